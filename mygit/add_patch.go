@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+type PatchModeHunkKind int
+
+const (
+	PatchModeContent    PatchModeHunkKind = iota // A hunk of the lines changed in a text file
+	PatchModeBinary                              // A change to the content of a binary file, staged whole
+	PatchModeDeletion                            // The deletion of a file
+	PatchModeModeChange                          // A change to a file's mode, e.g. chmod +x
+)
+
+// Represents a change which can be chosen to be staged or not in patch mode: a hunk of a file's diff, or a change to
+// the whole file. A content hunk covers the ops of the file's diff from start to end (exclusive).
+type PatchModeHunk struct {
+	kind   PatchModeHunkKind
+	hunk   *DiffHunk
+	start  int
+	end    int
+	staged bool
+}
+
+// Represents a file with unstaged changes, along with the hunks of them which may be staged
+type PatchModeFile struct {
+	change    *DiffFileChange
+	header    string // The lines of the file's diff before its first hunk, e.g. diff --git a/file b/file
+	body      string // The rest of the file's diff: its hunks, or the line saying that a binary file differs
+	modeLines string // The lines of the header giving the file's old and new modes, if they differ
+	ops       []*DiffOp
+	hunks     []*PatchModeHunk
+}
+
+// The help shown for each of the responses to the prompt for a hunk, as in Git
+var PATCH_MODE_HELP = []struct {
+	response    string
+	description string
+}{
+	{"y", "stage this hunk"},
+	{"n", "do not stage this hunk"},
+	{"q", "quit; do not stage this hunk or any of the remaining ones"},
+	{"a", "stage this hunk and all later hunks in the file"},
+	{"d", "do not stage this hunk or any of the later hunks in the file"},
+	{"s", "split the current hunk into smaller hunks"},
+	{"?", "print help"},
+}
+
+// Interactively chooses which of the unstaged changes to the tracked files at or within the given paths (or to every
+// tracked file, if none are given) to stage, as git add -p does. Each file's diff is shown hunk by hunk, and the user
+// is prompted on the terminal to stage each hunk or not. A hunk containing several changes separated by unchanged
+// lines can be split into a hunk for each change. Once every hunk has been answered (or the user quits), the index
+// entry of each file is updated to a new blob containing the index's content with only the chosen hunks applied, so
+// that the rest of the changes stay unstaged in the working tree. Deleting a file or changing its mode is offered as
+// a hunk of its own, as is any change to a binary file. Untracked files and files with merge conflicts are skipped.
+func AddPatch(paths []string, input io.Reader, repoDir string) error {
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read Git index file: %s", err)
+	}
+	unmergedPaths := make(map[string]bool)
+	for _, path := range getUnmergedPaths(index.entries) {
+		unmergedPaths[path] = true
+	}
+	workingTreeFiles, err := getWorkingTreeDiffFiles(index, repoDir)
+	if err != nil {
+		return err
+	}
+	algorithm, err := getDiffAlgorithm("", repoDir)
+	if err != nil {
+		return err
+	}
+	diffOptions := DiffOptions{algorithm: algorithm}
+
+	files := []*PatchModeFile{}
+	for _, change := range diffFileSets(getIndexDiffFiles(index), workingTreeFiles) {
+		if !isWithinPaths(change.path, paths) || unmergedPaths[change.path] || change.oldFile.mode == GITLINK_MODE {
+			continue
+		}
+		file, err := newPatchModeFile(change, diffOptions, repoDir)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		fmt.Println("No changes.")
+		return nil
+	}
+
+	colorizer, err := newColorizer(nil, "diff", os.Stdout, repoDir)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(input)
+	for _, file := range files {
+		if quit := file.selectHunks(reader, colorizer); quit {
+			break
+		}
+	}
+
+	newEntries := index.entries
+	for _, file := range files {
+		if newEntries, err = file.stageHunks(newEntries, repoDir); err != nil {
+			return err
+		}
+	}
+	sort.Slice(newEntries, func(i int, j int) bool {
+		return newEntries[i].path < newEntries[j].path
+	})
+
+	if err := writeUpdatedIndex(indexLock, index, newEntries); err != nil {
+		return fmt.Errorf("failed to write updated Git index file: %s", err)
+	}
+	return nil
+}
+
+// Splits the unstaged change to a file into the hunks which may be staged
+func newPatchModeFile(change *DiffFileChange, diffOptions DiffOptions, repoDir string) (*PatchModeFile, error) {
+	patch, err := change.formatPatch(diffOptions, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %s: %s", change.path, err)
+	}
+	file := &PatchModeFile{change: change, header: patch, hunks: []*PatchModeHunk{}}
+
+	// The header is everything before the first hunk (or the line saying that a binary file differs)
+	lines := strings.SplitAfter(patch, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "@@ ") || strings.HasPrefix(line, "Binary files ") {
+			file.header, file.body = strings.Join(lines[:i], ""), strings.Join(lines[i:], "")
+			break
+		}
+	}
+
+	// As in Git, a deletion is shown as a hunk of its own, including the header lines describing it
+	if change.newFile == nil {
+		file.header, file.body, _ = strings.Cut(patch, "\n")
+		file.header += "\n"
+		file.hunks = append(file.hunks, &PatchModeHunk{kind: PatchModeDeletion})
+		return file, nil
+	}
+	if change.oldFile.mode != change.newFile.mode {
+		file.hunks = append(file.hunks, &PatchModeHunk{kind: PatchModeModeChange})
+	}
+
+	// As in Git, a mode change is shown as a hunk of its own, after the rest of the header, rather than within it
+	headerLines := []string{}
+	for _, line := range strings.SplitAfter(file.header, "\n") {
+		if strings.HasPrefix(line, "old mode ") || strings.HasPrefix(line, "new mode ") {
+			file.modeLines += line
+		} else {
+			headerLines = append(headerLines, line)
+		}
+	}
+	file.header = strings.Join(headerLines, "")
+	if change.oldFile.hash == change.newFile.hash {
+		return file, nil
+	}
+
+	oldContent, newContent, err := change.readContents(nil, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	if isBinaryContent(oldContent) || isBinaryContent(newContent) {
+		file.hunks = append(file.hunks, &PatchModeHunk{kind: PatchModeBinary})
+		return file, nil
+	}
+
+	file.ops = diffLines(splitLines(oldContent), splitLines(newContent), diffOptions)
+	opIndexes := make(map[*DiffOp]int, len(file.ops))
+	for i, op := range file.ops {
+		opIndexes[op] = i
+	}
+	for _, hunk := range groupDiffHunks(file.ops, DIFF_CONTEXT_LINES, diffOptions) {
+		start := opIndexes[hunk.ops[0]]
+		file.hunks = append(file.hunks, &PatchModeHunk{kind: PatchModeContent, hunk: hunk, start: start, end: start + len(hunk.ops)})
+	}
+	return file, nil
+}
+
+// Shows each of the file's hunks and prompts the user whether to stage it, reading their responses from the given
+// reader, until every hunk has been answered (or the input ends). Returns whether the user quit, so that no further
+// files are shown.
+func (f *PatchModeFile) selectHunks(reader *bufio.Reader, colorizer Colorizer) bool {
+	showHeader := true
+	for i := 0; i < len(f.hunks); {
+		hunk := f.hunks[i]
+		if showHeader {
+			fmt.Print(colorPatch(f.header, colorizer))
+			showHeader = false
+		}
+		fmt.Print(colorPatch(f.formatHunk(hunk), colorizer))
+
+		splittable := len(f.splitHunk(hunk)) > 1
+		responses := "y,n,q,a,d"
+		if splittable {
+			responses += ",s"
+		}
+		fmt.Printf("(%d/%d) %s [%s,?]? ", i+1, len(f.hunks), hunk.kind.prompt(), responses)
+
+		// As in Git, the end of the input leaves the rest of the file's hunks unstaged
+		response, err := reader.ReadString('\n')
+		if err != nil && response == "" {
+			break
+		}
+		response = strings.ToLower(strings.TrimSpace(response))
+		if response == "" {
+			continue
+		}
+
+		switch response[0] {
+		case 'y':
+			hunk.staged = true
+			i++
+		case 'n':
+			i++
+		case 'q':
+			fmt.Println()
+			return true
+		case 'a', 'd':
+			for _, laterHunk := range f.hunks[i:] {
+				laterHunk.staged = response[0] == 'a'
+			}
+			i = len(f.hunks)
+		case 's':
+			if !splittable {
+				fmt.Fprintln(os.Stderr, "Sorry, cannot split this hunk")
+				continue
+			}
+			subHunks := f.splitHunk(hunk)
+			fmt.Printf("Split into %d hunks.\n", len(subHunks))
+			f.hunks = append(f.hunks[:i], append(subHunks, f.hunks[i+1:]...)...)
+		default:
+			for _, help := range PATCH_MODE_HELP {
+				if help.response != "s" || splittable {
+					fmt.Printf("%s - %s\n", help.response, help.description)
+				}
+			}
+		}
+	}
+	fmt.Println()
+	return false
+}
+
+// Formats the hunk as it's shown before prompting for it. A deletion shows the rest of the file's diff, and a mode
+// change the old and new modes.
+func (f *PatchModeFile) formatHunk(hunk *PatchModeHunk) string {
+	switch hunk.kind {
+	case PatchModeContent:
+		return hunk.hunk.format()
+	case PatchModeBinary, PatchModeDeletion:
+		return f.body
+	default:
+		return f.modeLines
+	}
+}
+
+// Splits a content hunk into a hunk for each run of changed lines within it, each surrounded by all of the unchanged
+// lines between it and the runs before and after it, as Git does. Returns just the hunk if it can't be split.
+func (f *PatchModeFile) splitHunk(hunk *PatchModeHunk) []*PatchModeHunk {
+	if hunk.kind != PatchModeContent {
+		return []*PatchModeHunk{hunk}
+	}
+
+	blocks := findDiffChangeBlocks(f.ops[hunk.start:hunk.end], DiffOptions{})
+	if len(blocks) < 2 {
+		return []*PatchModeHunk{hunk}
+	}
+	subHunks := []*PatchModeHunk{}
+	for i := range blocks {
+		start, end := hunk.start, hunk.end
+		if i > 0 {
+			start = hunk.start + blocks[i-1].end
+		}
+		if i < len(blocks)-1 {
+			end = hunk.start + blocks[i+1].start
+		}
+		subHunks = append(subHunks, &PatchModeHunk{kind: PatchModeContent, hunk: newDiffHunk(f.ops, start, end), start: start, end: end})
+	}
+	return subHunks
+}
+
+// Updates the file's index entry (within the given entries) to stage the chosen hunks, returning the new entries
+func (f *PatchModeFile) stageHunks(entries []*IndexEntry, repoDir string) ([]*IndexEntry, error) {
+	stagedFile := &DiffFileVersion{hash: f.change.oldFile.hash, mode: f.change.oldFile.mode}
+	stagedLines := make(map[int]bool)
+	for _, hunk := range f.hunks {
+		if !hunk.staged {
+			continue
+		}
+		switch hunk.kind {
+		case PatchModeDeletion:
+			stagedFile = nil
+		case PatchModeModeChange:
+			stagedFile.mode = f.change.newFile.mode
+		case PatchModeBinary:
+			stagedFile.hash = f.change.newFile.hash
+		case PatchModeContent:
+			for i := hunk.start; i < hunk.end; i++ {
+				stagedLines[i] = true
+			}
+		}
+	}
+
+	// The staged content keeps each unchanged line, and each changed line on the side chosen for its hunk
+	if len(stagedLines) > 0 {
+		var content strings.Builder
+		for i, op := range f.ops {
+			if op.opType == DiffEqual || (op.opType == DiffInsert) == stagedLines[i] {
+				content.WriteString(op.line)
+			}
+		}
+		hash, err := CreateObjectFile(Blob, []byte(content.String()), repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write staged content of %s: %s", f.change.path, err)
+		}
+		stagedFile.hash = hash
+	}
+
+	if stagedFile != nil && isSameFileVersion(stagedFile, f.change.oldFile) {
+		return entries, nil
+	}
+	newEntries := []*IndexEntry{}
+	for _, entry := range entries {
+		if entry.path != f.change.path {
+			newEntries = append(newEntries, entry)
+		}
+	}
+	if stagedFile != nil {
+		newEntries = append(newEntries, newTreeIndexEntry(f.change.path, stagedFile, 0))
+	}
+	return newEntries, nil
+}
+
+// Returns the question asked about a hunk of the given kind, as in Git
+func (k PatchModeHunkKind) prompt() string {
+	switch k {
+	case PatchModeDeletion:
+		return "Stage deletion"
+	case PatchModeModeChange:
+		return "Stage mode change"
+	default:
+		return "Stage this hunk"
+	}
+}
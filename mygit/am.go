@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Represents the options for applying patch emails as commits
+type AmOptions struct {
+	signoff bool // Adds a Signed-off-by trailer for the committer to each commit's message
+}
+
+// Represents a patch email parsed into the commit it describes
+type MailPatch struct {
+	author  CommitUser
+	subject string // The subject, without its [PATCH] prefix
+	message string // The commit message: the subject, followed by the body up to the --- line
+	patch   string // The rest of the email, containing the diff
+}
+
+// Matches the line separating the emails in a mailbox, e.g. one written by format-patch
+var MBOX_FROM_LINE_REGEX = regexp.MustCompile(`^From \S+ +\S{3} \S{3} +\d+ \d+:\d+:\d+ \d{4}`)
+
+// Applies the patches in the given mailboxes (or read from stdin, if none are given) as commits on top of HEAD, as
+// git am does. Each email is parsed for the author, date, and message of its commit (see parseMailPatch), and its
+// patch is applied to HEAD's files and checked out, as with merge, before being committed. The index must match
+// HEAD. If a patch doesn't apply, the commits made for the patches before it are kept, and an error is returned
+// naming the failed patch. As with merge, the commit HEAD was at beforehand is recorded as ORIG_HEAD.
+func Am(mailboxPaths []string, options AmOptions, repoDir string) error {
+	mails := []string{}
+	if len(mailboxPaths) == 0 {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read patches from stdin: %s", err)
+		}
+		mails = splitMailbox(string(data))
+	}
+	for _, path := range mailboxPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s", path, err)
+		}
+		mails = append(mails, splitMailbox(string(data))...)
+	}
+	if len(mails) == 0 {
+		return fmt.Errorf("patch format detection failed")
+	}
+
+	headCommitHash, commitsExist, err := ResolveHead("", repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve HEAD: %s", err)
+	}
+	headFiles := map[string]*DiffFileVersion{}
+	if commitsExist {
+		if headFiles, err = getHeadDiffFiles(repoDir); err != nil {
+			return err
+		}
+	}
+
+	// As in Git, the patches are applied to HEAD, so any changes staged in the index would be lost
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read Git index file: %s", err)
+	}
+	if len(getUnmergedPaths(index.entries)) > 0 {
+		return fmt.Errorf("you need to resolve your current index first")
+	}
+	stagedPaths := []string{}
+	for _, change := range diffFileSets(headFiles, getIndexDiffFiles(index)) {
+		stagedPaths = append(stagedPaths, change.path)
+	}
+	if len(stagedPaths) > 0 {
+		return fmt.Errorf("Dirty index: cannot apply patches (dirty: %s)", strings.Join(stagedPaths, " "))
+	}
+
+	committer, err := getCommitUser(CommitCommitter, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to determine committer: %s", err)
+	}
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return err
+	}
+	if commitsExist {
+		if err := writeOrigHead(headCommitHash, repoDir); err != nil {
+			return err
+		}
+	}
+
+	for i, mailContent := range mails {
+		mailPatch, err := parseMailPatch(mailContent)
+		if err != nil {
+			return fmt.Errorf("failed to parse patch %d: %s", i+1, err)
+		}
+		fmt.Printf("Applying: %s\n", mailPatch.subject)
+
+		filePatches, err := parsePatch(mailPatch.patch)
+		if err == nil && len(filePatches) == 0 {
+			err = fmt.Errorf("patch is empty")
+		}
+		var newFiles map[string]*DiffFileVersion
+		if err == nil {
+			newFiles, err = applyFilePatches(headFiles, filePatches, "index", repoDir)
+		}
+		if err == nil {
+			err = checkoutTreeFiles(headFiles, newFiles, false, "am", converter, repoDir)
+		}
+		if err != nil {
+			return fmt.Errorf("%s\nPatch failed at %04d %s", err, i+1, mailPatch.subject)
+		}
+
+		treeHash, err := createTreeObjectFromFiles(newFiles, repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to create patched tree: %s", err)
+		}
+		message := mailPatch.message
+		if options.signoff {
+			message = addSignoff(message, *committer)
+		}
+		parentCommitHashes := []string{}
+		expectedOldHash := NULL_OBJECT_HASH
+		if commitsExist {
+			parentCommitHashes, expectedOldHash = []string{headCommitHash}, headCommitHash
+		}
+		commitObj, err := createCommitObject(treeHash, parentCommitHashes, mailPatch.author, *committer, message, repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to create commit: %s", err)
+		}
+		if err := UpdateRef("HEAD", commitObj.hash, expectedOldHash, repoDir); err != nil {
+			return fmt.Errorf("failed to update current branch reference: %s", err)
+		}
+
+		headCommitHash, commitsExist, headFiles = commitObj.hash, true, newFiles
+	}
+
+	return nil
+}
+
+// Splits a mailbox into its emails, each of which starts with a From line (see MBOX_FROM_LINE_REGEX). Content which
+// doesn't start with one is taken to be a single email, e.g. a patch saved from a mail client.
+func splitMailbox(data string) []string {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	if !MBOX_FROM_LINE_REGEX.MatchString(data) {
+		if strings.TrimSpace(data) == "" {
+			return []string{}
+		}
+		return []string{data}
+	}
+
+	mails := []string{}
+	var curr strings.Builder
+	for _, line := range strings.SplitAfter(data, "\n") {
+		if MBOX_FROM_LINE_REGEX.MatchString(line) {
+			if curr.Len() > 0 {
+				mails = append(mails, curr.String())
+			}
+			curr.Reset()
+			continue
+		}
+		curr.WriteString(line)
+	}
+	if curr.Len() > 0 {
+		mails = append(mails, curr.String())
+	}
+	return mails
+}
+
+// Parses a patch email (without its mbox From line) into the commit it describes, as git mailinfo does. The author
+// and date are taken from the From and Date headers, and the message from the Subject header (stripped of any [PATCH]
+// prefix and Re:) and the body up to the --- line which separates it from the diffstat and diff. The body may start
+// with its own From, Subject, and Date lines, e.g. when someone sends a patch written by someone else, which take
+// precedence over the headers.
+func parseMailPatch(mailContent string) (*MailPatch, error) {
+	headerBlock, body, _ := strings.Cut(mailContent, "\n\n")
+	headers, err := parseMailHeaders(headerBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err = decodeMailBody(body, headers["content-transfer-encoding"])
+	if err != nil {
+		return nil, err
+	}
+
+	// In-body headers are only recognized at the very start of the body, and end at the first blank line
+	trimmedBody := strings.TrimLeft(body, "\n")
+	if inBodyBlock, rest, found := strings.Cut(trimmedBody, "\n\n"); found && isMailHeaderBlock(inBodyBlock) {
+		inBodyHeaders, err := parseMailHeaders(inBodyBlock)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range inBodyHeaders {
+			headers[name] = value
+		}
+		body = rest
+	}
+
+	if headers["from"] == "" {
+		return nil, fmt.Errorf("missing author (no From header)")
+	}
+	author, err := parseMailAuthor(headers["from"])
+	if err != nil {
+		return nil, err
+	}
+	if date := headers["date"]; date != "" {
+		if author.dateSeconds, author.timezone, err = parseCommitDate(date); err != nil {
+			return nil, err
+		}
+	} else {
+		clock, err := getObjectClock()
+		if err != nil {
+			return nil, err
+		}
+		now := clock.Now()
+		_, offset := now.Zone()
+		author.dateSeconds, author.timezone = now.Unix(), formatTimezone(offset)
+	}
+
+	// The message ends at the first line separating it from the patch: the --- before the diffstat, or the start of
+	// the diff itself if there isn't one
+	lines := strings.SplitAfter(body, "\n")
+	messageEnd := len(lines)
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, " \t\n")
+		if trimmed == "---" || strings.HasPrefix(trimmed, "diff -") || strings.HasPrefix(trimmed, "Index: ") {
+			messageEnd = i
+			break
+		}
+	}
+	subject := cleanMailSubject(headers["subject"])
+	messageBody := strings.TrimSpace(strings.Join(lines[:messageEnd], ""))
+	message := subject + "\n"
+	if messageBody != "" {
+		message += "\n" + messageBody + "\n"
+	}
+
+	return &MailPatch{
+		author:  *author,
+		subject: subject,
+		message: cleanupCommitMessage(message, false),
+		patch:   strings.Join(lines[messageEnd:], ""),
+	}, nil
+}
+
+// Parses the headers of an email, keyed by their lowercased names. Headers continued onto indented lines are unfolded,
+// and RFC 2047 encoded words (e.g. =?UTF-8?q?Ren=C3=A9?=) are decoded.
+func parseMailHeaders(headerBlock string) (map[string]string, error) {
+	headers := make(map[string]string)
+	decoder := &mime.WordDecoder{}
+	lastName := ""
+	for _, line := range strings.Split(headerBlock, "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && lastName != "" {
+			headers[lastName] += line
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		lastName = strings.ToLower(strings.TrimSpace(name))
+		headers[lastName] = value
+	}
+
+	for name, value := range headers {
+		decoded, err := decoder.DecodeHeader(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %s", name, err)
+		}
+		headers[name] = decoded
+	}
+	return headers, nil
+}
+
+// Returns whether the block of lines at the start of an email's body are in-body headers
+func isMailHeaderBlock(block string) bool {
+	for _, line := range strings.Split(block, "\n") {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		if name = strings.ToLower(name); name != "from" && name != "subject" && name != "date" {
+			return false
+		}
+	}
+	return true
+}
+
+// Decodes an email's body from its content transfer encoding
+func decodeMailBody(body string, encoding string) (string, error) {
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(body)))
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted-printable body: %s", err)
+		}
+		return string(decoded), nil
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 body: %s", err)
+		}
+		return strings.ReplaceAll(string(decoded), "\r\n", "\n"), nil
+	default:
+		return body, nil
+	}
+}
+
+// Parses the author of a patch from the From header of its email, e.g. `A U Thor <author@example.com>`
+func parseMailAuthor(from string) (*CommitUser, error) {
+	address, err := mail.ParseAddress(from)
+	if err == nil {
+		name := address.Name
+		if name == "" {
+			name, _, _ = strings.Cut(address.Address, "@")
+		}
+		return &CommitUser{name: name, email: address.Address}, nil
+	}
+
+	// Mail clients don't always quote names as they should, e.g. `Thor, A U <author@example.com>`
+	name, email, found := strings.Cut(from, "<")
+	if !found || !strings.HasSuffix(strings.TrimSpace(email), ">") {
+		return nil, fmt.Errorf("invalid author: %s", from)
+	}
+	return &CommitUser{name: strings.Trim(strings.TrimSpace(name), `"`), email: strings.TrimSuffix(strings.TrimSpace(email), ">")}, nil
+}
+
+// Removes the prefixes which mail clients and format-patch add to the subject of a patch email: any number of Re:
+// prefixes and bracketed groups such as [PATCH 1/2], along with any whitespace around them
+func cleanMailSubject(subject string) string {
+	subject = strings.Join(strings.Fields(subject), " ")
+	for {
+		trimmed := strings.TrimLeft(subject, " \t:")
+		if len(trimmed) >= 3 && strings.EqualFold(trimmed[:3], "re:") {
+			trimmed = trimmed[3:]
+		} else if strings.HasPrefix(trimmed, "[") {
+			if end := strings.Index(trimmed, "]"); end >= 0 {
+				trimmed = trimmed[end+1:]
+			}
+		}
+		if trimmed == subject {
+			return strings.TrimSpace(subject)
+		}
+		subject = trimmed
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Represents the changes a patch makes to a single file, parsed from a diff in Git's extended format (as written by
+// diff and format-patch). oldPath is empty for a created file, and newPath for a deleted file.
+type FilePatch struct {
+	oldPath string
+	newPath string
+	oldMode FileMode // Zero unless the patch gives the file's old mode
+	newMode FileMode // Zero unless the patch gives the file's new mode
+	binary  bool
+	hunks   []*PatchHunk
+}
+
+// Represents a hunk of a patch: the lines it expects to find in the file from oldStart on (its context and deleted
+// lines), and the lines it replaces them with (its context and inserted lines). The lines keep their line endings,
+// so a line without one is the last line of a file which doesn't end in a newline.
+type PatchHunk struct {
+	oldStart int // The 1-indexed line at which the hunk starts in the old file (or, if it has no old lines, before)
+	newStart int // The 1-indexed line at which the hunk starts in the new file (or, if it has no new lines, before)
+	oldLines []string
+	newLines []string
+	trailing int // The number of lines of context after the hunk's changes
+}
+
+// Matches the header of a hunk, e.g. @@ -1,5 +1,6 @@ (the counts are 1 if omitted)
+var HUNK_HEADER_REGEX = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// Represents the options for applying patches with apply
+type ApplyOptions struct {
+	reverse bool // Undoes the changes the patches make, rather than making them (-R)
+	cached  bool // Applies the patches to the index, leaving the working tree alone (--cached)
+	index   bool // Applies the patches to both the index and the working tree (--index)
+	check   bool // Only checks whether the patches apply, without changing anything (--check)
+}
+
+// Applies the patches in the given files (or read from stdin, if none are given), as git apply does. By default, the
+// working tree files the patches change are patched, whether or not they're tracked, and the index is left alone.
+// With cached, the index is patched instead, and with index, both are: the files the patches change must then be
+// unchanged in the working tree from their index entries, so that no uncommitted work is overwritten. Either way, the
+// patches are applied all together or not at all.
+func Apply(patchPaths []string, options ApplyOptions, repoDir string) error {
+	patches := []string{}
+	if len(patchPaths) == 0 {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read patch from stdin: %s", err)
+		}
+		patches = append(patches, string(data))
+	}
+	for _, path := range patchPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s", path, err)
+		}
+		patches = append(patches, string(data))
+	}
+
+	filePatches := []*FilePatch{}
+	for _, patch := range patches {
+		parsed, err := parsePatch(patch)
+		if err != nil {
+			return err
+		}
+		filePatches = append(filePatches, parsed...)
+	}
+	if len(filePatches) == 0 {
+		return fmt.Errorf("no valid patches in input")
+	}
+	if options.reverse {
+		for _, filePatch := range filePatches {
+			filePatch.reverse()
+		}
+	}
+
+	if !options.cached && !options.index {
+		files, err := getPatchedWorkingTreeFiles(filePatches, repoDir)
+		if err != nil {
+			return err
+		}
+		newFiles, err := applyFilePatches(files, filePatches, "working tree", repoDir)
+		if err != nil || options.check {
+			return err
+		}
+		return writePatchedWorkingTreeFiles(files, newFiles, repoDir)
+	}
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read Git index file: %s", err)
+	}
+	if len(getUnmergedPaths(index.entries)) > 0 {
+		return fmt.Errorf("you need to resolve your current index first")
+	}
+	indexFiles := getIndexDiffFiles(index)
+	newFiles, err := applyFilePatches(indexFiles, filePatches, "index", repoDir)
+	if err != nil || options.check {
+		return err
+	}
+
+	if options.index {
+		converter, err := newContentConverter(repoDir)
+		if err != nil {
+			return err
+		}
+		return checkoutTreeFiles(indexFiles, newFiles, false, "apply", converter, repoDir)
+	}
+	return writePatchedIndexFiles(newFiles, repoDir)
+}
+
+// Reads the working tree files which the patches change or create (keyed by path), storing them as blobs so that
+// they can be patched like the files of the index. Files which don't exist are left out.
+func getPatchedWorkingTreeFiles(filePatches []*FilePatch, repoDir string) (map[string]*DiffFileVersion, error) {
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*DiffFileVersion)
+	for _, filePatch := range filePatches {
+		for _, path := range []string{filePatch.oldPath, filePatch.newPath} {
+			if path == "" || files[path] != nil {
+				continue
+			}
+
+			fullPath := filepath.Join(repoDir, path)
+			info, err := os.Lstat(fullPath)
+			if err != nil && os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to stat file %s: %s", path, err)
+			}
+			if info.IsDir() {
+				continue
+			}
+
+			blobObj, err := CreateBlobObjectFromFile(fullPath, converter, repoDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read file %s: %s", path, err)
+			}
+			files[path] = &DiffFileVersion{hash: blobObj.hash, mode: getGitModeFromFileMode(info.Mode())}
+		}
+	}
+
+	return files, nil
+}
+
+// Writes the patched working tree files, removing those which the patches deleted (or renamed)
+func writePatchedWorkingTreeFiles(files map[string]*DiffFileVersion, newFiles map[string]*DiffFileVersion, repoDir string) error {
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return err
+	}
+	trustExecutableBit, err := getTrustExecutableBit(repoDir)
+	if err != nil {
+		return err
+	}
+	indexModTime := getIndexModTime(repoDir)
+
+	for path, file := range files {
+		if newFiles[path] == nil {
+			if err := removeIndexEntryFile(newTreeIndexEntry(path, file, 0), repoDir); err != nil {
+				return err
+			}
+		}
+	}
+	for path, file := range newFiles {
+		if isSameFileVersion(files[path], file) {
+			continue
+		}
+		if _, err := checkoutIndexEntry(newTreeIndexEntry(path, file, 0), path, true, trustExecutableBit, indexModTime, converter, repoDir); err != nil {
+			return fmt.Errorf("failed to write %s: %s", path, err)
+		}
+	}
+
+	return nil
+}
+
+// Replaces the index's entries with the patched files, keeping the entries of the files which weren't changed
+func writePatchedIndexFiles(newFiles map[string]*DiffFileVersion, repoDir string) error {
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return err
+	}
+
+	newEntries := []*IndexEntry{}
+	keptPaths := make(map[string]bool, len(index.entries))
+	for _, entry := range index.entries {
+		curr := &DiffFileVersion{hash: hex.EncodeToString(entry.sha1[:]), mode: entry.mode}
+		if isSameFileVersion(curr, newFiles[entry.path]) {
+			newEntries = append(newEntries, entry)
+			keptPaths[entry.path] = true
+		}
+	}
+	for path, file := range newFiles {
+		if !keptPaths[path] {
+			newEntries = append(newEntries, newTreeIndexEntry(path, file, 0))
+		}
+	}
+
+	if err := writeUpdatedIndex(indexLock, index, newEntries); err != nil {
+		return fmt.Errorf("failed to write updated Git index file: %s", err)
+	}
+	return nil
+}
+
+// Parses a patch into the changes it makes to each file. Anything before the first file's diff (e.g. a commit message
+// and diffstat) is skipped, as is anything after a file's hunks which isn't another diff (e.g. an email signature).
+func parsePatch(patch string) ([]*FilePatch, error) {
+	lines := strings.SplitAfter(patch, "\n")
+	filePatches := []*FilePatch{}
+
+	for i := 0; i < len(lines); {
+		line := strings.TrimRight(lines[i], "\n")
+		if !strings.HasPrefix(line, "diff --git ") {
+			i++
+			continue
+		}
+
+		filePatch, next, err := parseFilePatch(lines, i)
+		if err != nil {
+			return nil, err
+		}
+		filePatches = append(filePatches, filePatch)
+		i = next
+	}
+
+	return filePatches, nil
+}
+
+// Parses the diff of a single file, starting at its diff --git line, returning the index of the line after it
+func parseFilePatch(lines []string, start int) (*FilePatch, int, error) {
+	header := strings.TrimRight(lines[start], "\n")
+	filePatch := &FilePatch{hunks: []*PatchHunk{}}
+
+	// The paths are given by the --- and +++ lines, or for a change without a content diff, by the diff --git line
+	// itself. A path containing spaces is ambiguous there, unless the old and new paths are the same.
+	gitPaths := strings.TrimPrefix(header, "diff --git ")
+	if half := (len(gitPaths) - 1) / 2; len(gitPaths)%2 == 1 && gitPaths[half] == ' ' && strings.HasPrefix(gitPaths, "a/") && gitPaths[half+1:] == "b/"+gitPaths[2:half] {
+		filePatch.oldPath, filePatch.newPath = gitPaths[2:half], gitPaths[2:half]
+	} else if oldPath, newPath, ok := strings.Cut(gitPaths, " b/"); ok && strings.HasPrefix(oldPath, "a/") {
+		filePatch.oldPath, filePatch.newPath = unquotePatchPath(oldPath)[2:], newPath
+	} else if unquoted := unquotePatchPaths(gitPaths); len(unquoted) == 2 {
+		filePatch.oldPath, filePatch.newPath = strings.TrimPrefix(unquoted[0], "a/"), strings.TrimPrefix(unquoted[1], "b/")
+	}
+
+	i := start + 1
+	for ; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\n")
+		var err error
+		switch {
+		case strings.HasPrefix(line, "old mode "):
+			filePatch.oldMode, err = parsePatchMode(line, "old mode ")
+		case strings.HasPrefix(line, "new mode "):
+			filePatch.newMode, err = parsePatchMode(line, "new mode ")
+		case strings.HasPrefix(line, "deleted file mode "):
+			filePatch.oldMode, err = parsePatchMode(line, "deleted file mode ")
+			filePatch.newPath = ""
+		case strings.HasPrefix(line, "new file mode "):
+			filePatch.newMode, err = parsePatchMode(line, "new file mode ")
+			filePatch.oldPath = ""
+		case strings.HasPrefix(line, "rename from "), strings.HasPrefix(line, "copy from "):
+			_, path, _ := strings.Cut(line, " from ")
+			filePatch.oldPath = unquotePatchPath(path)
+		case strings.HasPrefix(line, "rename to "), strings.HasPrefix(line, "copy to "):
+			_, path, _ := strings.Cut(line, " to ")
+			filePatch.newPath = unquotePatchPath(path)
+		case strings.HasPrefix(line, "index "), strings.HasPrefix(line, "similarity index "), strings.HasPrefix(line, "dissimilarity index "):
+		case strings.HasPrefix(line, "Binary files "), line == "GIT binary patch":
+			filePatch.binary = true
+		case strings.HasPrefix(line, "--- "):
+			if path := parsePatchFileName(line, "--- ", "a/"); path != "" {
+				filePatch.oldPath = path
+			}
+		case strings.HasPrefix(line, "+++ "):
+			if path := parsePatchFileName(line, "+++ ", "b/"); path != "" {
+				filePatch.newPath = path
+			}
+		case strings.HasPrefix(line, "@@ "):
+			hunk, next, err := parsePatchHunk(lines, i)
+			if err != nil {
+				return nil, -1, fmt.Errorf("corrupt patch for %s at line %d: %s", filePatch.getPath(), i+1, err)
+			}
+			filePatch.hunks = append(filePatch.hunks, hunk)
+			i = next - 1
+		default:
+			return filePatch, i, nil
+		}
+		if err != nil {
+			return nil, -1, err
+		}
+	}
+
+	return filePatch, i, nil
+}
+
+// Parses a hunk starting at its @@ header line, returning the index of the line after it
+func parsePatchHunk(lines []string, start int) (*PatchHunk, int, error) {
+	match := HUNK_HEADER_REGEX.FindStringSubmatch(lines[start])
+	if match == nil {
+		return nil, -1, fmt.Errorf("invalid hunk header %s", strings.TrimSpace(lines[start]))
+	}
+	counts := make([]int, 4)
+	for j, group := range match[1:] {
+		counts[j] = 1
+		if group != "" {
+			counts[j], _ = strconv.Atoi(group)
+		}
+	}
+	hunk := &PatchHunk{oldStart: counts[0], newStart: counts[2], oldLines: []string{}, newLines: []string{}}
+	oldRemaining, newRemaining := counts[1], counts[3]
+
+	i := start + 1
+	seenChange := false
+	var lastType byte
+	for ; i < len(lines) && (oldRemaining > 0 || newRemaining > 0 || strings.HasPrefix(lines[i], "\\")); i++ {
+		line := lines[i]
+		if line == "\n" {
+			// Some mailers strip the space from an empty context line
+			line = " \n"
+		}
+		if line == "" {
+			break
+		}
+
+		text := line[1:]
+		switch line[0] {
+		case ' ':
+			hunk.oldLines = append(hunk.oldLines, text)
+			hunk.newLines = append(hunk.newLines, text)
+			oldRemaining, newRemaining = oldRemaining-1, newRemaining-1
+			if seenChange {
+				hunk.trailing++
+			}
+		case '-':
+			hunk.oldLines = append(hunk.oldLines, text)
+			oldRemaining--
+			seenChange, hunk.trailing = true, 0
+		case '+':
+			hunk.newLines = append(hunk.newLines, text)
+			newRemaining--
+			seenChange, hunk.trailing = true, 0
+		case '\\':
+			// "\ No newline at end of file" applies to the line before it
+			if lastType == ' ' || lastType == '-' {
+				hunk.oldLines[len(hunk.oldLines)-1] = strings.TrimSuffix(hunk.oldLines[len(hunk.oldLines)-1], "\n")
+			}
+			if lastType == ' ' || lastType == '+' {
+				hunk.newLines[len(hunk.newLines)-1] = strings.TrimSuffix(hunk.newLines[len(hunk.newLines)-1], "\n")
+			}
+		default:
+			return nil, -1, fmt.Errorf("unexpected line %q", strings.TrimRight(line, "\n"))
+		}
+		lastType = line[0]
+
+		if oldRemaining < 0 || newRemaining < 0 {
+			return nil, -1, fmt.Errorf("hunk has more lines than its header gives")
+		}
+	}
+	if oldRemaining > 0 || newRemaining > 0 {
+		return nil, -1, fmt.Errorf("hunk has fewer lines than its header gives")
+	}
+
+	return hunk, i, nil
+}
+
+func parsePatchMode(line string, prefix string) (FileMode, error) {
+	mode, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, prefix)), 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode in patch: %s", line)
+	}
+	return FileMode(mode), nil
+}
+
+// Parses the file name from a --- or +++ line, without its a/ or b/ prefix, returning an empty string for /dev/null
+func parsePatchFileName(line string, marker string, prefix string) string {
+	name := strings.TrimPrefix(line, marker)
+	if !strings.HasPrefix(name, `"`) {
+		// Diffs made by other tools may follow the name with a tab and a timestamp
+		name, _, _ = strings.Cut(name, "\t")
+	}
+	name = unquotePatchPath(name)
+	if name == "/dev/null" {
+		return ""
+	}
+	return strings.TrimPrefix(name, prefix)
+}
+
+// Unquotes a path which Git quoted in a patch because it contains special characters, e.g. "a/caf\303\251.txt"
+func unquotePatchPath(path string) string {
+	if !strings.HasPrefix(path, `"`) {
+		return path
+	}
+	if unquoted, err := strconv.Unquote(path); err == nil {
+		return unquoted
+	}
+	return path
+}
+
+// Splits the paths of a diff --git line in which either path is quoted
+func unquotePatchPaths(paths string) []string {
+	unquoted := []string{}
+	for paths != "" {
+		paths = strings.TrimLeft(paths, " ")
+		if !strings.HasPrefix(paths, `"`) {
+			path, rest, _ := strings.Cut(paths, " ")
+			unquoted, paths = append(unquoted, path), rest
+			continue
+		}
+
+		end := 1
+		for end < len(paths) && paths[end] != '"' {
+			if paths[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(paths) {
+			return unquoted
+		}
+		unquoted, paths = append(unquoted, unquotePatchPath(paths[:end+1])), paths[end+1:]
+	}
+	return unquoted
+}
+
+// Returns the path of the file the patch changes: its new path, or its old path if it's deleted
+func (p *FilePatch) getPath() string {
+	if p.newPath != "" {
+		return p.newPath
+	}
+	return p.oldPath
+}
+
+// Reverses the patch, so that applying it undoes the changes it makes (as with git apply -R): it then creates the
+// files it deleted, deletes the files it created, and turns each hunk's inserted lines back into its deleted lines
+func (p *FilePatch) reverse() {
+	p.oldPath, p.newPath = p.newPath, p.oldPath
+	p.oldMode, p.newMode = p.newMode, p.oldMode
+	for _, hunk := range p.hunks {
+		hunk.oldStart, hunk.newStart = hunk.newStart, hunk.oldStart
+		hunk.oldLines, hunk.newLines = hunk.newLines, hunk.oldLines
+	}
+}
+
+// Applies the patches to the given files (keyed by path), as git apply does, returning the new set of files. The files
+// are those of the target named in errors (the index or the working tree). Patched content is written as blobs. Each hunk must match the file exactly, although it may be found at a different line
+// than the patch gives (e.g. if lines were added earlier in the file), with the nearest match being used. As in Git,
+// a hunk starting at the first line must match at the start of the file, and one without trailing context at its end.
+func applyFilePatches(files map[string]*DiffFileVersion, filePatches []*FilePatch, target string, repoDir string) (map[string]*DiffFileVersion, error) {
+	newFiles := make(map[string]*DiffFileVersion, len(files))
+	for path, file := range files {
+		newFiles[path] = file
+	}
+
+	for _, filePatch := range filePatches {
+		path := filePatch.getPath()
+		if filePatch.binary {
+			return nil, fmt.Errorf("cannot apply binary patch to '%s'", path)
+		}
+
+		var oldFile *DiffFileVersion
+		if filePatch.oldPath != "" {
+			oldFile = files[filePatch.oldPath]
+			if oldFile == nil {
+				return nil, fmt.Errorf("%s: does not exist in %s", filePatch.oldPath, target)
+			}
+		} else if files[filePatch.newPath] != nil {
+			return nil, fmt.Errorf("%s: already exists in %s", filePatch.newPath, target)
+		}
+
+		oldContent, err := oldFile.readContent(filePatch.oldPath, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		newContent, err := applyPatchHunks(oldContent, filePatch.hunks)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		if filePatch.oldPath != "" && filePatch.oldPath != filePatch.newPath {
+			delete(newFiles, filePatch.oldPath)
+		}
+		if filePatch.newPath == "" {
+			if len(newContent) > 0 {
+				return nil, fmt.Errorf("%s: removal patch leaves file contents", path)
+			}
+			continue
+		}
+
+		mode := filePatch.newMode
+		if mode == 0 && oldFile != nil {
+			mode = oldFile.mode
+		} else if mode == 0 {
+			mode = REGULAR_FILE_MODE
+		}
+		newHash := ""
+		if oldFile != nil && len(filePatch.hunks) == 0 {
+			newHash = oldFile.hash
+		} else if newHash, err = CreateObjectFile(Blob, newContent, repoDir); err != nil {
+			return nil, fmt.Errorf("failed to write patched %s: %s", path, err)
+		}
+		newFiles[filePatch.newPath] = &DiffFileVersion{hash: newHash, mode: mode}
+	}
+
+	return newFiles, nil
+}
+
+// Applies the hunks to the content of a file in order, returning the patched content
+func applyPatchHunks(content []byte, hunks []*PatchHunk) ([]byte, error) {
+	lines := splitLines(content)
+	newLines := []string{}
+	pos, offset := 0, 0
+
+	for _, hunk := range hunks {
+		// A hunk with no old lines gives the line after which its lines are inserted
+		expected := hunk.oldStart - 1 + offset
+		if len(hunk.oldLines) == 0 {
+			expected = hunk.oldStart + offset
+		}
+		matchStart := hunk.oldStart <= 1
+		matchEnd := hunk.trailing == 0
+
+		start := findPatchHunk(lines, hunk.oldLines, pos, expected, matchStart, matchEnd)
+		if start < 0 {
+			return nil, fmt.Errorf("patch does not apply (hunk at line %d)", hunk.oldStart)
+		}
+
+		newLines = append(newLines, lines[pos:start]...)
+		newLines = append(newLines, hunk.newLines...)
+		pos = start + len(hunk.oldLines)
+		offset = start - (hunk.oldStart - 1)
+		if len(hunk.oldLines) == 0 {
+			offset = start - hunk.oldStart
+		}
+	}
+	newLines = append(newLines, lines[pos:]...)
+
+	return []byte(strings.Join(newLines, "")), nil
+}
+
+// Finds where the hunk's old lines appear in the file's lines at or after minStart, returning the position nearest
+// to the expected one, or -1 if they don't appear
+func findPatchHunk(lines []string, oldLines []string, minStart int, expected int, matchStart bool, matchEnd bool) int {
+	candidates := []int{}
+	for start := minStart; start+len(oldLines) <= len(lines); start++ {
+		if matchStart && start != 0 {
+			continue
+		}
+		if matchEnd && start+len(oldLines) != len(lines) {
+			continue
+		}
+		if slicesEqualAt(lines, oldLines, start) {
+			candidates = append(candidates, start)
+		}
+	}
+	if len(candidates) == 0 {
+		return -1
+	}
+
+	sort.SliceStable(candidates, func(i int, j int) bool {
+		return absInt(candidates[i]-expected) < absInt(candidates[j]-expected)
+	})
+	return candidates[0]
+}
+
+// Returns whether the lines starting at start are the expected lines
+func slicesEqualAt(lines []string, expected []string, start int) bool {
+	for i, line := range expected {
+		if lines[start+i] != line {
+			return false
+		}
+	}
+	return true
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Represents the file format of an archive made by the archive command
+type ArchiveFormat int
+
+const (
+	ArchiveTar ArchiveFormat = iota
+	ArchiveZip
+)
+
+func (f ArchiveFormat) toString() string {
+	switch f {
+	case ArchiveTar:
+		return "tar"
+	case ArchiveZip:
+		return "zip"
+	default:
+		return "unknown"
+	}
+}
+
+func archiveFormatFromString(name string) (ArchiveFormat, error) {
+	for _, format := range []ArchiveFormat{ArchiveTar, ArchiveZip} {
+		if format.toString() == name {
+			return format, nil
+		}
+	}
+	return -1, fmt.Errorf("unknown archive format '%s'", name)
+}
+
+// Returns the format of an archive written to the given file, inferred from its extension as in Git, or tar if the
+// extension isn't recognized
+func archiveFormatFromPath(path string) ArchiveFormat {
+	if strings.HasSuffix(path, ".zip") {
+		return ArchiveZip
+	}
+	return ArchiveTar
+}
+
+// Represents the options controlling how an archive is made
+type ArchiveOptions struct {
+	format ArchiveFormat
+	prefix string // Prepended to the path of every entry, e.g. project-1.0/ to unpack into its own directory
+}
+
+// Represents a file or directory in an archive
+type ArchiveEntry struct {
+	path    string // Including the archive's prefix, and ending with a slash for a directory
+	mode    FileMode
+	content []byte // The file's content as it would be checked out, or the target of a symbolic link
+}
+
+// Writes an archive of the files in the given tree-ish (a commit, tag, or tree) to the writer, as `git archive` does.
+// Each file's content is what would be checked out (so line endings and filter drivers are applied, using the
+// tree's own .gitattributes), and files with the export-ignore attribute are left out. Every entry is given the
+// commit's committer date (or, for a tree, the current time), and a submodule is archived as an empty directory.
+// Entries are written as the tree is walked, so only one file's content is held in memory at a time.
+func WriteArchive(w io.Writer, treeish string, options ArchiveOptions, repoDir string) error {
+	_, objHash, err := resolveRevision(treeish, repoDir)
+	if err != nil {
+		return err
+	}
+	objHash, objType, err := peelObject(objHash, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", treeish, err)
+	}
+
+	commitHash, treeHash, modTime := "", objHash, systemClock.Now()
+	switch objType {
+	case Commit:
+		commitObj, err := ReadCommitObjectFile(objHash, repoDir)
+		if err != nil {
+			return err
+		}
+		commitHash, treeHash, modTime = commitObj.hash, commitObj.treeHash, time.Unix(commitObj.committer.dateSeconds, 0)
+	case Tree:
+	default:
+		return fmt.Errorf("not a tree object: %s", treeish)
+	}
+
+	converter, err := newTreeContentConverter(treeHash, repoDir)
+	if err != nil {
+		return err
+	}
+
+	bufferedWriter := bufio.NewWriter(w)
+	var archiver ArchiveWriter
+	switch options.format {
+	case ArchiveTar:
+		umask, err := getTarUmask(repoDir)
+		if err != nil {
+			return err
+		}
+		archiver, err = newTarArchiveWriter(bufferedWriter, commitHash, modTime, umask)
+		if err != nil {
+			return err
+		}
+	case ArchiveZip:
+		archiver, err = newZipArchiveWriter(bufferedWriter, commitHash, modTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.prefix != "" && strings.HasSuffix(options.prefix, "/") {
+		if err := archiver.writeEntry(&ArchiveEntry{path: options.prefix, mode: DIRECTORY_MODE}); err != nil {
+			return err
+		}
+	}
+	if err := writeArchiveTree(archiver, treeHash, "", options.prefix, converter, repoDir); err != nil {
+		return err
+	}
+	if err := archiver.close(); err != nil {
+		return err
+	}
+	return bufferedWriter.Flush()
+}
+
+// Writes an entry for everything in the tree, depth first and in the tree's order, as Git does
+func writeArchiveTree(archiver ArchiveWriter, treeHash string, treePath string, prefix string, converter *ContentConverter, repoDir string) error {
+	treeObj, err := ReadTreeObjectFile(treeHash, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read tree object file: %s", err)
+	}
+
+	for _, treeEntry := range treeObj.entries {
+		path := treePath + treeEntry.name
+		if value, _ := converter.attributes.get(path, "export-ignore"); value == ATTRIBUTE_SET {
+			continue
+		}
+
+		switch treeEntry.mode {
+		case DIRECTORY_MODE:
+			if err := archiver.writeEntry(&ArchiveEntry{path: prefix + path + "/", mode: DIRECTORY_MODE}); err != nil {
+				return err
+			}
+			if err := writeArchiveTree(archiver, treeEntry.hash, path+"/", prefix, converter, repoDir); err != nil {
+				return err
+			}
+		case GITLINK_MODE:
+			if err := archiver.writeEntry(&ArchiveEntry{path: prefix + path + "/", mode: DIRECTORY_MODE}); err != nil {
+				return err
+			}
+		default:
+			blobObj, err := ReadBlobObjectFile(treeEntry.hash, repoDir)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %s", path, err)
+			}
+			content := blobObj.content
+			if treeEntry.mode != SYMBOLIC_LINK_MODE {
+				content, err = converter.toWorkingTree(filepath.Join(repoDir, filepath.FromSlash(path)), content)
+				if err != nil {
+					return err
+				}
+			}
+			if err := archiver.writeEntry(&ArchiveEntry{path: prefix + path, mode: treeEntry.mode, content: content}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Writes the entries of an archive in a particular format
+type ArchiveWriter interface {
+	writeEntry(entry *ArchiveEntry) error
+	close() error
+}
+
+// The permissions removed from the entries of tar archives by default, so that they're group-writable but not
+// world-writable, as in Git
+const DEFAULT_TAR_UMASK = 0o002
+
+// Returns the umask applied to the permissions of the entries of tar archives, set by the tar.umask config variable
+// (in octal)
+func getTarUmask(repoDir string) (int64, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read config: %s", err)
+	}
+	value, isSet := config.get("tar.umask")
+	if !isSet {
+		return DEFAULT_TAR_UMASK, nil
+	}
+	umask, err := strconv.ParseInt(value, 8, 64)
+	if err != nil {
+		return -1, fmt.Errorf("invalid tar.umask: %s", value)
+	}
+	return umask, nil
+}
+
+// Writes a tar archive laid out as Git does: a pax global header recording the commit (if any), then an entry owned
+// by root for each file and directory, and padding to a whole number of 10 KiB records
+type TarArchiveWriter struct {
+	writer    *CountingWriter
+	tarWriter *tar.Writer
+	modTime   time.Time
+	umask     int64
+}
+
+func newTarArchiveWriter(w io.Writer, commitHash string, modTime time.Time, umask int64) (*TarArchiveWriter, error) {
+	countingWriter := &CountingWriter{writer: w}
+	archiver := &TarArchiveWriter{writer: countingWriter, tarWriter: tar.NewWriter(countingWriter), modTime: modTime, umask: umask}
+
+	if commitHash != "" {
+		globalHeader := &tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": commitHash}}
+		if err := archiver.tarWriter.WriteHeader(globalHeader); err != nil {
+			return nil, fmt.Errorf("failed to write archive: %s", err)
+		}
+	}
+	return archiver, nil
+}
+
+func (a *TarArchiveWriter) writeEntry(entry *ArchiveEntry) error {
+	header := &tar.Header{Name: entry.path, ModTime: a.modTime, Uname: "root", Gname: "root", Format: tar.FormatPAX}
+	switch entry.mode {
+	case DIRECTORY_MODE:
+		header.Typeflag, header.Mode = tar.TypeDir, 0o777&^a.umask
+	case SYMBOLIC_LINK_MODE:
+		header.Typeflag, header.Mode, header.Linkname = tar.TypeSymlink, 0o777, string(entry.content)
+	case EXECUTABLE_FILE_MODE:
+		header.Typeflag, header.Mode, header.Size = tar.TypeReg, 0o777&^a.umask, int64(len(entry.content))
+	default:
+		header.Typeflag, header.Mode, header.Size = tar.TypeReg, 0o666&^a.umask, int64(len(entry.content))
+	}
+
+	if err := a.tarWriter.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write archive entry %s: %s", entry.path, err)
+	}
+	if header.Typeflag == tar.TypeReg {
+		if _, err := a.tarWriter.Write(entry.content); err != nil {
+			return fmt.Errorf("failed to write archive entry %s: %s", entry.path, err)
+		}
+	}
+	return nil
+}
+
+func (a *TarArchiveWriter) close() error {
+	if err := a.tarWriter.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %s", err)
+	}
+	const recordSize = 20 * 512
+	if remainder := a.writer.count % recordSize; remainder != 0 {
+		if _, err := a.writer.Write(make([]byte, recordSize-remainder)); err != nil {
+			return fmt.Errorf("failed to write archive: %s", err)
+		}
+	}
+	return nil
+}
+
+// Writes a zip archive laid out as Git does: each file is deflated, executable files and symbolic links record their
+// Unix modes, and the archive's comment is the commit (if any)
+type ZipArchiveWriter struct {
+	zipWriter *zip.Writer
+	modTime   time.Time
+}
+
+func newZipArchiveWriter(w io.Writer, commitHash string, modTime time.Time) (*ZipArchiveWriter, error) {
+	archiver := &ZipArchiveWriter{zipWriter: zip.NewWriter(w), modTime: modTime}
+	if commitHash != "" {
+		if err := archiver.zipWriter.SetComment(commitHash); err != nil {
+			return nil, fmt.Errorf("failed to write archive: %s", err)
+		}
+	}
+	return archiver, nil
+}
+
+func (a *ZipArchiveWriter) writeEntry(entry *ArchiveEntry) error {
+	header := &zip.FileHeader{Name: entry.path, Modified: a.modTime, Method: zip.Deflate}
+	switch entry.mode {
+	case DIRECTORY_MODE:
+		header.Method = zip.Store
+		header.SetMode(os.ModeDir | 0o755)
+	case SYMBOLIC_LINK_MODE:
+		header.Method = zip.Store
+		header.SetMode(os.ModeSymlink | 0o777)
+	case EXECUTABLE_FILE_MODE:
+		header.SetMode(0o755)
+	}
+
+	fileWriter, err := a.zipWriter.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to write archive entry %s: %s", entry.path, err)
+	}
+	if _, err := fileWriter.Write(entry.content); err != nil {
+		return fmt.Errorf("failed to write archive entry %s: %s", entry.path, err)
+	}
+	return nil
+}
+
+func (a *ZipArchiveWriter) close() error {
+	if err := a.zipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %s", err)
+	}
+	return nil
+}
+
+// Counts the bytes written through it
+type CountingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *CountingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The values of an attribute which is set (e.g. `diff`) or unset (e.g. `-diff`) rather than given a value (e.g.
+// `diff=pdf`), as shown by git check-attr
+const (
+	ATTRIBUTE_SET   = "set"
+	ATTRIBUTE_UNSET = "unset"
+)
+
+// Represents a line of a gitattributes file, giving attributes to the paths matching its pattern
+type AttributeRule struct {
+	pattern    string
+	attributes map[string]string
+}
+
+// Represents the attributes rules of a repository, in increasing order of precedence
+type Attributes struct {
+	rules []*AttributeRule
+}
+
+// Reads the attributes rules of the repository from the same files as Git, in increasing order of precedence: the
+// file given by the core.attributesFile config variable, the .gitattributes file at the top level of the working
+// tree, and .git/info/attributes. .gitattributes files in subdirectories aren't read.
+func readAttributes(repoDir string) (*Attributes, error) {
+	gitattributesPath := filepath.Join(repoDir, ".gitattributes")
+	content, err := os.ReadFile(gitattributesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read attributes file %s: %s", gitattributesPath, err)
+	}
+	return readAttributesWithGitattributes(content, repoDir)
+}
+
+// Reads the attributes rules of the repository as readAttributes does, but with the .gitattributes file at the top
+// level of the given tree in place of the one in the working tree
+func readTreeAttributes(treeHash string, repoDir string) (*Attributes, error) {
+	blobHash, exists, err := findFileInTree(treeHash, ".gitattributes", repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	if exists {
+		blobObj, err := ReadBlobObjectFile(blobHash, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read .gitattributes in tree %s: %s", treeHash, err)
+		}
+		content = blobObj.content
+	}
+	return readAttributesWithGitattributes(content, repoDir)
+}
+
+// Reads the attributes rules of the repository, given the content of its top-level .gitattributes file (or nil)
+func readAttributesWithGitattributes(gitattributes []byte, repoDir string) (*Attributes, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %s", err)
+	}
+
+	attributes := &Attributes{rules: []*AttributeRule{}}
+	if attributesFile, isSet := config.get("core.attributesFile"); isSet && attributesFile != "" {
+		attributesFile, err = expandConfigPath(attributesFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := attributes.readFile(attributesFile); err != nil {
+			return nil, err
+		}
+	}
+
+	attributes.rules = append(attributes.rules, parseAttributes(string(gitattributes))...)
+
+	if err := attributes.readFile(filepath.Join(getCommonDir(repoDir), "info", "attributes")); err != nil {
+		return nil, err
+	}
+
+	return attributes, nil
+}
+
+// Adds the rules of the given attributes file, if it exists
+func (a *Attributes) readFile(attributesPath string) error {
+	content, err := os.ReadFile(attributesPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read attributes file %s: %s", attributesPath, err)
+	}
+	a.rules = append(a.rules, parseAttributes(string(content))...)
+	return nil
+}
+
+// Parses the lines of a gitattributes file, each of which is a pattern followed by attributes: `attr` sets the
+// attribute, `-attr` unsets it, `attr=value` gives it a value, and `!attr` leaves it unspecified. Blank lines and
+// comments are skipped. As in Git, `binary` is a macro which also unsets the diff, merge, and text attributes.
+func parseAttributes(content string) []*AttributeRule {
+	rules := []*AttributeRule{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		rule := &AttributeRule{pattern: fields[0], attributes: map[string]string{}}
+		for _, field := range fields[1:] {
+			switch {
+			case strings.HasPrefix(field, "-"):
+				rule.attributes[field[1:]] = ATTRIBUTE_UNSET
+			case strings.HasPrefix(field, "!"):
+				rule.attributes[field[1:]] = ""
+			case strings.Contains(field, "="):
+				name, value, _ := strings.Cut(field, "=")
+				rule.attributes[name] = value
+			case field == "binary":
+				rule.attributes[field] = ATTRIBUTE_SET
+				for _, name := range []string{"diff", "merge", "text"} {
+					rule.attributes[name] = ATTRIBUTE_UNSET
+				}
+			default:
+				rule.attributes[field] = ATTRIBUTE_SET
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Returns the value of the named attribute for the given path (relative to the top level of the working tree), and
+// whether it's specified. As in Git, the last matching rule which mentions the attribute wins.
+func (a *Attributes) get(path string, name string) (string, bool) {
+	for i := len(a.rules) - 1; i >= 0; i-- {
+		rule := a.rules[i]
+		value, exists := rule.attributes[name]
+		if !exists || !rule.matches(path) {
+			continue
+		}
+		return value, value != ""
+	}
+	return "", false
+}
+
+// Matches a path against the rule's pattern. As in Git, a pattern without a slash matches the name of a file at any
+// depth, and otherwise it matches the path from the top level of the working tree.
+func (r *AttributeRule) matches(path string) bool {
+	pattern := r.pattern
+	if !strings.Contains(pattern, "/") {
+		return matchConfigPattern(pattern, filepath.Base(path), false)
+	}
+	return matchConfigPattern(strings.TrimPrefix(pattern, "/"), path, false)
+}
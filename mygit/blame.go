@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The number of hex digits of commit hashes shown by blame (as in Git, one more than the usual abbreviation)
+const BLAME_ABBREV_HASH_LENGTH = 8
+
+// Represents a run of consecutive lines of the blamed file which were last changed by the same commit
+type BlameEntry struct {
+	commitObj  *CommitObject
+	boundary   bool   // Whether the commit has no parent, so the lines may have originated before it
+	prevHash   string // The parent commit whose version of the file the lines were absent from, if it had the file
+	origStart  int    // 0-indexed line number of the first line in the commit's version of the file
+	finalStart int    // 0-indexed line number of the first line in the blamed version of the file
+	numLines   int
+	lines      []string
+}
+
+// Represents the options controlling how lines are attributed to commits by blame
+type BlameOptions struct {
+	startLine int // 0-indexed, inclusive
+	endLine   int // 0-indexed, exclusive. -1 means the end of the file
+	diff      DiffOptions
+}
+
+// A line of the blamed file which hasn't been attributed to a commit yet, along with its position in the version of
+// the file currently being examined
+type blameSuspectLine struct {
+	origLine  int
+	finalLine int
+}
+
+// Attributes each line of the given file (as of the given commit) to the commit which last changed it, by walking
+// the first-parent history of the commit and diffing each version of the file against the previous one. The blame
+// entries are passed to emit as soon as they're found, i.e. starting from the most recent commits, which allows the
+// output to be streamed.
+func Blame(path string, commitHash string, options BlameOptions, emit func(*BlameEntry) error, repoDir string) error {
+	commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read commit %s: %s", commitHash, err)
+	}
+
+	blobHash, exists, err := findFileInTree(commitObj.treeHash, path, repoDir)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no such path '%s' in %s", path, commitHash)
+	}
+
+	finalLines, err := getBlobLines(blobHash, nil, repoDir)
+	if err != nil {
+		return err
+	}
+
+	endLine := options.endLine
+	if endLine == -1 {
+		endLine = len(finalLines)
+	}
+	if options.startLine < 0 || options.startLine >= max(len(finalLines), 1) || endLine > len(finalLines) || endLine < options.startLine {
+		return fmt.Errorf("file %s has only %d %s", path, len(finalLines), pluralize(len(finalLines), "line", "lines"))
+	}
+
+	suspects := []*blameSuspectLine{}
+	for i := options.startLine; i < endLine; i++ {
+		suspects = append(suspects, &blameSuspectLine{origLine: i, finalLine: i})
+	}
+	currLines := finalLines
+
+	for len(suspects) > 0 {
+		if len(commitObj.parentCommitHashes) == 0 {
+			return emitBlameEntries(commitObj, true, "", suspects, finalLines, emit)
+		}
+
+		parentCommitObj, err := ReadCommitObjectFile(commitObj.parentCommitHashes[0], repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to read commit %s: %s", commitObj.parentCommitHashes[0], err)
+		}
+
+		parentBlobHash, existsInParent, err := findFileInTree(parentCommitObj.treeHash, path, repoDir)
+		if err != nil {
+			return err
+		}
+		if !existsInParent {
+			return emitBlameEntries(commitObj, false, "", suspects, finalLines, emit)
+		}
+
+		// The file is unchanged, so every line is passed on to the parent as is
+		if parentBlobHash == blobHash {
+			commitObj = parentCommitObj
+			continue
+		}
+
+		parentLines, err := getBlobLines(parentBlobHash, nil, repoDir)
+		if err != nil {
+			return err
+		}
+
+		parentLineNums := mapLinesToParent(parentLines, currLines, options.diff)
+		passedSuspects, blamedSuspects := []*blameSuspectLine{}, []*blameSuspectLine{}
+		for _, suspect := range suspects {
+			if parentLineNum, inParent := parentLineNums[suspect.origLine]; inParent {
+				suspect.origLine = parentLineNum
+				passedSuspects = append(passedSuspects, suspect)
+			} else {
+				blamedSuspects = append(blamedSuspects, suspect)
+			}
+		}
+
+		if err := emitBlameEntries(commitObj, false, parentCommitObj.hash, blamedSuspects, finalLines, emit); err != nil {
+			return err
+		}
+
+		suspects = passedSuspects
+		commitObj, blobHash, currLines = parentCommitObj, parentBlobHash, parentLines
+	}
+
+	return nil
+}
+
+// Diffs the parent's version of a file against the current version, returning a mapping from the number of each
+// current line which is unchanged from the parent to its number in the parent
+func mapLinesToParent(parentLines []string, currLines []string, diffOptions DiffOptions) map[int]int {
+	parentLineNums := make(map[int]int)
+	for _, op := range diffLines(parentLines, currLines, diffOptions) {
+		if op.opType == DiffEqual {
+			parentLineNums[op.newLineNum] = op.oldLineNum
+		}
+	}
+	return parentLineNums
+}
+
+// Groups the lines attributed to a commit into entries of consecutive lines, and emits them
+func emitBlameEntries(commitObj *CommitObject, boundary bool, prevHash string, suspects []*blameSuspectLine, finalLines []string, emit func(*BlameEntry) error) error {
+	var entry *BlameEntry
+	for _, suspect := range suspects {
+		if entry != nil && suspect.finalLine == entry.finalStart+entry.numLines && suspect.origLine == entry.origStart+entry.numLines {
+			entry.numLines += 1
+			entry.lines = append(entry.lines, finalLines[suspect.finalLine])
+			continue
+		}
+
+		if entry != nil {
+			if err := emit(entry); err != nil {
+				return err
+			}
+		}
+		entry = &BlameEntry{
+			commitObj:  commitObj,
+			boundary:   boundary,
+			prevHash:   prevHash,
+			origStart:  suspect.origLine,
+			finalStart: suspect.finalLine,
+			numLines:   1,
+			lines:      []string{finalLines[suspect.finalLine]},
+		}
+	}
+
+	if entry != nil {
+		return emit(entry)
+	}
+	return nil
+}
+
+// Looks up the blob hash of the file at the given path (relative to the repository root) within a tree
+func findFileInTree(treeHash string, path string, repoDir string) (string, bool, error) {
+	components := strings.Split(path, "/")
+	for i, component := range components {
+		treeObj, err := ReadTreeObjectFile(treeHash, repoDir)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read tree %s: %s", treeHash, err)
+		}
+
+		found := false
+		for _, entry := range treeObj.entries {
+			if entry.name != component {
+				continue
+			}
+
+			isLastComponent := i == len(components)-1
+			if isLastComponent && entry.objType == Blob {
+				return entry.hash, true, nil
+			} else if !isLastComponent && entry.objType == Tree {
+				treeHash = entry.hash
+				found = true
+			}
+			break
+		}
+
+		if !found {
+			return "", false, nil
+		}
+	}
+
+	return "", false, nil
+}
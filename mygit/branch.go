@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 )
 
 func CreateBranch(branchName string, repoDir string) error {
@@ -22,13 +23,15 @@ func CreateBranch(branchName string, repoDir string) error {
 		return fmt.Errorf("failed to create commit object from tree: %s", err)
 	}
 
-	branchRefPath := filepath.Join(repoDir, ".git", "refs", "heads", branchName)
-	_, err = os.Stat(branchRefPath)
-	if !os.IsNotExist(err) {
+	_, branchExists, err := ResolveBranchRef(branchName, "", repoDir)
+	if err != nil {
+		return err
+	}
+	if branchExists {
 		return fmt.Errorf("branch %s already exists", branchName)
 	}
 
-	err = UpdateBranchRef(branchName, commitObj.hash, false, repoDir)
+	err = UpdateBranchRef(branchName, commitObj.hash, "", repoDir)
 	if err != nil {
 		return fmt.Errorf("failed to create reference for new branch %s: %s", branchName, err)
 	}
@@ -36,35 +39,151 @@ func CreateBranch(branchName string, repoDir string) error {
 	return nil
 }
 
-func CheckoutBranch(branchName string, repoDir string) error {
-	headCommitHash, commitsExist, err := ResolveBranchRef(branchName, false, repoDir)
+// Checks out the given branch, and then runs the post-checkout hook. The hook can't undo the checkout, but its
+// failure is still reported, as in Git. Uncommitted changes are carried over to the branch, unless force is set, in
+// which case they're discarded (see CheckoutCommit).
+func CheckoutBranch(branchName string, force bool, repoDir string) error {
+	headCommitHash, commitsExist, err := ResolveBranchRef(branchName, "", repoDir)
 	if err != nil || !commitsExist {
 		return fmt.Errorf("no branch named %s found", branchName)
 	}
 
-	err = CheckoutCommit(headCommitHash, repoDir)
+	prevHead, _, err := ResolveHead("", repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve HEAD: %s", err)
+	}
+
+	err = CheckoutCommit(headCommitHash, force, repoDir)
 	if err != nil {
 		return fmt.Errorf("failed to checkout commit %s: %s", headCommitHash, err)
 	}
 
+	err = copyRunSh(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to copy mygit run.sh script into repository: %s", err)
+	}
+
 	err = updateRefsAfterCheckout(branchName, repoDir)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return runPostCheckoutHook(prevHead, headCommitHash, true, repoDir)
+}
+
+// Checks out the given commit with HEAD detached at it, rather than pointing to a branch, as with git checkout
+// <commit>, and then runs the post-checkout hook. Commits made on the detached HEAD only move HEAD, so they're lost
+// once another branch is checked out unless a branch is created for them.
+func CheckoutDetached(commitHash string, force bool, repoDir string) error {
+	prevHead, _, err := ResolveHead("", repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve HEAD: %s", err)
+	}
+
+	if err := CheckoutCommit(commitHash, force, repoDir); err != nil {
+		return fmt.Errorf("failed to checkout commit %s: %s", commitHash, err)
+	}
+
+	if err := copyRunSh(repoDir); err != nil {
+		return fmt.Errorf("failed to copy mygit run.sh script into repository: %s", err)
+	}
+
+	if err := DetachHead(commitHash, repoDir); err != nil {
+		return err
+	}
+
+	return runPostCheckoutHook(prevHead, commitHash, true, repoDir)
 }
 
 func updateRefsAfterCheckout(branchName string, repoDir string) error {
-	err := UpdateHeadWithBranchRef(branchName, false, repoDir)
+	err := UpdateHeadWithBranchRef(branchName, "", repoDir)
 	if err != nil {
 		return fmt.Errorf("failed to update local HEAD reference with branch %s: %s", branchName, err)
 	}
 
-	err = UpdateHeadWithBranchRef(branchName, true, repoDir)
+	err = UpdateHeadWithBranchRef(branchName, DEFAULT_REMOTE_NAME, repoDir)
 	if err != nil {
 		return fmt.Errorf("failed to update remote HEAD reference with branch %s: %s", branchName, err)
 	}
 
 	return nil
 }
+
+// Switches to a new orphan branch, which has no commits yet, as with git switch --orphan: HEAD points to the unborn
+// branch, the index is emptied, and the tracked files are removed from the working tree (untracked files are left
+// alone). The next commit is then a root commit, with no parents, which starts the branch's history (e.g. for a
+// gh-pages branch). As in Git, the switch is refused if there are uncommitted changes to tracked files, which would
+// otherwise be lost.
+func SwitchToOrphanBranch(branchName string, repoDir string) error {
+	branchRefName := getBranchRefName(branchName, "")
+	if err := validateRefName(branchRefName); err != nil {
+		return fmt.Errorf("'%s' is not a valid branch name", branchName)
+	}
+	_, branchExists, err := ResolveBranchRef(branchName, "", repoDir)
+	if err != nil {
+		return err
+	}
+	if branchExists {
+		return fmt.Errorf("a branch named '%s' already exists", branchName)
+	}
+
+	// Populated submodules are kept, so changes within them are never lost
+	status, err := GetRepoStatus(IgnoreSubmodulesAll, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to determine status of repository: %s", err)
+	}
+	changedPaths := []string{}
+	for _, file := range append(status.stagedFiles, status.notStagedFiles...) {
+		if !slices.Contains(changedPaths, file.path) {
+			changedPaths = append(changedPaths, file.path)
+		}
+	}
+	for _, file := range status.unmergedFiles {
+		changedPaths = append(changedPaths, file.path)
+	}
+	if len(changedPaths) > 0 {
+		sort.Strings(changedPaths)
+		return fmt.Errorf("your local changes to the following files would be overwritten by checkout:\n\t%s\nPlease commit your changes or stash them before you switch branches.", strings.Join(changedPaths, "\n\t"))
+	}
+
+	prevHead, _, err := ResolveHead("", repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve HEAD: %s", err)
+	}
+
+	if err := clearIndexAndTrackedFiles(repoDir); err != nil {
+		return err
+	}
+
+	if err := updateRefsAfterCheckout(branchName, repoDir); err != nil {
+		return err
+	}
+
+	return runPostCheckoutHook(prevHead, NULL_OBJECT_HASH, true, repoDir)
+}
+
+// Removes every file tracked in the index from the working tree, along with any directories left empty, and then
+// empties the index. Populated submodules are kept, as they are when checking out a commit.
+func clearIndexAndTrackedFiles(repoDir string) error {
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range index.entries {
+		if err := removeIndexEntryFile(entry, repoDir); err != nil {
+			return err
+		}
+	}
+
+	if err := writeIndex(indexLock, []*IndexEntry{}, nil); err != nil {
+		return fmt.Errorf("failed to write empty Git index file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The first line of a bundle file in each version of the format. Version 3 adds capabilities (such as the hash
+// algorithm), which are only written when they differ from version 2's defaults, so bundles are created as version 2.
+const BUNDLE_V2_SIGNATURE = "# v2 git bundle\n"
+const BUNDLE_V3_SIGNATURE = "# v3 git bundle\n"
+
+// Represents a bundle: a file holding a list of refs and a packfile with the objects needed for them, which stands in
+// for a remote repository that can be cloned or pulled from without a network connection. An incremental bundle
+// leaves out the history before some commits (its prerequisites), which must already be in the repository unbundling
+// it. The file is laid out as Git does, so bundles can be exchanged with Git:
+//
+//	# v2 git bundle
+//	-<prerequisite hash> <subject of the prerequisite commit>
+//	<ref hash> <ref name>
+//	<empty line>
+//	<packfile>
+type Bundle struct {
+	prerequisites []*BundlePrerequisite
+	refs          []*BundleRef
+	packfile      []byte
+}
+
+type BundlePrerequisite struct {
+	hash    string
+	comment string
+}
+
+type BundleRef struct {
+	name string
+	hash string
+}
+
+// Creates a bundle at the given path containing the refs named by the revisions, along with the history needed for
+// them. As with `git bundle create`, each revision may be a ref (e.g. main, v1.0, or HEAD), `--all` for every ref
+// and HEAD, `^<commit>` to leave out the history reachable from a commit, or `<commit>..<ref>` to include only the
+// history since a commit. The commits that are left out but whose children are included become the bundle's
+// prerequisites.
+func CreateBundle(bundlePath string, revisions []string, repoDir string) (*Bundle, error) {
+	bundle := &Bundle{prerequisites: []*BundlePrerequisite{}, refs: []*BundleRef{}}
+	tipHashes, excludedHashes := []string{}, []string{}
+
+	addRef := func(revision string) error {
+		refName, objHash, err := resolveRevision(revision, repoDir)
+		if err != nil {
+			return err
+		}
+		commitHash, err := resolveCommitish(objHash, repoDir)
+		if err != nil {
+			return fmt.Errorf("%s: %s", revision, err)
+		}
+		tipHashes = append(tipHashes, commitHash)
+
+		// Only refs are listed in the bundle, though the history of a bare commit hash is still included
+		if refName == "" || bundle.getRef(refName) != nil {
+			return nil
+		}
+		bundle.refs = append(bundle.refs, &BundleRef{name: refName, hash: objHash})
+		return nil
+	}
+
+	for _, revision := range revisions {
+		switch {
+		case revision == "--all":
+			refNames, err := listRefNames(repoDir)
+			if err != nil {
+				return nil, err
+			}
+			for _, refName := range refNames {
+				if err := addRef(refName); err != nil {
+					return nil, err
+				}
+			}
+			if _, commitsExist, err := ResolveHead("", repoDir); err == nil && commitsExist {
+				if err := addRef("HEAD"); err != nil {
+					return nil, err
+				}
+			}
+		case strings.HasPrefix(revision, "^"):
+			commitHash, err := resolveCommitish(revision[1:], repoDir)
+			if err != nil {
+				return nil, err
+			}
+			excludedHashes = append(excludedHashes, commitHash)
+		case strings.Contains(revision, ".."):
+			from, to, _ := strings.Cut(revision, "..")
+			if to == "" {
+				to = "HEAD"
+			}
+			commitHash, err := resolveCommitish(from, repoDir)
+			if err != nil {
+				return nil, err
+			}
+			excludedHashes = append(excludedHashes, commitHash)
+			if err := addRef(to); err != nil {
+				return nil, err
+			}
+		default:
+			if err := addRef(revision); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	excluded := make(map[string]bool)
+	for _, commitHash := range excludedHashes {
+		reachable, err := getReachableCommits(commitHash, false, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		for reachableHash := range reachable {
+			excluded[reachableHash] = true
+		}
+	}
+
+	// As in Git, a ref whose commit is left out isn't listed, and a bundle without any refs isn't created
+	includedRefs := []*BundleRef{}
+	for _, ref := range bundle.refs {
+		if commitHash, err := resolveCommitish(ref.hash, repoDir); err == nil && !excluded[commitHash] {
+			includedRefs = append(includedRefs, ref)
+		}
+	}
+	bundle.refs = includedRefs
+	if len(bundle.refs) == 0 {
+		return nil, fmt.Errorf("refusing to create empty bundle")
+	}
+
+	objHashes, err := bundle.collectObjects(tipHashes, excluded, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	bundle.packfile, err = CreatePackfile(objHashes, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create packfile: %s", err)
+	}
+
+	if err := bundle.write(bundlePath); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+func (b *Bundle) getRef(refName string) *BundleRef {
+	for _, ref := range b.refs {
+		if ref.name == refName {
+			return ref
+		}
+	}
+	return nil
+}
+
+// Returns the objects which the bundle's packfile must contain: the commits reachable from the tips but not excluded,
+// along with their trees and blobs, and any annotated tags that the bundle's refs point to. Excluded commits whose
+// children are included are recorded as the bundle's prerequisites, and the trees and blobs they contain are left
+// out, since the repository unbundling it must already have them.
+func (b *Bundle) collectObjects(tipHashes []string, excluded map[string]bool, repoDir string) ([]string, error) {
+	objHashes := []string{}
+	seen := make(map[string]bool)
+
+	commitHashes := []string{}
+	queue := tipHashes
+	for len(queue) > 0 {
+		commitHash := queue[0]
+		queue = queue[1:]
+		if seen[commitHash] || excluded[commitHash] {
+			continue
+		}
+		seen[commitHash] = true
+		commitHashes = append(commitHashes, commitHash)
+
+		commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %s: %s", commitHash, err)
+		}
+		for _, parentHash := range commitObj.parentCommitHashes {
+			if !excluded[parentHash] {
+				queue = append(queue, parentHash)
+				continue
+			}
+			if b.hasPrerequisite(parentHash) {
+				continue
+			}
+			parentObj, err := ReadCommitObjectFile(parentHash, repoDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read commit %s: %s", parentHash, err)
+			}
+			b.prerequisites = append(b.prerequisites, &BundlePrerequisite{hash: parentHash, comment: getCommitOnelineSubject(parentObj)})
+		}
+	}
+
+	// The contents of the prerequisites are marked as seen without being included
+	for _, prerequisite := range b.prerequisites {
+		commitObj, err := ReadCommitObjectFile(prerequisite.hash, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := collectTreeObjects(commitObj.treeHash, seen, repoDir); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, ref := range b.refs {
+		for objHash := ref.hash; !seen[objHash]; {
+			objType, err := getObjectType(objHash, repoDir)
+			if err != nil || objType != Tag {
+				break
+			}
+			seen[objHash] = true
+			objHashes = append(objHashes, objHash)
+
+			tagObj, err := ReadTagObjectFile(objHash, repoDir)
+			if err != nil {
+				return nil, err
+			}
+			objHash = tagObj.objectHash
+		}
+	}
+
+	for _, commitHash := range commitHashes {
+		commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		treeObjHashes, err := collectTreeObjects(commitObj.treeHash, seen, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		objHashes = append(objHashes, commitHash)
+		objHashes = append(objHashes, treeObjHashes...)
+	}
+
+	return objHashes, nil
+}
+
+func (b *Bundle) hasPrerequisite(commitHash string) bool {
+	for _, prerequisite := range b.prerequisites {
+		if prerequisite.hash == commitHash {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the objects in the tree (including the tree itself) which haven't been seen yet, marking them as seen. A
+// subtree which has already been seen is skipped entirely, since everything in it has been seen too.
+func collectTreeObjects(treeHash string, seen map[string]bool, repoDir string) ([]string, error) {
+	if seen[treeHash] {
+		return []string{}, nil
+	}
+	seen[treeHash] = true
+
+	treeObj, err := ReadTreeObjectFile(treeHash, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree object file: %s", err)
+	}
+
+	objHashes := []string{treeHash}
+	for _, entry := range treeObj.entries {
+		switch entry.objType {
+		case Blob:
+			if !seen[entry.hash] {
+				seen[entry.hash] = true
+				objHashes = append(objHashes, entry.hash)
+			}
+		case Tree:
+			subTreeObjHashes, err := collectTreeObjects(entry.hash, seen, repoDir)
+			if err != nil {
+				return nil, err
+			}
+			objHashes = append(objHashes, subTreeObjHashes...)
+		}
+	}
+	return objHashes, nil
+}
+
+// Writes the bundle to the given path, replacing it atomically (through a lock file) if it already exists
+func (b *Bundle) write(bundlePath string) error {
+	var header strings.Builder
+	header.WriteString(BUNDLE_V2_SIGNATURE)
+	for _, prerequisite := range b.prerequisites {
+		fmt.Fprintf(&header, "-%s %s\n", prerequisite.hash, prerequisite.comment)
+	}
+	for _, ref := range b.refs {
+		fmt.Fprintf(&header, "%s %s\n", ref.hash, ref.name)
+	}
+	header.WriteString("\n")
+
+	lock, err := acquireLockFile(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer lock.rollback()
+
+	if err := lock.write([]byte(header.String())); err != nil {
+		return err
+	}
+	if err := lock.write(b.packfile); err != nil {
+		return err
+	}
+	return lock.commit()
+}
+
+// Returns whether the path is a bundle file rather than the URL of a remote repository
+func isBundleFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	signature := make([]byte, len(BUNDLE_V2_SIGNATURE))
+	if _, err := io.ReadFull(file, signature); err != nil {
+		return false
+	}
+	return string(signature) == BUNDLE_V2_SIGNATURE || string(signature) == BUNDLE_V3_SIGNATURE
+}
+
+// Reads the bundle file at the given path, in version 2 or 3 of the format
+func readBundle(bundlePath string) (*Bundle, error) {
+	data, err := os.ReadFile(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open '%s'", bundlePath)
+	}
+
+	version := 2
+	if rest, isV2 := bytes.CutPrefix(data, []byte(BUNDLE_V2_SIGNATURE)); isV2 {
+		data = rest
+	} else if rest, isV3 := bytes.CutPrefix(data, []byte(BUNDLE_V3_SIGNATURE)); isV3 {
+		data, version = rest, 3
+	} else {
+		return nil, fmt.Errorf("'%s' does not look like a v2 or v3 bundle file", bundlePath)
+	}
+
+	bundle := &Bundle{prerequisites: []*BundlePrerequisite{}, refs: []*BundleRef{}}
+	for {
+		lineEnd := bytes.IndexByte(data, '\n')
+		if lineEnd == -1 {
+			return nil, fmt.Errorf("'%s' is truncated", bundlePath)
+		}
+		line := string(data[:lineEnd])
+		data = data[lineEnd+1:]
+		if line == "" {
+			break
+		}
+
+		if capability, isCapability := strings.CutPrefix(line, "@"); isCapability && version == 3 {
+			if capability != "object-format=sha1" {
+				return nil, fmt.Errorf("'%s' requires the unsupported capability %s", bundlePath, capability)
+			}
+			continue
+		}
+
+		if prerequisiteLine, isPrerequisite := strings.CutPrefix(line, "-"); isPrerequisite {
+			hash, comment, _ := strings.Cut(prerequisiteLine, " ")
+			if !isValidObjectHash(hash) {
+				return nil, fmt.Errorf("unrecognized header: %s", line)
+			}
+			bundle.prerequisites = append(bundle.prerequisites, &BundlePrerequisite{hash: hash, comment: comment})
+			continue
+		}
+
+		hash, refName, hasRefName := strings.Cut(line, " ")
+		if !hasRefName || !isValidObjectHash(hash) {
+			return nil, fmt.Errorf("unrecognized header: %s", line)
+		}
+		bundle.refs = append(bundle.refs, &BundleRef{name: refName, hash: hash})
+	}
+
+	if !bytes.HasPrefix(data, []byte(PACKFILE_SIGNATURE)) {
+		return nil, fmt.Errorf("'%s' does not contain a packfile", bundlePath)
+	}
+	bundle.packfile = data
+	return bundle, nil
+}
+
+// Returns the prerequisites of the bundle which are missing from the repository
+func (b *Bundle) getMissingPrerequisites(repoDir string) []*BundlePrerequisite {
+	missing := []*BundlePrerequisite{}
+	for _, prerequisite := range b.prerequisites {
+		if !objectExists(prerequisite.hash, repoDir) {
+			missing = append(missing, prerequisite)
+		}
+	}
+	return missing
+}
+
+// Checks that the repository has every prerequisite of the bundle, so that its packfile can be unpacked
+func (b *Bundle) checkPrerequisites(repoDir string) error {
+	missing := b.getMissingPrerequisites(repoDir)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	lines := []string{}
+	for _, prerequisite := range missing {
+		lines = append(lines, prerequisite.hash+" "+prerequisite.comment)
+	}
+	return fmt.Errorf("repository lacks these prerequisite commits:\n%s", strings.Join(lines, "\n"))
+}
+
+// Returns the bundle's refs in the form advertised by a remote repository, so that the bundle can be cloned or pulled
+// from. The remote HEAD's branch is guessed from the branches pointing to the same commit, since bundles don't record
+// which branch HEAD points to.
+func (b *Bundle) remoteRefs() *RemoteRefs {
+	remoteRefs := &RemoteRefs{refs: make(map[string]string), capabilities: []string{}}
+	for _, ref := range b.refs {
+		remoteRefs.refs[ref.name] = ref.hash
+	}
+	return remoteRefs
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Represents a node of the cache tree stored in the index's TREE extension. Each node records the tree object
+// hash for a directory in the index, so that write-tree doesn't need to recreate the tree objects for
+// directories in which nothing has changed. An entry count of -1 indicates that the node has been invalidated.
+type CacheTree struct {
+	name       string
+	entryCount int
+	hash       string
+	subtrees   []*CacheTree
+}
+
+// Parses the data of the TREE index extension, which stores the cache tree nodes in pre-order. Each node consists
+// of its NUL-terminated path component, the ASCII entry count and subtree count (separated by a space and
+// terminated by a newline), and the tree object hash (only present for valid nodes).
+func parseCacheTree(data []byte) (*CacheTree, error) {
+	cacheTree, i, err := parseCacheTreeNode(data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if i != len(data) {
+		return nil, fmt.Errorf("leftover data in cache tree extension")
+	}
+
+	return cacheTree, nil
+}
+
+func parseCacheTreeNode(data []byte, i int) (*CacheTree, int, error) {
+	nullByteIndex := bytes.IndexByte(data[i:], 0)
+	if nullByteIndex == -1 {
+		return nil, -1, fmt.Errorf("invalid cache tree entry: missing null byte separator")
+	}
+	name := string(data[i : i+nullByteIndex])
+	i += nullByteIndex + 1
+
+	newlineIndex := bytes.IndexByte(data[i:], '\n')
+	if newlineIndex == -1 {
+		return nil, -1, fmt.Errorf("invalid cache tree entry: missing newline separator")
+	}
+	counts := strings.Split(string(data[i:i+newlineIndex]), " ")
+	i += newlineIndex + 1
+	if len(counts) != 2 {
+		return nil, -1, fmt.Errorf("invalid cache tree entry: expected entry count and subtree count")
+	}
+
+	entryCount, err := strconv.Atoi(counts[0])
+	if err != nil {
+		return nil, -1, fmt.Errorf("invalid cache tree entry count: %s", err)
+	}
+	numSubtrees, err := strconv.Atoi(counts[1])
+	if err != nil || numSubtrees < 0 {
+		return nil, -1, fmt.Errorf("invalid cache tree subtree count: %s", counts[1])
+	}
+
+	cacheTree := &CacheTree{
+		name:       name,
+		entryCount: entryCount,
+		subtrees:   []*CacheTree{},
+	}
+
+	if entryCount >= 0 {
+		if i+OBJECT_HASH_LENGTH_BYTES > len(data) {
+			return nil, -1, fmt.Errorf("invalid cache tree entry: not long enough to contain SHA hash")
+		}
+		cacheTree.hash = hex.EncodeToString(data[i : i+OBJECT_HASH_LENGTH_BYTES])
+		i += OBJECT_HASH_LENGTH_BYTES
+	}
+
+	for range numSubtrees {
+		var subtree *CacheTree
+		subtree, i, err = parseCacheTreeNode(data, i)
+		if err != nil {
+			return nil, -1, err
+		}
+		cacheTree.subtrees = append(cacheTree.subtrees, subtree)
+	}
+
+	return cacheTree, i, nil
+}
+
+func (ct *CacheTree) serialize() []byte {
+	var buf bytes.Buffer
+	ct.serializeNode(&buf)
+	return buf.Bytes()
+}
+
+func (ct *CacheTree) serializeNode(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "%s\x00%d %d\n", ct.name, ct.entryCount, len(ct.subtrees))
+	if ct.entryCount >= 0 {
+		hashBytes, _ := hex.DecodeString(ct.hash)
+		buf.Write(hashBytes)
+	}
+
+	for _, subtree := range ct.subtrees {
+		subtree.serializeNode(buf)
+	}
+}
+
+func (ct *CacheTree) isValid() bool {
+	return ct.entryCount >= 0
+}
+
+// Invalidates the nodes for every directory containing the given path, since the tree objects recorded for
+// those directories no longer reflect the index
+func (ct *CacheTree) invalidatePath(path string) {
+	ct.entryCount = -1
+
+	name, rest, found := strings.Cut(path, "/")
+	if !found {
+		return
+	}
+
+	for _, subtree := range ct.subtrees {
+		if subtree.name == name {
+			subtree.invalidatePath(rest)
+			return
+		}
+	}
+}
+
+// Invalidates the cache tree for every path whose index entry was added, removed, or changed between the old
+// and new sets of index entries
+func (ct *CacheTree) invalidateChangedEntries(oldEntries []*IndexEntry, newEntries []*IndexEntry) {
+	oldEntriesMap := make(map[string]*IndexEntry, len(oldEntries))
+	for _, entry := range oldEntries {
+		oldEntriesMap[entry.path] = entry
+	}
+
+	newEntriesMap := make(map[string]*IndexEntry, len(newEntries))
+	for _, entry := range newEntries {
+		newEntriesMap[entry.path] = entry
+
+		oldEntry, exists := oldEntriesMap[entry.path]
+		if !exists || oldEntry.sha1 != entry.sha1 || oldEntry.mode != entry.mode || oldEntry.flags != entry.flags || oldEntry.extendedFlags != entry.extendedFlags {
+			ct.invalidatePath(entry.path)
+		}
+	}
+
+	for _, entry := range oldEntries {
+		if _, exists := newEntriesMap[entry.path]; !exists {
+			ct.invalidatePath(entry.path)
+		}
+	}
+}
+
+// Returns a mapping from each directory path (with "." as the root) to its node in the cache tree
+func (ct *CacheTree) getNodesByDir() map[string]*CacheTree {
+	nodesByDir := make(map[string]*CacheTree)
+	ct.collectNodesByDir(".", nodesByDir)
+	return nodesByDir
+}
+
+func (ct *CacheTree) collectNodesByDir(dir string, nodesByDir map[string]*CacheTree) {
+	nodesByDir[dir] = ct
+	for _, subtree := range ct.subtrees {
+		subtree.collectNodesByDir(filepath.Join(dir, subtree.name), nodesByDir)
+	}
+}
+
+func sortCacheTreeSubtrees(subtrees []*CacheTree) {
+	sort.Slice(subtrees, func(i int, j int) bool {
+		return subtrees[i].name < subtrees[j].name
+	})
+}
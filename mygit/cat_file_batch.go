@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// The format of the line printed for each object by cat-file --batch and --batch-check when none is given
+const DEFAULT_CAT_FILE_BATCH_FORMAT = "%(objectname) %(objecttype) %(objectsize)"
+
+var CAT_FILE_BATCH_ATOM_REGEX = regexp.MustCompile(`%\((objectname|objecttype|objectsize|rest)\)`)
+
+type CatFileBatchOptions struct {
+	format      string // The format of the line printed for each object, e.g. DEFAULT_CAT_FILE_BATCH_FORMAT
+	withContent bool   // Whether to print each object's content after its line (--batch, rather than --batch-check)
+	buffer      bool   // Whether to buffer the output, rather than flushing it after each object (--buffer)
+}
+
+// Reads object names from the input, one per line, and writes the type, size, and (with --batch) content of each
+// object to the output in the format of git cat-file --batch, so that many objects can be inspected by a single
+// process: a line in the given format (by default `<hash> <type> <size>`), followed by the object's content and a
+// newline. An object name is an object hash, a revision (see resolveRevision), or <tree-ish>:<path>. A name which
+// doesn't resolve to an existing object is reported as `<name> missing`. Unless buffering is requested, the output is
+// flushed after each object, so a tool can write a name and read back the object before writing the next one.
+func CatFileBatch(input io.Reader, output *bufio.Writer, options CatFileBatchOptions, repoDir string) error {
+	// As in Git, the rest of the line after the object name is only split off if the format uses it
+	splitRest := strings.Contains(options.format, "%(rest)")
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		name, rest := scanner.Text(), ""
+		if splitRest {
+			if i := strings.IndexAny(name, " \t"); i >= 0 {
+				name, rest = name[:i], strings.TrimLeft(name[i:], " \t")
+			}
+		}
+
+		if err := writeCatFileBatchObject(name, rest, output, options, repoDir); err != nil {
+			return err
+		}
+		if !options.buffer {
+			if err := output.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read object names: %s", err)
+	}
+
+	return output.Flush()
+}
+
+func writeCatFileBatchObject(name string, rest string, output *bufio.Writer, options CatFileBatchOptions, repoDir string) error {
+	objHash, found := resolveCatFileBatchName(name, repoDir)
+	if !found {
+		_, err := fmt.Fprintf(output, "%s missing\n", name)
+		return err
+	}
+
+	objType, sizeBytes, reader, err := openObjectFile(objHash, repoDir)
+	if err != nil {
+		_, err := fmt.Fprintf(output, "%s missing\n", name)
+		return err
+	}
+	defer reader.Close()
+
+	line := CAT_FILE_BATCH_ATOM_REGEX.ReplaceAllStringFunc(options.format, func(atom string) string {
+		switch atom {
+		case "%(objectname)":
+			return objHash
+		case "%(objecttype)":
+			return objType.toString()
+		case "%(objectsize)":
+			return fmt.Sprint(sizeBytes)
+		default:
+			return rest
+		}
+	})
+	if _, err := output.WriteString(line + "\n"); err != nil {
+		return err
+	}
+
+	if !options.withContent {
+		return nil
+	}
+	// The content is streamed rather than read into memory, since it may be a large blob
+	if _, err := io.Copy(output, reader); err != nil {
+		return fmt.Errorf("failed to read object %s: %s", objHash, err)
+	}
+	return output.WriteByte('\n')
+}
+
+// Resolves an object name read by cat-file --batch to the hash of an existing object
+func resolveCatFileBatchName(name string, repoDir string) (string, bool) {
+	if isValidObjectHash(name) {
+		return name, objectExists(name, repoDir)
+	}
+
+	if strings.Contains(name, ":") {
+		blobHash, _, err := resolveBlobPath(name, repoDir)
+		return blobHash, err == nil
+	}
+
+	_, objHash, err := resolveRevision(name, repoDir)
+	return objHash, err == nil
+}
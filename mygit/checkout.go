@@ -1,39 +1,286 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
-func CheckoutCommit(commitHash string, repoDir string) error {
+// Checks out the commit into the index and working tree, moving them from the commit currently checked out at HEAD
+// (if any). As in Git, only the files which differ between the two commits are touched: untracked files are left
+// alone, and uncommitted changes to any other files are carried over. The checkout is refused if it would overwrite
+// uncommitted changes or untracked files (see getCheckoutConflicts), unless force is set, in which case every
+// uncommitted change to a tracked file is discarded, as with git checkout --force.
+func CheckoutCommit(commitHash string, force bool, repoDir string) error {
 	commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
 	if err != nil {
 		return err
 	}
 
-	if err := clearWorkingDirectory(repoDir); err != nil {
+	if err := prefetchTreeBlobs(commitObj.treeHash, repoDir); err != nil {
 		return err
 	}
 
-	if err := checkoutTree(commitObj.treeHash, repoDir, repoDir); err != nil {
+	oldFiles, err := getHeadDiffFiles(repoDir)
+	if err != nil {
+		return err
+	}
+	newFiles := make(map[string]*DiffFileVersion)
+	if err := populateTreeDiffFiles(newFiles, commitObj.treeHash, "", repoDir); err != nil {
+		return fmt.Errorf("failed to read files in commit %s: %s", commitHash, err)
+	}
+
+	// The files are converted according to the attributes of the commit being checked out
+	converter, err := newTreeContentConverter(commitObj.treeHash, repoDir)
+	if err != nil {
+		return err
+	}
+
+	return checkoutTreeFiles(oldFiles, newFiles, force, "checkout", converter, repoDir)
+}
+
+// Moves the index and working tree from the files of one tree (keyed by path) to those of another, as git read-tree
+// -m -u does. Each file which differs between the trees is updated (or removed) along with its index entry, and each
+// other file is left as it is, along with any uncommitted changes to it. With force, the index and working tree are
+// instead reset to the new tree, discarding uncommitted changes to every tracked file. Either way, files which are
+// tracked in the index but not in the new tree are removed, while untracked files are kept. Files which are unchanged
+// keep their index entries, so they're neither rewritten nor rehashed. The operation (checkout, merge, or am) names what
+// would overwrite uncommitted work in the error refusing to do so.
+func checkoutTreeFiles(oldFiles map[string]*DiffFileVersion, newFiles map[string]*DiffFileVersion, force bool, operation string, converter *ContentConverter, repoDir string) error {
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
 		return err
 	}
+	defer indexLock.rollback()
 
-	err = copyRunSh(repoDir)
+	index, err := readIndexFile(repoDir)
 	if err != nil {
-		return fmt.Errorf("failed to copy mygit run.sh script into repository: %s", err)
+		return err
+	}
+
+	currEntries := make(map[string]*IndexEntry, len(index.entries))
+	paths := make(map[string]bool, len(index.entries))
+	for _, entry := range index.entries {
+		if entry.stage() != 0 {
+			if !force {
+				return fmt.Errorf("you need to resolve your current index first")
+			}
+		} else {
+			currEntries[entry.path] = entry
+		}
+		paths[entry.path] = true
+	}
+	for _, files := range []map[string]*DiffFileVersion{oldFiles, newFiles} {
+		for path := range files {
+			paths[path] = true
+		}
+	}
+
+	newEntries := []*IndexEntry{}
+	changedPaths := make(map[string]bool)
+	for path := range paths {
+		currEntry := currEntries[path]
+		var curr *DiffFileVersion
+		if currEntry != nil {
+			curr = &DiffFileVersion{hash: hex.EncodeToString(currEntry.sha1[:]), mode: currEntry.mode}
+		}
+
+		// Without force, a file which is the same in both trees (or is already staged as it is in the new tree) is
+		// left as it is, along with any changes to it
+		keep := isSameFileVersion(curr, newFiles[path])
+		if !force {
+			keep = keep || isSameFileVersion(oldFiles[path], newFiles[path])
+		}
+		if keep {
+			if currEntry != nil {
+				newEntries = append(newEntries, currEntry)
+			}
+			continue
+		}
+
+		if newFiles[path] != nil {
+			newEntries = append(newEntries, newTreeIndexEntry(path, newFiles[path], 0))
+			changedPaths[path] = true
+		}
+	}
+
+	if !force {
+		if err := getCheckoutConflicts(changedPaths, currEntries, oldFiles, newFiles, operation, converter, repoDir); err != nil {
+			return err
+		}
+	}
+
+	newPaths := make(map[string]bool, len(newEntries))
+	for _, entry := range newEntries {
+		newPaths[entry.path] = true
+	}
+	for _, entry := range index.entries {
+		if !newPaths[entry.path] {
+			if err := removeIndexEntryFile(entry, repoDir); err != nil {
+				return err
+			}
+		}
+	}
+
+	// With force, every file is checked, so that any changes to files which are staged as they are in the new tree
+	// are discarded too. Files which already match their entries aren't rewritten.
+	if force {
+		changedPaths = nil
+	}
+	options := CheckoutIndexOptions{force: true, refresh: true}
+	if _, err := checkoutIndexEntries(newEntries, changedPaths, options, converter, repoDir); err != nil {
+		return err
 	}
 
-	if err := CreateIndexFromWorkingTree(repoDir); err != nil {
+	if err := writeUpdatedIndex(indexLock, index, newEntries); err != nil {
+		return fmt.Errorf("failed to write updated Git index file: %s", err)
+	}
+	return nil
+}
+
+// Checks whether moving the index and working tree from the old tree to the new one would lose any uncommitted work,
+// returning an error listing the files which would be overwritten if so. Each tracked file which the new tree changes
+// or removes must be staged as it is in the old tree, and be unchanged in the working tree (or deleted). Each file
+// which the new tree adds mustn't already exist as an untracked file (unless it's identical), or be in the way of an
+// untracked file, e.g. as a directory containing one.
+func getCheckoutConflicts(changedPaths map[string]bool, currEntries map[string]*IndexEntry, oldFiles map[string]*DiffFileVersion, newFiles map[string]*DiffFileVersion, operation string, converter *ContentConverter, repoDir string) error {
+	trustExecutableBit, err := getTrustExecutableBit(repoDir)
+	if err != nil {
 		return err
 	}
+	indexModTime := getIndexModTime(repoDir)
+
+	// The files updated by the new tree, along with those which it removes
+	updatedPaths := []string{}
+	for path := range changedPaths {
+		updatedPaths = append(updatedPaths, path)
+	}
+	for path := range oldFiles {
+		if newFiles[path] == nil && currEntries[path] != nil {
+			updatedPaths = append(updatedPaths, path)
+		}
+	}
+	sort.Strings(updatedPaths)
+
+	modified, untracked := []string{}, []string{}
+	for _, path := range updatedPaths {
+		currEntry := currEntries[path]
+		fullPath := filepath.Join(repoDir, path)
+
+		if currEntry != nil {
+			if !isSameFileVersion(&DiffFileVersion{hash: hex.EncodeToString(currEntry.sha1[:]), mode: currEntry.mode}, oldFiles[path]) {
+				modified = append(modified, path)
+				continue
+			}
+			info, err := os.Lstat(fullPath)
+			if err != nil || currEntry.mode == GITLINK_MODE {
+				continue
+			}
+			matches, err := isIndexEntryCheckedOut(currEntry, fullPath, info, trustExecutableBit, indexModTime, converter)
+			if err != nil {
+				return err
+			}
+			if !matches {
+				modified = append(modified, path)
+			}
+			continue
+		}
+
+		if oldFiles[path] != nil {
+			modified = append(modified, path)
+			continue
+		}
+
+		// A file in place of one of the new file's parent directories is only removed if it's tracked
+		for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+			info, err := os.Lstat(filepath.Join(repoDir, dir))
+			if err == nil && !info.IsDir() && currEntries[filepath.ToSlash(dir)] == nil {
+				untracked = append(untracked, filepath.ToSlash(dir))
+			}
+		}
+
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			if newFiles[path].mode == GITLINK_MODE {
+				continue
+			}
+			untrackedFiles, err := getUntrackedFilesWithin(path, currEntries, repoDir)
+			if err != nil {
+				return err
+			}
+			untracked = append(untracked, untrackedFiles...)
+			continue
+		}
+
+		fileHash, err := HashBlobObjectFromFile(fullPath, converter)
+		if err != nil {
+			return err
+		}
+		if fileHash != newFiles[path].hash {
+			untracked = append(untracked, path)
+		}
+	}
 
+	action := operation
+	if operation == "checkout" {
+		action = "switch branches"
+	} else if operation == "am" {
+		action = "apply patches"
+	}
+	messages := []string{}
+	if len(modified) > 0 {
+		messages = append(messages, fmt.Sprintf("your local changes to the following files would be overwritten by %s:\n\t%s\nPlease commit your changes or stash them before you %s.", operation, strings.Join(modified, "\n\t"), action))
+	}
+	if len(untracked) > 0 {
+		messages = append(messages, fmt.Sprintf("the following untracked working tree files would be overwritten by %s:\n\t%s\nPlease move or remove them before you %s.", operation, strings.Join(untracked, "\n\t"), action))
+	}
+	if len(messages) > 0 {
+		return fmt.Errorf("%s", strings.Join(messages, "\n"))
+	}
 	return nil
 }
 
-func checkoutTree(treeHash string, currDir string, repoDir string) error {
+// Returns the paths of the files within the directory (relative to the top level of the working tree) which aren't
+// tracked in the index, including any nested repositories
+func getUntrackedFilesWithin(dirPath string, currEntries map[string]*IndexEntry, repoDir string) ([]string, error) {
+	untracked := []string{}
+	err := filepath.WalkDir(filepath.Join(repoDir, dirPath), func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(repoDir, fullPath)
+		if err != nil {
+			return err
+		}
+		path := filepath.ToSlash(relPath)
+
+		if d.IsDir() {
+			if path != dirPath && fileExists(filepath.Join(fullPath, ".git")) {
+				if currEntries[path] == nil {
+					untracked = append(untracked, path)
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if currEntries[path] == nil {
+			untracked = append(untracked, path)
+		}
+		return nil
+	})
+	return untracked, err
+}
+
+// Checks out the tree into the given directory, converting the content of its files with converter, and
+// recording the commit of each submodule in the tree in submodules (keyed by path)
+func checkoutTree(treeHash string, currDir string, converter *ContentConverter, repoDir string, submodules map[string]string) error {
 	if err := os.MkdirAll(currDir, 0755); err != nil {
 		return fmt.Errorf("failed to create directory %s: %w", currDir, err)
 	}
@@ -48,13 +295,24 @@ func checkoutTree(treeHash string, currDir string, repoDir string) error {
 
 		switch entry.objType {
 		case Blob:
-			if err := checkoutBlob(entry.hash, entryPath, entry.mode, repoDir); err != nil {
+			if err := checkoutBlob(entry.hash, entryPath, entry.mode, converter, repoDir); err != nil {
 				return err
 			}
 		case Tree:
-			if err := checkoutTree(entry.hash, entryPath, repoDir); err != nil {
+			if err := checkoutTree(entry.hash, entryPath, converter, repoDir, submodules); err != nil {
 				return err
 			}
+		case Commit:
+			// As in Git, a submodule is checked out as an empty directory, in which its repository can be cloned,
+			// unless it has already been populated
+			if err := os.MkdirAll(entryPath, 0755); err != nil {
+				return fmt.Errorf("failed to create submodule directory %s: %w", entryPath, err)
+			}
+			path, err := filepath.Rel(repoDir, entryPath)
+			if err != nil {
+				return err
+			}
+			submodules[filepath.ToSlash(path)] = entry.hash
 		default:
 			return fmt.Errorf("unexpected object type %s in tree %s", entry.objType.toString(), treeHash)
 		}
@@ -63,7 +321,8 @@ func checkoutTree(treeHash string, currDir string, repoDir string) error {
 	return nil
 }
 
-func checkoutBlob(blobHash string, filePath string, mode int, repoDir string) error {
+// Writes the blob to the given file with the given mode, converting its content with converter unless it's nil
+func checkoutBlob(blobHash string, filePath string, mode FileMode, converter *ContentConverter, repoDir string) error {
 	blobObj, err := ReadBlobObjectFile(blobHash, repoDir)
 	if err != nil {
 		return err
@@ -74,45 +333,73 @@ func checkoutBlob(blobHash string, filePath string, mode int, repoDir string) er
 		return fmt.Errorf("failed to create directory %s: %w", parentDir, err)
 	}
 
-	if err := os.WriteFile(filePath, blobObj.content, 0644); err != nil {
-		return fmt.Errorf("failed to write file %s: %w", filePath, err)
+	// An existing symbolic link is replaced rather than written through, since it may point outside of the repository
+	if info, err := os.Lstat(filePath); err == nil && (mode == SYMBOLIC_LINK_MODE || info.Mode()&os.ModeSymlink != 0) {
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", filePath, err)
+		}
+	}
+
+	if mode == SYMBOLIC_LINK_MODE {
+		if err := os.Symlink(filepath.FromSlash(string(blobObj.content)), filePath); err != nil {
+			return fmt.Errorf("failed to create symbolic link %s: %w", filePath, err)
+		}
+		return nil
 	}
 
-	// If any executable bits are set, update the file permissions
-	perm := os.FileMode(mode & 0777)
-	if perm&0111 != 0 {
-		if err := os.Chmod(filePath, perm); err != nil {
-			return fmt.Errorf("failed to set permissions on %s: %w", filePath, err)
+	content := blobObj.content
+	if converter != nil {
+		content, err = converter.toWorkingTree(filePath, content)
+		if err != nil {
+			return err
 		}
 	}
 
+	if err := os.WriteFile(filePath, content, 0644); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", filePath, err)
+	}
+
+	// os.WriteFile keeps the permissions of an existing file, so they're always set, which also clears the executable
+	// bits of a file which is no longer executable
+	if err := os.Chmod(filePath, os.FileMode(mode&0777)); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", filePath, err)
+	}
+
 	return nil
 }
 
-func clearWorkingDirectory(repoDir string) error {
-	entries, err := os.ReadDir(repoDir)
+// Removes the directory and everything in it, other than any populated submodules, which are repositories of their
+// own whose commits and changes would otherwise be lost. Returns whether any submodules were kept, in which case the
+// directories containing them are kept too.
+func removeDirectoryExceptSubmodules(dir string) (bool, error) {
+	if fileExists(filepath.Join(dir, ".git")) {
+		return true, nil
+	}
+
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return fmt.Errorf("failed to read repository directory: %w", err)
+		return false, err
 	}
 
-	// Remove all entries except hidden directories & files (such as .git/)
+	keptSubmodules := false
 	for _, entry := range entries {
-		if strings.HasPrefix(entry.Name(), ".") {
+		path := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			if err := os.Remove(path); err != nil {
+				return false, err
+			}
 			continue
 		}
 
-		path := filepath.Join(repoDir, entry.Name())
-		var removeErr error
-		if entry.IsDir() {
-			removeErr = os.RemoveAll(path)
-		} else {
-			removeErr = os.Remove(path)
-		}
-
-		if removeErr != nil {
-			return fmt.Errorf("failed to remove %s: %w", path, removeErr)
+		kept, err := removeDirectoryExceptSubmodules(path)
+		if err != nil {
+			return false, err
 		}
+		keptSubmodules = keptSubmodules || kept
 	}
 
-	return nil
+	if keptSubmodules {
+		return true, nil
+	}
+	return false, os.Remove(dir)
 }
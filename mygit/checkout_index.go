@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type CheckoutIndexOptions struct {
+	force   bool   // Whether files which already exist with other contents are overwritten (-f)
+	refresh bool   // Whether the stat data of the checked out entries is updated in the index (-u)
+	prefix  string // Prepended to the path of each file written, e.g. a directory to export the files into (--prefix)
+}
+
+// Writes the index entries of the given paths (relative to the top level of the working tree), or of every file in
+// the index with all, into the working tree, as git checkout-index does: the inverse of add. Files with merge
+// conflicts are skipped, since there's no single version of them to write. A file which already exists is only
+// overwritten with force, unless it already matches its entry, in which case it's left as it is. Returned are
+// messages for the paths which were skipped: those which aren't in the index (`<path> is not in the cache`), have
+// merge conflicts (`<path> is unmerged`, only reported for paths which were given), or already exist
+// (`<path> already exists, no checkout`).
+func CheckoutIndex(paths []string, all bool, options CheckoutIndexOptions, repoDir string) ([]string, error) {
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	stages := make(map[string]int, len(index.entries))
+	for _, entry := range index.entries {
+		stages[entry.path] = entry.stage()
+	}
+
+	messages := []string{}
+	var selectedPaths map[string]bool
+	if !all {
+		selectedPaths = make(map[string]bool, len(paths))
+		for _, path := range paths {
+			stage, inIndex := stages[path]
+			switch {
+			case !inIndex:
+				messages = append(messages, fmt.Sprintf("%s is not in the cache", path))
+			case stage != 0:
+				messages = append(messages, fmt.Sprintf("%s is unmerged", path))
+			default:
+				selectedPaths[path] = true
+			}
+		}
+	}
+
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := append([]*IndexEntry{}, index.entries...)
+	skipped, err := checkoutIndexEntries(entries, selectedPaths, options, converter, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	messages = append(messages, skipped...)
+
+	if options.refresh {
+		if err := writeUpdatedIndex(indexLock, index, entries); err != nil {
+			return nil, fmt.Errorf("failed to write updated Git index file: %s", err)
+		}
+	}
+	return messages, nil
+}
+
+// Writes the stage 0 entries among the given index entries into the working tree, converting the content of their
+// files with converter. If selectedPaths isn't nil, only the entries of those paths are written. Returns a message
+// for each file which was skipped because it already exists (see checkoutIndexEntry). With refresh, each entry which
+// was written (or already matched its file) is replaced in entries with a copy holding the file's new stat data.
+func checkoutIndexEntries(entries []*IndexEntry, selectedPaths map[string]bool, options CheckoutIndexOptions, converter *ContentConverter, repoDir string) ([]string, error) {
+	trustExecutableBit, err := getTrustExecutableBit(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	indexModTime := getIndexModTime(repoDir)
+
+	messages := []string{}
+	for i, entry := range entries {
+		if entry.stage() != 0 || (selectedPaths != nil && !selectedPaths[entry.path]) {
+			continue
+		}
+
+		path := options.prefix + entry.path
+		checkedOut, err := checkoutIndexEntry(entry, path, options.force, trustExecutableBit, indexModTime, converter, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check out %s: %s", path, err)
+		}
+		if !checkedOut {
+			messages = append(messages, fmt.Sprintf("%s already exists, no checkout", path))
+			continue
+		}
+
+		// The stat data is only meaningful for files written at their own paths, and submodules have none
+		if options.refresh && options.prefix == "" && entry.mode != GITLINK_MODE {
+			info, err := os.Lstat(filepath.Join(repoDir, path))
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat file %s: %s", path, err)
+			}
+			refreshedEntry := *entry
+			setIndexEntryStatData(&refreshedEntry, info)
+			entries[i] = &refreshedEntry
+		}
+	}
+
+	return messages, nil
+}
+
+// Writes the index entry's file at the given path (relative to the top level of the working tree). Symbolic links
+// are created as links, and executable files are made executable. A submodule is created as an empty directory, in
+// which its repository can be cloned, unless it already exists. Returns false, without writing anything, if something
+// other than the entry's file is already at the path (or in the way of its parent directories) and force isn't set;
+// with force, it's removed first, other than any populated submodules within it.
+func checkoutIndexEntry(entry *IndexEntry, path string, force bool, trustExecutableBit bool, indexModTime time.Time, converter *ContentConverter, repoDir string) (bool, error) {
+	fullPath := filepath.Join(repoDir, path)
+
+	// A file in place of one of the parent directories would stop the file from being created
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		info, err := os.Lstat(filepath.Join(repoDir, dir))
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if !force {
+			return false, nil
+		}
+		if err := os.Remove(filepath.Join(repoDir, dir)); err != nil {
+			return false, err
+		}
+	}
+
+	info, err := os.Lstat(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		if entry.mode == GITLINK_MODE && info.IsDir() {
+			return true, nil
+		}
+
+		matches, err := isIndexEntryCheckedOut(entry, fullPath, info, trustExecutableBit, indexModTime, converter)
+		if err != nil {
+			return false, err
+		}
+		if matches {
+			return true, nil
+		}
+		if !force {
+			return false, nil
+		}
+
+		if info.IsDir() {
+			keptSubmodules, err := removeDirectoryExceptSubmodules(fullPath)
+			if err != nil {
+				return false, err
+			}
+			if keptSubmodules {
+				return false, fmt.Errorf("the directory contains a submodule")
+			}
+		} else if entry.mode == GITLINK_MODE {
+			if err := os.Remove(fullPath); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if entry.mode == GITLINK_MODE {
+		return true, os.MkdirAll(fullPath, 0755)
+	}
+	return true, checkoutBlob(hex.EncodeToString(entry.sha1[:]), fullPath, entry.mode, converter, repoDir)
+}
+
+// Determines whether the file already matches the index entry, checking its stat data first so that it's only
+// rehashed if it may have changed
+func isIndexEntryCheckedOut(entry *IndexEntry, fullPath string, info os.FileInfo, trustExecutableBit bool, indexModTime time.Time, converter *ContentConverter) (bool, error) {
+	if info.IsDir() {
+		return false, nil
+	}
+	if isIndexEntryStatClean(entry, info, indexModTime) {
+		return true, nil
+	}
+
+	fileHash, err := HashBlobObjectFromFile(fullPath, converter)
+	if err != nil {
+		return false, err
+	}
+	mode := getWorkingTreeFileMode(info.Mode(), entry.mode, trustExecutableBit)
+	return fileHash == hex.EncodeToString(entry.sha1[:]) && mode == entry.mode, nil
+}
+
+// Removes the file of the index entry from the working tree, along with any parent directories left empty, as in
+// Git. A submodule's directory is only removed if it hasn't been populated.
+func removeIndexEntryFile(entry *IndexEntry, repoDir string) error {
+	fullPath := filepath.Join(repoDir, entry.path)
+	if entry.mode == GITLINK_MODE {
+		if _, err := removeDirectoryExceptSubmodules(fullPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove submodule directory %s: %s", entry.path, err)
+		}
+		return nil
+	}
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove file %s: %s", entry.path, err)
+	}
+
+	for dir := filepath.Dir(entry.path); dir != "."; dir = filepath.Dir(dir) {
+		if os.Remove(filepath.Join(repoDir, dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
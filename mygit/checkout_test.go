@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckoutBlobUpdatesExecutableBit(t *testing.T) {
+	repoDir := newTestRepo(t)
+	blobHash := createTestBlob(t, "#!/bin/sh\n", repoDir)
+	filePath := filepath.Join(repoDir, "script.sh")
+
+	for _, mode := range []FileMode{EXECUTABLE_FILE_MODE, REGULAR_FILE_MODE, EXECUTABLE_FILE_MODE} {
+		if err := checkoutBlob(blobHash, filePath, mode, nil, repoDir); err != nil {
+			t.Fatalf("failed to check out blob with mode %s: %s", mode.toString(), err)
+		}
+
+		info, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatalf("failed to stat checked out file: %s", err)
+		}
+		if perm := info.Mode().Perm(); perm != os.FileMode(mode&0777) {
+			t.Errorf("checking out the blob with mode %s left the file with permissions %s", mode.toString(), perm)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Provides the current time for timestamping new objects, so that it can be fixed (e.g. for reproducible commits,
+// or by tests, which can replace systemClock)
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Represents a clock which is stopped at a fixed time
+type FixedClock struct {
+	time time.Time
+}
+
+func (c FixedClock) Now() time.Time {
+	return c.time
+}
+
+// The clock used for timestamping new objects when SOURCE_DATE_EPOCH isn't set
+var systemClock Clock = realClock{}
+
+// Returns the clock used for timestamping new objects. If the SOURCE_DATE_EPOCH environment variable is set (as in
+// reproducible builds), the clock is fixed at that number of seconds since the Unix epoch, in UTC, so that repeated
+// runs create objects with identical hashes.
+func getObjectClock() (Clock, error) {
+	sourceDateEpoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if sourceDateEpoch == "" {
+		return systemClock, nil
+	}
+
+	seconds, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+	if err != nil || seconds < 0 {
+		return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %s", sourceDateEpoch)
+	}
+	return FixedClock{time: time.Unix(seconds, 0).UTC()}, nil
+}
+
+// The layouts of the dates accepted by parseCommitDate besides Git's internal format: RFC 2822 (as in email headers),
+// and ISO 8601 with or without a timezone (dates without one are in the local timezone)
+var COMMIT_DATE_LAYOUTS = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// Matches Git's internal date format, `<seconds since the epoch> <timezone>` (e.g. `1700000000 +0100`), optionally
+// with the seconds prefixed by @ and the timezone omitted (in which case it's UTC)
+var INTERNAL_DATE_REGEX = regexp.MustCompile(`^@?(\d+)(?: ([+-]\d{4}))?$`)
+
+// Parses a date given by GIT_AUTHOR_DATE, GIT_COMMITTER_DATE, or --date, returning the seconds since the epoch and
+// the timezone (e.g. +0100) to record in the commit. As in Git, the date may be in Git's internal format, RFC 2822,
+// or ISO 8601.
+func parseCommitDate(date string) (int64, string, error) {
+	date = strings.TrimSpace(date)
+	if match := INTERNAL_DATE_REGEX.FindStringSubmatch(date); match != nil {
+		seconds, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return 0, "", fmt.Errorf("invalid date: %s", date)
+		}
+		timezone := match[2]
+		if timezone == "" {
+			timezone = "+0000"
+		}
+		return seconds, timezone, nil
+	}
+
+	for _, layout := range COMMIT_DATE_LAYOUTS {
+		t, err := time.ParseInLocation(layout, date, time.Local)
+		if err != nil {
+			continue
+		}
+		_, offset := t.Zone()
+		return t.Unix(), formatTimezone(offset), nil
+	}
+
+	return 0, "", fmt.Errorf("invalid date: %s", date)
+}
+
+// Formats a timezone's offset from UTC in seconds as it's recorded in commits, e.g. -0330
+func formatTimezone(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, offset/3600, (offset%3600)/60)
+}
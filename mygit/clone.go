@@ -4,9 +4,27 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 )
 
-func CloneRepo(repoURL string, repoDir string) {
+// Represents the options controlling what a clone fetches and checks out
+type CloneOptions struct {
+	branch       string // The branch or tag to check out instead of the remote HEAD
+	singleBranch bool   // Only fetch the history of, and create refs for, the branch being checked out
+	filter       string // The filter leaving objects out of a partial clone (e.g. blob:none), or empty for a full clone
+	limitRate    string // The maximum speed of the transfer in bytes per second (e.g. 100k), or empty for no limit
+}
+
+func CloneRepo(repoURL string, options CloneOptions, repoDir string) {
+	// A bundle file is recorded as the remote by its absolute path, so that it can be pulled from within the clone
+	if isBundleFile(repoURL) {
+		absBundlePath, err := filepath.Abs(repoURL)
+		if err != nil {
+			log.Fatalf("Failed to resolve bundle path: %s\n", err)
+		}
+		repoURL = absBundlePath
+	}
+
 	info, err := os.Stat(repoDir)
 	if !os.IsNotExist(err) && info.IsDir() {
 		log.Fatalf("Destination path '%s' already exists", repoDir)
@@ -17,34 +35,103 @@ func CloneRepo(repoURL string, repoDir string) {
 		log.Fatalf("Failed to create repository directory: %s\n", err)
 	}
 
-	fmt.Printf("Cloning into '%s'...\n", repoDir)
+	if !progressSettings.quiet {
+		fmt.Printf("Cloning into '%s'...\n", repoDir)
+	}
 
-	_, err = initRepo(repoDir)
+	_, err = initRepo(repoDir, InitOptions{})
 	if err != nil {
 		log.Fatalf("Failed to initialize repository: %s\n", err)
 	}
 
-	refsMap, err := refDiscovery(repoURL)
+	err = loadTransferLimits(options.limitRate, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to set up transfer limits: %s\n", err)
+	}
+
+	err = loadHTTPSettings(repoDir)
+	if err != nil {
+		log.Fatalf("Failed to set up HTTP client: %s\n", err)
+	}
+
+	remoteRefs, err := refDiscovery(repoURL)
 	if err != nil {
 		log.Fatalf("Failed to perform reference discovery on the remote repository: %s\n", err)
 	}
 
-	packfile, err := uploadPackRequest(repoURL, refsMap)
+	if len(remoteRefs.refs) == 0 {
+		fmt.Println("warning: You appear to have cloned an empty repository.")
+		err = setUpEmptyClone(repoURL, remoteRefs, options, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to set up clone of empty repository: %s\n", err)
+		}
+		return
+	}
+
+	checkout, err := resolveCloneCheckout(remoteRefs, options.branch)
 	if err != nil {
-		log.Fatalf("Failed to perform git-upload-pack request: %s\n", err)
+		log.Fatalf("Failed to determine what to check out: %s\n", err)
+	}
+
+	// A clone fetches the remote's branches and tags. A single-branch clone fetches only the commit being checked out
+	// (and the tag, if a tag is being checked out), and creates only the refs for its branch or tag.
+	wantObjHashes := append(getDefaultWants(remoteRefs), checkout.commitHash)
+	remoteBranches := remoteRefs.branches()
+	remoteTags := remoteRefs.tags()
+	for _, tagHash := range remoteTags {
+		wantObjHashes = append(wantObjHashes, tagHash)
+	}
+	trackedRef := ""
+	if options.singleBranch {
+		wantObjHashes = []string{checkout.commitHash}
+		remoteBranches = make(map[string]string)
+		remoteTags = make(map[string]string)
+		if checkout.branchName != "" {
+			remoteBranches[checkout.branchName] = checkout.commitHash
+			trackedRef = getBranchRefName(checkout.branchName, "")
+		} else if checkout.tagName != "" {
+			wantObjHashes = append(wantObjHashes, checkout.tagHash)
+			remoteTags[checkout.tagName] = checkout.tagHash
+			trackedRef = "refs/tags/" + checkout.tagName
+		}
+	}
+
+	// A partial clone leaves out the objects excluded by its filter, which are fetched later when they're needed. As in
+	// Git, a server which doesn't support filtering sends everything instead.
+	filterSpec := options.filter
+	if filterSpec != "" && !remoteRefs.hasCapability("filter") {
+		fmt.Fprintln(os.Stderr, "warning: filtering not recognized by server, ignoring")
+		filterSpec = ""
 	}
 
-	headHash, ok := refsMap["HEAD"]
-	if !ok {
-		log.Fatalf("No HEAD reference found in remote repository")
+	err = fetchObjects(repoURL, remoteRefs, wantObjHashes, filterSpec, true, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to fetch objects: %s\n", err)
 	}
 
-	err = ReadPackfile(packfile, repoDir)
+	// The remote is configured before checking out, since the blobs left out of a partial clone are fetched from it
+	err = addRemote(DEFAULT_REMOTE_NAME, repoURL, trackedRef, repoDir)
 	if err != nil {
-		log.Fatalf("Failed to read packfile: %s\n", err)
+		log.Fatalf("Failed to configure remote: %s\n", err)
+	}
+
+	if filterSpec != "" {
+		err = recordPartialClone(DEFAULT_REMOTE_NAME, filterSpec, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to record partial clone: %s\n", err)
+		}
+	}
+
+	// A tag is peeled to its commit once it's been fetched, in case the remote didn't advertise its peeled value (as a
+	// bundle doesn't)
+	if checkout.tagName != "" {
+		err = checkout.peelTag(repoDir)
+		if err != nil {
+			log.Fatalf("Failed to resolve tag %s: %s\n", checkout.tagName, err)
+		}
 	}
 
-	err = CheckoutCommit(headHash, repoDir)
+	err = CheckoutCommit(checkout.commitHash, false, repoDir)
 	if err != nil {
 		log.Fatalf("Failed to check out HEAD commit: %s\n", err)
 	}
@@ -54,8 +141,156 @@ func CloneRepo(repoURL string, repoDir string) {
 		log.Fatalf("Failed to copy mygit run.sh script into cloned repository: %s\n", err)
 	}
 
-	err = updateRefsAfterPull(refsMap, repoDir)
+	err = updateRefsAfterPull(remoteBranches, DEFAULT_REMOTE_NAME, true, repoDir)
 	if err != nil {
 		log.Fatalf("Failed to create refs: %s\n", err)
 	}
+
+	err = updateTagsAfterClone(remoteTags, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to create tags: %s\n", err)
+	}
+
+	err = updateHeadsAfterClone(remoteRefs, checkout, remoteBranches, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to update HEAD: %s\n", err)
+	}
+
+	// The checked out branch tracks the remote branch it was cloned from, so that pull and push default to it
+	if checkout.branchName != "" {
+		_, err = setBranchUpstream(checkout.branchName, DEFAULT_REMOTE_NAME+"/"+checkout.branchName, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to set upstream of branch %s: %s\n", checkout.branchName, err)
+		}
+	}
+
+	if !progressSettings.quiet {
+		fmt.Println(transferStats.summarize())
+	}
+
+	err = runPostCheckoutHook("", checkout.commitHash, true, repoDir)
+	if err != nil {
+		log.Fatalf("Cloned repository, but %s\n", err)
+	}
+}
+
+// Sets up a clone of a repository without any refs, in which there's nothing to fetch or check out. HEAD points to
+// the (as yet unborn) default branch of the remote, which tracks the remote branch of the same name.
+func setUpEmptyClone(repoURL string, remoteRefs *RemoteRefs, options CloneOptions, repoDir string) error {
+	branchName := options.branch
+	if branchName == "" {
+		// Servers don't necessarily advertise the default branch of an empty repository, in which case the local
+		// default (init.defaultBranch) is used, as in real Git
+		headBranch, hasHeadBranch := remoteRefs.headBranch()
+		if hasHeadBranch {
+			branchName = headBranch
+		} else {
+			initialBranch, err := getInitialBranchName(repoDir)
+			if err != nil {
+				return err
+			}
+			branchName = initialBranch
+		}
+	}
+
+	trackedRef := ""
+	if options.singleBranch {
+		trackedRef = getBranchRefName(branchName, "")
+	}
+	if err := addRemote(DEFAULT_REMOTE_NAME, repoURL, trackedRef, repoDir); err != nil {
+		return fmt.Errorf("failed to configure remote: %s", err)
+	}
+
+	if err := UpdateHeadWithBranchRef(branchName, "", repoDir); err != nil {
+		return err
+	}
+
+	if err := writeBranchUpstream(branchName, &BranchUpstream{remote: DEFAULT_REMOTE_NAME, branch: branchName}, repoDir); err != nil {
+		return err
+	}
+
+	return copyRunSh(repoDir)
+}
+
+// Represents what a clone checks out: a branch, or (when cloning a tag, or a remote whose HEAD is detached) a
+// detached HEAD at a commit
+type CloneCheckout struct {
+	branchName string // Empty if HEAD is detached
+	tagName    string // Empty unless a tag is being checked out
+	tagHash    string // The object the tag points to, which is the tag object for an annotated tag
+	commitHash string
+}
+
+// Determines the branch or tag to check out after cloning: the given one if set, or otherwise the remote HEAD
+func resolveCloneCheckout(remoteRefs *RemoteRefs, refName string) (*CloneCheckout, error) {
+	if refName == "" {
+		headHash, exists := remoteRefs.get("HEAD")
+		if !exists {
+			return nil, fmt.Errorf("no HEAD reference found in remote repository")
+		}
+		headBranch, _ := remoteRefs.headBranch()
+		return &CloneCheckout{branchName: headBranch, commitHash: headHash}, nil
+	}
+
+	if branchHash, exists := remoteRefs.get(getBranchRefName(refName, "")); exists {
+		return &CloneCheckout{branchName: refName, commitHash: branchHash}, nil
+	}
+
+	// An annotated tag is advertised along with the commit that it points to (its peeled value), which is checked
+	// out instead of the tag object itself
+	if tagHash, exists := remoteRefs.get("refs/tags/" + refName); exists {
+		commitHash, peeled := remoteRefs.get("refs/tags/" + refName + "^{}")
+		if !peeled {
+			commitHash = tagHash
+		}
+		return &CloneCheckout{branchName: "", tagName: refName, tagHash: tagHash, commitHash: commitHash}, nil
+	}
+
+	return nil, fmt.Errorf("remote branch %s not found in upstream %s", refName, DEFAULT_REMOTE_NAME)
+}
+
+// Sets the commit to check out to the one which the fetched tag points to, following any tag objects
+func (c *CloneCheckout) peelTag(repoDir string) error {
+	commitHash, objType, err := peelObject(c.tagHash, repoDir)
+	if err != nil {
+		return err
+	}
+	if objType != Commit {
+		return fmt.Errorf("tag %s points to a %s, not a commit", c.tagName, objType.toString())
+	}
+	c.commitHash = commitHash
+	return nil
+}
+
+// Creates the tags fetched by a clone, all in one ref transaction. remoteTags maps the name of each tag to its hash.
+func updateTagsAfterClone(remoteTags map[string]string, repoDir string) error {
+	transaction := newRefTransaction(repoDir)
+	for tagName, tagHash := range remoteTags {
+		if err := transaction.update("refs/tags/"+tagName, tagHash, ""); err != nil {
+			return fmt.Errorf("failed to update tag reference for %s: %s", tagName, err)
+		}
+	}
+
+	if err := transaction.commit(); err != nil {
+		return fmt.Errorf("failed to update tag references: %s", err)
+	}
+	return nil
+}
+
+// Points the local HEAD at the checked out branch (or commit), and the remote HEAD at the remote-tracking branch for
+// the remote's default branch (as advertised via the symref capability), if that branch was fetched
+func updateHeadsAfterClone(remoteRefs *RemoteRefs, checkout *CloneCheckout, remoteBranches map[string]string, repoDir string) error {
+	if checkout.branchName != "" {
+		if err := UpdateHeadWithBranchRef(checkout.branchName, "", repoDir); err != nil {
+			return err
+		}
+	} else if err := DetachHead(checkout.commitHash, repoDir); err != nil {
+		return err
+	}
+
+	remoteHeadBranch, hasHeadBranch := remoteRefs.headBranch()
+	if _, fetched := remoteBranches[remoteHeadBranch]; hasHeadBranch && fetched {
+		return UpdateHeadWithBranchRef(remoteHeadBranch, DEFAULT_REMOTE_NAME, repoDir)
+	}
+	return nil
 }
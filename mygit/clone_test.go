@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Creates a bundle of a repository whose main branch has a commit on top of one tagged v1.0 by an annotated tag,
+// returning the bundle's path along with the hashes of the tag object and of the commit it tags
+func createTestTagBundle(t *testing.T) (string, string, string) {
+	repoDir := newTestRepo(t)
+	taggedHash, headHash := createTestHistory(t, repoDir)
+	if err := UpdateBranchRef("main", headHash, "", repoDir); err != nil {
+		t.Fatalf("failed to update branch: %s", err)
+	}
+
+	tagContent := fmt.Sprintf("object %s\ntype commit\ntag v1.0\ntagger Test User <test@example.com> 1700000000 +0000\n\nVersion 1.0\n", taggedHash)
+	tagObj, err := MakeTag(tagContent, repoDir)
+	if err != nil {
+		t.Fatalf("failed to create tag object: %s", err)
+	}
+	if err := UpdateRef("refs/tags/v1.0", tagObj.hash, "", repoDir); err != nil {
+		t.Fatalf("failed to create tag: %s", err)
+	}
+
+	bundlePath := filepath.Join(t.TempDir(), "repo.bundle")
+	if _, err := CreateBundle(bundlePath, []string{"--all"}, repoDir); err != nil {
+		t.Fatalf("failed to create bundle: %s", err)
+	}
+	return bundlePath, tagObj.hash, taggedHash
+}
+
+// Clones the given repository with the given options into a new directory, without copying run.sh into it
+func cloneTestRepo(t *testing.T, repoURL string, options CloneOptions) string {
+	copyRunSh, quiet := *CopyRunSh, progressSettings.quiet
+	*CopyRunSh, progressSettings.quiet = false, true
+	t.Cleanup(func() { *CopyRunSh, progressSettings.quiet = copyRunSh, quiet })
+
+	cloneDir := filepath.Join(t.TempDir(), "clone")
+	CloneRepo(repoURL, options, cloneDir)
+	return cloneDir
+}
+
+func TestCloneTag(t *testing.T) {
+	bundlePath, tagHash, taggedHash := createTestTagBundle(t)
+
+	testCases := []struct {
+		name          string
+		singleBranch  bool
+		expectedRefs  []string
+		expectedFetch string
+	}{
+		{"all branches", false, []string{"refs/heads/main", "refs/remotes/origin/HEAD", "refs/remotes/origin/main", "refs/tags/v1.0"}, "+refs/heads/*:refs/remotes/origin/*"},
+		{"single branch", true, []string{"refs/tags/v1.0"}, "+refs/tags/v1.0:refs/tags/v1.0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cloneDir := cloneTestRepo(t, bundlePath, CloneOptions{branch: "v1.0", singleBranch: tc.singleBranch})
+
+			// HEAD is detached at the tagged commit, and the tag is the annotated tag itself rather than its commit
+			if headRef, isSymbolic, err := ReadSymbolicRef("HEAD", cloneDir); err != nil || isSymbolic {
+				t.Errorf("HEAD points to %s, expected it to be detached", headRef)
+			}
+			if headHash, _, err := ResolveHead("", cloneDir); err != nil || headHash != taggedHash {
+				t.Errorf("HEAD is at %s, expected the tagged commit %s", headHash, taggedHash)
+			}
+			if clonedTagHash, _, err := resolveRef("refs/tags/v1.0", cloneDir); err != nil || clonedTagHash != tagHash {
+				t.Errorf("tag v1.0 points to %s, expected the tag object %s", clonedTagHash, tagHash)
+			}
+			if _, err := ReadTagObjectFile(tagHash, cloneDir); err != nil {
+				t.Errorf("failed to read the cloned tag object: %s", err)
+			}
+
+			refNames, err := listRefNames(cloneDir)
+			if err != nil {
+				t.Fatalf("failed to list refs: %s", err)
+			}
+			if !slices.Equal(refNames, tc.expectedRefs) {
+				t.Errorf("the clone has refs %v, expected %v", refNames, tc.expectedRefs)
+			}
+
+			config, err := readRepoConfig(cloneDir)
+			if err != nil {
+				t.Fatalf("failed to read config: %s", err)
+			}
+			if fetchRefspecs := config.getAll("remote.origin.fetch"); !slices.Equal(fetchRefspecs, []string{tc.expectedFetch}) {
+				t.Errorf("the remote fetches %v, expected %s", fetchRefspecs, tc.expectedFetch)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	COLOR_RESET  = "\033[0m"
+	COLOR_BOLD   = "\033[1m"
+	COLOR_RED    = "\033[31m"
+	COLOR_GREEN  = "\033[32m"
+	COLOR_YELLOW = "\033[33m"
+	COLOR_CYAN   = "\033[36m"
+)
+
+// Represents when output is colored, as selected by --color or the color.* config variables
+type ColorMode int
+
+const (
+	ColorAuto   ColorMode = iota // Only when writing to a terminal, and NO_COLOR isn't set
+	ColorAlways                  // Even when writing to a file or pipe
+	ColorNever
+)
+
+// Parses a color mode as Git does, accepting auto, always, or never, or a boolean (where true means always)
+func parseColorMode(value string) (ColorMode, error) {
+	switch strings.ToLower(value) {
+	case "auto":
+		return ColorAuto, nil
+	case "always":
+		return ColorAlways, nil
+	case "never":
+		return ColorNever, nil
+	}
+
+	enabled, err := parseConfigBool(value)
+	if err != nil {
+		return ColorNever, fmt.Errorf("invalid color mode '%s' (expected auto, always, or never)", value)
+	}
+	if enabled {
+		return ColorAlways, nil
+	}
+	return ColorNever, nil
+}
+
+// Parses the value of a color.* config variable, where (unlike for --color) true means auto, as in Git
+func parseConfigColorMode(value string) (ColorMode, error) {
+	mode, err := parseColorMode(value)
+	if err == nil && mode == ColorAlways && strings.ToLower(value) != "always" {
+		return ColorAuto, nil
+	}
+	return mode, err
+}
+
+// The value of the --color flag, which may be given without a value (meaning always) or as --color=<when>
+type colorFlag struct {
+	mode ColorMode
+	set  bool
+}
+
+func (f *colorFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	return []string{"auto", "always", "never"}[f.mode]
+}
+
+func (f *colorFlag) Set(value string) error {
+	mode, err := parseColorMode(value)
+	if err != nil {
+		return err
+	}
+	f.mode, f.set = mode, true
+	return nil
+}
+
+// Allows the flag to be given without a value
+func (f *colorFlag) IsBoolFlag() bool {
+	return true
+}
+
+// The value of the --no-color flag, which is the same as --color=never
+type noColorFlag struct {
+	color *colorFlag
+}
+
+func (f noColorFlag) String() string {
+	return ""
+}
+
+func (f noColorFlag) Set(value string) error {
+	disabled, err := parseConfigBool(value)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		f.color.mode, f.color.set = ColorNever, true
+	}
+	return nil
+}
+
+func (f noColorFlag) IsBoolFlag() bool {
+	return true
+}
+
+// Registers the --color[=<when>] and --no-color flags of a command which colors its output
+func addColorFlags() *colorFlag {
+	color := &colorFlag{}
+	flag.Var(color, "color", "When to color the output (auto, always, or never)")
+	flag.Var(noColorFlag{color: color}, "no-color", "Don't color the output")
+	return color
+}
+
+// Colors the output of a command, or leaves it plain if colors are disabled
+type Colorizer struct {
+	enabled bool
+}
+
+// Returns a colorizer for output written to the given file by the given command (e.g. status, for which the
+// color.status config variable applies). Colors are enabled as selected by the command's --color flag if given, or
+// else by color.<command> or color.ui (which default to auto). In auto mode, output is only colored if it's written
+// to a terminal (possibly through a pager), and neither the NO_COLOR environment variable nor TERM=dumb is set.
+func newColorizer(color *colorFlag, command string, out *os.File, repoDir string) (Colorizer, error) {
+	mode := ColorAuto
+	if color != nil && color.set {
+		mode = color.mode
+	} else {
+		config, err := readConfig(repoDir)
+		if err != nil {
+			return Colorizer{}, fmt.Errorf("failed to read repository config: %s", err)
+		}
+
+		names := []string{"color.ui"}
+		if command != "" {
+			names = []string{"color." + command, "color.ui"}
+		}
+		for _, name := range names {
+			if value, found := config.get(name); found {
+				mode, err = parseConfigColorMode(value)
+				if err != nil {
+					return Colorizer{}, fmt.Errorf("invalid value for config variable %s: %s", name, err)
+				}
+				break
+			}
+		}
+	}
+
+	switch mode {
+	case ColorAlways:
+		return Colorizer{enabled: true}, nil
+	case ColorNever:
+		return Colorizer{enabled: false}, nil
+	default:
+		// Output piped into a pager is displayed on the terminal
+		writesToTerminal := isTerminal(out) || (activePager != nil && out == os.Stdout)
+		enabled := os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb" && writesToTerminal
+		return Colorizer{enabled: enabled}, nil
+	}
+}
+
+// Returns whether the file is a terminal (rather than e.g. a regular file or a pipe)
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Wraps the text in the given color, unless colors are disabled
+func (c Colorizer) wrap(text string, color string) string {
+	if !c.enabled || text == "" {
+		return text
+	}
+	return color + text + COLOR_RESET
+}
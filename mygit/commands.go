@@ -1,43 +1,101 @@
 package main
 
 import (
+	"bufio"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-const (
-	COLOR_RESET = "\033[0m"
-	COLOR_RED   = "\033[31m"
-	COLOR_GREEN = "\033[32m"
-)
-
-// Initializes the given directory as a Git repository by creating the .git directory and
-// any necessary Git metadata.
+// Initializes the given directory (or the current directory, if none is given) as a Git repository by creating the
+// .git directory and any necessary Git metadata. The directory is created if it doesn't exist yet. Running init in
+// an existing repository leaves its HEAD and config file untouched.
+// --initial-branch/-b --> Identifies the branch that HEAD starts on, overriding the init.defaultBranch config variable.
+// --bare --> Creates a bare repository, which has no working tree and keeps its metadata directly in the directory.
 func InitHandler(repoDir string) {
-	if len(os.Args) != 2 {
-		log.Fatal("Usage: init")
+	usage := "Usage: init [--bare] [--initial-branch=<branch_name>] [<directory>]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	initialBranchPtr := flag.String("initial-branch", "", "The branch that HEAD starts on")
+	flag.StringVar(initialBranchPtr, "b", "", "The branch that HEAD starts on")
+	barePtr := flag.Bool("bare", false, "Create a bare repository")
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		log.Fatal(usage)
+	}
+
+	if *initialBranchPtr != "" {
+		if err := validateRefName(getBranchRefName(*initialBranchPtr, "")); err != nil {
+			log.Fatalf("Invalid initial branch name %s: %s\n", *initialBranchPtr, err)
+		}
+	}
+
+	if flag.NArg() == 1 {
+		targetDir := flag.Arg(0)
+		if !filepath.IsAbs(targetDir) {
+			targetDir = filepath.Join(repoDir, targetDir)
+		}
+		if err := os.MkdirAll(targetDir, 0755); err != nil {
+			log.Fatalf("Failed to create directory %s: %s\n", flag.Arg(0), err)
+		}
+		repoDir = filepath.Clean(targetDir) + string(filepath.Separator)
+	}
+
+	reinitialized := fileExists(filepath.Join(getInitGitDir(repoDir, *barePtr), "HEAD"))
+	if reinitialized && *initialBranchPtr != "" {
+		fmt.Fprintf(os.Stderr, "warning: re-init: ignored --initial-branch=%s\n", *initialBranchPtr)
 	}
 
-	absPath, err := initRepo(repoDir)
+	absPath, err := initRepo(repoDir, InitOptions{initialBranch: *initialBranchPtr, bare: *barePtr})
 	if err != nil {
 		log.Fatalf("Error initializing Git repository: %s\n", err)
 	}
-	fmt.Printf("Initialized empty Git repository in %s\n", absPath)
+
+	if reinitialized {
+		fmt.Printf("Reinitialized existing Git repository in %s\n", absPath)
+	} else {
+		fmt.Printf("Initialized empty Git repository in %s\n", absPath)
+	}
 }
 
 // Prints the information associated with the given object, identified by hash.
 // -t --> Prints the type of the object.
 // -s --> Prints the size in bytes of the object's content.
 // -p --> Pretty-prints the object file, including header and content.
+// --textconv --> Prints the content of a file converted with its textconv driver (if it has one), given as
+// <tree-ish>:<path> (e.g. HEAD:docs/guide.pdf), or :<path> for the version in the index.
+// --batch[=<format>] --> Reads object names from standard input, one per line, and prints the type, size, and
+// content of each object (see CatFileBatch).
+// --batch-check[=<format>] --> Like --batch, but doesn't print the content of each object.
+// --buffer --> With --batch or --batch-check, buffers the output rather than flushing it after each object.
 func CatFileHandler(repoDir string) {
+	usage := "Usage: cat-file (-t | -s | -p) <object_sha> | cat-file --textconv <tree-ish>:<path> | cat-file (--batch | --batch-check)[=<format>] [--buffer]"
+
+	if len(os.Args) >= 3 && (strings.HasPrefix(os.Args[2], "--batch") || os.Args[2] == "--buffer") {
+		catFileBatch(usage, repoDir)
+		return
+	}
+
+	if len(os.Args) != 4 {
+		log.Fatal(usage)
+	}
+
 	flag := os.Args[2]
-	if len(os.Args) != 4 || (flag != "-t" && flag != "-s" && flag != "-p") {
-		log.Fatal("Usage: cat-file (-t | -s | -p) <object_sha>")
+	if flag == "--textconv" {
+		catFileTextconv(os.Args[3], repoDir)
+		return
+	} else if flag != "-t" && flag != "-s" && flag != "-p" {
+		log.Fatal(usage)
 	}
 
 	objHash := os.Args[3]
@@ -63,47 +121,168 @@ func CatFileHandler(repoDir string) {
 	}
 }
 
-// Creates a Git blob object for the repository file provided and prints the resulting object hash.
-// Must be executed with the -w flag for actually writing the object into the object database.
+func catFileBatch(usage string, repoDir string) {
+	options := CatFileBatchOptions{}
+	batchModes := 0
+	for _, arg := range os.Args[2:] {
+		mode, format, hasFormat := strings.Cut(arg, "=")
+		switch {
+		case mode == "--batch" || mode == "--batch-check":
+			options.withContent = mode == "--batch"
+			options.format = DEFAULT_CAT_FILE_BATCH_FORMAT
+			if hasFormat {
+				options.format = format
+			}
+			batchModes += 1
+		case arg == "--buffer":
+			options.buffer = true
+		default:
+			log.Fatal(usage)
+		}
+	}
+	if batchModes != 1 {
+		log.Fatal(usage)
+	}
+
+	if err := CatFileBatch(os.Stdin, bufio.NewWriter(os.Stdout), options, repoDir); err != nil {
+		log.Fatalf("Failed to print objects: %s\n", err)
+	}
+}
+
+func catFileTextconv(objectName string, repoDir string) {
+	blobHash, path, err := resolveBlobPath(objectName, repoDir)
+	if err != nil {
+		log.Fatalf("Could not resolve object: %s\n", err)
+	}
+
+	blobObj, err := ReadBlobObjectFile(blobHash, repoDir)
+	if err != nil {
+		log.Fatalf("Could not read object file: %s\n", err)
+	}
+
+	textconv, err := newTextconv(repoDir)
+	if err != nil {
+		log.Fatalf("Failed to load textconv drivers: %s\n", err)
+	}
+
+	content, err := textconv.convert(path, blobObj.content, blobHash)
+	if err != nil {
+		log.Fatalf("Failed to run textconv: %s\n", err)
+	}
+	if err := textconv.saveCaches(); err != nil {
+		log.Fatalf("Failed to save textconv cache: %s\n", err)
+	}
+
+	os.Stdout.Write(content)
+}
+
+// Computes the hash of the object with the content of each file provided (relative to the current directory), and
+// prints the hashes in order. Files are converted as add would convert them (e.g. by text and filter attributes) before
+// being hashed as blobs.
+// -w --> Writes the objects into the object database, rather than only computing their hashes.
+// -t <type> --> Hashes the content as an object of the given type (blob, tree, commit, or tag) rather than a blob. The
+// content must already be in the object's format, as printed by cat-file -p for a commit or tag, and isn't converted.
+// Content which isn't a valid object of the type is refused.
+// --literally --> Hashes the content as an object of the given type even if it isn't a valid one.
+// --stdin --> Hashes the content read from standard input, before any files.
+// --no-filters --> Hashes the files as they are, without converting them.
 func HashObjectHandler(repoDir string) {
-	if len(os.Args) != 4 || os.Args[2] != "-w" {
-		log.Fatal("Usage: hash-object -w <file>")
+	usage := "Usage: hash-object [-w] [-t <type>] [--literally] [--no-filters] [--stdin] [<file>...]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	writePtr := flag.Bool("w", false, "Write the objects into the object database")
+	typePtr := flag.String("t", "blob", "The type of the objects")
+	literallyPtr := flag.Bool("literally", false, "Hash the content even if it isn't a valid object of its type")
+	stdinPtr := flag.Bool("stdin", false, "Hash the content read from standard input")
+	noFiltersPtr := flag.Bool("no-filters", false, "Hash the files without converting them")
+	flag.Parse()
+
+	if flag.NArg() == 0 && !*stdinPtr {
+		log.Fatal(usage)
 	}
 
-	filePath := os.Args[3]
-	blobObj, err := CreateBlobObjectFromFile(filepath.Join(repoDir, filePath), repoDir)
+	objType, err := ObjTypeFromString(*typePtr)
 	if err != nil {
-		log.Fatalf("Could not create blob object from file: %s\n", err)
+		log.Fatalf("Invalid object type: %s\n", *typePtr)
+	}
+
+	var converter *ContentConverter
+	if objType == Blob && !*noFiltersPtr {
+		converter, err = newContentConverter(repoDir)
+		if err != nil {
+			log.Fatalf("Failed to load content conversion settings: %s\n", err)
+		}
+	}
+
+	hashContent := func(content []byte) string {
+		if !*literallyPtr {
+			if err := checkObjectContent(objType, content); err != nil {
+				log.Fatalf("Refusing to hash malformed %s object: %s\n", objType.toString(), err)
+			}
+		}
+		if !*writePtr {
+			objHash, _ := hashObject(objType, content)
+			return objHash
+		}
+		objHash, err := CreateObjectFile(objType, content, repoDir)
+		if err != nil {
+			log.Fatalf("Could not create object: %s\n", err)
+		}
+		return objHash
+	}
+
+	if *stdinPtr {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("Failed to read standard input: %s\n", err)
+		}
+		fmt.Println(hashContent(content))
 	}
 
-	fmt.Println(blobObj.hash)
+	// The files are read relative to the current directory, which may be a subdirectory of the repository
+	for _, filePath := range flag.Args() {
+		content, err := readWorkingTreeFile(filePath, converter)
+		if err != nil {
+			log.Fatalf("Could not read file %s: %s\n", filePath, err)
+		}
+		fmt.Println(hashContent(content))
+	}
 }
 
-// Prints information on the entries in the given tree object, identified by hash.
-// --name-only --> Prints only the names of the entries in the given tree object.
+// Prints information on the entries in the given tree-ish (HEAD, or the hash of a commit or tree), optionally
+// restricted to the given paths within it (see LsTree).
+// --name-only --> Prints only the paths of the entries.
+// -r --> Recurses into subtrees, listing the blobs (and submodules) within them with their full paths.
+// -d --> Lists only trees. With -r, every tree is listed, as the trees aren't otherwise shown.
+// -l, --long --> Includes the size of each blob.
 func LsTreeHandler(repoDir string) {
-	var nameOnly bool
-	if len(os.Args) == 3 {
-		nameOnly = false
-	} else if len(os.Args) == 4 && os.Args[2] == "--name-only" {
-		nameOnly = true
-	} else {
-		log.Fatal("Usage: ls-tree [--name-only] <tree_sha>")
-	}
+	usage := "Usage: ls-tree [-r] [-d] [-l] [--name-only] <tree-ish> [<path>...]"
 
-	treeHash := os.Args[len(os.Args)-1]
-	if !isValidObjectHash(treeHash) {
-		log.Fatalf("Invalid object hash: %s\n", treeHash)
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	var options LsTreeOptions
+	flag.BoolVar(&options.recursive, "r", false, "Recurse into subtrees")
+	flag.BoolVar(&options.onlyTrees, "d", false, "List only trees")
+	flag.BoolVar(&options.long, "l", false, "Include the size of each blob")
+	flag.BoolVar(&options.long, "long", false, "Include the size of each blob")
+	flag.BoolVar(&options.nameOnly, "name-only", false, "List only the paths of the entries")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		log.Fatal(usage)
 	}
 
-	treeObj, err := ReadTreeObjectFile(treeHash, repoDir)
+	treeHash, err := resolveTreeish(flag.Arg(0), repoDir)
 	if err != nil {
-		log.Fatalf("Could not read tree object file: %s\n", err)
+		log.Fatalf("Could not resolve tree: %s\n", err)
 	}
 
-	for _, entry := range treeObj.entries {
-		entryString := entry.toString(nameOnly)
-		fmt.Println(entryString)
+	output := bufio.NewWriter(os.Stdout)
+	err = LsTree(treeHash, flag.Args()[1:], options, output, repoDir)
+	if flushErr := output.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		log.Fatalf("Failed to list tree: %s\n", err)
 	}
 }
 
@@ -127,7 +306,12 @@ func WriteWorkingTreeHandler(repoDir string) {
 		log.Fatal("Usage: write-working-tree")
 	}
 
-	treeObj, err := CreateTreeObjectFromDirectory(repoDir, repoDir)
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		log.Fatalf("Failed to load content conversion settings: %s\n", err)
+	}
+
+	treeObj, err := CreateTreeObjectFromDirectory(repoDir, converter, repoDir)
 	if err != nil {
 		log.Fatalf("Could not create tree object from working tree directory: %s\n", err)
 	}
@@ -136,12 +320,16 @@ func WriteWorkingTreeHandler(repoDir string) {
 }
 
 // Creates a new Git commit object from the tree object provided, identified by hash. Prints the
-// hash of the resulting commit object.
-// -p --> Identifies an optional parent commit hash for the new commit.
+// hash of the resulting commit object. The author and committer are determined as for commit.
+// -p --> Identifies a parent commit for the new commit, by hash or as a revision. May be given several times, e.g. twice for a merge commit,
+// or more for an octopus merge; a parent given more than once is only used once.
 // -m --> Identifies an optional message for the new commit.
+// --author --> Sets the author of the commit, given as `Name <email>`, instead of the current user.
+// --date --> Sets the author date of the commit, in any of the formats accepted by parseCommitDate.
 func CommitTreeHandler(repoDir string) {
-	if len(os.Args) < 3 || len(os.Args) > 7 {
-		log.Fatal("Usage: commit-tree <tree_sha> [-p <parent_commit_sha>] [-m <commit_message>]")
+	usage := "Usage: commit-tree <tree_sha> [(-p <parent_commit>)...] [-m <commit_message>] [--author=<author>] [--date=<date>]"
+	if len(os.Args) < 3 {
+		log.Fatal(usage)
 	}
 
 	treeHash := os.Args[2]
@@ -150,20 +338,45 @@ func CommitTreeHandler(repoDir string) {
 	}
 
 	os.Args = append(os.Args[0:1], os.Args[3:]...)
-	parentCommitHashPtr := flag.String("p", "", "Parent commit")
+	var parents stringListFlag
+	flag.Var(&parents, "p", "Parent commit")
 	commitMessagePtr := flag.String("m", "Made a commit!", "Commit message")
+	authorPtr := flag.String("author", "", "Set the author of the commit")
+	datePtr := flag.String("date", "", "Set the author date of the commit")
 	flag.Parse()
 
-	if *parentCommitHashPtr != "" && !isValidObjectHash(*parentCommitHashPtr) {
-		log.Fatalf("Invalid parent commit hash: %s\n", *parentCommitHashPtr)
+	if flag.NArg() != 0 {
+		log.Fatal(usage)
+	}
+
+	parentCommitHashes := []string{}
+	for _, parent := range parents {
+		parentCommitHash, err := resolveCommitish(parent, repoDir)
+		if err != nil {
+			log.Fatalf("Invalid parent commit %s: %s\n", parent, err)
+		}
+		if slices.Contains(parentCommitHashes, parentCommitHash) {
+			fmt.Fprintf(os.Stderr, "error: duplicate parent %s ignored\n", parentCommitHash)
+			continue
+		}
+		parentCommitHashes = append(parentCommitHashes, parentCommitHash)
+	}
+
+	author, err := getCommitUser(CommitAuthor, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine author: %s\n", err)
+	}
+	*author, err = overrideCommitAuthor(*author, *authorPtr, *datePtr)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	var parentCommitHashes []string
-	if *parentCommitHashPtr != "" {
-		parentCommitHashes = append(parentCommitHashes, *parentCommitHashPtr)
+	committer, err := getCommitUser(CommitCommitter, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine committer: %s\n", err)
 	}
 
-	commitObj, err := CreateCommitObjectFromTree(treeHash, parentCommitHashes, *commitMessagePtr, repoDir)
+	commitObj, err := createCommitObject(treeHash, parentCommitHashes, *author, *committer, *commitMessagePtr, repoDir)
 	if err != nil {
 		log.Fatalf("Could not create commit object from tree: %s\n", err)
 	}
@@ -171,79 +384,342 @@ func CommitTreeHandler(repoDir string) {
 	fmt.Println(commitObj.hash)
 }
 
-// Clones the Git repository at the given URL into some local directory. The directory to clone into may be
-// specified by the user. If not specified, it will default to the basename of the remote repository.
+// Creates a new Git tree object from entries read from standard input, one per line in the format printed by ls-tree
+// (`<mode> <type> <object_sha>\t<name>`), in any order. Prints the hash of the resulting tree object.
+// -z --> Reads entries terminated by NUL bytes rather than newlines, e.g. for names containing newlines.
+// --missing --> Allows the entries' objects to be missing, rather than requiring them to exist with the given types.
+func MktreeHandler(repoDir string) {
+	usage := "Usage: mktree [-z] [--missing]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	nulTerminatedPtr := flag.Bool("z", false, "Read entries terminated by NUL bytes")
+	allowMissingPtr := flag.Bool("missing", false, "Allow the entries' objects to be missing")
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		log.Fatal(usage)
+	}
+
+	treeObj, err := MakeTree(os.Stdin, *nulTerminatedPtr, *allowMissingPtr, repoDir)
+	if err != nil {
+		log.Fatalf("Could not create tree object: %s\n", err)
+	}
+
+	fmt.Println(treeObj.hash)
+}
+
+// Creates a new Git tag object from the content read from standard input, which must have the object, type, tag, and
+// tagger headers (in that order) followed by a blank line and the tag message, as printed by cat-file -p. The tagged
+// object must exist and have the given type. Prints the hash of the resulting tag object.
+func MktagHandler(repoDir string) {
+	if len(os.Args) != 2 {
+		log.Fatal("Usage: mktag")
+	}
+
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Failed to read tag from standard input: %s\n", err)
+	}
+
+	tagObj, err := MakeTag(string(content), repoDir)
+	if err != nil {
+		log.Fatalf("Could not create tag object: %s\n", err)
+	}
+
+	fmt.Println(tagObj.hash)
+}
+
+// Clones the Git repository at the given URL (or in the given bundle file) into some local directory. The directory to
+// clone into may be specified by the user. If not specified, it will default to the basename of the remote repository.
+// -b, --branch <name> --> Checks out the given branch instead of the remote HEAD. If given a tag, HEAD is detached at
+// the commit it points to.
+// --single-branch --> Only fetches the history of the branch (or tag) being checked out, and only creates refs for it.
+// --limit-rate <rate> --> Limits the speed of the transfer to the given number of bytes per second, which may have a
+// k, m, or g suffix (e.g. 100k).
+// --filter=<filter-spec> --> Makes a partial clone, which leaves out the objects excluded by the filter: blob:none for
+// every blob, or blob:limit=<n> for blobs of at least n bytes. The blobs needed to check out HEAD are fetched right
+// away, and any others are fetched from the remote when a command first needs them.
+// -q, --quiet --> Doesn't report the progress or summary of the transfer.
+// --progress --> Reports the progress of the transfer even if stderr isn't a terminal.
 func CloneHandler() {
-	if len(os.Args) != 3 && len(os.Args) != 4 {
-		log.Fatal("Usage: clone <repo_url> [some_dir]")
+	usage := "Usage: clone [-q | --progress] [-b <branch>] [--single-branch] [--filter=<filter-spec>] [--limit-rate <rate>] <repo_url> [some_dir]"
+	if len(os.Args) < 3 {
+		log.Fatal(usage)
+	}
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	branchPtr := flag.String("b", "", "Check out the given branch or tag instead of the remote HEAD")
+	flag.StringVar(branchPtr, "branch", "", "Check out the given branch or tag instead of the remote HEAD")
+	singleBranchPtr := flag.Bool("single-branch", false, "Only fetch the branch being checked out")
+	filterPtr := flag.String("filter", "", "Make a partial clone, leaving out the objects excluded by the filter")
+	limitRatePtr := flag.String("limit-rate", "", "Limit the speed of the transfer, in bytes per second")
+	quietPtr := flag.Bool("q", false, "Don't report the progress or summary of the transfer")
+	flag.BoolVar(quietPtr, "quiet", false, "Don't report the progress or summary of the transfer")
+	progressPtr := flag.Bool("progress", false, "Report the progress of the transfer even if stderr isn't a terminal")
+	flag.Parse()
+
+	if flag.NArg() != 1 && flag.NArg() != 2 {
+		log.Fatal(usage)
+	}
+	setUpProgress(*quietPtr, *progressPtr)
+
+	if *filterPtr != "" {
+		if err := validateFilterSpec(*filterPtr); err != nil {
+			log.Fatalf("Failed to make partial clone: %s\n", err)
+		}
+	}
+	if _, err := parseRateLimit(*limitRatePtr); err != nil {
+		log.Fatal(err)
 	}
 
-	repoURL := os.Args[2]
+	repoURL := flag.Arg(0)
 	err := validateRepoURL(repoURL)
 	if err != nil {
 		log.Fatalf("Failed to validate structure of repository URL: %s\n", err)
 	}
 
 	var repoDir string
-	if len(os.Args) == 4 {
-		repoDir = os.Args[3]
+	if flag.NArg() == 2 {
+		repoDir = flag.Arg(1)
 	} else {
 		repoURLParts := strings.Split(repoURL, "/")
 		repoDir = repoURLParts[len(repoURLParts)-1]
+		if isBundleFile(repoURL) {
+			repoDir = strings.TrimSuffix(repoDir, ".bundle")
+		}
 	}
 	repoDir = filepath.Clean(repoDir) + string(filepath.Separator)
 
-	CloneRepo(repoURL, repoDir)
+	CloneRepo(repoURL, CloneOptions{branch: *branchPtr, singleBranch: *singleBranchPtr, filter: *filterPtr, limitRate: *limitRatePtr}, repoDir)
 }
 
 // Prints information about the entries (representing repository files) in the Git index file. By default,
-// prints only the filepath of each entry.
-// -s --> Prints the mode and object hash for each entry, in addition to the path.
+// prints only the filepath of each entry. A file with merge conflicts has an entry for each of its versions: stage 1
+// for the merge base, stage 2 for ours, and stage 3 for theirs.
+// -s --> Prints the mode, object hash, and stage of each entry, in addition to the path.
+// -u --> Prints only the entries of files with merge conflicts, as -s does.
+// --with-tree --> Also lists the files in the given tree-ish (HEAD, or the hash of a commit or tree) which aren't in
+// the index, e.g. to show what a commit would contain without changing anything. Can't be used with -s or -u.
 func LsFilesHandler(repoDir string) {
-	if len(os.Args) < 2 || len(os.Args) > 3 {
-		log.Fatal("Usage: ls-files [-s]")
-	}
+	usage := "Usage: ls-files [-s | -u | --with-tree=<tree-ish>]"
 
 	os.Args = append(os.Args[0:1], os.Args[2:]...)
-	showDetailsPtr := flag.Bool("s", false, "Show entries' mode bits and object hash in the output")
+	showDetailsPtr := flag.Bool("s", false, "Show entries' mode bits, object hash, and stage in the output")
+	flag.BoolVar(showDetailsPtr, "stage", false, "Show entries' mode bits, object hash, and stage in the output")
+	unmergedPtr := flag.Bool("u", false, "Show only the entries of files with merge conflicts")
+	flag.BoolVar(unmergedPtr, "unmerged", false, "Show only the entries of files with merge conflicts")
+	withTreePtr := flag.String("with-tree", "", "Also list the files in the given tree-ish")
 	flag.Parse()
 
+	if flag.NArg() != 0 || ((*showDetailsPtr || *unmergedPtr) && *withTreePtr != "") {
+		log.Fatal(usage)
+	}
+
+	if *withTreePtr != "" {
+		paths, err := ListFilesWithTree(*withTreePtr, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to list files with tree %s: %s\n", *withTreePtr, err)
+		}
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+		return
+	}
+
 	entries, err := ReadIndex(repoDir)
 	if err != nil {
 		log.Fatalf("Failed to read entries within Git index file: %s\n", err)
 	}
 
 	for _, entry := range entries {
-		if *showDetailsPtr {
-			fmt.Printf("%06d %s %s\n", entry.mode, hex.EncodeToString(entry.sha1[:]), entry.path)
+		if *unmergedPtr && entry.stage() == 0 {
+			continue
+		}
+		if *showDetailsPtr || *unmergedPtr {
+			fmt.Printf("%s %s %d\t%s\n", entry.mode.toPaddedString(), hex.EncodeToString(entry.sha1[:]), entry.stage(), entry.path)
 		} else {
 			fmt.Println(entry.path)
 		}
 	}
 }
 
-// Adds the list of provided files (identified by relative paths from the repository root) to the Git index.
-// If executed with ., adds all files in the repository to the Git index.
+// Replaces the contents of the index with the entries of the given tree-ish (e.g. HEAD, a branch, or the hash of a
+// commit or tree). The working tree isn't changed.
+// -m --> Merges one to three trees into the index rather than replacing it, keeping the stat data of unchanged entries
+// (see mergeTreesIntoIndex). With two trees, moves the index from the first to the second, keeping staged changes.
+// With three trees (the merge base, ours, and theirs), makes a three-way merge, leaving files changed differently on
+// both sides with merge conflicts.
+func ReadTreeHandler(repoDir string) {
+	usage := "Usage: read-tree <tree-ish> | read-tree -m <tree-ish> [<tree-ish> [<tree-ish>]]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	mergePtr := flag.Bool("m", false, "Merge the trees into the index")
+	flag.Parse()
+
+	if flag.NArg() == 0 || flag.NArg() > 3 || (!*mergePtr && flag.NArg() != 1) {
+		log.Fatal(usage)
+	}
+
+	treeHashes := []string{}
+	for _, treeish := range flag.Args() {
+		treeHash, err := resolveTreeish(treeish, repoDir)
+		if err != nil {
+			log.Fatalf("Could not resolve tree: %s\n", err)
+		}
+		treeHashes = append(treeHashes, treeHash)
+	}
+
+	if err := ReadTree(treeHashes, *mergePtr, repoDir); err != nil {
+		log.Fatalf("Failed to read tree into index: %s\n", err)
+	}
+}
+
+// Writes the index entries of the given files (identified by paths relative to the current directory) into the
+// working tree, as a lower-level alternative to checkout (see CheckoutIndex). Files which already exist with other
+// contents are skipped, in which case the exit status is 1.
+// -a, --all --> Writes every file in the index, other than those with merge conflicts.
+// -f, --force --> Overwrites files which already exist.
+// -u, --index --> Updates the stat data of the written files in the index, so they aren't rehashed by status.
+// -q, --quiet --> Doesn't list files which are skipped.
+// --prefix <prefix> --> Prepends the prefix to the path of each file written, e.g. --prefix=export/ to write the
+// files into the export directory.
+func CheckoutIndexHandler(repoDir string) {
+	usage := "Usage: checkout-index [-a] [-f] [-u] [-q] [--prefix=<prefix>] [--] [<file>...]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	allPtr := flag.Bool("a", false, "Write every file in the index")
+	flag.BoolVar(allPtr, "all", false, "Write every file in the index")
+	var options CheckoutIndexOptions
+	flag.BoolVar(&options.force, "f", false, "Overwrite files which already exist")
+	flag.BoolVar(&options.force, "force", false, "Overwrite files which already exist")
+	flag.BoolVar(&options.refresh, "u", false, "Update the stat data of the written files in the index")
+	flag.BoolVar(&options.refresh, "index", false, "Update the stat data of the written files in the index")
+	quietPtr := flag.Bool("q", false, "Don't list files which are skipped")
+	flag.BoolVar(quietPtr, "quiet", false, "Don't list files which are skipped")
+	flag.StringVar(&options.prefix, "prefix", "", "Prepend the prefix to the path of each file written")
+	flag.Parse()
+
+	if *allPtr && flag.NArg() > 0 {
+		log.Fatal(usage)
+	}
+
+	paths := []string{}
+	for _, file := range flag.Args() {
+		path, err := getRepoRelativePath(file, repoDir)
+		if err != nil {
+			log.Fatalf("Invalid path %s: %s\n", file, err)
+		}
+		paths = append(paths, path)
+	}
+
+	messages, err := CheckoutIndex(paths, *allPtr, options, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to check out index: %s\n", err)
+	}
+	if !*quietPtr {
+		for _, message := range messages {
+			fmt.Fprintln(os.Stderr, message)
+		}
+	}
+	if len(messages) > 0 {
+		exit(1)
+	}
+}
+
+// Updates the index entries of the given files (identified by paths relative to the current directory) with their
+// current contents, as a lower-level alternative to add (see UpdateIndex).
+// --add --> Adds files which aren't in the index yet.
+// --remove --> Removes files which have been deleted from the working tree.
+// --force-remove --> Removes the files from the index even if they still exist in the working tree.
+// --cacheinfo <mode>,<hash>,<path> --> Adds an entry for the object to the index as it is, without reading the
+// working tree. May be given more than once.
+// --refresh --> Refreshes the stat data of every file in the index whose contents are unchanged, listing any which
+// need updating, in which case the exit status is 1.
+// --assume-unchanged, --no-assume-unchanged --> Sets or clears the assume-unchanged bit of the files instead of
+// updating them. Changes to a file with the bit set aren't noticed by status, diff, or commit -a.
+func UpdateIndexHandler(repoDir string) {
+	usage := "Usage: update-index [--add] [--remove | --force-remove] [--refresh] [--assume-unchanged | --no-assume-unchanged] [--cacheinfo <mode>,<hash>,<path>]... [--] [<file>...]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	var options UpdateIndexOptions
+	flag.BoolVar(&options.add, "add", false, "Add files which aren't in the index yet")
+	flag.BoolVar(&options.remove, "remove", false, "Remove files which have been deleted from the working tree")
+	flag.BoolVar(&options.forceRemove, "force-remove", false, "Remove the files from the index even if they exist")
+	flag.BoolVar(&options.refresh, "refresh", false, "Refresh the stat data of unchanged files")
+	assumeUnchangedPtr := flag.Bool("assume-unchanged", false, "Set the assume-unchanged bit of the files")
+	noAssumeUnchangedPtr := flag.Bool("no-assume-unchanged", false, "Clear the assume-unchanged bit of the files")
+	var cacheInfo cacheInfoFlag
+	flag.Var(&cacheInfo, "cacheinfo", "Add an entry for the object to the index as it is")
+	flag.Parse()
+
+	if *assumeUnchangedPtr && *noAssumeUnchangedPtr {
+		log.Fatal(usage)
+	}
+	if *assumeUnchangedPtr || *noAssumeUnchangedPtr {
+		options.assumeUnchanged = assumeUnchangedPtr
+	}
+	options.cacheInfo = cacheInfo
+
+	paths := []string{}
+	for _, file := range flag.Args() {
+		path, err := getRepoRelativePath(file, repoDir)
+		if err != nil {
+			log.Fatalf("Invalid path %s: %s\n", file, err)
+		}
+		paths = append(paths, path)
+	}
+
+	messages, err := UpdateIndex(paths, options, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to update index: %s\n", err)
+	}
+	for _, message := range messages {
+		fmt.Println(message)
+	}
+	if len(messages) > 0 {
+		exit(1)
+	}
+}
+
+// Adds the list of provided files (identified by paths relative to the current directory) to the Git index. A
+// directory adds all of the files within it, and a tracked file which has been deleted has its deletion staged. If
+// executed with . from the top level of the repository, adds all files in the repository to the Git index.
+// -p, --patch --> Interactively chooses which hunks of the changes to the given tracked files (or to every tracked
+// file) to stage, prompting for each one (see AddPatch).
 func AddHandler(repoDir string) {
+	usage := "Usage: `add <file> <file> ...`, `add .`, or `add -p [<file>...]`"
 	if len(os.Args) < 3 {
-		log.Fatal("Usage: `add <file> <file> ...` or `add .`")
+		log.Fatal(usage)
 	}
 
-	addAll := len(os.Args) == 3 && os.Args[2] == "."
-	if addAll {
-		if err := CreateIndexFromWorkingTree(repoDir); err != nil {
-			log.Fatalf("Failed to create add all files in working tree to index: %s\n", err)
-		}
-		return
+	patchMode := os.Args[2] == "-p" || os.Args[2] == "--patch"
+	args := os.Args[2:]
+	if patchMode {
+		args = os.Args[3:]
 	}
 
 	filesToAdd := []string{}
-	for _, file := range os.Args[2:] {
-		if _, err := os.Stat(filepath.Join(repoDir, file)); err != nil {
-			log.Fatalf("File does not exist: %s\n", file)
+	for _, file := range args {
+		path, err := getRepoRelativePath(file, repoDir)
+		if err != nil {
+			log.Fatalf("Invalid path %s: %s\n", file, err)
+		}
+		filesToAdd = append(filesToAdd, path)
+	}
+
+	if patchMode {
+		if err := AddPatch(filesToAdd, os.Stdin, repoDir); err != nil {
+			log.Fatalf("Failed to stage hunks: %s\n", err)
 		}
+		return
+	}
 
-		filesToAdd = append(filesToAdd, file)
+	addAll := len(filesToAdd) == 1 && filesToAdd[0] == "."
+	if addAll {
+		if err := CreateIndexFromWorkingTree(repoDir); err != nil {
+			log.Fatalf("Failed to create add all files in working tree to index: %s\n", err)
+		}
+		return
 	}
 
 	err := AddFilesToIndex(filesToAdd, repoDir)
@@ -252,20 +728,58 @@ func AddHandler(repoDir string) {
 	}
 }
 
-// Removes the list of provided files (identified by relative paths from the repository root)
+// Removes the list of provided files (identified by paths relative to the current directory)
 // from the Git index.
+// --hard [<commit>] --> Instead resets the index and working tree to the given commit (HEAD by default) and moves the
+// current branch to it, discarding every change to tracked files (see ResetHard).
 func ResetHandler(repoDir string) {
-	if len(os.Args) < 3 {
-		log.Fatal("Usage: reset <file> <file> ...")
+	usage := "Usage: reset <file> <file> ... | reset --hard [<commit>]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	hardPtr := flag.Bool("hard", false, "Reset the index and working tree to the commit")
+	flag.Parse()
+
+	if *hardPtr {
+		if flag.NArg() > 1 {
+			log.Fatal(usage)
+		}
+		revision := "HEAD"
+		if flag.NArg() == 1 {
+			revision = flag.Arg(0)
+		}
+
+		commitHash, err := resolveCommitish(revision, repoDir)
+		if err != nil {
+			log.Fatalf("Could not resolve commit: %s\n", err)
+		}
+		if err := ResetHard(commitHash, repoDir); err != nil {
+			log.Fatalf("Failed to reset to %s: %s\n", revision, err)
+		}
+
+		commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to read commit %s: %s\n", commitHash, err)
+		}
+		fmt.Printf("HEAD is now at %s %s\n", abbreviateHash(commitHash), getCommitSubject(commitObj))
+		return
+	}
+
+	if flag.NArg() == 0 {
+		log.Fatal(usage)
 	}
 
 	var filesToRemove []string
-	for _, file := range os.Args[2:] {
-		if _, err := os.Stat(filepath.Join(repoDir, file)); err != nil {
+	for _, file := range flag.Args() {
+		path, err := getRepoRelativePath(file, repoDir)
+		if err != nil {
+			log.Fatalf("Invalid path %s: %s\n", file, err)
+		}
+
+		if _, err := os.Lstat(filepath.Join(repoDir, path)); err != nil {
 			log.Fatalf("File does not exist: %s\n", file)
 		}
 
-		filesToRemove = append(filesToRemove, file)
+		filesToRemove = append(filesToRemove, path)
 	}
 
 	err := RemoveFilesFromIndex(filesToRemove, repoDir)
@@ -275,98 +789,1882 @@ func ResetHandler(repoDir string) {
 }
 
 // Shows the status of the working tree to the user, including modified, deleted, and created/untracked files.
+// Submodules which have moved to another commit, or have modified or untracked content of their own, are shown as
+// modified. Files whose mode has changed are shown along with the change, e.g. (mode change 100644 => 100755), unless
+// core.fileMode is false, in which case changes to the executable bit are ignored.
+// --ignore-submodules --> Identifies which changes to submodules to leave out (none, untracked, dirty, or all),
+// overriding the diff.ignoreSubmodules config variable.
+// --json --> Prints the status as JSON for tools, including the modes and object IDs on both sides of each change
+// and the original paths of renamed files (see Status).
+// -s, --short --> Prints a line for each changed file with a two-letter status code, e.g. MM file.txt (see
+// printShortStatus).
+// --porcelain[=v1|v2] --> Prints the short format without colors, in a format which is stable for scripts, or with
+// the modes and object IDs of each changed file for v2.
+// -z --> Terminates each entry with a NUL byte rather than a newline, and doesn't quote paths. Implies --porcelain if
+// no other format is given.
+// -b, --branch --> Prints the current branch and how it compares to its upstream before the changed files in the
+// short and porcelain formats.
+// --color[=<when>], --no-color --> Colors the long and short formats always, never, or only when writing to a terminal
+// (auto), overriding the color.status and color.ui config variables (see newColorizer).
 func StatusHandler(repoDir string) {
-	if len(os.Args) != 2 {
-		log.Fatal("Usage: status")
+	usage := "Usage: status [--ignore-submodules=<when>] [--json | -s | --porcelain[=v1|v2]] [-z] [-b] [--color[=<when>] | --no-color]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	ignoreSubmodulesPtr := flag.String("ignore-submodules", "", "Which changes to submodules to ignore")
+	jsonPtr := flag.Bool("json", false, "Print the status as JSON")
+	shortPtr := flag.Bool("s", false, "Print the status in the short format")
+	flag.BoolVar(shortPtr, "short", false, "Print the status in the short format")
+	var porcelain porcelainFlag
+	flag.Var(&porcelain, "porcelain", "Print the status in a stable format for scripts (v1 or v2)")
+	nulTerminatedPtr := flag.Bool("z", false, "Terminate entries with NUL bytes")
+	showBranchPtr := flag.Bool("b", false, "Show the branch and its upstream in the short and porcelain formats")
+	flag.BoolVar(showBranchPtr, "branch", false, "Show the branch and its upstream in the short and porcelain formats")
+	color := addColorFlags()
+	flag.Parse()
+
+	if flag.NArg() != 0 || (*jsonPtr && (*shortPtr || porcelain.format != StatusFormatLong)) {
+		log.Fatal(usage)
 	}
 
-	status, err := GetRepoStatus(repoDir)
+	ignoreSubmodules, err := getIgnoreSubmodules(*ignoreSubmodulesPtr, repoDir)
 	if err != nil {
-		log.Fatalf("Failed to determine status of repository: %s\n", err)
+		log.Fatalf("Failed to determine which changes to submodules to ignore: %s\n", err)
 	}
 
-	hasChanges := len(status.stagedFiles) > 0 || len(status.notStagedFiles) > 0 || len(status.untrackedFiles) > 0
-
-	fmt.Printf("On branch %s\n", status.branch)
+	colorizer, err := newColorizer(color, "status", os.Stdout, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine whether to color output: %s\n", err)
+	}
 
-	if status.remoteHead == "" {
-		fmt.Printf("There are no remote commits for the %s branch. Push in order to create the remote branch.\n", status.branch)
-	} else if status.localHead != status.remoteHead {
-		fmt.Printf("Your local HEAD %s differs from remote HEAD for 'origin/%s': %s.\n", status.localHead, status.branch, status.remoteHead)
+	// As in Git, --porcelain takes precedence over -s, and -z implies --porcelain
+	format := porcelain.format
+	if format == StatusFormatLong && *shortPtr {
+		format = StatusFormatShort
+	} else if format == StatusFormatLong && *nulTerminatedPtr && !*jsonPtr {
+		format = StatusFormatPorcelainV1
 	}
 
-	if !hasChanges {
-		fmt.Println("\nnothing to commit, working tree clean")
+	if format != StatusFormatLong {
+		report, err := Status(ignoreSubmodules, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to determine status of repository: %s\n", err)
+		}
+
+		// The porcelain formats are never colored
+		if format != StatusFormatShort {
+			colorizer = Colorizer{}
+		}
+		options := ShortStatusOptions{format: format, showBranch: *showBranchPtr, nulTerminated: *nulTerminatedPtr, colorizer: colorizer}
+		if err := printShortStatus(os.Stdout, report, options, repoDir); err != nil {
+			log.Fatalf("Failed to print status of repository: %s\n", err)
+		}
 		return
 	}
 
-	// Print staged changes
-	if len(status.stagedFiles) > 0 {
-		fmt.Println("\nChanges to be committed:")
-		fmt.Println("  (use \"git reset <file>...\" to unstage)")
+	if *jsonPtr {
+		report, err := Status(ignoreSubmodules, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to determine status of repository: %s\n", err)
+		}
 
-		for _, fs := range status.stagedFiles {
-			var statusStr string
-			switch fs.status {
-			case ModifiedStaged:
-				statusStr = "modified:"
-			case AddedStaged:
-				statusStr = "new file:"
-			case DeletedStaged:
-				statusStr = "deleted:"
-			default:
-				log.Fatalf("Unexpected status for staged file %s: %d\n", fs.path, fs.status)
-			}
-			fmt.Printf("\t%s%s\t%s%s\n", COLOR_GREEN, statusStr, fs.path, COLOR_RESET)
+		reportJSON, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode status as JSON: %s\n", err)
 		}
+		fmt.Println(string(reportJSON))
+		return
 	}
 
-	// Print not staged changes
-	if len(status.notStagedFiles) > 0 {
+	status, err := GetRepoStatus(ignoreSubmodules, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine status of repository: %s\n", err)
+	}
+
+	hasChanges := len(status.stagedFiles) > 0 || len(status.notStagedFiles) > 0 || len(status.untrackedFiles) > 0 || len(status.unmergedFiles) > 0
+
+	printHeadStatus(status)
+
+	for _, operation := range status.operations {
+		printOperationStatus(operation, len(status.unmergedFiles) > 0)
+	}
+
+	if !hasChanges {
+		fmt.Println()
+		printStashStatus(status)
+		fmt.Println("nothing to commit, working tree clean")
+		return
+	}
+
+	// Print staged changes
+	if len(status.stagedFiles) > 0 {
+		fmt.Println("\nChanges to be committed:")
+		fmt.Println("  (use \"git reset <file>...\" to unstage)")
+
+		for _, fs := range status.stagedFiles {
+			statusStr := fs.status.describe()
+
+			path := fs.path
+			if modeChange := fs.describeModeChange(); modeChange != "" {
+				path = fmt.Sprintf("%s (%s)", fs.path, modeChange)
+			}
+			fmt.Printf("\t%s\n", colorizer.wrap(statusStr+"\t"+path, COLOR_GREEN))
+		}
+	}
+
+	// Print files with merge conflicts
+	if len(status.unmergedFiles) > 0 {
+		fmt.Println("\nUnmerged paths:")
+		fmt.Println("  (use \"git add <file>...\" to mark resolution)")
+
+		for _, fs := range status.unmergedFiles {
+			fmt.Printf("\t%s\n", colorizer.wrap(fmt.Sprintf("%-17s%s", fs.describe(), fs.path), COLOR_RED))
+		}
+	}
+
+	// Print not staged changes
+	if len(status.notStagedFiles) > 0 {
 		fmt.Println("\nChanges not staged for commit:")
 		fmt.Println("  (use \"git add/reset <file>...\" to update what will be committed)")
 
-		for _, fs := range status.notStagedFiles {
-			var statusStr string
-			switch fs.status {
-			case ModifiedNotStaged:
-				statusStr = "modified:"
-			case DeletedNotStaged:
-				statusStr = "deleted:"
-			default:
-				log.Fatalf("Unexpected status for unstaged file %s: %d\n", fs.path, fs.status)
+		for _, fs := range status.notStagedFiles {
+			statusStr := fs.status.describe()
+
+			path := fs.path
+			if fs.submoduleChanges != 0 {
+				path = fmt.Sprintf("%s (%s)", fs.path, fs.submoduleChanges.describe())
+			} else if modeChange := fs.describeModeChange(); modeChange != "" {
+				path = fmt.Sprintf("%s (%s)", fs.path, modeChange)
+			}
+			fmt.Printf("\t%s\n", colorizer.wrap(statusStr+"\t"+path, COLOR_RED))
+		}
+	}
+
+	// Print untracked files
+	if len(status.untrackedFiles) > 0 {
+		fmt.Println("\nUntracked files:")
+		fmt.Println("  (use \"git add <file>...\" to include in what will be committed)")
+
+		for _, fs := range status.untrackedFiles {
+			fmt.Printf("\t%s\n", colorizer.wrap(fs.path, COLOR_RED))
+		}
+	}
+
+	fmt.Println()
+	printStashStatus(status)
+	if len(status.stagedFiles) == 0 {
+		fmt.Println("no changes added to commit (use \"git add\" and/or \"git commit -a\")")
+	}
+}
+
+// Prints the current branch and how it compares to its upstream, or, if HEAD is detached, the commit it's at (or the
+// commit being rebased onto, if a rebase is in progress)
+func printHeadStatus(status *RepositoryStatus) {
+	if status.branch == "" {
+		for _, operation := range status.operations {
+			if operation.opType == OperationRebase {
+				interactive := ""
+				if operation.interactive {
+					interactive = "interactive "
+				}
+				fmt.Printf("%srebase in progress; onto %s\n", interactive, abbreviateHash(operation.onto))
+				return
+			}
+		}
+
+		fmt.Printf("HEAD detached at %s\n", abbreviateHash(status.localHead))
+		return
+	}
+
+	fmt.Printf("On branch %s\n", status.branch)
+
+	if status.upstream != nil {
+		printUpstreamStatus(status)
+	} else {
+		fmt.Printf("There are no remote commits for the %s branch. Push in order to create the remote branch.\n", status.branch)
+	}
+}
+
+// Describes an operation in progress, along with how to continue it (or, for a merge, abort it)
+func printOperationStatus(operation *InProgressOperation, hasConflicts bool) {
+	fmt.Println()
+
+	switch operation.opType {
+	case OperationMerge:
+		if hasConflicts {
+			fmt.Println("You have unmerged paths.")
+			fmt.Println("  (fix conflicts and run \"git commit\")")
+			fmt.Println("  (use \"git merge --abort\" to abort the merge)")
+		} else {
+			fmt.Println("All conflicts fixed but you are still merging.")
+			fmt.Println("  (use \"git commit\" to conclude merge)")
+		}
+
+	case OperationRebase:
+		progress := ""
+		if operation.numSteps > 0 {
+			progress = fmt.Sprintf(" (commit %d of %d)", operation.currStep, operation.numSteps)
+		}
+		if operation.branchName != "" {
+			fmt.Printf("You are currently rebasing branch '%s' on '%s'%s.\n", operation.branchName, abbreviateHash(operation.onto), progress)
+		} else {
+			fmt.Printf("You are currently rebasing%s.\n", progress)
+		}
+
+		if hasConflicts {
+			fmt.Println("  (fix conflicts and then run \"git rebase --continue\")")
+		} else {
+			fmt.Println("  (all conflicts fixed: run \"git rebase --continue\")")
+		}
+		fmt.Println("  (use \"git rebase --skip\" to skip this patch)")
+
+	case OperationCherryPick, OperationRevert:
+		command, action := "cherry-pick", "cherry-picking"
+		if operation.opType == OperationRevert {
+			command, action = "revert", "reverting"
+		}
+
+		pending := ""
+		if operation.numPending > 0 {
+			pending = fmt.Sprintf(" (%d more %s pending)", operation.numPending, pluralize(operation.numPending, "commit", "commits"))
+		}
+		fmt.Printf("You are currently %s commit %s%s.\n", action, abbreviateHash(operation.commitHash), pending)
+
+		if hasConflicts {
+			fmt.Printf("  (fix conflicts and run \"git %s --continue\")\n", command)
+		} else {
+			fmt.Printf("  (all conflicts fixed: run \"git %s --continue\")\n", command)
+		}
+		fmt.Printf("  (use \"git %s --skip\" to skip this patch)\n", command)
+	}
+}
+
+func printStashStatus(status *RepositoryStatus) {
+	if status.stashCount > 0 {
+		fmt.Printf("Your stash currently has %d %s\n", status.stashCount, pluralize(status.stashCount, "entry", "entries"))
+	}
+}
+
+func printUpstreamStatus(status *RepositoryStatus) {
+	upstreamName := status.upstream.toString()
+
+	switch {
+	case status.upstreamHead == "":
+		fmt.Printf("Your branch is based on '%s', but the upstream is gone.\n", upstreamName)
+		fmt.Println("  (use \"git branch --unset-upstream\" to fixup)")
+	case status.ahead == 0 && status.behind == 0:
+		fmt.Printf("Your branch is up to date with '%s'.\n", upstreamName)
+	case status.behind == 0:
+		fmt.Printf("Your branch is ahead of '%s' by %d %s.\n", upstreamName, status.ahead, pluralize(status.ahead, "commit", "commits"))
+		fmt.Println("  (use \"git push\" to publish your local commits)")
+	case status.ahead == 0:
+		fmt.Printf("Your branch is behind '%s' by %d %s, and can be fast-forwarded.\n", upstreamName, status.behind, pluralize(status.behind, "commit", "commits"))
+		fmt.Println("  (use \"git pull\" to update your local branch)")
+	default:
+		fmt.Printf("Your branch and '%s' have diverged,\nand have %d and %d different commits each, respectively.\n", upstreamName, status.ahead, status.behind)
+		fmt.Println("  (use \"git pull\" to merge the remote branch into yours)")
+	}
+}
+
+// Lists the local branches, marking the current branch with an asterisk, or manages the upstream of a branch.
+// -u, --set-upstream-to --> Sets the upstream of the given branch (by default, the current branch) to the given
+// remote-tracking branch, e.g. origin/main. The upstream is used by status, pull, and push.
+// --unset-upstream --> Removes the upstream of the given branch (by default, the current branch).
+// --color[=<when>], --no-color --> Colors the current branch in the list always, never, or only when writing to a
+// terminal (auto), overriding the color.branch and color.ui config variables.
+func BranchHandler(repoDir string) {
+	usage := "Usage: branch [--color[=<when>] | --no-color] [(-u | --set-upstream-to) <remote>/<branch> [<branch_name>] | --unset-upstream [<branch_name>]]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	var upstreamName string
+	flag.StringVar(&upstreamName, "u", "", "Set the upstream of the branch")
+	flag.StringVar(&upstreamName, "set-upstream-to", "", "Set the upstream of the branch")
+	unsetUpstreamPtr := flag.Bool("unset-upstream", false, "Remove the upstream of the branch")
+	color := addColorFlags()
+	flag.Parse()
+
+	if flag.NArg() > 1 || (upstreamName != "" && *unsetUpstreamPtr) || (flag.NArg() == 1 && upstreamName == "" && !*unsetUpstreamPtr) {
+		log.Fatal(usage)
+	}
+
+	if upstreamName == "" && !*unsetUpstreamPtr {
+		colorizer, err := newColorizer(color, "branch", os.Stdout, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to determine whether to color output: %s\n", err)
+		}
+		if err := printBranches(colorizer, repoDir); err != nil {
+			log.Fatalf("Failed to list branches: %s\n", err)
+		}
+		return
+	}
+
+	var branchName string
+	if flag.NArg() == 1 {
+		branchName = flag.Arg(0)
+		if _, exists, err := ResolveBranchRef(branchName, "", repoDir); err != nil || !exists {
+			log.Fatalf("No branch named %s found\n", branchName)
+		}
+	} else {
+		currBranch, err := getCurrentBranch(repoDir)
+		if err != nil {
+			log.Fatalf("Failed to determine the current branch: %s\n", err)
+		}
+		branchName = currBranch
+	}
+
+	if *unsetUpstreamPtr {
+		if err := unsetBranchUpstream(branchName, repoDir); err != nil {
+			log.Fatalf("Failed to unset upstream: %s\n", err)
+		}
+		return
+	}
+
+	upstream, err := setBranchUpstream(branchName, upstreamName, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to set upstream: %s\n", err)
+	}
+	fmt.Printf("branch '%s' set up to track '%s'.\n", branchName, upstream.toString())
+}
+
+// Lists the configured remotes, or shows the details of a remote: its URL, its HEAD branch, its branches (compared
+// against the remote-tracking branches fetched from it), and the local branches pulled from and pushed to them.
+// -n --> Doesn't contact the remote repository, showing only what's known locally.
+func RemoteHandler(repoDir string) {
+	usage := "Usage: remote [show [-n] <name>]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	if len(os.Args) < 2 {
+		remoteNames, err := getRemoteNames(repoDir)
+		if err != nil {
+			log.Fatalf("Failed to list remotes: %s\n", err)
+		}
+		for _, remoteName := range remoteNames {
+			fmt.Println(remoteName)
+		}
+		return
+	}
+	if os.Args[1] != "show" {
+		log.Fatal(usage)
+	}
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	noQueryPtr := flag.Bool("n", false, "Don't contact the remote repository")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatal(usage)
+	}
+
+	if !*noQueryPtr {
+		if err := loadHTTPSettings(repoDir); err != nil {
+			log.Fatalf("Failed to set up HTTP client: %s\n", err)
+		}
+	}
+
+	details, err := getRemoteDetails(flag.Arg(0), !*noQueryPtr, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to show remote: %s\n", err)
+	}
+	printRemoteDetails(details)
+}
+
+func printRemoteDetails(details *RemoteDetails) {
+	fmt.Printf("* remote %s\n", details.name)
+	fmt.Printf("  Fetch URL: %s\n", details.url)
+	fmt.Printf("  Push  URL: %s\n", details.url)
+
+	switch {
+	case !details.queried:
+		fmt.Println("  HEAD branch: (not queried)")
+	case details.headBranch == "":
+		fmt.Println("  HEAD branch: (unknown)")
+	default:
+		fmt.Printf("  HEAD branch: %s\n", details.headBranch)
+	}
+
+	if len(details.branches) > 0 {
+		notQueried := ""
+		if !details.queried {
+			notQueried = " (status not queried)"
+		}
+		fmt.Printf("  %s:%s\n", pluralize(len(details.branches), "Remote branch", "Remote branches"), notQueried)
+
+		width := 0
+		for _, branch := range details.branches {
+			width = max(width, len(branch.name))
+		}
+		for _, branch := range details.branches {
+			if state := branch.state.describe(details.name); state != "" {
+				fmt.Printf("    %-*s %s\n", width, branch.name, state)
+			} else {
+				fmt.Printf("    %s\n", branch.name)
+			}
+		}
+	}
+
+	pullBranches := []*RemoteLocalBranch{}
+	for _, localBranch := range details.localBranches {
+		if localBranch.pullsFrom {
+			pullBranches = append(pullBranches, localBranch)
+		}
+	}
+	if len(pullBranches) > 0 {
+		fmt.Printf("  %s configured for 'git pull':\n", pluralize(len(pullBranches), "Local branch", "Local branches"))
+
+		pullAction := "merges with"
+		if details.pullRebase {
+			pullAction = "rebases onto"
+		}
+		width := 0
+		for _, localBranch := range pullBranches {
+			width = max(width, len(localBranch.name))
+		}
+		for _, localBranch := range pullBranches {
+			fmt.Printf("    %-*s %s remote %s\n", width, localBranch.name, pullAction, localBranch.remoteBranch)
+		}
+	}
+
+	if len(details.localBranches) > 0 {
+		notQueried := ""
+		if !details.queried {
+			notQueried = " (status not queried)"
+		}
+		fmt.Printf("  %s configured for 'git push'%s:\n", pluralize(len(details.localBranches), "Local ref", "Local refs"), notQueried)
+
+		width, remoteWidth := 0, 0
+		for _, localBranch := range details.localBranches {
+			width = max(width, len(localBranch.name))
+			remoteWidth = max(remoteWidth, len(localBranch.remoteBranch))
+		}
+		for _, localBranch := range details.localBranches {
+			if localBranch.pushStatus == "" {
+				fmt.Printf("    %-*s pushes to %s\n", width, localBranch.name, localBranch.remoteBranch)
+			} else {
+				fmt.Printf("    %-*s pushes to %-*s (%s)\n", width, localBranch.name, remoteWidth, localBranch.remoteBranch, localBranch.pushStatus)
+			}
+		}
+	}
+}
+
+// Lists the submodules recorded in the index, each with the commit checked out in it (or, if it hasn't been populated,
+// the commit recorded for it) and its path, in the same format as Git. Populated submodules are followed by a name
+// for their commit, such as the tag it's described by. The commit is prefixed by - if the submodule hasn't been
+// populated, + if its checked out commit differs from the one recorded in the index, or U if it has merge conflicts.
+// init registers the submodules' URLs from .gitmodules in the repository's config, and update clones each registered
+// submodule (if needed) and checks out the commit recorded for it.
+// --init --> For update, registers any submodules which haven't been registered first.
+func SubmoduleHandler(repoDir string) {
+	usage := "Usage: submodule [status | init | update [--init]]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	subcommand := "status"
+	if len(os.Args) > 1 {
+		subcommand = os.Args[1]
+		os.Args = append(os.Args[0:1], os.Args[2:]...)
+	}
+	initPtr := flag.Bool("init", false, "Register submodules which haven't been registered before updating")
+	flag.Parse()
+
+	if flag.NArg() != 0 || (*initPtr && subcommand != "update") {
+		log.Fatal(usage)
+	}
+
+	switch subcommand {
+	case "status":
+		states, err := GetSubmoduleStates(repoDir)
+		if err != nil {
+			log.Fatalf("Failed to determine submodule status: %s\n", err)
+		}
+		for _, state := range states {
+			fmt.Println(state.format())
+		}
+	case "init":
+		if err := InitSubmodules(repoDir); err != nil {
+			log.Fatalf("Failed to initialize submodules: %s\n", err)
+		}
+	case "update":
+		if *initPtr {
+			if err := InitSubmodules(repoDir); err != nil {
+				log.Fatalf("Failed to initialize submodules: %s\n", err)
+			}
+		}
+		if err := loadHTTPSettings(repoDir); err != nil {
+			log.Fatalf("Failed to set up HTTP client: %s\n", err)
+		}
+		if err := UpdateSubmodules(repoDir); err != nil {
+			log.Fatalf("Failed to update submodules: %s\n", err)
+		}
+	default:
+		log.Fatal(usage)
+	}
+}
+
+func printBranches(colorizer Colorizer, repoDir string) error {
+	branchNames, err := ListBranches("", repoDir)
+	if err != nil {
+		return err
+	}
+
+	// HEAD may be detached, in which case no branch is current, and the commit it's at is listed first, as in Git
+	currBranch, err := getStatusBranch(repoDir)
+	if err != nil {
+		return err
+	}
+	if currBranch == "" {
+		headCommitHash, _, err := ResolveHead("", repoDir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("* %s\n", colorizer.wrap(fmt.Sprintf("(HEAD detached at %s)", abbreviateHash(headCommitHash)), COLOR_GREEN))
+	}
+
+	for _, branchName := range branchNames {
+		if branchName == currBranch {
+			fmt.Printf("* %s\n", colorizer.wrap(branchName, COLOR_GREEN))
+		} else {
+			fmt.Printf("  %s\n", branchName)
+		}
+	}
+
+	return nil
+}
+
+// Writes an archive of the files in the given tree-ish (a commit, tag, or tree) to standard output, or to a file. Each
+// file is archived with its mode and its content as it would be checked out, and entries are given the commit's date.
+// --format=<tar|zip> --> The format of the archive. By default, it's inferred from the extension of the output file,
+// or is tar.
+// --prefix=<prefix>/ --> Prepends the prefix to the path of every entry, e.g. so that the archive unpacks into its own
+// directory.
+// -o, --output <file> --> Writes the archive to the file rather than to standard output.
+func ArchiveHandler(repoDir string) {
+	usage := "Usage: archive [--format=<tar|zip>] [--prefix=<prefix>/] [-o <file>] <tree-ish>"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	formatPtr := flag.String("format", "", "The format of the archive (tar or zip)")
+	prefixPtr := flag.String("prefix", "", "Prepend the prefix to the path of every entry")
+	outputPtr := flag.String("o", "", "Write the archive to the file rather than to standard output")
+	flag.StringVar(outputPtr, "output", "", "Write the archive to the file rather than to standard output")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatal(usage)
+	}
+
+	options := ArchiveOptions{format: ArchiveTar, prefix: *prefixPtr}
+	if *formatPtr != "" {
+		format, err := archiveFormatFromString(*formatPtr)
+		if err != nil {
+			log.Fatalf("Failed to create archive: %s\n", err)
+		}
+		options.format = format
+	} else if *outputPtr != "" {
+		options.format = archiveFormatFromPath(*outputPtr)
+	}
+
+	if *outputPtr == "" {
+		if err := WriteArchive(os.Stdout, flag.Arg(0), options, repoDir); err != nil {
+			log.Fatalf("Failed to create archive: %s\n", err)
+		}
+		return
+	}
+
+	file, err := os.Create(*outputPtr)
+	if err != nil {
+		log.Fatalf("Failed to create archive: %s\n", err)
+	}
+	err = WriteArchive(file, flag.Arg(0), options, repoDir)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*outputPtr)
+		log.Fatalf("Failed to create archive: %s\n", err)
+	}
+}
+
+// Creates or inspects a bundle, a file which can be cloned or pulled from in place of a remote repository (e.g. to move
+// a repository between machines without a network connection). create writes a bundle of the refs named by the
+// revisions, which may be refs, `--all`, `^<commit>`, or `<commit>..<ref>` (see CreateBundle). verify checks that the
+// bundle could be unbundled into the repository, i.e. that the repository has the bundle's prerequisites, and
+// list-heads prints the refs in the bundle.
+func BundleHandler(repoDir string) {
+	usage := "Usage: bundle create <file> <revision>... | bundle verify <file> | bundle list-heads <file>"
+
+	if len(os.Args) < 4 {
+		log.Fatal(usage)
+	}
+	subcommand, bundlePath, revisions := os.Args[2], os.Args[3], os.Args[4:]
+
+	switch subcommand {
+	case "create":
+		if len(revisions) == 0 {
+			log.Fatal(usage)
+		}
+		if _, err := CreateBundle(bundlePath, revisions, repoDir); err != nil {
+			log.Fatalf("Failed to create bundle: %s\n", err)
+		}
+	case "verify":
+		if len(revisions) != 0 {
+			log.Fatal(usage)
+		}
+		bundle, err := readBundle(bundlePath)
+		if err != nil {
+			log.Fatalf("Failed to read bundle: %s\n", err)
+		}
+		if err := bundle.checkPrerequisites(repoDir); err != nil {
+			log.Fatalf("Failed to verify bundle: %s\n", err)
+		}
+
+		fmt.Printf("The bundle contains %s:\n", pluralize(len(bundle.refs), "this ref", fmt.Sprintf("these %d refs", len(bundle.refs))))
+		for _, ref := range bundle.refs {
+			fmt.Printf("%s %s\n", ref.hash, ref.name)
+		}
+		if len(bundle.prerequisites) == 0 {
+			fmt.Println("The bundle records a complete history.")
+		} else {
+			fmt.Printf("The bundle requires %s:\n", pluralize(len(bundle.prerequisites), "this ref", fmt.Sprintf("these %d refs", len(bundle.prerequisites))))
+			for _, prerequisite := range bundle.prerequisites {
+				fmt.Printf("%s %s\n", prerequisite.hash, prerequisite.comment)
+			}
+		}
+		fmt.Println("The bundle uses this hash algorithm: sha1")
+		fmt.Fprintf(os.Stderr, "%s is okay\n", bundlePath)
+	case "list-heads":
+		if len(revisions) != 0 {
+			log.Fatal(usage)
+		}
+		bundle, err := readBundle(bundlePath)
+		if err != nil {
+			log.Fatalf("Failed to read bundle: %s\n", err)
+		}
+		for _, ref := range bundle.refs {
+			fmt.Printf("%s %s\n", ref.hash, ref.name)
+		}
+	default:
+		log.Fatal(usage)
+	}
+}
+
+// Moves loose refs into the .git/packed-refs file, which is more efficient for repositories with many refs.
+// --all --> Packs all refs. By default, only tags and refs which have already been packed are packed.
+func PackRefsHandler(repoDir string) {
+	if len(os.Args) < 2 || len(os.Args) > 3 {
+		log.Fatal("Usage: pack-refs [--all]")
+	}
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	allPtr := flag.Bool("all", false, "Pack all refs")
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		log.Fatal("Usage: pack-refs [--all]")
+	}
+
+	numPacked, err := PackRefs(*allPtr, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to pack refs: %s\n", err)
+	}
+	fmt.Printf("Packed %d refs\n", numPacked)
+}
+
+// Updates the given ref (e.g. refs/heads/main, or HEAD to update the current branch) to point to the given object.
+// If an old object hash is given, the ref is only updated if it currently points to that object, with the all-zero
+// hash meaning that the ref must not exist yet.
+// -d --> Deletes the ref instead, optionally only if it currently points to the given old object hash.
+// --stdin --> Reads update, create, delete, and verify commands from standard input, one per line, and applies them
+// together in one transaction (see ApplyRefUpdateCommands), so that either all of them are made or none are.
+func UpdateRefHandler(repoDir string) {
+	usage := "Usage: update-ref <ref> <new_sha> [<old_sha>] | update-ref -d <ref> [<old_sha>] | update-ref --stdin"
+	if len(os.Args) < 3 {
+		log.Fatal(usage)
+	}
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	deletePtr := flag.Bool("d", false, "Delete the ref")
+	stdinPtr := flag.Bool("stdin", false, "Read ref update commands from standard input")
+	flag.Parse()
+
+	if *stdinPtr {
+		if *deletePtr || flag.NArg() != 0 {
+			log.Fatal(usage)
+		}
+
+		err := ApplyRefUpdateCommands(os.Stdin, os.Stdout, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to update refs: %s\n", err)
+		}
+		return
+	}
+
+	if *deletePtr {
+		if flag.NArg() < 1 || flag.NArg() > 2 {
+			log.Fatal(usage)
+		}
+
+		err := DeleteRef(flag.Arg(0), flag.Arg(1), repoDir)
+		if err != nil {
+			log.Fatalf("Failed to delete ref %s: %s\n", flag.Arg(0), err)
+		}
+		return
+	}
+
+	if flag.NArg() < 2 || flag.NArg() > 3 {
+		log.Fatal(usage)
+	}
+
+	refName, newHash, expectedOldHash := flag.Arg(0), flag.Arg(1), flag.Arg(2)
+	if !isValidObjectHash(newHash) || !objectExists(newHash, repoDir) {
+		log.Fatalf("Object %s does not exist\n", newHash)
+	}
+
+	err := UpdateRef(refName, newHash, expectedOldHash, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to update ref %s: %s\n", refName, err)
+	}
+}
+
+// Lists the refs under refs/ (optionally only those matching the given patterns, e.g. refs/heads or refs/tags/v1.*),
+// each formatted by the given format, in which %(<field>) is replaced by a field of the ref: refname, objectname,
+// objecttype, symref, upstream, or HEAD (* for the current branch), with :short giving a shortened form.
+// --format --> The format of each line, which defaults to `%(objectname) %(objecttype)\t%(refname)`.
+// --count --> Stops after listing the given number of refs.
+func ForEachRefHandler(repoDir string) {
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	formatPtr := flag.String("format", DEFAULT_FOR_EACH_REF_FORMAT, "The format of each ref's line")
+	countPtr := flag.Int("count", 0, "The maximum number of refs to list")
+	flag.Parse()
+
+	if *countPtr < 0 {
+		log.Fatal("Usage: for-each-ref [--format=<format>] [--count=<n>] [<pattern>...]")
+	}
+
+	lines, err := ForEachRef(ForEachRefOptions{format: *formatPtr, patterns: flag.Args(), count: *countPtr}, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to list refs: %s\n", err)
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+// Prints the ref that the given symbolic ref (e.g. HEAD) points to, or, if a target ref is given, points the
+// symbolic ref at it.
+func SymbolicRefHandler(repoDir string) {
+	if len(os.Args) < 3 || len(os.Args) > 4 {
+		log.Fatal("Usage: symbolic-ref <name> [<ref>]")
+	}
+
+	refName := os.Args[2]
+	if len(os.Args) == 4 {
+		err := UpdateSymbolicRef(refName, os.Args[3], repoDir)
+		if err != nil {
+			log.Fatalf("Failed to update symbolic ref %s: %s\n", refName, err)
+		}
+		return
+	}
+
+	targetRefName, isSymbolic, err := ReadSymbolicRef(refName, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to read symbolic ref %s: %s\n", refName, err)
+	}
+	if !isSymbolic {
+		log.Fatalf("ref %s is not a symbolic ref\n", refName)
+	}
+	fmt.Println(targetRefName)
+}
+
+// Checks a repository created by real Git (in the current directory) for anything that mygit can't read, and adapts
+// what it can, e.g. by unpacking packfiles into loose objects. Reports the outcome of each check, exiting with a
+// non-zero status if any incompatibilities remain.
+func MigrateFromGitHandler(repoDir string) {
+	if len(os.Args) != 2 {
+		log.Fatal("Usage: migrate-from-git")
+	}
+
+	checks, err := MigrateFromGit(repoDir)
+	if err != nil {
+		log.Fatalf("Failed to migrate repository: %s\n", err)
+	}
+
+	colorizer, err := newColorizer(nil, "", os.Stdout, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine whether to color output: %s\n", err)
+	}
+
+	numIncompatible := 0
+	for _, check := range checks {
+		color := COLOR_GREEN
+		if check.state == MigrationIncompatible {
+			color = COLOR_RED
+			numIncompatible += 1
+		}
+		fmt.Printf("%s %-10s %s\n", colorizer.wrap(fmt.Sprintf("%-12s", check.state.toString()), color), check.name, check.details)
+	}
+
+	if numIncompatible > 0 {
+		log.Fatalf("\nFound %d %s: this repository can't be fully used with mygit\n", numIncompatible, pluralize(numIncompatible, "incompatibility", "incompatibilities"))
+	}
+	fmt.Println("\nThis repository can be used with mygit")
+}
+
+// Diagnoses problems with the repository, checking that its config, HEAD, refs, objects, and index can all be read,
+// that no stale lock files are left behind, that the user's identity is configured, and that the default remote is
+// reachable. Reports the outcome of each check along with a suggested fix for any problem found, exiting with a
+// non-zero status if any check failed.
+// -n --> Doesn't contact the remote repository.
+func DoctorHandler(repoDir string) {
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	noRemotePtr := flag.Bool("n", false, "Don't contact the remote repository")
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		log.Fatal("Usage: doctor [-n]")
+	}
+
+	// A config which can't be read is reported by the checks themselves, so the output is then left uncolored
+	colorizer, _ := newColorizer(nil, "", os.Stdout, repoDir)
+
+	numErrors, numWarnings := 0, 0
+	for _, check := range RunDoctor(!*noRemotePtr, repoDir) {
+		color := COLOR_GREEN
+		switch check.state {
+		case DoctorWarning:
+			color = COLOR_YELLOW
+			numWarnings += 1
+		case DoctorError:
+			color = COLOR_RED
+			numErrors += 1
+		}
+
+		fmt.Printf("%s %-9s %s\n", colorizer.wrap(fmt.Sprintf("%-8s", check.state.toString()), color), check.name, check.details)
+		if check.fix != "" {
+			fmt.Printf("%-18s fix: %s\n", "", check.fix)
+		}
+	}
+
+	if numErrors > 0 {
+		log.Fatalf("\nFound %d %s and %d %s\n", numErrors, pluralize(numErrors, "error", "errors"), numWarnings, pluralize(numWarnings, "warning", "warnings"))
+	}
+	if numWarnings > 0 {
+		fmt.Printf("\nFound %d %s\n", numWarnings, pluralize(numWarnings, "warning", "warnings"))
+		return
+	}
+	fmt.Println("\nNo problems found")
+}
+
+// Generates a synthetic repository in the given directory (created if it doesn't exist yet), for use as a
+// reproducible fixture in benchmarks and stress tests. This is a development command, so isn't documented with the
+// others. The same options always generate a repository with the same object hashes.
+// --files --> The number of files in the repository.
+// --min-size, --max-size --> The range of file sizes, in bytes.
+// --size-distribution --> How file sizes are spread over the range: uniform, or exponential (mostly small files).
+// --commits --> The number of commits on the initial branch, each modifying about a tenth of the files.
+// --branches --> The number of topic branches, each forked from a random commit on the initial branch.
+// --branch-commits --> The number of commits on each topic branch.
+// --merge --> Merges each topic branch back into the initial branch.
+// --seed --> Seeds the random choices, so that different repositories can be generated with the same options.
+func SynthRepoHandler(repoDir string) {
+	usage := "Usage: synth-repo [--files=<n>] [--min-size=<bytes>] [--max-size=<bytes>] [--size-distribution=<distribution>] [--commits=<n>] [--branches=<n>] [--branch-commits=<n>] [--merge] [--seed=<n>] <directory>"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	var options SynthRepoOptions
+	flag.IntVar(&options.files, "files", 100, "The number of files in the repository")
+	flag.IntVar(&options.minFileSize, "min-size", 16, "The minimum size of a file, in bytes")
+	flag.IntVar(&options.maxFileSize, "max-size", 4096, "The maximum size of a file, in bytes")
+	sizeDistributionPtr := flag.String("size-distribution", "uniform", "How file sizes are spread over the range")
+	flag.IntVar(&options.commits, "commits", 10, "The number of commits on the initial branch")
+	flag.IntVar(&options.branches, "branches", 0, "The number of topic branches")
+	flag.IntVar(&options.branchCommits, "branch-commits", 3, "The number of commits on each topic branch")
+	flag.BoolVar(&options.merge, "merge", false, "Merge each topic branch back into the initial branch")
+	flag.Int64Var(&options.seed, "seed", 1, "The seed for the random choices")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatal(usage)
+	}
+
+	sizeDistribution, err := parseSynthSizeDistribution(*sizeDistributionPtr)
+	if err != nil {
+		log.Fatalf("Invalid size distribution: %s\n", err)
+	}
+	options.sizeDistribution = sizeDistribution
+
+	targetDir := flag.Arg(0)
+	if !filepath.IsAbs(targetDir) {
+		targetDir = filepath.Join(repoDir, targetDir)
+	}
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		log.Fatalf("Failed to create directory %s: %s\n", flag.Arg(0), err)
+	}
+
+	head, err := GenerateSynthRepo(options, filepath.Clean(targetDir)+string(filepath.Separator))
+	if err != nil {
+		log.Fatalf("Failed to generate synthetic repository: %s\n", err)
+	}
+
+	fmt.Printf("Generated synthetic repository in %s at %s\n", targetDir, head)
+}
+
+// Prints the value of the given config variable, as set by the system, global, repository, and worktree config files
+// (and any files they include), in increasing order of precedence. Exits with a non-zero status if it isn't set.
+// -l, --list --> Prints every variable set, as <name>=<value>, in the order in which they're read.
+// --show-origin --> Prefixes each value with the path of the file that set it.
+// --show-scope --> Prefixes each value with the scope (system, global, local, or worktree) of the file that set it.
+func ConfigHandler(repoDir string) {
+	usage := "Usage: config [--show-origin] [--show-scope] (-l | --list | <name>)"
+	if len(os.Args) < 3 {
+		log.Fatal(usage)
+	}
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	listPtr := flag.Bool("l", false, "List every variable")
+	flag.BoolVar(listPtr, "list", false, "List every variable")
+	showOriginPtr := flag.Bool("show-origin", false, "Show the file that set each variable")
+	showScopePtr := flag.Bool("show-scope", false, "Show the scope of the file that set each variable")
+	flag.Parse()
+
+	if (*listPtr && flag.NArg() != 0) || (!*listPtr && flag.NArg() != 1) {
+		log.Fatal(usage)
+	}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		log.Fatalf("Failed to read config: %s\n", err)
+	}
+
+	formatPrefix := func(entry *ConfigEntry) string {
+		prefix := ""
+		if *showScopePtr {
+			prefix += entry.scope.toString() + "\t"
+		}
+		if *showOriginPtr {
+			prefix += "file:" + entry.origin + "\t"
+		}
+		return prefix
+	}
+
+	if *listPtr {
+		for _, entry := range config.entries {
+			fmt.Printf("%s%s=%s\n", formatPrefix(entry), entry.name(), entry.value)
+		}
+		return
+	}
+
+	entry, found := config.getEntry(flag.Arg(0))
+	if !found {
+		exit(1)
+	}
+	fmt.Printf("%s%s\n", formatPrefix(entry), entry.value)
+}
+
+// Shows, for each line of the given file (as of HEAD), the commit which last changed it, along with the commit's
+// author and the time it was authored.
+// -L <start>,<end> --> Only blames the given range of lines (1-indexed and inclusive). The end may also be given as
+// +<count>, or omitted to blame up to the end of the file.
+// -w --> Ignores whitespace changes when determining which commit last changed each line.
+// --diff-algorithm --> Identifies the algorithm used to diff each version of the file against the previous one
+// (myers, minimal, patience, or histogram), overriding the diff.algorithm config variable.
+// --incremental --> Prints each run of lines as soon as its commit is found, in a machine-readable format (as used
+// by editor integrations): a `<hash> <orig_line> <final_line> <num_lines>` header followed by information about the
+// commit the first time it appears.
+func BlameHandler(repoDir string) {
+	usage := "Usage: blame [-L <start>,<end>] [-w] [--diff-algorithm=<algorithm>] [--incremental] <file>"
+	if len(os.Args) < 3 {
+		log.Fatal(usage)
+	}
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	lineRangePtr := flag.String("L", "", "Only blame the given range of lines")
+	ignoreWhitespacePtr := flag.Bool("w", false, "Ignore whitespace changes")
+	diffAlgorithmPtr := flag.String("diff-algorithm", "", "The algorithm used to diff each version of the file")
+	incrementalPtr := flag.Bool("incremental", false, "Print machine-readable output as each run of lines is blamed")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatal(usage)
+	}
+	path := filepath.ToSlash(filepath.Clean(flag.Arg(0)))
+
+	algorithm, err := getDiffAlgorithm(*diffAlgorithmPtr, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine diff algorithm: %s\n", err)
+	}
+
+	options := BlameOptions{startLine: 0, endLine: -1, diff: DiffOptions{algorithm: algorithm, ignoreAllSpace: *ignoreWhitespacePtr}}
+	if *lineRangePtr != "" {
+		startLine, endLine, err := parseBlameLineRange(*lineRangePtr)
+		if err != nil {
+			log.Fatalf("Invalid line range %s: %s\n", *lineRangePtr, err)
+		}
+		options.startLine, options.endLine = startLine, endLine
+	}
+
+	headCommitHash, commitsExist, err := ResolveHead("", repoDir)
+	if err != nil {
+		log.Fatalf("Failed to resolve HEAD: %s\n", err)
+	}
+	if !commitsExist {
+		log.Fatal("No commits found in repository")
+	}
+
+	entries := []*BlameEntry{}
+	emit := func(entry *BlameEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}
+
+	if *incrementalPtr {
+		seenCommits := make(map[string]bool)
+		emit = func(entry *BlameEntry) error {
+			printIncrementalBlameEntry(entry, path, !seenCommits[entry.commitObj.hash])
+			seenCommits[entry.commitObj.hash] = true
+			return nil
+		}
+	}
+
+	err = Blame(path, headCommitHash, options, emit, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to blame %s: %s\n", path, err)
+	}
+
+	if !*incrementalPtr {
+		printBlameEntries(entries)
+	}
+}
+
+// Parses a line range such as 10,20 or 10,+5, returning its 0-indexed start (inclusive) and end (exclusive), where
+// an end of -1 means the end of the file
+func parseBlameLineRange(lineRange string) (int, int, error) {
+	startStr, endStr, hasEnd := strings.Cut(lineRange, ",")
+	start, err := strconv.Atoi(startStr)
+	if err != nil || start < 1 {
+		return -1, -1, fmt.Errorf("start must be a positive line number")
+	}
+
+	if !hasEnd || endStr == "" {
+		return start - 1, -1, nil
+	}
+
+	if countStr, isCount := strings.CutPrefix(endStr, "+"); isCount {
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count < 1 {
+			return -1, -1, fmt.Errorf("count must be a positive number of lines")
+		}
+		return start - 1, start - 1 + count, nil
+	}
+
+	end, err := strconv.Atoi(endStr)
+	if err != nil || end < start {
+		return -1, -1, fmt.Errorf("end must be a line number no less than the start")
+	}
+	return start - 1, end, nil
+}
+
+// Prints each blamed line in Git's default format, e.g.
+// `a1b2c3d4 (Jane Doe 2024-01-31 12:34:56 +0000 1) package main`. Lines attributed to a root commit are marked with
+// a leading ^.
+func printBlameEntries(entries []*BlameEntry) {
+	sort.Slice(entries, func(i int, j int) bool {
+		return entries[i].finalStart < entries[j].finalStart
+	})
+
+	authorWidth, maxLineNum := 0, 0
+	for _, entry := range entries {
+		authorWidth = max(authorWidth, len(entry.commitObj.author.name))
+		maxLineNum = max(maxLineNum, entry.finalStart+entry.numLines)
+	}
+	lineNumWidth := len(strconv.Itoa(maxLineNum))
+
+	for _, entry := range entries {
+		abbrevHash := entry.commitObj.hash[:BLAME_ABBREV_HASH_LENGTH]
+		if entry.boundary {
+			abbrevHash = "^" + entry.commitObj.hash[:BLAME_ABBREV_HASH_LENGTH-1]
+		}
+		authorTime := entry.commitObj.author.formatDate(DateFormatISO)
+
+		for i, line := range entry.lines {
+			fmt.Printf("%s (%-*s %s %*d) %s", abbrevHash, authorWidth, entry.commitObj.author.name, authorTime, lineNumWidth, entry.finalStart+i+1, line)
+			if !strings.HasSuffix(line, "\n") {
+				fmt.Println()
+			}
+		}
+	}
+}
+
+func printIncrementalBlameEntry(entry *BlameEntry, path string, firstForCommit bool) {
+	commitObj := entry.commitObj
+	fmt.Printf("%s %d %d %d\n", commitObj.hash, entry.origStart+1, entry.finalStart+1, entry.numLines)
+
+	if firstForCommit {
+		fmt.Printf("author %s\n", commitObj.author.name)
+		fmt.Printf("author-mail <%s>\n", commitObj.author.email)
+		fmt.Printf("author-time %d\n", commitObj.author.dateSeconds)
+		fmt.Printf("author-tz %s\n", commitObj.author.timezone)
+		fmt.Printf("committer %s\n", commitObj.committer.name)
+		fmt.Printf("committer-mail <%s>\n", commitObj.committer.email)
+		fmt.Printf("committer-time %d\n", commitObj.committer.dateSeconds)
+		fmt.Printf("committer-tz %s\n", commitObj.committer.timezone)
+		fmt.Printf("summary %s\n", getCommitSubject(commitObj))
+		if entry.boundary {
+			fmt.Println("boundary")
+		}
+	}
+
+	if entry.prevHash != "" {
+		fmt.Printf("previous %s %s\n", entry.prevHash, path)
+	}
+
+	fmt.Printf("filename %s\n", path)
+}
+
+// Prints the best common ancestor of the first commit and any of the others (see MergeBases), e.g. the point at which
+// two branches diverged. Exits with status 1, without printing anything, if the commits have no common ancestor.
+// -a, --all --> Prints every best common ancestor, one per line, rather than just one.
+// --is-ancestor --> Checks whether the first of exactly two commits is an ancestor of the second, exiting with status 0
+// if so and 1 otherwise, without printing anything.
+func MergeBaseHandler(repoDir string) {
+	usage := "Usage: merge-base [-a | --all] <commit> <commit>...\n       merge-base --is-ancestor <commit> <commit>"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	allPtr := flag.Bool("a", false, "Print every best common ancestor")
+	flag.BoolVar(allPtr, "all", false, "Print every best common ancestor")
+	isAncestorPtr := flag.Bool("is-ancestor", false, "Check whether the first commit is an ancestor of the second")
+	flag.Parse()
+
+	if flag.NArg() < 2 || (*isAncestorPtr && (flag.NArg() != 2 || *allPtr)) {
+		log.Fatal(usage)
+	}
+
+	commitHashes := []string{}
+	for _, revision := range flag.Args() {
+		commitHash, err := resolveCommitish(revision, repoDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		commitHashes = append(commitHashes, commitHash)
+	}
+
+	if *isAncestorPtr {
+		isAncestor, err := isAncestorCommit(commitHashes[0], commitHashes[1], repoDir)
+		if err != nil {
+			log.Fatalf("Failed to determine ancestry: %s\n", err)
+		}
+		if !isAncestor {
+			exit(1)
+		}
+		return
+	}
+
+	baseHashes, err := MergeBases(commitHashes[0], commitHashes[1:], repoDir)
+	if err != nil {
+		log.Fatalf("Failed to find merge base: %s\n", err)
+	}
+	if len(baseHashes) == 0 {
+		exit(1)
+	}
+	if !*allPtr {
+		baseHashes = baseHashes[:1]
+	}
+	for _, baseHash := range baseHashes {
+		fmt.Println(baseHash)
+	}
+}
+
+// Lists the commits reachable from the given revisions, most recent first (see RevList). Revisions may be excluded
+// with ^ or given as ranges, as with log.
+// --not --> Excludes the history of the revisions after it (up to the next --not), as if each were prefixed with ^.
+// --objects --> Also lists the trees and blobs reachable from the listed commits which the excluded commits don't
+// have, each with its path, after the commits.
+func RevListHandler(repoDir string) {
+	usage := "Usage: rev-list [--objects] <commit>... [--not <commit>...]"
+
+	// As in Git, --not applies to the revisions after it, so the arguments are parsed in order
+	objects, not := false, false
+	revisions := []string{}
+	for _, arg := range os.Args[2:] {
+		switch {
+		case arg == "--objects":
+			objects = true
+		case arg == "--not":
+			not = !not
+		case strings.HasPrefix(arg, "-"):
+			log.Fatal(usage)
+		case not && strings.HasPrefix(arg, "^"):
+			revisions = append(revisions, arg[1:])
+		case not:
+			revisions = append(revisions, "^"+arg)
+		default:
+			revisions = append(revisions, arg)
+		}
+	}
+	if len(revisions) == 0 {
+		log.Fatal(usage)
+	}
+
+	startHashes, excludedHashes := []string{}, []string{}
+	for _, revision := range revisions {
+		revisionRange, err := resolveRevisionRange(revision, repoDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		startHashes = append(startHashes, revisionRange.included...)
+		excludedHashes = append(excludedHashes, revisionRange.excluded...)
+
+		// The history common to both sides of A...B is excluded, i.e. that of their merge bases
+		if revisionRange.symmetric {
+			baseHashes, err := MergeBases(revisionRange.included[0], revisionRange.included[1:], repoDir)
+			if err != nil {
+				log.Fatalf("Failed to find merge base: %s\n", err)
+			}
+			excludedHashes = append(excludedHashes, baseHashes...)
+		}
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	err := RevList(startHashes, excludedHashes, objects, output, repoDir)
+	if flushErr := output.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		log.Fatalf("Failed to list revisions: %s\n", err)
+	}
+}
+
+// Merges the changes made to the base file by the other file into the current file, as git merge-file does, writing
+// the result into the current file (see mergeFileContents). Conflicting changes are written between conflict markers,
+// in the style given by the merge.conflictStyle config variable (merge by default), and labeled with the files' names.
+// Exits with the number of conflicts as its status (capped at 127), so 0 means the merge was clean.
+// -p --> Prints the result, rather than writing it into the current file.
+// --diff3 --> Also shows the base's version of the lines in each conflict.
+// --zdiff3 --> Like --diff3, but moves lines common to both sides at the start and end of each conflict out of it.
+// -L <label> --> Labels the current file's conflict markers with the given label, rather than its name. May be given
+// up to three times, labeling the current, base, and other files in turn.
+func MergeFileHandler(repoDir string) {
+	usage := "Usage: merge-file [-p] [--diff3 | --zdiff3] [-L <current_name> [-L <base_name> [-L <other_name>]]] <current_file> <base_file> <other_file>"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	printPtr := flag.Bool("p", false, "Print the result rather than writing it into the current file")
+	flag.BoolVar(printPtr, "stdout", false, "Print the result rather than writing it into the current file")
+	diff3Ptr := flag.Bool("diff3", false, "Also show the base's version of the lines in each conflict")
+	zdiff3Ptr := flag.Bool("zdiff3", false, "Show the base's version, moving common lines out of each conflict")
+	var labels stringListFlag
+	flag.Var(&labels, "L", "Label for the current, base, or other file's conflict markers")
+	flag.Parse()
+
+	if flag.NArg() != 3 || len(labels) > 3 || (*diff3Ptr && *zdiff3Ptr) {
+		log.Fatal(usage)
+	}
+
+	styleName := ""
+	if *diff3Ptr {
+		styleName = "diff3"
+	} else if *zdiff3Ptr {
+		styleName = "zdiff3"
+	}
+	style, err := getConflictStyle(styleName, repoDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	algorithm, err := getDiffAlgorithm("", repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine diff algorithm: %s\n", err)
+	}
+
+	fileNames := flag.Args()
+	contents := make([][]byte, len(fileNames))
+	for i, fileName := range fileNames {
+		contents[i], err = os.ReadFile(fileName)
+		if err != nil {
+			log.Fatalf("Failed to read file %s: %s\n", fileName, err)
+		}
+		if isBinaryContent(contents[i]) {
+			log.Fatalf("Cannot merge binary files: %s\n", fileName)
+		}
+	}
+
+	markerLabels := append(labels, fileNames[len(labels):]...)
+	options := MergeFileOptions{
+		style:        style,
+		oursLabel:    markerLabels[0],
+		baseLabel:    markerLabels[1],
+		theirsLabel:  markerLabels[2],
+		diffOptions:  DiffOptions{algorithm: algorithm},
+		joinNonAlnum: true,
+	}
+	merged, numConflicts := mergeFileContents(contents[1], contents[0], contents[2], options)
+
+	if *printPtr {
+		os.Stdout.Write(merged)
+	} else if err := os.WriteFile(fileNames[0], merged, 0644); err != nil {
+		log.Fatalf("Failed to write file %s: %s\n", fileNames[0], err)
+	}
+	exit(min(numConflicts, 127))
+}
+
+// Merges the given commit (e.g. a branch) into the current branch, as git merge does (see Merge). The current branch
+// is fast-forwarded if it's an ancestor of the commit, and otherwise a merge commit is made. Conflicting changes are
+// left in the working tree between conflict markers, in the style given by the merge.conflictStyle config variable,
+// and recorded in the index as unmerged, to be resolved with add and then committed. Exits with status 1 if the merge
+// has conflicts.
+// -m <message> --> Uses the given message for the merge commit, rather than one naming the merged commit.
+// --no-ff --> Makes a merge commit even if the current branch could be fast-forwarded.
+// --ff-only --> Refuses to merge unless the current branch can be fast-forwarded.
+// --abort --> Abandons the merge in progress, resetting the files it changed to their versions in HEAD (see
+// AbortMerge).
+func MergeHandler(repoDir string) {
+	usage := "Usage: merge [--no-ff | --ff-only] [-m <message>] <commit> | merge --abort"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	messagePtr := flag.String("m", "", "Message for the merge commit")
+	noFastForwardPtr := flag.Bool("no-ff", false, "Make a merge commit even if the current branch could be fast-forwarded")
+	fastForwardOnlyPtr := flag.Bool("ff-only", false, "Refuse to merge unless the current branch can be fast-forwarded")
+	abortPtr := flag.Bool("abort", false, "Abandon the merge in progress")
+	flag.Parse()
+
+	if *abortPtr {
+		if flag.NArg() != 0 || *messagePtr != "" || *noFastForwardPtr || *fastForwardOnlyPtr {
+			log.Fatal(usage)
+		}
+		if err := AbortMerge(repoDir); err != nil {
+			log.Fatalf("Failed to abort merge: %s\n", err)
+		}
+		return
+	}
+
+	if flag.NArg() != 1 || (*noFastForwardPtr && *fastForwardOnlyPtr) {
+		log.Fatal(usage)
+	}
+
+	options := MergeOptions{
+		message:         *messagePtr,
+		noFastForward:   *noFastForwardPtr,
+		fastForwardOnly: *fastForwardOnlyPtr,
+	}
+	merged, err := Merge(flag.Arg(0), options, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to merge %s: %s\n", flag.Arg(0), err)
+	}
+	if !merged {
+		exit(1)
+	}
+}
+
+// Describes the given commit (HEAD by default) by the most recent tag reachable from it, as
+// <tag>-<number of commits since the tag>-g<abbreviated hash>, or by just the tag name if the commit is tagged.
+// --tags --> Also uses lightweight tags, rather than only annotated tags.
+// --first-parent --> Only follows the first parent of merge commits, so that tags on merged-in branches aren't used.
+// --match <pattern> --> Only uses tags matching the glob pattern (e.g. v[0-9]*). May be given several times, in which
+// case tags matching any of the patterns are used.
+// --exclude <pattern> --> Never uses tags matching the glob pattern (e.g. nightly-*). May be given several times.
+func DescribeHandler(repoDir string) {
+	usage := "Usage: describe [--tags] [--first-parent] [--match <pattern>]... [--exclude <pattern>]... [<commit>]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	tagsPtr := flag.Bool("tags", false, "Also use lightweight tags")
+	firstParentPtr := flag.Bool("first-parent", false, "Only follow the first parent of merge commits")
+	var match, exclude patternListFlag
+	flag.Var(&match, "match", "Only use tags matching the glob pattern")
+	flag.Var(&exclude, "exclude", "Never use tags matching the glob pattern")
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		log.Fatal(usage)
+	}
+
+	commitish := "HEAD"
+	if flag.NArg() == 1 {
+		commitish = flag.Arg(0)
+	}
+
+	commitHash, err := resolveCommitish(commitish, repoDir)
+	if err != nil {
+		log.Fatalf("Could not resolve commit: %s\n", err)
+	}
+
+	options := DescribeOptions{tags: *tagsPtr, firstParent: *firstParentPtr, match: match, exclude: exclude}
+	description, err := Describe(commitHash, options, repoDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(description)
+}
+
+// Shows the commit history reachable from the given revisions (HEAD by default), most recently committed first. Each
+// revision is HEAD, a commit hash, or a branch, tag, or remote-tracking branch name, or excludes history: ^A excludes
+// the history of A, A..B shows the commits on B since it diverged from A, and A...B shows the commits on either side
+// since they diverged (see RevisionRange). Given paths (after the revisions, optionally separated from them by --),
+// only commits which changed the files at or within those paths are shown. Commits are printed as they're found, so
+// the start of a long history (e.g. piped into head) is shown immediately. On a terminal, the output is shown through
+// a pager (see startPager).
+// -n, --max-count <number> --> Shows at most the given number of commits.
+// --oneline --> Shows each commit as its abbreviated hash and the subject of its message.
+// --first-parent --> Only follows the first parent of merge commits.
+// --date=<format> --> Shows dates in the given format: default, iso, iso-strict, rfc, short, raw, or unix.
+// --color[=<when>], --no-color --> Colors commit hashes always, never, or only when writing to a terminal (auto),
+// overriding the color.diff and color.ui config variables.
+// --stat --> Shows a diffstat of the changes made by each commit after it: the number of changed lines in each file,
+// with a graph of its insertions and deletions, and the total numbers of files changed, insertions, and deletions.
+// Merge commits have no diffstat, unless --first-parent is given.
+// --show-signature --> Verifies the signature of each signed commit (see verifyCommitSignature), showing the report on
+// it after the commit's hash.
+func LogHandler(repoDir string) {
+	usage := "Usage: log [-n <number>] [--oneline] [--first-parent] [--date=<format>] [--stat] [--show-signature] [--color[=<when>] | --no-color] [<revision>...] [[--] <path>...]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	maxCountPtr := flag.Int("n", -1, "Show at most the given number of commits")
+	flag.IntVar(maxCountPtr, "max-count", -1, "Show at most the given number of commits")
+	onelinePtr := flag.Bool("oneline", false, "Show each commit as its abbreviated hash and subject")
+	firstParentPtr := flag.Bool("first-parent", false, "Only follow the first parent of merge commits")
+	dateFormatPtr := flag.String("date", "default", "Show dates in the given format")
+	statPtr := flag.Bool("stat", false, "Show a diffstat of the changes made by each commit")
+	showSignaturePtr := flag.Bool("show-signature", false, "Verify the signature of each signed commit")
+	color := addColorFlags()
+	flag.Parse()
+
+	dateFormat, err := parseDateFormat(*dateFormatPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	algorithm, err := getDiffAlgorithm("", repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine diff algorithm: %s\n", err)
+	}
+
+	if err := startPager("log", repoDir); err != nil {
+		log.Fatalf("Failed to start pager: %s\n", err)
+	}
+
+	// As in Git, log is colored as selected by color.diff
+	colorizer, err := newColorizer(color, "diff", os.Stdout, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine whether to color output: %s\n", err)
+	}
+
+	revisions, paths, err := splitRevisionsAndPaths(flag.Args(), repoDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(revisions) == 0 {
+		revisions = []string{"HEAD"}
+	}
+	for _, revision := range revisions {
+		if strings.HasPrefix(revision, "-") {
+			log.Fatal(usage)
+		}
+	}
+
+	startHashes, excluded, err := resolveRevisionRanges(revisions, repoDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	options := LogOptions{
+		maxCount:      *maxCountPtr,
+		oneline:       *onelinePtr,
+		firstParent:   *firstParentPtr,
+		dateFormat:    dateFormat,
+		colorizer:     colorizer,
+		stat:          *statPtr,
+		showSignature: *showSignaturePtr,
+		diffOptions:   DiffOptions{algorithm: algorithm},
+		paths:         paths,
+	}
+	err = Log(startHashes, excluded, options, output, repoDir)
+	if flushErr := output.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		log.Fatalf("Failed to show log: %s\n", err)
+	}
+}
+
+// Summarizes the commit history reachable from the given revisions or ranges (HEAD by default, see LogHandler) by
+// author, listing the subjects of each author's commits, oldest first, under their name and number of commits (see
+// Shortlog). The flags may be combined, e.g. shortlog -sn v1.0..v2.0 to rank the authors of a release by their numbers
+// of commits.
+// -s, --summary --> Shows only the number of commits by each author.
+// -n, --numbered --> Sorts the authors by their numbers of commits, rather than by name.
+// -e, --email --> Shows each author's email address along with their name.
+func ShortlogHandler(repoDir string) {
+	usage := "Usage: shortlog [-s] [-n] [-e] [<revision>...]"
+
+	// The flags are usually given together, e.g. -sn
+	os.Args = append(os.Args[0:1], splitBundledFlags(os.Args[2:], "sne")...)
+	var options ShortlogOptions
+	flag.BoolVar(&options.summary, "s", false, "Show only the number of commits by each author")
+	flag.BoolVar(&options.summary, "summary", false, "Show only the number of commits by each author")
+	flag.BoolVar(&options.numbered, "n", false, "Sort the authors by their numbers of commits")
+	flag.BoolVar(&options.numbered, "numbered", false, "Sort the authors by their numbers of commits")
+	flag.BoolVar(&options.email, "e", false, "Show each author's email address")
+	flag.BoolVar(&options.email, "email", false, "Show each author's email address")
+	flag.Parse()
+
+	revisions := flag.Args()
+	if len(revisions) == 0 {
+		revisions = []string{"HEAD"}
+	}
+	for _, revision := range revisions {
+		if strings.HasPrefix(revision, "-") {
+			log.Fatal(usage)
+		}
+	}
+
+	startHashes, excluded, err := resolveRevisionRanges(revisions, repoDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	err = Shortlog(startHashes, excluded, options, output, repoDir)
+	if flushErr := output.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		log.Fatalf("Failed to summarize log: %s\n", err)
+	}
+}
+
+// Writes each commit in the given range as a patch email (see FormatPatch), to be sent and applied elsewhere with am.
+// Given a single revision, the commits since it (i.e. <since>..HEAD) are written, and given a range (see LogHandler),
+// the commits in it.
+// -o <dir> --> Writes the patch files into the given directory, rather than the current one.
+// --stdout --> Prints all of the patches, one after another as a mailbox, rather than writing them into files.
+// -<n> --> Writes only the last n commits, from HEAD or the given revision, e.g. -1 for just the latest commit.
+// -n, --numbered --> Numbers the subject even of a single patch, as [PATCH 1/1].
+func FormatPatchHandler(repoDir string) {
+	usage := "Usage: format-patch [-o <dir>] [--stdout] [-n] [-<n>] (<since> | <revision_range>)"
+
+	// As in Git, the number of commits may be given as e.g. -3
+	args := []string{}
+	maxCount := -1
+	for _, arg := range os.Args[2:] {
+		if count, err := strconv.Atoi(strings.TrimPrefix(arg, "-")); err == nil && strings.HasPrefix(arg, "-") && count >= 0 {
+			maxCount = count
+			continue
+		}
+		args = append(args, arg)
+	}
+	os.Args = append(os.Args[0:1], args...)
+	outputDirPtr := flag.String("o", "", "Write the patch files into the given directory")
+	stdoutPtr := flag.Bool("stdout", false, "Print the patches rather than writing them into files")
+	numberedPtr := flag.Bool("n", false, "Number the subject even of a single patch")
+	flag.BoolVar(numberedPtr, "numbered", false, "Number the subject even of a single patch")
+	flag.Parse()
+
+	if flag.NArg() > 1 || (flag.NArg() == 0 && maxCount < 0) {
+		log.Fatal(usage)
+	}
+
+	// A single revision names the commits since it, unless the number of commits is given, in which case it's where
+	// they're counted from
+	revisions := []string{"HEAD"}
+	if flag.NArg() == 1 {
+		revision := flag.Arg(0)
+		if maxCount >= 0 || strings.Contains(revision, "..") || strings.HasPrefix(revision, "^") {
+			revisions = []string{revision}
+		} else {
+			revisions = []string{"^" + revision, "HEAD"}
+		}
+	}
+	startHashes, excluded, err := resolveRevisionRanges(revisions, repoDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options := FormatPatchOptions{
+		outputDir: *outputDirPtr,
+		stdout:    *stdoutPtr,
+		numbered:  *numberedPtr,
+		maxCount:  maxCount,
+	}
+	if err := FormatPatch(startHashes, excluded, options, repoDir); err != nil {
+		log.Fatalf("Failed to format patches: %s\n", err)
+	}
+}
+
+// Applies the patches in the given mailboxes (e.g. files written by format-patch), or read from stdin, as commits on
+// top of HEAD, keeping the author, date, and message of each (see Am). Stops at the first patch which doesn't apply.
+// -s --> Adds a Signed-off-by trailer for the committer to each commit's message.
+func AmHandler(repoDir string) {
+	usage := "Usage: am [-s] [<mbox>...]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	signoffPtr := flag.Bool("s", false, "Add a Signed-off-by trailer to each commit's message")
+	flag.BoolVar(signoffPtr, "signoff", false, "Add a Signed-off-by trailer to each commit's message")
+	flag.Parse()
+
+	for _, arg := range flag.Args() {
+		if strings.HasPrefix(arg, "-") {
+			log.Fatal(usage)
+		}
+	}
+
+	options := AmOptions{signoff: *signoffPtr}
+	if err := Am(flag.Args(), options, repoDir); err != nil {
+		log.Fatalf("Failed to apply patches: %s\n", err)
+	}
+}
+
+// Applies the patches in the given files (e.g. written by diff or format-patch), or read from stdin, to the working
+// tree, as git apply does (see Apply). The patches are applied all together or not at all.
+// -R, --reverse --> Undoes the changes the patches make, e.g. to back out a patch which was applied earlier.
+// --cached --> Applies the patches to the index, without touching the working tree.
+// --index --> Applies the patches to both the index and the working tree.
+// --check --> Only checks whether the patches apply, without applying them.
+func ApplyHandler(repoDir string) {
+	usage := "Usage: apply [-R | --reverse] [--cached | --index] [--check] [<patch>...]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	var options ApplyOptions
+	flag.BoolVar(&options.reverse, "R", false, "Apply the patches in reverse")
+	flag.BoolVar(&options.reverse, "reverse", false, "Apply the patches in reverse")
+	flag.BoolVar(&options.cached, "cached", false, "Apply the patches to the index only")
+	flag.BoolVar(&options.index, "index", false, "Apply the patches to the index and the working tree")
+	flag.BoolVar(&options.check, "check", false, "Only check whether the patches apply")
+	flag.Parse()
+
+	if options.cached && options.index {
+		log.Fatal(usage)
+	}
+	for _, arg := range flag.Args() {
+		if strings.HasPrefix(arg, "-") {
+			log.Fatal(usage)
+		}
+	}
+
+	if err := Apply(flag.Args(), options, repoDir); err != nil {
+		log.Fatalf("Failed to apply patch: %s\n", err)
+	}
+}
+
+// Shows the changes between the index and the working tree, as a unified diff for each changed file. On a terminal,
+// the output is shown through a pager (see startPager).
+// --cached [<commit>] --> Shows the changes between HEAD and the index (i.e. the changes staged for the next commit)
+// instead, or between the given commit and the index.
+// --shortstat --> Prints only the total number of changed files, inserted lines, and deleted lines.
+// --numstat --> Prints the number of inserted and deleted lines for each changed file, in a machine-readable format.
+// -z --> With --numstat, terminates each line with a NUL byte rather than a newline.
+// --summary --> Lists files which were created or deleted, or whose mode changed (e.g. mode change 100644 => 100755),
+// instead of the patch, or after the --shortstat or --numstat output.
+// --check --> Instead of showing the changes, flags whitespace errors in the added lines (trailing whitespace, a
+// space before a tab in the indentation, blank lines added at the end of a file, and a missing newline at the end of
+// a file, by default), as selected by the core.whitespace config variable or the whitespace attribute. Exits with
+// status 2 if any are found, so that e.g. a pre-commit hook can reject the change.
+// -w/--ignore-all-space --> Ignores whitespace when comparing lines.
+// -b/--ignore-space-change --> Ignores changes in the amount of whitespace, and whitespace at the end of lines.
+// --ignore-blank-lines --> Ignores changes which only insert or delete blank lines.
+// Files whose changes are all ignored are left out of the output.
+// --diff-algorithm --> Identifies the algorithm used to diff lines (myers, minimal, patience, or histogram),
+// overriding the diff.algorithm config variable.
+// --no-textconv --> Diffs files as they are, rather than first converting them to text with the textconv drivers
+// given to them by the diff attribute. Conversions of blobs are cached for drivers with diff.<driver>.cachetextconv set.
+// --color[=<when>], --no-color --> Colors the patch always, never, or only when writing to a terminal (auto),
+// overriding the color.diff and color.ui config variables (see colorPatch).
+func DiffHandler(repoDir string) {
+	usage := "Usage: diff [--cached [<commit>]] [-w | -b] [--ignore-blank-lines] [--diff-algorithm=<algorithm>] [--no-textconv] [--color[=<when>] | --no-color] [--shortstat | --numstat [-z] | --check] [--summary]"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	cachedPtr := flag.Bool("cached", false, "Show the changes between HEAD and the index")
+	shortStatPtr := flag.Bool("shortstat", false, "Show only the total number of changed files and lines")
+	numStatPtr := flag.Bool("numstat", false, "Show the number of changed lines for each file")
+	nulTerminatedPtr := flag.Bool("z", false, "Terminate --numstat lines with NUL bytes")
+	checkPtr := flag.Bool("check", false, "Flag whitespace errors in the added lines")
+	summaryPtr := flag.Bool("summary", false, "Show files which were created, deleted, or changed mode")
+
+	var diffOptions DiffOptions
+	flag.BoolVar(&diffOptions.ignoreAllSpace, "w", false, "Ignore whitespace when comparing lines")
+	flag.BoolVar(&diffOptions.ignoreAllSpace, "ignore-all-space", false, "Ignore whitespace when comparing lines")
+	flag.BoolVar(&diffOptions.ignoreSpaceChange, "b", false, "Ignore changes in the amount of whitespace")
+	flag.BoolVar(&diffOptions.ignoreSpaceChange, "ignore-space-change", false, "Ignore changes in the amount of whitespace")
+	flag.BoolVar(&diffOptions.ignoreBlankLines, "ignore-blank-lines", false, "Ignore changes which only insert or delete blank lines")
+	diffAlgorithmPtr := flag.String("diff-algorithm", "", "The algorithm used to diff lines")
+	noTextconvPtr := flag.Bool("no-textconv", false, "Don't convert files with textconv drivers")
+	color := addColorFlags()
+	flag.Parse()
+
+	if flag.NArg() > 1 || (flag.NArg() == 1 && !*cachedPtr) || (*shortStatPtr && *numStatPtr) || (*nulTerminatedPtr && !*numStatPtr) || (*checkPtr && (*shortStatPtr || *numStatPtr || *summaryPtr)) {
+		log.Fatal(usage)
+	}
+
+	algorithm, err := getDiffAlgorithm(*diffAlgorithmPtr, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine diff algorithm: %s\n", err)
+	}
+	diffOptions.algorithm = algorithm
+
+	commitHash := ""
+	if flag.NArg() == 1 {
+		commitHash, err = resolveCommitish(flag.Arg(0), repoDir)
+		if err != nil {
+			log.Fatalf("Failed to resolve commit: %s\n", err)
+		}
+	}
+
+	if err := startPager("diff", repoDir); err != nil {
+		log.Fatalf("Failed to start pager: %s\n", err)
+	}
+
+	if *checkPtr {
+		whitespaceErrors, err := CheckDiffWhitespace(*cachedPtr, commitHash, diffOptions, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to check for whitespace errors: %s\n", err)
+		}
+
+		for _, whitespaceError := range whitespaceErrors {
+			fmt.Print(whitespaceError.format())
+		}
+		// As in Git, whitespace errors are reported with exit status 2
+		if len(whitespaceErrors) > 0 {
+			exit(2)
+		}
+		return
+	}
+
+	if !*noTextconvPtr {
+		diffOptions.textconv, err = newTextconv(repoDir)
+		if err != nil {
+			log.Fatalf("Failed to load textconv drivers: %s\n", err)
+		}
+		defer func() {
+			if err := diffOptions.textconv.saveCaches(); err != nil {
+				log.Fatalf("Failed to save textconv cache: %s\n", err)
 			}
-			fmt.Printf("\t%s%s\t%s%s\n", COLOR_RED, statusStr, fs.path, COLOR_RESET)
+		}()
+	}
+
+	if *shortStatPtr || *numStatPtr {
+		summary, err := GetDiffSummary(*cachedPtr, commitHash, diffOptions, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to compute diff summary: %s\n", err)
+		}
+
+		if *numStatPtr {
+			fmt.Print(summary.numStat(*nulTerminatedPtr))
+		} else if len(summary.files) > 0 {
+			fmt.Println(summary.shortStat())
+		}
+		if !*summaryPtr {
+			return
 		}
 	}
 
-	// Print untracked files
-	if len(status.untrackedFiles) > 0 {
-		fmt.Println("\nUntracked files:")
-		fmt.Println("  (use \"git add <file>...\" to include in what will be committed)")
+	changes, err := GetDiffChanges(*cachedPtr, commitHash, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to compute diff: %s\n", err)
+	}
 
-		for _, fs := range status.untrackedFiles {
-			fmt.Printf("\t%s%s%s\n", COLOR_RED, fs.path, COLOR_RESET)
+	if *summaryPtr {
+		for _, change := range changes {
+			if summaryLine := change.summaryLine(); summaryLine != "" {
+				fmt.Println(summaryLine)
+			}
 		}
+		return
 	}
 
-	if len(status.stagedFiles) == 0 {
-		fmt.Println("\nno changes added to commit (use \"git add\" and/or \"git commit -a\")")
+	colorizer, err := newColorizer(color, "diff", os.Stdout, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine whether to color output: %s\n", err)
+	}
+
+	for _, change := range changes {
+		patch, err := change.formatPatch(diffOptions, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to format diff for %s: %s\n", change.path, err)
+		}
+		fmt.Print(colorPatch(patch, colorizer))
 	}
 }
 
-// Creates a new Git commit from the current contents of the index and with the optional commit message specified.
-// -m --> Identifies an optional message for the new commit.
+// Creates a new Git commit from the current contents of the index. Unless a message is given with -m or -F, the
+// user's editor (GIT_EDITOR, core.editor, VISUAL, or EDITOR) is opened on .git/COMMIT_EDITMSG, starting with the
+// commit.template file if configured and followed by a summary of the repository's status as comments. Comment lines
+// are removed from the edited message, and the commit is aborted if the message is empty (or, when a template is
+// used, unchanged). The pre-commit hook is run first, followed by the commit-msg hook, which may edit the message.
+// The commit is aborted if either hook fails. While a merge with conflicts is in progress (see Merge), the commit
+// concludes it: the commits listed in MERGE_HEAD are added as its other parents, and the editor starts with the
+// merge's message from MERGE_MSG.
+// -a, --all --> Stages the changes to all tracked files (including deletions) before committing. Untracked files
+// aren't added, and neither are files with merge conflicts, which must be resolved with add or rm before committing.
+// -m --> Identifies the message for the new commit.
+// -F, --file --> Reads the message for the new commit from the given file, or from standard input if it's -.
+// --amend --> Replaces the current commit with a new one, with the same parents and author. The current commit's
+// message is reused as the starting point for the new message.
+// --no-edit --> With --amend, reuses the current commit's message without opening the editor (or when concluding a
+// merge, the merge's message).
+// -n, --no-verify --> Skips the pre-commit and commit-msg hooks.
+// -s, --signoff --> Adds a Signed-off-by trailer for the committer to the end of the message.
+// -S[<keyid>], --gpg-sign[=<keyid>] --> Signs the commit with the given key, or else the user.signingKey config
+// variable (see signPayload). The gpg.format config variable selects OpenPGP (the default) or SSH signatures.
+// Defaults to the value of the commit.gpgSign config variable.
+// --no-gpg-sign --> Doesn't sign the commit, overriding the commit.gpgSign config variable.
+// --author --> Sets the author of the commit, given as `Name <email>`, instead of the current user (or with --amend,
+// the amended commit's author).
+// --date --> Sets the author date of the commit, in any of the formats accepted by parseCommitDate.
+// The author and committer are otherwise determined by getCommitUser, so they may also be set with the
+// GIT_AUTHOR_NAME, GIT_AUTHOR_EMAIL, GIT_AUTHOR_DATE, GIT_COMMITTER_NAME, GIT_COMMITTER_EMAIL, and GIT_COMMITTER_DATE
+// environment variables.
 func CommitHandler(repoDir string) {
-	if len(os.Args) < 2 || len(os.Args) > 4 {
-		log.Fatal("Usage: commit [-m <commit_message>]")
+	usage := "Usage: commit [-a | --all] [-m <commit_message> | -F <file>] [--amend [--no-edit]] [-n | --no-verify] [-s | --signoff] [-S[<keyid>] | --gpg-sign[=<keyid>] | --no-gpg-sign] [--author=<author>] [--date=<date>]"
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		log.Fatalf("Failed to read repository config: %s\n", err)
 	}
 
-	os.Args = append(os.Args[0:1], os.Args[2:]...)
-	commitMessagePtr := flag.String("m", "Made a commit!", "Commit message")
+	gpgSign, err := config.getBool("commit.gpgSign", false)
+	if err != nil {
+		log.Fatalf("Failed to read commit.gpgSign config: %s\n", err)
+	}
+
+	// The key of -S and --gpg-sign is optional, which the flag package doesn't support, so they're handled first
+	args, gpgSignGiven, signingKey := extractGPGSignArgs(os.Args[2:])
+	gpgSign = gpgSign || gpgSignGiven
+	os.Args = append(os.Args[0:1], args...)
+	allPtr := flag.Bool("a", false, "Stage the changes to all tracked files")
+	flag.BoolVar(allPtr, "all", false, "Stage the changes to all tracked files")
+	commitMessagePtr := flag.String("m", "", "Commit message")
+	messageFilePtr := flag.String("F", "", "Read the commit message from the given file")
+	flag.StringVar(messageFilePtr, "file", "", "Read the commit message from the given file")
+	amendPtr := flag.Bool("amend", false, "Replace the current commit")
+	noEditPtr := flag.Bool("no-edit", false, "Reuse the current commit's message without editing it")
+	noVerifyPtr := flag.Bool("no-verify", false, "Skip the pre-commit and commit-msg hooks")
+	flag.BoolVar(noVerifyPtr, "n", false, "Skip the pre-commit and commit-msg hooks")
+	signoffPtr := flag.Bool("signoff", false, "Add a Signed-off-by trailer to the message")
+	flag.BoolVar(signoffPtr, "s", false, "Add a Signed-off-by trailer to the message")
+	noGPGSignPtr := flag.Bool("no-gpg-sign", false, "Don't sign the commit")
+	authorPtr := flag.String("author", "", "Set the author of the commit")
+	datePtr := flag.String("date", "", "Set the author date of the commit")
 	flag.Parse()
 
-	headCommitHash, commitsExist, err := ResolveHead(false, repoDir)
+	if *noGPGSignPtr {
+		if gpgSignGiven {
+			log.Fatal(usage)
+		}
+		gpgSign = false
+	}
+
+	messageGiven := *commitMessagePtr != "" || *messageFilePtr != ""
+	if flag.NArg() != 0 || (*commitMessagePtr != "" && *messageFilePtr != "") || (*noEditPtr && messageGiven) {
+		log.Fatal(usage)
+	}
+
+	mergeHeads, err := readPseudoRef("MERGE_HEAD", repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine whether a merge is in progress: %s\n", err)
+	}
+	if *noEditPtr && !*amendPtr && len(mergeHeads) == 0 {
+		log.Fatal(usage)
+	}
+
+	// On a detached HEAD, the commit is made on top of HEAD, which is moved to it rather than any branch
+	currBranch, err := getStatusBranch(repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine the current branch: %s\n", err)
+	}
+
+	headCommitHash, commitsExist, err := ResolveHead("", repoDir)
 	if err != nil {
 		log.Fatalf("Failed to resolve HEAD reference: %s\n", err)
 	}
@@ -376,42 +2674,242 @@ func CommitHandler(repoDir string) {
 		parentCommitHashes = append(parentCommitHashes, headCommitHash)
 	}
 
+	var amendedCommitObj *CommitObject
+	if *amendPtr {
+		if !commitsExist {
+			log.Fatal("You have nothing to amend.")
+		}
+		amendedCommitObj, err = ReadCommitObjectFile(headCommitHash, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to read commit to amend: %s\n", err)
+		}
+		parentCommitHashes = amendedCommitObj.parentCommitHashes
+	}
+
+	// Committing a merge in progress makes the merge commit, with the merged commits as its other parents
+	if len(mergeHeads) > 0 {
+		if *amendPtr {
+			log.Fatal("You are in the middle of a merge -- cannot amend.")
+		}
+		parentCommitHashes = append(parentCommitHashes, mergeHeads...)
+	}
+
+	// An amended commit keeps its original author (unless overridden), but is committed by the current user
+	var author CommitUser
+	if amendedCommitObj != nil {
+		author = amendedCommitObj.author
+	} else {
+		currentAuthor, err := getCommitUser(CommitAuthor, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to determine author: %s\n", err)
+		}
+		author = *currentAuthor
+	}
+	author, err = overrideCommitAuthor(author, *authorPtr, *datePtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *allPtr {
+		if err := AddTrackedFilesToIndex(repoDir); err != nil {
+			log.Fatalf("Failed to stage changes to tracked files: %s\n", err)
+		}
+	}
+
+	// As in Git, merge conflicts must be resolved (by adding or removing the files) before committing
+	indexEntries, err := ReadIndex(repoDir)
+	if err != nil {
+		log.Fatalf("Failed to read entries within Git index file: %s\n", err)
+	}
+	if len(getUnmergedPaths(indexEntries)) > 0 {
+		log.Fatal("Committing is not possible because you have unmerged files.\nhint: Fix them up in the work tree, and then use 'add/rm <file>'\nhint: as appropriate to mark resolution and make a commit.")
+	}
+
+	if !*noVerifyPtr {
+		if err := runHook("pre-commit", nil, "", repoDir); err != nil {
+			log.Fatalf("Aborting commit: %s\n", err)
+		}
+	}
+
+	var commitMessage string
+	if *commitMessagePtr != "" {
+		commitMessage = cleanupCommitMessage(*commitMessagePtr, false)
+	} else if *messageFilePtr != "" {
+		message, err := readCommitMessageFile(*messageFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to read commit message: %s\n", err)
+		}
+		commitMessage = cleanupCommitMessage(message, false)
+	} else if *noEditPtr && amendedCommitObj != nil {
+		commitMessage = amendedCommitObj.commitMessage
+	} else if *noEditPtr {
+		mergeMessage, err := readMergeMessage(repoDir)
+		if err != nil {
+			log.Fatalf("Failed to read merge message: %s\n", err)
+		}
+		commitMessage = cleanupCommitMessage(mergeMessage, true)
+	} else {
+		initialMessage := ""
+		if amendedCommitObj != nil {
+			initialMessage = amendedCommitObj.commitMessage
+		} else if len(mergeHeads) > 0 {
+			if initialMessage, err = readMergeMessage(repoDir); err != nil {
+				log.Fatalf("Failed to read merge message: %s\n", err)
+			}
+		} else if initialMessage, err = readCommitTemplate(repoDir); err != nil {
+			log.Fatalf("Failed to read commit message template: %s\n", err)
+		}
+
+		ignoreSubmodules, err := getIgnoreSubmodules("", repoDir)
+		if err != nil {
+			log.Fatalf("Failed to determine which changes to submodules to ignore: %s\n", err)
+		}
+		status, err := GetRepoStatus(ignoreSubmodules, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to determine status of repository: %s\n", err)
+		}
+
+		commitMessage, err = editCommitMessage(initialMessage, status, repoDir)
+		if err != nil {
+			log.Fatalf("Failed to edit commit message: %s\n", err)
+		}
+		if amendedCommitObj == nil && len(mergeHeads) == 0 && initialMessage != "" && commitMessage == cleanupCommitMessage(initialMessage, true) {
+			log.Fatal("Aborting commit; you did not edit the message.")
+		}
+	}
+
+	if commitMessage == "" {
+		log.Fatal("Aborting commit due to empty commit message.")
+	}
+
+	committer, err := getCommitUser(CommitCommitter, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to determine committer: %s\n", err)
+	}
+
+	if *signoffPtr {
+		commitMessage = addSignoff(commitMessage, *committer)
+	}
+
+	if !*noVerifyPtr {
+		commitMessage, err = runCommitMsgHook(commitMessage, repoDir)
+		if err != nil {
+			log.Fatalf("Aborting commit: %s\n", err)
+		}
+	}
+
 	treeObj, err := CreateTreeObjectFromIndex(repoDir)
 	if err != nil {
 		log.Fatalf("Could not create tree object from Git index: %s\n", err)
 	}
 
-	commitObj, err := CreateCommitObjectFromTree(treeObj.hash, parentCommitHashes, *commitMessagePtr, repoDir)
+	var commitObj *CommitObject
+	if gpgSign {
+		commitObj, err = createSignedCommitObject(treeObj.hash, parentCommitHashes, author, *committer, commitMessage, signingKey, repoDir)
+	} else {
+		commitObj, err = createCommitObject(treeObj.hash, parentCommitHashes, author, *committer, commitMessage, repoDir)
+	}
 	if err != nil {
 		log.Fatalf("Could not create commit object from tree: %s\n", err)
 	}
 
-	err = UpdateCurrentBranchRef(commitObj.hash, false, repoDir)
+	// The branch (or detached HEAD) must still be where it was when the commit was started (or still be unborn, for
+	// a root commit), so that a commit made concurrently isn't overwritten
+	expectedOldHash := headCommitHash
+	if !commitsExist {
+		expectedOldHash = NULL_OBJECT_HASH
+	}
+	err = UpdateRef("HEAD", commitObj.hash, expectedOldHash, repoDir)
 	if err != nil {
 		log.Fatalf("Failed to update current branch reference: %s\n", err)
 	}
-
-	currBranch, err := getCurrentBranch(repoDir)
-	if err != nil {
-		log.Fatalf("Failed to determine the current branch: %s\n", err)
+	if err := removeMergeState(repoDir); err != nil {
+		log.Fatalf("Failed to conclude merge: %s\n", err)
 	}
 
-	fmt.Printf("Committed: [%s %s] %s\n", currBranch, commitObj.hash, *commitMessagePtr)
+	// As in Git, the first commit on a branch with no history (e.g. an orphan branch) is marked as a root commit
+	branchLabel := currBranch
+	if currBranch == "" {
+		branchLabel = "detached HEAD"
+	}
+	if len(commitObj.parentCommitHashes) == 0 {
+		branchLabel += " (root-commit)"
+	}
+	fmt.Printf("Committed: [%s %s] %s\n", branchLabel, commitObj.hash, getCommitSubject(commitObj))
 }
 
-// Pushes the local commits to the remote repository, specified by the URL provided.
+// Pushes the local commits to the remote repository, specified by URL or by the name of a configured remote (by
+// default, the remote of the current branch's upstream, or origin). The current branch is pushed to
+// its upstream branch if one is configured (see `branch -u`), or otherwise to the remote branch of the same name.
+// The push is rejected unless it fast-forwards the remote branch.
+// --force --> Overwrites the remote branch unconditionally.
+// --force-with-lease[=<branch>[:<expected>]] --> Overwrites the remote branch only if its tip matches the expected
+// value (by default, the value of the remote-tracking ref, i.e. what was last pulled from or pushed to the remote).
+// --no-verify --> Skips the pre-push hook, which otherwise runs before anything is sent and can abort the push.
+// --signed[=<true|false|if-asked>] --> Signs the push with a push certificate, which the server may verify and record.
+// With if-asked, the push is only signed if the server accepts push certificates, and otherwise it fails if the
+// server doesn't. Defaults to the value of the push.gpgSign config variable.
+// --no-signed --> Doesn't sign the push, overriding the push.gpgSign config variable.
+// -q, --quiet --> Doesn't report the progress of writing the packfile.
+// --progress --> Reports the progress of writing the packfile even if stderr isn't a terminal.
 func PushHandler(repoDir string) {
-	if len(os.Args) != 3 {
-		log.Fatal("Usage: push <remote_repo_url>")
+	usage := "Usage: push [-q | --progress] [--force | --force-with-lease[=<branch>[:<expected_sha>]]] [--no-verify] [--signed[=<true|false|if-asked>] | --no-signed] [<remote> | <remote_repo_url>]"
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		log.Fatalf("Failed to read repository config: %s\n", err)
 	}
 
-	repoURL := os.Args[2]
-	err := validateRepoURL(repoURL)
+	signMode := PushSignNever
+	if value, isSet := config.get("push.gpgSign"); isSet {
+		signMode, err = parsePushSignMode(value)
+		if err != nil {
+			log.Fatalf("Failed to read push.gpgSign config: %s\n", err)
+		}
+	}
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	forcePtr := flag.Bool("force", false, "Overwrite the remote branch unconditionally")
+	var lease forceWithLeaseFlag
+	flag.Var(&lease, "force-with-lease", "Overwrite the remote branch only if its tip matches the expected value")
+	noVerifyPtr := flag.Bool("no-verify", false, "Skip the pre-push hook")
+	var signed pushSignedFlag
+	flag.Var(&signed, "signed", "Sign the push with a push certificate")
+	noSignedPtr := flag.Bool("no-signed", false, "Don't sign the push")
+	quietPtr := flag.Bool("q", false, "Don't report the progress of the push")
+	flag.BoolVar(quietPtr, "quiet", false, "Don't report the progress of the push")
+	progressPtr := flag.Bool("progress", false, "Report the progress of the push even if stderr isn't a terminal")
+	flag.Parse()
+
+	if flag.NArg() > 1 || (signed.given && *noSignedPtr) {
+		log.Fatal(usage)
+	}
+	setUpProgress(*quietPtr, *progressPtr)
+
+	// A push isn't rate limited, but like any transfer it's aborted if it stalls for longer than http.lowSpeedTime
+	if err := loadTransferLimits("", repoDir); err != nil {
+		log.Fatalf("Failed to set up transfer limits: %s\n", err)
+	}
+	if err := loadHTTPSettings(repoDir); err != nil {
+		log.Fatalf("Failed to set up HTTP client: %s\n", err)
+	}
+
+	if signed.given {
+		signMode = signed.mode
+	} else if *noSignedPtr {
+		signMode = PushSignNever
+	}
+
+	if lease.expected != "" && !isValidObjectHash(lease.expected) {
+		log.Fatalf("Invalid expected commit hash for --force-with-lease: %s\n", lease.expected)
+	}
+
+	repoURL, err := resolveRemoteURL(flag.Arg(0), repoDir)
 	if err != nil {
-		log.Fatalf("Failed to validate structure of remote repository URL: %s\n", err)
+		log.Fatalf("Failed to determine remote repository: %s\n", err)
 	}
 
-	localHead, localCommitsExist, err := ResolveHead(false, repoDir)
+	localHead, localCommitsExist, err := ResolveHead("", repoDir)
 	if err != nil {
 		log.Fatalf("Failed to resolve local HEAD reference: %s\n", err)
 	}
@@ -420,16 +2918,14 @@ func PushHandler(repoDir string) {
 		log.Fatal("Nothing to push - no commits found in local repository")
 	}
 
-	remoteHead, remoteCommitsExist, err := ResolveHead(true, repoDir)
-	if err != nil {
-		log.Fatalf("Failed to resolve remote HEAD reference: %s\n", err)
-	}
-
-	if !remoteCommitsExist {
-		remoteHead = ""
+	forceOptions := ForcePushOptions{
+		force:         *forcePtr,
+		withLease:     lease.enabled,
+		leaseRef:      lease.ref,
+		leaseExpected: lease.expected,
 	}
 
-	err = Push(localHead, remoteHead, repoURL, repoDir)
+	err = Push(localHead, repoURL, forceOptions, signMode, *noVerifyPtr, repoDir)
 	if err != nil {
 		log.Fatalf("Failed to push commits to remote repository: %s\n", err)
 	}
@@ -437,45 +2933,101 @@ func PushHandler(repoDir string) {
 	fmt.Println("Successfully pushed commits to remote repository")
 }
 
-// Pulls the remote commits for all refs found during reference discovery to the local repository, using the given
-// remote repository URL. As a result, the local HEAD will be updated to point to the remote HEAD.
+// Pulls the remote commits for all refs found during reference discovery to the local repository, from the remote
+// repository specified by URL or by the name of a configured remote (by default, the remote of the current branch's
+// upstream, or origin). As a result, the local HEAD will be updated to point to the remote HEAD.
+// --rebase --> Replays local commits not yet in the upstream branch on top of it, rather than discarding them.
+// Defaults to the value of the pull.rebase config variable.
+// --autostash, --no-autostash --> Whether to save uncommitted changes before a rebasing pull and reapply them
+// afterwards, rather than refusing to pull. Defaults to the value of the rebase.autoStash config variable.
+// --limit-rate <rate> --> Limits the speed of the transfer to the given number of bytes per second, which may have a
+// k, m, or g suffix (e.g. 100k).
+// -q, --quiet --> Doesn't report the progress or summary of the transfer.
+// --progress --> Reports the progress of the transfer even if stderr isn't a terminal.
 func PullHandler(repoDir string) {
-	if len(os.Args) != 3 {
-		log.Fatal("Usage: pull <remote_repo_url>")
+	usage := "Usage: pull [-q | --progress] [--rebase] [--autostash | --no-autostash] [--limit-rate <rate>] [<remote> | <remote_repo_url>]"
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		log.Fatalf("Failed to read repository config: %s\n", err)
 	}
 
-	repoURL := os.Args[2]
-	err := validateRepoURL(repoURL)
+	defaultRebase, err := config.getBool("pull.rebase", false)
+	if err != nil {
+		log.Fatalf("Failed to read pull.rebase config: %s\n", err)
+	}
+
+	defaultAutoStash, err := config.getBool("rebase.autoStash", false)
+	if err != nil {
+		log.Fatalf("Failed to read rebase.autoStash config: %s\n", err)
+	}
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	rebasePtr := flag.Bool("rebase", defaultRebase, "Rebase local commits onto the upstream branch")
+	autoStashPtr := flag.Bool("autostash", false, "Stash uncommitted changes before a rebasing pull")
+	noAutoStashPtr := flag.Bool("no-autostash", false, "Don't stash uncommitted changes before a rebasing pull")
+	limitRatePtr := flag.String("limit-rate", "", "Limit the speed of the transfer, in bytes per second")
+	quietPtr := flag.Bool("q", false, "Don't report the progress or summary of the transfer")
+	flag.BoolVar(quietPtr, "quiet", false, "Don't report the progress or summary of the transfer")
+	progressPtr := flag.Bool("progress", false, "Report the progress of the transfer even if stderr isn't a terminal")
+	flag.Parse()
+
+	if flag.NArg() > 1 || (*autoStashPtr && *noAutoStashPtr) {
+		log.Fatal(usage)
+	}
+	setUpProgress(*quietPtr, *progressPtr)
+
+	if err := loadTransferLimits(*limitRatePtr, repoDir); err != nil {
+		log.Fatalf("Failed to set up transfer limits: %s\n", err)
+	}
+	if err := loadHTTPSettings(repoDir); err != nil {
+		log.Fatalf("Failed to set up HTTP client: %s\n", err)
+	}
+
+	repoURL, err := resolveRemoteURL(flag.Arg(0), repoDir)
 	if err != nil {
-		log.Fatalf("Failed to validate structure of remote repository URL: %s\n", err)
+		log.Fatalf("Failed to determine remote repository: %s\n", err)
+	}
+
+	options := PullOptions{
+		rebase:    *rebasePtr,
+		autoStash: (defaultAutoStash || *autoStashPtr) && !*noAutoStashPtr,
 	}
 
-	err = Pull(repoURL, repoDir)
+	err = Pull(repoURL, options, repoDir)
 	if err != nil {
 		log.Fatalf("Failed to pull remote commits to local repository: %s\n", err)
 	}
 
 	fmt.Println("Successfully pulled remote commits to local repository")
+	if !progressSettings.quiet {
+		fmt.Println(transferStats.summarize())
+	}
 }
 
-// Checks out the branch identified by the given name.
+// Checks out the branch identified by the given name, or, given a commit (e.g. a hash or a tag), detaches HEAD at it,
+// so that commits made on top of it don't move any branch. Only the files which differ between the commits are
+// updated, so untracked files and uncommitted changes to other files are kept. The checkout is refused if it would
+// overwrite uncommitted changes or untracked files (see CheckoutCommit).
 // -b --> Creates a new branch with the given name and checks it out.
+// -f, --force --> Discards uncommitted changes to tracked files rather than refusing to overwrite them.
+// --detach --> Detaches HEAD at the given commit even if it's a branch.
 func CheckoutHandler(repoDir string) {
-	if len(os.Args) < 3 || len(os.Args) > 4 {
-		log.Fatal("Usage: checkout [-b] <branch_name>")
-	}
+	usage := "Usage: checkout [-f] ([-b] <branch_name> | [--detach] <commit>)"
 
-	var branchName string
-	var createBranch bool
-	if len(os.Args) == 4 && os.Args[2] == "-b" {
-		branchName = os.Args[3]
-		createBranch = true
-	} else {
-		branchName = os.Args[2]
-		createBranch = false
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	createPtr := flag.Bool("b", false, "Create a new branch and check it out")
+	forcePtr := flag.Bool("f", false, "Discard uncommitted changes to tracked files")
+	flag.BoolVar(forcePtr, "force", false, "Discard uncommitted changes to tracked files")
+	detachPtr := flag.Bool("detach", false, "Detach HEAD at the commit")
+	flag.Parse()
+
+	if flag.NArg() != 1 || (*createPtr && *detachPtr) {
+		log.Fatal(usage)
 	}
+	branchName := flag.Arg(0)
 
-	if createBranch {
+	if *createPtr {
 		err := CreateBranch(branchName, repoDir)
 		if err != nil {
 			log.Fatalf("Failed to create branch %s: %s\n", branchName, err)
@@ -483,10 +3035,105 @@ func CheckoutHandler(repoDir string) {
 		fmt.Printf("Created branch '%s'\n", branchName)
 	}
 
-	err := CheckoutBranch(branchName, repoDir)
+	if _, isBranch, _ := ResolveBranchRef(branchName, "", repoDir); *detachPtr || !isBranch {
+		checkoutDetachedHead(branchName, *forcePtr, repoDir)
+		return
+	}
+
+	err := CheckoutBranch(branchName, *forcePtr, repoDir)
 	if err != nil {
 		log.Fatalf("Failed to checkout branch %s: %s\n", branchName, err)
 	}
 
 	fmt.Printf("Switched to branch '%s'\n", branchName)
 }
+
+// Detaches HEAD at the given commit for checkout and switch --detach, explaining the detached HEAD state as Git does
+func checkoutDetachedHead(revision string, force bool, repoDir string) {
+	commitHash, err := resolveCommitish(revision, repoDir)
+	if err != nil {
+		log.Fatalf("Could not resolve commit: %s\n", err)
+	}
+	commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
+	if err != nil {
+		log.Fatalf("Failed to read commit %s: %s\n", commitHash, err)
+	}
+
+	if err := CheckoutDetached(commitHash, force, repoDir); err != nil {
+		log.Fatalf("Failed to checkout %s: %s\n", revision, err)
+	}
+
+	fmt.Printf("Note: switching to '%s'.\n\n", revision)
+	fmt.Println("You are in 'detached HEAD' state. You can look around, make experimental changes and commit them, and you")
+	fmt.Println("can discard any commits you make in this state without impacting any branches by switching back to a branch.")
+	fmt.Printf("\nHEAD is now at %s %s\n", abbreviateHash(commitHash), getCommitSubject(commitObj))
+}
+
+// Switches to the branch identified by the given name.
+// -c, --create <branch_name> --> Creates a new branch with the given name and switches to it.
+// --orphan <branch_name> --> Switches to a new branch with no history, emptying the index and removing the tracked
+// files from the working tree, so that the next commit is a root commit (see SwitchToOrphanBranch).
+// -f, --force, --discard-changes --> Discards uncommitted changes to tracked files rather than refusing to overwrite
+// them.
+// --detach <commit> --> Detaches HEAD at the given commit (e.g. a hash, tag, or branch) rather than switching to a
+// branch. Unlike checkout, switch requires this to check out anything other than a branch.
+func SwitchHandler(repoDir string) {
+	usage := "Usage: switch [-f] (<branch_name> | (-c | --create) <new_branch_name> | --orphan <new_branch_name> | --detach <commit>)"
+
+	os.Args = append(os.Args[0:1], os.Args[2:]...)
+	createPtr := flag.String("c", "", "Create a new branch and switch to it")
+	flag.StringVar(createPtr, "create", "", "Create a new branch and switch to it")
+	orphanPtr := flag.String("orphan", "", "Switch to a new branch with no history")
+	forcePtr := flag.Bool("f", false, "Discard uncommitted changes to tracked files")
+	flag.BoolVar(forcePtr, "force", false, "Discard uncommitted changes to tracked files")
+	flag.BoolVar(forcePtr, "discard-changes", false, "Discard uncommitted changes to tracked files")
+	detachPtr := flag.Bool("detach", false, "Detach HEAD at the commit")
+	flag.Parse()
+
+	if *createPtr != "" && *orphanPtr != "" || *detachPtr && (*createPtr != "" || *orphanPtr != "") {
+		log.Fatal(usage)
+	}
+
+	if *detachPtr {
+		if flag.NArg() != 1 {
+			log.Fatal(usage)
+		}
+		checkoutDetachedHead(flag.Arg(0), *forcePtr, repoDir)
+		return
+	}
+
+	if *orphanPtr != "" {
+		if flag.NArg() != 0 {
+			log.Fatal(usage)
+		}
+		if err := SwitchToOrphanBranch(*orphanPtr, repoDir); err != nil {
+			log.Fatalf("Failed to switch to branch %s: %s\n", *orphanPtr, err)
+		}
+		fmt.Printf("Switched to a new branch '%s'\n", *orphanPtr)
+		return
+	}
+
+	branchName := *createPtr
+	if branchName != "" {
+		if flag.NArg() != 0 {
+			log.Fatal(usage)
+		}
+		if err := CreateBranch(branchName, repoDir); err != nil {
+			log.Fatalf("Failed to create branch %s: %s\n", branchName, err)
+		}
+	} else if flag.NArg() == 1 {
+		branchName = flag.Arg(0)
+	} else {
+		log.Fatal(usage)
+	}
+
+	if err := CheckoutBranch(branchName, *forcePtr, repoDir); err != nil {
+		log.Fatalf("Failed to switch to branch %s: %s\n", branchName, err)
+	}
+
+	if *createPtr != "" {
+		fmt.Printf("Switched to a new branch '%s'\n", branchName)
+	} else {
+		fmt.Printf("Switched to branch '%s'\n", branchName)
+	}
+}
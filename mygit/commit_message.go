@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The editor used for commit messages if none is configured, as in Git
+const DEFAULT_EDITOR = "vi"
+
+// The instructions shown in COMMIT_EDITMSG when the user is asked for a commit message
+const COMMIT_EDITMSG_INSTRUCTIONS = `Please enter the commit message for your changes. Lines starting
+with '#' will be ignored, and an empty message aborts the commit.`
+
+// Returns the editor used for commit messages, in Git's order of precedence: the GIT_EDITOR environment variable, the
+// core.editor config variable, the VISUAL and EDITOR environment variables, and then DEFAULT_EDITOR
+func getEditor(repoDir string) (string, error) {
+	if editor := os.Getenv("GIT_EDITOR"); editor != "" {
+		return editor, nil
+	}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config: %s", err)
+	}
+	if editor, isSet := config.get("core.editor"); isSet && editor != "" {
+		return editor, nil
+	}
+
+	for _, variable := range []string{"VISUAL", "EDITOR"} {
+		if editor := os.Getenv(variable); editor != "" {
+			return editor, nil
+		}
+	}
+	return DEFAULT_EDITOR, nil
+}
+
+// Opens the file in the user's editor, returning once the editor exits. The editor is run by the shell, so it may
+// include arguments (e.g. `code --wait`).
+func launchEditor(path string, repoDir string) error {
+	editor, err := getEditor(repoDir)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("there was a problem with the editor '%s': %s", editor, err)
+	}
+	return nil
+}
+
+// Cleans up a commit message like Git does: trailing whitespace is removed from each line, runs of blank lines are
+// collapsed into one, and leading and trailing blank lines are removed. If stripComments is set, lines starting with
+// # are removed first. Returns an empty string if nothing is left, and otherwise the message ending in a newline.
+func cleanupCommitMessage(message string, stripComments bool) string {
+	lines := []string{}
+	for _, line := range strings.Split(message, "\n") {
+		if stripComments && strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" && (len(lines) == 0 || lines[len(lines)-1] == "") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Reads the commit message given with -F, from the file (relative to the current directory), or from standard input
+// if the path is -
+func readCommitMessageFile(path string) (string, error) {
+	var message []byte
+	var err error
+	if path == "-" {
+		message, err = io.ReadAll(os.Stdin)
+	} else {
+		message, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read log file '%s': %s", path, err)
+	}
+	return string(message), nil
+}
+
+// Returns the contents of the commit message template given by the commit.template config variable, or an empty
+// string if there isn't one
+func readCommitTemplate(repoDir string) (string, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config: %s", err)
+	}
+
+	templatePath, isSet := config.get("commit.template")
+	if !isSet || templatePath == "" {
+		return "", nil
+	}
+
+	templatePath, err = expandConfigPath(templatePath)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(templatePath) {
+		templatePath = filepath.Join(repoDir, templatePath)
+	}
+
+	template, err := os.ReadFile(templatePath)
+	if err != nil {
+		return "", fmt.Errorf("could not read commit message template '%s': %s", templatePath, err)
+	}
+	return string(template), nil
+}
+
+// Asks the user for a commit message by opening COMMIT_EDITMSG in their editor, starting with the given message and
+// followed by a summary of the repository's status as comments. Returns the message with comments removed and
+// cleaned up, which is empty if the user didn't write one.
+func editCommitMessage(initialMessage string, status *RepositoryStatus, repoDir string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(initialMessage)
+	if initialMessage != "" && !strings.HasSuffix(initialMessage, "\n") {
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\n")
+	for _, line := range strings.Split(COMMIT_EDITMSG_INSTRUCTIONS, "\n") {
+		fmt.Fprintf(&sb, "# %s\n", line)
+	}
+	sb.WriteString("#\n")
+	writeCommitStatusSummary(&sb, status)
+
+	commitEditMsgPath := filepath.Join(getGitDir(repoDir), "COMMIT_EDITMSG")
+	if err := os.WriteFile(commitEditMsgPath, []byte(sb.String()), 0644); err != nil {
+		return "", fmt.Errorf("failed to write commit message: %s", err)
+	}
+
+	if err := launchEditor(commitEditMsgPath, repoDir); err != nil {
+		return "", err
+	}
+
+	editedMessage, err := os.ReadFile(commitEditMsgPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read commit message: %s", err)
+	}
+	return cleanupCommitMessage(string(editedMessage), true), nil
+}
+
+// Writes the summary of the repository's status shown as comments in COMMIT_EDITMSG, listing the current branch and
+// the staged, unstaged, and untracked files
+func writeCommitStatusSummary(sb *strings.Builder, status *RepositoryStatus) {
+	if status.branch != "" {
+		fmt.Fprintf(sb, "# On branch %s\n", status.branch)
+	} else {
+		fmt.Fprintf(sb, "# HEAD detached at %s\n", abbreviateHash(status.localHead))
+	}
+
+	sections := []struct {
+		title string
+		files []*RepositoryFileStatus
+	}{
+		{"Changes to be committed:", status.stagedFiles},
+		{"Changes not staged for commit:", status.notStagedFiles},
+		{"Untracked files:", status.untrackedFiles},
+	}
+	for _, section := range sections {
+		if len(section.files) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(sb, "#\n# %s\n", section.title)
+		for _, fs := range section.files {
+			if fs.status == Untracked {
+				fmt.Fprintf(sb, "#\t%s\n", fs.path)
+			} else {
+				fmt.Fprintf(sb, "#\t%-12s%s\n", fs.status.describe(), fs.path)
+			}
+		}
+	}
+	sb.WriteString("#\n")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Walks the history reachable from a set of commits lazily, yielding one commit at a time with the most recently
+// committed first, as git log does. A commit's parents are only read once the commit itself has been yielded, so the
+// cost of the walk is proportional to the number of commits actually consumed rather than to the size of the history
+// (e.g. when log's output is cut short by head). Commits that aren't present in the local object database are skipped.
+type CommitWalker struct {
+	queue       *CommitQueue
+	seen        map[string]bool
+	excluded    map[string]bool // Commits which are neither yielded nor walked through, e.g. those reachable from A in A..B
+	paths       []string        // If set, only commits which changed the files at (or within) these paths are yielded
+	firstParent bool
+	repoDir     string
+}
+
+// Represents the commits waiting to be yielded by a CommitWalker, as a heap ordered by commit date (newest first).
+// Commits with the same date are yielded in the order in which they were queued.
+type CommitQueue struct {
+	commits   []*CommitObject
+	queuedAt  map[string]int
+	numQueued int
+}
+
+func (q *CommitQueue) Len() int {
+	return len(q.commits)
+}
+
+func (q *CommitQueue) Less(i, j int) bool {
+	if q.commits[i].committer.dateSeconds != q.commits[j].committer.dateSeconds {
+		return q.commits[i].committer.dateSeconds > q.commits[j].committer.dateSeconds
+	}
+	return q.queuedAt[q.commits[i].hash] < q.queuedAt[q.commits[j].hash]
+}
+
+func (q *CommitQueue) Swap(i, j int) {
+	q.commits[i], q.commits[j] = q.commits[j], q.commits[i]
+}
+
+func (q *CommitQueue) Push(x any) {
+	commitObj := x.(*CommitObject)
+	q.queuedAt[commitObj.hash] = q.numQueued
+	q.numQueued += 1
+	q.commits = append(q.commits, commitObj)
+}
+
+func (q *CommitQueue) Pop() any {
+	commitObj := q.commits[len(q.commits)-1]
+	q.commits = q.commits[:len(q.commits)-1]
+	delete(q.queuedAt, commitObj.hash)
+	return commitObj
+}
+
+// Starts a walk of the history reachable from the given commits, but not through any of the excluded commits (which
+// may be nil), following only the first parent of merge commits if firstParent is set
+func newCommitWalker(startHashes []string, excluded map[string]bool, firstParent bool, repoDir string) (*CommitWalker, error) {
+	walker := &CommitWalker{
+		queue:       &CommitQueue{commits: []*CommitObject{}, queuedAt: make(map[string]int)},
+		seen:        make(map[string]bool),
+		excluded:    excluded,
+		firstParent: firstParent,
+		repoDir:     repoDir,
+	}
+
+	for _, commitHash := range startHashes {
+		if err := walker.push(commitHash); err != nil {
+			return nil, err
+		}
+	}
+	return walker, nil
+}
+
+// Returns the next commit in the walk, or nil once every reachable commit has been yielded
+func (w *CommitWalker) next() (*CommitObject, error) {
+	for w.queue.Len() > 0 {
+		commitObj := heap.Pop(w.queue).(*CommitObject)
+
+		parentHashes := commitObj.parentCommitHashes
+		if w.firstParent && len(parentHashes) > 1 {
+			parentHashes = parentHashes[:1]
+		}
+		changed := true
+		if len(w.paths) > 0 {
+			var err error
+			parentHashes, changed, err = w.simplifyParents(commitObj, parentHashes)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, parentHash := range parentHashes {
+			if err := w.push(parentHash); err != nil {
+				return nil, err
+			}
+		}
+		if changed {
+			return commitObj, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Determines whether the commit changed the files at the walker's paths, and which of its parents the walk should
+// continue through, as Git's default history simplification does: a commit which left the paths as they were in one
+// of its parents (i.e. is TREESAME to it) isn't shown, and only that parent is followed, since any other history
+// merged in by the commit didn't contribute to the paths. A root commit is shown if it contains any of the paths.
+func (w *CommitWalker) simplifyParents(commitObj *CommitObject, parentHashes []string) ([]string, bool, error) {
+	pathHashes, err := getTreePathHashes(commitObj.treeHash, w.paths, w.repoDir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(parentHashes) == 0 {
+		return parentHashes, slices.ContainsFunc(pathHashes, func(objHash string) bool { return objHash != "" }), nil
+	}
+	for _, parentHash := range parentHashes {
+		if !objectExists(parentHash, w.repoDir) {
+			continue
+		}
+		parentObj, err := ReadCommitObjectFile(parentHash, w.repoDir)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read commit %s: %s", parentHash, err)
+		}
+		parentPathHashes, err := getTreePathHashes(parentObj.treeHash, w.paths, w.repoDir)
+		if err != nil {
+			return nil, false, err
+		}
+		if slices.Equal(parentPathHashes, pathHashes) {
+			return []string{parentHash}, false, nil
+		}
+	}
+	return parentHashes, true, nil
+}
+
+// Returns the hashes of the objects at the given paths in the tree, with an empty hash for each path which isn't in the
+// tree, so that two trees can be compared at the paths without reading any other part of them
+func getTreePathHashes(treeHash string, paths []string, repoDir string) ([]string, error) {
+	pathHashes := make([]string, len(paths))
+	for i, path := range paths {
+		objHash, err := findObjectInTree(treeHash, path, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		pathHashes[i] = objHash
+	}
+	return pathHashes, nil
+}
+
+// Looks up the hash of the file or directory at the given path (relative to the repository root) within a tree,
+// returning an empty hash if there's nothing at the path. The path . refers to the tree itself.
+func findObjectInTree(treeHash string, path string, repoDir string) (string, error) {
+	if path == "." {
+		return treeHash, nil
+	}
+	objHash, objType := treeHash, Tree
+	for _, component := range strings.Split(path, "/") {
+		if objType != Tree {
+			return "", nil
+		}
+		treeObj, err := ReadTreeObjectFile(objHash, repoDir)
+		if err != nil {
+			return "", fmt.Errorf("failed to read tree %s: %s", objHash, err)
+		}
+
+		objHash = ""
+		for _, entry := range treeObj.entries {
+			if entry.name == component {
+				objHash, objType = entry.hash, entry.objType
+				break
+			}
+		}
+		if objHash == "" {
+			return "", nil
+		}
+	}
+	return objHash, nil
+}
+
+func (w *CommitWalker) push(commitHash string) error {
+	if w.seen[commitHash] || w.excluded[commitHash] || !objectExists(commitHash, w.repoDir) {
+		return nil
+	}
+	w.seen[commitHash] = true
+
+	commitObj, err := ReadCommitObjectFile(commitHash, w.repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read commit %s: %s", commitHash, err)
+	}
+	heap.Push(w.queue, commitObj)
+	return nil
+}
+
+// Determines whether the commit identified by ancestorHash is reachable from the commit identified by
+// descendantHash by following parent links (a commit is considered its own ancestor). Commits that aren't
+// present in the local object database are treated as having no parents.
+func isAncestorCommit(ancestorHash string, descendantHash string, repoDir string) (bool, error) {
+	visited := make(map[string]bool)
+	queue := []string{descendantHash}
+
+	for len(queue) > 0 {
+		commitHash := queue[0]
+		queue = queue[1:]
+
+		if commitHash == ancestorHash {
+			return true, nil
+		}
+		if visited[commitHash] || !objectExists(commitHash, repoDir) {
+			continue
+		}
+		visited[commitHash] = true
+
+		commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
+		if err != nil {
+			return false, fmt.Errorf("failed to read commit %s: %s", commitHash, err)
+		}
+		queue = append(queue, commitObj.parentCommitHashes...)
+	}
+
+	return false, nil
+}
+
+// Returns the set of commits reachable from the given commit (including the commit itself), following only the first
+// parent of merge commits if firstParent is set
+func getReachableCommits(commitHash string, firstParent bool, repoDir string) (map[string]bool, error) {
+	reachable := make(map[string]bool)
+	queue := []string{commitHash}
+
+	for len(queue) > 0 {
+		currHash := queue[0]
+		queue = queue[1:]
+
+		if reachable[currHash] || !objectExists(currHash, repoDir) {
+			continue
+		}
+		reachable[currHash] = true
+
+		commitObj, err := ReadCommitObjectFile(currHash, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %s: %s", currHash, err)
+		}
+		if firstParent && len(commitObj.parentCommitHashes) > 1 {
+			queue = append(queue, commitObj.parentCommitHashes[0])
+		} else {
+			queue = append(queue, commitObj.parentCommitHashes...)
+		}
+	}
+
+	return reachable, nil
+}
+
+// Counts the commits reachable from localHash but not upstreamHash (ahead) and vice versa (behind)
+func countAheadBehind(localHash string, upstreamHash string, repoDir string) (int, int, error) {
+	localCommits, err := getReachableCommits(localHash, false, repoDir)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	upstreamCommits, err := getReachableCommits(upstreamHash, false, repoDir)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	ahead, behind := 0, 0
+	for commitHash := range localCommits {
+		if !upstreamCommits[commitHash] {
+			ahead += 1
+		}
+	}
+	for commitHash := range upstreamCommits {
+		if !localCommits[commitHash] {
+			behind += 1
+		}
+	}
+
+	return ahead, behind, nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Represents a single variable set in a Git config file, e.g. `url` within the `[remote "origin"]` section
+type ConfigEntry struct {
+	section    string // Lowercased, as section names are case-insensitive
+	subsection string // Case-sensitive, empty if the section has no subsection
+	key        string // Lowercased, as variable names are case-insensitive
+	value      string
+	origin     string // The path of the file which set the variable (which may have been included by another file)
+	scope      ConfigScope
+}
+
+// Represents the variables set in a Git config file, in the order in which they appear
+type Config struct {
+	entries []*ConfigEntry
+}
+
+func getRepoConfigPath(repoDir string) string {
+	return filepath.Join(getCommonDir(repoDir), "config")
+}
+
+// Reads the variables set in the repository's own config file (and any files it includes), ignoring the system and
+// global config files
+func readRepoConfig(repoDir string) (*Config, error) {
+	gitDir, err := filepath.Abs(getGitDir(repoDir))
+	if err != nil {
+		return nil, err
+	}
+	return readConfigFile(getRepoConfigPath(repoDir), ConfigScopeLocal, gitDir, 0)
+}
+
+// Reads the variables set in the given config file, along with those set in the files it includes (which are
+// treated as if they were set in place of the include). gitDir is the repository that conditional includes are
+// evaluated against, and depth is the number of includes followed to reach the file.
+func readConfigFile(configPath string, scope ConfigScope, gitDir string, depth int) (*Config, error) {
+	file, err := os.Open(configPath)
+	if err != nil && os.IsNotExist(err) {
+		return &Config{entries: []*ConfigEntry{}}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open config file %s: %s", configPath, err)
+	}
+	defer file.Close()
+
+	config := &Config{entries: []*ConfigEntry{}}
+	section := ""
+	subsection := ""
+	lineNum := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			closingIndex := strings.LastIndexByte(line, ']')
+			if closingIndex == -1 {
+				return nil, fmt.Errorf("bad config line %d in file %s: unterminated section header", lineNum, configPath)
+			}
+			section, subsection, err = parseConfigSectionHeader(line[1:closingIndex])
+			if err != nil {
+				return nil, fmt.Errorf("bad config line %d in file %s: %s", lineNum, configPath, err)
+			}
+			line = strings.TrimSpace(line[closingIndex+1:])
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+		}
+
+		if section == "" {
+			return nil, fmt.Errorf("bad config line %d in file %s: variable outside of any section", lineNum, configPath)
+		}
+
+		key, rawValue, hasValue := strings.Cut(line, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value := "true" // A variable without a value is a boolean true
+		if hasValue {
+			value = parseConfigValue(rawValue)
+		}
+
+		entry := &ConfigEntry{
+			section:    section,
+			subsection: subsection,
+			key:        key,
+			value:      value,
+			origin:     configPath,
+			scope:      scope,
+		}
+		config.entries = append(config.entries, entry)
+
+		includedConfig, err := readIncludedConfig(entry, scope, gitDir, depth)
+		if err != nil {
+			return nil, err
+		}
+		if includedConfig != nil {
+			config.entries = append(config.entries, includedConfig.entries...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %s", configPath, err)
+	}
+
+	return config, nil
+}
+
+// Parses a section header such as `core` or `remote "origin"` (or the deprecated `branch.main` form)
+func parseConfigSectionHeader(header string) (string, string, error) {
+	header = strings.TrimSpace(header)
+
+	section, subsection, hasSubsection := strings.Cut(header, " ")
+	if hasSubsection {
+		subsection = strings.TrimSpace(subsection)
+		if len(subsection) < 2 || subsection[0] != '"' || subsection[len(subsection)-1] != '"' {
+			return "", "", fmt.Errorf("subsection name must be quoted")
+		}
+		subsection = strings.ReplaceAll(subsection[1:len(subsection)-1], `\"`, `"`)
+		subsection = strings.ReplaceAll(subsection, `\\`, `\`)
+	} else if dotSection, dotSubsection, hasDot := strings.Cut(header, "."); hasDot {
+		section = dotSection
+		subsection = strings.ToLower(dotSubsection)
+	}
+
+	if section == "" {
+		return "", "", fmt.Errorf("empty section name")
+	}
+
+	return strings.ToLower(section), subsection, nil
+}
+
+// Parses a variable's raw value, removing any trailing comment and handling double quotes and escape sequences
+func parseConfigValue(rawValue string) string {
+	var sb strings.Builder
+	inQuotes := false
+	pendingWhitespace := ""
+
+	rawValue = strings.TrimSpace(rawValue)
+	for i := 0; i < len(rawValue); i++ {
+		c := rawValue[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '\\' && i+1 < len(rawValue):
+			i += 1
+			sb.WriteString(pendingWhitespace)
+			pendingWhitespace = ""
+			switch rawValue[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'b':
+				sb.WriteByte('\b')
+			default:
+				sb.WriteByte(rawValue[i])
+			}
+		case (c == '#' || c == ';') && !inQuotes:
+			return sb.String()
+		case (c == ' ' || c == '\t') && !inQuotes:
+			// Internal whitespace is kept, but whitespace before a trailing comment is not
+			pendingWhitespace += string(c)
+		default:
+			sb.WriteString(pendingWhitespace)
+			pendingWhitespace = ""
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String()
+}
+
+func (e *ConfigEntry) name() string {
+	if e.subsection == "" {
+		return e.section + "." + e.key
+	}
+	return e.section + "." + e.subsection + "." + e.key
+}
+
+// Splits a variable name such as `remote.origin.url` into its section, subsection, and key
+func splitConfigName(name string) (string, string, string, error) {
+	firstDot := strings.IndexByte(name, '.')
+	lastDot := strings.LastIndexByte(name, '.')
+	if firstDot == -1 || firstDot == 0 || lastDot == len(name)-1 {
+		return "", "", "", fmt.Errorf("invalid config variable name: %s", name)
+	}
+
+	section := strings.ToLower(name[:firstDot])
+	key := strings.ToLower(name[lastDot+1:])
+	subsection := ""
+	if firstDot != lastDot {
+		subsection = name[firstDot+1 : lastDot]
+	}
+
+	return section, subsection, key, nil
+}
+
+// Returns the value of the given variable (e.g. `core.bare`). If the variable is set multiple times, the last
+// value wins.
+func (c *Config) get(name string) (string, bool) {
+	entry, found := c.getEntry(name)
+	if !found {
+		return "", false
+	}
+	return entry.value, true
+}
+
+// Returns the entry which sets the given variable, i.e. the last one if the variable is set multiple times
+func (c *Config) getEntry(name string) (*ConfigEntry, bool) {
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil {
+		return nil, false
+	}
+
+	var lastEntry *ConfigEntry
+	for _, entry := range c.entries {
+		if entry.section == section && entry.subsection == subsection && entry.key == key {
+			lastEntry = entry
+		}
+	}
+
+	return lastEntry, lastEntry != nil
+}
+
+// Returns every value of the given variable, which may be set multiple times (e.g. `safe.directory`), in the order
+// in which they're set
+func (c *Config) getAll(name string) []string {
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil {
+		return []string{}
+	}
+
+	values := []string{}
+	for _, entry := range c.entries {
+		if entry.section == section && entry.subsection == subsection && entry.key == key {
+			values = append(values, entry.value)
+		}
+	}
+	return values
+}
+
+// Returns the value of the given variable interpreted as an integer, which may have a k, m, or g suffix
+// (scaling by 1024, 1024^2, or 1024^3)
+func (c *Config) getInt(name string, defaultValue int64) (int64, error) {
+	value, found := c.get(name)
+	if !found {
+		return defaultValue, nil
+	}
+
+	if value == "" {
+		return 0, fmt.Errorf("empty integer value for config variable %s", name)
+	}
+
+	n, err := parseScaledInt(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer value for config variable %s: %s", name, value)
+	}
+	return n, nil
+}
+
+// Parses an integer as Git parses integer config values, which may have a k, m, or g suffix (scaling by 1024,
+// 1024^2, or 1024^3)
+func parseScaledInt(value string) (int64, error) {
+	multiplier := int64(1)
+	if value != "" {
+		switch strings.ToLower(value[len(value)-1:]) {
+		case "k":
+			multiplier = 1 << 10
+		case "m":
+			multiplier = 1 << 20
+		case "g":
+			multiplier = 1 << 30
+		}
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// Returns the value of the given variable interpreted as a boolean (true/yes/on/1 or false/no/off/0)
+func (c *Config) getBool(name string, defaultValue bool) (bool, error) {
+	value, found := c.get(name)
+	if !found {
+		return defaultValue, nil
+	}
+
+	boolValue, err := parseConfigBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean value for config variable %s: %s", name, value)
+	}
+	return boolValue, nil
+}
+
+// Parses a boolean value as Git does, accepting true/yes/on/1 and false/no/off/0 (or an empty value) in any case
+func parseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0", "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean value: %s", value)
+	}
+}
+
+// Sets the given variable (e.g. `branch.main.remote`) in the config file, replacing its last existing value if it
+// is already set, or otherwise adding it to the end of its section (which is created if it doesn't exist yet)
+func setConfigValue(configPath string, name string, value string) error {
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil {
+		return err
+	}
+	rawKey := name[strings.LastIndexByte(name, '.')+1:]
+	newLine := fmt.Sprintf("\t%s = %s", rawKey, formatConfigValue(value))
+
+	lines, err := readConfigFileLines(configPath)
+	if err != nil {
+		return err
+	}
+
+	lastSectionLine, lastKeyLine := -1, -1
+	forEachConfigLine(lines, func(i int, lineSection string, lineSubsection string, lineKey string) {
+		if lineSection == section && lineSubsection == subsection {
+			lastSectionLine = i
+			if lineKey == key {
+				lastKeyLine = i
+			}
+		}
+	})
+
+	if lastKeyLine != -1 {
+		lines[lastKeyLine] = newLine
+	} else if lastSectionLine != -1 {
+		lines = slices.Insert(lines, lastSectionLine+1, newLine)
+	} else {
+		lines = append(lines, formatConfigSectionHeader(section, subsection), newLine)
+	}
+
+	return writeFileWithLock(configPath, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// Removes every value of the given variable from the config file. Returns whether the variable was set.
+func unsetConfigValue(configPath string, name string) (bool, error) {
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil {
+		return false, err
+	}
+
+	lines, err := readConfigFileLines(configPath)
+	if err != nil {
+		return false, err
+	}
+
+	linesToRemove := make(map[int]bool)
+	forEachConfigLine(lines, func(i int, lineSection string, lineSubsection string, lineKey string) {
+		if lineSection == section && lineSubsection == subsection && lineKey == key {
+			linesToRemove[i] = true
+		}
+	})
+
+	if len(linesToRemove) == 0 {
+		return false, nil
+	}
+
+	keptLines := []string{}
+	for i, line := range lines {
+		if !linesToRemove[i] {
+			keptLines = append(keptLines, line)
+		}
+	}
+
+	return true, writeFileWithLock(configPath, []byte(strings.Join(keptLines, "\n")+"\n"))
+}
+
+func readConfigFileLines(configPath string) ([]string, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil && os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %s", configPath, err)
+	}
+
+	content := strings.TrimSuffix(string(data), "\n")
+	if content == "" {
+		return []string{}, nil
+	}
+	return strings.Split(content, "\n"), nil
+}
+
+// Calls the given function for each line of the config file that is part of a section, with the section and
+// subsection that the line belongs to, and the (lowercased) key of the variable set on the line (empty if the line
+// doesn't set a variable)
+func forEachConfigLine(lines []string, fn func(i int, section string, subsection string, key string)) {
+	section, subsection := "", ""
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			closingIndex := strings.LastIndexByte(line, ']')
+			if closingIndex == -1 {
+				continue
+			}
+			var err error
+			section, subsection, err = parseConfigSectionHeader(line[1:closingIndex])
+			if err != nil {
+				section, subsection = "", ""
+				continue
+			}
+			fn(i, section, subsection, "")
+			continue
+		}
+
+		if section != "" {
+			key, _, _ := strings.Cut(line, "=")
+			fn(i, section, subsection, strings.ToLower(strings.TrimSpace(key)))
+		}
+	}
+}
+
+func formatConfigSectionHeader(section string, subsection string) string {
+	if subsection == "" {
+		return fmt.Sprintf("[%s]", section)
+	}
+
+	escapedSubsection := strings.ReplaceAll(subsection, `\`, `\\`)
+	escapedSubsection = strings.ReplaceAll(escapedSubsection, `"`, `\"`)
+	return fmt.Sprintf("[%s \"%s\"]", section, escapedSubsection)
+}
+
+// Formats a value for writing to a config file, quoting it if it would otherwise be altered when read back
+func formatConfigValue(value string) string {
+	escapedValue := strings.ReplaceAll(value, `\`, `\\`)
+	escapedValue = strings.ReplaceAll(escapedValue, `"`, `\"`)
+	escapedValue = strings.ReplaceAll(escapedValue, "\n", `\n`)
+	escapedValue = strings.ReplaceAll(escapedValue, "\t", `\t`)
+
+	if value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;") {
+		return `"` + escapedValue + `"`
+	}
+	return escapedValue
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The scope of a config file. Files with a higher scope take precedence over those with a lower scope.
+type ConfigScope int
+
+const (
+	ConfigScopeSystem ConfigScope = iota
+	ConfigScopeGlobal
+	ConfigScopeLocal
+	ConfigScopeWorktree
+)
+
+func (s ConfigScope) toString() string {
+	switch s {
+	case ConfigScopeSystem:
+		return "system"
+	case ConfigScopeGlobal:
+		return "global"
+	case ConfigScopeLocal:
+		return "local"
+	default:
+		return "worktree"
+	}
+}
+
+// The maximum number of nested includes which are followed, which guards against include cycles
+const MAX_CONFIG_INCLUDE_DEPTH = 10
+
+// Reads the variables set in every config file which applies to the repository, in increasing order of precedence:
+// the system config, the global (per-user) config, the repository's config, and its worktree config. As the last
+// value set for a variable wins, the repository's config overrides the global config, and so on.
+func readConfig(repoDir string) (*Config, error) {
+	gitDir, err := filepath.Abs(getGitDir(repoDir))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{entries: []*ConfigEntry{}}
+	readScope := func(configPath string, scope ConfigScope) error {
+		scopeConfig, err := readConfigFile(configPath, scope, gitDir, 0)
+		if err != nil {
+			return err
+		}
+		config.entries = append(config.entries, scopeConfig.entries...)
+		return nil
+	}
+
+	for _, configPath := range getSystemConfigPaths() {
+		if err := readScope(configPath, ConfigScopeSystem); err != nil {
+			return nil, err
+		}
+	}
+	for _, configPath := range getGlobalConfigPaths() {
+		if err := readScope(configPath, ConfigScopeGlobal); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := readScope(getRepoConfigPath(repoDir), ConfigScopeLocal); err != nil {
+		return nil, err
+	}
+
+	// The worktree config is only read if the repository opts into it
+	worktreeConfigEnabled, err := config.getBool("extensions.worktreeConfig", false)
+	if err != nil {
+		return nil, err
+	}
+	if worktreeConfigEnabled {
+		if err := readScope(filepath.Join(gitDir, "config.worktree"), ConfigScopeWorktree); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// Reads the variables set in the system and global config files, which unlike a repository's own config can only be
+// written by the user (or an administrator), and so are trusted for security-sensitive settings such as
+// safe.directory. Conditional includes are evaluated outside of any repository, so they never hold.
+func readProtectedConfig() (*Config, error) {
+	config := &Config{entries: []*ConfigEntry{}}
+	for _, configPath := range getSystemConfigPaths() {
+		scopeConfig, err := readConfigFile(configPath, ConfigScopeSystem, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		config.entries = append(config.entries, scopeConfig.entries...)
+	}
+	for _, configPath := range getGlobalConfigPaths() {
+		scopeConfig, err := readConfigFile(configPath, ConfigScopeGlobal, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		config.entries = append(config.entries, scopeConfig.entries...)
+	}
+	return config, nil
+}
+
+// Returns the path of the system config file, which may be overridden by GIT_CONFIG_SYSTEM, or skipped entirely by
+// setting GIT_CONFIG_NOSYSTEM
+func getSystemConfigPaths() []string {
+	if os.Getenv("GIT_CONFIG_NOSYSTEM") != "" {
+		return []string{}
+	}
+	if systemConfigPath := os.Getenv("GIT_CONFIG_SYSTEM"); systemConfigPath != "" {
+		return []string{systemConfigPath}
+	}
+	return []string{"/etc/gitconfig"}
+}
+
+// Returns the paths of the global config files, in increasing order of precedence: $XDG_CONFIG_HOME/git/config (or
+// ~/.config/git/config) and ~/.gitconfig. Both may be replaced by a single file set with GIT_CONFIG_GLOBAL.
+func getGlobalConfigPaths() []string {
+	if globalConfigPath := os.Getenv("GIT_CONFIG_GLOBAL"); globalConfigPath != "" {
+		return []string{globalConfigPath}
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return []string{}
+	}
+
+	xdgConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	if xdgConfigHome == "" {
+		xdgConfigHome = filepath.Join(homeDir, ".config")
+	}
+
+	return []string{filepath.Join(xdgConfigHome, "git", "config"), filepath.Join(homeDir, ".gitconfig")}
+}
+
+// Reads the config file included by the given entry if it's an include.path variable, or an includeIf.<condition>.path
+// variable whose condition holds. Returns nil if the entry doesn't include a file.
+func readIncludedConfig(entry *ConfigEntry, scope ConfigScope, gitDir string, depth int) (*Config, error) {
+	if entry.key != "path" || entry.value == "" {
+		return nil, nil
+	}
+
+	switch {
+	case entry.section == "include" && entry.subsection == "":
+	case entry.section == "includeif":
+		conditionHolds, err := evaluateIncludeCondition(entry.subsection, entry.origin, gitDir)
+		if err != nil || !conditionHolds {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+
+	if depth >= MAX_CONFIG_INCLUDE_DEPTH {
+		return nil, fmt.Errorf("exceeded maximum include depth (%d) while including %s from %s (possible include cycle)", MAX_CONFIG_INCLUDE_DEPTH, entry.value, entry.origin)
+	}
+
+	// Relative paths are relative to the directory of the file containing the include
+	includePath, err := expandConfigPath(entry.value)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(includePath) {
+		includePath = filepath.Dir(entry.origin) + string(filepath.Separator) + includePath
+	}
+
+	// A missing included file is ignored
+	return readConfigFile(includePath, scope, gitDir, depth+1)
+}
+
+// Expands a leading ~/ in a path from a config file to the user's home directory
+func expandConfigPath(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to expand %s: %s", path, err)
+	}
+	// filepath.Join isn't used, as it would drop a trailing slash, which is significant in gitdir conditions
+	return strings.TrimSuffix(homeDir, string(filepath.Separator)) + path[1:], nil
+}
+
+// Evaluates the condition of an includeIf section, which is one of:
+// gitdir:<pattern> --> The .git directory matches the glob pattern.
+// gitdir/i:<pattern> --> The same, but matched case-insensitively.
+// onbranch:<pattern> --> The current branch matches the glob pattern.
+// Unknown conditions, and conditions evaluated outside of a repository, never hold.
+func evaluateIncludeCondition(condition string, configPath string, gitDir string) (bool, error) {
+	if gitDir == "" {
+		return false, nil
+	}
+
+	if pattern, found := strings.CutPrefix(condition, "gitdir:"); found {
+		return matchGitDirCondition(pattern, configPath, gitDir, false)
+	} else if pattern, found := strings.CutPrefix(condition, "gitdir/i:"); found {
+		return matchGitDirCondition(pattern, configPath, gitDir, true)
+	} else if pattern, found := strings.CutPrefix(condition, "onbranch:"); found {
+		branchName, err := getCurrentBranch(filepath.Dir(gitDir))
+		if err != nil {
+			// HEAD is detached (or missing), so no branch is current
+			return false, nil
+		}
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "**"
+		}
+		return matchConfigPattern(pattern, branchName, false), nil
+	}
+
+	return false, nil
+}
+
+// Matches the .git directory against the pattern of a gitdir condition. As in Git, a leading ~/ is expanded to the
+// user's home directory, a leading ./ to the directory of the config file containing the condition, a relative
+// pattern matches at any depth (as if prefixed with **/), and a pattern ending in / matches everything under it.
+func matchGitDirCondition(pattern string, configPath string, gitDir string, caseInsensitive bool) (bool, error) {
+	pattern, err := expandConfigPath(pattern)
+	if err != nil {
+		return false, err
+	}
+
+	if strings.HasPrefix(pattern, "./") {
+		// filepath.Join drops the trailing slash, which is significant
+		hasTrailingSlash := strings.HasSuffix(pattern, "/")
+		pattern = filepath.Join(filepath.Dir(configPath), pattern[2:])
+		if hasTrailingSlash {
+			pattern += "/"
+		}
+	} else if !filepath.IsAbs(pattern) {
+		pattern = "**/" + pattern
+	}
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	pattern = filepath.ToSlash(pattern)
+
+	// The .git directory is matched both as given and with any symbolic links resolved
+	gitDirPaths := []string{gitDir}
+	if realGitDir, err := filepath.EvalSymlinks(gitDir); err == nil && realGitDir != gitDir {
+		gitDirPaths = append(gitDirPaths, realGitDir)
+	}
+
+	for _, gitDirPath := range gitDirPaths {
+		if matchConfigPattern(pattern, filepath.ToSlash(gitDirPath), caseInsensitive) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Matches a path against a glob pattern, in which * and ? match within a single path component, and ** matches
+// across any number of components
+func matchConfigPattern(pattern string, path string, caseInsensitive bool) bool {
+	var sb strings.Builder
+	if caseInsensitive {
+		sb.WriteString("(?i)")
+	}
+	sb.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i += 1
+		case pattern[i] == '*':
+			sb.WriteString("[^/]*")
+		case pattern[i] == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	sb.WriteString("$")
+	matched, err := regexp.MatchString(sb.String(), path)
+	return err == nil && matched
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Converts the content of the files of a repository between the form in which they're stored in blobs and the form
+// in which they're written to the working tree, as Git does: by running the filter driver given by a file's filter
+// attribute (see FilterDriver), and by converting its line endings (see LineEndings). As in Git, a file being staged
+// is cleaned by its filter driver before its line endings are normalized, and a file being checked out has its line
+// endings converted before it's smudged by its filter driver.
+type ContentConverter struct {
+	attributes  *Attributes
+	config      *Config
+	lineEndings *LineEndings
+	repoDir     string
+}
+
+func newContentConverter(repoDir string) (*ContentConverter, error) {
+	attributes, err := readAttributes(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attributes: %s", err)
+	}
+	return newContentConverterWithAttributes(attributes, "", repoDir)
+}
+
+// Returns the content converter for checking out the given tree, whose .gitattributes file is used in place of the
+// one in the working tree, since the working tree is about to be replaced
+func newTreeContentConverter(treeHash string, repoDir string) (*ContentConverter, error) {
+	attributes, err := readTreeAttributes(treeHash, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attributes: %s", err)
+	}
+	return newContentConverterWithAttributes(attributes, treeHash, repoDir)
+}
+
+func newContentConverterWithAttributes(attributes *Attributes, treeHash string, repoDir string) (*ContentConverter, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %s", err)
+	}
+
+	lineEndings, err := newLineEndings(attributes, config, treeHash, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ContentConverter{attributes: attributes, config: config, lineEndings: lineEndings, repoDir: repoDir}, nil
+}
+
+// Converts the content of a file (given by its path relative to the current directory) to the content stored in its
+// blob. A file outside of the working tree is never converted.
+func (c *ContentConverter) toBlob(filePath string, content []byte) ([]byte, error) {
+	path, inWorkingTree, err := c.getRelativePath(filePath)
+	if err != nil || !inWorkingTree {
+		return content, err
+	}
+
+	content, err = c.runFilter(path, content, FilterClean)
+	if err != nil {
+		return nil, err
+	}
+	return c.lineEndings.toBlob(path, content)
+}
+
+// Converts the content of a blob to the content written to the given file (whose path is relative to the current
+// directory). A file outside of the working tree is never converted.
+func (c *ContentConverter) toWorkingTree(filePath string, content []byte) ([]byte, error) {
+	path, inWorkingTree, err := c.getRelativePath(filePath)
+	if err != nil || !inWorkingTree {
+		return content, err
+	}
+
+	content, err = c.lineEndings.toWorkingTree(path, content)
+	if err != nil {
+		return nil, err
+	}
+	return c.runFilter(path, content, FilterSmudge)
+}
+
+// Returns the path of the file relative to the top level of the working tree, and whether it's inside the working tree
+func (c *ContentConverter) getRelativePath(filePath string) (string, bool, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", false, err
+	}
+	absRepoDir, err := filepath.Abs(c.repoDir)
+	if err != nil {
+		return "", false, err
+	}
+
+	path, err := filepath.Rel(absRepoDir, absPath)
+	path = filepath.ToSlash(path)
+	if err != nil || path == ".." || strings.HasPrefix(path, "../") {
+		return "", false, nil
+	}
+	return path, true, nil
+}
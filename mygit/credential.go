@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Represents a credential for a remote repository, in the terms of Git's credential helper protocol: the URL it's for
+// (its protocol, host, and, if credential.useHttpPath is set, path), along with a username and a password (for
+// GitHub, a personal access token)
+type Credential struct {
+	protocol string
+	host     string
+	path     string
+	username string
+	password string
+	source   string // Where the credential came from, for reporting authentication failures
+	helpers  []string
+	approved bool
+}
+
+// The credentials found by the command, by the URL they're for, so that each is only looked up once
+var credentialCache = make(map[string]*Credential)
+
+// Returns the credential to authenticate requests to the given URL with, found as Git finds it: from the URL itself,
+// then the GIT_USERNAME and GIT_TOKEN environment variables (which may be set in a .env file), then each credential
+// helper given by the credential.helper config variable (e.g. `store`, `cache`, or `osxkeychain`), and finally by
+// prompting for it. credential.username gives the username to look up the password for, and each variable may be set
+// for the URLs starting with a given prefix, e.g. credential.https://github.com.helper.
+func getCredential(requestURL string) (*Credential, error) {
+	credential, settings, err := newCredential(requestURL)
+	if err != nil {
+		return nil, err
+	}
+	if cached, isCached := credentialCache[credential.key()]; isCached {
+		return cached, nil
+	}
+
+	credential.username = settings.username
+	if username := os.Getenv("GIT_USERNAME"); username != "" {
+		credential.username = username
+	}
+	if parsedURL, _ := url.Parse(requestURL); parsedURL.User != nil {
+		credential.username = parsedURL.User.Username()
+		credential.password, _ = parsedURL.User.Password()
+		credential.source = "URL"
+	}
+	if token := os.Getenv("GIT_TOKEN"); token != "" && credential.password == "" && credential.username != "" {
+		credential.password = token
+		credential.source = "GIT_USERNAME and GIT_TOKEN environment variables"
+	}
+
+	if credential.password == "" {
+		credential.fill()
+	}
+	if credential.password == "" {
+		if err := credential.prompt(settings.askPass); err != nil {
+			return nil, err
+		}
+	}
+
+	credentialCache[credential.key()] = credential
+	return credential, nil
+}
+
+// Returns the credential which requests to the given URL are known to need, i.e. one which was already needed for
+// the same repository (or host) by an earlier request, or one given in the URL itself. Otherwise, requests are made
+// without credentials, as public repositories don't need them, until the server asks for them.
+func getKnownCredential(requestURL string) (*Credential, error) {
+	if parsedURL, err := url.Parse(requestURL); err == nil && parsedURL.User != nil {
+		return getCredential(requestURL)
+	}
+	credential, _, err := newCredential(requestURL)
+	if err != nil {
+		return nil, err
+	}
+	return credentialCache[credential.key()], nil
+}
+
+// Returns an empty credential for the given URL, along with the credential settings which apply to it
+func newCredential(requestURL string) (*Credential, CredentialSettings, error) {
+	parsedURL, err := url.Parse(requestURL)
+	if err != nil {
+		return nil, CredentialSettings{}, fmt.Errorf("invalid URL: %s", requestURL)
+	}
+	settings := getCredentialSettings(parsedURL)
+
+	credential := &Credential{protocol: parsedURL.Scheme, host: parsedURL.Host, helpers: settings.helpers}
+	if settings.useHTTPPath {
+		credential.path = strings.TrimPrefix(getRepoURLPath(parsedURL.Path), "/")
+	}
+	return credential, settings, nil
+}
+
+// Returns the path of the repository which the request is made to, i.e. without the endpoint of the smart HTTP
+// protocol, since credentials are per repository
+func getRepoURLPath(urlPath string) string {
+	for _, endpoint := range []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"} {
+		if repoPath, isEndpoint := strings.CutSuffix(urlPath, endpoint); isEndpoint {
+			return repoPath
+		}
+	}
+	return urlPath
+}
+
+// Returns the URL which the credential is for, e.g. https://github.com, identifying it in the credential cache and
+// prompts
+func (c *Credential) key() string {
+	key := c.protocol + "://" + c.host
+	if c.path != "" {
+		key += "/" + c.path
+	}
+	return key
+}
+
+// Formats the credential as the input to a credential helper: one attribute per line, followed by a blank line. The
+// password is only included if withPassword is set, since helpers are only told it when storing or erasing it.
+func (c *Credential) format(withPassword bool) string {
+	var sb strings.Builder
+	for _, attribute := range [][2]string{{"protocol", c.protocol}, {"host", c.host}, {"path", c.path}, {"username", c.username}} {
+		if attribute[1] != "" {
+			sb.WriteString(fmt.Sprintf("%s=%s\n", attribute[0], attribute[1]))
+		}
+	}
+	if withPassword && c.password != "" {
+		sb.WriteString(fmt.Sprintf("password=%s\n", c.password))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// Asks each credential helper in turn for the credential, until one gives both a username and a password (or tells
+// the rest not to be asked, with quit=1). A helper which fails is skipped, as in Git.
+func (c *Credential) fill() {
+	for _, helper := range c.helpers {
+		output, err := runCredentialHelper(helper, "get", c.format(false))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: credential helper '%s' failed: %s\n", helper, err)
+			continue
+		}
+
+		quit := false
+		scanner := bufio.NewScanner(strings.NewReader(output))
+		for scanner.Scan() {
+			key, value, found := strings.Cut(scanner.Text(), "=")
+			if !found {
+				continue
+			}
+			switch key {
+			case "username":
+				c.username = value
+			case "password":
+				c.password = value
+			case "quit":
+				quit, _ = parseConfigBool(value)
+			}
+		}
+
+		if c.username != "" && c.password != "" {
+			c.source = fmt.Sprintf("credential helper '%s'", helper)
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// Tells the credential helpers that the credential was accepted, so that they can store it for next time, if it was
+// entered at the prompt or given in the URL (a token from the environment is left where it is)
+func (c *Credential) approve() {
+	if c.approved {
+		return
+	}
+	c.approved = true
+	if c.source != "prompt" && c.source != "URL" {
+		return
+	}
+	for _, helper := range c.helpers {
+		if _, err := runCredentialHelper(helper, "store", c.format(true)); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: credential helper '%s' failed: %s\n", helper, err)
+		}
+	}
+}
+
+// Tells the credential helpers that the credential was rejected, so that they erase it rather than giving it again
+func (c *Credential) reject() {
+	for _, helper := range c.helpers {
+		if _, err := runCredentialHelper(helper, "erase", c.format(true)); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: credential helper '%s' failed: %s\n", helper, err)
+		}
+	}
+	delete(credentialCache, c.key())
+}
+
+// Runs a credential helper, as named by credential.helper, to perform the given action (get, store, or erase) with
+// the given input, returning its output. As in Git, a helper starting with ! is a shell command, an absolute path is
+// run as it is, and any other name is the name of a git-credential-<name> program, given any arguments that follow.
+func runCredentialHelper(helper string, action string, input string) (string, error) {
+	command := "git credential-" + helper
+	if shellCommand, isShellCommand := strings.CutPrefix(helper, "!"); isShellCommand {
+		command = shellCommand
+	} else if fields := strings.Fields(helper); len(fields) > 0 && filepath.IsAbs(fields[0]) {
+		command = helper
+	}
+
+	cmd := exec.Command("sh", "-c", command+" "+action)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// Prompts for whatever the credential is missing: with the askpass program given by GIT_ASKPASS, core.askPass, or
+// SSH_ASKPASS, or otherwise on the terminal (without echoing the password), unless GIT_TERMINAL_PROMPT is false
+func (c *Credential) prompt(askPass string) error {
+	if c.username == "" {
+		username, err := promptForCredential(fmt.Sprintf("Username for '%s': ", c.key()), true, askPass)
+		if err != nil {
+			return err
+		}
+		c.username = username
+	}
+
+	userKey := fmt.Sprintf("%s://%s@%s", c.protocol, url.PathEscape(c.username), strings.TrimPrefix(c.key(), c.protocol+"://"))
+	password, err := promptForCredential(fmt.Sprintf("Password for '%s': ", userKey), false, askPass)
+	if err != nil {
+		return err
+	}
+	c.password = password
+	c.source = "prompt"
+	return nil
+}
+
+// Reads a single line answering the given prompt, either from the askpass program or the terminal
+func promptForCredential(prompt string, echo bool, askPass string) (string, error) {
+	if askPass != "" {
+		cmd := exec.Command("sh", "-c", askPass+` "$@"`, askPass, prompt)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("unable to read askpass response from '%s': %s", askPass, err)
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+	}
+
+	what := strings.TrimSuffix(prompt, ": ")
+	if value := os.Getenv("GIT_TERMINAL_PROMPT"); value != "" {
+		if terminalPrompt, err := parseConfigBool(value); err == nil && !terminalPrompt {
+			return "", fmt.Errorf("could not read %s: terminal prompts disabled", what)
+		}
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: no terminal to prompt on (set GIT_USERNAME and GIT_TOKEN, or configure a credential helper)", what)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	if !echo {
+		if err := setTerminalEcho(tty, false); err == nil {
+			defer setTerminalEcho(tty, true)
+			defer fmt.Fprintln(tty)
+		}
+	}
+
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %s", what, err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Turns the terminal's echoing of what's typed on or off, with stty
+func setTerminalEcho(tty *os.File, echo bool) error {
+	mode := "-echo"
+	if echo {
+		mode = "echo"
+	}
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
+
+// Represents the credential settings which apply to a URL
+type CredentialSettings struct {
+	helpers     []string
+	username    string
+	useHTTPPath bool
+	askPass     string
+}
+
+// Returns the credential settings which apply to the given URL, from the config loaded by loadHTTPSettings: those
+// set for every URL (e.g. credential.helper) and those set for a prefix of the URL (e.g.
+// credential.https://github.com.helper), in the order they're set. As in Git, an empty credential.helper clears the
+// list of helpers set before it.
+func getCredentialSettings(requestURL *url.URL) CredentialSettings {
+	settings := CredentialSettings{helpers: []string{}}
+	config := httpSettings.config
+	if config == nil {
+		config = &Config{entries: []*ConfigEntry{}}
+	}
+
+	for _, entry := range config.entries {
+		if entry.section != "credential" || (entry.subsection != "" && !credentialURLMatches(entry.subsection, requestURL)) {
+			continue
+		}
+		switch entry.key {
+		case "helper":
+			if entry.value == "" {
+				settings.helpers = []string{}
+			} else {
+				settings.helpers = append(settings.helpers, entry.value)
+			}
+		case "username":
+			settings.username = entry.value
+		case "usehttppath":
+			settings.useHTTPPath, _ = parseConfigBool(entry.value)
+		}
+	}
+
+	settings.askPass = os.Getenv("GIT_ASKPASS")
+	if settings.askPass == "" {
+		settings.askPass, _ = config.get("core.askPass")
+	}
+	if settings.askPass == "" {
+		settings.askPass = os.Getenv("SSH_ASKPASS")
+	}
+	return settings
+}
+
+// Returns whether the URL given in a credential.<url>.* variable applies to the request's URL: its protocol and host
+// must be the same, and its path (if any) must be a prefix of the request's
+func credentialURLMatches(pattern string, requestURL *url.URL) bool {
+	patternURL, err := url.Parse(pattern)
+	if err != nil || patternURL.Host == "" {
+		return false
+	}
+	if patternURL.Scheme != requestURL.Scheme || !strings.EqualFold(patternURL.Host, requestURL.Host) {
+		return false
+	}
+	if patternURL.User != nil && (requestURL.User == nil || patternURL.User.Username() != requestURL.User.Username()) {
+		return false
+	}
+	patternPath := strings.TrimSuffix(patternURL.Path, "/")
+	return patternPath == "" || requestURL.Path == patternPath || strings.HasPrefix(requestURL.Path, patternPath+"/")
+}
@@ -0,0 +1,44 @@
+package main
+
+// The default byte budget of the delta base cache, matching Git's default core.deltaBaseCacheLimit
+const DEFAULT_DELTA_BASE_CACHE_LIMIT = 96 * 1024 * 1024
+
+// A least-recently-used cache of resolved packfile objects, keyed by their offsets within the packfile. While
+// reading a packfile, every object that deltified objects may use as their base is kept here (up to a total
+// content size budget), so that long delta chains don't require inflating and resolving the same base
+// objects over and over again.
+type DeltaBaseCache struct {
+	cache *LRUCache[int, DeltaBaseCacheEntry]
+}
+
+// Represents a resolved packfile object stored in the delta base cache
+type DeltaBaseCacheEntry struct {
+	objType ObjectType
+	content []byte
+}
+
+func newDeltaBaseCache(limitBytes int64) *DeltaBaseCache {
+	return &DeltaBaseCache{cache: newLRUCache[int, DeltaBaseCacheEntry](limitBytes)}
+}
+
+// Returns the delta base cache byte budget configured by core.deltaBaseCacheLimit
+func getDeltaBaseCacheLimit(repoDir string) (int64, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return -1, err
+	}
+
+	return config.getInt("core.deltaBaseCacheLimit", DEFAULT_DELTA_BASE_CACHE_LIMIT)
+}
+
+func (c *DeltaBaseCache) get(offset int) (ObjectType, []byte, bool) {
+	entry, ok := c.cache.get(offset)
+	if !ok {
+		return -1, nil, false
+	}
+	return entry.objType, entry.content, true
+}
+
+func (c *DeltaBaseCache) add(offset int, objType ObjectType, content []byte) {
+	c.cache.add(offset, DeltaBaseCacheEntry{objType: objType, content: content}, int64(len(content)))
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The maximum number of tags considered when describing a commit, as in Git. The walk stops once this many tags have
+// been found, as tags found later are unlikely to be closer.
+const DESCRIBE_MAX_CANDIDATES = 10
+
+// Represents the options controlling which tags may describe a commit, and how its history is searched for them
+type DescribeOptions struct {
+	tags        bool     // Whether lightweight tags qualify, rather than only annotated tags
+	firstParent bool     // Whether only the first parent of merge commits is followed
+	match       []string // Only tags matching one of these glob patterns qualify (any tag if empty)
+	exclude     []string // Tags matching any of these glob patterns never qualify
+}
+
+// Represents a tag which may describe a commit, i.e. a tag pointing (possibly through annotated tags) to the commit
+type DescribeTag struct {
+	name       string // The tag name, without refs/tags/
+	commitHash string
+	annotated  bool
+	taggerDate int64 // 0 for lightweight tags and tags which don't record a tagger
+}
+
+// Represents a tag found while walking the history of the commit being described
+type describeCandidate struct {
+	tag        *DescribeTag
+	depth      int // The number of commits reachable from the described commit but not from the tag
+	foundOrder int
+}
+
+// Collects the repeated --match and --exclude flags of describe
+type patternListFlag []string
+
+func (f *patternListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *patternListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Describes the commit by the most recent tag reachable from it, as <tag>-<n>-g<abbreviated hash>, where n is the
+// number of commits reachable from the commit but not from the tag. A commit which is tagged itself is described by
+// just the tag name. As in Git, the history is walked in committer date order from the commit, and of the first
+// DESCRIBE_MAX_CANDIDATES tags found, the one with the fewest commits since it is chosen.
+func Describe(commitHash string, options DescribeOptions, repoDir string) (string, error) {
+	tagsByCommit, hasUnannotated, err := getDescribeTags(options, repoDir)
+	if err != nil {
+		return "", err
+	}
+	if len(tagsByCommit) == 0 {
+		if hasUnannotated {
+			return "", fmt.Errorf("No annotated tags can describe '%s'.\nHowever, there were unannotated tags: try --tags.", commitHash)
+		}
+		return "", fmt.Errorf("No names found, cannot describe anything.")
+	}
+
+	if tag, isTagged := tagsByCommit[commitHash]; isTagged {
+		return tag.name, nil
+	}
+
+	candidates := []*describeCandidate{}
+	seen := make(map[string]bool)
+	queue := []*CommitObject{}
+	pushCommit := func(hash string) error {
+		if seen[hash] || !objectExists(hash, repoDir) {
+			return nil
+		}
+		seen[hash] = true
+
+		commitObj, err := ReadCommitObjectFile(hash, repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to read commit %s: %s", hash, err)
+		}
+		// The queue is kept sorted with the most recently committed commit first
+		i := sort.Search(len(queue), func(i int) bool {
+			return queue[i].committer.dateSeconds < commitObj.committer.dateSeconds
+		})
+		queue = append(queue[:i], append([]*CommitObject{commitObj}, queue[i:]...)...)
+		return nil
+	}
+
+	if err := pushCommit(commitHash); err != nil {
+		return "", err
+	}
+
+	for len(queue) > 0 && len(candidates) < DESCRIBE_MAX_CANDIDATES {
+		commitObj := queue[0]
+		queue = queue[1:]
+
+		if tag, isTagged := tagsByCommit[commitObj.hash]; isTagged {
+			candidates = append(candidates, &describeCandidate{tag: tag, foundOrder: len(candidates)})
+			// Any tag behind this one has at least as many commits since it, so the walk doesn't go past it
+			continue
+		}
+
+		parentHashes := commitObj.parentCommitHashes
+		if options.firstParent && len(parentHashes) > 1 {
+			parentHashes = parentHashes[:1]
+		}
+		for _, parentHash := range parentHashes {
+			if err := pushCommit(parentHash); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		if hasUnannotated && !options.tags {
+			return "", fmt.Errorf("No annotated tags can describe '%s'.\nHowever, there were unannotated tags: try --tags.", commitHash)
+		}
+		return "", fmt.Errorf("No tags can describe '%s'.", commitHash)
+	}
+
+	describedCommits, err := getReachableCommits(commitHash, options.firstParent, repoDir)
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range candidates {
+		tagCommits, err := getReachableCommits(candidate.tag.commitHash, options.firstParent, repoDir)
+		if err != nil {
+			return "", err
+		}
+		for hash := range describedCommits {
+			if !tagCommits[hash] {
+				candidate.depth += 1
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].depth != candidates[j].depth {
+			return candidates[i].depth < candidates[j].depth
+		}
+		return candidates[i].foundOrder < candidates[j].foundOrder
+	})
+
+	best := candidates[0]
+	return fmt.Sprintf("%s-%d-g%s", best.tag.name, best.depth, abbreviateHash(commitHash)), nil
+}
+
+// Returns the tags which may describe a commit, keyed by the hash of the commit they point to, along with whether any
+// lightweight tags were passed over because only annotated tags qualify. When several tags point to the same commit,
+// an annotated tag is preferred over a lightweight one, and a newer annotated tag over an older one.
+func getDescribeTags(options DescribeOptions, repoDir string) (map[string]*DescribeTag, bool, error) {
+	packedRefs, err := readPackedRefs(repoDir)
+	if err != nil {
+		return nil, false, err
+	}
+	looseRefs, err := readLooseRefs(repoDir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Loose refs take precedence over packed refs, since refs that are updated after being packed are written as
+	// loose files again
+	tagRefs := make(map[string]string)
+	for refName, packedRef := range packedRefs {
+		tagRefs[refName] = packedRef.hash
+	}
+	for _, looseRef := range looseRefs {
+		tagRefs[looseRef.name] = looseRef.hash
+	}
+
+	tagsByCommit := make(map[string]*DescribeTag)
+	hasUnannotated := false
+	for refName, tagHash := range tagRefs {
+		tagName, isTag := strings.CutPrefix(refName, "refs/tags/")
+		if !isTag || !matchesDescribePatterns(tagName, options) {
+			continue
+		}
+
+		tag, err := readDescribeTag(tagName, tagHash, repoDir)
+		if err != nil {
+			return nil, false, err
+		}
+		if tag == nil {
+			continue
+		}
+		if !tag.annotated && !options.tags {
+			hasUnannotated = true
+			continue
+		}
+
+		if existing, exists := tagsByCommit[tag.commitHash]; exists && !isBetterDescribeTag(tag, existing) {
+			continue
+		}
+		tagsByCommit[tag.commitHash] = tag
+	}
+
+	return tagsByCommit, hasUnannotated, nil
+}
+
+// Reads the tag with the given name and hash, peeling it to the commit it points to. Returns nil for tags which don't
+// point to a commit (e.g. tags of trees or blobs), or which point to objects missing from the repository.
+func readDescribeTag(tagName string, tagHash string, repoDir string) (*DescribeTag, error) {
+	if !objectExists(tagHash, repoDir) {
+		return nil, nil
+	}
+
+	commitHash, objType, err := peelObject(tagHash, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to peel tag %s: %s", tagName, err)
+	}
+	if objType != Commit {
+		return nil, nil
+	}
+
+	tag := &DescribeTag{name: tagName, commitHash: commitHash, annotated: commitHash != tagHash}
+	if tag.annotated {
+		tagObj, err := ReadTagObjectFile(tagHash, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		if tagObj.tagger != nil {
+			tag.taggerDate = tagObj.tagger.dateSeconds
+		}
+	}
+	return tag, nil
+}
+
+func isBetterDescribeTag(tag *DescribeTag, other *DescribeTag) bool {
+	if tag.annotated != other.annotated {
+		return tag.annotated
+	}
+	if tag.taggerDate != other.taggerDate {
+		return tag.taggerDate > other.taggerDate
+	}
+	// Tie-break by name so that the result doesn't depend on the order in which refs are read
+	return tag.name < other.name
+}
+
+// Checks whether the tag name matches one of the --match patterns (if any are given) and none of the --exclude
+// patterns
+func matchesDescribePatterns(tagName string, options DescribeOptions) bool {
+	for _, pattern := range options.exclude {
+		if matchDescribePattern(pattern, tagName) {
+			return false
+		}
+	}
+
+	if len(options.match) == 0 {
+		return true
+	}
+	for _, pattern := range options.match {
+		if matchDescribePattern(pattern, tagName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches a tag name against a glob pattern. As in Git, * and ? also match slashes, so that e.g. v* matches
+// v1.0/rc1, and [...] matches one of a set of characters ([!...] or [^...] for any character not in the set).
+func matchDescribePattern(pattern string, tagName string) bool {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				sb.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			set := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(set, "!") {
+				set = "^" + set[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(set, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	sb.WriteString("$")
+	matched, err := regexp.MatchString(sb.String(), tagName)
+	return err == nil && matched
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The number of bytes at the start of a file that are checked for NUL bytes to detect binary files (as Git does)
+const BINARY_DETECTION_LENGTH = 8000
+
+type DiffOpType int
+
+const (
+	DiffEqual DiffOpType = iota
+	DiffInsert
+	DiffDelete
+)
+
+// Represents a single line of the line-by-line diff between an old and a new file. oldLineNum and newLineNum are
+// the 0-indexed positions of the line in the old and new files, set to -1 if the line isn't present in that file.
+type DiffOp struct {
+	opType     DiffOpType
+	oldLineNum int
+	newLineNum int
+	line       string
+}
+
+// Splits file content into lines, each keeping its trailing newline (so that a missing newline at the end of the
+// file is preserved)
+func splitLines(content []byte) []string {
+	return splitAtLineEnds(string(content), findLineEnds(content))
+}
+
+// Represents the options controlling how lines are diffed: the algorithm used, and which differences in whitespace
+// are ignored when comparing lines
+type DiffOptions struct {
+	algorithm         DiffAlgorithm
+	ignoreAllSpace    bool      // Ignores all whitespace, e.g. treating `a b` the same as `ab`
+	ignoreSpaceChange bool      // Ignores changes in the amount of whitespace, and whitespace at the end of lines
+	ignoreBlankLines  bool      // Ignores changes which only insert or delete blank lines
+	textconv          *Textconv // Converts files with textconv drivers before they're diffed, unless nil
+}
+
+// Returns the form of the line compared when diffing, in which the whitespace differences being ignored are removed
+func (o DiffOptions) normalizeLine(line string) string {
+	switch {
+	case o.ignoreAllSpace:
+		return strings.Join(strings.Fields(line), "")
+	case o.ignoreSpaceChange:
+		// Leading whitespace is collapsed rather than removed, so that indenting a line is still a change
+		normalized := strings.Join(strings.Fields(line), " ")
+		if normalized != "" && unicode.IsSpace(rune(line[0])) {
+			normalized = " " + normalized
+		}
+		return normalized
+	default:
+		return line
+	}
+}
+
+// Returns whether the line is blank for the purposes of ignoring blank lines. As in Git, a line containing only
+// whitespace is only considered blank if whitespace is also being ignored.
+func (o DiffOptions) isBlankLine(line string) bool {
+	if o.ignoreAllSpace || o.ignoreSpaceChange {
+		return strings.TrimSpace(line) == ""
+	}
+	return line == "\n" || line == ""
+}
+
+func isBinaryContent(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), BINARY_DETECTION_LENGTH)], 0) != -1
+}
+
+// Computes a line-by-line diff between the old and new lines using the algorithm specified by the options, ignoring
+// any whitespace differences specified by the options. Unchanged lines are given their new version, since they may
+// still differ in whitespace.
+func diffLines(oldLines []string, newLines []string, options DiffOptions) []*DiffOp {
+	oldKeys, newKeys := oldLines, newLines
+	if options.ignoreAllSpace || options.ignoreSpaceChange {
+		oldKeys, newKeys = make([]string, len(oldLines)), make([]string, len(newLines))
+		for i, line := range oldLines {
+			oldKeys[i] = options.normalizeLine(line)
+		}
+		for i, line := range newLines {
+			newKeys[i] = options.normalizeLine(line)
+		}
+	}
+
+	ops := diffLineKeys(oldKeys, newKeys, options.algorithm)
+	for _, op := range ops {
+		if op.newLineNum != -1 {
+			op.line = newLines[op.newLineNum]
+		} else {
+			op.line = oldLines[op.oldLineNum]
+		}
+	}
+	return ops
+}
+
+// Computes a line-by-line diff between the old and new lines using the given algorithm. The runs of changed lines
+// are then shifted into the same positions as Git would choose, where there's more than one way to line them up.
+func diffLineKeys(oldLines []string, newLines []string, algorithm DiffAlgorithm) []*DiffOp {
+	marks := newLineChangeMarks(oldLines, newLines)
+	switch algorithm {
+	case DiffAlgorithmPatience:
+		marks.patienceDiff(0, len(oldLines), 0, len(newLines))
+	case DiffAlgorithmHistogram:
+		marks.histogramDiff(0, len(oldLines), 0, len(newLines))
+	default:
+		// Any common prefix and suffix are matched up directly, leaving the lines in between to be diffed (which, as
+		// in Git, is only done for Myers, since the other algorithms would change how the files are split up)
+		prefixLength := 0
+		for prefixLength < len(oldLines) && prefixLength < len(newLines) && oldLines[prefixLength] == newLines[prefixLength] {
+			prefixLength += 1
+		}
+
+		suffixLength := 0
+		for suffixLength < len(oldLines)-prefixLength && suffixLength < len(newLines)-prefixLength &&
+			oldLines[len(oldLines)-1-suffixLength] == newLines[len(newLines)-1-suffixLength] {
+			suffixLength += 1
+		}
+
+		marks.myersDiff(prefixLength, len(oldLines)-suffixLength, prefixLength, len(newLines)-suffixLength)
+	}
+
+	marks.compact()
+	return marks.toDiffOps()
+}
+
+// Myers' algorithm searches the edit graph for the furthest-reaching path on each diagonal k = x - y for
+// increasing numbers of edits d. The state of each round (the diagonals -d-1 to d+1) is saved so that the path
+// can then be recovered by backtracking from the end.
+func myersDiff(oldLines []string, newLines []string) []*DiffOp {
+	n, m := len(oldLines), len(newLines)
+	maxEdits := n + m
+	offset := maxEdits + 1
+
+	v := make([]int, 2*maxEdits+3)
+	trace := [][]int{}
+
+	for d := 0; d <= maxEdits; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // Move down (insertion)
+			} else {
+				x = v[offset+k-1] + 1 // Move right (deletion)
+			}
+			y := x - k
+
+			// Follow the diagonal as far as possible, since matching lines cost nothing
+			for x < n && y < m && oldLines[x] == newLines[y] {
+				x += 1
+				y += 1
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrackMyersDiff(oldLines, newLines, trace, d)
+			}
+		}
+	}
+
+	return []*DiffOp{}
+}
+
+func backtrackMyersDiff(oldLines []string, newLines []string, trace [][]int, numEdits int) []*DiffOp {
+	x, y := len(oldLines), len(newLines)
+	reversedOps := []*DiffOp{}
+
+	for d := numEdits; d > 0; d-- {
+		// Diagonal k is stored at index k+d+1 of the saved state for round d
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[k-1+d+1] < v[k+1+d+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+d+1]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x -= 1
+			y -= 1
+			reversedOps = append(reversedOps, &DiffOp{opType: DiffEqual, oldLineNum: x, newLineNum: y, line: oldLines[x]})
+		}
+
+		if x == prevX {
+			y -= 1
+			reversedOps = append(reversedOps, &DiffOp{opType: DiffInsert, oldLineNum: -1, newLineNum: y, line: newLines[y]})
+		} else {
+			x -= 1
+			reversedOps = append(reversedOps, &DiffOp{opType: DiffDelete, oldLineNum: x, newLineNum: -1, line: oldLines[x]})
+		}
+	}
+
+	for x > 0 && y > 0 {
+		x -= 1
+		y -= 1
+		reversedOps = append(reversedOps, &DiffOp{opType: DiffEqual, oldLineNum: x, newLineNum: y, line: oldLines[x]})
+	}
+
+	ops := make([]*DiffOp, len(reversedOps))
+	for i, op := range reversedOps {
+		ops[len(reversedOps)-1-i] = op
+	}
+	return ops
+}
+
+// Represents a hunk of a unified diff: a run of changed lines surrounded by up to DIFF_CONTEXT_LINES of unchanged
+// lines on either side
+type DiffHunk struct {
+	oldStart int // 0-indexed
+	oldCount int
+	newStart int // 0-indexed
+	newCount int
+	ops      []*DiffOp
+}
+
+const DIFF_CONTEXT_LINES = 3
+
+// Represents a run of consecutive changed lines in a diff
+type diffChangeBlock struct {
+	start     int  // Index of the first op of the block
+	end       int  // Index just past the last op of the block
+	ignorable bool // Whether the block only inserts or deletes blank lines, and blank lines are being ignored
+}
+
+// Groups the changed lines of a diff into hunks with surrounding context. Changes separated by no more than twice
+// the number of context lines are merged into a single hunk. If blank lines are being ignored, changes which only insert
+// or delete blank lines don't start a hunk of their own, but are still shown if they're close enough to another
+// change (following the same rules as Git).
+func groupDiffHunks(ops []*DiffOp, contextLines int, diffOptions DiffOptions) []*DiffHunk {
+	blocks := findDiffChangeBlocks(ops, diffOptions)
+	maxCommon, maxIgnorable := 2*contextLines, contextLines
+	hunks := []*DiffHunk{}
+
+	i := 0
+	for i < len(blocks) {
+		// Ignorable changes at the start of the hunk are dropped unless they're within the context of the next change
+		first := i
+		for j := i; j < len(blocks) && blocks[j].ignorable; j++ {
+			if j+1 == len(blocks) || blocks[j+1].start-blocks[j].end >= maxIgnorable {
+				first = j + 1
+			}
+		}
+		if first == len(blocks) {
+			break
+		}
+
+		// Ignorable changes are only kept at the end of the hunk if they're within the context of the last change
+		last := first
+		for j := first + 1; j < len(blocks); j++ {
+			distance := blocks[j].start - blocks[j-1].end
+			if distance > maxCommon {
+				break
+			}
+
+			if distance < maxIgnorable && (!blocks[j].ignorable || last == j-1) {
+				last = j
+			} else if distance < maxIgnorable {
+				continue
+			} else if last != j-1 && blocks[j].start-blocks[last].end > maxCommon {
+				break
+			} else if !blocks[j].ignorable {
+				last = j
+			}
+		}
+
+		start := blocks[first].start
+		for start > 0 && blocks[first].start-start < contextLines && ops[start-1].opType == DiffEqual {
+			start -= 1
+		}
+		end := blocks[last].end
+		for end < len(ops) && end-blocks[last].end < contextLines && ops[end].opType == DiffEqual {
+			end += 1
+		}
+
+		hunks = append(hunks, newDiffHunk(ops, start, end))
+		i = last + 1
+	}
+
+	return hunks
+}
+
+// Finds the runs of consecutive changed lines in a diff
+func findDiffChangeBlocks(ops []*DiffOp, diffOptions DiffOptions) []*diffChangeBlock {
+	blocks := []*diffChangeBlock{}
+
+	i := 0
+	for i < len(ops) {
+		if ops[i].opType == DiffEqual {
+			i += 1
+			continue
+		}
+
+		block := &diffChangeBlock{start: i, ignorable: diffOptions.ignoreBlankLines}
+		for i < len(ops) && ops[i].opType != DiffEqual {
+			block.ignorable = block.ignorable && diffOptions.isBlankLine(ops[i].line)
+			i += 1
+		}
+		block.end = i
+		blocks = append(blocks, block)
+	}
+
+	return blocks
+}
+
+func newDiffHunk(ops []*DiffOp, start int, end int) *DiffHunk {
+	hunk := &DiffHunk{ops: ops[start:end]}
+
+	// The hunk starts where the first op is positioned in each file, which for an op that's missing from a file is
+	// just after the nearest preceding line of that file
+	hunk.oldStart, hunk.newStart = 0, 0
+	for _, op := range ops[:start] {
+		if op.oldLineNum != -1 {
+			hunk.oldStart = op.oldLineNum + 1
+		}
+		if op.newLineNum != -1 {
+			hunk.newStart = op.newLineNum + 1
+		}
+	}
+
+	for _, op := range hunk.ops {
+		if op.opType != DiffInsert {
+			hunk.oldCount += 1
+		}
+		if op.opType != DiffDelete {
+			hunk.newCount += 1
+		}
+	}
+
+	return hunk
+}
+
+// Formats the hunk header, e.g. `@@ -1,3 +1,4 @@`. Line numbers are 1-indexed, except that an empty range is
+// given the number of the line just before it, and a count of 1 is omitted.
+func (h *DiffHunk) header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", formatHunkRange(h.oldStart, h.oldCount), formatHunkRange(h.newStart, h.newCount))
+}
+
+// Formats the hunk as it's shown in a unified diff: its header, followed by its lines, each prefixed with a space
+// (unchanged), + (inserted), or - (deleted)
+func (h *DiffHunk) format() string {
+	var sb strings.Builder
+	sb.WriteString(h.header() + "\n")
+	for _, op := range h.ops {
+		switch op.opType {
+		case DiffEqual:
+			sb.WriteString(" ")
+		case DiffInsert:
+			sb.WriteString("+")
+		case DiffDelete:
+			sb.WriteString("-")
+		}
+		sb.WriteString(op.line)
+		if !strings.HasSuffix(op.line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+	return sb.String()
+}
+
+func formatHunkRange(start int, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, count)
+	}
+}
+
+// Records which lines of the old and new files are changed, as computed by a diff algorithm. Unchanged lines are
+// matched up in order between the two files. Ranges of lines are given as [start, end).
+type lineChangeMarks struct {
+	oldLines   []string
+	newLines   []string
+	oldChanged []bool
+	newChanged []bool
+}
+
+func newLineChangeMarks(oldLines []string, newLines []string) *lineChangeMarks {
+	return &lineChangeMarks{
+		oldLines:   oldLines,
+		newLines:   newLines,
+		oldChanged: make([]bool, len(oldLines)),
+		newChanged: make([]bool, len(newLines)),
+	}
+}
+
+func (m *lineChangeMarks) markChanged(oldStart int, oldEnd int, newStart int, newEnd int) {
+	for i := oldStart; i < oldEnd; i++ {
+		m.oldChanged[i] = true
+	}
+	for i := newStart; i < newEnd; i++ {
+		m.newChanged[i] = true
+	}
+}
+
+// Diffs the given ranges of lines using the Myers algorithm
+func (m *lineChangeMarks) myersDiff(oldStart int, oldEnd int, newStart int, newEnd int) {
+	for _, op := range myersDiff(m.oldLines[oldStart:oldEnd], m.newLines[newStart:newEnd]) {
+		switch op.opType {
+		case DiffDelete:
+			m.oldChanged[oldStart+op.oldLineNum] = true
+		case DiffInsert:
+			m.newChanged[newStart+op.newLineNum] = true
+		}
+	}
+}
+
+// Converts the marks into diff ops. Unchanged lines of the two files are matched up in order, and within each run
+// of changed lines, the deleted lines come before the inserted ones.
+func (m *lineChangeMarks) toDiffOps() []*DiffOp {
+	ops := []*DiffOp{}
+
+	i, j := 0, 0
+	for i < len(m.oldLines) || j < len(m.newLines) {
+		switch {
+		case i < len(m.oldLines) && m.oldChanged[i]:
+			ops = append(ops, &DiffOp{opType: DiffDelete, oldLineNum: i, newLineNum: -1, line: m.oldLines[i]})
+			i += 1
+		case j < len(m.newLines) && m.newChanged[j]:
+			ops = append(ops, &DiffOp{opType: DiffInsert, oldLineNum: -1, newLineNum: j, line: m.newLines[j]})
+			j += 1
+		default:
+			ops = append(ops, &DiffOp{opType: DiffEqual, oldLineNum: i, newLineNum: j, line: m.oldLines[i]})
+			i += 1
+			j += 1
+		}
+	}
+
+	return ops
+}
+
+// Shifts each run of changed lines up or down where the lines allow it (e.g. a block inserted after a line which
+// is identical to the block's last line), as Git does: the run is first shifted as far as possible, merging with
+// any other runs it meets, and then placed as low as possible, unless it can line up with a run of changes in the
+// other file instead
+func (m *lineChangeMarks) compact() {
+	compactLineChanges(m.oldLines, m.oldChanged, m.newChanged)
+	compactLineChanges(m.newLines, m.newChanged, m.oldChanged)
+}
+
+// Represents a (possibly empty) run of changed lines, delimited by unchanged lines or the start or end of the file.
+// Since unchanged lines are matched up between the files, each run corresponds to the run in the same position in
+// the other file.
+type lineChangeGroup struct {
+	start int
+	end   int
+}
+
+func compactLineChanges(lines []string, changed []bool, otherChanged []bool) {
+	group, otherGroup := firstLineChangeGroup(changed), firstLineChangeGroup(otherChanged)
+
+	for {
+		if group.end > group.start {
+			earliestEnd, endMatchingOther := -1, -1
+			for {
+				groupSize := group.end - group.start
+				endMatchingOther = -1
+
+				for group.slideUp(lines, changed) {
+					otherGroup.previous(otherChanged)
+				}
+				earliestEnd = group.end
+				if otherGroup.end > otherGroup.start {
+					endMatchingOther = group.end
+				}
+
+				for group.slideDown(lines, changed) {
+					otherGroup.next(otherChanged)
+					if otherGroup.end > otherGroup.start {
+						endMatchingOther = group.end
+					}
+				}
+
+				// Shifting may have merged the group with others, in which case it may be able to shift further
+				if group.end-group.start == groupSize {
+					break
+				}
+			}
+
+			if group.end != earliestEnd && endMatchingOther != -1 {
+				for otherGroup.end == otherGroup.start {
+					group.slideUp(lines, changed)
+					otherGroup.previous(otherChanged)
+				}
+			}
+		}
+
+		if !group.next(changed) {
+			break
+		}
+		otherGroup.next(otherChanged)
+	}
+}
+
+func firstLineChangeGroup(changed []bool) *lineChangeGroup {
+	group := &lineChangeGroup{start: 0, end: 0}
+	for group.end < len(changed) && changed[group.end] {
+		group.end += 1
+	}
+	return group
+}
+
+// Moves to the next group, returning false if this is the last group
+func (g *lineChangeGroup) next(changed []bool) bool {
+	if g.end == len(changed) {
+		return false
+	}
+
+	g.start = g.end + 1
+	g.end = g.start
+	for g.end < len(changed) && changed[g.end] {
+		g.end += 1
+	}
+	return true
+}
+
+// Moves to the previous group, returning false if this is the first group
+func (g *lineChangeGroup) previous(changed []bool) bool {
+	if g.start == 0 {
+		return false
+	}
+
+	g.end = g.start - 1
+	g.start = g.end
+	for g.start > 0 && changed[g.start-1] {
+		g.start -= 1
+	}
+	return true
+}
+
+// Shifts the group down by a line if the line after it matches its first line, merging it with the next group if
+// they meet. Returns false if the group can't be shifted.
+func (g *lineChangeGroup) slideDown(lines []string, changed []bool) bool {
+	if g.end == len(lines) || lines[g.start] != lines[g.end] {
+		return false
+	}
+
+	changed[g.start], changed[g.end] = false, true
+	g.start += 1
+	g.end += 1
+	for g.end < len(changed) && changed[g.end] {
+		g.end += 1
+	}
+	return true
+}
+
+// Shifts the group up by a line if the line before it matches its last line, merging it with the previous group if
+// they meet. Returns false if the group can't be shifted.
+func (g *lineChangeGroup) slideUp(lines []string, changed []bool) bool {
+	if g.start == 0 || lines[g.start-1] != lines[g.end-1] {
+		return false
+	}
+
+	g.start -= 1
+	g.end -= 1
+	changed[g.start], changed[g.end] = true, false
+	for g.start > 0 && changed[g.start-1] {
+		g.start -= 1
+	}
+	return true
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type DiffAlgorithm int
+
+const (
+	DiffAlgorithmMyers DiffAlgorithm = iota
+	DiffAlgorithmMinimal
+	DiffAlgorithmPatience
+	DiffAlgorithmHistogram
+)
+
+func (a DiffAlgorithm) toString() string {
+	switch a {
+	case DiffAlgorithmMyers:
+		return "myers"
+	case DiffAlgorithmMinimal:
+		return "minimal"
+	case DiffAlgorithmPatience:
+		return "patience"
+	case DiffAlgorithmHistogram:
+		return "histogram"
+	default:
+		return "unknown"
+	}
+}
+
+// The number of times a line may occur in the old file for the histogram algorithm to use it to split up the diff.
+// If every common line occurs more often than this, the Myers algorithm is used instead (as in Git).
+const HISTOGRAM_MAX_CHAIN_LENGTH = 64
+
+// Parses the name of a diff algorithm, as given to --diff-algorithm or the diff.algorithm config variable. Since the
+// Myers implementation always finds a minimal diff, `minimal` is equivalent to `myers` (and `default`).
+func parseDiffAlgorithm(name string) (DiffAlgorithm, error) {
+	switch strings.ToLower(name) {
+	case "myers", "default":
+		return DiffAlgorithmMyers, nil
+	case "minimal":
+		return DiffAlgorithmMinimal, nil
+	case "patience":
+		return DiffAlgorithmPatience, nil
+	case "histogram":
+		return DiffAlgorithmHistogram, nil
+	default:
+		return -1, fmt.Errorf("unknown diff algorithm: %s", name)
+	}
+}
+
+// Returns the diff algorithm to use: the one named on the command line if any, or else the one named by the
+// diff.algorithm config variable, or else Myers
+func getDiffAlgorithm(name string, repoDir string) (DiffAlgorithm, error) {
+	if name == "" {
+		config, err := readConfig(repoDir)
+		if err != nil {
+			return -1, fmt.Errorf("failed to read config: %s", err)
+		}
+
+		configName, isSet := config.get("diff.algorithm")
+		if !isSet {
+			return DiffAlgorithmMyers, nil
+		}
+		name = configName
+	}
+
+	return parseDiffAlgorithm(name)
+}
+
+// Represents a line which occurs in the old file for the patience algorithm, where it's uniquely common if it occurs
+// exactly once in each file
+type patienceLine struct {
+	oldLineNum int // The line's first occurrence in the old file
+	newLineNum int // The line's last occurrence in the new file
+	oldCount   int
+	newCount   int
+	prev       *patienceLine // The previous line in the longest common sequence ending at this line
+}
+
+// Diffs the given ranges of lines using the patience algorithm, which matches up the lines occurring exactly once in
+// each range (finding the longest sequence of them that appear in the same order in both files), and then diffs the
+// lines between each of these recursively. This keeps unique lines such as function signatures lined up, rather
+// than lines such as lone braces which happen to match.
+func (m *lineChangeMarks) patienceDiff(oldStart int, oldEnd int, newStart int, newEnd int) {
+	if oldStart == oldEnd || newStart == newEnd {
+		m.markChanged(oldStart, oldEnd, newStart, newEnd)
+		return
+	}
+
+	lines := make(map[string]*patienceLine)
+	lineOrder := []*patienceLine{}
+	for i := oldStart; i < oldEnd; i++ {
+		line, exists := lines[m.oldLines[i]]
+		if !exists {
+			line = &patienceLine{oldLineNum: i}
+			lines[m.oldLines[i]] = line
+			lineOrder = append(lineOrder, line)
+		}
+		line.oldCount += 1
+	}
+
+	hasMatches := false
+	for j := newStart; j < newEnd; j++ {
+		if line, exists := lines[m.newLines[j]]; exists {
+			hasMatches = true
+			line.newLineNum = j
+			line.newCount += 1
+		}
+	}
+
+	if !hasMatches {
+		m.markChanged(oldStart, oldEnd, newStart, newEnd)
+		return
+	}
+
+	commonLines := longestCommonUniqueSequence(lineOrder)
+	if len(commonLines) == 0 {
+		m.myersDiff(oldStart, oldEnd, newStart, newEnd)
+		return
+	}
+
+	// Each uniquely common line is extended into a run of matching lines in both directions, and the lines between
+	// the runs are diffed recursively
+	for k := 0; k <= len(commonLines); k++ {
+		nextOld, nextNew := oldEnd, newEnd
+		if k < len(commonLines) {
+			nextOld, nextNew = commonLines[k].oldLineNum, commonLines[k].newLineNum
+			for nextOld > oldStart && nextNew > newStart && m.oldLines[nextOld-1] == m.newLines[nextNew-1] {
+				nextOld -= 1
+				nextNew -= 1
+			}
+		}
+		for oldStart < nextOld && newStart < nextNew && m.oldLines[oldStart] == m.newLines[newStart] {
+			oldStart += 1
+			newStart += 1
+		}
+
+		if nextOld > oldStart || nextNew > newStart {
+			m.patienceDiff(oldStart, nextOld, newStart, nextNew)
+		}
+
+		if k == len(commonLines) {
+			break
+		}
+		for k+1 < len(commonLines) && commonLines[k+1].oldLineNum == commonLines[k].oldLineNum+1 &&
+			commonLines[k+1].newLineNum == commonLines[k].newLineNum+1 {
+			k += 1
+		}
+		oldStart, newStart = commonLines[k].oldLineNum+1, commonLines[k].newLineNum+1
+	}
+}
+
+// Finds the longest sequence of uniquely common lines which appear in the same order in both files, using patience
+// sorting. The lines are given in the order they appear in the old file.
+func longestCommonUniqueSequence(lineOrder []*patienceLine) []*patienceLine {
+	// piles[i] is the line with the smallest new line number ending a common sequence of length i + 1
+	piles := []*patienceLine{}
+	for _, line := range lineOrder {
+		if line.oldCount != 1 || line.newCount != 1 {
+			continue
+		}
+
+		left, right := -1, len(piles)
+		for left+1 < right {
+			middle := left + (right-left)/2
+			if piles[middle].newLineNum > line.newLineNum {
+				right = middle
+			} else {
+				left = middle
+			}
+		}
+
+		line.prev = nil
+		if left >= 0 {
+			line.prev = piles[left]
+		}
+		if left+1 == len(piles) {
+			piles = append(piles, line)
+		} else {
+			piles[left+1] = line
+		}
+	}
+
+	if len(piles) == 0 {
+		return nil
+	}
+
+	sequence := make([]*patienceLine, len(piles))
+	line := piles[len(piles)-1]
+	for i := len(piles) - 1; i >= 0; i-- {
+		sequence[i] = line
+		line = line.prev
+	}
+	return sequence
+}
+
+// Represents a run of matching lines in the two files, for the histogram algorithm. Unlike other ranges, ends are
+// inclusive.
+type histogramRegion struct {
+	oldStart int
+	oldEnd   int
+	newStart int
+	newEnd   int
+}
+
+// Diffs the given ranges of lines using the histogram algorithm, an extension of the patience algorithm which also
+// supports lines that aren't unique. It repeatedly finds the longest run of matching lines containing the line
+// which occurs the fewest times in the old file, and then diffs the lines before and after the run.
+func (m *lineChangeMarks) histogramDiff(oldStart int, oldEnd int, newStart int, newEnd int) {
+	for {
+		if oldStart == oldEnd || newStart == newEnd {
+			m.markChanged(oldStart, oldEnd, newStart, newEnd)
+			return
+		}
+
+		region, fallBack := m.findHistogramRegion(oldStart, oldEnd, newStart, newEnd)
+		if fallBack {
+			m.myersDiff(oldStart, oldEnd, newStart, newEnd)
+			return
+		}
+		if region == nil {
+			m.markChanged(oldStart, oldEnd, newStart, newEnd)
+			return
+		}
+
+		m.histogramDiff(oldStart, region.oldStart, newStart, region.newStart)
+		oldStart, newStart = region.oldEnd+1, region.newEnd+1
+	}
+}
+
+// Finds the longest run of matching lines containing the least frequent line of the old file (following Git's
+// implementation, including its tie-breaking). Returns nil if the files have no lines in common, and whether to fall
+// back to the Myers algorithm because every common line occurs too many times.
+func (m *lineChangeMarks) findHistogramRegion(oldStart int, oldEnd int, newStart int, newEnd int) (*histogramRegion, bool) {
+	// The positions in the old file at which each line occurs, in increasing order
+	occurrences := make(map[string][]int)
+	for i := oldStart; i < oldEnd; i++ {
+		occurrences[m.oldLines[i]] = append(occurrences[m.oldLines[i]], i)
+	}
+	countAt := func(oldLineNum int) int {
+		return len(occurrences[m.oldLines[oldLineNum]])
+	}
+
+	var best *histogramRegion
+	bestLength, bestCount := 0, HISTOGRAM_MAX_CHAIN_LENGTH+1
+	hasCommon := false
+
+	for j := newStart; j < newEnd; {
+		nextJ := j + 1
+
+		lineOccurrences, exists := occurrences[m.newLines[j]]
+		if exists {
+			hasCommon = true
+		}
+		if !exists || len(lineOccurrences) > bestCount {
+			j = nextJ
+			continue
+		}
+
+		for k := 0; k < len(lineOccurrences); {
+			oldMatchStart, newMatchStart := lineOccurrences[k], j
+			oldMatchEnd, newMatchEnd := oldMatchStart, newMatchStart
+			minCount := len(lineOccurrences)
+
+			for oldMatchStart > oldStart && newMatchStart > newStart && m.oldLines[oldMatchStart-1] == m.newLines[newMatchStart-1] {
+				oldMatchStart -= 1
+				newMatchStart -= 1
+				if minCount > 1 {
+					minCount = min(minCount, countAt(oldMatchStart))
+				}
+			}
+			for oldMatchEnd+1 < oldEnd && newMatchEnd+1 < newEnd && m.oldLines[oldMatchEnd+1] == m.newLines[newMatchEnd+1] {
+				oldMatchEnd += 1
+				newMatchEnd += 1
+				if minCount > 1 {
+					minCount = min(minCount, countAt(oldMatchEnd))
+				}
+			}
+
+			// Lines of the new file within the run don't need to be tried again
+			if nextJ <= newMatchEnd {
+				nextJ = newMatchEnd + 1
+			}
+
+			if bestLength < oldMatchEnd-oldMatchStart || minCount < bestCount {
+				best = &histogramRegion{oldStart: oldMatchStart, oldEnd: oldMatchEnd, newStart: newMatchStart, newEnd: newMatchEnd}
+				bestLength, bestCount = oldMatchEnd-oldMatchStart, minCount
+			}
+
+			// Skip over the other occurrences of the line within the run
+			for k < len(lineOccurrences) && lineOccurrences[k] <= oldMatchEnd {
+				k += 1
+			}
+		}
+
+		j = nextJ
+	}
+
+	if hasCommon && bestCount > HISTOGRAM_MAX_CHAIN_LENGTH {
+		return nil, true
+	}
+	return best, false
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The length to which object hashes are abbreviated in diff output
+const DIFF_ABBREV_HASH_LENGTH = 7
+
+// Represents a version of a file on one side of a diff. Working tree files are read from disk rather than from the
+// object database, since their contents haven't necessarily been stored as blobs.
+type DiffFileVersion struct {
+	hash          string
+	mode          FileMode
+	inWorkingTree bool
+}
+
+// Represents a file which differs between the two sides of a diff. oldFile is nil for an added file, and newFile
+// is nil for a deleted file.
+type DiffFileChange struct {
+	path    string
+	oldFile *DiffFileVersion
+	newFile *DiffFileVersion
+}
+
+// Represents the number of lines inserted and deleted in a single changed file. Binary files have no line counts, but
+// have the sizes of their old and new versions instead.
+type DiffFileStat struct {
+	path       string
+	insertions int
+	deletions  int
+	binary     bool
+	oldSize    int
+	newSize    int
+}
+
+// Represents the size of a set of changes, e.g. for CI tooling that tracks how large each change is
+type DiffSummary struct {
+	files      []*DiffFileStat
+	insertions int
+	deletions  int
+}
+
+// Determines the files that differ between the index and the working tree or, if cached is set, between HEAD (or the
+// given commit, if not empty) and the index
+func GetDiffChanges(cached bool, commitHash string, repoDir string) ([]*DiffFileChange, error) {
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Git index file: %s", err)
+	}
+	indexFiles := getIndexDiffFiles(index)
+
+	if cached {
+		var commitFiles map[string]*DiffFileVersion
+		if commitHash != "" {
+			commitFiles, err = getCommitDiffFiles(commitHash, repoDir)
+		} else {
+			commitFiles, err = getHeadDiffFiles(repoDir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return diffFileSets(commitFiles, indexFiles), nil
+	}
+
+	workingTreeFiles, err := getWorkingTreeDiffFiles(index, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	return diffFileSets(indexFiles, workingTreeFiles), nil
+}
+
+// Computes the number of lines inserted and deleted for the same set of changes shown by GetDiffChanges
+func GetDiffSummary(cached bool, commitHash string, diffOptions DiffOptions, repoDir string) (*DiffSummary, error) {
+	changes, err := GetDiffChanges(cached, commitHash, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return summarizeDiffChanges(changes, diffOptions, repoDir)
+}
+
+func summarizeDiffChanges(changes []*DiffFileChange, diffOptions DiffOptions, repoDir string) (*DiffSummary, error) {
+	summary := &DiffSummary{files: []*DiffFileStat{}}
+
+	for _, change := range changes {
+		oldContent, newContent, err := change.readContents(diffOptions.textconv, repoDir)
+		if err != nil {
+			return nil, err
+		}
+
+		fileStat := &DiffFileStat{path: change.path}
+		if isBinaryContent(oldContent) || isBinaryContent(newContent) {
+			fileStat.binary = true
+			fileStat.oldSize, fileStat.newSize = len(oldContent), len(newContent)
+		} else {
+			hunks, err := change.diffContentHunks(oldContent, newContent, diffOptions, repoDir)
+			if err != nil {
+				return nil, err
+			}
+			if len(hunks) == 0 && change.onlyContentChanged() {
+				continue
+			}
+
+			for _, hunk := range hunks {
+				for _, op := range hunk.ops {
+					switch op.opType {
+					case DiffInsert:
+						fileStat.insertions += 1
+					case DiffDelete:
+						fileStat.deletions += 1
+					}
+				}
+			}
+		}
+
+		summary.files = append(summary.files, fileStat)
+		summary.insertions += fileStat.insertions
+		summary.deletions += fileStat.deletions
+	}
+
+	return summary, nil
+}
+
+// Formats the summary as a single line such as ` 2 files changed, 3 insertions(+), 1 deletion(-)`. As in Git, a
+// zero count of insertions or deletions is omitted unless both are zero.
+func (s *DiffSummary) shortStat() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, " %d %s changed", len(s.files), pluralize(len(s.files), "file", "files"))
+	if s.insertions > 0 || s.deletions == 0 {
+		fmt.Fprintf(&sb, ", %d %s(+)", s.insertions, pluralize(s.insertions, "insertion", "insertions"))
+	}
+	if s.deletions > 0 || s.insertions == 0 {
+		fmt.Fprintf(&sb, ", %d %s(-)", s.deletions, pluralize(s.deletions, "deletion", "deletions"))
+	}
+	return sb.String()
+}
+
+// Formats the summary with one line per file, consisting of the tab-separated insertion count, deletion count, and
+// path ("-" is shown for both counts of a binary file). If nulTerminated is set, each line is terminated by a NUL
+// byte rather than a newline, so that paths don't need to be quoted.
+func (s *DiffSummary) numStat(nulTerminated bool) string {
+	terminator := "\n"
+	if nulTerminated {
+		terminator = "\x00"
+	}
+
+	var sb strings.Builder
+	for _, fileStat := range s.files {
+		if fileStat.binary {
+			fmt.Fprintf(&sb, "-\t-\t%s%s", fileStat.path, terminator)
+		} else {
+			fmt.Fprintf(&sb, "%d\t%d\t%s%s", fileStat.insertions, fileStat.deletions, fileStat.path, terminator)
+		}
+	}
+	return sb.String()
+}
+
+// Formats the summary as a diffstat, as shown by log --stat: a line for each file with its path, its number of changed
+// lines, and a graph of its insertions (+) and deletions (-), followed by the --shortstat line. As in Git, the output
+// fits within the given width, by scaling the graphs down and abbreviating long paths with ... if needed. A binary
+// file is shown with its old and new sizes instead, e.g. `Bin 0 -> 3 bytes`.
+func (s *DiffSummary) stat(width int) string {
+	nameWidth, numberWidth, binaryWidth, maxChange := 0, 0, 0, 0
+	for _, fileStat := range s.files {
+		nameWidth = max(nameWidth, utf8.RuneCountInString(fileStat.path))
+		if fileStat.binary {
+			// e.g. `Bin 0 -> 3 bytes`, of which the part after "Bin" must fit in the graph
+			binaryWidth = max(binaryWidth, 14+len(strconv.Itoa(fileStat.oldSize))+len(strconv.Itoa(fileStat.newSize)))
+			numberWidth = 3
+			continue
+		}
+		maxChange = max(maxChange, fileStat.insertions+fileStat.deletions)
+	}
+	numberWidth = max(numberWidth, len(strconv.Itoa(maxChange)))
+
+	// The graphs and paths are narrowed to fit, leaving at least 3/8 of the width for the graphs
+	width = max(width, 16+6+numberWidth)
+	graphWidth := maxChange
+	if maxChange+4 <= binaryWidth {
+		graphWidth = binaryWidth - 4
+	}
+	if nameWidth+numberWidth+6+graphWidth > width {
+		if graphWidth > width*3/8-numberWidth-6 {
+			graphWidth = max(width*3/8-numberWidth-6, 6)
+		}
+		if nameWidth > width-numberWidth-6-graphWidth {
+			nameWidth = width - numberWidth - 6 - graphWidth
+		} else {
+			graphWidth = width - numberWidth - 6 - nameWidth
+		}
+	}
+
+	var sb strings.Builder
+	for _, fileStat := range s.files {
+		name, prefix := []rune(fileStat.path), ""
+		if len(name) > nameWidth {
+			// The start of a long path is cut off, at a directory boundary if possible
+			prefix = "..."
+			name = name[len(name)-max(nameWidth-3, 0):]
+			if slash := slices.Index(name, '/'); slash >= 0 {
+				name = name[slash:]
+			}
+		}
+		padding := strings.Repeat(" ", max(nameWidth-len(prefix)-len(name), 0))
+		fmt.Fprintf(&sb, " %s%s%s | ", prefix, string(name), padding)
+
+		if fileStat.binary {
+			fmt.Fprintf(&sb, "%*s %d -> %d bytes\n", numberWidth, "Bin", fileStat.oldSize, fileStat.newSize)
+			continue
+		}
+
+		insertions, deletions := fileStat.insertions, fileStat.deletions
+		fmt.Fprintf(&sb, "%*d", numberWidth, insertions+deletions)
+		if graphWidth < maxChange {
+			insertions, deletions = scaleDiffStat(insertions, deletions, graphWidth, maxChange)
+		}
+		if insertions+deletions > 0 {
+			fmt.Fprintf(&sb, " %s%s", strings.Repeat("+", insertions), strings.Repeat("-", deletions))
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString(s.shortStat() + "\n")
+	return sb.String()
+}
+
+// Scales a file's counts of insertions and deletions down to a graph of the given width, where maxChange is the
+// largest number of changed lines in any file. As in Git, every nonzero count is shown by at least one character.
+func scaleDiffStat(insertions int, deletions int, graphWidth int, maxChange int) (int, int) {
+	scale := func(count int) int {
+		if count == 0 {
+			return 0
+		}
+		return 1 + count*(graphWidth-1)/maxChange
+	}
+
+	total := scale(insertions + deletions)
+	if total < 2 && insertions > 0 && deletions > 0 {
+		total = 2
+	}
+	if insertions < deletions {
+		insertions = scale(insertions)
+		return insertions, total - insertions
+	}
+	deletions = scale(deletions)
+	return total - deletions, deletions
+}
+
+func pluralize(count int, singular string, plural string) string {
+	if count == 1 {
+		return singular
+	}
+	return plural
+}
+
+// Formats the change as a unified diff in Git's extended format. A change which is left with no hunks once the
+// whitespace differences being ignored are removed is omitted entirely (an empty string is returned).
+func (c *DiffFileChange) formatPatch(diffOptions DiffOptions, repoDir string) (string, error) {
+	oldContent, newContent, err := c.readContents(diffOptions.textconv, repoDir)
+	if err != nil {
+		return "", err
+	}
+
+	isBinary := isBinaryContent(oldContent) || isBinaryContent(newContent)
+	hunks := []*DiffHunk{}
+	if !isBinary {
+		hunks, err = c.diffContentHunks(oldContent, newContent, diffOptions, repoDir)
+		if err != nil {
+			return "", err
+		}
+		if len(hunks) == 0 && c.onlyContentChanged() {
+			return "", nil
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "diff --git a/%s b/%s\n", c.path, c.path)
+
+	oldHash, newHash := strings.Repeat("0", DIFF_ABBREV_HASH_LENGTH), strings.Repeat("0", DIFF_ABBREV_HASH_LENGTH)
+	if c.oldFile != nil {
+		oldHash = c.oldFile.hash[:DIFF_ABBREV_HASH_LENGTH]
+	}
+	if c.newFile != nil {
+		newHash = c.newFile.hash[:DIFF_ABBREV_HASH_LENGTH]
+	}
+
+	switch {
+	case c.oldFile == nil:
+		fmt.Fprintf(&sb, "new file mode %s\n", c.newFile.mode.toPaddedString())
+		fmt.Fprintf(&sb, "index %s..%s\n", oldHash, newHash)
+	case c.newFile == nil:
+		fmt.Fprintf(&sb, "deleted file mode %s\n", c.oldFile.mode.toPaddedString())
+		fmt.Fprintf(&sb, "index %s..%s\n", oldHash, newHash)
+	case c.oldFile.mode != c.newFile.mode:
+		fmt.Fprintf(&sb, "old mode %s\n", c.oldFile.mode.toPaddedString())
+		fmt.Fprintf(&sb, "new mode %s\n", c.newFile.mode.toPaddedString())
+		if oldHash != newHash {
+			fmt.Fprintf(&sb, "index %s..%s\n", oldHash, newHash)
+		}
+	default:
+		fmt.Fprintf(&sb, "index %s..%s %s\n", oldHash, newHash, c.newFile.mode.toPaddedString())
+	}
+
+	// A change to only the file mode has no content diff
+	if c.oldFile != nil && c.newFile != nil && c.oldFile.hash == c.newFile.hash {
+		return sb.String(), nil
+	}
+
+	oldName, newName := "a/"+c.path, "b/"+c.path
+	if c.oldFile == nil {
+		oldName = "/dev/null"
+	}
+	if c.newFile == nil {
+		newName = "/dev/null"
+	}
+
+	if isBinary {
+		fmt.Fprintf(&sb, "Binary files %s and %s differ\n", oldName, newName)
+		return sb.String(), nil
+	}
+
+	fmt.Fprintf(&sb, "--- %s\n", oldName)
+	fmt.Fprintf(&sb, "+++ %s\n", newName)
+
+	for _, hunk := range hunks {
+		sb.WriteString(hunk.format())
+	}
+
+	return sb.String(), nil
+}
+
+// Colors a patch formatted by formatPatch as Git does: the header of each file's diff in bold, hunk headers in cyan,
+// deleted lines in red, and inserted lines in green. Lines are classified by whether they come before or after the
+// first hunk header of a file, since a deleted or inserted line may itself look like e.g. a `--- a/file` header.
+func colorPatch(patch string, colorizer Colorizer) string {
+	if !colorizer.enabled {
+		return patch
+	}
+
+	var sb strings.Builder
+	inHunk := false
+	for _, line := range strings.SplitAfter(patch, "\n") {
+		text := strings.TrimSuffix(line, "\n")
+		color := ""
+		switch {
+		case strings.HasPrefix(text, "diff --git "):
+			inHunk, color = false, COLOR_BOLD
+		case strings.HasPrefix(text, "@@ "):
+			inHunk, color = true, COLOR_CYAN
+		case !inHunk:
+			color = COLOR_BOLD
+		case strings.HasPrefix(text, "-"):
+			color = COLOR_RED
+		case strings.HasPrefix(text, "+"):
+			color = COLOR_GREEN
+		}
+
+		if color == "" {
+			sb.WriteString(line)
+			continue
+		}
+		sb.WriteString(colorizer.wrap(text, color))
+		sb.WriteString(line[len(text):])
+	}
+	return sb.String()
+}
+
+func (c *DiffFileChange) diffContentHunks(oldContent []byte, newContent []byte, diffOptions DiffOptions, repoDir string) ([]*DiffHunk, error) {
+	oldLines, err := c.oldFile.splitContentLines(c.path, oldContent, diffOptions.textconv, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	newLines, err := c.newFile.splitContentLines(c.path, newContent, diffOptions.textconv, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := diffLines(oldLines, newLines, diffOptions)
+	return groupDiffHunks(ops, DIFF_CONTEXT_LINES, diffOptions), nil
+}
+
+// Splits the content read for this version of the file into lines. The lines of a blob are shared through the blob
+// line cache, unless its content was converted by a textconv driver.
+func (v *DiffFileVersion) splitContentLines(path string, content []byte, textconv *Textconv, repoDir string) ([]string, error) {
+	if v == nil || v.inWorkingTree || v.mode == GITLINK_MODE {
+		return splitLines(content), nil
+	}
+
+	if textconv != nil {
+		driver, err := textconv.getDriver(path)
+		if err != nil {
+			return nil, err
+		} else if driver != nil {
+			return splitLines(content), nil
+		}
+	}
+
+	return getBlobLines(v.hash, content, repoDir)
+}
+
+// Summarizes a change which creates or deletes a file or changes its mode, as Git's --summary does (e.g.
+// ` mode change 100644 => 100755 run.sh`), or returns an empty string for a change to only a file's content
+func (c *DiffFileChange) summaryLine() string {
+	switch {
+	case c.oldFile == nil:
+		return fmt.Sprintf(" create mode %s %s", c.newFile.mode.toPaddedString(), c.path)
+	case c.newFile == nil:
+		return fmt.Sprintf(" delete mode %s %s", c.oldFile.mode.toPaddedString(), c.path)
+	case c.oldFile.mode != c.newFile.mode:
+		return fmt.Sprintf(" mode change %s => %s %s", c.oldFile.mode.toPaddedString(), c.newFile.mode.toPaddedString(), c.path)
+	default:
+		return ""
+	}
+}
+
+// Returns whether the change is to the content of a file which exists on both sides with the same mode
+func (c *DiffFileChange) onlyContentChanged() bool {
+	return c.oldFile != nil && c.newFile != nil && c.oldFile.mode == c.newFile.mode
+}
+
+// Reads the contents of both versions of the file, converted with the file's textconv driver if textconv is set
+func (c *DiffFileChange) readContents(textconv *Textconv, repoDir string) ([]byte, []byte, error) {
+	oldContent, err := c.oldFile.readConvertedContent(c.path, textconv, repoDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newContent, err := c.newFile.readConvertedContent(c.path, textconv, repoDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return oldContent, newContent, nil
+}
+
+func (v *DiffFileVersion) readConvertedContent(path string, textconv *Textconv, repoDir string) ([]byte, error) {
+	content, err := v.readContent(path, repoDir)
+	if err != nil || textconv == nil || v == nil || v.mode == GITLINK_MODE {
+		return content, err
+	}
+
+	// Working tree files aren't stored as blobs, so their conversions can't be cached
+	blobHash := v.hash
+	if v.inWorkingTree {
+		blobHash = ""
+	}
+	return textconv.convert(path, content, blobHash)
+}
+
+// Reads the content of this version of the file, which is empty if the file doesn't exist on this side of the diff
+func (v *DiffFileVersion) readContent(path string, repoDir string) ([]byte, error) {
+	if v == nil {
+		return []byte{}, nil
+	}
+
+	// A submodule is shown as the commit recorded for it, as in Git
+	if v.mode == GITLINK_MODE {
+		return []byte(fmt.Sprintf("Subproject commit %s\n", v.hash)), nil
+	}
+
+	// As in Git, a working tree file is compared as it would be stored, after its clean filter and line ending conversion
+	if v.inWorkingTree {
+		converter, err := newContentConverter(repoDir)
+		if err != nil {
+			return nil, err
+		}
+		content, err := readWorkingTreeFile(filepath.Join(repoDir, path), converter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %s", path, err)
+		}
+		return content, nil
+	}
+
+	blobObj, err := ReadBlobObjectFile(v.hash, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob object %s for file %s: %s", v.hash, path, err)
+	}
+	return blobObj.content, nil
+}
+
+// Returns the files which were added, deleted, or changed (in content or mode) from the old set to the new set
+func diffFileSets(oldFiles map[string]*DiffFileVersion, newFiles map[string]*DiffFileVersion) []*DiffFileChange {
+	changes := []*DiffFileChange{}
+
+	for path, oldFile := range oldFiles {
+		newFile, exists := newFiles[path]
+		if !exists {
+			changes = append(changes, &DiffFileChange{path: path, oldFile: oldFile, newFile: nil})
+		} else if oldFile.hash != newFile.hash || oldFile.mode != newFile.mode {
+			changes = append(changes, &DiffFileChange{path: path, oldFile: oldFile, newFile: newFile})
+		}
+	}
+
+	for path, newFile := range newFiles {
+		if _, exists := oldFiles[path]; !exists {
+			changes = append(changes, &DiffFileChange{path: path, oldFile: nil, newFile: newFile})
+		}
+	}
+
+	sort.Slice(changes, func(i int, j int) bool {
+		return changes[i].path < changes[j].path
+	})
+
+	return changes
+}
+
+func getHeadDiffFiles(repoDir string) (map[string]*DiffFileVersion, error) {
+	headFiles := make(map[string]*DiffFileVersion)
+
+	headCommitHash, commitsExist, err := ResolveHead("", repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve HEAD reference: %s", err)
+	}
+	if !commitsExist {
+		return headFiles, nil
+	}
+
+	headCommitObj, err := ReadCommitObjectFile(headCommitHash, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HEAD commit object file: %s", err)
+	}
+
+	err = populateTreeDiffFiles(headFiles, headCommitObj.treeHash, "", repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read files in HEAD tree: %s", err)
+	}
+
+	return headFiles, nil
+}
+
+func populateTreeDiffFiles(files map[string]*DiffFileVersion, treeHash string, pathPrefix string, repoDir string) error {
+	treeObj, err := ReadTreeObjectFile(treeHash, repoDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range treeObj.entries {
+		path := entry.name
+		if pathPrefix != "" {
+			path = pathPrefix + "/" + entry.name
+		}
+
+		if entry.objType == Tree {
+			if err := populateTreeDiffFiles(files, entry.hash, path, repoDir); err != nil {
+				return err
+			}
+		} else {
+			files[path] = &DiffFileVersion{hash: entry.hash, mode: entry.mode}
+		}
+	}
+
+	return nil
+}
+
+func getIndexDiffFiles(index *Index) map[string]*DiffFileVersion {
+	indexFiles := make(map[string]*DiffFileVersion, len(index.entries))
+	for _, entry := range index.entries {
+		indexFiles[entry.path] = &DiffFileVersion{
+			hash: hex.EncodeToString(entry.sha1[:]),
+			mode: entry.mode,
+		}
+	}
+	return indexFiles
+}
+
+// Returns the working tree versions of the files tracked in the index. Untracked files are never part of a diff.
+func getWorkingTreeDiffFiles(index *Index, repoDir string) (map[string]*DiffFileVersion, error) {
+	workingTreeFiles := make(map[string]*DiffFileVersion, len(index.entries))
+	indexModTime := getIndexModTime(repoDir)
+	trustExecutableBit, err := getTrustExecutableBit(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range index.entries {
+		// Files excluded from the working tree by a sparse checkout are treated as unchanged
+		if entry.isSkipWorktree() {
+			workingTreeFiles[entry.path] = &DiffFileVersion{
+				hash: hex.EncodeToString(entry.sha1[:]),
+				mode: entry.mode,
+			}
+			continue
+		}
+
+		_, err := os.Lstat(filepath.Join(repoDir, entry.path))
+		if err != nil && os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to stat file %s: %s", entry.path, err)
+		}
+
+		workingTreeFile, _, err := getWorkingTreeFileVersion(entry.path, entry, indexModTime, trustExecutableBit, converter, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		workingTreeFiles[entry.path] = workingTreeFile
+	}
+
+	return workingTreeFiles, nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type DoctorCheckState int
+
+const (
+	DoctorOK DoctorCheckState = iota
+	DoctorWarning
+	DoctorError
+)
+
+func (s DoctorCheckState) toString() string {
+	switch s {
+	case DoctorOK:
+		return "ok"
+	case DoctorWarning:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// The maximum number of problem objects or refs named in a check's details
+const DOCTOR_MAX_LISTED_PROBLEMS = 5
+
+// Represents the outcome of one diagnostic check of a repository, along with a suggested fix if it found a problem
+type DoctorCheck struct {
+	name    string
+	state   DoctorCheckState
+	details string
+	fix     string
+}
+
+func (c *DoctorCheck) fail(state DoctorCheckState, details string, fix string) *DoctorCheck {
+	c.state, c.details, c.fix = state, details, fix
+	return c
+}
+
+// Runs a battery of checks on the repository, diagnosing the problems most likely to make commands fail: an
+// unreadable config or index, a broken HEAD, refs which can't be resolved, missing or corrupt objects, stale lock
+// files, and an unset user identity. Unless checkRemote is unset, the default remote is also contacted to check that
+// it's reachable. Returns the outcome of each check, in the order they were made.
+func RunDoctor(checkRemote bool, repoDir string) []*DoctorCheck {
+	checks := []*DoctorCheck{
+		checkDoctorConfig(repoDir),
+		checkDoctorHead(repoDir),
+		checkDoctorRefs(repoDir),
+		checkDoctorObjects(repoDir),
+		checkDoctorIndex(repoDir),
+		checkDoctorLocks(repoDir),
+		checkDoctorIdentity(repoDir),
+	}
+	if checkRemote {
+		checks = append(checks, checkDoctorRemote(repoDir))
+	}
+	return checks
+}
+
+func checkDoctorConfig(repoDir string) *DoctorCheck {
+	check := &DoctorCheck{name: "config", state: DoctorOK}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return check.fail(DoctorError, err.Error(), "fix the syntax of the config file named in the error, or remove the offending lines")
+	}
+
+	formatVersion, err := config.getInt("core.repositoryformatversion", 0)
+	if err != nil || formatVersion > 1 {
+		return check.fail(DoctorError, "unsupported core.repositoryFormatVersion", "this repository was created by a newer version of Git, which mygit can't read")
+	}
+
+	check.details = fmt.Sprintf("repository format version %d", formatVersion)
+	return check
+}
+
+// Checks that HEAD points to a valid branch name, or (if detached) to a commit which can be read
+func checkDoctorHead(repoDir string) *DoctorCheck {
+	check := &DoctorCheck{name: "HEAD", state: DoctorOK}
+	setHeadFix := "point HEAD at an existing branch with `./run.sh symbolic-ref HEAD refs/heads/<branch>`"
+
+	headValue, exists, err := readRefValue("HEAD", repoDir)
+	if err != nil {
+		return check.fail(DoctorError, err.Error(), setHeadFix)
+	}
+	if !exists {
+		return check.fail(DoctorError, "HEAD is missing", setHeadFix)
+	}
+
+	targetRefName, isSymbolic := strings.CutPrefix(headValue, SYMBOLIC_REF_PREFIX)
+	if !isSymbolic {
+		if !isValidObjectHash(headValue) {
+			return check.fail(DoctorError, fmt.Sprintf("HEAD contains neither a ref nor an object hash: %s", headValue), setHeadFix)
+		}
+		if objType, err := getObjectType(headValue, repoDir); err != nil || objType != Commit {
+			return check.fail(DoctorError, fmt.Sprintf("HEAD is detached at %s, which isn't a readable commit", headValue), setHeadFix+", "+getMissingObjectsFix())
+		}
+		check.details = fmt.Sprintf("detached at %s", abbreviateHash(headValue))
+		return check
+	}
+
+	if err := validateRefName(targetRefName); err != nil || !strings.HasPrefix(targetRefName, "refs/heads/") {
+		return check.fail(DoctorError, fmt.Sprintf("HEAD points to %s, which isn't a valid branch name", targetRefName), setHeadFix)
+	}
+	branchName := strings.TrimPrefix(targetRefName, "refs/heads/")
+
+	headHash, commitsExist, err := resolveRef(targetRefName, repoDir)
+	if err != nil {
+		return check.fail(DoctorError, err.Error(), setHeadFix)
+	}
+	if !commitsExist {
+		// A new repository is on a branch with no commits yet, which is fine unless other branches do exist
+		branchNames, err := ListBranches("", repoDir)
+		if err == nil && len(branchNames) > 0 {
+			return check.fail(DoctorWarning, fmt.Sprintf("HEAD points to branch %s, which doesn't exist", branchName), fmt.Sprintf("check out an existing branch, e.g. `./run.sh checkout %s`", branchNames[0]))
+		}
+		check.details = fmt.Sprintf("on branch %s, with no commits yet", branchName)
+		return check
+	}
+
+	if objType, err := getObjectType(headHash, repoDir); err != nil || objType != Commit {
+		return check.fail(DoctorError, fmt.Sprintf("branch %s points to %s, which isn't a readable commit", branchName, headHash), getMissingObjectsFix())
+	}
+
+	check.details = fmt.Sprintf("on branch %s at %s", branchName, abbreviateHash(headHash))
+	return check
+}
+
+// Checks that every loose and packed ref has a valid name and resolves to an object which can be read
+func checkDoctorRefs(repoDir string) *DoctorCheck {
+	check := &DoctorCheck{name: "refs", state: DoctorOK}
+
+	refNames, err := listRefNames(repoDir)
+	if err != nil {
+		return check.fail(DoctorError, err.Error(), "remove or repair the invalid lines in .git/packed-refs")
+	}
+
+	invalidRefs, danglingRefs, unreadableRefs := []string{}, []string{}, []string{}
+	for _, refName := range refNames {
+		if err := validateRefName(refName); err != nil {
+			invalidRefs = append(invalidRefs, refName)
+			continue
+		}
+
+		refHash, exists, err := resolveRef(refName, repoDir)
+		if err != nil || !exists {
+			danglingRefs = append(danglingRefs, refName)
+		} else if _, err := getObjectType(refHash, repoDir); err != nil {
+			unreadableRefs = append(unreadableRefs, refName)
+		}
+	}
+
+	switch {
+	case len(invalidRefs) > 0:
+		return check.fail(DoctorError, "invalid ref names: "+listDoctorProblems(invalidRefs), "rename or remove the ref files under .git/refs/ with these names")
+	case len(unreadableRefs) > 0:
+		return check.fail(DoctorError, "objects pointed to by these refs can't be read: "+listDoctorProblems(unreadableRefs), getMissingObjectsFix()+", or remove the refs with `./run.sh update-ref -d <ref>`")
+	case len(danglingRefs) > 0:
+		return check.fail(DoctorWarning, "symbolic refs pointing to refs which don't exist: "+listDoctorProblems(danglingRefs), "remove the symbolic ref files under .git/, or fetch the refs they point to")
+	}
+
+	check.details = fmt.Sprintf("%d %s", len(refNames), pluralize(len(refNames), "ref", "refs"))
+	return check
+}
+
+// Checks that every loose object file is named after the hash of its contents and can be decompressed and parsed, and
+// that there are no packfiles, whose objects can't be read
+func checkDoctorObjects(repoDir string) *DoctorCheck {
+	check := &DoctorCheck{name: "objects", state: DoctorOK}
+	objectsDir := filepath.Join(getCommonDir(repoDir), "objects")
+
+	numObjects := 0
+	corruptObjects := []string{}
+	err := filepath.WalkDir(objectsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(objectsDir, path)
+		if err != nil {
+			return err
+		}
+		dirName, fileName, isObjectFile := strings.Cut(filepath.ToSlash(relPath), "/")
+		if d.IsDir() {
+			// Only the fan-out directories named after the first two hex digits of object hashes hold loose objects
+			if relPath != "." && (len(dirName) != 2 || !isValidObjectHash(dirName+strings.Repeat("0", 38))) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isObjectFile {
+			return nil
+		}
+
+		objHash := dirName + fileName
+		numObjects += 1
+		if !isValidObjectHash(objHash) || verifyLooseObject(objHash, repoDir) != nil {
+			corruptObjects = append(corruptObjects, objHash)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return check.fail(DoctorError, fmt.Sprintf("failed to read the object store: %s", err), "check the permissions of .git/objects/")
+	}
+
+	if len(corruptObjects) > 0 {
+		return check.fail(DoctorError, "corrupt object files: "+listDoctorProblems(corruptObjects), "restore the objects from another clone of the repository (copying their files into .git/objects/), or clone it again")
+	}
+
+	packPaths, _ := filepath.Glob(filepath.Join(objectsDir, "pack", "*.pack"))
+	if len(packPaths) > 0 {
+		return check.fail(DoctorWarning, fmt.Sprintf("%d loose %s, and %d %s whose objects mygit can't read", numObjects, pluralize(numObjects, "object", "objects"), len(packPaths), pluralize(len(packPaths), "packfile", "packfiles")), "unpack them into loose objects with `./run.sh migrate-from-git`")
+	}
+
+	check.details = fmt.Sprintf("%d loose %s", numObjects, pluralize(numObjects, "object", "objects"))
+	return check
+}
+
+// Reads the whole of a loose object, checking that its contents match its hash
+func verifyLooseObject(objHash string, repoDir string) error {
+	objType, size, reader, err := openObjectFile(objHash, repoDir)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if len(content) != size {
+		return fmt.Errorf("object %s has size %d, but its header says %d", objHash, len(content), size)
+	}
+	if actualHash, _ := hashObject(objType, content); actualHash != objHash {
+		return fmt.Errorf("object %s has hash %s", objHash, actualHash)
+	}
+	return nil
+}
+
+func checkDoctorIndex(repoDir string) *DoctorCheck {
+	check := &DoctorCheck{name: "index", state: DoctorOK}
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return check.fail(DoctorError, err.Error(), "rebuild the index from HEAD with `./run.sh reset` (changes staged since the last commit will need to be added again)")
+	}
+
+	unmergedPaths, missingPaths := []string{}, []string{}
+	for _, entry := range index.entries {
+		if entry.stage() != 0 {
+			if len(unmergedPaths) == 0 || unmergedPaths[len(unmergedPaths)-1] != entry.path {
+				unmergedPaths = append(unmergedPaths, entry.path)
+			}
+		} else if entry.mode != GITLINK_MODE && !objectExists(hex.EncodeToString(entry.sha1[:]), repoDir) {
+			missingPaths = append(missingPaths, entry.path)
+		}
+	}
+
+	if len(missingPaths) > 0 {
+		return check.fail(DoctorError, "the objects staged for these files are missing: "+listDoctorProblems(missingPaths), "stage the files again with `./run.sh add <file>`")
+	}
+	if len(unmergedPaths) > 0 {
+		return check.fail(DoctorWarning, "unmerged files: "+listDoctorProblems(unmergedPaths), "resolve the merge conflicts, then mark them resolved with `./run.sh add <file>`")
+	}
+
+	check.details = fmt.Sprintf("version %d, %d %s", index.version, len(index.entries), pluralize(len(index.entries), "entry", "entries"))
+	return check
+}
+
+// Checks for lock files left behind by a process which crashed while holding them, which make later commands fail
+// until they're removed. Lock files recorded as owned by a process which is no longer running are removed
+// automatically (see cleanUpAfterCrashes), so any which remain may belong to a process which is still running.
+func checkDoctorLocks(repoDir string) *DoctorCheck {
+	check := &DoctorCheck{name: "locks", state: DoctorOK}
+	gitDir := getGitDir(repoDir)
+
+	lockPaths := []string{}
+	filepath.WalkDir(gitDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && path == filepath.Join(gitDir, "objects") {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && strings.HasSuffix(path, LOCK_FILE_SUFFIX) {
+			relPath, _ := filepath.Rel(gitDir, path)
+			lockPaths = append(lockPaths, filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+
+	if len(lockPaths) > 0 {
+		return check.fail(DoctorWarning, "lock files exist: "+listDoctorProblems(lockPaths), "if no other mygit or Git process is running in this repository, remove the lock files from .git/")
+	}
+
+	check.details = "no lock files"
+	return check
+}
+
+// Checks that the user's name and email are configured, rather than guessed from the system's user account
+func checkDoctorIdentity(repoDir string) *DoctorCheck {
+	check := &DoctorCheck{name: "identity", state: DoctorOK}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return check.fail(DoctorError, err.Error(), "fix the config file named in the error")
+	}
+	commitUser, err := getCommitUser(CommitAuthor, repoDir)
+	if err != nil {
+		return check.fail(DoctorError, err.Error(), "set GIT_AUTHOR_NAME, GIT_AUTHOR_EMAIL, and GIT_AUTHOR_DATE correctly, or unset them")
+	}
+
+	unsetNames, fixes := []string{}, []string{}
+	for _, variable := range [][]string{{"name", `"Your Name"`}, {"email", "you@example.com"}} {
+		_, isConfigured := config.get("user." + variable[0])
+		_, isSetInEnv := os.LookupEnv("GIT_AUTHOR_" + strings.ToUpper(variable[0]))
+		if !isConfigured && !isSetInEnv {
+			unsetNames = append(unsetNames, "user."+variable[0])
+			fixes = append(fixes, fmt.Sprintf("`git config --global user.%s %s`", variable[0], variable[1]))
+		}
+	}
+	if len(unsetNames) > 0 {
+		details := fmt.Sprintf("%s not set, so commits will be made as %s <%s>", strings.Join(unsetNames, " and "), commitUser.name, commitUser.email)
+		return check.fail(DoctorWarning, details, "set your identity with "+strings.Join(fixes, " and "))
+	}
+
+	check.details = fmt.Sprintf("%s <%s>", commitUser.name, commitUser.email)
+	return check
+}
+
+// Checks that the default remote is configured and can be reached with the credentials from the environment
+func checkDoctorRemote(repoDir string) *DoctorCheck {
+	check := &DoctorCheck{name: "remote", state: DoctorOK}
+
+	remoteNames, err := getRemoteNames(repoDir)
+	if err != nil {
+		return check.fail(DoctorError, err.Error(), "fix the config file named in the error")
+	}
+	if len(remoteNames) == 0 {
+		check.details = "no remotes configured"
+		return check
+	}
+
+	repoURL, err := resolveRemoteURL("", repoDir)
+	if err != nil {
+		return check.fail(DoctorWarning, err.Error(), fmt.Sprintf("pass the remote to pull and push explicitly, e.g. `./run.sh pull %s`", remoteNames[0]))
+	}
+
+	if err := loadHTTPSettings(repoDir); err != nil {
+		return check.fail(DoctorError, err.Error(), "fix the http.* config variables")
+	}
+	remoteRefs, err := refDiscovery(repoURL)
+	if err != nil {
+		return check.fail(DoctorError, fmt.Sprintf("%s is unreachable: %s", repoURL, err), "check the remote's URL, your network connection, and your credentials for it")
+	}
+
+	check.details = fmt.Sprintf("%s is reachable, with %d %s", repoURL, len(remoteRefs.refs), pluralize(len(remoteRefs.refs), "ref", "refs"))
+	return check
+}
+
+func getMissingObjectsFix() string {
+	return "if the repository was created by real Git, unpack its objects with `./run.sh migrate-from-git`; otherwise, clone it again"
+}
+
+// Joins the names of the problem objects or refs, listing only the first few of a long list
+func listDoctorProblems(names []string) string {
+	if len(names) <= DOCTOR_MAX_LISTED_PROBLEMS {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s, and %d more", strings.Join(names[:DOCTOR_MAX_LISTED_PROBLEMS], ", "), len(names)-DOCTOR_MAX_LISTED_PROBLEMS)
+}
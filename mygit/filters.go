@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Represents the direction in which a filter driver converts the content of a file
+type FilterDirection int
+
+const (
+	FilterClean  FilterDirection = iota // From the working tree into a blob, when the file is staged or hashed
+	FilterSmudge                        // From a blob into the working tree, when the file is checked out
+)
+
+func (d FilterDirection) toString() string {
+	switch d {
+	case FilterClean:
+		return "clean"
+	case FilterSmudge:
+		return "smudge"
+	default:
+		return "unknown"
+	}
+}
+
+// Represents a filter driver, configured by the filter.<driver>.clean and filter.<driver>.smudge config variables and
+// given to paths by the `filter=<driver>` attribute. Each command reads the file's content on its standard input and
+// writes the converted content to its standard output, e.g. to expand keywords on checkout and collapse them again
+// when the file is staged, or to store a large file elsewhere and commit only a pointer to it.
+type FilterDriver struct {
+	name     string
+	clean    string
+	smudge   string
+	required bool // Whether a missing or failing command is an error, rather than the content passing through as it is
+}
+
+func (d *FilterDriver) getCommand(direction FilterDirection) string {
+	if direction == FilterClean {
+		return d.clean
+	}
+	return d.smudge
+}
+
+// Returns the filter driver for the given path, or nil if it doesn't have one
+func (c *ContentConverter) getFilterDriver(path string) (*FilterDriver, error) {
+	driverName, isSpecified := c.attributes.get(path, "filter")
+	if !isSpecified || driverName == ATTRIBUTE_SET || driverName == ATTRIBUTE_UNSET {
+		return nil, nil
+	}
+
+	clean, _ := c.config.get(fmt.Sprintf("filter.%s.clean", driverName))
+	smudge, _ := c.config.get(fmt.Sprintf("filter.%s.smudge", driverName))
+	required, err := c.config.getBool(fmt.Sprintf("filter.%s.required", driverName), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FilterDriver{name: driverName, clean: clean, smudge: smudge, required: required}, nil
+}
+
+// Runs the file's filter driver in the given direction on its content, returning the content unchanged if the file
+// doesn't have a filter driver or the driver has no command for that direction. As in Git, if the command fails, the
+// content passes through unchanged (with an error reported), unless the driver is required.
+func (c *ContentConverter) runFilter(path string, content []byte, direction FilterDirection) ([]byte, error) {
+	driver, err := c.getFilterDriver(path)
+	if err != nil || driver == nil {
+		return content, err
+	}
+
+	command := driver.getCommand(direction)
+	if command == "" {
+		if driver.required {
+			return nil, fmt.Errorf("%s: %s filter '%s' failed", path, direction.toString(), driver.name)
+		}
+		return content, nil
+	}
+
+	filtered, err := runFilterCommand(command, path, content, c.repoDir)
+	if err == nil {
+		return filtered, nil
+	}
+	if driver.required {
+		return nil, fmt.Errorf("%s: %s filter '%s' failed: %s", path, direction.toString(), driver.name, err)
+	}
+	fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	return content, nil
+}
+
+// Runs a filter command in the shell from the top level of the working tree, with the content on its standard input.
+// As in Git, any %f in the command is replaced by the path of the file (passed safely as a shell argument, however
+// it's named). Returns the command's output.
+func runFilterCommand(command string, path string, content []byte, repoDir string) ([]byte, error) {
+	script := strings.ReplaceAll(command, "%f", `"$1"`)
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", script, command, path)
+	cmd.Dir = repoDir
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("external filter '%s' failed %d", command, exitErr.ExitCode())
+	} else if err != nil {
+		return nil, fmt.Errorf("external filter '%s' failed: %s", command, err)
+	}
+
+	return stdout.Bytes(), nil
+}
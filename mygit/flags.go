@@ -1,5 +1,50 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"os"
+	"strings"
+)
 
 var CopyRunSh = flag.Bool("copy-run-sh", true, "Copy the mygit run.sh script into the root of repositories as soon as they are cloned")
+
+var NoPager = flag.Bool("no-pager", false, "Don't pipe the output of the command into a pager")
+
+var TraceJSON = flag.String("trace-json", os.Getenv("GIT_TRACE_JSON"), "Write a JSON event log of the command to the given file descriptor or path")
+
+// Collects the values of a flag which may be given several times, e.g. commit-tree's -p
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Splits each argument which bundles several of the given single-letter boolean flags (e.g. -sn for -s -n) into
+// separate arguments, which the flag package doesn't do, so that they can be given together as in Git. Arguments
+// after -- are left as they are.
+func splitBundledFlags(args []string, letters string) []string {
+	splitArgs := []string{}
+	for i, arg := range args {
+		if arg == "--" {
+			return append(splitArgs, args[i:]...)
+		}
+
+		bundled := len(arg) > 2 && arg[0] == '-' && arg[1] != '-'
+		for i := 1; bundled && i < len(arg); i++ {
+			bundled = strings.IndexByte(letters, arg[i]) >= 0
+		}
+		if !bundled {
+			splitArgs = append(splitArgs, arg)
+			continue
+		}
+		for _, letter := range arg[1:] {
+			splitArgs = append(splitArgs, "-"+string(letter))
+		}
+	}
+	return splitArgs
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The format used by for-each-ref when none is given, as in Git
+const DEFAULT_FOR_EACH_REF_FORMAT = "%(objectname) %(objecttype)\t%(refname)"
+
+// The fields which may be interpolated into a for-each-ref format as %(<field>) or %(<field>:short)
+var FOR_EACH_REF_FIELDS = []string{"refname", "objectname", "objecttype", "symref", "upstream", "HEAD"}
+
+// Represents a ref listed by for-each-ref, along with the ref it points to if it's a symbolic ref
+type ListedRef struct {
+	name         string // The full ref name, e.g. refs/heads/main
+	hash         string
+	symrefTarget string
+}
+
+type ForEachRefOptions struct {
+	format   string
+	patterns []string // Only refs matching one of these are listed, unless it's empty
+	count    int      // The maximum number of refs to list, or 0 for no limit
+}
+
+// Represents a piece of a parsed for-each-ref format: either literal text, or a field to be interpolated
+type RefFormatPart struct {
+	literal string
+	field   string
+	short   bool
+}
+
+// Formats each ref under refs/ which matches the given patterns, in sorted order, according to the format. Together
+// with update-ref --stdin, this allows the state of a repository's refs to be exported and later restored, e.g. with
+// a format of `update %(refname) %(objectname)`.
+func ForEachRef(options ForEachRefOptions, repoDir string) ([]string, error) {
+	formatParts, err := parseRefFormat(options.format)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := listRefs(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// HEAD may be detached, in which case no branch is current
+	currBranch, _ := getCurrentBranch(repoDir)
+
+	lines := []string{}
+	for _, ref := range refs {
+		if !matchesRefPatterns(ref.name, options.patterns) {
+			continue
+		}
+		if options.count > 0 && len(lines) == options.count {
+			break
+		}
+
+		line, err := formatRef(ref, formatParts, currBranch, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// Parses a for-each-ref format, in which %(<field>) interpolates a field of each ref, %% is a literal %, and %xx is
+// the byte with the hex value xx (e.g. %00 for a NUL byte)
+func parseRefFormat(format string) ([]*RefFormatPart, error) {
+	parts := []*RefFormatPart{}
+	var literal strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+
+		rest := format[i+1:]
+		if strings.HasPrefix(rest, "%") {
+			literal.WriteByte('%')
+			i += 1
+			continue
+		}
+		if len(rest) >= 2 {
+			if value, err := strconv.ParseUint(rest[:2], 16, 8); err == nil {
+				literal.WriteByte(byte(value))
+				i += 2
+				continue
+			}
+		}
+		if !strings.HasPrefix(rest, "(") {
+			literal.WriteByte('%')
+			continue
+		}
+
+		end := strings.IndexByte(rest, ')')
+		if end == -1 {
+			return nil, fmt.Errorf("malformed format string %s", format)
+		}
+		field, modifier, hasModifier := strings.Cut(rest[1:end], ":")
+		if !slices.Contains(FOR_EACH_REF_FIELDS, field) || (hasModifier && modifier != "short") {
+			return nil, fmt.Errorf("unknown field name: %s", rest[1:end])
+		}
+
+		if literal.Len() > 0 {
+			parts = append(parts, &RefFormatPart{literal: literal.String()})
+			literal.Reset()
+		}
+		parts = append(parts, &RefFormatPart{field: field, short: hasModifier})
+		i += end + 1
+	}
+
+	if literal.Len() > 0 {
+		parts = append(parts, &RefFormatPart{literal: literal.String()})
+	}
+	return parts, nil
+}
+
+func formatRef(ref *ListedRef, formatParts []*RefFormatPart, currBranch string, repoDir string) (string, error) {
+	var sb strings.Builder
+	for _, part := range formatParts {
+		if part.field == "" {
+			sb.WriteString(part.literal)
+			continue
+		}
+
+		value := ""
+		switch part.field {
+		case "refname":
+			value = formatRefName(ref.name, part.short)
+		case "objectname":
+			value = ref.hash
+			if part.short {
+				value = abbreviateHash(ref.hash)
+			}
+		case "objecttype":
+			objType, err := getObjectType(ref.hash, repoDir)
+			if err != nil {
+				return "", fmt.Errorf("failed to read object %s pointed to by %s: %s", ref.hash, ref.name, err)
+			}
+			value = objType.toString()
+		case "symref":
+			if ref.symrefTarget != "" {
+				value = formatRefName(ref.symrefTarget, part.short)
+			}
+		case "upstream":
+			if branchName, isBranch := strings.CutPrefix(ref.name, "refs/heads/"); isBranch {
+				upstream, err := getBranchUpstream(branchName, repoDir)
+				if err != nil {
+					return "", err
+				}
+				if upstream != nil {
+					value = formatRefName(getBranchRefName(upstream.branch, upstream.remote), part.short)
+				}
+			}
+		case "HEAD":
+			value = " "
+			if currBranch != "" && ref.name == getBranchRefName(currBranch, "") {
+				value = "*"
+			}
+		}
+		sb.WriteString(value)
+	}
+
+	return sb.String(), nil
+}
+
+// Returns the full ref name, or, if short is set, the name without its refs/heads/, refs/tags/, or refs/remotes/
+// prefix (or refs/ for any other ref)
+func formatRefName(refName string, short bool) string {
+	if !short {
+		return refName
+	}
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/", "refs/"} {
+		if shortName, found := strings.CutPrefix(refName, prefix); found {
+			return shortName
+		}
+	}
+	return refName
+}
+
+// Returns whether the ref matches any of the patterns (or there are no patterns). As in Git, a pattern matches a ref
+// if it's the ref's full name or a prefix of it ending at a /, e.g. refs/heads matches every branch, or if it matches
+// the full name as a glob, e.g. refs/tags/v1.*.
+func matchesRefPatterns(refName string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		prefix := strings.TrimSuffix(pattern, "/")
+		if refName == prefix || strings.HasPrefix(refName, prefix+"/") {
+			return true
+		}
+		if matched, _ := path.Match(pattern, refName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns every ref under refs/, loose or packed, in sorted order. Symbolic refs (e.g. refs/remotes/origin/HEAD) are
+// resolved to the object that they ultimately point to, and any which point to a ref that doesn't exist are skipped.
+func listRefs(repoDir string) ([]*ListedRef, error) {
+	refNames, err := listRefNames(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []*ListedRef{}
+	for _, refName := range refNames {
+		symrefTarget, _, err := ReadSymbolicRef(refName, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		refHash, exists, err := resolveRef(refName, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		refs = append(refs, &ListedRef{name: refName, hash: refHash, symrefTarget: symrefTarget})
+	}
+
+	return refs, nil
+}
+
+// Returns the names of every ref under refs/, loose (including symbolic refs) or packed, in sorted order
+func listRefNames(repoDir string) ([]string, error) {
+	packedRefs, err := readPackedRefs(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	refNamesSet := make(map[string]bool)
+	for refName := range packedRefs {
+		refNamesSet[refName] = true
+	}
+
+	// A linked worktree's per-worktree refs are in its own Git directory, and the ones in the common directory belong
+	// to the main working tree
+	gitDir, commonDir := getGitDir(repoDir), getCommonDir(repoDir)
+	for _, refsRoot := range slices.Compact([]string{commonDir, gitDir}) {
+		err = filepath.WalkDir(filepath.Join(refsRoot, "refs"), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() || strings.HasSuffix(path, LOCK_FILE_SUFFIX) {
+				return nil
+			}
+
+			refName, err := filepath.Rel(refsRoot, path)
+			if err != nil {
+				return err
+			}
+			refName = filepath.ToSlash(refName)
+			if getRefPath(refName, repoDir) == path {
+				refNamesSet[refName] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read loose refs: %s", err)
+		}
+	}
+
+	refNames := make([]string, 0, len(refNamesSet))
+	for refName := range refNamesSet {
+		refNames = append(refNames, refName)
+	}
+	sort.Strings(refNames)
+	return refNames, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRefListingIsDeterministic(t *testing.T) {
+	repoDir := newTestRepo(t)
+	firstHash, lastHash := createTestHistory(t, repoDir)
+
+	// Some refs are loose and some packed, and both kinds are listed together
+	for i := range 10 {
+		if err := UpdateBranchRef(fmt.Sprintf("branch%d", i), firstHash, "", repoDir); err != nil {
+			t.Fatalf("failed to create branch: %s", err)
+		}
+		if err := UpdateRef(fmt.Sprintf("refs/tags/v%d", i), lastHash, "", repoDir); err != nil {
+			t.Fatalf("failed to create tag: %s", err)
+		}
+	}
+	if _, err := PackRefs(false, repoDir); err != nil {
+		t.Fatalf("failed to pack refs: %s", err)
+	}
+	for i := range 10 {
+		if err := UpdateBranchRef(fmt.Sprintf("feature/%d", i), lastHash, "origin", repoDir); err != nil {
+			t.Fatalf("failed to create remote-tracking branch: %s", err)
+		}
+	}
+
+	var firstOutput string
+	var firstBranches []string
+	for range DETERMINISM_TEST_RUNS {
+		lines, err := ForEachRef(ForEachRefOptions{format: DEFAULT_FOR_EACH_REF_FORMAT}, repoDir)
+		if err != nil {
+			t.Fatalf("failed to list refs: %s", err)
+		}
+		output := strings.Join(lines, "\n")
+		branches, err := ListBranches("origin", repoDir)
+		if err != nil {
+			t.Fatalf("failed to list remote-tracking branches: %s", err)
+		}
+
+		if firstBranches == nil {
+			firstOutput, firstBranches = output, branches
+			continue
+		}
+		if output != firstOutput {
+			t.Fatalf("for-each-ref listed\n%s\nand before\n%s", output, firstOutput)
+		}
+		if !slices.Equal(branches, firstBranches) {
+			t.Fatalf("remote-tracking branches were listed as %v, and before as %v", branches, firstBranches)
+		}
+	}
+
+	refNames := []string{}
+	for _, line := range strings.Split(firstOutput, "\n") {
+		_, refName, _ := strings.Cut(line, "\t")
+		refNames = append(refNames, refName)
+	}
+	if !slices.IsSorted(refNames) || len(refNames) != 30 {
+		t.Errorf("for-each-ref listed %v, expected the 30 refs in sorted order", refNames)
+	}
+	if !slices.IsSorted(firstBranches) || len(firstBranches) != 10 {
+		t.Errorf("remote-tracking branches were listed as %v, expected the 10 branches in sorted order", firstBranches)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// The line which starts each email written by format-patch, as in Git. The hash is that of the commit, while the date
+// is fixed, so that the line can be recognized as the start of a patch rather than of a real email.
+const FORMAT_PATCH_FROM_LINE = "From %s Mon Sep 17 00:00:00 2001\n"
+
+// The width at which the headers of a patch email are wrapped, and of its diffstat
+const (
+	MAIL_HEADER_WIDTH         = 78
+	MAIL_ENCODED_HEADER_WIDTH = 76
+	MAIL_STAT_WIDTH           = 72
+)
+
+// The maximum length of the name of a patch file, including its .patch suffix
+const PATCH_FILE_NAME_MAX = 64
+
+// The signature at the end of each patch email, unless the format.signature config variable sets another
+const DEFAULT_PATCH_SIGNATURE = "mygit"
+
+// Represents the options for writing commits as patch emails
+type FormatPatchOptions struct {
+	outputDir string // The directory to write the patch files into
+	stdout    bool   // Prints the patches as a single mailbox rather than writing them into files
+	numbered  bool   // Numbers the patches' subjects, e.g. [PATCH 1/2], even if there's only one
+	maxCount  int    // The number of commits to write, from the most recent, or -1 for all of them
+}
+
+// Writes each commit in the given history (walked from the start commits, leaving out the excluded commits) as an
+// email containing the commit's message and the patch of its changes, as git format-patch does, so that the commits
+// can be sent by email and applied elsewhere with am. The patches are written oldest first, each into a file named
+// after its number and subject (e.g. 0001-Fix-the-parser.patch), and their paths are printed. Merge commits, and
+// commits which change nothing, are left out, since they have no single patch to apply.
+func FormatPatch(startHashes []string, excluded map[string]bool, options FormatPatchOptions, repoDir string) error {
+	walker, err := newCommitWalker(startHashes, excluded, false, repoDir)
+	if err != nil {
+		return err
+	}
+
+	commits := []*CommitObject{}
+	for options.maxCount < 0 || len(commits) < options.maxCount {
+		commitObj, err := walker.next()
+		if err != nil {
+			return err
+		}
+		if commitObj == nil {
+			break
+		}
+		if len(commitObj.parentCommitHashes) > 1 {
+			continue
+		}
+		commits = append(commits, commitObj)
+	}
+	slices.Reverse(commits)
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+	signature, exists := config.get("format.signature")
+	if !exists {
+		signature = DEFAULT_PATCH_SIGNATURE
+	}
+	algorithm, err := getDiffAlgorithm("", repoDir)
+	if err != nil {
+		return err
+	}
+	diffOptions := DiffOptions{algorithm: algorithm}
+
+	patches := []*PatchEmail{}
+	for _, commitObj := range commits {
+		patch, err := newPatchEmail(commitObj, diffOptions, repoDir)
+		if err != nil {
+			return err
+		}
+		if patch != nil {
+			patches = append(patches, patch)
+		}
+	}
+
+	if !options.stdout && options.outputDir != "" {
+		if err := os.MkdirAll(options.outputDir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory %s: %s", options.outputDir, err)
+		}
+	}
+
+	numbered := options.numbered || len(patches) > 1
+	for i, patch := range patches {
+		subjectPrefix := "[PATCH]"
+		if numbered {
+			subjectPrefix = fmt.Sprintf("[PATCH %d/%d]", i+1, len(patches))
+		}
+		email := patch.format(subjectPrefix, signature)
+
+		if options.stdout {
+			fmt.Print(email)
+			continue
+		}
+		fileName := filepath.Join(options.outputDir, getPatchFileName(i+1, patch.subject))
+		if err := os.WriteFile(fileName, []byte(email), 0644); err != nil {
+			return fmt.Errorf("failed to write patch file %s: %s", fileName, err)
+		}
+		fmt.Println(fileName)
+	}
+	return nil
+}
+
+// Represents a commit to be written as a patch email
+type PatchEmail struct {
+	commitObj *CommitObject
+	subject   string // The first paragraph of the commit's message, joined into one line
+	body      string // The rest of the commit's message
+	stat      string // The diffstat of the commit's changes, followed by a summary of created and deleted files
+	diff      string
+}
+
+// Prepares the commit to be written as a patch email, returning nil if it changes nothing
+func newPatchEmail(commitObj *CommitObject, diffOptions DiffOptions, repoDir string) (*PatchEmail, error) {
+	changes, err := getCommitChanges(commitObj, false, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	var diff strings.Builder
+	for _, change := range changes {
+		patch, err := change.formatPatch(diffOptions, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff %s: %s", change.path, err)
+		}
+		diff.WriteString(patch)
+	}
+
+	summary, err := summarizeDiffChanges(changes, diffOptions, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	var stat strings.Builder
+	stat.WriteString(summary.stat(MAIL_STAT_WIDTH))
+	for _, change := range changes {
+		if summaryLine := change.summaryLine(); summaryLine != "" {
+			stat.WriteString(summaryLine + "\n")
+		}
+	}
+
+	// As in Git, the subject is the message's first paragraph, in case it was wrapped over several lines
+	message := strings.TrimSpace(commitObj.commitMessage)
+	subjectParagraph, body, _ := strings.Cut(message, "\n\n")
+	subject := strings.Join(strings.Fields(strings.ReplaceAll(subjectParagraph, "\n", " ")), " ")
+	body = strings.TrimLeft(body, "\n")
+	if body != "" {
+		body += "\n"
+	}
+
+	return &PatchEmail{
+		commitObj: commitObj,
+		subject:   subject,
+		body:      body,
+		stat:      stat.String(),
+		diff:      diff.String(),
+	}, nil
+}
+
+// Formats the patch as an email in the same format as Git: headers giving the commit's author and date, and its
+// subject after the given prefix, followed by the rest of the message, a --- line, the diffstat, the diff, and the
+// signature. Headers containing non-ASCII characters are encoded as RFC 2047 encoded words, and headers declaring
+// the message's charset are added if its subject or body does.
+func (p *PatchEmail) format(subjectPrefix string, signature string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, FORMAT_PATCH_FROM_LINE, p.commitObj.hash)
+
+	author := p.commitObj.author
+	fromHeader := "From: "
+	fromHeader += formatMailName(author.name, len(fromHeader))
+	fmt.Fprintf(&sb, "%s <%s>\n", fromHeader, author.email)
+	fmt.Fprintf(&sb, "Date: %s\n", author.formatDate(DateFormatRFC))
+
+	subjectHeader := "Subject: " + subjectPrefix + " "
+	if isASCII(p.subject) {
+		subjectHeader += wrapMailHeader(p.subject, len(subjectHeader))
+	} else {
+		subjectHeader += encodeMailHeader(p.subject, len(subjectHeader), false)
+	}
+	sb.WriteString(subjectHeader + "\n")
+
+	if !isASCII(p.subject) || !isASCII(p.body) {
+		sb.WriteString("MIME-Version: 1.0\n")
+		sb.WriteString("Content-Type: text/plain; charset=UTF-8\n")
+		sb.WriteString("Content-Transfer-Encoding: 8bit\n")
+	}
+
+	sb.WriteString("\n")
+	sb.WriteString(p.body)
+	sb.WriteString("---\n")
+	sb.WriteString(p.stat)
+	sb.WriteString("\n")
+	sb.WriteString(p.diff)
+	fmt.Fprintf(&sb, "-- \n%s\n\n", signature)
+	return sb.String()
+}
+
+// Returns the name of the file for the numbered patch with the given subject, e.g. 0001-Fix-the-parser.patch. As in
+// Git, each run of characters other than letters, digits, dots, and underscores in the subject is replaced with a
+// single dash (and runs of dots with a single dot), and the name is truncated to PATCH_FILE_NAME_MAX characters.
+func getPatchFileName(number int, subject string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%04d-", number)
+
+	separated := false
+	for i := 0; i < len(subject); i++ {
+		c := subject[i]
+		isTitleChar := c == '.' || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isTitleChar {
+			separated = true
+			continue
+		}
+		if separated && !strings.HasSuffix(sb.String(), "-") {
+			sb.WriteByte('-')
+		}
+		separated = false
+		sb.WriteByte(c)
+		for c == '.' && i+1 < len(subject) && subject[i+1] == '.' {
+			i++
+		}
+	}
+
+	const suffix = ".patch"
+	name := strings.TrimRight(sb.String(), ".-")
+	if maxLength := PATCH_FILE_NAME_MAX - len(suffix) - 1; len(name) > maxLength {
+		name = name[:maxLength]
+	}
+	return name + suffix
+}
+
+// Formats a name for an email's From header, as Git does: encoded (see encodeMailHeader) if it contains non-ASCII
+// characters, and otherwise quoted if it contains characters which aren't allowed in an unquoted name (e.g. a comma)
+func formatMailName(name string, headerLength int) string {
+	if !isASCII(name) {
+		return encodeMailHeader(name, headerLength, true)
+	}
+
+	for _, c := range name {
+		if !isMailAtomChar(c) && c != ' ' {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+		}
+	}
+	return name
+}
+
+// Returns whether the character may appear in an unquoted word of an email address header (an atom, in RFC 822)
+func isMailAtomChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", c)
+}
+
+// Wraps a header's value at spaces so that no line is longer than MAIL_HEADER_WIDTH, continuing it on lines indented
+// by a space, given the length of the header's line before the value
+func wrapMailHeader(value string, headerLength int) string {
+	var sb strings.Builder
+	column := headerLength
+	for i, word := range strings.Split(value, " ") {
+		wordWidth := utf8.RuneCountInString(word)
+		if i > 0 {
+			if column+1+wordWidth > MAIL_HEADER_WIDTH {
+				sb.WriteString("\n")
+				column = 0
+			}
+			sb.WriteString(" ")
+			column += 1
+		}
+		sb.WriteString(word)
+		column += wordWidth
+	}
+	return sb.String()
+}
+
+// Encodes a header's value as RFC 2047 encoded words in UTF-8, with each character other than printable ASCII (and,
+// in an address's name, any character with a special meaning in addresses) encoded as =XX for each of its bytes.
+// As in Git, the encoded words are split onto lines indented by a space so that no line is longer than
+// MAIL_ENCODED_HEADER_WIDTH, given the length of the header's line before the value.
+func encodeMailHeader(value string, headerLength int, isAddress bool) string {
+	const prefix, suffix = "=?UTF-8?q?", "?="
+
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	lineLength := headerLength + len(prefix)
+	for _, c := range value {
+		encoded := string(c)
+		if isSpecialMailHeaderChar(c, isAddress) {
+			encoded = ""
+			for _, b := range []byte(string(c)) {
+				encoded += fmt.Sprintf("=%02X", b)
+			}
+		}
+
+		if lineLength+len(encoded)+len(suffix) > MAIL_ENCODED_HEADER_WIDTH {
+			sb.WriteString(suffix + "\n " + prefix)
+			lineLength = 1 + len(prefix)
+		}
+		sb.WriteString(encoded)
+		lineLength += len(encoded)
+	}
+	sb.WriteString(suffix)
+	return sb.String()
+}
+
+// Returns whether the character must be encoded in an RFC 2047 encoded word
+func isSpecialMailHeaderChar(c rune, isAddress bool) bool {
+	if c >= utf8.RuneSelf || c <= ' ' || c == 0x7f || c == '=' || c == '?' || c == '_' {
+		return true
+	}
+	return isAddress && !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune("!*+-/", c))
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Returns the directory containing the repository's hooks: the core.hooksPath config variable (relative to the top
+// level of the working tree), or else the hooks directory of the Git directory
+func getHooksDir(repoDir string) (string, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config: %s", err)
+	}
+
+	if hooksPath, isSet := config.get("core.hooksPath"); isSet {
+		hooksPath, err := expandConfigPath(hooksPath)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(hooksPath) {
+			hooksPath = filepath.Join(repoDir, hooksPath)
+		}
+		return hooksPath, nil
+	}
+
+	return filepath.Join(getCommonDir(repoDir), "hooks"), nil
+}
+
+// Runs the named hook, if the repository has one, with the given arguments and standard input. Hooks are run from the
+// top level of the working tree, with their output shown on standard error, as in Git. A hook which exists but isn't
+// executable is skipped with a hint. Returns an error if the hook fails, i.e. exits with a non-zero status.
+func runHook(name string, args []string, stdin string, repoDir string) error {
+	hooksDir, err := getHooksDir(repoDir)
+	if err != nil {
+		return err
+	}
+
+	hookPath := filepath.Join(hooksDir, name)
+	info, err := os.Stat(hookPath)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+	if info.Mode()&0111 == 0 {
+		fmt.Fprintf(os.Stderr, "hint: The '%s' hook was ignored because it's not set as executable.\n", hookPath)
+		return nil
+	}
+
+	cmd := exec.Command(hookPath, args...)
+	cmd.Dir = repoDir
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("%s hook exited with status %d", name, exitErr.ExitCode())
+	} else if err != nil {
+		return fmt.Errorf("failed to run %s hook: %s", name, err)
+	}
+
+	return nil
+}
+
+// Runs the commit-msg hook on the given commit message, which is passed to the hook in the COMMIT_EDITMSG file of the
+// Git directory. The hook may edit the message, so the message is read back afterwards.
+func runCommitMsgHook(commitMessage string, repoDir string) (string, error) {
+	// The message is terminated by a newline in the file, so that lines the hook appends (e.g. trailers) start
+	// on a line of their own
+	fileMessage := commitMessage
+	if !strings.HasSuffix(fileMessage, "\n") {
+		fileMessage += "\n"
+	}
+
+	commitEditMsgPath := filepath.Join(getGitDir(repoDir), "COMMIT_EDITMSG")
+	if err := os.WriteFile(commitEditMsgPath, []byte(fileMessage), 0644); err != nil {
+		return "", fmt.Errorf("failed to write commit message: %s", err)
+	}
+
+	if err := runHook("commit-msg", []string{commitEditMsgPath}, "", repoDir); err != nil {
+		return "", err
+	}
+
+	editedMessage, err := os.ReadFile(commitEditMsgPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read commit message: %s", err)
+	}
+	if string(editedMessage) == fileMessage {
+		return commitMessage, nil
+	}
+	return string(editedMessage), nil
+}
+
+// Runs the post-checkout hook after HEAD has moved from prevHead (the null hash if there was no previous commit, e.g.
+// after a clone) to newHead. branchCheckout indicates whether a branch was checked out, rather than files.
+func runPostCheckoutHook(prevHead string, newHead string, branchCheckout bool, repoDir string) error {
+	if prevHead == "" {
+		prevHead = NULL_OBJECT_HASH
+	}
+
+	flag := "0"
+	if branchCheckout {
+		flag = "1"
+	}
+	return runHook("post-checkout", []string{prevHead, newHead, flag}, "", repoDir)
+}
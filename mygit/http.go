@@ -2,48 +2,310 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
-func makeHTTPRequest(method string, url string, body bytes.Buffer, expectedStatusCodes []int) ([]byte, error) {
-	username := os.Getenv("GIT_USERNAME")
-	if username == "" {
-		return nil, fmt.Errorf("GIT_USERNAME environment variable not set")
+// Returns the Content-Type with which a smart HTTP server responds to ref discovery for the given service
+// (git-upload-pack or git-receive-pack)
+func getAdvertisementContentType(service string) string {
+	return "application/x-" + service + "-advertisement"
+}
+
+// Returns the Content-Type with which a smart HTTP server responds to a request to the given service
+func getResultContentType(service string) string {
+	return "application/x-" + service + "-result"
+}
+
+// Returns the Content-Type of a request to the given service, which Git servers require
+func getRequestContentType(service string) string {
+	return "application/x-" + service + "-request"
+}
+
+// Represents the body of an HTTP request, which can be opened more than once, so that the request can be sent again
+// when it's redirected, retried, or made again with credentials
+type HTTPRequestBody struct {
+	open     func() io.ReadCloser
+	mu       sync.Mutex
+	writeErr error // The error with which writing a streamed body last failed, if it did
+}
+
+func newBufferedRequestBody(body []byte) *HTTPRequestBody {
+	return &HTTPRequestBody{open: func() io.ReadCloser {
+		return io.NopCloser(bytes.NewReader(body))
+	}}
+}
+
+// Returns a request body which is written by the given function as it's sent (e.g. a packfile being pushed), rather
+// than being held in memory. It's written again each time it's sent.
+func newStreamedRequestBody(write func(w io.Writer) error) *HTTPRequestBody {
+	body := &HTTPRequestBody{}
+	body.open = func() io.ReadCloser {
+		pr, pw := io.Pipe()
+		go func() {
+			writer := &PipeBodyWriter{writer: pw}
+			err := write(writer)
+			// Writing fails once the request stops reading the body (because it failed, or the server responded
+			// early), in which case the request's own error is reported instead
+			if err != nil && !writer.closed {
+				body.mu.Lock()
+				body.writeErr = err
+				body.mu.Unlock()
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr
+	}
+	return body
+}
+
+// Returns the error with which writing the body failed, which caused the request to fail
+func (b *HTTPRequestBody) writeError() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.writeErr
+}
+
+// Opens the body to be sent, along with its length. As in Git, up to http.postBuffer bytes of it are read ahead: a
+// body which fits is sent with its length, as every server supports, and only a larger one is sent as it's written,
+// with chunked transfer encoding (and a length of -1).
+func (b *HTTPRequestBody) openForRequest(postBuffer int) (io.ReadCloser, int64, error) {
+	reader := b.open()
+	buffered, err := io.ReadAll(io.LimitReader(reader, int64(postBuffer)+1))
+	if err != nil {
+		reader.Close()
+		return nil, -1, err
+	}
+	if len(buffered) <= postBuffer {
+		reader.Close()
+		return io.NopCloser(bytes.NewReader(buffered)), int64(len(buffered)), nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buffered), reader), reader}, -1, nil
+}
+
+// Writes a streamed request body into its pipe, noting whether the request has stopped reading it
+type PipeBodyWriter struct {
+	writer *io.PipeWriter
+	closed bool
+}
+
+func (w *PipeBodyWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if err != nil {
+		w.closed = true
 	}
+	return n, err
+}
 
-	token := os.Getenv("GIT_TOKEN")
-	if token == "" {
-		return nil, fmt.Errorf("GIT_TOKEN environment variable not set. Please create a personal access token at https://github.com/settings/tokens")
+// Reads a response body for the function handling it, noting whether the connection failed partway through it, as
+// opposed to the body being invalid
+type HTTPResponseReader struct {
+	reader  io.Reader
+	readErr error
+}
+
+func (r *HTTPResponseReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.readErr = err
 	}
+	return n, err
+}
 
-	req, err := http.NewRequest(method, url, &body)
+// Makes an HTTP request to a Git server, handing the response body to readResponse as it's received (so that a large
+// packfile can be unpacked as it arrives, without being held in memory), and returning the URL the response was
+// received from (which differs from the URL requested if the request was redirected). The body may be nil for a
+// request without one. As in Git, the request is first made without credentials, so that public repositories can be
+// used without any, and only if the server responds with 401 Unauthorized is it made again with the credential for
+// its URL (see getCredential), which is then sent with every later request to the same repository. Unless
+// expectedContentType is empty, the response must have that Content-Type, which catches servers responding with
+// something other than Git's smart HTTP protocol (most often an HTML login page, when authentication has failed)
+// before its body is misparsed. A request which fails transiently (because of a network error, even partway through
+// the response, or an overloaded server) is retried up to http.maxRetries times, waiting longer before each retry,
+// in which case readResponse is called again with the new response.
+func makeHTTPRequest(method string, url string, body *HTTPRequestBody, expectedStatusCodes []int, expectedContentType string, readResponse func(io.Reader) error) (string, error) {
+	credential, err := getKnownCredential(url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request to %s with method %s: %s", url, method, err)
+		return "", fmt.Errorf("failed to get credentials for %s: %s", redactURL(url), err)
+	}
+
+	request := func() (string, error) {
+		return attemptHTTPRequest(method, url, body, credential, expectedStatusCodes, expectedContentType, readResponse)
+	}
+	for retry := 0; ; retry++ {
+		respURL, err := request()
+		var reqErr *HTTPRequestError
+		if err == nil && credential != nil {
+			credential.approve()
+		} else if errors.As(err, &reqErr) && reqErr.statusCode == http.StatusUnauthorized && credential == nil {
+			// The server requires authentication, so the request is made again (without counting as a retry)
+			credential, err = getCredential(url)
+			if err != nil {
+				return "", fmt.Errorf("authentication required for %s, but no credentials were found: %s", redactURL(url), err)
+			}
+			retry--
+			continue
+		} else if errors.As(err, &reqErr) && reqErr.statusCode == http.StatusUnauthorized {
+			credential.reject()
+			return "", fmt.Errorf("%s: check the credentials from the %s", err, credential.source)
+		}
+		if err == nil || !errors.As(err, &reqErr) || !reqErr.transient || retry >= httpSettings.maxRetries {
+			return respURL, err
+		}
+
+		delay := getRetryDelay(retry, reqErr)
+		if delay > HTTP_MAX_RETRY_DELAY {
+			return "", err
+		}
+		fmt.Fprintf(os.Stderr, "warning: %s; retrying in %s\n", err, delay)
+		time.Sleep(delay)
 	}
+}
 
-	req.SetBasicAuth(username, token)
+// Makes a single attempt at an HTTP request for makeHTTPRequest. Errors which may be worth retrying the request for
+// are returned as HTTPRequestErrors.
+func attemptHTTPRequest(method string, url string, body *HTTPRequestBody, credential *Credential, expectedStatusCodes []int, expectedContentType string, readResponse func(io.Reader) error) (string, error) {
+	// The request is sent and its response read through a monitor, which applies the transfer limits and counts the
+	// bytes transferred for the command's transfer stats
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	monitor := newTransferMonitor(transferLimits, cancel)
+	defer monitor.stop()
+
+	var contentLength int64
+	getBody := func() (io.ReadCloser, error) {
+		if body == nil {
+			return http.NoBody, nil
+		}
+		reqBody, length, err := body.openForRequest(httpSettings.postBuffer)
+		if err != nil {
+			return nil, err
+		}
+		contentLength = length
+		return struct {
+			io.Reader
+			io.Closer
+		}{monitor.wrap(reqBody, &monitor.sent), reqBody}, nil
+	}
+	reqBody, err := getBody()
+	if err != nil {
+		return "", err
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP request to %s with method %s failed: %s", url, method, err)
+		reqBody.Close()
+		return "", fmt.Errorf("failed to create HTTP request to %s with method %s: %s", url, method, err)
+	}
+	// Since the body isn't a plain buffer, its length and how to resend it (if the request is redirected) are given
+	// explicitly
+	req.ContentLength = contentLength
+	req.GetBody = getBody
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", getRequestContentType(path.Base(req.URL.Path)))
+	}
+
+	if credential != nil {
+		req.SetBasicAuth(credential.username, credential.password)
+	}
+
+	idempotent := isIdempotentRequest(method, url)
+	resp, err := httpClient.Do(req)
+	if err != nil && monitor.tooSlow.Load() {
+		return "", monitor.lowSpeedError()
+	} else if err != nil && body != nil && body.writeError() != nil {
+		// The body (e.g. a packfile) couldn't be written, which retrying won't fix
+		return "", body.writeError()
+	} else if err != nil {
+		// A push is only retried if the connection failed before any of it was sent
+		err = fmt.Errorf("HTTP request to %s with method %s failed: %s", url, method, err)
+		return "", &HTTPRequestError{err: err, transient: idempotent || monitor.sent.Load() == 0}
 	}
 	defer resp.Body.Close()
 
-	receivedExpectedStatusCode := slices.Contains(expectedStatusCodes, resp.StatusCode)
-	if !receivedExpectedStatusCode {
+	if err := checkHTTPResponse(req, resp, expectedStatusCodes, expectedContentType); err != nil {
+		// A server which is rate limiting requests hasn't processed the request, so even a push can be retried
+		transient := isTransientStatusCode(resp.StatusCode) && (idempotent || resp.StatusCode == http.StatusTooManyRequests)
+		return "", &HTTPRequestError{err: err, statusCode: resp.StatusCode, transient: transient, retryAfter: parseRetryAfter(resp.Header)}
+	}
+
+	respReader := &HTTPResponseReader{reader: monitor.wrap(resp.Body, &monitor.received)}
+	if err := readResponse(respReader); err != nil && monitor.tooSlow.Load() {
+		return "", monitor.lowSpeedError()
+	} else if err != nil && respReader.readErr != nil {
+		err = fmt.Errorf("failed to read response body for HTTP request to %s with method %s: %s", url, method, respReader.readErr)
+		return "", &HTTPRequestError{err: err, statusCode: resp.StatusCode, transient: idempotent}
+	} else if err != nil {
+		return "", err
+	}
+
+	return resp.Request.URL.String(), nil
+}
+
+// Checks that the response is one which a Git server would send, explaining the likely cause if it isn't: failed
+// authentication, a redirect away from the repository (e.g. to a login page), or a page which isn't a Git response
+func checkHTTPResponse(req *http.Request, resp *http.Response, expectedStatusCodes []int, expectedContentType string) error {
+	url := req.URL.Redacted()
+	username, _, _ := req.BasicAuth()
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("authentication failed for %s", url)
+	case http.StatusForbidden:
+		if username == "" {
+			return fmt.Errorf("access to %s was denied (%s): the repository may need credentials which the server didn't ask for", url, resp.Status)
+		}
+		return fmt.Errorf("access to %s was denied (%s): authentication may have failed, or %s may not have access to the repository", url, resp.Status, username)
+	case http.StatusNotFound:
+		return fmt.Errorf("repository not found at %s (%s): check the URL, and that your credentials have access to it if it's private", url, resp.Status)
+	}
+
+	// Redirects which weren't followed (see HTTPSettings.shouldFollowRedirect) are returned as they are
+	if location := resp.Header.Get("Location"); resp.StatusCode >= 300 && resp.StatusCode < 400 && location != "" {
+		return fmt.Errorf("request to %s was redirected to %s, which isn't followed for %s requests (see http.followRedirects)", url, location, req.Method)
+	}
+
+	if !slices.Contains(expectedStatusCodes, resp.StatusCode) {
 		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("received invalid response status code %s for HTTP request to %s with method %s. Response body: %s", resp.Status, url, method, string(respBody))
+		if contentType == "text/html" {
+			return fmt.Errorf("received invalid response status code %s for HTTP request to %s with method %s, along with an HTML page", resp.Status, url, req.Method)
+		}
+		if len(bytes.TrimSpace(respBody)) == 0 {
+			return fmt.Errorf("received invalid response status code %s for HTTP request to %s with method %s", resp.Status, url, req.Method)
+		}
+		return fmt.Errorf("received invalid response status code %s for HTTP request to %s with method %s. Response body: %s", resp.Status, url, req.Method, string(respBody))
 	}
 
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body for HTTP request to %s with method %s: %s", url, method, err)
+	// Redirects which are followed are fine as long as they lead to the same endpoint of a repository (e.g. from
+	// http:// to https://, or from a repository's old name to its new one). Anywhere else, such as a login page, can't
+	// give a Git response.
+	if finalURL := resp.Request.URL; path.Base(finalURL.Path) != path.Base(req.URL.Path) {
+		return fmt.Errorf("request to %s was redirected to %s, which isn't a Git repository: authentication may have failed", url, finalURL.Redacted())
 	}
 
-	return respBody, nil
+	if expectedContentType == "" || contentType == expectedContentType {
+		return nil
+	}
+	if contentType == "text/html" {
+		return fmt.Errorf("received an HTML page rather than a Git response from %s: authentication may have failed, or the URL may not be a Git repository", url)
+	}
+	// Servers which only support the dumb HTTP protocol serve info/refs as a plain text file
+	if contentType == "text/plain" && strings.HasSuffix(expectedContentType, "-advertisement") {
+		return fmt.Errorf("the server at %s only supports the dumb HTTP protocol, which isn't supported", url)
+	}
+	return fmt.Errorf("received a response with unexpected Content-Type '%s' from %s (expected '%s'): the URL may not be a Git repository", resp.Header.Get("Content-Type"), url, expectedContentType)
 }
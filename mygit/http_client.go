@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Represents the settings of the HTTP client with which every request to a remote repository is made
+type HTTPSettings struct {
+	proxy           string        // The proxy given by http.proxy, or "" to use the proxy environment variables
+	connectTimeout  time.Duration // How long to wait for a connection (including its TLS handshake) to be established
+	timeout         time.Duration // How long each request may take as a whole, or 0 for no limit
+	maxRetries      int           // How many times a request which failed transiently is retried
+	followRedirects string        // Which requests follow redirects: "true" (all), "false" (none), or "initial"
+	postBuffer      int           // The largest request body which is sent with its length rather than in chunks
+	config          *Config       // The config, which the credential settings for each URL are read from
+}
+
+var DEFAULT_HTTP_SETTINGS = HTTPSettings{
+	connectTimeout:  30 * time.Second,
+	maxRetries:      3,
+	followRedirects: "initial",
+	postBuffer:      1024 * 1024,
+}
+
+// The first delay before retrying a request, which doubles with each retry unless the server asks for another delay
+const HTTP_RETRY_BASE_DELAY = time.Second
+
+// The longest delay a server may ask for before a request is retried, beyond which the request fails instead
+const HTTP_MAX_RETRY_DELAY = 5 * time.Minute
+
+// The HTTP client shared by every request made by the command, set up by loadHTTPSettings
+var httpSettings = DEFAULT_HTTP_SETTINGS
+var httpClient = newHTTPClient(DEFAULT_HTTP_SETTINGS)
+
+// Sets up the HTTP client from the config, as Git does: http.proxy overrides the proxy environment variables
+// (HTTPS_PROXY, HTTP_PROXY, and NO_PROXY), http.followRedirects chooses which requests follow redirects, and
+// http.maxRetries (or the GIT_HTTP_MAX_RETRIES environment variable) limits how many times a request is retried.
+// http.connectTimeout and http.timeout (in seconds) limit how long connecting and each request may take, and
+// http.postBuffer is the largest request body sent with its length (see HTTPRequestBody.openForRequest). The
+// credential.* variables are read when a credential is needed (see getCredential).
+func loadHTTPSettings(repoDir string) error {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+	settings := DEFAULT_HTTP_SETTINGS
+
+	if proxy, isSet := config.get("http.proxy"); isSet && proxy != "" {
+		if _, err := parseProxyURL(proxy); err != nil {
+			return err
+		}
+		settings.proxy = proxy
+	}
+
+	for name, timeout := range map[string]*time.Duration{"http.connectTimeout": &settings.connectTimeout, "http.timeout": &settings.timeout} {
+		seconds, err := config.getInt(name, int64(*timeout/time.Second))
+		if err != nil {
+			return err
+		}
+		if seconds < 0 {
+			return fmt.Errorf("invalid %s: %d", name, seconds)
+		}
+		*timeout = time.Duration(seconds) * time.Second
+	}
+
+	maxRetries, err := config.getInt("http.maxRetries", int64(settings.maxRetries))
+	if err != nil {
+		return err
+	}
+	if envValue := os.Getenv("GIT_HTTP_MAX_RETRIES"); envValue != "" {
+		if maxRetries, err = strconv.ParseInt(envValue, 10, 64); err != nil {
+			return fmt.Errorf("invalid GIT_HTTP_MAX_RETRIES: %s", envValue)
+		}
+	}
+	if maxRetries < 0 {
+		return fmt.Errorf("invalid http.maxRetries: %d", maxRetries)
+	}
+	settings.maxRetries = int(maxRetries)
+
+	postBuffer, err := config.getInt("http.postBuffer", int64(settings.postBuffer))
+	if err != nil {
+		return err
+	}
+	if postBuffer <= 0 {
+		return fmt.Errorf("invalid http.postBuffer: %d", postBuffer)
+	}
+	settings.postBuffer = int(postBuffer)
+
+	if value, isSet := config.get("http.followRedirects"); isSet {
+		if strings.ToLower(value) == "initial" {
+			settings.followRedirects = "initial"
+		} else if follow, err := parseConfigBool(value); err != nil {
+			return fmt.Errorf("invalid value for config variable http.followRedirects: %s", value)
+		} else {
+			settings.followRedirects = strconv.FormatBool(follow)
+		}
+	}
+
+	settings.config = config
+	httpSettings = settings
+	httpClient = newHTTPClient(settings)
+	return nil
+}
+
+// Returns an HTTP client with the given settings. A connection which can't be established within the connect timeout
+// fails, but once connected, a request only times out if http.timeout is set, since a large clone may take a long
+// time; a stalled transfer is instead caught by the low speed limit (see TransferMonitor).
+func newHTTPClient(settings HTTPSettings) *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if settings.proxy != "" {
+		// The proxy was already checked when the settings were loaded
+		proxyURL, _ := parseProxyURL(settings.proxy)
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialer := &net.Dialer{Timeout: settings.connectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   settings.connectTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   settings.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !settings.shouldFollowRedirect(via[0]) {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// Returns whether the given request may be redirected. By default, as in Git, only ref discovery (the initial request
+// to info/refs) is, in which case the rest of the requests are made to the repository it was redirected to; a server
+// redirecting anything else is more likely to be sending the request somewhere it shouldn't go.
+func (s HTTPSettings) shouldFollowRedirect(req *http.Request) bool {
+	switch s.followRedirects {
+	case "true":
+		return true
+	case "initial":
+		return isRefDiscoveryRequest(req)
+	default:
+		return false
+	}
+}
+
+func isRefDiscoveryRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/info/refs")
+}
+
+// Parses the URL of a proxy, which as in Git defaults to the http:// scheme (e.g. proxy.example.com:3128), and may
+// include a username and password for the proxy
+func parseProxyURL(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: %s", proxy)
+	}
+	return proxyURL, nil
+}
+
+// Returns the URL with any password replaced by "xxxxx", so that it can be shown
+func redactURL(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return parsedURL.Redacted()
+}
+
+// Represents an error from a single attempt at an HTTP request, which may be retried if it's transient
+type HTTPRequestError struct {
+	err        error
+	statusCode int           // The status code of the response, or 0 if no response was received
+	transient  bool          // Whether the request may succeed if it's retried
+	retryAfter time.Duration // The delay requested by the server's Retry-After header, if any
+}
+
+func (e *HTTPRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *HTTPRequestError) Unwrap() error {
+	return e.err
+}
+
+// Returns whether a request failing with the given status code may succeed if it's retried: when the server is
+// overloaded or restarting, or a proxy or load balancer couldn't reach it
+func isTransientStatusCode(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns whether the request can safely be repeated. Fetching only reads from the remote repository, but a push may
+// already have been applied by the time its response is lost, so it's only retried if the server turned it away
+// before processing it (see makeHTTPRequest).
+func isIdempotentRequest(method string, url string) bool {
+	return method == http.MethodGet || strings.HasSuffix(url, "/git-upload-pack")
+}
+
+// Returns the delay requested by a Retry-After header, which may be a number of seconds or a date, or 0 if there's none
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// Returns how long to wait before the given retry (counting from 0) of a request which failed with the given error:
+// the delay the server asked for, or otherwise an exponentially increasing delay (1 s, 2 s, 4 s, ...), up to a minute
+func getRetryDelay(retry int, err *HTTPRequestError) time.Duration {
+	if err.retryAfter > 0 {
+		return err.retryAfter
+	}
+	return min(HTTP_RETRY_BASE_DELAY<<retry, time.Minute)
+}
@@ -8,39 +8,132 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const (
 	INDEX_HEADER_LENGTH   = 12
 	INDEX_SIGNATURE       = "DIRC"
 	INDEX_CHECKSUM_LENGTH = 20
+
+	INDEX_ENTRY_FIXED_LENGTH          = 62
+	INDEX_EXTENSION_HEADER_LENGTH     = 8
+	INDEX_MIN_SUPPORTED_VERSION       = 2
+	INDEX_MAX_SUPPORTED_VERSION       = 4
+	INDEX_PATH_COMPRESSION_VERSION    = 4
+	INDEX_EXTENDED_FLAGS_MIN_VERSION  = 3
+	INDEX_ENTRY_EXTENDED_FLAGS_LENGTH = 2
+)
+
+// Bits of the flags field of an index entry
+const (
+	INDEX_ENTRY_ASSUME_VALID_FLAG = 0x8000
+	INDEX_ENTRY_EXTENDED_FLAG     = 0x4000
+	INDEX_ENTRY_STAGE_MASK        = 0x3000
+	INDEX_ENTRY_STAGE_SHIFT       = 12
+	INDEX_ENTRY_NAME_LENGTH_MASK  = 0x0FFF
+)
+
+// Bits of the extended flags field of an index entry (only present in index versions 3 and 4)
+const (
+	INDEX_ENTRY_SKIP_WORKTREE_FLAG = 0x4000
+	INDEX_ENTRY_INTENT_TO_ADD_FLAG = 0x2000
 )
 
+// Signatures of the index extensions written by Git that are understood by this implementation. Extensions
+// with signatures starting with an uppercase letter are optional and may be ignored by readers that don't
+// understand them, whereas the others are required for the index to be interpreted correctly.
+const (
+	INDEX_EXT_CACHE_TREE          = "TREE"
+	INDEX_EXT_RESOLVE_UNDO        = "REUC"
+	INDEX_EXT_UNTRACKED_CACHE     = "UNTR"
+	INDEX_EXT_FS_MONITOR          = "FSMN"
+	INDEX_EXT_END_OF_INDEX_ENTRY  = "EOIE"
+	INDEX_EXT_INDEX_ENTRY_OFFSETS = "IEOT"
+	INDEX_EXT_SPLIT_INDEX         = "link"
+	INDEX_EXT_SPARSE_DIRECTORIES  = "sdir"
+)
+
+// Represents the parsed contents of the Git index file
+type Index struct {
+	version    uint32
+	entries    []*IndexEntry
+	extensions []*IndexExtension
+	cacheTree  *CacheTree
+}
+
+// Represents an extension section following the entries in the Git index file
+type IndexExtension struct {
+	signature string
+	data      []byte
+}
+
 // Represents an entry (representing a file in the repository) in the Git index file
 type IndexEntry struct {
-	cTimeSec     uint32
-	cTimeNanoSec uint32
-	mTimeSec     uint32
-	mTimeNanoSec uint32
-	dev          uint32
-	ino          uint32
-	mode         uint32
-	uid          uint32
-	gid          uint32
-	fileSize     uint32
-	sha1         [OBJECT_HASH_LENGTH_BYTES]byte
-	flags        uint16
-	path         string
+	cTimeSec      uint32
+	cTimeNanoSec  uint32
+	mTimeSec      uint32
+	mTimeNanoSec  uint32
+	dev           uint32
+	ino           uint32
+	mode          FileMode
+	uid           uint32
+	gid           uint32
+	fileSize      uint32
+	sha1          [OBJECT_HASH_LENGTH_BYTES]byte
+	flags         uint16
+	extendedFlags uint16
+	path          string
+}
+
+func (e *IndexEntry) stage() int {
+	return int(e.flags&INDEX_ENTRY_STAGE_MASK) >> INDEX_ENTRY_STAGE_SHIFT
+}
+
+// Returns the paths of the index entries with merge conflicts, which are recorded as entries at stages 1 (the merge
+// base), 2 (ours), and 3 (theirs) in place of a single entry at stage 0. Each path is listed once, in index order.
+func getUnmergedPaths(entries []*IndexEntry) []string {
+	paths := []string{}
+	for _, entry := range entries {
+		if entry.stage() != 0 && !slices.Contains(paths, entry.path) {
+			paths = append(paths, entry.path)
+		}
+	}
+	return paths
+}
+
+func (e *IndexEntry) isAssumeValid() bool {
+	return e.flags&INDEX_ENTRY_ASSUME_VALID_FLAG != 0
+}
+
+func (e *IndexEntry) isSkipWorktree() bool {
+	return e.extendedFlags&INDEX_ENTRY_SKIP_WORKTREE_FLAG != 0
+}
+
+func (e *IndexEntry) isIntentToAdd() bool {
+	return e.extendedFlags&INDEX_ENTRY_INTENT_TO_ADD_FLAG != 0
 }
 
 func ReadIndex(repoDir string) ([]*IndexEntry, error) {
-	indexPath := filepath.Join(repoDir, ".git", "index")
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return index.entries, nil
+}
+
+func readIndexFile(repoDir string) (*Index, error) {
+	indexPath := filepath.Join(getGitDir(repoDir), "index")
 
 	index, err := os.ReadFile(indexPath)
 	if err != nil && os.IsNotExist(err) {
-		return []*IndexEntry{}, nil
+		return &Index{version: 2, entries: []*IndexEntry{}, extensions: []*IndexExtension{}}, nil
 	} else if err != nil {
 		return nil, fmt.Errorf("failed to read Git index file: %s", err)
 	}
@@ -53,48 +146,102 @@ func ReadIndex(repoDir string) ([]*IndexEntry, error) {
 
 	i := 0
 
-	numEntries, err := readIndexHeader(index)
+	version, numEntries, err := readIndexHeader(index)
 	if err != nil {
 		return nil, err
 	}
 	i += INDEX_HEADER_LENGTH
 
-	entries, err := readIndexEntries(index, i, numEntries)
+	entries, i, err := readIndexEntries(index, i, numEntries, version)
 	if err != nil {
 		return nil, err
 	}
 
-	return entries, nil
+	extensions, err := readIndexExtensions(index, i)
+	if err != nil {
+		return nil, err
+	}
+
+	var cacheTree *CacheTree
+	for _, extension := range extensions {
+		if extension.signature == INDEX_EXT_CACHE_TREE {
+			cacheTree, err = parseCacheTree(extension.data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cache tree extension in index file: %s", err)
+			}
+		}
+	}
+
+	return &Index{
+		version:    version,
+		entries:    entries,
+		extensions: extensions,
+		cacheTree:  cacheTree,
+	}, nil
 }
 
+// Adds the given files to the index. A directory stands for all of the files within it, so any files deleted from it
+// are removed from the index, as is any given file which is tracked but has been deleted. Adding a file with merge
+// conflicts marks them as resolved, replacing its entries at stages 1 to 3 with a single entry at stage 0.
 func AddFilesToIndex(paths []string, repoDir string) error {
-	currIndexEntries, err := ReadIndex(repoDir)
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
 	if err != nil {
 		return err
 	}
 
+	paths, dirs, err := expandDirectoryPaths(paths, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to scan repository for all files in working tree: %s", err)
+	}
+
+	trackedPaths := make(map[string]bool, len(index.entries))
+	for _, entry := range index.entries {
+		trackedPaths[entry.path] = true
+	}
+
+	// A tracked file which has been deleted from the working tree is removed from the index, staging its deletion
 	pathsSet := make(map[string]bool, len(paths))
+	existingPaths := []string{}
 	for _, path := range paths {
 		pathsSet[path] = true
+
+		if _, err := os.Lstat(filepath.Join(repoDir, path)); os.IsNotExist(err) {
+			if !trackedPaths[path] {
+				return fmt.Errorf("pathspec '%s' did not match any files", path)
+			}
+			continue
+		}
+		existingPaths = append(existingPaths, path)
 	}
 
 	entriesToKeep := []*IndexEntry{}
-	for _, entry := range currIndexEntries {
-		if _, adding := pathsSet[entry.path]; !adding {
+	for _, entry := range index.entries {
+		_, adding := pathsSet[entry.path]
+		inAddedDir := slices.ContainsFunc(dirs, func(dir string) bool {
+			return strings.HasPrefix(entry.path, dir+"/")
+		})
+		if !adding && !inAddedDir {
 			entriesToKeep = append(entriesToKeep, entry)
 		}
 	}
 
-	newIndexEntries := entriesToKeep
-	for path, _ := range pathsSet {
-		entry, err := createIndexEntry(path, repoDir)
-		if err != nil {
-			return fmt.Errorf("failed to create index entry for '%s': %s", path, err)
-		}
-		newIndexEntries = append(newIndexEntries, entry)
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return err
 	}
+	addedEntries, err := createIndexEntries(existingPaths, index.entries, converter, repoDir)
+	if err != nil {
+		return err
+	}
+	newIndexEntries := append(entriesToKeep, addedEntries...)
 
-	err = writeIndex(newIndexEntries, repoDir)
+	err = writeUpdatedIndex(indexLock, index, newIndexEntries)
 	if err != nil {
 		return fmt.Errorf("failed to write updated Git index file: %s", err)
 	}
@@ -102,8 +249,109 @@ func AddFilesToIndex(paths []string, repoDir string) error {
 	return nil
 }
 
+// Stages the current contents of every file tracked in the index, as `commit -a` does: modified files are updated
+// and deleted files are removed, while untracked files are left alone. Files excluded from the working tree by a
+// sparse checkout, files marked assume-unchanged, files with merge conflicts, and submodules which haven't been
+// populated are skipped.
+func AddTrackedFilesToIndex(repoDir string) error {
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return err
+	}
+
+	paths := []string{}
+	for _, entry := range index.entries {
+		if entry.stage() != 0 || entry.isSkipWorktree() || entry.isAssumeValid() {
+			continue
+		}
+
+		if entry.mode == GITLINK_MODE {
+			head, err := getSubmoduleHead(entry.path, repoDir)
+			if err != nil {
+				return err
+			} else if head == "" {
+				continue
+			}
+		}
+		paths = append(paths, entry.path)
+	}
+
+	return AddFilesToIndex(paths, repoDir)
+}
+
+// Replaces each directory among the given paths with the working tree files within it, also returning the
+// directories. Nested repositories are left as they are, since they're added as submodules.
+func expandDirectoryPaths(paths []string, repoDir string) ([]string, []string, error) {
+	expandedPaths, dirs := []string{}, []string{}
+	var workingTreePaths []string
+	for _, path := range paths {
+		fullPath := filepath.Join(repoDir, path)
+		if !isDirectory(fullPath) || fileExists(filepath.Join(fullPath, ".git")) {
+			expandedPaths = append(expandedPaths, path)
+			continue
+		}
+
+		if workingTreePaths == nil {
+			var err error
+			workingTreePaths, err = getWorkingTreeFilePaths(repoDir)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		for _, workingTreePath := range workingTreePaths {
+			if strings.HasPrefix(workingTreePath, path+"/") {
+				expandedPaths = append(expandedPaths, workingTreePath)
+			}
+		}
+		dirs = append(dirs, path)
+	}
+
+	return expandedPaths, dirs, nil
+}
+
+// Returns the paths of the files in the index together with those in the given tree-ish which aren't in the index,
+// in sorted order, i.e. the files as they'd be if the index were overlaid on the tree. Nothing is modified.
+func ListFilesWithTree(treeish string, repoDir string) ([]string, error) {
+	treeHash, err := resolveTreeish(treeish, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	treeFiles := make(map[string]*DiffFileVersion)
+	if err := populateTreeDiffFiles(treeFiles, treeHash, "", repoDir); err != nil {
+		return nil, fmt.Errorf("failed to read files in tree %s: %s", treeHash, err)
+	}
+
+	entries, err := ReadIndex(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pathsSet := make(map[string]bool, len(entries)+len(treeFiles))
+	for _, entry := range entries {
+		pathsSet[entry.path] = true
+	}
+	for path := range treeFiles {
+		pathsSet[path] = true
+	}
+
+	paths := make([]string, 0, len(pathsSet))
+	for path := range pathsSet {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
 func RemoveFilesFromIndex(paths []string, repoDir string) error {
-	currIndexEntries, err := ReadIndex(repoDir)
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
 	if err != nil {
 		return err
 	}
@@ -114,13 +362,13 @@ func RemoveFilesFromIndex(paths []string, repoDir string) error {
 	}
 
 	entriesToKeep := []*IndexEntry{}
-	for _, entry := range currIndexEntries {
+	for _, entry := range index.entries {
 		if _, removing := pathsSet[entry.path]; !removing {
 			entriesToKeep = append(entriesToKeep, entry)
 		}
 	}
 
-	err = writeIndex(entriesToKeep, repoDir)
+	err = writeUpdatedIndex(indexLock, index, entriesToKeep)
 	if err != nil {
 		return fmt.Errorf("failed to write updated Git index file: %s", err)
 	}
@@ -129,9 +377,27 @@ func RemoveFilesFromIndex(paths []string, repoDir string) error {
 }
 
 func CreateIndexFromWorkingTree(repoDir string) error {
-	indexPath := filepath.Join(repoDir, ".git", "index")
-	if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove index file: %s", err)
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return err
+	}
+	return createIndexFromWorkingTree(converter, repoDir)
+}
+
+// Creates the index from the working tree as CreateIndexFromWorkingTree does, converting the content of the files
+// with the given converter (e.g. that of a tree which has just been checked out)
+func createIndexFromWorkingTree(converter *ContentConverter, repoDir string) error {
+	// The existing index is only used as a stat cache and cache tree here, so an unreadable index is simply
+	// rebuilt from scratch
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		index = &Index{version: 2, entries: []*IndexEntry{}, extensions: []*IndexExtension{}}
 	}
 
 	filesToAdd, err := getWorkingTreeFilePaths(repoDir)
@@ -139,103 +405,280 @@ func CreateIndexFromWorkingTree(repoDir string) error {
 		return fmt.Errorf("failed to scan repository for all files in working tree: %s", err)
 	}
 
-	if err := AddFilesToIndex(filesToAdd, repoDir); err != nil {
+	newIndexEntries, err := createIndexEntries(filesToAdd, index.entries, converter, repoDir)
+	if err != nil {
 		return fmt.Errorf("failed to update index: %s", err)
 	}
 
+	// A submodule which hasn't been populated is an empty directory, which isn't listed as part of the working tree,
+	// so its entry is kept as it is
+	for _, entry := range index.entries {
+		submoduleDir := filepath.Join(repoDir, entry.path)
+		if entry.mode == GITLINK_MODE && entry.stage() == 0 && isDirectory(submoduleDir) && !fileExists(filepath.Join(submoduleDir, ".git")) {
+			newIndexEntries = append(newIndexEntries, entry)
+		}
+	}
+
+	if err := writeUpdatedIndex(indexLock, index, newIndexEntries); err != nil {
+		return fmt.Errorf("failed to write updated Git index file: %s", err)
+	}
+
 	return nil
 }
 
-func createIndexEntry(path string, repoDir string) (*IndexEntry, error) {
-	fullPath := filepath.Join(repoDir, path)
-	info, err := os.Stat(fullPath)
+// Writes the new set of entries into the index, invalidating the parts of the index's cache tree covering
+// any entries that were added, removed, or changed
+func writeUpdatedIndex(indexLock *LockFile, index *Index, newEntries []*IndexEntry) error {
+	if index.cacheTree != nil {
+		index.cacheTree.invalidateChangedEntries(index.entries, newEntries)
+	}
+
+	return writeIndex(indexLock, newEntries, index.cacheTree)
+}
+
+// Creates index entries for the given paths. Any path whose current index entry has stat data matching the file
+// on disk keeps its existing entry, so that unchanged files are not read and hashed again.
+func createIndexEntries(paths []string, currIndexEntries []*IndexEntry, converter *ContentConverter, repoDir string) ([]*IndexEntry, error) {
+	// Adding a file with merge conflicts resolves them, so only stage 0 entries are reused
+	currIndexEntriesMap := make(map[string]*IndexEntry, len(currIndexEntries))
+	for _, entry := range currIndexEntries {
+		if entry.stage() == 0 {
+			currIndexEntriesMap[entry.path] = entry
+		}
+	}
+
+	indexModTime := getIndexModTime(repoDir)
+	trustExecutableBit, err := getTrustExecutableBit(repoDir)
 	if err != nil {
 		return nil, err
 	}
-	stat := info.Sys().(*syscall.Stat_t)
 
-	if info.IsDir() {
-		return nil, fmt.Errorf("unable to create an index entry for a directory: '%s'", path)
+	seenPaths := make(map[string]bool, len(paths))
+	entries := []*IndexEntry{}
+	for _, path := range paths {
+		if seenPaths[path] {
+			continue
+		}
+		seenPaths[path] = true
+
+		currEntry, inIndex := currIndexEntriesMap[path]
+		if inIndex {
+			info, err := os.Lstat(filepath.Join(repoDir, path))
+			if err == nil && isIndexEntryStatClean(currEntry, info, indexModTime) {
+				entries = append(entries, currEntry)
+				continue
+			}
+		}
+
+		// Without a trustworthy executable bit, the file keeps the mode it was staged with
+		var currMode FileMode
+		if inIndex {
+			currMode = currEntry.mode
+		}
+		entry, err := createIndexEntry(path, currMode, trustExecutableBit, converter, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create index entry for '%s': %s", path, err)
+		}
+		entries = append(entries, entry)
 	}
 
-	blobObj, err := CreateBlobObjectFromFile(fullPath, repoDir)
+	return entries, nil
+}
+
+func createIndexEntry(path string, currMode FileMode, trustExecutableBit bool, converter *ContentConverter, repoDir string) (*IndexEntry, error) {
+	fullPath := filepath.Join(repoDir, path)
+	info, err := os.Lstat(fullPath)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create a blob object for this index entry: '%s'", path)
+		return nil, err
+	}
+
+	var objHash string
+	if info.IsDir() {
+		// A nested repository is added as a submodule, recording the commit checked out in it
+		objHash, err = getSubmoduleHead(path, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		if objHash == "" {
+			return nil, fmt.Errorf("unable to create an index entry for a directory which isn't a repository with a commit checked out: '%s'", path)
+		}
+	} else {
+		blobObj, err := CreateBlobObjectFromFile(fullPath, converter, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create a blob object for this index entry: '%s': %s", path, err)
+		}
+		objHash = blobObj.hash
 	}
 
-	objHashBytes, err := hex.DecodeString(blobObj.hash)
+	objHashBytes, err := hex.DecodeString(objHash)
 	if err != nil {
 		return nil, fmt.Errorf("invalid hash format: %s", err)
 	}
 
 	entry := &IndexEntry{
-		cTimeSec:     uint32(stat.Ctimespec.Sec),
-		cTimeNanoSec: uint32(stat.Ctimespec.Nsec),
-		mTimeSec:     uint32(stat.Mtimespec.Sec),
-		mTimeNanoSec: uint32(stat.Mtimespec.Nsec),
-		dev:          uint32(stat.Dev),
-		ino:          uint32(stat.Ino),
-		mode:         uint32(getGitModeFromFileMode(info.Mode())),
-		uid:          stat.Uid,
-		gid:          stat.Gid,
-		fileSize:     uint32(info.Size()),
-		sha1:         [OBJECT_HASH_LENGTH_BYTES]byte{},
-		flags:        0,
-		path:         path,
+		sha1:  [OBJECT_HASH_LENGTH_BYTES]byte{},
+		flags: 0,
+		path:  path,
 	}
+	setIndexEntryStatData(entry, info)
 	copy(entry.sha1[:], objHashBytes)
+	entry.mode = getWorkingTreeFileMode(info.Mode(), currMode, trustExecutableBit)
+	if info.IsDir() {
+		entry.mode = GITLINK_MODE
+	}
 
 	return entry, nil
 }
 
-func writeIndex(entries []*IndexEntry, repoDir string) error {
+// Records the stat data of the given file in the index entry, which is later used to detect whether the file
+// has changed since the entry was created without having to rehash its contents. The entry's mode is left as it is,
+// since refreshing the stat data of a file whose contents are unchanged mustn't stage a change to its mode.
+func setIndexEntryStatData(entry *IndexEntry, info os.FileInfo) {
+	stat := info.Sys().(*syscall.Stat_t)
+	cTime, mTime := statTimes(stat)
+
+	entry.cTimeSec = uint32(cTime.Sec)
+	entry.cTimeNanoSec = uint32(cTime.Nsec)
+	entry.mTimeSec = uint32(mTime.Sec)
+	entry.mTimeNanoSec = uint32(mTime.Nsec)
+	entry.dev = uint32(stat.Dev)
+	entry.ino = uint32(stat.Ino)
+	entry.uid = stat.Uid
+	entry.gid = stat.Gid
+	entry.fileSize = uint32(info.Size())
+}
+
+// Determines whether the stat data cached in the index entry still matches the given file, in which case the
+// stored object hash can be trusted without rehashing the file. Following Git's racy-git rule, an entry whose
+// file was modified at or after the time the index was last written is never considered clean, since the file
+// may have changed again within the same timestamp granularity.
+func isIndexEntryStatClean(entry *IndexEntry, info os.FileInfo, indexModTime time.Time) bool {
+	currEntry := &IndexEntry{mode: getGitModeFromFileMode(info.Mode())}
+	setIndexEntryStatData(currEntry, info)
+
+	if currEntry.mTimeSec != entry.mTimeSec || currEntry.mTimeNanoSec != entry.mTimeNanoSec ||
+		currEntry.cTimeSec != entry.cTimeSec || currEntry.cTimeNanoSec != entry.cTimeNanoSec ||
+		currEntry.fileSize != entry.fileSize || currEntry.ino != entry.ino || currEntry.dev != entry.dev ||
+		currEntry.mode != entry.mode || currEntry.uid != entry.uid || currEntry.gid != entry.gid {
+		return false
+	}
+
+	entryModTime := time.Unix(int64(entry.mTimeSec), int64(entry.mTimeNanoSec))
+	return entryModTime.Before(indexModTime)
+}
+
+// Returns the time at which the index file was last written, or the zero time if there is no index file
+func getIndexModTime(repoDir string) time.Time {
+	info, err := os.Stat(filepath.Join(getGitDir(repoDir), "index"))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// Acquires the lock on the index file. The lock should be acquired before the index is read for any
+// read-modify-write update, so that concurrent updates can't overwrite each other.
+func lockIndex(repoDir string) (*LockFile, error) {
+	return acquireLockFile(filepath.Join(getGitDir(repoDir), "index"))
+}
+
+// Writes the index to the given index lock file, replacing the index file on disk and releasing the lock
+func writeIndex(indexLock *LockFile, entries []*IndexEntry, cacheTree *CacheTree) error {
+	// As in Git, the entries of a file with merge conflicts are ordered by stage
 	sort.Slice(entries, func(i int, j int) bool {
-		return entries[i].path < entries[j].path
+		if entries[i].path != entries[j].path {
+			return entries[i].path < entries[j].path
+		}
+		return entries[i].stage() < entries[j].stage()
 	})
 
+	// Extended flags can only be stored from version 3 onwards, so version 2 is only used if no entry needs them
+	version := uint32(INDEX_MIN_SUPPORTED_VERSION)
+	for _, entry := range entries {
+		if entry.extendedFlags != 0 {
+			version = INDEX_EXTENDED_FLAGS_MIN_VERSION
+			break
+		}
+	}
+
 	var indexBuf bytes.Buffer
 
 	indexBuf.WriteString(INDEX_SIGNATURE)
-	binary.Write(&indexBuf, binary.BigEndian, uint32(2))
+	binary.Write(&indexBuf, binary.BigEndian, version)
 	binary.Write(&indexBuf, binary.BigEndian, uint32(len(entries)))
 
 	for _, entry := range entries {
+		entryStartPos := indexBuf.Len()
 		binary.Write(&indexBuf, binary.BigEndian, entry.cTimeSec)
 		binary.Write(&indexBuf, binary.BigEndian, entry.cTimeNanoSec)
 		binary.Write(&indexBuf, binary.BigEndian, entry.mTimeSec)
 		binary.Write(&indexBuf, binary.BigEndian, entry.mTimeNanoSec)
 		binary.Write(&indexBuf, binary.BigEndian, entry.dev)
 		binary.Write(&indexBuf, binary.BigEndian, entry.ino)
-		binary.Write(&indexBuf, binary.BigEndian, entry.mode)
+		binary.Write(&indexBuf, binary.BigEndian, uint32(entry.mode))
 		binary.Write(&indexBuf, binary.BigEndian, entry.uid)
 		binary.Write(&indexBuf, binary.BigEndian, entry.gid)
 		binary.Write(&indexBuf, binary.BigEndian, entry.fileSize)
 		indexBuf.Write(entry.sha1[:])
-		binary.Write(&indexBuf, binary.BigEndian, entry.flags)
+		binary.Write(&indexBuf, binary.BigEndian, encodeIndexEntryFlags(entry))
+		if entry.extendedFlags != 0 {
+			binary.Write(&indexBuf, binary.BigEndian, entry.extendedFlags)
+		}
 		indexBuf.WriteString(entry.path)
-		indexBuf.WriteByte(0)
+
+		// Pad the entry with 1-8 NUL bytes (the first terminating the path) so that its length is a multiple of 8
+		entryLength := indexBuf.Len() - entryStartPos
+		paddedEntryLength := (entryLength + 8) &^ 7
+		indexBuf.Write(make([]byte, paddedEntryLength-entryLength))
 	}
 
-	indexData := indexBuf.Bytes()
-	indexChecksum := sha1.Sum(indexData)
+	if cacheTree != nil {
+		cacheTreeData := cacheTree.serialize()
+		indexBuf.WriteString(INDEX_EXT_CACHE_TREE)
+		binary.Write(&indexBuf, binary.BigEndian, uint32(len(cacheTreeData)))
+		indexBuf.Write(cacheTreeData)
+	}
 
-	indexPath := filepath.Join(repoDir, ".git", "index")
-	indexFile, err := os.Create(indexPath)
-	if err != nil {
-		return fmt.Errorf("failed to create index file: %s", err)
+	indexChecksum := sha1.Sum(indexBuf.Bytes())
+	indexBuf.Write(indexChecksum[:])
+
+	if err := indexLock.write(indexBuf.Bytes()); err != nil {
+		return err
 	}
-	defer indexFile.Close()
 
-	_, err = indexFile.Write(indexData)
-	if err != nil {
-		return fmt.Errorf("failed to write content to index file: %s", err)
+	return indexLock.commit()
+}
+
+// Encodes the flags field of an index entry, consisting of the assume-valid bit, the extended bit (set if the
+// entry has extended flags), the 2-bit merge stage, and the 12-bit length of the entry's path. Paths longer
+// than can be represented in 12 bits store 0xFFF as their length, so readers must scan for the terminating NUL.
+func encodeIndexEntryFlags(entry *IndexEntry) uint16 {
+	flags := entry.flags &^ (INDEX_ENTRY_EXTENDED_FLAG | INDEX_ENTRY_NAME_LENGTH_MASK)
+	if entry.extendedFlags != 0 {
+		flags |= INDEX_ENTRY_EXTENDED_FLAG
 	}
-	_, err = indexFile.Write(indexChecksum[:])
-	if err != nil {
-		return fmt.Errorf("failed to write checksum to index file: %s", err)
+	flags |= uint16(min(len(entry.path), INDEX_ENTRY_NAME_LENGTH_MASK))
+	return flags
+}
+
+// Index entries store the mode as its actual bits (e.g. 0o100644). Indexes written by earlier versions of mygit
+// stored the mode's octal digits read as a decimal integer (e.g. 100644) instead, which are still read correctly. None
+// of these values are valid mode bits, so they can't be confused with a correctly encoded mode.
+func decodeIndexEntryMode(encodedMode uint32) FileMode {
+	if isValidMode(FileMode(encodedMode)) {
+		return FileMode(encodedMode)
 	}
 
-	return nil
+	legacyMode, err := parseFileMode(strconv.FormatUint(uint64(encodedMode), 10))
+	if err != nil || !isValidMode(legacyMode) {
+		return FileMode(encodedMode)
+	}
+	return legacyMode
+}
+
+func isLegacyUnpaddedIndexEntry(entry *IndexEntry) bool {
+	return entry.flags&INDEX_ENTRY_NAME_LENGTH_MASK == 0 && entry.path != ""
 }
 
 func verifyIndexChecksum(index []byte) error {
@@ -253,46 +696,45 @@ func verifyIndexChecksum(index []byte) error {
 	return nil
 }
 
-func readIndexHeader(index []byte) (int, error) {
+func readIndexHeader(index []byte) (uint32, int, error) {
 	if len(index) < INDEX_HEADER_LENGTH {
-		return -1, fmt.Errorf("invalid index file: too short to contain a header")
+		return 0, -1, fmt.Errorf("invalid index file: too short to contain a header")
 	}
 
 	signature := string(index[0:4])
 	if signature != INDEX_SIGNATURE {
-		return -1, fmt.Errorf("invalid index file signature: expected '%s', got '%s'", INDEX_SIGNATURE, signature)
+		return 0, -1, fmt.Errorf("invalid index file signature: expected '%s', got '%s'", INDEX_SIGNATURE, signature)
 	}
 
 	versionNumber := binary.BigEndian.Uint32(index[4:8])
-	if versionNumber != 2 {
-		return -1, fmt.Errorf("unsupported index file version number: expected 2, got %d", versionNumber)
+	if versionNumber < INDEX_MIN_SUPPORTED_VERSION || versionNumber > INDEX_MAX_SUPPORTED_VERSION {
+		return 0, -1, fmt.Errorf("unsupported index file version number: expected %d-%d, got %d", INDEX_MIN_SUPPORTED_VERSION, INDEX_MAX_SUPPORTED_VERSION, versionNumber)
 	}
 
 	numEntries := binary.BigEndian.Uint32(index[8:12])
-	return int(numEntries), nil
+	return versionNumber, int(numEntries), nil
 }
 
-func readIndexEntries(index []byte, i int, numEntries int) ([]*IndexEntry, error) {
+func readIndexEntries(index []byte, i int, numEntries int, version uint32) ([]*IndexEntry, int, error) {
 	entries := make([]*IndexEntry, 0, numEntries)
+	prevPath := ""
 	for range numEntries {
 		var entry *IndexEntry
 		var err error
-		entry, i, err = readIndexEntry(index, i)
+		entry, i, err = readIndexEntry(index, i, version, prevPath)
 		if err != nil {
-			return nil, err
+			return nil, -1, err
 		}
 		entries = append(entries, entry)
+		prevPath = entry.path
 	}
 
-	if i != len(index) {
-		return nil, fmt.Errorf("leftover data in index file after reading all expected entries")
-	}
-
-	return entries, nil
+	return entries, i, nil
 }
 
-func readIndexEntry(index []byte, i int) (*IndexEntry, int, error) {
-	if i+62 > len(index) {
+func readIndexEntry(index []byte, i int, version uint32, prevPath string) (*IndexEntry, int, error) {
+	entryStartPos := i
+	if i+INDEX_ENTRY_FIXED_LENGTH > len(index) {
 		return nil, i, fmt.Errorf("index file is too short to contain another entry")
 	}
 
@@ -303,7 +745,7 @@ func readIndexEntry(index []byte, i int) (*IndexEntry, int, error) {
 		mTimeNanoSec: binary.BigEndian.Uint32(index[i+12 : i+16]),
 		dev:          binary.BigEndian.Uint32(index[i+16 : i+20]),
 		ino:          binary.BigEndian.Uint32(index[i+20 : i+24]),
-		mode:         binary.BigEndian.Uint32(index[i+24 : i+28]),
+		mode:         decodeIndexEntryMode(binary.BigEndian.Uint32(index[i+24 : i+28])),
 		uid:          binary.BigEndian.Uint32(index[i+28 : i+32]),
 		gid:          binary.BigEndian.Uint32(index[i+32 : i+36]),
 		fileSize:     binary.BigEndian.Uint32(index[i+36 : i+40]),
@@ -312,14 +754,100 @@ func readIndexEntry(index []byte, i int) (*IndexEntry, int, error) {
 		path:         "",
 	}
 	copy(entry.sha1[:], index[i+40:i+40+OBJECT_HASH_LENGTH_BYTES])
+	i += INDEX_ENTRY_FIXED_LENGTH
+
+	if entry.flags&INDEX_ENTRY_EXTENDED_FLAG != 0 {
+		if version < INDEX_EXTENDED_FLAGS_MIN_VERSION {
+			return nil, i, fmt.Errorf("index entry has extended flags, which are not supported in index version %d", version)
+		}
+		if i+INDEX_ENTRY_EXTENDED_FLAGS_LENGTH > len(index) {
+			return nil, i, fmt.Errorf("index file is too short to contain extended flags for entry")
+		}
+		entry.extendedFlags = binary.BigEndian.Uint16(index[i : i+INDEX_ENTRY_EXTENDED_FLAGS_LENGTH])
+		i += INDEX_ENTRY_EXTENDED_FLAGS_LENGTH
+	}
+
+	// In version 4, each path is prefix-compressed relative to the previous entry's path: a variable-width
+	// integer N gives the number of bytes to remove from the end of the previous path, followed by the
+	// NUL-terminated suffix to append
+	var prefix string
+	if version == INDEX_PATH_COMPRESSION_VERSION {
+		numRemovedBytes, j, err := readVariableOffsetEncoding(index, i)
+		if err != nil {
+			return nil, i, fmt.Errorf("failed to read index entry path prefix length: %s", err)
+		}
+		if numRemovedBytes > len(prevPath) {
+			return nil, i, fmt.Errorf("invalid index entry path prefix length: %d", numRemovedBytes)
+		}
+		prefix = prevPath[:len(prevPath)-numRemovedBytes]
+		i = j
+	}
 
-	pathStartPos := i + 62
+	// The name length stored in the flags is capped at 0xFFF, so the path is always read up to its NUL terminator
+	pathStartPos := i
 	pathEndPos := pathStartPos
 	for pathEndPos < len(index) && index[pathEndPos] != 0 {
 		pathEndPos += 1
 	}
+	if pathEndPos == len(index) {
+		return nil, i, fmt.Errorf("index entry path is missing its NUL terminator")
+	}
+
+	entry.path = prefix + string(index[pathStartPos:pathEndPos])
+	i = pathEndPos + 1
+
+	// Versions 2 and 3 pad each entry with NUL bytes so that its length is a multiple of 8. Indexes written by
+	// earlier versions of mygit have no padding, and can be recognized by their entries' name length of 0 (Git
+	// itself never writes an entry with an empty path).
+	if version != INDEX_PATH_COMPRESSION_VERSION && !isLegacyUnpaddedIndexEntry(entry) {
+		paddedEndPos := entryStartPos + ((pathEndPos - entryStartPos + 8) &^ 7)
+		if paddedEndPos > len(index) || !isAllZeroBytes(index[i:paddedEndPos]) {
+			return nil, i, fmt.Errorf("index entry %s has invalid padding", entry.path)
+		}
+		i = paddedEndPos
+	}
+
+	return entry, i, nil
+}
+
+func readIndexExtensions(index []byte, i int) ([]*IndexExtension, error) {
+	extensions := []*IndexExtension{}
+	for i < len(index) {
+		if i+INDEX_EXTENSION_HEADER_LENGTH > len(index) {
+			return nil, fmt.Errorf("leftover data in index file after reading all expected entries")
+		}
+
+		signature := string(index[i : i+4])
+		size := int(binary.BigEndian.Uint32(index[i+4 : i+8]))
+		i += INDEX_EXTENSION_HEADER_LENGTH
+
+		if i+size > len(index) {
+			return nil, fmt.Errorf("index extension %s is truncated", signature)
+		}
+		data := index[i : i+size]
+		i += size
+
+		switch signature {
+		case INDEX_EXT_CACHE_TREE, INDEX_EXT_RESOLVE_UNDO, INDEX_EXT_UNTRACKED_CACHE, INDEX_EXT_FS_MONITOR, INDEX_EXT_END_OF_INDEX_ENTRY, INDEX_EXT_INDEX_ENTRY_OFFSETS:
+			extensions = append(extensions, &IndexExtension{signature: signature, data: data})
+		case INDEX_EXT_SPLIT_INDEX, INDEX_EXT_SPARSE_DIRECTORIES:
+			return nil, fmt.Errorf("unsupported index extension %s: split and sparse indexes are not supported", signature)
+		default:
+			if signature[0] < 'A' || signature[0] > 'Z' {
+				return nil, fmt.Errorf("unsupported required index extension %s", signature)
+			}
+			// Unknown optional extensions may safely be ignored
+		}
+	}
 
-	entry.path = string(index[pathStartPos:pathEndPos])
+	return extensions, nil
+}
 
-	return entry, pathEndPos + 1, nil
+func isAllZeroBytes(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The default byte budget of the blob line cache, set by the core.lineCacheLimit config variable
+const DEFAULT_LINE_CACHE_LIMIT = 32 * 1024 * 1024
+
+// The directory of the Git directory holding the on-disk line indexes of blobs, enabled by core.lineIndexCache. Each
+// is stored at line-index/<first 2 hex digits of the blob hash>/<remaining hex digits>, like a loose object.
+const LINE_INDEX_DIR = "line-index"
+
+const TEMP_FILE_KIND_LINE_INDEX = "lines"
+
+// The approximate number of bytes of bookkeeping for each cached line, on top of the line itself
+const LINE_CACHE_LINE_OVERHEAD = 16
+
+// A least-recently-used cache of the lines of blobs, keyed by their hashes, which is shared by blame and diff. Blame
+// reads every version of a file in its history, and often the same versions repeatedly (e.g. when blaming several
+// files or ranges of one commit), so caching their lines avoids re-reading and re-splitting large blobs. As blobs
+// are immutable, cached lines never go stale.
+type LineCache struct {
+	// The lines of each cached blob, which are substrings of the blob's content, so they share its memory
+	*LRUCache[string, []string]
+	useIndex bool // Whether line indexes are read from and written to disk (core.lineIndexCache)
+}
+
+// The line cache used for the rest of the command, created on first use by getBlobLineCache
+var blobLineCache *LineCache
+
+func newLineCache(limitBytes int64, useIndex bool) *LineCache {
+	return &LineCache{
+		LRUCache: newLRUCache[string, []string](limitBytes),
+		useIndex: useIndex,
+	}
+}
+
+// Returns the line cache shared by the commands run by this process, configured by the core.lineCacheLimit (the
+// cache's byte budget) and core.lineIndexCache (whether line indexes are kept on disk) config variables
+func getBlobLineCache(repoDir string) (*LineCache, error) {
+	if blobLineCache != nil {
+		return blobLineCache, nil
+	}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %s", err)
+	}
+
+	limitBytes, err := config.getInt("core.lineCacheLimit", DEFAULT_LINE_CACHE_LIMIT)
+	if err != nil {
+		return nil, err
+	}
+	useIndex, err := config.getBool("core.lineIndexCache", false)
+	if err != nil {
+		return nil, err
+	}
+
+	blobLineCache = newLineCache(limitBytes, useIndex)
+	return blobLineCache, nil
+}
+
+// Returns the lines of the blob, each keeping its trailing newline as with splitLines. content is the blob's
+// content if the caller has already read it, or nil to have it read only if the lines aren't cached.
+func getBlobLines(blobHash string, content []byte, repoDir string) ([]string, error) {
+	cache, err := getBlobLineCache(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if lines, ok := cache.get(blobHash); ok {
+		return lines, nil
+	}
+
+	if content == nil {
+		blobObj, err := ReadBlobObjectFile(blobHash, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read blob %s: %s", blobHash, err)
+		}
+		content = blobObj.content
+	}
+
+	lines := cache.splitBlobLines(blobHash, content, repoDir)
+	cache.add(blobHash, lines, int64(len(content)+LINE_CACHE_LINE_OVERHEAD*len(lines)))
+	return lines, nil
+}
+
+// Splits the blob's content into lines at the line ends given by its on-disk line index, if line indexes are enabled
+// and it has one, or else by scanning the content for newlines (writing the line index if they're enabled). A line
+// index which doesn't fit the content is ignored and rewritten.
+func (c *LineCache) splitBlobLines(blobHash string, content []byte, repoDir string) []string {
+	var lineEnds []int
+	if c.useIndex {
+		lineEnds = readLineIndex(blobHash, len(content), repoDir)
+	}
+
+	if lineEnds == nil {
+		lineEnds = findLineEnds(content)
+		// The line index only saves work later, so failing to write it (e.g. in a read-only repository) isn't fatal
+		if c.useIndex {
+			if err := writeLineIndex(blobHash, lineEnds, repoDir); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+			}
+		}
+	}
+
+	return splitAtLineEnds(string(content), lineEnds)
+}
+
+func splitAtLineEnds(text string, lineEnds []int) []string {
+	lines := make([]string, 0, len(lineEnds))
+	start := 0
+	for _, end := range lineEnds {
+		lines = append(lines, text[start:end])
+		start = end
+	}
+	return lines
+}
+
+// Returns the offset just past the end of each line of the content, i.e. after its newline, or at the end of the
+// content for a last line without one
+func findLineEnds(content []byte) []int {
+	lineEnds := []int{}
+	for offset := 0; offset < len(content); {
+		newlineIndex := bytes.IndexByte(content[offset:], '\n')
+		if newlineIndex == -1 {
+			lineEnds = append(lineEnds, len(content))
+			break
+		}
+		offset += newlineIndex + 1
+		lineEnds = append(lineEnds, offset)
+	}
+	return lineEnds
+}
+
+func getLineIndexPath(blobHash string, repoDir string) string {
+	return filepath.Join(getCommonDir(repoDir), LINE_INDEX_DIR, blobHash[:2], blobHash[2:])
+}
+
+// Reads the line index of the blob, which stores the length of each line as a varint. Returns nil if the blob has no
+// line index, or if its line index doesn't add up to the blob's size.
+func readLineIndex(blobHash string, contentLength int, repoDir string) []int {
+	data, err := os.ReadFile(getLineIndexPath(blobHash, repoDir))
+	if err != nil {
+		return nil
+	}
+
+	lineEnds := []int{}
+	end := 0
+	for len(data) > 0 {
+		lineLength, n := binary.Uvarint(data)
+		if n <= 0 || lineLength == 0 || lineLength > uint64(contentLength-end) {
+			return nil
+		}
+		end += int(lineLength)
+		lineEnds = append(lineEnds, end)
+		data = data[n:]
+	}
+
+	if end != contentLength {
+		return nil
+	}
+	return lineEnds
+}
+
+// Writes the line index of the blob, through a temporary file which is renamed into place so that a partially
+// written line index is never read
+func writeLineIndex(blobHash string, lineEnds []int, repoDir string) error {
+	data := []byte{}
+	start := 0
+	for _, end := range lineEnds {
+		data = binary.AppendUvarint(data, uint64(end-start))
+		start = end
+	}
+
+	indexPath := getLineIndexPath(blobHash, repoDir)
+	if err := os.MkdirAll(filepath.Dir(indexPath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create line index directory: %s", err)
+	}
+
+	tempFile, err := createTempFile(TEMP_FILE_KIND_LINE_INDEX, getCommonDir(repoDir))
+	if err != nil {
+		return err
+	}
+	defer releaseTempFile(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write line index: %s", err)
+	}
+
+	if err := os.Rename(tempFile.Name(), indexPath); err != nil {
+		return fmt.Errorf("failed to move line index into place: %s", err)
+	}
+	return nil
+}
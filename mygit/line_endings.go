@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Represents how the line endings of a file are converted between the working tree and the repository
+type EOLConversion int
+
+const (
+	EOLConversionNone EOLConversion = iota // The file is stored exactly as it is in the working tree
+	EOLConversionText                      // The file is text, so its line endings are always normalized
+	EOLConversionAuto                      // The file's line endings are normalized only if its content looks like text
+)
+
+// Converts the line endings of the files of a repository, as determined by their text and eol attributes and the
+// core.autocrlf and core.eol config variables. Files which are converted are stored in the repository with LF line
+// endings, and are checked out with either LF or CRLF line endings, so that a file doesn't appear to be modified just
+// because it's been edited on a platform with different line endings.
+type LineEndings struct {
+	attributes *Attributes
+	autoCRLF   string // The value of core.autocrlf: "true", "false", or "input"
+	eol        string // The value of core.eol: "lf", "crlf", or "native"
+	treeHash   string // The tree being checked out, whose blobs are used in place of the index's, or empty if none
+	blobHashes map[string]string
+	repoDir    string
+}
+
+// Reads the line ending settings from the config. Where the conversion of a file depends on its current blob, the blob
+// is looked up in the given tree (e.g. the tree being checked out), or in the index if treeHash is empty.
+func newLineEndings(attributes *Attributes, config *Config, treeHash string, repoDir string) (*LineEndings, error) {
+	autoCRLF := "false"
+	if value, isSet := config.get("core.autocrlf"); isSet {
+		if strings.EqualFold(value, "input") {
+			autoCRLF = "input"
+		} else if enabled, err := parseConfigBool(value); err != nil {
+			return nil, fmt.Errorf("invalid value for core.autocrlf: %s", value)
+		} else if enabled {
+			autoCRLF = "true"
+		}
+	}
+
+	eol := "native"
+	if value, isSet := config.get("core.eol"); isSet {
+		eol = strings.ToLower(value)
+		if eol != "lf" && eol != "crlf" && eol != "native" {
+			return nil, fmt.Errorf("invalid value for core.eol: %s", value)
+		}
+	}
+
+	return &LineEndings{attributes: attributes, autoCRLF: autoCRLF, eol: eol, treeHash: treeHash, repoDir: repoDir}, nil
+}
+
+// Returns how the line endings of the file at the given path (relative to the top level of the working tree) are
+// converted, and whether it's checked out with CRLF line endings. As in Git:
+//   - The text attribute marks a file as text (`text`), not text (`-text` or `binary`), or to be detected (`text=auto`).
+//   - Without a text attribute, a file with an eol attribute is text, and otherwise core.autocrlf being true or input
+//     has the file detected, while it's left alone if core.autocrlf is false.
+//   - A converted file is checked out with the line endings given by its eol attribute (`eol=lf` or `eol=crlf`), or
+//     otherwise CRLF if core.autocrlf is true, LF if it's input, and the line endings given by core.eol if it's false.
+func (l *LineEndings) getConversion(path string) (EOLConversion, bool) {
+	conversion := EOLConversionNone
+	text, isTextSpecified := l.attributes.get(path, "text")
+	eol, isEOLSpecified := l.attributes.get(path, "eol")
+	switch {
+	case isTextSpecified && text == ATTRIBUTE_SET:
+		conversion = EOLConversionText
+	case isTextSpecified && text == "auto":
+		conversion = EOLConversionAuto
+	case isTextSpecified:
+		return EOLConversionNone, false
+	case isEOLSpecified && (eol == "lf" || eol == "crlf"):
+		conversion = EOLConversionText
+	case l.autoCRLF != "false":
+		conversion = EOLConversionAuto
+	default:
+		return EOLConversionNone, false
+	}
+
+	switch {
+	case isEOLSpecified && (eol == "lf" || eol == "crlf"):
+		return conversion, eol == "crlf"
+	case l.autoCRLF != "false":
+		return conversion, l.autoCRLF == "true"
+	case l.eol == "native":
+		return conversion, runtime.GOOS == "windows"
+	default:
+		return conversion, l.eol == "crlf"
+	}
+}
+
+// Converts the content of the file at the given path (relative to the top level of the working tree) to the content
+// stored in its blob, replacing CRLF line endings with LF if the file is converted. As in Git, a detected text file
+// isn't converted if its current blob already has carriage returns, so that a file committed with CRLF line endings
+// doesn't appear to be modified until it's explicitly renormalized.
+func (l *LineEndings) toBlob(path string, content []byte) ([]byte, error) {
+	conversion, _ := l.getConversion(path)
+	if conversion == EOLConversionNone || (conversion == EOLConversionAuto && !looksLikeText(content)) {
+		return content, nil
+	}
+	if conversion == EOLConversionAuto && bytes.Contains(content, []byte("\r\n")) {
+		hasCR, err := l.currentBlobHasCR(path)
+		if err != nil || hasCR {
+			return content, err
+		}
+	}
+	return bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n")), nil
+}
+
+// Returns whether the file's current blob (in the tree being checked out, or otherwise in the index) contains a
+// carriage return. The blobs' hashes are only read the first time they're needed.
+func (l *LineEndings) currentBlobHasCR(path string) (bool, error) {
+	if l.blobHashes == nil {
+		l.blobHashes = make(map[string]string)
+		if l.treeHash != "" {
+			files := make(map[string]*DiffFileVersion)
+			if err := populateTreeDiffFiles(files, l.treeHash, "", l.repoDir); err != nil {
+				return false, err
+			}
+			for filePath, file := range files {
+				l.blobHashes[filePath] = file.hash
+			}
+		} else if index, err := readIndexFile(l.repoDir); err == nil {
+			// An unreadable index is about to be rebuilt from scratch, so it's treated as empty
+			for _, entry := range index.entries {
+				if entry.stage() == 0 {
+					l.blobHashes[entry.path] = hex.EncodeToString(entry.sha1[:])
+				}
+			}
+		}
+	}
+
+	blobHash, exists := l.blobHashes[path]
+	if !exists {
+		return false, nil
+	}
+	blobObj, err := ReadBlobObjectFile(blobHash, l.repoDir)
+	if err != nil {
+		return false, err
+	}
+	return bytes.IndexByte(blobObj.content, '\r') != -1, nil
+}
+
+// Converts the content of the blob of the file at the given path (relative to the top level of the working tree) to
+// the content written to the working tree, replacing LF line endings with CRLF if the file is checked out with them.
+// As in Git, a detected text file which already contains carriage returns is left alone.
+func (l *LineEndings) toWorkingTree(path string, content []byte) ([]byte, error) {
+	conversion, crlf := l.getConversion(path)
+	if conversion == EOLConversionNone || !crlf {
+		return content, nil
+	}
+	if conversion == EOLConversionAuto && (!looksLikeText(content) || bytes.IndexByte(content, '\r') != -1) {
+		return content, nil
+	}
+
+	var converted bytes.Buffer
+	converted.Grow(len(content) + bytes.Count(content, []byte("\n")))
+	for i, b := range content {
+		if b == '\n' && (i == 0 || content[i-1] != '\r') {
+			converted.WriteByte('\r')
+		}
+		converted.WriteByte(b)
+	}
+	return converted.Bytes(), nil
+}
+
+// Returns whether the content looks like text for the purposes of line ending conversion. As in Git, content with a
+// NUL byte or a carriage return which isn't part of a CRLF line ending is treated as binary.
+func looksLikeText(content []byte) bool {
+	if isBinaryContent(content) {
+		return false
+	}
+	for i, b := range content {
+		if b == '\r' && (i+1 == len(content) || content[i+1] != '\n') {
+			return false
+		}
+	}
+	return true
+}
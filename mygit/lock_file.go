@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const LOCK_FILE_SUFFIX = ".lock"
+
+// Represents a held lock on a file in the .git directory. Following Git's lock file protocol, the new contents of
+// the file are written to a `<file>.lock` file, which is created exclusively so that only one process can update
+// the file at a time. Committing the lock flushes the new contents to disk and atomically renames the lock file
+// over the original, so that a crash mid-write never leaves the original file partially written. This process is
+// recorded as the lock's owner, so that the lock can be cleaned up if the process crashes while holding it.
+type LockFile struct {
+	path      string
+	lockPath  string
+	ownerPath string // The record of this process owning the lock (see recordLockFileOwner)
+	file      *os.File
+}
+
+func acquireLockFile(path string) (*LockFile, error) {
+	lockPath := path + LOCK_FILE_SUFFIX
+	file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil && os.IsExist(err) {
+		return nil, fmt.Errorf("unable to create '%s': file exists. Another mygit process seems to be running in this repository; if not, a previous process may have crashed, and the lock file can be removed manually to continue", lockPath)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to create '%s': %s", lockPath, err)
+	}
+	trackTempFile(lockPath)
+
+	ownerPath, err := recordLockFileOwner(lockPath)
+	if err != nil {
+		file.Close()
+		releaseTempFile(lockPath)
+		return nil, err
+	}
+
+	return &LockFile{
+		path:      path,
+		lockPath:  lockPath,
+		ownerPath: ownerPath,
+		file:      file,
+	}, nil
+}
+
+func (l *LockFile) write(data []byte) error {
+	if _, err := l.file.Write(data); err != nil {
+		return fmt.Errorf("failed to write to lock file %s: %s", l.lockPath, err)
+	}
+	return nil
+}
+
+// Flushes the lock file's contents to disk and renames it over the locked file, releasing the lock
+func (l *LockFile) commit() error {
+	if l.file == nil {
+		return fmt.Errorf("lock file %s has already been released", l.lockPath)
+	}
+
+	if err := l.file.Sync(); err != nil {
+		l.rollback()
+		return fmt.Errorf("failed to flush lock file %s: %s", l.lockPath, err)
+	}
+
+	if err := l.file.Close(); err != nil {
+		l.file = nil
+		l.release()
+		return fmt.Errorf("failed to close lock file %s: %s", l.lockPath, err)
+	}
+	l.file = nil
+
+	if err := os.Rename(l.lockPath, l.path); err != nil {
+		l.release()
+		return fmt.Errorf("failed to rename lock file %s to %s: %s", l.lockPath, l.path, err)
+	}
+
+	// The lock file no longer exists (and may even have been acquired by another process), so it mustn't be removed
+	untrackTempFile(l.lockPath)
+	l.releaseOwner()
+	return nil
+}
+
+// Discards the lock file without touching the locked file, releasing the lock. Does nothing if the lock has
+// already been committed or rolled back, so it's safe to defer immediately after acquiring the lock.
+func (l *LockFile) rollback() {
+	if l.file == nil {
+		return
+	}
+
+	l.file.Close()
+	l.file = nil
+	l.release()
+}
+
+func (l *LockFile) release() {
+	releaseTempFile(l.lockPath)
+	l.releaseOwner()
+}
+
+func (l *LockFile) releaseOwner() {
+	if l.ownerPath != "" {
+		releaseTempFile(l.ownerPath)
+	}
+}
+
+// Atomically replaces the contents of the file at the given path while holding its lock
+func writeFileWithLock(path string, data []byte) error {
+	lock, err := acquireLockFile(path)
+	if err != nil {
+		return err
+	}
+	defer lock.rollback()
+
+	if err := lock.write(data); err != nil {
+		return err
+	}
+
+	return lock.commit()
+}
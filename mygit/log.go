@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Represents a format in which the date of a commit or tag is shown, as selected by Git's --date option
+type DateFormat int
+
+const (
+	DateFormatDefault   DateFormat = iota // e.g. Mon Jan 2 15:04:05 2006 -0700
+	DateFormatISO                         // e.g. 2006-01-02 15:04:05 -0700
+	DateFormatISOStrict                   // e.g. 2006-01-02T15:04:05-07:00, i.e. strict ISO 8601
+	DateFormatRFC                         // e.g. Mon, 2 Jan 2006 15:04:05 -0700, i.e. RFC 2822, as in emails
+	DateFormatShort                       // e.g. 2006-01-02
+	DateFormatRaw                         // e.g. 1136239445 -0700, as stored in the object
+	DateFormatUnix                        // e.g. 1136239445
+)
+
+// The layouts (for time.Format) of the date formats which are formatted from the time in the user's timezone
+var DATE_FORMAT_LAYOUTS = map[DateFormat]string{
+	DateFormatDefault:   "Mon Jan 2 15:04:05 2006 -0700",
+	DateFormatISO:       "2006-01-02 15:04:05 -0700",
+	DateFormatISOStrict: "2006-01-02T15:04:05-07:00",
+	DateFormatRFC:       "Mon, 2 Jan 2006 15:04:05 -0700",
+	DateFormatShort:     "2006-01-02",
+}
+
+// Parses the name of a date format as given to --date, accepting the same names (and aliases) as Git
+func parseDateFormat(name string) (DateFormat, error) {
+	switch name {
+	case "default":
+		return DateFormatDefault, nil
+	case "iso", "iso8601":
+		return DateFormatISO, nil
+	case "iso-strict", "iso8601-strict":
+		return DateFormatISOStrict, nil
+	case "rfc", "rfc2822":
+		return DateFormatRFC, nil
+	case "short":
+		return DateFormatShort, nil
+	case "raw":
+		return DateFormatRaw, nil
+	case "unix":
+		return DateFormatUnix, nil
+	default:
+		return -1, fmt.Errorf("unknown date format %s", name)
+	}
+}
+
+// Formats the date at which the commit was authored or committed (or the tag was created) in the given format. As in
+// Git, dates are shown in the user's own timezone, as recorded alongside them.
+func (u *CommitUser) formatDate(format DateFormat) string {
+	switch format {
+	case DateFormatRaw:
+		return fmt.Sprintf("%d %s", u.dateSeconds, u.timezone)
+	case DateFormatUnix:
+		return strconv.FormatInt(u.dateSeconds, 10)
+	default:
+		return u.time().Format(DATE_FORMAT_LAYOUTS[format])
+	}
+}
+
+// The width within which log --stat fits each diffstat, as Git uses when its output isn't a terminal
+const LOG_STAT_WIDTH = 80
+
+type LogOptions struct {
+	maxCount      int  // The maximum number of commits to show, or -1 for no limit
+	oneline       bool // Whether to show each commit as its abbreviated hash and subject, rather than in full
+	firstParent   bool
+	dateFormat    DateFormat
+	colorizer     Colorizer   // Colors the hash of each commit
+	stat          bool        // Whether to show a diffstat of the changes made by each commit
+	showSignature bool        // Whether to verify each signed commit's signature and show the report on it
+	diffOptions   DiffOptions // How the lines of changed files are diffed for the diffstats
+	paths         []string    // If set, only commits which changed these paths are shown, and only their changes
+}
+
+// Writes the history reachable from the given commits, other than the excluded commits (e.g. those reachable from A in
+// A..B), to the output, most recently committed first, as git log does. Each commit is written as soon as the walk
+// reaches it, so the start of a long history is shown without waiting for the rest of it to be read.
+func Log(startHashes []string, excluded map[string]bool, options LogOptions, output io.Writer, repoDir string) error {
+	walker, err := newCommitWalker(startHashes, excluded, options.firstParent, repoDir)
+	if err != nil {
+		return err
+	}
+	walker.paths = options.paths
+
+	for count := 0; options.maxCount < 0 || count < options.maxCount; count++ {
+		commitObj, err := walker.next()
+		if err != nil {
+			return err
+		}
+		if commitObj == nil {
+			break
+		}
+
+		signatureReport := ""
+		if options.showSignature {
+			signatureReport = getLogSignatureReport(commitObj, repoDir)
+		}
+
+		if options.oneline {
+			_, err = fmt.Fprintf(output, "%s%s %s\n", signatureReport, options.colorizer.wrap(abbreviateHash(commitObj.hash), COLOR_YELLOW), getCommitOnelineSubject(commitObj))
+		} else {
+			if count > 0 {
+				fmt.Fprintln(output)
+			}
+			_, err = io.WriteString(output, formatLogCommit(commitObj, signatureReport, options.dateFormat, options.colorizer))
+		}
+		if err != nil {
+			return err
+		}
+
+		if options.stat {
+			if err := writeLogCommitStat(commitObj, options, output, repoDir); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the report on the commit's signature shown by log --show-signature (see verifyCommitSignature), which is
+// empty for an unsigned commit. As in Git, a signature which can't be verified at all is reported as "No signature",
+// with the reason printed as an error.
+func getLogSignatureReport(commitObj *CommitObject, repoDir string) string {
+	report, err := verifyCommitSignature(commitObj, repoDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return "No signature\n"
+	}
+	if report != "" && !strings.HasSuffix(report, "\n") {
+		report += "\n"
+	}
+	return report
+}
+
+// Writes a diffstat of the changes made by the commit (see getCommitChanges) to the log's paths, if any, separated from
+// the commit's message by a blank line unless each commit is shown on one line. Nothing is written for a commit which
+// changed nothing.
+func writeLogCommitStat(commitObj *CommitObject, options LogOptions, output io.Writer, repoDir string) error {
+	allChanges, err := getCommitChanges(commitObj, options.firstParent, repoDir)
+	if err != nil {
+		return err
+	}
+	changes := []*DiffFileChange{}
+	for _, change := range allChanges {
+		if isWithinPaths(change.path, options.paths) {
+			changes = append(changes, change)
+		}
+	}
+	summary, err := summarizeDiffChanges(changes, options.diffOptions, repoDir)
+	if err != nil {
+		return err
+	}
+	if len(summary.files) == 0 {
+		return nil
+	}
+
+	if !options.oneline {
+		fmt.Fprintln(output)
+	}
+	_, err = io.WriteString(output, summary.stat(LOG_STAT_WIDTH))
+	return err
+}
+
+// Returns the changes made by the commit to the files of its first parent (or, for a root commit, to an empty tree).
+// As in Git, a merge commit has no changes shown, unless only first parents are being followed, in which case its
+// changes are those it brought into the first parent's history.
+func getCommitChanges(commitObj *CommitObject, firstParent bool, repoDir string) ([]*DiffFileChange, error) {
+	parentFiles := make(map[string]*DiffFileVersion)
+	switch {
+	case len(commitObj.parentCommitHashes) > 1 && !firstParent:
+		return []*DiffFileChange{}, nil
+	case len(commitObj.parentCommitHashes) > 0:
+		var err error
+		parentFiles, err = getCommitDiffFiles(commitObj.parentCommitHashes[0], repoDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	commitFiles := make(map[string]*DiffFileVersion)
+	if err := populateTreeDiffFiles(commitFiles, commitObj.treeHash, "", repoDir); err != nil {
+		return nil, fmt.Errorf("failed to read files in tree of commit %s: %s", commitObj.hash, err)
+	}
+
+	return diffFileSets(parentFiles, commitFiles), nil
+}
+
+// Determines whether the file at the given path is at or within one of the paths, or if no paths are given, anywhere
+func isWithinPaths(filePath string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, path := range paths {
+		if path == "." || filePath == path || strings.HasPrefix(filePath, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Formats the commit as git log does by default: its hash, the report on its signature (if any, see
+// getLogSignatureReport), its parents (if it's a merge), its author and author date (in the given format), and its
+// message indented by four spaces
+func formatLogCommit(commitObj *CommitObject, signatureReport string, dateFormat DateFormat, colorizer Colorizer) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s\n", colorizer.wrap("commit "+commitObj.hash, COLOR_YELLOW))
+	sb.WriteString(signatureReport)
+	if len(commitObj.parentCommitHashes) > 1 {
+		abbreviatedParents := make([]string, len(commitObj.parentCommitHashes))
+		for i, parentHash := range commitObj.parentCommitHashes {
+			abbreviatedParents[i] = abbreviateHash(parentHash)
+		}
+		fmt.Fprintf(&sb, "Merge: %s\n", strings.Join(abbreviatedParents, " "))
+	}
+	fmt.Fprintf(&sb, "Author: %s <%s>\n", commitObj.author.name, commitObj.author.email)
+	fmt.Fprintf(&sb, "Date:   %s\n", commitObj.author.formatDate(dateFormat))
+
+	sb.WriteString("\n")
+	for _, line := range strings.Split(strings.TrimRight(commitObj.commitMessage, " \t\n"), "\n") {
+		sb.WriteString("    " + line + "\n")
+	}
+	return sb.String()
+}
+
+// Returns the subject of the commit as shown by log --oneline: the first paragraph of its message, joined into a
+// single line
+func getCommitOnelineSubject(commitObj *CommitObject) string {
+	paragraph, _, _ := strings.Cut(strings.TrimLeft(commitObj.commitMessage, "\n"), "\n\n")
+	lines := strings.Split(strings.TrimSpace(paragraph), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, " ")
+}
+
+// Resolves a revision given to log to the commit it names: HEAD, a pseudoref such as ORIG_HEAD (see PSEUDO_REFS), a
+// full or abbreviated object hash, or a ref name, which as in Git may be given in full (e.g. refs/heads/main) or as a branch, tag,
+// or remote-tracking branch (e.g. main, v1.0, or origin/main). Tags are peeled to the commits they point to.
+func resolveCommitish(revision string, repoDir string) (string, error) {
+	_, objHash, err := resolveRevision(revision, repoDir)
+	if err != nil {
+		return "", err
+	}
+
+	commitHash, objType, err := peelObject(objHash, repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %s", revision, err)
+	}
+	if objType != Commit {
+		return "", fmt.Errorf("%s is a %s, not a commit", revision, objType.toString())
+	}
+	return commitHash, nil
+}
+
+// Resolves a revision (as accepted by resolveCommitish) to the object it names, without peeling tags, along with the
+// full name of the ref it was found through, e.g. HEAD, or refs/heads/main for main. The ref name is empty if the
+// revision is a full or abbreviated object hash.
+func resolveRevision(revision string, repoDir string) (string, string, error) {
+	if revision == "HEAD" {
+		headCommitHash, commitsExist, err := ResolveHead("", repoDir)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to resolve HEAD: %s", err)
+		}
+		if !commitsExist {
+			currBranch, _ := getCurrentBranch(repoDir)
+			return "", "", fmt.Errorf("your current branch '%s' does not have any commits yet", currBranch)
+		}
+		return "HEAD", headCommitHash, nil
+	}
+	if slices.Contains(PSEUDO_REFS, revision) {
+		refHash, exists, err := resolvePseudoRef(revision, repoDir)
+		if err != nil {
+			return "", "", err
+		}
+		if exists {
+			return revision, refHash, nil
+		}
+	}
+	if isValidObjectHash(revision) && objectExists(revision, repoDir) {
+		return "", revision, nil
+	}
+
+	candidates := []string{"refs/" + revision, "refs/tags/" + revision, "refs/heads/" + revision, "refs/remotes/" + revision, "refs/remotes/" + revision + "/HEAD"}
+	if strings.HasPrefix(revision, "refs/") {
+		candidates = append([]string{revision}, candidates...)
+	}
+	for _, refName := range candidates {
+		if validateRefName(refName) != nil {
+			continue
+		}
+		refHash, exists, err := resolveRef(refName, repoDir)
+		if err != nil {
+			return "", "", err
+		}
+		if exists {
+			return refName, refHash, nil
+		}
+	}
+
+	// As in Git, a ref takes precedence over an object whose hash it abbreviates
+	objHash, found, err := findObjectByAbbreviatedHash(revision, repoDir)
+	if err != nil {
+		return "", "", err
+	}
+	if found {
+		return "", objHash, nil
+	}
+	return "", "", fmt.Errorf("ambiguous argument '%s': unknown revision or path not in the working tree.", revision)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestResolveRevisionWithAbbreviatedHash(t *testing.T) {
+	repoDir := newTestRepo(t)
+
+	// Blobs are written until two of them share the first MIN_ABBREV_HASH_LENGTH digits of their hashes
+	blobHashesByPrefix := make(map[string]string)
+	var hash, otherHash string
+	for i := 0; otherHash == ""; i++ {
+		hash = createTestBlob(t, fmt.Sprintf("blob %d\n", i), repoDir)
+		prefix := hash[:MIN_ABBREV_HASH_LENGTH]
+		otherHash = blobHashesByPrefix[prefix]
+		blobHashesByPrefix[prefix] = hash
+	}
+
+	for _, objHash := range []string{hash, otherHash} {
+		_, resolvedHash, err := resolveRevision(abbreviateHash(objHash), repoDir)
+		if err != nil {
+			t.Fatalf("failed to resolve %s: %s", abbreviateHash(objHash), err)
+		}
+		if resolvedHash != objHash {
+			t.Errorf("%s resolved to %s, expected %s", abbreviateHash(objHash), resolvedHash, objHash)
+		}
+	}
+
+	if _, _, err := resolveRevision(hash[:MIN_ABBREV_HASH_LENGTH], repoDir); err == nil {
+		t.Errorf("ambiguous abbreviated hash %s was resolved", hash[:MIN_ABBREV_HASH_LENGTH])
+	}
+	if _, _, err := resolveRevision(hash[:MIN_ABBREV_HASH_LENGTH-1], repoDir); err == nil {
+		t.Errorf("abbreviated hash %s shorter than the minimum was resolved", hash[:MIN_ABBREV_HASH_LENGTH-1])
+	}
+}
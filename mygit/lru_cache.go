@@ -0,0 +1,71 @@
+package main
+
+import "container/list"
+
+// A least-recently-used cache holding values up to a total size budget (e.g. in bytes), given with each value as it's
+// added. The least recently used values are evicted to make room for new ones, and a value larger than the whole
+// budget isn't cached at all. Used for the caches of delta bases (see DeltaBaseCache) and blob lines (see LineCache).
+type LRUCache[K comparable, V any] struct {
+	limit   int64
+	used    int64
+	entries map[K]*list.Element
+	lru     *list.List // Most recently used entries at the front
+}
+
+// Represents a value stored in an LRU cache, along with its key (so that it can be removed from the cache's map when
+// it's evicted) and its size
+type LRUCacheEntry[K comparable, V any] struct {
+	key   K
+	value V
+	size  int64
+}
+
+func newLRUCache[K comparable, V any](limit int64) *LRUCache[K, V] {
+	return &LRUCache[K, V]{
+		limit:   limit,
+		used:    0,
+		entries: make(map[K]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *LRUCache[K, V]) get(key K) (V, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*LRUCacheEntry[K, V]).value, true
+}
+
+func (c *LRUCache[K, V]) add(key K, value V, size int64) {
+	if size > c.limit {
+		return
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	for c.used+size > c.limit {
+		c.evictOldest()
+	}
+
+	elem := c.lru.PushFront(&LRUCacheEntry[K, V]{key: key, value: value, size: size})
+	c.entries[key] = elem
+	c.used += size
+}
+
+func (c *LRUCache[K, V]) evictOldest() {
+	elem := c.lru.Back()
+	if elem == nil {
+		return
+	}
+
+	entry := c.lru.Remove(elem).(*LRUCacheEntry[K, V])
+	delete(c.entries, entry.key)
+	c.used -= entry.size
+}
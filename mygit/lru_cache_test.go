@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLRUCache[string, int](10)
+	cache.add("a", 1, 4)
+	cache.add("b", 2, 4)
+
+	// Using a makes b the least recently used, so it's evicted to make room for c
+	if value, ok := cache.get("a"); !ok || value != 1 {
+		t.Fatalf("get(a) = %d, %t, expected 1, true", value, ok)
+	}
+	cache.add("c", 3, 4)
+
+	if _, ok := cache.get("b"); ok {
+		t.Errorf("b was not evicted")
+	}
+	for key, expected := range map[string]int{"a": 1, "c": 3} {
+		if value, ok := cache.get(key); !ok || value != expected {
+			t.Errorf("get(%s) = %d, %t, expected %d, true", key, value, ok, expected)
+		}
+	}
+	if cache.used != 8 {
+		t.Errorf("cache uses %d, expected 8", cache.used)
+	}
+
+	// A value larger than the whole budget isn't cached, and doesn't evict anything
+	cache.add("d", 4, 11)
+	if _, ok := cache.get("d"); ok {
+		t.Errorf("d was cached despite exceeding the cache's limit")
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("cache holds %d entries, expected 2", len(cache.entries))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type LsTreeOptions struct {
+	recursive bool // Whether to list the entries of subtrees rather than the subtrees themselves (-r)
+	onlyTrees bool // Whether to list only trees (-d)
+	long      bool // Whether to include the size of each blob (-l)
+	nameOnly  bool
+}
+
+// Writes the entries of the given tree to the output in the format of git ls-tree, with each entry's path given from
+// the root of the tree. If any paths are given, only the entries they match are listed: a path matches the entry at
+// exactly that path, and a path ending in / matches the entries within that directory (so `src` lists the src tree
+// itself, while `src/` lists its contents). With recursive, a path also matches everything beneath it.
+func LsTree(treeHash string, paths []string, options LsTreeOptions, output io.Writer, repoDir string) error {
+	return lsTreeEntries(treeHash, "", paths, options, output, repoDir)
+}
+
+func lsTreeEntries(treeHash string, prefix string, paths []string, options LsTreeOptions, output io.Writer, repoDir string) error {
+	treeObj, err := ReadTreeObjectFile(treeHash, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read tree object file: %s", err)
+	}
+
+	for _, entry := range treeObj.entries {
+		path := prefix + entry.name
+		matched := lsTreePathMatches(path, paths, options.recursive)
+		isTree := entry.objType == Tree
+
+		// With -r, trees are only listed if -d is also given
+		show := matched && (isTree && (options.onlyTrees || !options.recursive) || !isTree && !options.onlyTrees)
+		if show {
+			line, err := formatLsTreeEntry(&entry, path, options, repoDir)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintln(output, line); err != nil {
+				return err
+			}
+		}
+
+		// A tree is descended into to list its entries recursively, or to reach the paths within it
+		if isTree && (options.recursive && matched || lsTreePathsWithin(path, paths)) {
+			if err := lsTreeEntries(entry.hash, path+"/", paths, options, output, repoDir); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns whether the entry at the given path is matched by any of the paths, or by default (if none are given)
+func lsTreePathMatches(entryPath string, paths []string, recursive bool) bool {
+	if len(paths) == 0 {
+		return true
+	}
+
+	for _, path := range paths {
+		switch {
+		case path == entryPath:
+			return true
+		case strings.HasSuffix(path, "/") && strings.HasPrefix(entryPath, path):
+			return true
+		case recursive && strings.HasPrefix(entryPath, path+"/"):
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether any of the paths are within the directory at the given path
+func lsTreePathsWithin(dirPath string, paths []string) bool {
+	for _, path := range paths {
+		if strings.HasPrefix(path, dirPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Formats the entry as a line of ls-tree's output, e.g. `100644 blob <hash>\tpath`. With -l, the size of a blob is
+// given before the path, right-aligned, with trees and submodules (which have no size) given a size of -.
+func formatLsTreeEntry(entry *TreeObjectEntry, path string, options LsTreeOptions, repoDir string) (string, error) {
+	if options.nameOnly {
+		return path, nil
+	}
+	if !options.long {
+		return fmt.Sprintf("%s %s %s\t%s", entry.mode.toPaddedString(), entry.objType.toString(), entry.hash, path), nil
+	}
+
+	size := "-"
+	if entry.objType == Blob {
+		_, sizeBytes, reader, err := openObjectFile(entry.hash, repoDir)
+		if err != nil {
+			return "", fmt.Errorf("failed to read size of blob %s: %s", entry.hash, err)
+		}
+		reader.Close()
+		size = fmt.Sprint(sizeBytes)
+	}
+	return fmt.Sprintf("%s %s %s %7s\t%s", entry.mode.toPaddedString(), entry.objType.toString(), entry.hash, size, path), nil
+}
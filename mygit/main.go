@@ -6,24 +6,24 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 
 	"github.com/joho/godotenv"
 )
 
 func configureLogger() {
 	log.SetFlags(0)
+	log.SetOutput(TraceLogWriter{})
 }
 
+// Loads environment variables (such as GIT_USERNAME and GIT_TOKEN) from a .env file in the current directory or its
+// parent, if there is one. Without one, credentials for remote repositories are found as Git finds them, when they're
+// first needed (see getCredential).
 func initEnvironmentVariables() {
 	if err := godotenv.Load(".env"); err == nil {
 		return
 	}
-
-	if err := godotenv.Load("../.env"); err == nil {
-		return
-	}
-
-	log.Fatal("Error: no .env file found. Please create one with GIT_USERNAME and GIT_TOKEN (personal access token) set in either the current directory or parent directory. If you only want to work with public repositories, you can set dummy values.")
+	godotenv.Load("../.env")
 }
 
 func copyRunSh(repoDir string) error {
@@ -65,19 +65,63 @@ func getRepoDir() string {
 	return repoDir
 }
 
+// Commands which operate on the working tree, and so can't be run in a bare repository
+var WORK_TREE_COMMANDS = []string{"write-working-tree", "add", "reset", "status", "diff", "commit", "pull", "merge", "am", "apply", "checkout", "checkout-index"}
+
+// Finds the repository containing the current directory which the command operates on, returning its top-level
+// directory
+func findRepoDir(cwd string, command string) string {
+	repo, err := discoverRepo(cwd)
+	if err != nil {
+		log.Fatalf("Failed to find Git repository: %s\n", err)
+	}
+	if repo == nil {
+		log.Fatal("Not a Git repository (or any of the parent directories): .git")
+	}
+
+	if !repo.hasWorkTree && slices.Contains(WORK_TREE_COMMANDS, command) {
+		log.Fatalf("Cannot run %s without a working tree (e.g. in a bare repository)\n", command)
+	}
+
+	return filepath.Clean(repo.repoDir) + string(filepath.Separator)
+}
+
+// Removes any temporary and lock files left behind in the repository by crashed commands, like `git gc --auto`
+// does for stale temporary files. Failing to do so isn't fatal, since the command may not need them removed.
+func cleanUpAfterCrashes(repoDir string) {
+	gitDir := getGitDir(repoDir)
+	if info, err := os.Stat(gitDir); err != nil || !info.IsDir() {
+		return
+	}
+
+	if _, err := cleanStaleTempFiles(gitDir); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to clean up stale temporary files: %s\n", err)
+	}
+}
+
 // Usage: ./run.sh <command> [<args>...]
 func main() {
 	configureLogger()
 	initEnvironmentVariables()
 	flag.Parse()
-
-	repoDir := getRepoDir()
+	// Options given before the command apply to the whole run, e.g. `--trace-json=<path> commit`
+	os.Args = append(os.Args[0:1], flag.Args()...)
+	startTrace(*TraceJSON, os.Args)
 
 	if len(os.Args) < 2 {
 		fmt.Fprintf(os.Stderr, "Usage: ./run.sh <command> [<args>...]\n")
-		os.Exit(1)
+		exit(1)
+	}
+
+	// New repositories are created relative to the current directory rather than any repository containing it
+	repoDir := getRepoDir()
+	if command := os.Args[1]; command != "init" && command != "clone" && command != "synth-repo" {
+		repoDir = findRepoDir(repoDir, command)
 	}
 
+	installInterruptCleanup()
+	cleanUpAfterCrashes(repoDir)
+
 	switch command := os.Args[1]; command {
 	case "init":
 		InitHandler(repoDir)
@@ -93,16 +137,50 @@ func main() {
 		WriteWorkingTreeHandler(repoDir)
 	case "commit-tree":
 		CommitTreeHandler(repoDir)
+	case "mktree":
+		MktreeHandler(repoDir)
+	case "mktag":
+		MktagHandler(repoDir)
 	case "clone":
 		CloneHandler()
 	case "ls-files":
 		LsFilesHandler(repoDir)
+	case "read-tree":
+		ReadTreeHandler(repoDir)
+	case "checkout-index":
+		CheckoutIndexHandler(repoDir)
+	case "update-index":
+		UpdateIndexHandler(repoDir)
 	case "add":
 		AddHandler(repoDir)
 	case "reset":
 		ResetHandler(repoDir)
 	case "status":
 		StatusHandler(repoDir)
+	case "diff":
+		DiffHandler(repoDir)
+	case "blame":
+		BlameHandler(repoDir)
+	case "merge-base":
+		MergeBaseHandler(repoDir)
+	case "rev-list":
+		RevListHandler(repoDir)
+	case "merge-file":
+		MergeFileHandler(repoDir)
+	case "merge":
+		MergeHandler(repoDir)
+	case "describe":
+		DescribeHandler(repoDir)
+	case "log":
+		LogHandler(repoDir)
+	case "shortlog":
+		ShortlogHandler(repoDir)
+	case "format-patch":
+		FormatPatchHandler(repoDir)
+	case "am":
+		AmHandler(repoDir)
+	case "apply":
+		ApplyHandler(repoDir)
 	case "commit":
 		CommitHandler(repoDir)
 	case "push":
@@ -111,8 +189,39 @@ func main() {
 		PullHandler(repoDir)
 	case "checkout":
 		CheckoutHandler(repoDir)
+	case "switch":
+		SwitchHandler(repoDir)
+	case "branch":
+		BranchHandler(repoDir)
+	case "remote":
+		RemoteHandler(repoDir)
+	case "submodule":
+		SubmoduleHandler(repoDir)
+	case "bundle":
+		BundleHandler(repoDir)
+	case "archive":
+		ArchiveHandler(repoDir)
+	case "pack-refs":
+		PackRefsHandler(repoDir)
+	case "for-each-ref":
+		ForEachRefHandler(repoDir)
+	case "update-ref":
+		UpdateRefHandler(repoDir)
+	case "symbolic-ref":
+		SymbolicRefHandler(repoDir)
+	case "migrate-from-git":
+		MigrateFromGitHandler(repoDir)
+	case "doctor":
+		DoctorHandler(repoDir)
+	case "config":
+		ConfigHandler(repoDir)
+	case "synth-repo":
+		SynthRepoHandler(repoDir)
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
-		os.Exit(1)
+		exit(1)
 	}
+
+	stopPager()
+	trace.exit(0)
 }
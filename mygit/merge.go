@@ -0,0 +1,537 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Represents the options for merging a commit into HEAD
+type MergeOptions struct {
+	message         string // The merge commit's message, rather than one naming the merged revision
+	noFastForward   bool   // Creates a merge commit even if HEAD could be fast-forwarded
+	fastForwardOnly bool   // Refuses to merge unless HEAD can be fast-forwarded
+}
+
+// Represents the result of merging the files of two commits against those of their merge base
+type TreeMerge struct {
+	files     map[string]*DiffFileVersion   // The merged files, with each conflicted file as it's left in the working tree
+	conflicts map[string][]*DiffFileVersion // The base, ours, and theirs versions of each conflicted file (nil if absent)
+	messages  []string                      // The messages describing the merge of each file, as Git prints them
+}
+
+// Merges the given revision into HEAD, as git merge does. HEAD is fast-forwarded to the revision if it's an ancestor
+// of it (unless noFastForward is set). Otherwise, the changes made on each side since their merge base are combined
+// file by file (see mergeTrees), and recorded in a merge commit with HEAD and the revision as its parents. If any
+// changes conflict, no commit is made: the conflicted files are instead left in the working tree with conflict
+// markers, and recorded in the index at stages 1 (base), 2 (ours), and 3 (theirs), to be resolved and committed,
+// while MERGE_HEAD and MERGE_MSG record the merge as in progress (see writeMergeState). Either way, the commit HEAD was
+// at is recorded as ORIG_HEAD. Returns whether the merge is complete, i.e. had no conflicts.
+func Merge(revision string, options MergeOptions, repoDir string) (bool, error) {
+	headCommitHash, commitsExist, err := ResolveHead("", repoDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve HEAD: %s", err)
+	}
+	if !commitsExist {
+		return false, fmt.Errorf("merging into a branch with no commits is not supported")
+	}
+	if mergeHeads, err := readPseudoRef("MERGE_HEAD", repoDir); err != nil || len(mergeHeads) > 0 {
+		if err != nil {
+			return false, err
+		}
+		return false, fmt.Errorf("you have not concluded your merge (MERGE_HEAD exists); commit your changes before you merge")
+	}
+
+	refName, _, err := resolveRevision(revision, repoDir)
+	if err != nil {
+		return false, err
+	}
+	mergeCommitHash, err := resolveCommitish(revision, repoDir)
+	if err != nil {
+		return false, err
+	}
+
+	alreadyMerged, err := isAncestorCommit(mergeCommitHash, headCommitHash, repoDir)
+	if err != nil {
+		return false, err
+	}
+	if alreadyMerged {
+		fmt.Println("Already up to date.")
+		return true, nil
+	}
+
+	canFastForward, err := isAncestorCommit(headCommitHash, mergeCommitHash, repoDir)
+	if err != nil {
+		return false, err
+	}
+	if canFastForward && !options.noFastForward {
+		return true, fastForwardMerge(headCommitHash, mergeCommitHash, repoDir)
+	}
+	if options.fastForwardOnly {
+		return false, fmt.Errorf("not possible to fast-forward")
+	}
+
+	// As in Git, the changes staged in the index must be committed (or stashed) first, since they'd be lost otherwise
+	headFiles, err := getHeadDiffFiles(repoDir)
+	if err != nil {
+		return false, err
+	}
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to read Git index file: %s", err)
+	}
+	if len(getUnmergedPaths(index.entries)) > 0 {
+		return false, fmt.Errorf("you need to resolve your current index first")
+	}
+	stagedPaths := []string{}
+	for _, change := range diffFileSets(headFiles, getIndexDiffFiles(index)) {
+		stagedPaths = append(stagedPaths, change.path)
+	}
+	if len(stagedPaths) > 0 {
+		return false, fmt.Errorf("your local changes to the following files would be overwritten by merge:\n\t%s\nPlease commit your changes or stash them before you merge.", strings.Join(stagedPaths, "\n\t"))
+	}
+
+	baseHashes, err := MergeBases(headCommitHash, []string{mergeCommitHash}, repoDir)
+	if err != nil {
+		return false, err
+	}
+	if len(baseHashes) == 0 {
+		return false, fmt.Errorf("refusing to merge unrelated histories")
+	}
+	// Unlike Git, which merges several merge bases (left by criss-cross merges) into a virtual one, the most recent
+	// merge base is used
+	baseFiles, err := getCommitDiffFiles(baseHashes[0], repoDir)
+	if err != nil {
+		return false, err
+	}
+	mergeFiles, err := getCommitDiffFiles(mergeCommitHash, repoDir)
+	if err != nil {
+		return false, err
+	}
+
+	style, err := getConflictStyle("", repoDir)
+	if err != nil {
+		return false, err
+	}
+	algorithm, err := getDiffAlgorithm("", repoDir)
+	if err != nil {
+		return false, err
+	}
+	fileOptions := MergeFileOptions{
+		style:       style,
+		oursLabel:   "HEAD",
+		baseLabel:   abbreviateHash(baseHashes[0]),
+		theirsLabel: revision,
+		diffOptions: DiffOptions{algorithm: algorithm},
+	}
+	treeMerge, err := mergeTrees(baseFiles, headFiles, mergeFiles, fileOptions, repoDir)
+	if err != nil {
+		return false, err
+	}
+
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return false, err
+	}
+	if err := writeOrigHead(headCommitHash, repoDir); err != nil {
+		return false, err
+	}
+	if err := checkoutTreeFiles(headFiles, treeMerge.files, false, "merge", converter, repoDir); err != nil {
+		return false, err
+	}
+
+	for _, message := range treeMerge.messages {
+		fmt.Println(message)
+	}
+
+	message := options.message
+	if message == "" {
+		if message, err = getMergeMessage(revision, refName, repoDir); err != nil {
+			return false, err
+		}
+	}
+	message = cleanupCommitMessage(message, false)
+
+	if len(treeMerge.conflicts) > 0 {
+		if err := recordMergeConflicts(treeMerge.conflicts, repoDir); err != nil {
+			return false, err
+		}
+
+		// As in Git, the conflicted files are listed in the message as comments, which are removed when it's committed
+		conflictedPaths := []string{}
+		for path := range treeMerge.conflicts {
+			conflictedPaths = append(conflictedPaths, path)
+		}
+		sort.Strings(conflictedPaths)
+		mergeMessage := fmt.Sprintf("%s\n# Conflicts:\n#\t%s\n", message, strings.Join(conflictedPaths, "\n#\t"))
+		if err := writeMergeState([]string{mergeCommitHash}, mergeMessage, options.noFastForward, repoDir); err != nil {
+			return false, err
+		}
+
+		fmt.Println("Automatic merge failed; fix conflicts and then commit the result.")
+		return false, nil
+	}
+
+	treeHash, err := createTreeObjectFromFiles(treeMerge.files, repoDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to create merged tree: %s", err)
+	}
+	author, err := getCommitUser(CommitAuthor, repoDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to determine author: %s", err)
+	}
+	committer, err := getCommitUser(CommitCommitter, repoDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to determine committer: %s", err)
+	}
+	commitObj, err := createCommitObject(treeHash, []string{headCommitHash, mergeCommitHash}, *author, *committer, message, repoDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to create merge commit: %s", err)
+	}
+	if err := UpdateRef("HEAD", commitObj.hash, headCommitHash, repoDir); err != nil {
+		return false, fmt.Errorf("failed to update current branch reference: %s", err)
+	}
+
+	if err := printMergeStat(headFiles, treeMerge.files, repoDir); err != nil {
+		return false, err
+	}
+	runPostMergeHook(repoDir)
+	return true, nil
+}
+
+// Fast-forwards HEAD (and the current branch) to the given descendant commit, checking out its files
+func fastForwardMerge(headCommitHash string, mergeCommitHash string, repoDir string) error {
+	mergeCommitObj, err := ReadCommitObjectFile(mergeCommitHash, repoDir)
+	if err != nil {
+		return err
+	}
+	if err := prefetchTreeBlobs(mergeCommitObj.treeHash, repoDir); err != nil {
+		return err
+	}
+
+	headFiles, err := getCommitDiffFiles(headCommitHash, repoDir)
+	if err != nil {
+		return err
+	}
+	mergeFiles, err := getCommitDiffFiles(mergeCommitHash, repoDir)
+	if err != nil {
+		return err
+	}
+	converter, err := newTreeContentConverter(mergeCommitObj.treeHash, repoDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Updating %s..%s\n", abbreviateHash(headCommitHash), abbreviateHash(mergeCommitHash))
+	if err := writeOrigHead(headCommitHash, repoDir); err != nil {
+		return err
+	}
+	if err := checkoutTreeFiles(headFiles, mergeFiles, false, "merge", converter, repoDir); err != nil {
+		return err
+	}
+	if err := UpdateRef("HEAD", mergeCommitHash, headCommitHash, repoDir); err != nil {
+		return fmt.Errorf("failed to update current branch reference: %s", err)
+	}
+
+	fmt.Println("Fast-forward")
+	if err := printMergeStat(headFiles, mergeFiles, repoDir); err != nil {
+		return err
+	}
+	runPostMergeHook(repoDir)
+	return nil
+}
+
+// Abandons the merge in progress, as git merge --abort does. Every file which the merge changed (i.e. whose index
+// entry differs from HEAD's version, or is unmerged) is reset to HEAD's version in the index and working tree, and
+// MERGE_HEAD and MERGE_MSG are removed. Since a merge can only be started without staged changes, any other file is
+// left as it is, along with any unstaged changes to it from before the merge.
+func AbortMerge(repoDir string) error {
+	mergeHeads, err := readPseudoRef("MERGE_HEAD", repoDir)
+	if err != nil {
+		return err
+	}
+	if len(mergeHeads) == 0 {
+		return fmt.Errorf("there is no merge to abort (MERGE_HEAD missing)")
+	}
+
+	headCommitHash, _, err := ResolveHead("", repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve HEAD: %s", err)
+	}
+	headCommitObj, err := ReadCommitObjectFile(headCommitHash, repoDir)
+	if err != nil {
+		return err
+	}
+	headFiles, err := getCommitDiffFiles(headCommitHash, repoDir)
+	if err != nil {
+		return err
+	}
+	converter, err := newTreeContentConverter(headCommitObj.treeHash, repoDir)
+	if err != nil {
+		return err
+	}
+
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read Git index file: %s", err)
+	}
+
+	newEntries := []*IndexEntry{}
+	unchangedPaths := make(map[string]bool)
+	resetPaths := make(map[string]bool)
+	for _, entry := range index.entries {
+		entryFile := &DiffFileVersion{hash: hex.EncodeToString(entry.sha1[:]), mode: entry.mode}
+		if entry.stage() == 0 && isSameFileVersion(entryFile, headFiles[entry.path]) {
+			newEntries = append(newEntries, entry)
+			unchangedPaths[entry.path] = true
+			continue
+		}
+
+		// A file which the merge added is removed, as it's not in HEAD
+		if headFiles[entry.path] == nil && !resetPaths[entry.path] {
+			if err := removeIndexEntryFile(entry, repoDir); err != nil {
+				return err
+			}
+		}
+		resetPaths[entry.path] = true
+	}
+	for path, file := range headFiles {
+		if !unchangedPaths[path] {
+			newEntries = append(newEntries, newTreeIndexEntry(path, file, 0))
+			resetPaths[path] = true
+		}
+	}
+
+	options := CheckoutIndexOptions{force: true, refresh: true}
+	if _, err := checkoutIndexEntries(newEntries, resetPaths, options, converter, repoDir); err != nil {
+		return err
+	}
+	if err := writeUpdatedIndex(indexLock, index, newEntries); err != nil {
+		return fmt.Errorf("failed to write updated Git index file: %s", err)
+	}
+	return removeMergeState(repoDir)
+}
+
+// Merges the files of two commits (ours and theirs) against those of their merge base. A file changed on only one
+// side since the base is taken from that side, and a file changed the same way on both is taken as it is. A text file
+// changed differently on both sides has its changes merged line by line (see mergeFileContents), and is conflicted if
+// any of them conflict, in which case it's left with conflict markers. Any other file changed on both sides (e.g.
+// modified on one side and deleted on the other, or a binary file) is conflicted, and left as it is on whichever side
+// still has it (ours, if both do).
+func mergeTrees(baseFiles map[string]*DiffFileVersion, oursFiles map[string]*DiffFileVersion, theirsFiles map[string]*DiffFileVersion, options MergeFileOptions, repoDir string) (*TreeMerge, error) {
+	paths := []string{}
+	seenPaths := make(map[string]bool)
+	for _, files := range []map[string]*DiffFileVersion{baseFiles, oursFiles, theirsFiles} {
+		for path := range files {
+			if !seenPaths[path] {
+				seenPaths[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	treeMerge := &TreeMerge{
+		files:     make(map[string]*DiffFileVersion),
+		conflicts: make(map[string][]*DiffFileVersion),
+		messages:  []string{},
+	}
+	for _, path := range paths {
+		baseFile, oursFile, theirsFile := baseFiles[path], oursFiles[path], theirsFiles[path]
+
+		var merged *DiffFileVersion
+		conflicted := false
+		switch {
+		case isSameFileVersion(oursFile, theirsFile) || isSameFileVersion(baseFile, theirsFile):
+			merged = oursFile
+		case isSameFileVersion(baseFile, oursFile):
+			merged = theirsFile
+		case oursFile == nil || theirsFile == nil:
+			// The modified version is left in the working tree
+			merged, conflicted = theirsFile, true
+			deletedLabel, modifiedLabel := options.oursLabel, options.theirsLabel
+			if oursFile != nil {
+				merged = oursFile
+				deletedLabel, modifiedLabel = modifiedLabel, deletedLabel
+			}
+			treeMerge.messages = append(treeMerge.messages, fmt.Sprintf("CONFLICT (modify/delete): %s deleted in %s and modified in %s.  Version %s of %s left in tree.", path, deletedLabel, modifiedLabel, modifiedLabel, path))
+		default:
+			var err error
+			merged, conflicted, err = mergeTreeFile(path, baseFile, oursFile, theirsFile, options, treeMerge, repoDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if merged != nil {
+			treeMerge.files[path] = merged
+		}
+		if conflicted {
+			treeMerge.conflicts[path] = []*DiffFileVersion{baseFile, oursFile, theirsFile}
+		}
+	}
+
+	return treeMerge, nil
+}
+
+// Merges a file changed differently on both sides of a merge, returning its merged version and whether it's
+// conflicted. Messages describing the merge are added to treeMerge.
+func mergeTreeFile(path string, baseFile *DiffFileVersion, oursFile *DiffFileVersion, theirsFile *DiffFileVersion, options MergeFileOptions, treeMerge *TreeMerge, repoDir string) (*DiffFileVersion, bool, error) {
+	conflictType := "content"
+	if baseFile == nil {
+		conflictType = "add/add"
+	}
+	conflictMessage := fmt.Sprintf("CONFLICT (%s): Merge conflict in %s", conflictType, path)
+	treeMerge.messages = append(treeMerge.messages, "Auto-merging "+path)
+
+	// Only regular files can have their content merged
+	if !isRegularFileMode(oursFile.mode) || !isRegularFileMode(theirsFile.mode) || (baseFile != nil && !isRegularFileMode(baseFile.mode)) {
+		treeMerge.messages = append(treeMerge.messages, conflictMessage)
+		return oursFile, true, nil
+	}
+
+	// As in Git, the merged file's mode is merged separately from its content
+	mode, modeConflicted := oursFile.mode, false
+	switch {
+	case oursFile.mode == theirsFile.mode:
+	case baseFile != nil && baseFile.mode == oursFile.mode:
+		mode = theirsFile.mode
+	case baseFile != nil && baseFile.mode == theirsFile.mode:
+	default:
+		modeConflicted = true
+	}
+
+	contents := make([][]byte, 3)
+	for i, file := range []*DiffFileVersion{baseFile, oursFile, theirsFile} {
+		if file == nil {
+			continue
+		}
+		blobObj, err := ReadBlobObjectFile(file.hash, repoDir)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read %s: %s", path, err)
+		}
+		contents[i] = blobObj.content
+	}
+	if isBinaryContent(contents[0]) || isBinaryContent(contents[1]) || isBinaryContent(contents[2]) {
+		treeMerge.messages = append(treeMerge.messages, fmt.Sprintf("warning: Cannot merge binary files: %s (%s vs. %s)", path, options.oursLabel, options.theirsLabel), conflictMessage)
+		return oursFile, true, nil
+	}
+
+	merged, numConflicts := mergeFileContents(contents[0], contents[1], contents[2], options)
+	mergedHash, err := CreateObjectFile(Blob, merged, repoDir)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to write merged %s: %s", path, err)
+	}
+
+	if numConflicts > 0 || modeConflicted {
+		treeMerge.messages = append(treeMerge.messages, conflictMessage)
+		return &DiffFileVersion{hash: mergedHash, mode: mode}, true, nil
+	}
+	return &DiffFileVersion{hash: mergedHash, mode: mode}, false, nil
+}
+
+// Returns whether the mode is that of a regular (non-executable or executable) file
+func isRegularFileMode(mode FileMode) bool {
+	return mode == REGULAR_FILE_MODE || mode == EXECUTABLE_FILE_MODE
+}
+
+// Replaces the index entries of the conflicted files with entries at stage 1 for the base version, stage 2 for ours,
+// and stage 3 for theirs, for whichever of them contain the file, so that the files are unmerged until resolved
+func recordMergeConflicts(conflicts map[string][]*DiffFileVersion, repoDir string) error {
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return err
+	}
+
+	newEntries := []*IndexEntry{}
+	for _, entry := range index.entries {
+		if conflicts[entry.path] == nil {
+			newEntries = append(newEntries, entry)
+		}
+	}
+	for path, versions := range conflicts {
+		for i, file := range versions {
+			if file != nil {
+				newEntries = append(newEntries, newTreeIndexEntry(path, file, i+1))
+			}
+		}
+	}
+
+	if err := writeUpdatedIndex(indexLock, index, newEntries); err != nil {
+		return fmt.Errorf("failed to write updated Git index file: %s", err)
+	}
+	return nil
+}
+
+// Returns the default message of a commit merging the revision (found through the given ref, if any), as Git words it,
+// e.g. "Merge branch 'topic'". As in Git, the message names the current branch too, unless it's main or master.
+// Merging FETCH_HEAD names the branch that was fetched, along with where it was fetched from.
+func getMergeMessage(revision string, refName string, repoDir string) (string, error) {
+	var message string
+	if refName == "FETCH_HEAD" {
+		fetchHead, err := os.ReadFile(filepath.Join(getGitDir(repoDir), "FETCH_HEAD"))
+		if err != nil {
+			return "", fmt.Errorf("failed to read FETCH_HEAD: %s", err)
+		}
+		firstLine, _, _ := strings.Cut(string(fetchHead), "\n")
+		fields := strings.SplitN(firstLine, "\t", 3)
+		if len(fields) < 3 {
+			return "", fmt.Errorf("invalid FETCH_HEAD: %s", firstLine)
+		}
+		message = "Merge " + fields[2]
+	} else if branchName, isBranch := strings.CutPrefix(refName, "refs/heads/"); isBranch {
+		message = fmt.Sprintf("Merge branch '%s'", branchName)
+	} else if remoteBranchName, isRemoteBranch := strings.CutPrefix(refName, "refs/remotes/"); isRemoteBranch {
+		message = fmt.Sprintf("Merge remote-tracking branch '%s'", strings.TrimSuffix(remoteBranchName, "/HEAD"))
+	} else if tagName, isTag := strings.CutPrefix(refName, "refs/tags/"); isTag {
+		message = fmt.Sprintf("Merge tag '%s'", tagName)
+	} else {
+		message = fmt.Sprintf("Merge commit '%s'", revision)
+	}
+
+	currBranch, err := getStatusBranch(repoDir)
+	if err != nil {
+		return "", err
+	}
+	switch currBranch {
+	case "main", "master":
+	case "":
+		message += " into HEAD"
+	default:
+		message += " into " + currBranch
+	}
+	return message, nil
+}
+
+// Prints the diffstat of the changes which a merge made to HEAD's files
+func printMergeStat(oldFiles map[string]*DiffFileVersion, newFiles map[string]*DiffFileVersion, repoDir string) error {
+	summary, err := summarizeDiffChanges(diffFileSets(oldFiles, newFiles), DiffOptions{}, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to summarize merged changes: %s", err)
+	}
+	fmt.Print(summary.stat(LOG_STAT_WIDTH))
+	return nil
+}
+
+// Runs the post-merge hook after a merge updates the working tree. Its failure can't affect the outcome of the merge,
+// so it's only a warning.
+func runPostMergeHook(repoDir string) {
+	if err := runHook("post-merge", []string{"0"}, "", repoDir); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Finds the best common ancestors of the commit and any of the others, as git merge-base does: the commits reachable
+// from both the commit and one of the others which aren't ancestors of any other such commit. There's usually just
+// one, but criss-cross merges can leave several equally good ones. Returned are the merge bases, most recently
+// committed first, or none if the histories are unrelated.
+func MergeBases(commitHash string, otherHashes []string, repoDir string) ([]string, error) {
+	reachable, err := getReachableCommits(commitHash, false, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	otherReachable := make(map[string]bool)
+	for _, otherHash := range otherHashes {
+		currReachable, err := getReachableCommits(otherHash, false, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		for currHash := range currReachable {
+			otherReachable[currHash] = true
+		}
+	}
+
+	commonCommits := make(map[string]*CommitObject)
+	for currHash := range reachable {
+		if !otherReachable[currHash] {
+			continue
+		}
+		commitObj, err := ReadCommitObjectFile(currHash, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %s: %s", currHash, err)
+		}
+		commonCommits[currHash] = commitObj
+	}
+
+	// Every ancestor of a common commit is also common, so a common commit is an ancestor of another exactly when it's
+	// the parent of one
+	redundant := make(map[string]bool)
+	for _, commitObj := range commonCommits {
+		for _, parentHash := range commitObj.parentCommitHashes {
+			redundant[parentHash] = true
+		}
+	}
+
+	bases := []*CommitObject{}
+	for currHash, commitObj := range commonCommits {
+		if !redundant[currHash] {
+			bases = append(bases, commitObj)
+		}
+	}
+	sort.Slice(bases, func(i int, j int) bool {
+		if bases[i].committer.dateSeconds != bases[j].committer.dateSeconds {
+			return bases[i].committer.dateSeconds > bases[j].committer.dateSeconds
+		}
+		return bases[i].hash < bases[j].hash
+	})
+
+	baseHashes := make([]string, len(bases))
+	for i, base := range bases {
+		baseHashes[i] = base.hash
+	}
+	return baseHashes, nil
+}
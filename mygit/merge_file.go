@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+type ConflictStyle int
+
+const (
+	ConflictStyleMerge ConflictStyle = iota
+	ConflictStyleDiff3
+	ConflictStyleZdiff3
+)
+
+// The length of the <<<<<<<, |||||||, =======, and >>>>>>> markers written around each conflict
+const CONFLICT_MARKER_SIZE = 7
+
+// Parses the name of a conflict style, as given to merge.conflictStyle. `merge` shows our and their versions of each
+// conflicting hunk; `diff3` also shows the merge base's version, and `zdiff3` does too, but moves any lines common to
+// both sides at the start and end of the hunk out of the conflict.
+func parseConflictStyle(name string) (ConflictStyle, error) {
+	switch strings.ToLower(name) {
+	case "merge":
+		return ConflictStyleMerge, nil
+	case "diff3":
+		return ConflictStyleDiff3, nil
+	case "zdiff3":
+		return ConflictStyleZdiff3, nil
+	default:
+		return -1, fmt.Errorf("unknown style '%s' given for 'merge.conflictstyle'", name)
+	}
+}
+
+// Returns the conflict style to use: the one named on the command line if any, or else the one named by the
+// merge.conflictStyle config variable, or else merge
+func getConflictStyle(name string, repoDir string) (ConflictStyle, error) {
+	if name == "" {
+		config, err := readConfig(repoDir)
+		if err != nil {
+			return -1, fmt.Errorf("failed to read config: %s", err)
+		}
+
+		configName, isSet := config.get("merge.conflictStyle")
+		if !isSet {
+			return ConflictStyleMerge, nil
+		}
+		name = configName
+	}
+
+	return parseConflictStyle(name)
+}
+
+// The greatest number of lines which may separate two conflicts for them to be joined into one, as in Git
+const CONFLICT_JOIN_DISTANCE = 3
+
+type MergeFileOptions struct {
+	style        ConflictStyle
+	oursLabel    string // Written after the <<<<<<< marker
+	baseLabel    string // Written after the ||||||| marker
+	theirsLabel  string // Written after the >>>>>>> marker
+	diffOptions  DiffOptions
+	joinNonAlnum bool // Whether conflicts separated only by lines without letters or digits are joined, however many
+}
+
+// Represents a run of lines changed on one side of a merge, as the range of the merge base's lines it replaces and the
+// range of the side's lines it replaces them with (end exclusive). A pure insertion replaces an empty range.
+type mergeChange struct {
+	baseStart int
+	baseEnd   int
+	sideStart int
+	sideEnd   int
+}
+
+// Represents a run of lines in the result of a merge: either lines which were merged cleanly, or a conflict between
+// our and their versions of some of the base's lines
+type mergeSegment struct {
+	conflict    bool
+	lines       []string // The merged lines, if there's no conflict
+	baseLines   []string
+	oursLines   []string
+	theirsLines []string
+}
+
+// Merges the changes made to the base's lines by ours and theirs, as git merge-file does, returning the merged content
+// along with the number of conflicts. Each side's changes are found by diffing it against the base. Changes which
+// don't touch any made by the other side are applied as they are, as are changes made identically on both sides.
+// Changes which overlap (or are adjacent to) different changes made by the other side conflict: both versions of the
+// lines are written between conflict markers, in the given style. As in Git, the merge style narrows each conflict
+// down to the lines which actually differ between ours and theirs, splitting it up where they agree, but then joins
+// back up conflicts which are only a few lines apart, so that they're easier to read.
+func mergeFileContents(baseContent []byte, oursContent []byte, theirsContent []byte, options MergeFileOptions) ([]byte, int) {
+	baseLines, oursLines, theirsLines := splitLines(baseContent), splitLines(oursContent), splitLines(theirsContent)
+	oursChanges := getMergeChanges(baseLines, oursLines, options.diffOptions)
+	theirsChanges := getMergeChanges(baseLines, theirsLines, options.diffOptions)
+
+	segments := []*mergeSegment{}
+	basePos, i, j := 0, 0, 0
+	for i < len(oursChanges) || j < len(theirsChanges) {
+		// The region starts with the earliest change, and grows to take in every change which touches it on either side
+		regionStart := len(baseLines)
+		if i < len(oursChanges) {
+			regionStart = oursChanges[i].baseStart
+		}
+		if j < len(theirsChanges) {
+			regionStart = min(regionStart, theirsChanges[j].baseStart)
+		}
+		regionEnd := regionStart
+		firstOurs, firstTheirs := i, j
+		for {
+			if i < len(oursChanges) && oursChanges[i].baseStart <= regionEnd {
+				regionEnd = max(regionEnd, oursChanges[i].baseEnd)
+				i += 1
+			} else if j < len(theirsChanges) && theirsChanges[j].baseStart <= regionEnd {
+				regionEnd = max(regionEnd, theirsChanges[j].baseEnd)
+				j += 1
+			} else {
+				break
+			}
+		}
+
+		segments = append(segments, &mergeSegment{lines: baseLines[basePos:regionStart]})
+		baseRegion := baseLines[regionStart:regionEnd]
+		oursRegion := getMergeRegionLines(oursChanges[firstOurs:i], oursLines, baseLines, regionStart, regionEnd)
+		theirsRegion := getMergeRegionLines(theirsChanges[firstTheirs:j], theirsLines, baseLines, regionStart, regionEnd)
+
+		switch {
+		case i == firstOurs:
+			segments = append(segments, &mergeSegment{lines: theirsRegion})
+		case j == firstTheirs || slices.Equal(oursRegion, theirsRegion):
+			segments = append(segments, &mergeSegment{lines: oursRegion})
+		default:
+			segments = append(segments, splitMergeConflict(baseRegion, oursRegion, theirsRegion, options)...)
+		}
+		basePos = regionEnd
+	}
+	segments = append(segments, &mergeSegment{lines: baseLines[basePos:]})
+
+	if options.style == ConflictStyleMerge {
+		segments = joinMergeConflicts(segments, options.joinNonAlnum)
+	}
+
+	var sb strings.Builder
+	numConflicts := 0
+	for _, segment := range segments {
+		if segment.conflict {
+			writeConflictMarkers(&sb, segment, options)
+			numConflicts += 1
+		} else {
+			sb.WriteString(strings.Join(segment.lines, ""))
+		}
+	}
+	return []byte(sb.String()), numConflicts
+}
+
+// Returns the runs of lines changed by the side, found by diffing it against the base
+func getMergeChanges(baseLines []string, sideLines []string, diffOptions DiffOptions) []*mergeChange {
+	changes := []*mergeChange{}
+	var currChange *mergeChange
+	basePos, sidePos := 0, 0
+	for _, op := range diffLines(baseLines, sideLines, diffOptions) {
+		if op.opType == DiffEqual {
+			currChange = nil
+			basePos, sidePos = basePos+1, sidePos+1
+			continue
+		}
+
+		if currChange == nil {
+			currChange = &mergeChange{baseStart: basePos, baseEnd: basePos, sideStart: sidePos, sideEnd: sidePos}
+			changes = append(changes, currChange)
+		}
+		if op.opType == DiffDelete {
+			basePos += 1
+			currChange.baseEnd = basePos
+		} else {
+			sidePos += 1
+			currChange.sideEnd = sidePos
+		}
+	}
+	return changes
+}
+
+// Returns the side's version of the region of the base's lines, given the side's changes within the region. Around
+// its changes, the side's lines are the same as the base's.
+func getMergeRegionLines(changes []*mergeChange, sideLines []string, baseLines []string, regionStart int, regionEnd int) []string {
+	if len(changes) == 0 {
+		return baseLines[regionStart:regionEnd]
+	}
+	first, last := changes[0], changes[len(changes)-1]
+	return sideLines[first.sideStart-(first.baseStart-regionStart) : last.sideEnd+(regionEnd-last.baseEnd)]
+}
+
+// Splits the conflict between our and their versions of a region into segments according to the style. With the
+// merge style, the versions are diffed against each other, so that lines on which they agree are merged, leaving only
+// the lines which differ in conflicts; with zdiff3, only the lines they agree on at the start and end of the region
+// are. With diff3, the whole region is left as one conflict, so that the base's version of it can be shown.
+func splitMergeConflict(baseRegion []string, oursRegion []string, theirsRegion []string, options MergeFileOptions) []*mergeSegment {
+	switch options.style {
+	case ConflictStyleDiff3:
+		return []*mergeSegment{{conflict: true, baseLines: baseRegion, oursLines: oursRegion, theirsLines: theirsRegion}}
+
+	case ConflictStyleZdiff3:
+		prefixLength := 0
+		for prefixLength < len(oursRegion) && prefixLength < len(theirsRegion) && oursRegion[prefixLength] == theirsRegion[prefixLength] {
+			prefixLength += 1
+		}
+		suffixLength := 0
+		for suffixLength < len(oursRegion)-prefixLength && suffixLength < len(theirsRegion)-prefixLength &&
+			oursRegion[len(oursRegion)-1-suffixLength] == theirsRegion[len(theirsRegion)-1-suffixLength] {
+			suffixLength += 1
+		}
+
+		return []*mergeSegment{
+			{lines: oursRegion[:prefixLength]},
+			{
+				conflict:    true,
+				baseLines:   baseRegion,
+				oursLines:   oursRegion[prefixLength : len(oursRegion)-suffixLength],
+				theirsLines: theirsRegion[prefixLength : len(theirsRegion)-suffixLength],
+			},
+			{lines: oursRegion[len(oursRegion)-suffixLength:]},
+		}
+
+	default:
+		// As in Git, there's nothing to narrow down if one side has removed the region
+		if len(oursRegion) == 0 || len(theirsRegion) == 0 {
+			return []*mergeSegment{{conflict: true, baseLines: baseRegion, oursLines: oursRegion, theirsLines: theirsRegion}}
+		}
+
+		segments := []*mergeSegment{}
+		oursPos := 0
+		for _, change := range getMergeChanges(oursRegion, theirsRegion, options.diffOptions) {
+			segments = append(segments, &mergeSegment{lines: oursRegion[oursPos:change.baseStart]})
+			segments = append(segments, &mergeSegment{
+				conflict:    true,
+				oursLines:   oursRegion[change.baseStart:change.baseEnd],
+				theirsLines: theirsRegion[change.sideStart:change.sideEnd],
+			})
+			oursPos = change.baseEnd
+		}
+		return append(segments, &mergeSegment{lines: oursRegion[oursPos:]})
+	}
+}
+
+// Joins each pair of conflicts separated by no more than CONFLICT_JOIN_DISTANCE merged lines (or with joinNonAlnum, by
+// lines containing no letters or digits, such as blank lines and braces) into a single conflict, as Git does, since a
+// reader needs to consider them together anyway
+func joinMergeConflicts(segments []*mergeSegment, joinNonAlnum bool) []*mergeSegment {
+	joined := []*mergeSegment{}
+	for _, segment := range segments {
+		n := len(joined)
+		if !segment.conflict && n > 0 && !joined[n-1].conflict {
+			joined[n-1] = &mergeSegment{lines: slices.Concat(joined[n-1].lines, segment.lines)}
+			continue
+		}
+		joined = append(joined, segment)
+
+		n += 1
+		if !segment.conflict || n < 3 || !joined[n-3].conflict {
+			continue
+		}
+		gap := joined[n-2].lines
+		if len(gap) > CONFLICT_JOIN_DISTANCE && (!joinNonAlnum || slices.ContainsFunc(gap, containsAlnum)) {
+			continue
+		}
+
+		prev := joined[n-3]
+		joined[n-3] = &mergeSegment{
+			conflict:    true,
+			oursLines:   slices.Concat(prev.oursLines, gap, segment.oursLines),
+			theirsLines: slices.Concat(prev.theirsLines, gap, segment.theirsLines),
+		}
+		joined = joined[:n-2]
+	}
+	return joined
+}
+
+// Determines whether the line contains any letters or digits
+func containsAlnum(line string) bool {
+	return strings.ContainsFunc(line, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	})
+}
+
+// Writes a conflict: our version of the lines, the base's version (unless the style is merge), and their version,
+// separated by conflict markers. A version whose last line has no newline is given one, so that the marker after it
+// starts on its own line.
+func writeConflictMarkers(sb *strings.Builder, conflict *mergeSegment, options MergeFileOptions) {
+	writeMarker := func(char string, label string) {
+		sb.WriteString(strings.Repeat(char, CONFLICT_MARKER_SIZE))
+		if label != "" {
+			sb.WriteString(" " + label)
+		}
+		sb.WriteString("\n")
+	}
+	writeLines := func(lines []string) {
+		sb.WriteString(strings.Join(lines, ""))
+		if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+			sb.WriteString("\n")
+		}
+	}
+
+	writeMarker("<", options.oursLabel)
+	writeLines(conflict.oursLines)
+	if options.style != ConflictStyleMerge {
+		writeMarker("|", options.baseLabel)
+		writeLines(conflict.baseLines)
+	}
+	writeMarker("=", "")
+	writeLines(conflict.theirsLines)
+	writeMarker(">", options.theirsLabel)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+type MigrationCheckState int
+
+const (
+	MigrationOK MigrationCheckState = iota
+	MigrationAdapted
+	MigrationIncompatible
+)
+
+func (s MigrationCheckState) toString() string {
+	switch s {
+	case MigrationOK:
+		return "ok"
+	case MigrationAdapted:
+		return "adapted"
+	default:
+		return "incompatible"
+	}
+}
+
+// Represents the outcome of checking one aspect of a repository created by real Git for compatibility with mygit
+type MigrationCheck struct {
+	name    string
+	state   MigrationCheckState
+	details string
+}
+
+// Checks a repository created by real Git for anything that mygit can't read, adapting what it can. Objects stored
+// in packfiles are unpacked into loose object files (leaving the packfiles in place, so the repository remains
+// usable by real Git). Returns the outcome of each check, in the order they were made.
+func MigrateFromGit(repoDir string) ([]*MigrationCheck, error) {
+	commonDir := getCommonDir(repoDir)
+	if _, err := os.Stat(commonDir); err != nil {
+		return nil, fmt.Errorf("not a Git repository: %s", err)
+	}
+
+	checks := []*MigrationCheck{
+		checkMigrationConfig(repoDir),
+		checkMigrationFileAbsent(filepath.Join(commonDir, "shallow"), "shallow", "the repository is a shallow clone, so commits before the shallow boundary are missing"),
+		checkMigrationFileAbsent(filepath.Join(commonDir, "objects", "info", "alternates"), "alternates", "objects are borrowed from other repositories listed in objects/info/alternates"),
+		migratePackfiles(repoDir),
+		checkMigrationRefs(repoDir),
+		checkMigrationIndex(repoDir),
+	}
+
+	return checks, nil
+}
+
+func checkMigrationConfig(repoDir string) *MigrationCheck {
+	check := &MigrationCheck{name: "config", state: MigrationOK}
+
+	config, err := readRepoConfig(repoDir)
+	if err != nil {
+		check.state, check.details = MigrationIncompatible, err.Error()
+		return check
+	}
+
+	formatVersion, err := config.getInt("core.repositoryformatversion", 0)
+	if err != nil || formatVersion > 1 {
+		check.state, check.details = MigrationIncompatible, "unsupported core.repositoryFormatVersion"
+		return check
+	}
+
+	if isBare, err := config.getBool("core.bare", false); err != nil || isBare {
+		check.state, check.details = MigrationIncompatible, "bare repositories are not supported"
+		return check
+	}
+
+	// Repository format version 1 requires every extension to be understood, and none are implemented
+	extensions := []string{}
+	for _, entry := range config.entries {
+		if entry.section == "extensions" && !(entry.key == "objectformat" && strings.EqualFold(entry.value, "sha1")) {
+			extensions = append(extensions, fmt.Sprintf("%s=%s", entry.key, entry.value))
+		}
+	}
+	if formatVersion == 1 && len(extensions) > 0 {
+		check.state, check.details = MigrationIncompatible, fmt.Sprintf("unsupported repository extensions: %s", strings.Join(extensions, ", "))
+		return check
+	}
+
+	check.details = fmt.Sprintf("repository format version %d", formatVersion)
+	return check
+}
+
+func checkMigrationFileAbsent(path string, name string, details string) *MigrationCheck {
+	if _, err := os.Stat(path); err == nil {
+		return &MigrationCheck{name: name, state: MigrationIncompatible, details: details}
+	}
+	return &MigrationCheck{name: name, state: MigrationOK, details: "none"}
+}
+
+// Unpacks each packfile in .git/objects/pack/ into loose object files
+func migratePackfiles(repoDir string) *MigrationCheck {
+	check := &MigrationCheck{name: "packfiles", state: MigrationOK}
+
+	packPaths, err := filepath.Glob(filepath.Join(getCommonDir(repoDir), "objects", "pack", "*.pack"))
+	if err != nil {
+		check.state, check.details = MigrationIncompatible, err.Error()
+		return check
+	}
+	sort.Strings(packPaths)
+
+	if len(packPaths) == 0 {
+		check.details = "no packfiles"
+		return check
+	}
+
+	numObjects := 0
+	for _, packPath := range packPaths {
+		packName := filepath.Base(packPath)
+
+		// A promisor packfile comes from a partial clone, in which objects may be missing until fetched on demand
+		promisorPath := strings.TrimSuffix(packPath, ".pack") + ".promisor"
+		if _, err := os.Stat(promisorPath); err == nil {
+			check.state, check.details = MigrationIncompatible, fmt.Sprintf("%s is from a partial clone, which is not supported", packName)
+			return check
+		}
+
+		packfile, err := os.Open(packPath)
+		if err != nil {
+			check.state, check.details = MigrationIncompatible, fmt.Sprintf("failed to read %s: %s", packName, err)
+			return check
+		}
+
+		packStats, err := unpackPackfile(packfile, false, repoDir)
+		packfile.Close()
+		if err != nil {
+			check.state, check.details = MigrationIncompatible, fmt.Sprintf("failed to unpack %s: %s", packName, err)
+			return check
+		}
+		numObjects += packStats.numObjects
+	}
+
+	check.state = MigrationAdapted
+	check.details = fmt.Sprintf("unpacked %d %s from %d %s into loose object files", numObjects, pluralize(numObjects, "object", "objects"), len(packPaths), pluralize(len(packPaths), "packfile", "packfiles"))
+	return check
+}
+
+// Checks that HEAD and every loose and packed ref can be resolved to an object that mygit can read
+func checkMigrationRefs(repoDir string) *MigrationCheck {
+	check := &MigrationCheck{name: "refs", state: MigrationOK}
+
+	refHashes := make(map[string]string)
+	packedRefs, err := readPackedRefs(repoDir)
+	if err != nil {
+		check.state, check.details = MigrationIncompatible, err.Error()
+		return check
+	}
+	for refName, packedRef := range packedRefs {
+		refHashes[refName] = packedRef.hash
+	}
+
+	looseRefs, err := readLooseRefs(repoDir)
+	if err != nil {
+		check.state, check.details = MigrationIncompatible, err.Error()
+		return check
+	}
+	for _, looseRef := range looseRefs {
+		refHashes[looseRef.name] = looseRef.hash
+	}
+
+	headHash, headExists, err := ResolveHead("", repoDir)
+	if err != nil {
+		check.state, check.details = MigrationIncompatible, fmt.Sprintf("failed to resolve HEAD: %s", err)
+		return check
+	}
+	if headExists {
+		refHashes["HEAD"] = headHash
+	}
+
+	refNames := make([]string, 0, len(refHashes))
+	for refName := range refHashes {
+		refNames = append(refNames, refName)
+	}
+	sort.Strings(refNames)
+
+	unreadableRefs := []string{}
+	for _, refName := range refNames {
+		if _, err := getObjectType(refHashes[refName], repoDir); err != nil {
+			unreadableRefs = append(unreadableRefs, refName)
+		}
+	}
+	if len(unreadableRefs) > 0 {
+		check.state, check.details = MigrationIncompatible, fmt.Sprintf("objects pointed to by these refs can't be read: %s", strings.Join(unreadableRefs, ", "))
+		return check
+	}
+
+	check.details = fmt.Sprintf("%d %s (%d packed)", len(refNames), pluralize(len(refNames), "ref", "refs"), len(packedRefs))
+	return check
+}
+
+func checkMigrationIndex(repoDir string) *MigrationCheck {
+	check := &MigrationCheck{name: "index", state: MigrationOK}
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		check.state, check.details = MigrationIncompatible, err.Error()
+		return check
+	}
+
+	unmergedPaths, unsupportedModePaths := []string{}, []string{}
+	for _, entry := range index.entries {
+		if entry.stage() != 0 {
+			unmergedPaths = append(unmergedPaths, entry.path)
+		} else if !isValidMode(entry.mode) {
+			unsupportedModePaths = append(unsupportedModePaths, entry.path)
+		}
+	}
+
+	if len(unmergedPaths) > 0 {
+		check.state, check.details = MigrationIncompatible, fmt.Sprintf("unmerged entries (resolve the merge conflicts first): %s", strings.Join(slices.Compact(unmergedPaths), ", "))
+		return check
+	}
+	if len(unsupportedModePaths) > 0 {
+		check.state, check.details = MigrationIncompatible, fmt.Sprintf("entries with unsupported modes: %s", strings.Join(unsupportedModePaths, ", "))
+		return check
+	}
+
+	check.details = fmt.Sprintf("version %d, %d %s", index.version, len(index.entries), pluralize(len(index.entries), "entry", "entries"))
+	return check
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matches the identity of a tagger (or author or committer) as Git's strict checks require it: a name, an email in
+// angle brackets, and a date of seconds since the epoch with a timezone
+var STRICT_IDENT_REGEX = regexp.MustCompile(`^[^<>\n]*<[^<>\n]*> [0-9]+ [+-][0-9]{4}$`)
+
+// Creates a tag object with the given content, after checking it as strictly as Git's mktag does: it must have exactly
+// the object, type, tag, and tagger headers, in that order, and the object it tags must exist and have the given type.
+// The content is written as it is, so the tag's hash is the same as it would be with Git.
+func MakeTag(content string, repoDir string) (*TagObject, error) {
+	if err := checkTagContent(content); err != nil {
+		return nil, fmt.Errorf("tag on stdin did not pass our strict fsck check: %s", err)
+	}
+
+	headers, _ := parseObjectHeaders(content)
+	objHash, typeName := headers[0].value, headers[1].value
+	objType, err := getObjectType(objHash, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read tagged object '%s'", objHash)
+	}
+	if objType.toString() != typeName {
+		return nil, fmt.Errorf("object '%s' tagged as '%s', but is a '%s' type", objHash, typeName, objType.toString())
+	}
+
+	tagHash, err := CreateObjectFile(Tag, []byte(content), repoDir)
+	if err != nil {
+		return nil, err
+	}
+	return ReadTagObjectFile(tagHash, repoDir)
+}
+
+// The headers which a tag must have, in order, along with the ID of the fsck check which fails if each is missing
+var TAG_HEADERS = [][]string{{"object", "missingObject"}, {"type", "missingTypeEntry"}, {"tag", "missingTagEntry"}, {"tagger", "missingTaggerEntry"}}
+
+// Checks the headers of a tag's content, returning an error named after the corresponding fsck check in Git
+func checkTagContent(content string) error {
+	headerSection, _, hasMessage := strings.Cut(content, "\n\n")
+	if !hasMessage && !strings.HasSuffix(content, "\n") {
+		return fmt.Errorf("unterminatedHeader: unterminated header")
+	}
+	lines := strings.Split(strings.TrimSuffix(headerSection, "\n"), "\n")
+
+	for i, header := range TAG_HEADERS {
+		name, missingCheckID := header[0], header[1]
+		value, hasHeader := "", false
+		if i < len(lines) {
+			value, hasHeader = strings.CutPrefix(lines[i], name+" ")
+		}
+		if !hasHeader {
+			return fmt.Errorf("%s: invalid format - expected '%s' line", missingCheckID, name)
+		}
+
+		switch name {
+		case "object":
+			if !isValidObjectHash(value) {
+				return fmt.Errorf("badObjectSha1: invalid 'object' line format - bad sha1")
+			}
+		case "type":
+			if _, err := ObjTypeFromString(value); err != nil {
+				return fmt.Errorf("badType: invalid 'type' value")
+			}
+		case "tag":
+			if validateRefName("refs/tags/"+value) != nil {
+				return fmt.Errorf("badTagName: invalid 'tag' name: %s", value)
+			}
+		case "tagger":
+			if !STRICT_IDENT_REGEX.MatchString(value) {
+				return fmt.Errorf("badTagger: invalid 'tagger' line: %s", value)
+			}
+		}
+	}
+
+	if len(lines) > len(TAG_HEADERS) {
+		return fmt.Errorf("extraHeaderEntry: invalid format - extra header(s) after 'tagger'")
+	}
+	return nil
+}
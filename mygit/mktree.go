@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Creates a tree object from entries in the format printed by ls-tree (`<mode> SP <type> SP <hash> TAB <name>`), read
+// from the input one per line (or terminated by NUL bytes, if nulTerminated). The entries may be in any order. As in
+// Git, each entry's object must exist and have the type given by the entry, unless allowMissing is set. The commit of a
+// submodule belongs to another repository, so it's never required to exist.
+func MakeTree(input io.Reader, nulTerminated bool, allowMissing bool, repoDir string) (*TreeObject, error) {
+	terminator := byte('\n')
+	if nulTerminated {
+		terminator = 0
+	}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, terminator); i != -1 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	entries := []TreeObjectEntry{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		entry, err := parseMktreeLine(line, allowMissing, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tree entries: %s", err)
+	}
+
+	return createTreeObject(entries, repoDir)
+}
+
+// Parses a line of input to mktree into a tree entry, checking it as Git does
+func parseMktreeLine(line string, allowMissing bool, repoDir string) (*TreeObjectEntry, error) {
+	header, name, hasName := strings.Cut(line, "\t")
+	fields := strings.Split(header, " ")
+	if !hasName || len(fields) != 3 {
+		return nil, fmt.Errorf("input format error: %s", line)
+	}
+
+	mode, err := parseFileMode(fields[0])
+	if err != nil || !isValidMode(mode) {
+		return nil, fmt.Errorf("input format error: %s", line)
+	}
+	objType, err := ObjTypeFromString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("input format error: %s", line)
+	}
+	objHash := fields[2]
+	if !isValidObjectHash(objHash) {
+		return nil, fmt.Errorf("input format error: %s", line)
+	}
+
+	if err := checkTreeEntryName(name); err != nil {
+		return nil, err
+	}
+
+	modeType := getObjectTypeFromMode(mode)
+	if objType != modeType {
+		return nil, fmt.Errorf("entry '%s' object type (%s) doesn't match mode type (%s)", name, objType.toString(), modeType.toString())
+	}
+
+	if mode != GITLINK_MODE {
+		if actualType, err := getObjectType(objHash, repoDir); err != nil {
+			if !allowMissing {
+				return nil, fmt.Errorf("entry '%s' object %s is unavailable", name, objHash)
+			}
+		} else if actualType != objType {
+			return nil, fmt.Errorf("entry '%s' object %s is a %s but specified type was (%s)", name, objHash, actualType.toString(), objType.toString())
+		}
+	}
+
+	return &TreeObjectEntry{hash: objHash, mode: mode, name: name, objType: objType}, nil
+}
+
+// Checks the name of a tree entry as Git does: it must be a single path component, other than ., .., and .git
+func checkTreeEntryName(name string) error {
+	if name == "" || name == "." || name == ".." || name == ".git" {
+		return fmt.Errorf("invalid path '%s'", name)
+	}
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("path %s contains slash", name)
+	}
+	return nil
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -27,6 +30,7 @@ const (
 	Blob   ObjectType = iota // 0
 	Tree                     // 1
 	Commit                   // 2
+	Tag                      // 3
 )
 
 func (ot ObjectType) toString() string {
@@ -36,6 +40,8 @@ func (ot ObjectType) toString() string {
 		return "tree"
 	} else if ot == Commit {
 		return "commit"
+	} else if ot == Tag {
+		return "tag"
 	} else {
 		return "unknown"
 	}
@@ -48,19 +54,46 @@ func ObjTypeFromString(objType string) (ObjectType, error) {
 		return Tree, nil
 	} else if objType == Commit.toString() {
 		return Commit, nil
+	} else if objType == Tag.toString() {
+		return Tag, nil
 	} else {
 		return -1, fmt.Errorf("unknown object type %s", objType)
 	}
 }
 
+// Represents the mode of a tree or index entry, which identifies the kind of file it is (and whether it's executable)
+// by the same bits as a Unix file mode, e.g. 0o100644 for a regular file
+type FileMode uint32
+
 const (
-	REGULAR_FILE_MODE    = 100644
-	EXECUTABLE_FILE_MODE = 100755
-	SYMBOLIC_LINK_MODE   = 120000
-	DIRECTORY_MODE       = 40000
+	REGULAR_FILE_MODE    FileMode = 0o100644
+	EXECUTABLE_FILE_MODE FileMode = 0o100755
+	SYMBOLIC_LINK_MODE   FileMode = 0o120000
+	DIRECTORY_MODE       FileMode = 0o040000
+	GITLINK_MODE         FileMode = 0o160000 // A submodule, recorded as the hash of a commit in the submodule's repository
 )
 
-var VALID_MODES = []int{REGULAR_FILE_MODE, EXECUTABLE_FILE_MODE, SYMBOLIC_LINK_MODE, DIRECTORY_MODE}
+var VALID_MODES = []FileMode{REGULAR_FILE_MODE, EXECUTABLE_FILE_MODE, SYMBOLIC_LINK_MODE, DIRECTORY_MODE, GITLINK_MODE}
+
+// Formats the mode as it's written in tree objects: in octal, without leading zeros (e.g. 40000 for a directory)
+func (m FileMode) toString() string {
+	return strconv.FormatUint(uint64(m), 8)
+}
+
+// Formats the mode as Git displays it, e.g. in ls-tree and diff output: in octal, zero-padded to 6 digits (e.g.
+// 040000 for a directory)
+func (m FileMode) toPaddedString() string {
+	return fmt.Sprintf("%06o", uint32(m))
+}
+
+// Parses a mode written in octal, as in tree objects
+func parseFileMode(s string) (FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("mode should be an octal number: %s", s)
+	}
+	return FileMode(mode), nil
+}
 
 // GitObject is the common interface for all Git objects (blobs, trees, commits)
 type GitObject interface {
@@ -112,7 +145,7 @@ func (t *TreeObject) PrettyPrint() string {
 	var sb strings.Builder
 	fmt.Fprintf(&sb, "tree %d\n", t.sizeBytes)
 	for _, entry := range t.entries {
-		fmt.Fprintf(&sb, "%06d %s %s\n", entry.mode, entry.name, entry.hash)
+		sb.WriteString(entry.toString(false) + "\n")
 	}
 	return sb.String()
 }
@@ -120,7 +153,7 @@ func (t *TreeObject) PrettyPrint() string {
 // Represents an entry (either a blob or another tree) within a Git tree object
 type TreeObjectEntry struct {
 	hash    string
-	mode    int
+	mode    FileMode
 	name    string
 	objType ObjectType
 }
@@ -129,8 +162,7 @@ func (e *TreeObjectEntry) toString(nameOnly bool) string {
 	if nameOnly {
 		return e.name
 	} else {
-		mode := fmt.Sprintf("%06d", e.mode)
-		return fmt.Sprintf("%s %s %s    %s", mode, e.objType.toString(), e.hash, e.name)
+		return fmt.Sprintf("%s %s %s\t%s", e.mode.toPaddedString(), e.objType.toString(), e.hash, e.name)
 	}
 }
 
@@ -143,6 +175,8 @@ type CommitObject struct {
 	author             CommitUser
 	committer          CommitUser
 	commitMessage      string
+	signature          string          // The ASCII-armored signature from the gpgsig header, or empty if unsigned
+	headers            []*ObjectHeader // Every header of the commit in order, including those which aren't parsed above
 }
 
 // Represents a user (author or committer) associated with a Git commit
@@ -162,20 +196,63 @@ func (c *CommitObject) GetSizeBytes() int {
 }
 
 func (c *CommitObject) PrettyPrint() string {
-	var sb strings.Builder
-	fmt.Fprintf(&sb, "commit %d\n", c.sizeBytes)
-	fmt.Fprintf(&sb, "tree %s\n", c.treeHash)
-	for _, parentCommitHash := range c.parentCommitHashes {
-		fmt.Fprintf(&sb, "parent %s", parentCommitHash)
-	}
-	fmt.Fprintf(&sb, "author %s <%s> %d %s\n", c.author.name, c.author.email, c.author.dateSeconds, c.author.timezone)
-	fmt.Fprintf(&sb, "committer %s <%s> %d %s\n", c.committer.name, c.committer.email, c.committer.dateSeconds, c.committer.timezone)
-	fmt.Fprintf(&sb, "\n%s\n", c.commitMessage)
-	return sb.String()
+	return fmt.Sprintf("commit %d\n%s", c.sizeBytes, c.serialize())
+}
+
+// Returns the content of the commit object, formatted from its headers and message. For a commit which was read from
+// the repository, this reproduces its content exactly (so it hashes to the same object), including any headers which
+// mygit doesn't understand.
+func (c *CommitObject) serialize() string {
+	return formatObjectContent(c.headers, c.commitMessage)
+}
+
+// Represents a Git tag object, i.e. an annotated tag, which names another object (usually a commit) along with the
+// tagger and a message
+type TagObject struct {
+	hash       string
+	sizeBytes  int
+	objectHash string
+	objectType ObjectType
+	tagName    string
+	tagger     *CommitUser // nil for old tags which don't record a tagger
+	tagMessage string
+	headers    []*ObjectHeader // Every header of the tag in order, including those which aren't parsed above
+}
+
+func (t *TagObject) GetObjectType() ObjectType {
+	return Tag
+}
+
+func (t *TagObject) GetSizeBytes() int {
+	return t.sizeBytes
+}
+
+func (t *TagObject) PrettyPrint() string {
+	return fmt.Sprintf("tag %d\n%s", t.sizeBytes, t.serialize())
+}
+
+// Returns the content of the tag object, formatted from its headers and message. As with commits, this reproduces
+// the content of a tag read from the repository exactly.
+func (t *TagObject) serialize() string {
+	return formatObjectContent(t.headers, t.tagMessage)
 }
 
 /** GENERIC TO ALL OBJECTS */
 
+// The number of hex digits that object hashes are abbreviated to when shown to the user
+const ABBREV_HASH_LENGTH = 7
+
+// The fewest hex digits that an abbreviated object hash given by the user may have, as in Git
+const MIN_ABBREV_HASH_LENGTH = 4
+
+// Abbreviates an object hash for display, leaving it unchanged if it's already no longer than an abbreviation
+func abbreviateHash(objHash string) string {
+	if len(objHash) <= ABBREV_HASH_LENGTH {
+		return objHash
+	}
+	return objHash[:ABBREV_HASH_LENGTH]
+}
+
 func isValidObjectHash(objHash string) bool {
 	if len(objHash) != OBJECT_HASH_LENGTH_STRING {
 		return false
@@ -185,28 +262,31 @@ func isValidObjectHash(objHash string) bool {
 	return isAlphanumeric
 }
 
-func isValidMode(mode int) bool {
+func isValidMode(mode FileMode) bool {
 	return slices.Contains(VALID_MODES, mode)
 }
 
 func getObjectType(objHash string, repoDir string) (ObjectType, error) {
-	objType, _, _, err := ReadObjectFile(objHash, repoDir)
+	objType, _, reader, err := openObjectFile(objHash, repoDir)
 	if err != nil {
 		return -1, err
 	}
+	reader.Close()
 
 	return objType, nil
 }
 
-func getObjectTypeFromMode(mode int) ObjectType {
-	if mode == 40000 {
+func getObjectTypeFromMode(mode FileMode) ObjectType {
+	if mode == DIRECTORY_MODE {
 		return Tree
+	} else if mode == GITLINK_MODE {
+		return Commit
 	} else {
 		return Blob
 	}
 }
 
-func getGitModeFromFileMode(fileMode os.FileMode) int {
+func getGitModeFromFileMode(fileMode os.FileMode) FileMode {
 	if fileMode.IsDir() {
 		return DIRECTORY_MODE
 	} else if fileMode&os.ModeSymlink != 0 {
@@ -218,6 +298,32 @@ func getGitModeFromFileMode(fileMode os.FileMode) int {
 	}
 }
 
+// Returns the mode of a working tree file as it's compared against, and staged over, the mode recorded for it in the
+// index. If trustExecutableBit is unset (core.fileMode is false, e.g. on filesystems without an executable bit), a
+// regular file keeps whichever of 100644 and 100755 the index records, as in Git.
+func getWorkingTreeFileMode(fileMode os.FileMode, indexMode FileMode, trustExecutableBit bool) FileMode {
+	mode := getGitModeFromFileMode(fileMode)
+	isRegularFile := mode == REGULAR_FILE_MODE || mode == EXECUTABLE_FILE_MODE
+	if !trustExecutableBit && isRegularFile && (indexMode == REGULAR_FILE_MODE || indexMode == EXECUTABLE_FILE_MODE) {
+		return indexMode
+	}
+	return mode
+}
+
+// Returns whether the executable bit of working tree files can be trusted, as set by core.fileMode (true by default)
+func getTrustExecutableBit(repoDir string) (bool, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to read repository config: %s", err)
+	}
+
+	trustExecutableBit, err := config.getBool("core.filemode", true)
+	if err != nil {
+		return false, fmt.Errorf("invalid core.fileMode: %s", err)
+	}
+	return trustExecutableBit, nil
+}
+
 func GetObject(objHash string, repoDir string) (GitObject, error) {
 	objType, err := getObjectType(objHash, repoDir)
 	if err != nil {
@@ -244,6 +350,12 @@ func GetObject(objHash string, repoDir string) (GitObject, error) {
 			return nil, err
 		}
 		gitObj = commitObj
+	case Tag:
+		tagObj, err := ReadTagObjectFile(objHash, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		gitObj = tagObj
 	default:
 		return nil, fmt.Errorf("unsupported Git object type")
 	}
@@ -251,11 +363,50 @@ func GetObject(objHash string, repoDir string) (GitObject, error) {
 	return gitObj, nil
 }
 
+func objectExists(objHash string, repoDir string) bool {
+	objPath := filepath.Join(getCommonDir(repoDir), "objects", objHash[:2], objHash[2:])
+	_, err := os.Stat(objPath)
+	return err == nil
+}
+
+// Finds the object whose hash starts with the given abbreviated hash, as Git accepts in place of a full hash: at least
+// MIN_ABBREV_HASH_LENGTH lowercase hex digits, matching exactly one object. Since objects are stored loose, only the
+// directory for the hash's first two digits needs to be listed. Returns whether an object was found, and fails if
+// several objects match.
+func findObjectByAbbreviatedHash(abbrevHash string, repoDir string) (string, bool, error) {
+	if len(abbrevHash) < MIN_ABBREV_HASH_LENGTH || len(abbrevHash) > OBJECT_HASH_LENGTH_STRING || !regexp.MustCompile(`^[0-9a-f]*$`).MatchString(abbrevHash) {
+		return "", false, nil
+	}
+
+	objDirEntries, err := os.ReadDir(filepath.Join(getCommonDir(repoDir), "objects", abbrevHash[:2]))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to read object directory: %s", err)
+	}
+
+	matches := []string{}
+	for _, objDirEntry := range objDirEntries {
+		objHash := abbrevHash[:2] + objDirEntry.Name()
+		if isValidObjectHash(objHash) && strings.HasPrefix(objHash, abbrevHash) {
+			matches = append(matches, objHash)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", false, nil
+	case 1:
+		return matches[0], true, nil
+	default:
+		return "", false, fmt.Errorf("short object ID %s is ambiguous", abbrevHash)
+	}
+}
+
 func ReadObjectFile(objHash string, repoDir string) (ObjectType, int, []byte, error) {
-	objPath := filepath.Join(repoDir, ".git", "objects", objHash[:2], objHash[2:])
-	file, err := os.Open(objPath)
+	file, err := openLooseObjectFile(objHash, repoDir)
 	if err != nil {
-		return -1, -1, nil, fmt.Errorf("failed to open object file")
+		return -1, -1, nil, err
 	}
 	defer file.Close()
 
@@ -269,28 +420,82 @@ func ReadObjectFile(objHash string, repoDir string) (ObjectType, int, []byte, er
 		return -1, -1, nil, fmt.Errorf("object file poorly formatted: missing null byte separator")
 	}
 
-	header := string(data[:nullByteIndex])
+	headerObjType, sizeBytes, err := parseObjectFileHeader(string(data[:nullByteIndex]))
+	if err != nil {
+		return -1, -1, nil, err
+	}
+
+	content := data[nullByteIndex+1:]
+
+	return headerObjType, sizeBytes, content, nil
+}
+
+// Represents an object file opened by openObjectFile, from which the object's content is read as it's decompressed
+type ObjectFileReader struct {
+	io.Reader
+	file *os.File
+	zr   io.ReadCloser
+}
+
+func (r *ObjectFileReader) Close() error {
+	r.zr.Close()
+	return r.file.Close()
+}
+
+// Opens the object file for reading its content as a stream, returning the object's type and size from its header.
+// Unlike ReadObjectFile, the content isn't read into memory, which matters for large blobs.
+func openObjectFile(objHash string, repoDir string) (ObjectType, int, *ObjectFileReader, error) {
+	file, err := openLooseObjectFile(objHash, repoDir)
+	if err != nil {
+		return -1, -1, nil, err
+	}
+
+	zr, err := zlib.NewReader(file)
+	if err != nil {
+		file.Close()
+		return -1, -1, nil, fmt.Errorf("failed to initialize zlib reader: %s", err)
+	}
+
+	bufferedReader := bufio.NewReader(zr)
+	reader := &ObjectFileReader{Reader: bufferedReader, file: file, zr: zr}
+	header, err := bufferedReader.ReadString(0)
+	if err != nil {
+		reader.Close()
+		return -1, -1, nil, fmt.Errorf("object file poorly formatted: missing null byte separator")
+	}
+
+	objType, sizeBytes, err := parseObjectFileHeader(strings.TrimSuffix(header, "\x00"))
+	if err != nil {
+		reader.Close()
+		return -1, -1, nil, err
+	}
+
+	return objType, sizeBytes, reader, nil
+}
+
+// Parses the header of an object file (without its null byte terminator), e.g. `blob 1234`
+func parseObjectFileHeader(header string) (ObjectType, int, error) {
 	headerParts := strings.Split(header, " ")
 	headerObjTypeStr := headerParts[0]
 	if len(headerParts) != 2 {
-		return -1, -1, nil, fmt.Errorf("invalid object header: %s", header)
+		return -1, -1, fmt.Errorf("invalid object header: %s", header)
 	}
 	headerObjType, err := ObjTypeFromString(headerObjTypeStr)
 	if err != nil {
-		return -1, -1, nil, fmt.Errorf("invalid object type in header: %s", header)
+		return -1, -1, fmt.Errorf("invalid object type in header: %s", header)
 	}
 
 	sizeBytes, err := strconv.Atoi(headerParts[1])
 	if err != nil {
-		return -1, -1, nil, fmt.Errorf("invalid size in object header: %s", err)
+		return -1, -1, fmt.Errorf("invalid size in object header: %s", err)
 	}
 
-	content := data[nullByteIndex+1:]
-
-	return headerObjType, sizeBytes, content, nil
+	return headerObjType, sizeBytes, nil
 }
 
-func CreateObjectFile(objType ObjectType, contentBytes []byte, repoDir string) (string, error) {
+// Computes the hash of an object with the given type and content, returning the hash along with the full
+// (uncompressed) object file contents, consisting of the header followed by the content.
+func hashObject(objType ObjectType, contentBytes []byte) (string, []byte) {
 	sizeBytes := len(contentBytes)
 	header := fmt.Sprintf("%s %d\x00", objType.toString(), sizeBytes)
 	headerBytes := []byte(header)
@@ -302,24 +507,72 @@ func CreateObjectFile(objType ObjectType, contentBytes []byte, repoDir string) (
 	objHashBytes := sha1.Sum(fileBytes)
 	objHash := hex.EncodeToString(objHashBytes[:])
 
-	objPath := filepath.Join(repoDir, ".git", "objects", objHash[:2], objHash[2:])
+	return objHash, fileBytes
+}
+
+// Checks that the given content is in the format of an object of the given type, as Git's hash-object does before
+// hashing it: a tree or commit must parse as one (with each tree entry named as mktree requires), and a tag must pass
+// mktag's checks. A blob may hold anything.
+func checkObjectContent(objType ObjectType, contentBytes []byte) error {
+	objHash, _ := hashObject(objType, contentBytes)
+	switch objType {
+	case Tree:
+		treeObj, err := parseTreeObject(objHash, len(contentBytes), contentBytes)
+		if err != nil {
+			return err
+		}
+		for _, entry := range treeObj.entries {
+			if err := checkTreeEntryName(entry.name); err != nil {
+				return err
+			}
+		}
+	case Commit:
+		_, err := parseCommitObject(objHash, len(contentBytes), contentBytes)
+		return err
+	case Tag:
+		return checkTagContent(string(contentBytes))
+	}
+	return nil
+}
+
+func CreateObjectFile(objType ObjectType, contentBytes []byte, repoDir string) (string, error) {
+	objHash, fileBytes := hashObject(objType, contentBytes)
+
+	objPath := filepath.Join(getCommonDir(repoDir), "objects", objHash[:2], objHash[2:])
+
+	// Objects are immutable, so an existing object file never needs to be rewritten
+	if _, err := os.Stat(objPath); err == nil {
+		return objHash, nil
+	}
 
 	dir := filepath.Dir(objPath)
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		return "", fmt.Errorf("failed to create directories storing object file")
 	}
 
-	objFile, err := os.Create(objPath)
+	// The object is written to a temporary file which is then renamed into place, so that a crash or interrupt
+	// mid-write never leaves a partially written object file behind
+	tempFile, err := createTempFile(TEMP_FILE_KIND_OBJECT, getCommonDir(repoDir))
 	if err != nil {
-		return "", fmt.Errorf("failed to create object file")
+		return "", fmt.Errorf("failed to create object file: %s", err)
 	}
-	defer objFile.Close()
+	defer releaseTempFile(tempFile.Name())
 
-	err = zlibCompress(objFile, fileBytes)
+	err = zlibCompress(tempFile, fileBytes)
 	if err != nil {
+		tempFile.Close()
 		return "", err
 	}
 
+	if err := tempFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to write object file: %s", err)
+	}
+
+	if err := os.Rename(tempFile.Name(), objPath); err != nil {
+		return "", fmt.Errorf("failed to move object file into place: %s", err)
+	}
+	trace.objectWritten()
+
 	return objHash, nil
 }
 
@@ -342,10 +595,11 @@ func ReadBlobObjectFile(objHash string, repoDir string) (*BlobObject, error) {
 	}, nil
 }
 
-func CreateBlobObjectFromFile(filePath string, repoDir string) (*BlobObject, error) {
-	content, err := os.ReadFile(filePath)
+// Creates a blob object for the given file, with its content converted by converter (or as it is, if nil)
+func CreateBlobObjectFromFile(filePath string, converter *ContentConverter, repoDir string) (*BlobObject, error) {
+	content, err := readWorkingTreeFile(filePath, converter)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file")
+		return nil, fmt.Errorf("failed to read file: %s", err)
 	}
 	sizeBytes := len(content)
 
@@ -361,6 +615,41 @@ func CreateBlobObjectFromFile(filePath string, repoDir string) (*BlobObject, err
 	}, nil
 }
 
+// Computes the hash of the blob object for the given file without writing the object into the object database
+func HashBlobObjectFromFile(filePath string, converter *ContentConverter) (string, error) {
+	content, err := readWorkingTreeFile(filePath, converter)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %s", err)
+	}
+
+	blobObjHash, _ := hashObject(Blob, content)
+	return blobObjHash, nil
+}
+
+// Reads the given working tree file as its content is stored in a blob, converted by converter unless it's nil. As
+// in Git, the content of a symbolic link is the path that it points to (with forward slashes), rather than the
+// content of the file that it points to.
+func readWorkingTreeFile(filePath string, converter *ContentConverter) ([]byte, error) {
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(filepath.ToSlash(target)), nil
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil || converter == nil {
+		return content, err
+	}
+	return converter.toBlob(filePath, content)
+}
+
 /** TREES */
 
 func ReadTreeObjectFile(objHash string, repoDir string) (*TreeObject, error) {
@@ -373,6 +662,12 @@ func ReadTreeObjectFile(objHash string, repoDir string) (*TreeObject, error) {
 		return nil, fmt.Errorf("expected tree object, received %s", headerObjType.toString())
 	}
 
+	return parseTreeObject(objHash, sizeBytes, content)
+}
+
+// Parses the content of a tree object, whose entries are each a mode and name separated by a space, followed by a
+// null byte and the entry's SHA hash in binary
+func parseTreeObject(objHash string, sizeBytes int, content []byte) (*TreeObject, error) {
 	entries := []TreeObjectEntry{}
 	i := 0
 	for i < len(content) {
@@ -396,8 +691,9 @@ func ReadTreeObjectFile(objHash string, repoDir string) (*TreeObject, error) {
 
 		i = entryHashStartIndex + OBJECT_HASH_LENGTH_BYTES
 	}
+	// Trees written by Git are already in this order, but trees written by other tools may not be
 	sort.Slice(entries, func(i int, j int) bool {
-		return entries[i].name < entries[j].name
+		return getTreeEntrySortKey(entries[i]) < getTreeEntrySortKey(entries[j])
 	})
 
 	return &TreeObject{
@@ -407,7 +703,7 @@ func ReadTreeObjectFile(objHash string, repoDir string) (*TreeObject, error) {
 	}, nil
 }
 
-func CreateTreeObjectFromDirectory(dir string, repoDir string) (*TreeObject, error) {
+func CreateTreeObjectFromDirectory(dir string, converter *ContentConverter, repoDir string) (*TreeObject, error) {
 	dirEntries, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read contents of directory %s", dir)
@@ -422,7 +718,7 @@ func CreateTreeObjectFromDirectory(dir string, repoDir string) (*TreeObject, err
 		fullPath := filepath.Join(dir, dirEntry.Name())
 
 		if dirEntry.IsDir() {
-			subDirTreeObj, err := CreateTreeObjectFromDirectory(fullPath, repoDir)
+			subDirTreeObj, err := CreateTreeObjectFromDirectory(fullPath, converter, repoDir)
 			if err != nil {
 				return nil, err
 			}
@@ -440,7 +736,7 @@ func CreateTreeObjectFromDirectory(dir string, repoDir string) (*TreeObject, err
 
 			mode := getGitModeFromFileMode(fileInfo.Mode())
 
-			fileBlobObj, err := CreateBlobObjectFromFile(fullPath, repoDir)
+			fileBlobObj, err := CreateBlobObjectFromFile(fullPath, converter, repoDir)
 			if err != nil {
 				return nil, err
 			}
@@ -456,12 +752,40 @@ func CreateTreeObjectFromDirectory(dir string, repoDir string) (*TreeObject, err
 	return createTreeObject(entries, repoDir)
 }
 
+// Represents the directory structure of the index, used for creating the tree objects for each directory
+type indexDirInfo struct {
+	dirToSubDirs    map[string](map[string]struct{})
+	dirToEntries    map[string][]TreeObjectEntry
+	dirToEntryCount map[string]int
+	uncacheableDirs map[string]bool
+	cachedTreeByDir map[string]*CacheTree
+}
+
+// Creates the tree objects for the current index, reusing the tree object hashes recorded in the index's cache
+// tree for any directories that haven't changed. The index is then updated with the new cache tree. Fails if the
+// index has merge conflicts.
 func CreateTreeObjectFromIndex(repoDir string) (*TreeObject, error) {
-	indexEntries, err := ReadIndex(repoDir)
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read Git index file: %s", err)
 	}
 
+	// A tree can only hold one version of each file, so merge conflicts must be resolved first
+	if unmergedPaths := getUnmergedPaths(index.entries); len(unmergedPaths) > 0 {
+		return nil, fmt.Errorf("the index has unmerged paths: %s", strings.Join(unmergedPaths, ", "))
+	}
+
+	// Entries added with `git add --intent-to-add` only record that the path will be added later
+	indexEntries := slices.DeleteFunc(slices.Clone(index.entries), func(entry *IndexEntry) bool {
+		return entry.isIntentToAdd()
+	})
+
 	dirSet := make(map[string]struct{})
 	dirSet["."] = struct{}{}
 	dirToSubDirs := make(map[string](map[string]struct{}))
@@ -484,9 +808,9 @@ func CreateTreeObjectFromIndex(repoDir string) (*TreeObject, error) {
 		dir := filepath.Dir(indexEntry.path)
 		entry := TreeObjectEntry{
 			hash:    hex.EncodeToString(indexEntry.sha1[:]),
-			mode:    int(indexEntry.mode),
+			mode:    indexEntry.mode,
 			name:    filepath.Base(indexEntry.path),
-			objType: Blob,
+			objType: getObjectTypeFromMode(indexEntry.mode),
 		}
 		dirToEntries[dir] = append(dirToEntries[dir], entry)
 	}
@@ -500,26 +824,68 @@ func CreateTreeObjectFromIndex(repoDir string) (*TreeObject, error) {
 		}
 	}
 
-	treeObj, err := createTreeObjectFromDirInfo(".", dirToSubDirs, dirToEntries, repoDir)
+	// The cache tree records how many index entries each directory covers, and can't record a tree for any
+	// directory containing intent-to-add entries since they're left out of the tree
+	dirToEntryCount := make(map[string]int)
+	uncacheableDirs := make(map[string]bool)
+	for _, entry := range index.entries {
+		currDir := filepath.Dir(entry.path)
+		for {
+			dirToEntryCount[currDir] += 1
+			if entry.isIntentToAdd() {
+				uncacheableDirs[currDir] = true
+			}
+			if currDir == "." || currDir == "/" {
+				break
+			}
+			currDir = filepath.Dir(currDir)
+		}
+	}
+
+	cachedTreeByDir := make(map[string]*CacheTree)
+	if index.cacheTree != nil {
+		cachedTreeByDir = index.cacheTree.getNodesByDir()
+	}
+
+	dirInfo := &indexDirInfo{
+		dirToSubDirs:    dirToSubDirs,
+		dirToEntries:    dirToEntries,
+		dirToEntryCount: dirToEntryCount,
+		uncacheableDirs: uncacheableDirs,
+		cachedTreeByDir: cachedTreeByDir,
+	}
+
+	treeHash, cacheTree, err := createTreeObjectFromDirInfo(".", dirInfo, repoDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create tree object from directory info: %s", err)
 	}
 
+	err = writeIndex(indexLock, index.entries, cacheTree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write cache tree to Git index file: %s", err)
+	}
+
+	treeObj, err := ReadTreeObjectFile(treeHash, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read created tree object: %s", err)
+	}
+
 	return treeObj, nil
 }
 
 func parseTreeObjectEntry(entryHeader string, entryHash string) (*TreeObjectEntry, error) {
-	entryHeaderParts := strings.Split(entryHeader, " ")
-	if len(entryHeaderParts) != 2 {
+	// The name may itself contain spaces, so only the first space separates it from the mode
+	modeStr, name, found := strings.Cut(entryHeader, " ")
+	if !found {
 		return nil, fmt.Errorf("tree object entry mode and name should be space-separated")
 	}
 
-	mode, err := strconv.Atoi(entryHeaderParts[0])
+	mode, err := parseFileMode(modeStr)
 	if err != nil {
-		return nil, fmt.Errorf("tree object entry mode should be an integer")
+		return nil, fmt.Errorf("invalid tree object entry mode: %s", err)
 	}
 	if !isValidMode(mode) {
-		return nil, fmt.Errorf("invalid tree object entry mode: %d", mode)
+		return nil, fmt.Errorf("invalid tree object entry mode: %s", modeStr)
 	}
 
 	if !isValidObjectHash(entryHash) {
@@ -529,19 +895,19 @@ func parseTreeObjectEntry(entryHeader string, entryHash string) (*TreeObjectEntr
 	return &TreeObjectEntry{
 		hash:    entryHash,
 		mode:    mode,
-		name:    entryHeaderParts[1],
+		name:    name,
 		objType: getObjectTypeFromMode(mode),
 	}, nil
 }
 
 func createTreeObject(entries []TreeObjectEntry, repoDir string) (*TreeObject, error) {
 	sort.Slice(entries, func(i int, j int) bool {
-		return entries[i].name < entries[j].name
+		return getTreeEntrySortKey(entries[i]) < getTreeEntrySortKey(entries[j])
 	})
 
 	var contentBuilder strings.Builder
 	for _, entry := range entries {
-		fmt.Fprintf(&contentBuilder, "%d %s\x00", entry.mode, entry.name)
+		fmt.Fprintf(&contentBuilder, "%s %s\x00", entry.mode.toString(), entry.name)
 
 		hashBytes, err := hex.DecodeString(entry.hash)
 		if err != nil {
@@ -564,32 +930,111 @@ func createTreeObject(entries []TreeObjectEntry, repoDir string) (*TreeObject, e
 	}, nil
 }
 
-func createTreeObjectFromDirInfo(dir string, dirToSubDirs map[string](map[string]struct{}), dirToEntries map[string][]TreeObjectEntry, repoDir string) (*TreeObject, error) {
-	subDirs, exists := dirToSubDirs[dir]
+// Git orders tree entries by comparing their names byte by byte (independent of locale), as if each subdirectory's
+// name ended with a slash, e.g. "a.txt" comes before the directory "a", which comes before "a0"
+func getTreeEntrySortKey(entry TreeObjectEntry) string {
+	if entry.mode == DIRECTORY_MODE {
+		return entry.name + "/"
+	}
+	return entry.name
+}
+
+// Creates the tree object for the given directory of the index (recursively creating the tree objects for its
+// subdirectories), returning the tree object hash along with the directory's node for the new cache tree
+func createTreeObjectFromDirInfo(dir string, dirInfo *indexDirInfo, repoDir string) (string, *CacheTree, error) {
+	subDirs, exists := dirInfo.dirToSubDirs[dir]
 	if !exists {
-		return nil, fmt.Errorf("directory %s does not exist in mapping to subdirectories", dir)
+		return "", nil, fmt.Errorf("directory %s does not exist in mapping to subdirectories", dir)
 	}
 
-	entries, exists := dirToEntries[dir]
+	entries, exists := dirInfo.dirToEntries[dir]
 	if !exists {
-		return nil, fmt.Errorf("directory %s does not exist in mapping to tree object entries", dir)
+		return "", nil, fmt.Errorf("directory %s does not exist in mapping to tree object entries", dir)
 	}
 
-	for subDir, _ := range subDirs {
-		subDirTreeObj, err := createTreeObjectFromDirInfo(subDir, dirToSubDirs, dirToEntries, repoDir)
+	name := filepath.Base(dir)
+	if dir == "." {
+		name = ""
+	}
+
+	// Nothing under this directory has changed since its tree object was last created, so it can be reused
+	cachedTree, isCached := dirInfo.cachedTreeByDir[dir]
+	if isCached && cachedTree.isValid() && cachedTree.entryCount == dirInfo.dirToEntryCount[dir] && objectExists(cachedTree.hash, repoDir) {
+		cachedTree.name = name
+		return cachedTree.hash, cachedTree, nil
+	}
+
+	subtrees := []*CacheTree{}
+	for subDir := range subDirs {
+		subDirTreeHash, subDirCacheTree, err := createTreeObjectFromDirInfo(subDir, dirInfo, repoDir)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
 
 		entries = append(entries, TreeObjectEntry{
-			hash:    subDirTreeObj.hash,
+			hash:    subDirTreeHash,
 			mode:    DIRECTORY_MODE,
 			name:    filepath.Base(subDir),
 			objType: Tree,
 		})
+		subtrees = append(subtrees, subDirCacheTree)
 	}
+	sortCacheTreeSubtrees(subtrees)
 
-	return createTreeObject(entries, repoDir)
+	treeObj, err := createTreeObject(entries, repoDir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cacheTree := &CacheTree{
+		name:       name,
+		entryCount: dirInfo.dirToEntryCount[dir],
+		hash:       treeObj.hash,
+		subtrees:   subtrees,
+	}
+	if dirInfo.uncacheableDirs[dir] {
+		cacheTree.entryCount = -1
+	}
+
+	return treeObj.hash, cacheTree, nil
+}
+
+// Resolves a tree-ish (HEAD, a ref such as a branch or tag, or the hash of a commit, tag, or tree) to the hash of its
+// tree
+func resolveTreeish(treeish string, repoDir string) (string, error) {
+	if treeish == "HEAD" {
+		headCommitHash, commitsExist, err := ResolveHead("", repoDir)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve HEAD: %s", err)
+		} else if !commitsExist {
+			return "", fmt.Errorf("HEAD does not point to a commit yet")
+		}
+		treeish = headCommitHash
+	}
+	if !isValidObjectHash(treeish) {
+		_, refHash, err := resolveRevision(treeish, repoDir)
+		if err != nil {
+			return "", fmt.Errorf("not a valid object name: %s", treeish)
+		}
+		treeish = refHash
+	}
+
+	treeish, objType, err := peelObject(treeish, repoDir)
+	if err != nil {
+		return "", err
+	}
+	switch objType {
+	case Commit:
+		commitObj, err := ReadCommitObjectFile(treeish, repoDir)
+		if err != nil {
+			return "", err
+		}
+		return commitObj.treeHash, nil
+	case Tree:
+		return treeish, nil
+	default:
+		return "", fmt.Errorf("%s is a %s, not a commit or tree", treeish, objType.toString())
+	}
 }
 
 func getAllObjectsInTree(treeHash string, repoDir string) ([]string, error) {
@@ -609,6 +1054,9 @@ func getAllObjectsInTree(treeHash string, repoDir string) ([]string, error) {
 				return nil, fmt.Errorf("failed to get objects in sub-tree: %s", err)
 			}
 			treeObjHashes = append(treeObjHashes, subTreeObjHashes...)
+		case Commit:
+			// A submodule's commit belongs to the submodule's repository rather than this one
+			continue
 		default:
 			return nil, fmt.Errorf("unexpected object type %s in tree %s", entry.objType.toString(), treeHash)
 		}
@@ -629,130 +1077,373 @@ func ReadCommitObjectFile(objHash string, repoDir string) (*CommitObject, error)
 		return nil, fmt.Errorf("expected commit object, received %s", headerObjType.toString())
 	}
 
-	lines := strings.Split(string(content), "\n")
-	treeHash := strings.Split(lines[0], " ")[1]
-	var parentCommitHashes []string
-	i := 1
-	for strings.HasPrefix(lines[i], "parent") {
-		parentCommitHashes = append(parentCommitHashes, strings.Split(lines[i], " ")[1])
-		i += 1
+	return parseCommitObject(objHash, sizeBytes, content)
+}
+
+// Parses the content of a commit object, which must have a tree, an author, and a committer
+func parseCommitObject(objHash string, sizeBytes int, content []byte) (*CommitObject, error) {
+	headers, commitMessage := parseObjectHeaders(string(content))
+
+	commitObj := &CommitObject{hash: objHash, sizeBytes: sizeBytes, commitMessage: commitMessage, headers: headers}
+	hasAuthor, hasCommitter := false, false
+	for _, header := range headers {
+		switch header.name {
+		case "tree":
+			commitObj.treeHash = header.value
+		case "parent":
+			commitObj.parentCommitHashes = append(commitObj.parentCommitHashes, header.value)
+		case "author":
+			author, err := parseCommitUser(header.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid author in commit %s: %s", objHash, err)
+			}
+			commitObj.author, hasAuthor = *author, true
+		case "committer":
+			committer, err := parseCommitUser(header.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid committer in commit %s: %s", objHash, err)
+			}
+			commitObj.committer, hasCommitter = *committer, true
+		case "gpgsig":
+			commitObj.signature = header.value + "\n"
+		}
+		// Other headers, such as encoding and mergetag (the tag objects of merged signed tags), are skipped
+	}
+
+	if !isValidObjectHash(commitObj.treeHash) {
+		return nil, fmt.Errorf("commit %s has no valid tree", objHash)
+	}
+	if !hasAuthor || !hasCommitter {
+		return nil, fmt.Errorf("commit %s is missing its author or committer", objHash)
 	}
-	author, err := parseCommitUser(lines[i])
+
+	return commitObj, nil
+}
+
+// Represents a header of a commit or tag object, e.g. `parent <hash>`. A header's value may span multiple lines (as
+// the gpgsig and mergetag headers do), in which case each line after the first is stored in the object indented by a
+// space, which isn't part of the value.
+type ObjectHeader struct {
+	name    string
+	value   string
+	noValue bool // Whether the header's line is only its name, without the space before the value (Git never writes these)
+}
+
+// Splits the content of a commit or tag object into its headers, in order, and its message, which follows the first
+// blank line. Nothing is lost or normalized, so formatObjectContent reproduces the content of any object written by
+// Git from the result (objects with no blank line before the message, which Git never writes, gain one).
+func parseObjectHeaders(content string) ([]*ObjectHeader, string) {
+	headerSection, message, hasMessage := strings.Cut(content, "\n\n")
+	if !hasMessage {
+		headerSection = strings.TrimSuffix(headerSection, "\n")
+	}
+
+	headers := []*ObjectHeader{}
+	for _, line := range strings.Split(headerSection, "\n") {
+		if continuation, isContinuation := strings.CutPrefix(line, " "); isContinuation && len(headers) > 0 {
+			lastHeader := headers[len(headers)-1]
+			lastHeader.value += "\n" + continuation
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(line, " ")
+		headers = append(headers, &ObjectHeader{name: name, value: value, noValue: !hasValue})
+	}
+
+	return headers, message
+}
+
+// Formats the content of a commit or tag object from its headers and message, indenting each continuation line of a
+// multi-line header value by a space
+func formatObjectContent(headers []*ObjectHeader, message string) string {
+	var contentBuilder strings.Builder
+	for _, header := range headers {
+		if header.noValue {
+			contentBuilder.WriteString(header.name + "\n")
+			continue
+		}
+		fmt.Fprintf(&contentBuilder, "%s %s\n", header.name, strings.ReplaceAll(header.value, "\n", "\n "))
+	}
+
+	fmt.Fprintf(&contentBuilder, "\n%s", message)
+	return contentBuilder.String()
+}
+
+func CreateCommitObjectFromTree(treeHash string, parentCommitHashes []string, commitMessage string, repoDir string) (*CommitObject, error) {
+	author, err := getCommitUser(CommitAuthor, repoDir)
 	if err != nil {
 		return nil, err
 	}
-	committer, err := parseCommitUser(lines[i+1])
+
+	committer, err := getCommitUser(CommitCommitter, repoDir)
 	if err != nil {
 		return nil, err
 	}
-	commitMessage := strings.Join(lines[i+3:], "\n")
 
-	return &CommitObject{
-		hash:               objHash,
-		sizeBytes:          sizeBytes,
-		treeHash:           treeHash,
-		parentCommitHashes: parentCommitHashes,
-		author:             *author,
-		committer:          *committer,
-		commitMessage:      commitMessage,
-	}, nil
+	return createCommitObject(treeHash, parentCommitHashes, *author, *committer, commitMessage, repoDir)
 }
 
-func CreateCommitObjectFromTree(treeHash string, parentCommitHashes []string, commitMessage string, repoDir string) (*CommitObject, error) {
-	var contentBuilder strings.Builder
-	fmt.Fprintf(&contentBuilder, "tree %s\n", treeHash)
+// Represents whether a user is the author of a commit or its committer, whose identities may be set separately
+type CommitUserRole int
 
-	for _, parentCommitHash := range parentCommitHashes {
-		fmt.Fprintf(&contentBuilder, "parent %s\n", parentCommitHash)
+const (
+	CommitAuthor CommitUserRole = iota
+	CommitCommitter
+)
+
+func (r CommitUserRole) toString() string {
+	switch r {
+	case CommitAuthor:
+		return "author"
+	default:
+		return "committer"
 	}
+}
 
+// Returns the current user in the given role, for use as the author or committer of a new commit, looked up as Git
+// does. The name is taken from the GIT_AUTHOR_NAME (or GIT_COMMITTER_NAME) environment variable, the author.name (or
+// committer.name) config variable, or the user.name config variable, falling back to the operating system's user.
+// The email is taken from the corresponding variables, then the EMAIL environment variable. The date is taken from
+// GIT_AUTHOR_DATE (or GIT_COMMITTER_DATE) in any of the formats accepted by parseCommitDate, falling back to the
+// current time (see getObjectClock).
+func getCommitUser(role CommitUserRole, repoDir string) (*CommitUser, error) {
 	currentUser, err := user.Current()
 	if err != nil {
 		return nil, err
 	}
-	now := time.Now()
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %s", err)
+	}
+
+	envPrefix := "GIT_" + strings.ToUpper(role.toString())
+	lookup := func(envName string, configNames ...string) (string, bool) {
+		if value, isSet := os.LookupEnv(envPrefix + "_" + envName); isSet {
+			return value, true
+		}
+		for _, configName := range configNames {
+			if value, isSet := config.get(configName); isSet {
+				return value, true
+			}
+		}
+		return "", false
+	}
+
+	name, hasName := lookup("NAME", role.toString()+".name", "user.name")
+	if !hasName {
+		name = currentUser.Name
+	}
+	email, hasEmail := lookup("EMAIL", role.toString()+".email", "user.email")
+	if !hasEmail {
+		email, hasEmail = os.LookupEnv("EMAIL")
+	}
+	if !hasEmail {
+		email = fmt.Sprintf("%s@mygit.com", currentUser.Username)
+	}
+
+	commitUser := &CommitUser{name: name, email: email}
+	if date := os.Getenv(envPrefix + "_DATE"); date != "" {
+		commitUser.dateSeconds, commitUser.timezone, err = parseCommitDate(date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s_DATE: %s", envPrefix, err)
+		}
+		return commitUser, nil
+	}
+
+	clock, err := getObjectClock()
+	if err != nil {
+		return nil, err
+	}
+	now := clock.Now()
 	_, offset := now.Zone()
-	timezone := fmt.Sprintf("%+03d%02d", offset/3600, (offset%3600)/60)
-	author_committer := CommitUser{
-		name:        currentUser.Name,
-		email:       fmt.Sprintf("%s@mygit.com", currentUser.Username),
-		dateSeconds: now.Unix(),
-		timezone:    timezone,
+	commitUser.dateSeconds, commitUser.timezone = now.Unix(), formatTimezone(offset)
+
+	return commitUser, nil
+}
+
+// Overrides the identity and date of a commit's author with those given by the --author and --date flags, which are
+// left unchanged if empty. The identity must be of the form `Name <email>`.
+func overrideCommitAuthor(author CommitUser, ident string, date string) (CommitUser, error) {
+	if ident != "" {
+		emailStart := strings.IndexByte(ident, '<')
+		emailEnd := strings.LastIndexByte(ident, '>')
+		if emailStart == -1 || emailEnd < emailStart || strings.TrimSpace(ident[emailEnd+1:]) != "" {
+			return author, fmt.Errorf("--author '%s' is not 'Name <email>'", ident)
+		}
+		author.name = strings.TrimSpace(ident[:emailStart])
+		author.email = ident[emailStart+1 : emailEnd]
 	}
-	fmt.Fprintf(&contentBuilder, "author %s <%s> %d %s\n", author_committer.name, author_committer.email, author_committer.dateSeconds, author_committer.timezone)
-	fmt.Fprintf(&contentBuilder, "committer %s <%s> %d %s\n", author_committer.name, author_committer.email, author_committer.dateSeconds, author_committer.timezone)
 
-	fmt.Fprintf(&contentBuilder, "\n%s", commitMessage)
+	if date != "" {
+		dateSeconds, timezone, err := parseCommitDate(date)
+		if err != nil {
+			return author, fmt.Errorf("invalid date format: %s", date)
+		}
+		author.dateSeconds, author.timezone = dateSeconds, timezone
+	}
 
-	contentBytes := []byte(contentBuilder.String())
+	return author, nil
+}
+
+func createCommitObject(treeHash string, parentCommitHashes []string, author CommitUser, committer CommitUser, commitMessage string, repoDir string) (*CommitObject, error) {
+	content := formatCommitContent(treeHash, parentCommitHashes, author, committer, commitMessage)
+	return writeCommitObject(content, treeHash, parentCommitHashes, author, committer, commitMessage, "", repoDir)
+}
+
+// Creates a commit object like createCommitObject, signed with the given key (see signPayload). The signature is
+// made over the commit object's content without it, and then added to the content as the gpgsig header.
+func createSignedCommitObject(treeHash string, parentCommitHashes []string, author CommitUser, committer CommitUser, commitMessage string, keyID string, repoDir string) (*CommitObject, error) {
+	content := formatCommitContent(treeHash, parentCommitHashes, author, committer, commitMessage)
+	signature, err := signPayload(content, keyID, committer, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	content = addCommitSignatureHeader(content, signature)
+	return writeCommitObject(content, treeHash, parentCommitHashes, author, committer, commitMessage, signature, repoDir)
+}
+
+func formatCommitContent(treeHash string, parentCommitHashes []string, author CommitUser, committer CommitUser, commitMessage string) string {
+	headers := []*ObjectHeader{{name: "tree", value: treeHash}}
+	for _, parentCommitHash := range parentCommitHashes {
+		headers = append(headers, &ObjectHeader{name: "parent", value: parentCommitHash})
+	}
+	headers = append(headers, &ObjectHeader{name: "author", value: author.format()})
+	headers = append(headers, &ObjectHeader{name: "committer", value: committer.format()})
+
+	return formatObjectContent(headers, commitMessage)
+}
+
+func writeCommitObject(content string, treeHash string, parentCommitHashes []string, author CommitUser, committer CommitUser, commitMessage string, signature string, repoDir string) (*CommitObject, error) {
+	contentBytes := []byte(content)
 	sizeBytes := len(contentBytes)
 	commitObjHash, err := CreateObjectFile(Commit, contentBytes, repoDir)
 	if err != nil {
 		return nil, err
 	}
 
+	headers, _ := parseObjectHeaders(content)
+
 	return &CommitObject{
 		hash:               commitObjHash,
 		sizeBytes:          sizeBytes,
 		treeHash:           treeHash,
 		parentCommitHashes: parentCommitHashes,
-		author:             author_committer,
-		committer:          author_committer,
+		author:             author,
+		committer:          committer,
 		commitMessage:      commitMessage,
+		signature:          signature,
+		headers:            headers,
 	}, nil
 }
 
-func GetAllObjectsInCommit(commitHash string, repoDir string) ([]string, error) {
-	commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read commit object file: %s", err)
+// Parses the identity of a commit's author or committer, i.e. the value of its header: `Name <email> <seconds>
+// <timezone>`. As in Git, the name is everything before the email (so it may contain any number of words, or be
+// empty), and the email is delimited by the last `>`. A missing or malformed date, which Git tolerates in old
+// commits, is treated as the epoch in UTC.
+func parseCommitUser(s string) (*CommitUser, error) {
+	emailStart := strings.IndexByte(s, '<')
+	emailEnd := strings.LastIndexByte(s, '>')
+	if emailStart == -1 || emailEnd < emailStart {
+		return nil, fmt.Errorf("invalid string format for commit user: %s", s)
+	}
+
+	commitUser := &CommitUser{
+		name:        strings.TrimSpace(s[:emailStart]),
+		email:       s[emailStart+1 : emailEnd],
+		dateSeconds: 0,
+		timezone:    "+0000",
+	}
+
+	dateParts := strings.Fields(s[emailEnd+1:])
+	if len(dateParts) == 2 {
+		if dateSeconds, err := strconv.ParseInt(dateParts[0], 10, 64); err == nil {
+			commitUser.dateSeconds, commitUser.timezone = dateSeconds, dateParts[1]
+		}
+	}
+
+	return commitUser, nil
+}
+
+// Formats the identity of a commit's author or committer as the value of its header, the inverse of parseCommitUser
+func (u *CommitUser) format() string {
+	return fmt.Sprintf("%s <%s> %d %s", u.name, u.email, u.dateSeconds, u.timezone)
+}
+
+// Returns the time at which the commit was authored or committed, in the user's timezone (e.g. +0100)
+func (u *CommitUser) time() time.Time {
+	t := time.Unix(u.dateSeconds, 0)
+	if len(u.timezone) != 5 || (u.timezone[0] != '+' && u.timezone[0] != '-') {
+		return t.UTC()
+	}
+
+	offsetHours, errHours := strconv.Atoi(u.timezone[1:3])
+	offsetMinutes, errMinutes := strconv.Atoi(u.timezone[3:5])
+	if errHours != nil || errMinutes != nil {
+		return t.UTC()
 	}
 
-	commitObjHashes := []string{commitObj.hash, commitObj.treeHash}
-	commitObjHashes = append(commitObjHashes, commitObj.parentCommitHashes...)
+	offsetSeconds := offsetHours*3600 + offsetMinutes*60
+	if u.timezone[0] == '-' {
+		offsetSeconds = -offsetSeconds
+	}
+	return t.In(time.FixedZone("", offsetSeconds))
+}
 
-	treeObjHashes, err := getAllObjectsInTree(commitObj.treeHash, repoDir)
+/** TAGS */
+
+func ReadTagObjectFile(objHash string, repoDir string) (*TagObject, error) {
+	headerObjType, sizeBytes, content, err := ReadObjectFile(objHash, repoDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get all objects in commit tree: %s", err)
+		return nil, fmt.Errorf("failed to read tag object file: %s", err)
 	}
-	commitObjHashes = append(commitObjHashes, treeObjHashes...)
 
-	return commitObjHashes, nil
+	if headerObjType != Tag {
+		return nil, fmt.Errorf("expected tag object, received %s", headerObjType.toString())
+	}
+
+	headers, tagMessage := parseObjectHeaders(string(content))
+	tagObj := &TagObject{hash: objHash, sizeBytes: sizeBytes, objectType: -1, tagMessage: tagMessage, headers: headers}
+	for _, header := range headers {
+		switch header.name {
+		case "object":
+			tagObj.objectHash = header.value
+		case "type":
+			tagObj.objectType, err = ObjTypeFromString(header.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid type in tag %s: %s", objHash, err)
+			}
+		case "tag":
+			tagObj.tagName = header.value
+		case "tagger":
+			tagObj.tagger, err = parseCommitUser(header.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tagger in tag %s: %s", objHash, err)
+			}
+		}
+	}
+
+	if !isValidObjectHash(tagObj.objectHash) || tagObj.objectType == -1 {
+		return nil, fmt.Errorf("tag %s has no valid object", objHash)
+	}
+
+	return tagObj, nil
 }
 
-func parseCommitUser(s string) (*CommitUser, error) {
-	parts := strings.Split(s, " ")
-
-	var name string
-	var email string
-	var dateSeconds int
-	var timezone string
-	var err error
-
-	if len(parts) == 5 {
-		name = parts[1]
-		email = parts[2][1 : len(parts[2])-1]
-		dateSeconds, err = strconv.Atoi(parts[3])
-		if err != nil {
-			return nil, err
+// Follows the given object through any tags pointing to it (as for an annotated tag of an annotated tag), returning
+// the object which isn't a tag and its type
+func peelObject(objHash string, repoDir string) (string, ObjectType, error) {
+	for {
+		objType, err := getObjectType(objHash, repoDir)
+		if err != nil || objType != Tag {
+			return objHash, objType, err
 		}
-		timezone = parts[4]
-	} else if len(parts) == 6 {
-		name = parts[1] + " " + parts[2]
-		email = parts[3][1 : len(parts[3])-1]
-		dateSeconds, err = strconv.Atoi(parts[4])
+
+		tagObj, err := ReadTagObjectFile(objHash, repoDir)
 		if err != nil {
-			return nil, err
+			return "", -1, err
 		}
-		timezone = parts[5]
-	} else {
-		return nil, fmt.Errorf("invalid string format for commit user: %s", s)
+		objHash = tagObj.objectHash
 	}
-
-	return &CommitUser{
-		name:        name,
-		email:       email,
-		dateSeconds: int64(dateSeconds),
-		timezone:    timezone,
-	}, nil
 }
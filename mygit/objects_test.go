@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// The author and committer of the commits made by tests, at a fixed date so that the commits' hashes are fixed too
+var TEST_COMMIT_USER = CommitUser{name: "Test User", email: "test@example.com", dateSeconds: 1700000000, timezone: "+0000"}
+
+// Writes the given files (contents keyed by path) into the working tree and commits the whole working tree on top of
+// the given parents, returning the commit's hash
+func createTestCommit(t *testing.T, files map[string]string, parentHashes []string, message string, repoDir string) string {
+	writeTestFiles(t, files, repoDir)
+
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		t.Fatalf("failed to set up content converter: %s", err)
+	}
+	treeObj, err := CreateTreeObjectFromDirectory(repoDir, converter, repoDir)
+	if err != nil {
+		t.Fatalf("failed to create tree object from directory: %s", err)
+	}
+	commitObj, err := createCommitObject(treeObj.hash, parentHashes, TEST_COMMIT_USER, TEST_COMMIT_USER, message+"\n", repoDir)
+	if err != nil {
+		t.Fatalf("failed to create commit object: %s", err)
+	}
+	return commitObj.hash
+}
+
+// Writes the given files (contents keyed by path) into the working tree, creating their directories
+func writeTestFiles(t *testing.T, files map[string]string, repoDir string) {
+	for path, content := range files {
+		fullPath := filepath.Join(repoDir, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatalf("failed to create directory for %s: %s", path, err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", path, err)
+		}
+	}
+}
+
+// Creates a blob object with the given content, returning its hash
+func createTestBlob(t *testing.T, content string, repoDir string) string {
+	blobHash, err := CreateObjectFile(Blob, []byte(content), repoDir)
+	if err != nil {
+		t.Fatalf("failed to create blob object: %s", err)
+	}
+	return blobHash
+}
+
+func TestCreateTreeObjectIsDeterministic(t *testing.T) {
+	repoDir := newTestRepo(t)
+
+	subTreeObj, err := createTreeObject([]TreeObjectEntry{
+		{hash: createTestBlob(t, "nested\n", repoDir), mode: REGULAR_FILE_MODE, name: "nested.txt", objType: Blob},
+	}, repoDir)
+	if err != nil {
+		t.Fatalf("failed to create subdirectory tree object: %s", err)
+	}
+
+	entries := []TreeObjectEntry{
+		{hash: createTestBlob(t, "b\n", repoDir), mode: REGULAR_FILE_MODE, name: "b", objType: Blob},
+		{hash: subTreeObj.hash, mode: DIRECTORY_MODE, name: "a", objType: Tree},
+		{hash: createTestBlob(t, "a0\n", repoDir), mode: EXECUTABLE_FILE_MODE, name: "a0", objType: Blob},
+		{hash: createTestBlob(t, "a.txt\n", repoDir), mode: REGULAR_FILE_MODE, name: "a.txt", objType: Blob},
+	}
+	reversedEntries := slices.Clone(entries)
+	slices.Reverse(reversedEntries)
+
+	treeObj, err := createTreeObject(entries, repoDir)
+	if err != nil {
+		t.Fatalf("failed to create tree object: %s", err)
+	}
+	reversedTreeObj, err := createTreeObject(reversedEntries, repoDir)
+	if err != nil {
+		t.Fatalf("failed to create tree object: %s", err)
+	}
+	if treeObj.hash != reversedTreeObj.hash {
+		t.Errorf("the same entries in a different order made tree %s and then tree %s", treeObj.hash, reversedTreeObj.hash)
+	}
+
+	// As in Git, the directory "a" sorts as "a/", after "a.txt" but before "a0"
+	names := []string{}
+	for _, entry := range treeObj.entries {
+		names = append(names, entry.name)
+	}
+	if expected := []string{"a.txt", "a", "a0", "b"}; !slices.Equal(names, expected) {
+		t.Errorf("tree entries are ordered %v, expected %v", names, expected)
+	}
+}
+
+func TestCreateTreeObjectFromDirectoryIsDeterministic(t *testing.T) {
+	repoDir := newTestRepo(t)
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		t.Fatalf("failed to set up content converter: %s", err)
+	}
+
+	files := map[string]string{
+		"a.txt":          "a.txt\n",
+		"a/nested.txt":   "nested\n",
+		"a0":             "a0\n",
+		"dir/sub/deep.c": "int main() {}\n",
+	}
+	writeTestFiles(t, files, repoDir)
+
+	treeObj, err := CreateTreeObjectFromDirectory(repoDir, converter, repoDir)
+	if err != nil {
+		t.Fatalf("failed to create tree object from directory: %s", err)
+	}
+	secondTreeObj, err := CreateTreeObjectFromDirectory(repoDir, converter, repoDir)
+	if err != nil {
+		t.Fatalf("failed to create tree object from directory: %s", err)
+	}
+	if treeObj.hash != secondTreeObj.hash {
+		t.Errorf("writing the same directory twice made tree %s and then tree %s", treeObj.hash, secondTreeObj.hash)
+	}
+}
+
+func TestCheckObjectContent(t *testing.T) {
+	emptyTreeHash := "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+	testCases := []struct {
+		objType ObjectType
+		content string
+		valid   bool
+	}{
+		{Blob, "anything\x00at all", true},
+		{Tree, "", true},
+		{Tree, "100644 file.txt\x00" + string(make([]byte, OBJECT_HASH_LENGTH_BYTES)), true},
+		{Tree, "100644 dir/file.txt\x00" + string(make([]byte, OBJECT_HASH_LENGTH_BYTES)), false},
+		{Tree, "100644 .git\x00" + string(make([]byte, OBJECT_HASH_LENGTH_BYTES)), false},
+		{Tree, "100644 file.txt\x00short", false},
+		{Commit, "tree " + emptyTreeHash + "\nauthor A <a@example.com> 1700000000 +0000\ncommitter A <a@example.com> 1700000000 +0000\n\nMessage\n", true},
+		{Commit, "tree " + emptyTreeHash + "\nauthor A <a@example.com> 1700000000 +0000\n\nMessage\n", false},
+		{Commit, "not a commit\n", false},
+		{Tag, "object " + emptyTreeHash + "\ntype tree\ntag v1.0\ntagger A <a@example.com> 1700000000 +0000\n\nMessage\n", true},
+		{Tag, "object " + emptyTreeHash + "\ntype tree\ntag v1.0\n\nMessage\n", false},
+	}
+
+	for _, tc := range testCases {
+		err := checkObjectContent(tc.objType, []byte(tc.content))
+		if tc.valid && err != nil {
+			t.Errorf("%s content %q was refused: %s", tc.objType.toString(), tc.content, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("%s content %q was accepted, expected it to be refused", tc.objType.toString(), tc.content)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type OperationType int
+
+const (
+	OperationMerge OperationType = iota
+	OperationRebase
+	OperationCherryPick
+	OperationRevert
+)
+
+// Represents an operation (such as a merge or rebase) which has been started but not yet completed, as recorded by
+// the state files kept in the .git directory while the operation is in progress (in the same format as real Git)
+type InProgressOperation struct {
+	opType      OperationType
+	interactive bool   // For a rebase, whether it's an interactive rebase
+	branchName  string // For a rebase, the branch being rebased (empty if a detached HEAD is being rebased)
+	onto        string // For a rebase, the commit being rebased onto
+	currStep    int    // For a rebase, the number of the commit currently being applied (1-indexed)
+	numSteps    int    // For a rebase, the total number of commits to apply
+	commitHash  string // For a cherry-pick or revert, the commit currently being applied
+	numPending  int    // For a cherry-pick or revert of multiple commits, the number of commits left after this one
+}
+
+// Returns the operations in progress in the repository. A cherry-pick or revert may be in progress during a rebase,
+// for example, so there may be more than one.
+func getInProgressOperations(repoDir string) ([]*InProgressOperation, error) {
+	gitDir := getGitDir(repoDir)
+	operations := []*InProgressOperation{}
+
+	if fileExists(filepath.Join(gitDir, "MERGE_HEAD")) {
+		operations = append(operations, &InProgressOperation{opType: OperationMerge})
+	}
+
+	rebaseOperation, err := readRebaseState(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	if rebaseOperation != nil {
+		operations = append(operations, rebaseOperation)
+	}
+
+	for _, pick := range []struct {
+		opType   OperationType
+		headFile string
+	}{{OperationCherryPick, "CHERRY_PICK_HEAD"}, {OperationRevert, "REVERT_HEAD"}} {
+		commitHash, exists, err := readStateFile(filepath.Join(gitDir, pick.headFile))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		numPending, err := countSequencerTodo(gitDir)
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, &InProgressOperation{opType: pick.opType, commitHash: commitHash, numPending: numPending})
+	}
+
+	return operations, nil
+}
+
+// Reads the state of a rebase in progress, which is kept in .git/rebase-merge/ (or .git/rebase-apply/ by the older
+// patch-based backend). Returns nil if no rebase is in progress.
+func readRebaseState(gitDir string) (*InProgressOperation, error) {
+	stateDir, currStepFile, numStepsFile := filepath.Join(gitDir, "rebase-merge"), "msgnum", "end"
+	if !fileExists(stateDir) {
+		stateDir, currStepFile, numStepsFile = filepath.Join(gitDir, "rebase-apply"), "next", "last"
+
+		// The patch-based backend also uses rebase-apply/ for git am, which is marked by an applying file
+		if !fileExists(stateDir) || fileExists(filepath.Join(stateDir, "applying")) {
+			return nil, nil
+		}
+	}
+
+	operation := &InProgressOperation{
+		opType:      OperationRebase,
+		interactive: fileExists(filepath.Join(stateDir, "interactive")),
+	}
+
+	headName, _, err := readStateFile(filepath.Join(stateDir, "head-name"))
+	if err != nil {
+		return nil, err
+	}
+	operation.branchName = strings.TrimPrefix(headName, "refs/heads/")
+	if headName == "detached HEAD" {
+		operation.branchName = ""
+	}
+
+	operation.onto, _, err = readStateFile(filepath.Join(stateDir, "onto"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, step := range []struct {
+		fileName string
+		value    *int
+	}{{currStepFile, &operation.currStep}, {numStepsFile, &operation.numSteps}} {
+		stepStr, exists, err := readStateFile(filepath.Join(stateDir, step.fileName))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			*step.value, _ = strconv.Atoi(stepStr)
+		}
+	}
+
+	return operation, nil
+}
+
+// Counts the commits still to be cherry-picked or reverted after the current one, listed in .git/sequencer/todo
+func countSequencerTodo(gitDir string) (int, error) {
+	file, err := os.Open(filepath.Join(gitDir, "sequencer", "todo"))
+	if err != nil && os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return -1, fmt.Errorf("failed to read sequencer todo list: %s", err)
+	}
+	defer file.Close()
+
+	numCommands := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && line[0] != '#' {
+			numCommands += 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return -1, fmt.Errorf("failed to read sequencer todo list: %s", err)
+	}
+
+	// The first command in the todo list is the one currently being applied
+	return max(numCommands-1, 0), nil
+}
+
+// Returns the number of entries in the stash, i.e. the number of entries in the reflog of refs/stash
+func getStashCount(repoDir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(getCommonDir(repoDir), "logs", "refs", "stash"))
+	if err != nil && !os.IsNotExist(err) {
+		return -1, fmt.Errorf("failed to read stash reflog: %s", err)
+	}
+
+	numEntries := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" {
+			numEntries += 1
+		}
+	}
+	if numEntries > 0 {
+		return numEntries, nil
+	}
+
+	// Without a reflog, only the stash entry pointed to by refs/stash itself is known
+	_, exists, err := resolveRef("refs/stash", repoDir)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// Reads a single-line state file, returning its trimmed contents
+func readStateFile(path string) (string, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to read %s: %s", filepath.Base(path), err)
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Checks whether the path is a directory. A symbolic link to a directory isn't one, since it's stored as a link.
+func isDirectory(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The header traits only promise sorted refs. The "peeled" trait isn't claimed because annotated tags aren't peeled
+// when packed, so the peeled value is only recorded for refs which already had one.
+const PACKED_REFS_HEADER = "# pack-refs with: sorted"
+
+// Represents a ref stored in the .git/packed-refs file rather than as a loose file under .git/refs/. For an
+// annotated tag, peeledHash is the hash of the object that the tag ultimately points to (empty if not recorded).
+type PackedRef struct {
+	name       string // The full ref name, e.g. refs/heads/main
+	hash       string
+	peeledHash string
+}
+
+func getPackedRefsPath(repoDir string) string {
+	return filepath.Join(getCommonDir(repoDir), "packed-refs")
+}
+
+// Reads the packed-refs file, returning a mapping from full ref names to their packed refs. A missing
+// packed-refs file simply means that no refs are packed.
+func readPackedRefs(repoDir string) (map[string]*PackedRef, error) {
+	packedRefs := make(map[string]*PackedRef)
+
+	file, err := os.Open(getPackedRefsPath(repoDir))
+	if err != nil && os.IsNotExist(err) {
+		return packedRefs, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open packed-refs file: %s", err)
+	}
+	defer file.Close()
+
+	var prevRef *PackedRef
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		// A line starting with ^ gives the peeled value of the annotated tag on the preceding line
+		if line[0] == '^' {
+			peeledHash := line[1:]
+			if prevRef == nil || !isValidObjectHash(peeledHash) {
+				return nil, fmt.Errorf("invalid peeled line in packed-refs file: %s", line)
+			}
+			prevRef.peeledHash = peeledHash
+			continue
+		}
+
+		hash, name, found := strings.Cut(line, " ")
+		if !found || !isValidObjectHash(hash) || !strings.HasPrefix(name, "refs/") {
+			return nil, fmt.Errorf("invalid line in packed-refs file: %s", line)
+		}
+
+		prevRef = &PackedRef{name: name, hash: hash}
+		packedRefs[name] = prevRef
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read packed-refs file: %s", err)
+	}
+
+	return packedRefs, nil
+}
+
+// Replaces the packed-refs file with the given refs, sorted by name
+func writePackedRefs(packedRefs map[string]*PackedRef, repoDir string) error {
+	refNames := make([]string, 0, len(packedRefs))
+	for refName := range packedRefs {
+		refNames = append(refNames, refName)
+	}
+	sort.Strings(refNames)
+
+	var sb strings.Builder
+	sb.WriteString(PACKED_REFS_HEADER + "\n")
+	for _, refName := range refNames {
+		packedRef := packedRefs[refName]
+		fmt.Fprintf(&sb, "%s %s\n", packedRef.hash, packedRef.name)
+		if packedRef.peeledHash != "" {
+			fmt.Fprintf(&sb, "^%s\n", packedRef.peeledHash)
+		}
+	}
+
+	return writeFileWithLock(getPackedRefsPath(repoDir), []byte(sb.String()))
+}
+
+// Moves loose refs into the packed-refs file and removes the loose ref files. By default, only tags and refs that
+// are already packed are packed (as branches are expected to be updated frequently), and if all is set, every ref
+// is packed. Symbolic refs are never packed. Returns the number of refs packed.
+func PackRefs(all bool, repoDir string) (int, error) {
+	packedRefs, err := readPackedRefs(repoDir)
+	if err != nil {
+		return -1, err
+	}
+
+	looseRefs, err := readLooseRefs(repoDir)
+	if err != nil {
+		return -1, err
+	}
+
+	refsToPrune := []*PackedRef{}
+	for _, looseRef := range looseRefs {
+		existingPackedRef, alreadyPacked := packedRefs[looseRef.name]
+		if !all && !alreadyPacked && !strings.HasPrefix(looseRef.name, "refs/tags/") {
+			continue
+		}
+
+		// A peeled value recorded for the ref is only kept if the ref still points to the same tag
+		if alreadyPacked && existingPackedRef.hash == looseRef.hash {
+			looseRef.peeledHash = existingPackedRef.peeledHash
+		}
+
+		packedRefs[looseRef.name] = looseRef
+		refsToPrune = append(refsToPrune, looseRef)
+	}
+
+	if err := writePackedRefs(packedRefs, repoDir); err != nil {
+		return -1, fmt.Errorf("failed to write packed-refs file: %s", err)
+	}
+
+	for _, packedRef := range refsToPrune {
+		if err := pruneLooseRef(packedRef, repoDir); err != nil {
+			return -1, err
+		}
+	}
+
+	return len(refsToPrune), nil
+}
+
+// Returns every loose ref file under .git/refs/ that points directly to an object
+func readLooseRefs(repoDir string) ([]*PackedRef, error) {
+	commonDir := getCommonDir(repoDir)
+	looseRefs := []*PackedRef{}
+
+	err := filepath.WalkDir(filepath.Join(commonDir, "refs"), func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, LOCK_FILE_SUFFIX) {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read ref file %s: %s", path, err)
+		}
+		hash := strings.TrimSpace(string(content))
+		if !isValidObjectHash(hash) {
+			return nil // Symbolic refs (e.g. refs/remotes/origin/HEAD) can't be packed
+		}
+
+		refName, err := filepath.Rel(commonDir, path)
+		if err != nil {
+			return err
+		}
+
+		looseRefs = append(looseRefs, &PackedRef{name: filepath.ToSlash(refName), hash: hash})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read loose refs: %s", err)
+	}
+
+	return looseRefs, nil
+}
+
+// Removes the loose file for a ref that has been packed, unless it has been updated since it was read
+func pruneLooseRef(packedRef *PackedRef, repoDir string) error {
+	refPath := getRefPath(packedRef.name, repoDir)
+
+	lock, err := acquireLockFile(refPath)
+	if err != nil {
+		return err
+	}
+	defer lock.rollback()
+
+	content, err := os.ReadFile(refPath)
+	if err != nil {
+		return fmt.Errorf("failed to read ref file %s: %s", packedRef.name, err)
+	}
+	if strings.TrimSpace(string(content)) != packedRef.hash {
+		return nil
+	}
+
+	if err := os.Remove(refPath); err != nil {
+		return fmt.Errorf("failed to remove loose ref file %s: %s", packedRef.name, err)
+	}
+
+	return nil
+}
@@ -1,151 +1,246 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 )
 
-func ReadPackfile(packfile []byte, repoDir string) error {
-	err := verifyPackfileChecksum(packfile)
-	if err != nil {
-		return err
-	}
-	packfile = packfile[:len(packfile)-PACKFILE_CHECKSUM_LENGTH]
+// Represents what was unpacked from a packfile
+type PackfileUnpackStats struct {
+	numObjects  int
+	objectBytes int64 // The total size of the unpacked objects' contents, before compression and deltification
+}
 
-	i := 0
+// Writes each object in the packfile to the repository as a loose object file. The packfile is read as it's received
+// (e.g. from the network), so only the object being unpacked and the delta base cache are held in memory, however
+// large the packfile is. Since its checksum is at the end, it's only verified once every object has been written,
+// so a corrupt packfile may leave behind some objects, which aren't referenced by anything. Unless reportProgress is
+// false, the objects received (and the bytes of the packfile read) are reported as they're unpacked (see Progress).
+func unpackPackfile(reader io.Reader, reportProgress bool, repoDir string) (*PackfileUnpackStats, error) {
+	packReader := newPackfileReader(reader)
 
-	numObjects, err := readPackfileHeader(packfile)
+	numObjects, err := readPackfileHeader(packReader)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Printf("remote: Enumerating objects: %d, done.\n", numObjects)
-	i += PACKFILE_HEADER_LENGTH
 
-	err = readPackfileObjects(packfile, i, numObjects, repoDir)
+	deltaBaseCacheLimit, err := getDeltaBaseCacheLimit(repoDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Printf("Reading objects: 100%% (%d/%d), done.\n", numObjects, numObjects)
 
-	return nil
+	unpacker := &PackfileUnpacker{
+		reader:         packReader,
+		stats:          &PackfileUnpackStats{numObjects: numObjects},
+		deltaBaseCache: newDeltaBaseCache(deltaBaseCacheLimit),
+		objHashes:      make(map[int]string),
+		repoDir:        repoDir,
+	}
+	var progress *Progress
+	if reportProgress {
+		progress = startProgress("Receiving objects", numObjects, true)
+		defer progress.stop()
+	}
+	for i := range numObjects {
+		if err := unpacker.readPackfileObject(); err != nil {
+			return nil, err
+		}
+		progress.update(i+1, int64(packReader.offset))
+	}
+
+	if err := packReader.verifyChecksum(); err != nil {
+		return nil, err
+	}
+	progress.done()
+
+	// Ref delta objects may use objects later in the packfile as their base objects, so they're applied last
+	var deltaProgress *Progress
+	if reportProgress && len(unpacker.refDeltaObjs) > 0 {
+		deltaProgress = startProgress("Resolving deltas", len(unpacker.refDeltaObjs), false)
+		defer deltaProgress.stop()
+	}
+	if err := applyRefDeltas(unpacker.refDeltaObjs, unpacker.stats, deltaProgress, repoDir); err != nil {
+		return nil, err
+	}
+	deltaProgress.done()
+
+	return unpacker.stats, nil
 }
 
-func verifyPackfileChecksum(packfile []byte) error {
-	if len(packfile) < PACKFILE_CHECKSUM_LENGTH {
-		return fmt.Errorf("invalid packfile: too short to contain a checksum")
+// Reads a packfile as it's received, keeping track of the offset of each object within it (by which ofs delta objects
+// refer to their base objects) and the checksum of what has been read. Objects are decompressed straight from the
+// reader, which (since it's an io.ByteReader) zlib reads from a byte at a time, without reading past their end.
+type PackfileReader struct {
+	reader   *bufio.Reader
+	checksum *PackfileChecksumReader
+	offset   int
+}
+
+func newPackfileReader(reader io.Reader) *PackfileReader {
+	checksum := &PackfileChecksumReader{reader: reader, hash: sha1.New()}
+	return &PackfileReader{reader: bufio.NewReaderSize(checksum, 64*1024), checksum: checksum}
+}
+
+func (r *PackfileReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.offset += n
+	return n, err
+}
+
+func (r *PackfileReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.offset += 1
 	}
+	return b, err
+}
 
-	expectedChecksum := packfile[len(packfile)-PACKFILE_CHECKSUM_LENGTH:]
-	actualChecksum := sha1.Sum(packfile[:len(packfile)-PACKFILE_CHECKSUM_LENGTH])
+// Checks that all that's left after the objects is the packfile's checksum, and that it matches the rest of the
+// packfile
+func (r *PackfileReader) verifyChecksum() error {
+	rest, err := io.ReadAll(r.reader)
+	if err != nil {
+		return fmt.Errorf("failed to read packfile: %s", err)
+	}
+	if len(rest) < PACKFILE_CHECKSUM_LENGTH {
+		return fmt.Errorf("invalid packfile: too short to contain a checksum")
+	}
+	if len(rest) > PACKFILE_CHECKSUM_LENGTH {
+		return fmt.Errorf("leftover data in packfile after reading all expected objects")
+	}
 
-	if !bytes.Equal(expectedChecksum, actualChecksum[:]) {
+	if !bytes.Equal(rest, r.checksum.hash.Sum(nil)) {
 		return fmt.Errorf("invalid packfile: actual checksum does not match expected checksum")
 	}
-
 	return nil
 }
 
-func readPackfileHeader(packfile []byte) (int, error) {
-	if len(packfile) < PACKFILE_HEADER_LENGTH {
+// Hashes a packfile as it's read, apart from its last 20 bytes (its checksum, as long as nothing follows it), which
+// are held back from the hash until more of the packfile is read
+type PackfileChecksumReader struct {
+	reader  io.Reader
+	hash    hash.Hash
+	pending []byte
+}
+
+func (r *PackfileChecksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.pending = append(r.pending, p[:n]...)
+	if excess := len(r.pending) - PACKFILE_CHECKSUM_LENGTH; excess > 0 {
+		r.hash.Write(r.pending[:excess])
+		r.pending = append(r.pending[:0], r.pending[excess:]...)
+	}
+	return n, err
+}
+
+func readPackfileHeader(reader io.Reader) (int, error) {
+	header := make([]byte, PACKFILE_HEADER_LENGTH)
+	if _, err := io.ReadFull(reader, header); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 		return -1, fmt.Errorf("invalid packfile: too short to contain a header")
+	} else if err != nil {
+		return -1, fmt.Errorf("failed to read packfile: %s", err)
 	}
 
-	signature := string(packfile[0:4])
+	signature := string(header[0:4])
 	if signature != PACKFILE_SIGNATURE {
 		return -1, fmt.Errorf("invalid packfile signature: expected 'PACK', got '%s'", signature)
 	}
 
-	versionNumber := binary.BigEndian.Uint32(packfile[4:8])
+	versionNumber := binary.BigEndian.Uint32(header[4:8])
 	if versionNumber != PACKFILE_VERSION_NUMBER {
 		return -1, fmt.Errorf("unsupported packfile version number: expected %d, got %d", PACKFILE_VERSION_NUMBER, versionNumber)
 	}
 
-	numObjects := binary.BigEndian.Uint32(packfile[8:12])
+	numObjects := binary.BigEndian.Uint32(header[8:12])
 	return int(numObjects), nil
 }
 
-func readPackfileObjects(packfile []byte, i int, numObjects int, repoDir string) error {
-	refDeltaObjs := []*PackfileRefDeltaObject{}
-
-	for range numObjects {
-		var refDeltaObj *PackfileRefDeltaObject
-		var err error
-		refDeltaObj, i, err = readPackfileObject(packfile, i, repoDir)
-		if err != nil {
-			return err
-		}
-
-		if refDeltaObj != nil {
-			refDeltaObjs = append(refDeltaObjs, refDeltaObj)
-		}
-	}
-
-	if i != len(packfile) {
-		return fmt.Errorf("leftover data in packfile after reading all expected objects")
-	}
-
-	err := applyRefDeltas(refDeltaObjs, repoDir)
-	if err != nil {
-		return err
-	}
-
-	return nil
+// Represents the state of unpacking a packfile as it's read
+type PackfileUnpacker struct {
+	reader         *PackfileReader
+	stats          *PackfileUnpackStats
+	deltaBaseCache *DeltaBaseCache
+	objHashes      map[int]string // The hash of the object at each offset, to read base objects back once they're evicted from the cache
+	refDeltaObjs   []*PackfileRefDeltaObject
+	repoDir        string
 }
 
-func readPackfileObject(packfile []byte, i int, repoDir string) (*PackfileRefDeltaObject, int, error) {
-	packfileObjectStartPos := i
+func (u *PackfileUnpacker) readPackfileObject() error {
+	packfileObjectStartPos := u.reader.offset
 
-	packfileObjectType, packfileObjectLength, i, err := readPackfileObjectHeader(packfile, i)
+	packfileObjectType, packfileObjectLength, err := readPackfileObjectHeader(u.reader)
 	if err != nil {
-		return nil, -1, err
+		return err
 	}
 
-	var objTypeStr string
-	switch packfileObjType := PackfileObjectType(packfileObjectType); packfileObjType {
+	var objType ObjectType
+	var objContent []byte
+	switch packfileObjectType {
 	case PACKFILE_OBJ_COMMIT, PACKFILE_OBJ_TREE, PACKFILE_OBJ_BLOB, PACKFILE_OBJ_TAG:
-		objTypeStr = packfileObjType.toString()
+		objType, err = ObjTypeFromString(packfileObjectType.toString())
+		if err != nil {
+			return err
+		}
+
+		objContent, err = decompressPackfileObject(u.reader, packfileObjectLength)
+		if err != nil {
+			return err
+		}
 	case PACKFILE_OBJ_OFS_DELTA:
-		_, i, err = applyOfsDeltaPackfileObject(packfile, i, packfileObjectStartPos, packfileObjectLength, repoDir)
-		return nil, i, err
+		objType, objContent, err = u.resolveOfsDeltaPackfileObject(packfileObjectStartPos, packfileObjectLength)
+		if err != nil {
+			return err
+		}
 	case PACKFILE_OBJ_REF_DELTA:
-		refDeltaObj, i, err := readRefDeltaPackfileObject(packfile, i, packfileObjectLength)
-		return refDeltaObj, i, err
+		refDeltaObj, err := readRefDeltaPackfileObject(u.reader, packfileObjectLength)
+		if err != nil {
+			return err
+		}
+		u.refDeltaObjs = append(u.refDeltaObjs, refDeltaObj)
+		return nil
 	default:
-		return nil, -1, fmt.Errorf("unsupported packfile object type: %d", packfileObjectType)
-	}
-
-	decompressedObjData, i, err := decompressPackfileObject(packfile, i, packfileObjectLength)
-	if err != nil {
-		return nil, -1, err
+		return fmt.Errorf("unsupported packfile object type: %d", packfileObjectType)
 	}
 
-	objType, err := ObjTypeFromString(objTypeStr)
-	if err != nil {
-		return nil, -1, err
-	}
+	// Later ofs delta objects may use this object as their base object
+	u.deltaBaseCache.add(packfileObjectStartPos, objType, objContent)
 
-	_, err = CreateObjectFile(objType, decompressedObjData, repoDir)
+	objHash, err := CreateObjectFile(objType, objContent, u.repoDir)
 	if err != nil {
-		return nil, -1, fmt.Errorf("failed to create object file: %s", err)
+		return fmt.Errorf("failed to create object file: %s", err)
 	}
+	u.objHashes[packfileObjectStartPos] = objHash
+	u.stats.objectBytes += int64(len(objContent))
 
-	return nil, i, nil
+	return nil
 }
 
-func readPackfileObjectHeader(packfile []byte, i int) (PackfileObjectType, int, int, error) {
-	b := packfile[i]
+func readPackfileObjectHeader(reader io.ByteReader) (PackfileObjectType, int, error) {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return -1, -1, fmt.Errorf("failed to read packfile object header: %s", err)
+	}
 	shift := 4
 	packfileObjectType := PackfileObjectType((b >> shift) & 0x07)
 
-	// Only the rightmost 4 bits of the first byte are used for the variable length encoding, so passing shift as 4
-	packfileObjectLength, i, err := readVariableSizeEncoding(packfile, i, shift)
-	if err != nil {
-		return -1, -1, -1, err
+	// Only the rightmost 4 bits of the first byte are used for the variable length encoding
+	packfileObjectLength := int(b & 0x0F)
+	for (b & 0x80) != 0 {
+		if b, err = reader.ReadByte(); err != nil {
+			return -1, -1, fmt.Errorf("failed to read packfile object header: %s", err)
+		}
+		packfileObjectLength |= int(b&0x7F) << shift // Shift the new 7 bits received, as they are the most significant
+		shift += 7
 	}
 
-	return packfileObjectType, packfileObjectLength, i, nil
+	return packfileObjectType, packfileObjectLength, nil
 }
 
 // Used for reading encoded sizes in the packfile (later values more significant)
@@ -189,102 +284,118 @@ func readVariableOffsetEncoding(data []byte, i int) (int, int, error) {
 	return decodedOffset, i + bytesRead, nil
 }
 
-func decompressPackfileObject(data []byte, i int, packfileObjectLength int) ([]byte, int, error) {
-	decompressedObjData, compressedBytesRead, err := zlibDecompressWithReadCount(data[i:])
+// Reads the offset of an ofs delta object's base object, encoded in the same way as by readVariableOffsetEncoding
+func readPackfileBaseObjectOffset(reader io.ByteReader) (int, error) {
+	b, err := reader.ReadByte()
 	if err != nil {
-		return nil, -1, err
+		return -1, fmt.Errorf("failed to read base object offset: %s", err)
 	}
+	decodedOffset := int(b & 0x7F)
 
-	if len(decompressedObjData) != packfileObjectLength {
-		return nil, -1, fmt.Errorf("decompressed object data length mismatch: expected %d, got %d", packfileObjectLength, len(decompressedObjData))
+	for (b & 0x80) != 0 {
+		if b, err = reader.ReadByte(); err != nil {
+			return -1, fmt.Errorf("failed to read base object offset: %s", err)
+		}
+		decodedOffset = (decodedOffset + 1) << 7 // Apply bias for multi-byte offsets
+		decodedOffset |= int(b & 0x7F)           // Append next 7 bits
+	}
+
+	return decodedOffset, nil
+}
+
+// Decompresses the object at the reader's position, reading exactly as far as the end of its compressed data
+func decompressPackfileObject(reader *PackfileReader, packfileObjectLength int) ([]byte, error) {
+	zr, err := zlib.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize zlib reader: %s", err)
 	}
+	defer zr.Close()
 
-	return decompressedObjData, i + compressedBytesRead, nil
+	decompressedObjData := bytes.NewBuffer(make([]byte, 0, packfileObjectLength))
+	if _, err := decompressedObjData.ReadFrom(zr); err != nil {
+		return nil, fmt.Errorf("failed to decompress data with zlib: %s", err)
+	}
+
+	if decompressedObjData.Len() != packfileObjectLength {
+		return nil, fmt.Errorf("decompressed object data length mismatch: expected %d, got %d", packfileObjectLength, decompressedObjData.Len())
+	}
+
+	return decompressedObjData.Bytes(), nil
 }
 
-func applyOfsDeltaPackfileObject(packfile []byte, i int, deltaObjStartPos int, packfileObjectLength int, repoDir string) (string, int, error) {
+func (u *PackfileUnpacker) resolveOfsDeltaPackfileObject(deltaObjStartPos int, packfileObjectLength int) (ObjectType, []byte, error) {
 	// This offset is a negative relative offset from the ofs delta object's position in the packfile, indicating where the base object starts
-	baseObjOffset, i, err := readVariableOffsetEncoding(packfile, i)
+	baseObjOffset, err := readPackfileBaseObjectOffset(u.reader)
 	if err != nil {
-		return "", -1, err
+		return -1, nil, err
 	}
 
-	deltaData, i, err := decompressPackfileObject(packfile, i, packfileObjectLength)
+	deltaData, err := decompressPackfileObject(u.reader, packfileObjectLength)
 	if err != nil {
-		return "", -1, err
+		return -1, nil, err
 	}
 
 	baseObjPos := deltaObjStartPos - baseObjOffset
-	if baseObjPos < 0 || baseObjPos >= len(packfile) {
-		return "", -1, fmt.Errorf("invalid base object position indicated by ofs delta object: %d", baseObjPos)
+	if baseObjPos < 0 || baseObjPos >= deltaObjStartPos {
+		return -1, nil, fmt.Errorf("invalid base object position indicated by ofs delta object: %d", baseObjPos)
 	}
 
-	packfileObjectType, packfileObjectLength, j, err := readPackfileObjectHeader(packfile, baseObjPos)
+	targetObjType, baseObjContent, err := u.getPackfileObjectAtPos(baseObjPos)
 	if err != nil {
-		return "", -1, err
+		return -1, nil, err
 	}
 
-	// We could have a chain of delta objects, so we may need to recursively resolve them
-	var targetObjType ObjectType
-	var baseObjContent []byte
-	if packfileObjectType == PACKFILE_OBJ_OFS_DELTA {
-		baseObjHash, _, err := applyOfsDeltaPackfileObject(packfile, j, baseObjPos, packfileObjectLength, repoDir)
-		if err != nil {
-			return "", -1, err
-		}
+	targetObjContent, err := applyDelta(deltaData, baseObjContent)
+	if err != nil {
+		return -1, nil, err
+	}
 
-		targetObjType, _, baseObjContent, err = ReadObjectFile(baseObjHash, repoDir)
-		if err != nil {
-			return "", -1, fmt.Errorf("failed to read base object referenced by delta object: %s", err)
-		}
-	} else if packfileObjectType == PACKFILE_OBJ_REF_DELTA {
-		return "", -1, fmt.Errorf("ofs_delta object referencing a ref_delta object as its base object is not supported")
-	} else {
-		targetObjType, err = ObjTypeFromString(packfileObjectType.toString())
-		if err != nil {
-			return "", -1, err
-		}
+	return targetObjType, targetObjContent, nil
+}
 
-		baseObjContent, _, err = decompressPackfileObject(packfile, j, packfileObjectLength)
-		if err != nil {
-			return "", -1, err
-		}
+// Returns the type and content of the object starting at the given position in the packfile, which has already been
+// read. Base objects are usually found in the delta base cache, but are read back from their object files if they
+// were evicted or too large to be cached, since the packfile itself can't be read again.
+func (u *PackfileUnpacker) getPackfileObjectAtPos(pos int) (ObjectType, []byte, error) {
+	if objType, objContent, found := u.deltaBaseCache.get(pos); found {
+		return objType, objContent, nil
 	}
 
-	targetObjContent, err := applyDelta(deltaData, baseObjContent)
-	if err != nil {
-		return "", -1, err
+	objHash, found := u.objHashes[pos]
+	if !found {
+		// Ref delta objects aren't resolved until the whole packfile has been read
+		return -1, nil, fmt.Errorf("ofs_delta object referencing a ref_delta object (or no object) as its base object is not supported")
 	}
 
-	targetObjHash, err := CreateObjectFile(targetObjType, targetObjContent, repoDir)
+	objType, _, objContent, err := ReadObjectFile(objHash, u.repoDir)
 	if err != nil {
-		return "", -1, err
+		return -1, nil, fmt.Errorf("failed to read base object referenced by delta object: %s", err)
 	}
 
-	return targetObjHash, i, nil
+	u.deltaBaseCache.add(pos, objType, objContent)
+
+	return objType, objContent, nil
 }
 
-func readRefDeltaPackfileObject(packfile []byte, i int, packfileObjectLength int) (*PackfileRefDeltaObject, int, error) {
-	if len(packfile[i:]) < OBJECT_HASH_LENGTH_BYTES {
-		return nil, -1, fmt.Errorf("invalid ref_delta packfile object: too short to contain base object SHA")
+func readRefDeltaPackfileObject(reader *PackfileReader, packfileObjectLength int) (*PackfileRefDeltaObject, error) {
+	baseObjSHA := make([]byte, OBJECT_HASH_LENGTH_BYTES)
+	if _, err := io.ReadFull(reader, baseObjSHA); err != nil {
+		return nil, fmt.Errorf("invalid ref_delta packfile object: too short to contain base object SHA")
 	}
 
-	baseObjSHA := fmt.Sprintf("%x", packfile[i:i+OBJECT_HASH_LENGTH_BYTES])
-	i += OBJECT_HASH_LENGTH_BYTES
-
-	deltaData, i, err := decompressPackfileObject(packfile, i, packfileObjectLength)
+	deltaData, err := decompressPackfileObject(reader, packfileObjectLength)
 	if err != nil {
-		return nil, -1, err
+		return nil, err
 	}
 
 	return &PackfileRefDeltaObject{
-		baseObjHash: baseObjSHA,
+		baseObjHash: fmt.Sprintf("%x", baseObjSHA),
 		deltaData:   deltaData,
-	}, i, nil
+	}, nil
 }
 
-func applyRefDeltas(refDeltaObjs []*PackfileRefDeltaObject, repoDir string) error {
-	for _, refDeltaObj := range refDeltaObjs {
+func applyRefDeltas(refDeltaObjs []*PackfileRefDeltaObject, stats *PackfileUnpackStats, progress *Progress, repoDir string) error {
+	for i, refDeltaObj := range refDeltaObjs {
 		objType, _, baseObjContent, err := ReadObjectFile(refDeltaObj.baseObjHash, repoDir)
 		if err != nil {
 			return fmt.Errorf("failed to read base object referenced by delta object: %s", err)
@@ -299,6 +410,8 @@ func applyRefDeltas(refDeltaObjs []*PackfileRefDeltaObject, repoDir string) erro
 		if err != nil {
 			return err
 		}
+		stats.objectBytes += int64(len(targetObjContent))
+		progress.update(i+1, 0)
 	}
 
 	return nil
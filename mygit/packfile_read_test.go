@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// The number of ofs delta objects in the chain of the packfile read by BenchmarkUnpackDeepDeltaChain
+const BENCHMARK_DELTA_CHAIN_DEPTH = 1000
+
+// Creates an empty repository in a temporary directory, isolated from the user's and the system's config files
+func newTestRepo(tb testing.TB) string {
+	tb.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	tb.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(tb.TempDir(), "gitconfig"))
+
+	repoDir := tb.TempDir()
+	if _, err := initRepo(repoDir, InitOptions{initialBranch: "main"}); err != nil {
+		tb.Fatalf("failed to initialize repository: %s", err)
+	}
+	return repoDir
+}
+
+// Builds a packfile holding a blob followed by a chain of ofs delta objects, each of which appends a line to the
+// object before it, so that resolving the last object means resolving every object in the chain. Returns the
+// packfile along with the content of the last object.
+func buildDeltaChainPackfile(tb testing.TB, depth int) ([]byte, []byte) {
+	var packfile bytes.Buffer
+	packfile.WriteString("PACK")
+	binary.Write(&packfile, binary.BigEndian, uint32(2))
+	binary.Write(&packfile, binary.BigEndian, uint32(depth+1))
+
+	writeObject := func(packfileObjType PackfileObjectType, data []byte, baseObjOffset []byte) {
+		header, err := encodePackfileObjectHeader(packfileObjType, len(data))
+		if err != nil {
+			tb.Fatalf("failed to encode packfile object header: %s", err)
+		}
+		compressed, err := zlibCompressBytes(data)
+		if err != nil {
+			tb.Fatalf("failed to compress packfile object: %s", err)
+		}
+		packfile.Write(header)
+		packfile.Write(baseObjOffset)
+		packfile.Write(compressed)
+	}
+
+	content := bytes.Repeat([]byte("A line of the blob at the base of the delta chain\n"), 100)
+	prevPos := packfile.Len()
+	writeObject(PACKFILE_OBJ_BLOB, content, nil)
+
+	for i := range depth {
+		line := []byte(fmt.Sprintf("Line %d, added by a delta\n", i))
+		newContent := append(append([]byte{}, content...), line...)
+
+		// The delta copies the whole base object (from offset 0, with a 3-byte size) and then adds the new line
+		delta := encodeVariableLengthSize(len(content), 7)
+		delta = append(delta, encodeVariableLengthSize(len(newContent), 7)...)
+		delta = append(delta, 0x80|0x10|0x20|0x40, byte(len(content)), byte(len(content)>>8), byte(len(content)>>16))
+		delta = append(delta, byte(len(line)))
+		delta = append(delta, line...)
+
+		pos := packfile.Len()
+		writeObject(PACKFILE_OBJ_OFS_DELTA, delta, encodeTestBaseObjectOffset(pos-prevPos))
+		prevPos, content = pos, newContent
+	}
+
+	checksum := sha1.Sum(packfile.Bytes())
+	packfile.Write(checksum[:])
+	return packfile.Bytes(), content
+}
+
+// Encodes the offset of an ofs delta object's base object, as decoded by readPackfileBaseObjectOffset
+func encodeTestBaseObjectOffset(offset int) []byte {
+	encoded := []byte{byte(offset & 0x7F)}
+	for offset >>= 7; offset > 0; offset >>= 7 {
+		offset--
+		encoded = append([]byte{0x80 | byte(offset&0x7F)}, encoded...)
+	}
+	return encoded
+}
+
+func TestUnpackDeepDeltaChain(t *testing.T) {
+	for _, cacheLimit := range []int{DEFAULT_DELTA_BASE_CACHE_LIMIT, 0} {
+		repoDir := newTestRepo(t)
+		if err := setConfigValue(filepath.Join(repoDir, ".git", "config"), "core.deltaBaseCacheLimit", strconv.Itoa(cacheLimit)); err != nil {
+			t.Fatalf("failed to set core.deltaBaseCacheLimit: %s", err)
+		}
+
+		packfile, lastContent := buildDeltaChainPackfile(t, 50)
+		stats, err := unpackPackfile(bytes.NewReader(packfile), false, repoDir)
+		if err != nil {
+			t.Fatalf("failed to unpack packfile with core.deltaBaseCacheLimit=%d: %s", cacheLimit, err)
+		}
+		if stats.numObjects != 51 {
+			t.Errorf("unpacked %d objects, expected 51", stats.numObjects)
+		}
+
+		lastHash, _ := hashObject(Blob, lastContent)
+		blobObj, err := ReadBlobObjectFile(lastHash, repoDir)
+		if err != nil {
+			t.Fatalf("failed to read the last object of the delta chain: %s", err)
+		}
+		if !bytes.Equal(blobObj.content, lastContent) {
+			t.Errorf("the last object of the delta chain was resolved incorrectly with core.deltaBaseCacheLimit=%d", cacheLimit)
+		}
+	}
+}
+
+// Measures unpacking a packfile with a deep delta chain, with the default delta base cache and with the cache
+// disabled, in which case the base of each delta has to be read back from its object file
+func BenchmarkUnpackDeepDeltaChain(b *testing.B) {
+	packfile, _ := buildDeltaChainPackfile(b, BENCHMARK_DELTA_CHAIN_DEPTH)
+
+	for _, cacheLimit := range []int{DEFAULT_DELTA_BASE_CACHE_LIMIT, 0} {
+		b.Run(fmt.Sprintf("deltaBaseCacheLimit=%d", cacheLimit), func(b *testing.B) {
+			b.SetBytes(int64(len(packfile)))
+			for range b.N {
+				b.StopTimer()
+				repoDir := newTestRepo(b)
+				if err := setConfigValue(filepath.Join(repoDir, ".git", "config"), "core.deltaBaseCacheLimit", strconv.Itoa(cacheLimit)); err != nil {
+					b.Fatalf("failed to set core.deltaBaseCacheLimit: %s", err)
+				}
+				b.StartTimer()
+
+				if _, err := unpackPackfile(bytes.NewReader(packfile), false, repoDir); err != nil {
+					b.Fatalf("failed to unpack packfile: %s", err)
+				}
+			}
+		})
+	}
+}
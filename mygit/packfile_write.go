@@ -1,35 +1,142 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
+// The default size (in bytes) above which blobs are streamed into packfiles, set by the core.bigFileThreshold config
+// variable. As in Git, this is 512 MiB.
+const DEFAULT_BIG_FILE_THRESHOLD = 512 * 1024 * 1024
+
 func CreatePackfile(objHashes []string, repoDir string) ([]byte, error) {
-	packfile := []byte{}
+	var packfile bytes.Buffer
+	if err := writePackfile(&packfile, objHashes, false, repoDir); err != nil {
+		return nil, err
+	}
+	return packfile.Bytes(), nil
+}
+
+// Writes a packfile of the given objects, one object at a time, so that it can be sent as it's written (e.g. while
+// pushing) without the whole packfile being held in memory. The checksum is computed as the packfile is written.
+// Unless reportProgress is false, the objects (and bytes) written are reported as they're written (see Progress).
+func writePackfile(w io.Writer, objHashes []string, reportProgress bool, repoDir string) error {
+	bigFileThreshold, err := getBigFileThreshold(repoDir)
+	if err != nil {
+		return err
+	}
 
-	if len(objHashes) == 0 {
-		return nil, fmt.Errorf("no objects provided for packfile creation")
+	var progress *Progress
+	if reportProgress {
+		progress = startProgress("Writing objects", len(objHashes), true)
+		defer progress.stop()
 	}
 
-	packfile = append(packfile, PACKFILE_SIGNATURE...)
-	packfile = binary.BigEndian.AppendUint32(packfile, PACKFILE_VERSION_NUMBER)
-	packfile = binary.BigEndian.AppendUint32(packfile, uint32(len(objHashes)))
+	checksum := sha1.New()
+	counter := &CountingWriter{writer: w}
+	packfile := bufio.NewWriterSize(io.MultiWriter(counter, checksum), 64*1024)
+
+	packfile.WriteString(PACKFILE_SIGNATURE)
+	packfile.Write(binary.BigEndian.AppendUint32(nil, PACKFILE_VERSION_NUMBER))
+	packfile.Write(binary.BigEndian.AppendUint32(nil, uint32(len(objHashes))))
+
+	for i, objHash := range objHashes {
+		isBigFile, err := isBigFileObject(objHash, bigFileThreshold, repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to read object %s: %s", objHash, err)
+		}
+
+		if isBigFile {
+			if err := streamPackfileObject(packfile, objHash, repoDir); err != nil {
+				return fmt.Errorf("failed to stream object %s: %s", objHash, err)
+			}
+			progress.update(i+1, counter.count+int64(packfile.Buffered()))
+			continue
+		}
 
-	for _, objHash := range objHashes {
 		encodedObj, err := encodePackfileObject(objHash, repoDir)
 		if err != nil {
-			return nil, fmt.Errorf("failed to encode object %s: %s", objHash, err)
+			return fmt.Errorf("failed to encode object %s: %s", objHash, err)
+		}
+
+		if _, err := packfile.Write(encodedObj); err != nil {
+			return err
 		}
+		progress.update(i+1, counter.count+int64(packfile.Buffered()))
+	}
+
+	if err := packfile.Flush(); err != nil {
+		return err
+	}
+	if _, err := counter.Write(checksum.Sum(nil)); err != nil {
+		return err
+	}
+	progress.update(len(objHashes), counter.count)
+	progress.done()
+	return nil
+}
+
+func getBigFileThreshold(repoDir string) (int64, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read config: %s", err)
+	}
+	return config.getInt("core.bigFileThreshold", DEFAULT_BIG_FILE_THRESHOLD)
+}
 
-		packfile = append(packfile, encodedObj...)
+// Checks whether the object is a blob larger than the big file threshold, reading only its header. As in Git, such
+// blobs are never candidates for delta compression (which would need their whole content, and that of every blob
+// they're compared against, in memory), so they're streamed into the packfile as they are.
+func isBigFileObject(objHash string, bigFileThreshold int64, repoDir string) (bool, error) {
+	objType, size, reader, err := openObjectFile(objHash, repoDir)
+	if err != nil {
+		return false, err
 	}
+	reader.Close()
 
-	checksum := sha1.Sum(packfile)
-	packfile = append(packfile, checksum[:]...)
+	return objType == Blob && int64(size) > bigFileThreshold, nil
+}
+
+// Writes the object into the packfile by recompressing its content as it's decompressed from its object file, so that
+// only a small buffer of it is held in memory at a time
+func streamPackfileObject(w io.Writer, objHash string, repoDir string) error {
+	objType, size, reader, err := openObjectFile(objHash, repoDir)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	packfileObjType, err := packfileObjTypeFromString(objType.toString())
+	if err != nil {
+		return fmt.Errorf("invalid packfile object type: %s", objType.toString())
+	}
+
+	header, err := encodePackfileObjectHeader(packfileObjType, size)
+	if err != nil {
+		return fmt.Errorf("failed to encode packfile object header: %s", err)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	zw := zlib.NewWriter(w)
+	written, err := io.Copy(zw, reader)
+	if err != nil {
+		return fmt.Errorf("failed to compress packfile object content: %s", err)
+	}
+	if written != int64(size) {
+		return fmt.Errorf("object content is %d bytes, but its header gives %d bytes", written, size)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to close zlib writer: %s", err)
+	}
 
-	return packfile, nil
+	return nil
 }
 
 func encodePackfileObject(objHash string, repoDir string) ([]byte, error) {
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// The number of times the outputs which used to come from iterating over maps are produced by the determinism tests,
+// since Go randomizes map iteration order anew for each iteration
+const DETERMINISM_TEST_RUNS = 5
+
+// Commits a history of three commits, the later two changing files in several directories, returning the hashes of
+// the first and last commits
+func createTestHistory(t *testing.T, repoDir string) (string, string) {
+	files := make(map[string]string)
+	for i := range 20 {
+		files[fmt.Sprintf("dir%d/file%d.txt", i%4, i)] = fmt.Sprintf("file %d\n", i)
+	}
+	firstHash := createTestCommit(t, files, nil, "First commit", repoDir)
+
+	secondHash := createTestCommit(t, map[string]string{"dir0/file0.txt": "changed\n", "dir1/new.txt": "new\n", "top.txt": "top\n"}, []string{firstHash}, "Second commit", repoDir)
+	lastHash := createTestCommit(t, map[string]string{"dir2/file2.txt": "changed\n", "dir3/sub/deep.txt": "deep\n"}, []string{secondHash}, "Third commit", repoDir)
+	return firstHash, lastHash
+}
+
+func TestPackfileIsDeterministic(t *testing.T) {
+	var firstPackfile []byte
+	var firstMissingObjHashes []string
+
+	// The same history is built in two repositories, and each packs it several times
+	for range 2 {
+		repoDir := newTestRepo(t)
+		remoteHead, localHead := createTestHistory(t, repoDir)
+
+		for range DETERMINISM_TEST_RUNS {
+			missingObjHashes, err := calculateMissingObjects(localHead, remoteHead, repoDir)
+			if err != nil {
+				t.Fatalf("failed to calculate missing objects: %s", err)
+			}
+			packfile, err := CreatePackfile(missingObjHashes, repoDir)
+			if err != nil {
+				t.Fatalf("failed to create packfile: %s", err)
+			}
+
+			if firstPackfile == nil {
+				firstMissingObjHashes, firstPackfile = missingObjHashes, packfile
+				continue
+			}
+			if !slices.Equal(missingObjHashes, firstMissingObjHashes) {
+				t.Fatalf("missing objects were listed as %v, and before as %v", missingObjHashes, firstMissingObjHashes)
+			}
+			if !bytes.Equal(packfile, firstPackfile) {
+				t.Fatalf("the same objects were packed into different packfiles")
+			}
+		}
+	}
+
+	// Each missing object is listed once, and the packfile holds all of them
+	if len(firstMissingObjHashes) == 0 {
+		t.Fatalf("no missing objects were found")
+	}
+	seen := make(map[string]bool)
+	for _, objHash := range firstMissingObjHashes {
+		if seen[objHash] {
+			t.Errorf("missing object %s was listed more than once", objHash)
+		}
+		seen[objHash] = true
+	}
+	repoDir := newTestRepo(t)
+	stats, err := unpackPackfile(bytes.NewReader(firstPackfile), false, repoDir)
+	if err != nil {
+		t.Fatalf("failed to unpack packfile: %s", err)
+	}
+	if stats.numObjects != len(firstMissingObjHashes) {
+		t.Errorf("unpacked %d objects, expected %d", stats.numObjects, len(firstMissingObjHashes))
+	}
+}
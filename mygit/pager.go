@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// The pager used when none is configured, which (as LESS is set to FRX) exits immediately if the output fits on one
+// screen, passes colors through, and leaves the output on the screen once it exits
+const DEFAULT_PAGER = "less"
+
+// The pager which the command's standard output is piped into, or nil if the output goes straight to standard output
+var activePager *Pager
+
+// Represents a pager process (e.g. less) which the command's standard output is piped into
+type Pager struct {
+	cmd      *exec.Cmd
+	input    *os.File // The write end of the pipe to the pager, which replaces os.Stdout
+	exited   chan struct{}
+	mu       sync.Mutex
+	stopping bool // Whether the command has finished writing its output, so the pager is expected to exit
+}
+
+// Pipes the rest of the command's standard output into a pager, if standard output is a terminal and paging isn't
+// disabled (with --no-pager or the pager.<command> config variable). The pager is chosen by, in order of precedence,
+// the GIT_PAGER environment variable, the core.pager config variable, the PAGER environment variable, or else less.
+// A pager of cat (or an empty pager) also disables paging. As in Git, pager.<command> may instead give the pager for
+// just that command.
+func startPager(command string, repoDir string) error {
+	if *NoPager || activePager != nil || !isTerminal(os.Stdout) {
+		return nil
+	}
+
+	pagerCommand, err := getPagerCommand(command, repoDir)
+	if err != nil {
+		return err
+	}
+	if pagerCommand == "" || pagerCommand == "cat" {
+		return nil
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe to pager: %s", err)
+	}
+
+	cmd := exec.Command("sh", "-c", pagerCommand)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = reader, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	if _, found := os.LookupEnv("LESS"); !found {
+		cmd.Env = append(cmd.Env, "LESS=FRX")
+	}
+	if _, found := os.LookupEnv("LV"); !found {
+		cmd.Env = append(cmd.Env, "LV=-c")
+	}
+	if err := cmd.Start(); err != nil {
+		reader.Close()
+		writer.Close()
+		return fmt.Errorf("failed to start pager '%s': %s", pagerCommand, err)
+	}
+	reader.Close()
+
+	pager := &Pager{cmd: cmd, input: writer, exited: make(chan struct{})}
+	go pager.wait()
+	activePager = pager
+	os.Stdout = writer
+	return nil
+}
+
+// Returns the command line of the pager to pipe the output of the given command into, or an empty string if it
+// shouldn't be paged
+func getPagerCommand(command string, repoDir string) (string, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read repository config: %s", err)
+	}
+
+	// pager.<command> is either a boolean enabling paging of the command or the pager to use for it
+	if value, found := config.get("pager." + command); found {
+		enabled, err := parseConfigBool(value)
+		if err != nil {
+			return value, nil
+		} else if !enabled {
+			return "", nil
+		}
+	}
+
+	if pagerCommand, found := os.LookupEnv("GIT_PAGER"); found {
+		return pagerCommand, nil
+	}
+	if pagerCommand, found := config.get("core.pager"); found {
+		return pagerCommand, nil
+	}
+	if pagerCommand, found := os.LookupEnv("PAGER"); found {
+		return pagerCommand, nil
+	}
+	return DEFAULT_PAGER, nil
+}
+
+// Waits for the pager to exit. If the user quits it before the command has finished writing its output, the command
+// exits quietly, as Git does when it's killed by SIGPIPE, rather than failing to write the rest of its output.
+func (p *Pager) wait() {
+	p.cmd.Wait()
+	close(p.exited)
+
+	p.mu.Lock()
+	stopping := p.stopping
+	p.mu.Unlock()
+	if !stopping {
+		trace.exit(0)
+		os.Exit(0)
+	}
+}
+
+// Closes the pipe to the pager, if one is running, and waits for the user to quit it. Called before the command
+// exits, since the pager would otherwise be left reading from a closed pipe.
+func stopPager() {
+	pager := activePager
+	if pager == nil {
+		return
+	}
+
+	pager.mu.Lock()
+	pager.stopping = true
+	pager.mu.Unlock()
+
+	pager.input.Close()
+	<-pager.exited
+}
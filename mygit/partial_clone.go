@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// Matches the object filters which a partial clone may be made with: blob:none, which omits every blob, and
+// blob:limit=<n>, which omits blobs of at least n bytes (optionally suffixed with k, m, or g)
+var SUPPORTED_FILTER_SPEC_REGEX = regexp.MustCompile(`^(blob:none|blob:limit=[0-9]+[kmgKMG]?)$`)
+
+func validateFilterSpec(filterSpec string) error {
+	if !SUPPORTED_FILTER_SPEC_REGEX.MatchString(filterSpec) {
+		return fmt.Errorf("unsupported filter '%s': only blob:none and blob:limit=<n> are supported", filterSpec)
+	}
+	return nil
+}
+
+// Records that the repository is a partial clone of the given remote, as Git does: the remote is the promisor remote,
+// which promises to provide any objects that the given filter left out, and future fetches from it use the same
+// filter. The repository format version is raised to 1, so that versions of Git which don't understand the
+// extensions.partialClone setting refuse to use the repository, rather than treating the missing objects as corruption.
+func recordPartialClone(remoteName string, filterSpec string, repoDir string) error {
+	configPath := getRepoConfigPath(repoDir)
+	settings := [][]string{
+		{"core.repositoryformatversion", "1"},
+		{"extensions.partialClone", remoteName},
+		{fmt.Sprintf("remote.%s.promisor", remoteName), "true"},
+		{fmt.Sprintf("remote.%s.partialclonefilter", remoteName), filterSpec},
+	}
+	for _, setting := range settings {
+		if err := setConfigValue(configPath, setting[0], setting[1]); err != nil {
+			return fmt.Errorf("failed to write %s to config: %s", setting[0], err)
+		}
+	}
+	return nil
+}
+
+// Returns the name of the promisor remote of a partial clone, or false if the repository isn't a partial clone
+func getPromisorRemote(repoDir string) (string, bool, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read repository config: %s", err)
+	}
+	remoteName, isPartialClone := config.get("extensions.partialClone")
+	return remoteName, isPartialClone && remoteName != "", nil
+}
+
+// Returns the filter with which the repository was partially cloned from the given remote, which fetches from it
+// continue to use, or "" if the remote isn't the repository's promisor remote
+func getPartialCloneFilter(remoteName string, repoDir string) (string, error) {
+	promisorRemote, isPartialClone, err := getPromisorRemote(repoDir)
+	if err != nil || !isPartialClone || promisorRemote != remoteName {
+		return "", err
+	}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read repository config: %s", err)
+	}
+	filterSpec, _ := config.get(fmt.Sprintf("remote.%s.partialclonefilter", remoteName))
+	return filterSpec, nil
+}
+
+// Opens the loose object file for the given object. In a partial clone, an object which is missing because it was left
+// out by the clone's filter is first fetched from the promisor remote, so that the many commands which read objects
+// work the same way whether or not it was.
+func openLooseObjectFile(objHash string, repoDir string) (*os.File, error) {
+	objPath := filepath.Join(getCommonDir(repoDir), "objects", objHash[:2], objHash[2:])
+	file, err := os.Open(objPath)
+	if err == nil {
+		trace.objectRead()
+		return file, nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open object file")
+	}
+
+	promisorRemote, isPartialClone, configErr := getPromisorRemote(repoDir)
+	if configErr != nil || !isPartialClone {
+		return nil, fmt.Errorf("failed to open object file")
+	}
+	if err := fetchMissingObjects(promisorRemote, []string{objHash}, repoDir); err != nil {
+		return nil, fmt.Errorf("failed to fetch missing object %s from promisor remote %s: %s", objHash, promisorRemote, err)
+	}
+
+	file, err = os.Open(objPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object file")
+	}
+	trace.objectRead()
+	return file, nil
+}
+
+// Fetches those of the given objects which are missing from the repository from the remote, in a single request. Only
+// the objects themselves are fetched (e.g. just the blob, or a tree along with everything in it), without any filter.
+func fetchMissingObjects(remoteName string, objHashes []string, repoDir string) error {
+	missingObjHashes := []string{}
+	for _, objHash := range objHashes {
+		if !objectExists(objHash, repoDir) {
+			missingObjHashes = append(missingObjHashes, objHash)
+		}
+	}
+	if len(missingObjHashes) == 0 {
+		return nil
+	}
+	sort.Strings(missingObjHashes)
+	missingObjHashes = slices.Compact(missingObjHashes)
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read repository config: %s", err)
+	}
+	repoURL, isRemote := config.get(fmt.Sprintf("remote.%s.url", remoteName))
+	if !isRemote {
+		return fmt.Errorf("the %s remote isn't configured", remoteName)
+	}
+
+	if err := loadHTTPSettings(repoDir); err != nil {
+		return fmt.Errorf("failed to set up HTTP client: %s", err)
+	}
+	remoteRefs, err := refDiscovery(repoURL)
+	if err != nil {
+		return fmt.Errorf("failed to perform reference discovery on the remote repository: %s", err)
+	}
+	// The objects are fetched without reporting progress, since they're fetched in the middle of another command
+	err = fetchObjects(repoURL, remoteRefs, missingObjHashes, "", false, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to fetch objects: %s", err)
+	}
+
+	for _, objHash := range missingObjHashes {
+		if !objectExists(objHash, repoDir) {
+			return fmt.Errorf("the remote repository didn't send object %s", objHash)
+		}
+	}
+	return nil
+}
+
+// Fetches the blobs of the tree which are missing from a partial clone before the tree is checked out, all in one
+// request rather than one request for each file as it's written
+func prefetchTreeBlobs(treeHash string, repoDir string) error {
+	promisorRemote, isPartialClone, err := getPromisorRemote(repoDir)
+	if err != nil || !isPartialClone {
+		return err
+	}
+
+	objHashes, err := getAllObjectsInTree(treeHash, repoDir)
+	if err != nil {
+		return err
+	}
+	if err := fetchMissingObjects(promisorRemote, objHashes, repoDir); err != nil {
+		return fmt.Errorf("failed to fetch missing objects from promisor remote %s: %s", promisorRemote, err)
+	}
+	return nil
+}
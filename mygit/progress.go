@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// How often a progress meter is redrawn when its percentage hasn't changed, which is also how often its throughput is
+// recalculated
+const PROGRESS_UPDATE_INTERVAL = time.Second
+
+// Represents how the command reports on its transfers, set by setUpProgress
+type ProgressSettings struct {
+	quiet bool // Don't report on transfers at all: neither their progress nor their summary
+	show  bool // Show progress meters on stderr
+}
+
+// As in Git, progress is shown by default only when stderr is a terminal, since it's redrawn in place
+var progressSettings = ProgressSettings{show: isTerminal(os.Stderr)}
+
+// Chooses how the command reports on its transfers: --quiet hides their progress and summary, and --progress shows
+// their progress even when stderr isn't a terminal (e.g. when it's logged to a file)
+func setUpProgress(quiet bool, progress bool) {
+	progressSettings = ProgressSettings{
+		quiet: quiet,
+		show:  progress || (!quiet && isTerminal(os.Stderr)),
+	}
+}
+
+// A progress meter for counting through a known number of items (e.g. objects in a packfile), printed on stderr in
+// the same format as Git's, e.g. `Receiving objects:  45% (450/1000), 1.20 MiB | 300.00 KiB/s`. The line is redrawn
+// in place whenever the percentage changes, or every PROGRESS_UPDATE_INTERVAL, so updating the meter is cheap.
+// Meters are nil when progress isn't shown, which their methods ignore.
+type Progress struct {
+	title          string
+	total          int
+	count          int
+	bytes          int64 // The bytes transferred so far, for meters which show throughput
+	showThroughput bool
+	start          time.Time
+	lastDrawn      time.Time
+	lastPercent    int
+	lastLineLength int
+	stopped        bool
+	rate           float64   // The throughput in bytes per second, as of the last rate sample
+	rateSampleTime time.Time // When the throughput was last calculated
+	rateSampleSize int64     // The bytes transferred by then
+}
+
+// Starts a progress meter for the given number of items, unless progress isn't shown (in which case it's nil)
+func startProgress(title string, total int, showThroughput bool) *Progress {
+	if !progressSettings.show {
+		return nil
+	}
+	now := time.Now()
+	progress := &Progress{title: title, total: total, showThroughput: showThroughput, start: now, lastPercent: -1, rateSampleTime: now}
+	progress.draw(now, "")
+	return progress
+}
+
+// Updates the number of items counted so far, along with the bytes transferred (for meters which show throughput)
+func (p *Progress) update(count int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.count, p.bytes = count, bytes
+
+	now := time.Now()
+	if p.percent() != p.lastPercent || now.Sub(p.lastDrawn) >= PROGRESS_UPDATE_INTERVAL {
+		p.draw(now, "")
+	}
+}
+
+// Draws the meter one last time, ending its line with ", done."
+func (p *Progress) done() {
+	if p == nil || p.stopped {
+		return
+	}
+	p.draw(time.Now(), ", done.\n")
+	p.stopped = true
+}
+
+// Ends the meter's line if it isn't done, so that whatever is printed next (e.g. an error from partway through the
+// transfer) starts on a line of its own
+func (p *Progress) stop() {
+	if p == nil || p.stopped {
+		return
+	}
+	fmt.Fprintln(os.Stderr)
+	p.stopped = true
+}
+
+func (p *Progress) percent() int {
+	if p.total == 0 {
+		return 100
+	}
+	return p.count * 100 / p.total
+}
+
+func (p *Progress) draw(now time.Time, suffix string) {
+	line := fmt.Sprintf("%s: %3d%% (%d/%d)", p.title, p.percent(), p.count, p.total)
+	if p.showThroughput {
+		line += ", " + humanizeBytes(float64(p.bytes)) + " | " + formatThroughput(p.throughput(now))
+	}
+
+	// A line shorter than the one it replaces is padded, so that none of the old line is left behind
+	padding := strings.Repeat(" ", max(p.lastLineLength-len(line), 0))
+	fmt.Fprintf(os.Stderr, "\r%s%s%s", line, padding, suffix)
+
+	p.lastDrawn, p.lastPercent, p.lastLineLength = now, p.percent(), len(line)
+}
+
+// Returns the throughput over roughly the last PROGRESS_UPDATE_INTERVAL, or, until a whole interval has passed since
+// the meter started, since the start
+func (p *Progress) throughput(now time.Time) float64 {
+	if elapsed := now.Sub(p.rateSampleTime); elapsed >= PROGRESS_UPDATE_INTERVAL {
+		p.rate = float64(p.bytes-p.rateSampleSize) / elapsed.Seconds()
+		p.rateSampleTime, p.rateSampleSize = now, p.bytes
+	} else if p.rateSampleTime.Equal(p.start) && elapsed > 0 {
+		p.rate = float64(p.bytes) / elapsed.Seconds()
+	}
+	return p.rate
+}
+
+// Formats a throughput as Git does in its progress output, in KiB/s, or MiB/s from 1 MiB/s upwards
+func formatThroughput(bytesPerSecond float64) string {
+	if bytesPerSecond >= 1<<20 {
+		return fmt.Sprintf("%.2f MiB/s", bytesPerSecond/(1<<20))
+	}
+	return fmt.Sprintf("%.2f KiB/s", bytesPerSecond/(1<<10))
+}
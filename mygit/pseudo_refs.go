@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The pseudorefs which can be given as revisions. Like HEAD, they're kept in the .git directory (of each working
+// tree), but they're written directly rather than through ref transactions, and never symbolic:
+//   - ORIG_HEAD is the commit HEAD was at before the last operation which moved it (reset, merge, or pull), so that
+//     the operation can be undone with reset --hard ORIG_HEAD.
+//   - MERGE_HEAD lists the commits being merged into HEAD while a merge with conflicts is in progress.
+//   - FETCH_HEAD lists the branches last fetched by pull, the first being the one merged into the current branch.
+//   - CHERRY_PICK_HEAD and REVERT_HEAD are written by Git during a cherry-pick or revert with conflicts.
+var PSEUDO_REFS = []string{"ORIG_HEAD", "MERGE_HEAD", "FETCH_HEAD", "CHERRY_PICK_HEAD", "REVERT_HEAD"}
+
+// The files recording a merge in progress, in the same format as Git: MERGE_HEAD, along with the message to commit
+// the merge with (MERGE_MSG) and whether it was started with --no-ff (MERGE_MODE)
+var MERGE_STATE_FILES = []string{"MERGE_HEAD", "MERGE_MSG", "MERGE_MODE"}
+
+// Returns the object hashes listed in the pseudoref, one per line. FETCH_HEAD's lines also describe where each
+// hash was fetched from, after a tab.
+func readPseudoRef(name string, repoDir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(getGitDir(repoDir), name))
+	if err != nil && os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", name, err)
+	}
+
+	hashes := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		hash, _, _ := strings.Cut(line, "\t")
+		hash = strings.TrimSpace(hash)
+		if hash == "" {
+			continue
+		}
+		if !isValidObjectHash(hash) {
+			return nil, fmt.Errorf("invalid %s: %s", name, line)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// Resolves the pseudoref to the first object hash listed in it, as Git does
+func resolvePseudoRef(name string, repoDir string) (string, bool, error) {
+	hashes, err := readPseudoRef(name, repoDir)
+	if err != nil || len(hashes) == 0 {
+		return "", false, err
+	}
+	return hashes[0], true, nil
+}
+
+// Atomically replaces the contents of the given file in the .git directory, e.g. a pseudoref
+func writeGitDirFile(name string, content string, repoDir string) error {
+	lockFile, err := acquireLockFile(filepath.Join(getGitDir(repoDir), name))
+	if err != nil {
+		return err
+	}
+	defer lockFile.rollback()
+
+	if err := lockFile.write([]byte(content)); err != nil {
+		return err
+	}
+	if err := lockFile.commit(); err != nil {
+		return fmt.Errorf("failed to write %s: %s", name, err)
+	}
+	return nil
+}
+
+// Records the commit which HEAD is at before an operation moves it, as ORIG_HEAD
+func writeOrigHead(commitHash string, repoDir string) error {
+	return writeGitDirFile("ORIG_HEAD", commitHash+"\n", repoDir)
+}
+
+// Records a merge with conflicts as in progress, so that committing the resolved merge gives the merge commit the
+// merged commits as its parents, and the given message as the starting point for its message
+func writeMergeState(mergeCommitHashes []string, message string, noFastForward bool, repoDir string) error {
+	if err := writeGitDirFile("MERGE_HEAD", strings.Join(mergeCommitHashes, "\n")+"\n", repoDir); err != nil {
+		return err
+	}
+	if err := writeGitDirFile("MERGE_MSG", message, repoDir); err != nil {
+		return err
+	}
+
+	mode := ""
+	if noFastForward {
+		mode = "no-ff"
+	}
+	return writeGitDirFile("MERGE_MODE", mode, repoDir)
+}
+
+// Returns the message of the merge in progress, as recorded in MERGE_MSG, or an empty string if there isn't one
+func readMergeMessage(repoDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(getGitDir(repoDir), "MERGE_MSG"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read MERGE_MSG: %s", err)
+	}
+	return string(data), nil
+}
+
+// Removes the record of a merge in progress, once it's been committed or abandoned
+func removeMergeState(repoDir string) error {
+	for _, name := range MERGE_STATE_FILES {
+		err := os.Remove(filepath.Join(getGitDir(repoDir), name))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Records the branches fetched from the remote repository in FETCH_HEAD, in the same format as Git: a line for each
+// branch, giving its hash and where it came from, with every branch but the one to be merged into the current branch
+// marked as not-for-merge. The branch to be merged is listed first, followed by the others in order.
+func writeFetchHead(remoteBranches map[string]string, mergeBranchName string, repoURL string, repoDir string) error {
+	// As in Git, the URL is recorded without any credentials or .git suffix
+	sourceURL := strings.TrimSuffix(strings.TrimRight(anonymizeURL(repoURL), "/"), ".git")
+
+	branchNames := []string{}
+	for branchName := range remoteBranches {
+		if branchName != mergeBranchName {
+			branchNames = append(branchNames, branchName)
+		}
+	}
+	sort.Strings(branchNames)
+
+	var sb strings.Builder
+	if mergeHash, exists := remoteBranches[mergeBranchName]; exists {
+		fmt.Fprintf(&sb, "%s\t\tbranch '%s' of %s\n", mergeHash, mergeBranchName, sourceURL)
+	}
+	for _, branchName := range branchNames {
+		fmt.Fprintf(&sb, "%s\tnot-for-merge\tbranch '%s' of %s\n", remoteBranches[branchName], branchName, sourceURL)
+	}
+	return writeGitDirFile("FETCH_HEAD", sb.String(), repoDir)
+}
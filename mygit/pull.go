@@ -1,14 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"os"
 	"regexp"
+	"slices"
+	"sort"
+	"strings"
 )
 
-func Pull(repoURL string, repoDir string) error {
-	refsMap, err := refDiscovery(repoURL)
+// Represents the options controlling how a pull integrates the remote commits with the local branch
+type PullOptions struct {
+	rebase    bool // Replay local commits on top of the upstream branch instead of merging the upstream branch into them
+	autoStash bool // Save uncommitted changes before the pull and reapply them afterwards
+}
+
+func Pull(repoURL string, options PullOptions, repoDir string) error {
+	remoteRefs, err := refDiscovery(repoURL)
 	if err != nil {
 		log.Fatalf("Failed to perform reference discovery on the remote repository: %s\n", err)
 	}
@@ -18,22 +32,101 @@ func Pull(repoURL string, repoDir string) error {
 		return fmt.Errorf("failed to get current branch: %s", err)
 	}
 
-	packfile, err := uploadPackRequest(repoURL, refsMap)
+	localHead, localCommitsExist, err := ResolveBranchRef(branchName, "", repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve local branch reference for %s: %s", branchName, err)
+	}
+
+	var autoStash *AutoStash
+	if options.rebase {
+		autoStash, err = createAutoStash(repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to check for uncommitted changes: %s", err)
+		}
+		if autoStash != nil && !options.autoStash {
+			return fmt.Errorf("cannot pull with rebase: you have uncommitted changes (commit them, or use --autostash)")
+		}
+	}
+
+	remoteName, err := getRemoteNameForURL(repoURL, repoDir)
 	if err != nil {
-		return fmt.Errorf("failed to perform git-upload-pack request: %s", err)
+		return err
 	}
 
-	branchHeadHash, ok := refsMap[branchName]
+	// Pulling into a partial clone from its promisor remote leaves out the same objects as the clone did
+	filterSpec, err := getPartialCloneFilter(remoteName, repoDir)
+	if err != nil {
+		return err
+	}
+	if filterSpec != "" && !remoteRefs.hasCapability("filter") {
+		fmt.Fprintln(os.Stderr, "warning: filtering not recognized by server, ignoring")
+		filterSpec = ""
+	}
+
+	err = fetchObjects(repoURL, remoteRefs, getDefaultWants(remoteRefs), filterSpec, true, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to fetch objects: %s", err)
+	}
+
+	// The current branch is updated to its upstream branch if one is configured, or otherwise to the remote
+	// branch of the same name
+	upstreamBranchName, err := getUpstreamBranchName(branchName, remoteName, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to determine upstream branch: %s", err)
+	}
+
+	branchHeadHash, ok := remoteRefs.get("refs/heads/" + upstreamBranchName)
 	if !ok {
-		log.Fatalf("No branch named %s found in remote repository", branchName)
+		log.Fatalf("No branch named %s found in remote repository", upstreamBranchName)
 	}
 
-	err = ReadPackfile(packfile, repoDir)
+	err = writeFetchHead(remoteRefs.branches(), upstreamBranchName, repoURL, repoDir)
 	if err != nil {
-		return fmt.Errorf("failed to read packfile: %s", err)
+		return fmt.Errorf("failed to record fetched branches: %s", err)
+	}
+
+	// Without --rebase, the upstream branch is merged into the current branch as in Git, which fast-forwards the
+	// branch unless it has commits of its own, and otherwise keeps them with a merge commit
+	if !options.rebase && localCommitsExist {
+		err = updateRefsAfterPull(remoteRefs.branches(), remoteName, false, repoDir)
+		if err != nil {
+			return err
+		}
+
+		merged, err := Merge("FETCH_HEAD", MergeOptions{}, repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to merge %s: %s", upstreamBranchName, err)
+		}
+
+		err = copyRunSh(repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to copy mygit run.sh script into repository: %s", err)
+		}
+
+		if !merged {
+			return fmt.Errorf("merging %s left conflicts; fix them and then commit the result", upstreamBranchName)
+		}
+		return nil
 	}
 
-	err = CheckoutCommit(branchHeadHash, repoDir)
+	newHead := branchHeadHash
+	if options.rebase && localCommitsExist {
+		newHead, _, err = rebaseOntoUpstream(localHead, branchHeadHash, repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to rebase local commits onto %s: %s", upstreamBranchName, err)
+		}
+	}
+
+	// As in Git, the commit the branch was at before the pull is recorded, so that the pull can be undone
+	if localCommitsExist && newHead != localHead {
+		err = writeOrigHead(localHead, repoDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Uncommitted changes which were stashed are reapplied afterwards, so they may be overwritten
+	err = CheckoutCommit(newHead, autoStash != nil, repoDir)
 	if err != nil {
 		return fmt.Errorf("failed to check out HEAD commit: %s", err)
 	}
@@ -43,23 +136,86 @@ func Pull(repoURL string, repoDir string) error {
 		return fmt.Errorf("failed to copy mygit run.sh script into repository: %s", err)
 	}
 
-	err = updateRefsAfterPull(refsMap, repoDir)
+	err = updateRefsAfterPull(remoteRefs.branches(), remoteName, false, repoDir)
 	if err != nil {
 		return err
 	}
 
+	// Of the local branches, only the current one is updated, as in Git
+	if !localCommitsExist || newHead != localHead {
+		err = UpdateBranchRef(branchName, newHead, "", repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to update local branch reference for %s: %s", branchName, err)
+		}
+	}
+
+	// The post-merge hook can't affect the outcome of the pull, so its failure is only a warning
+	if !options.rebase {
+		if err := runHook("post-merge", []string{"0"}, "", repoDir); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+		}
+	}
+
+	if autoStash != nil {
+		conflicts, err := autoStash.apply(newHead, repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to reapply uncommitted changes: %s", err)
+		}
+		if len(conflicts) > 0 {
+			return fmt.Errorf("uncommitted changes to the following files conflict with the pulled commits and were not reapplied: %s", autoStash.describe(conflicts))
+		}
+	}
+
 	return nil
 }
 
-func refDiscovery(repoURL string) (map[string]string, error) {
-	refDiscoveryRespBody, err := makeHTTPRequest("GET", repoURL+"/info/refs?service=git-upload-pack", bytes.Buffer{}, []int{200, 304})
+// Discovers the refs of the remote repository to fetch from, which may be a bundle file rather than a URL
+func refDiscovery(repoURL string) (*RemoteRefs, error) {
+	if isBundleFile(repoURL) {
+		bundle, err := readBundle(repoURL)
+		if err != nil {
+			return nil, err
+		}
+		return bundle.remoteRefs(), nil
+	}
+	return discoverRefs(repoURL, "git-upload-pack")
+}
+
+// Performs reference discovery for the given service (git-upload-pack for fetching, or git-receive-pack
+// for pushing), returning every ref advertised by the remote repository along with the server's capabilities. As in
+// Git, if the request is redirected (e.g. because the repository was renamed), the rest of the requests are made to
+// the repository it was redirected to. Some servers (unlike GitHub) only serve a repository at its URL with the .git
+// suffix, which is tried if the repository isn't found without it.
+func discoverRefs(repoURL string, service string) (*RemoteRefs, error) {
+	remoteRefs, err := requestRefAdvertisement(repoURL, service)
+	var reqErr *HTTPRequestError
+	if errors.As(err, &reqErr) && reqErr.statusCode == http.StatusNotFound && !strings.HasSuffix(strings.TrimSuffix(repoURL, "/"), ".git") {
+		if remoteRefs, gitSuffixErr := requestRefAdvertisement(strings.TrimSuffix(repoURL, "/")+".git", service); gitSuffixErr == nil {
+			return remoteRefs, nil
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("ref discovery request failed: %s", err)
 	}
+	return remoteRefs, nil
+}
 
-	validFirstBytes := regexp.MustCompile(`^[0-9a-f]{4}#`).MatchString(string(refDiscoveryRespBody[:5]))
+// Requests the advertisement of the remote repository's refs for the given service from its info/refs endpoint
+func requestRefAdvertisement(repoURL string, service string) (*RemoteRefs, error) {
+	// The advertisement is small enough to read in full before it's parsed
+	var refDiscoveryRespBody []byte
+	respURL, err := makeHTTPRequest("GET", repoURL+"/info/refs?service="+service, nil, []int{200, 304}, getAdvertisementContentType(service), func(respBody io.Reader) error {
+		var err error
+		refDiscoveryRespBody, err = io.ReadAll(respBody)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	validFirstBytes := len(refDiscoveryRespBody) >= 5 && regexp.MustCompile(`^[0-9a-f]{4}#`).MatchString(string(refDiscoveryRespBody[:5]))
 	if !validFirstBytes {
-		return nil, fmt.Errorf("received invalid response when fetching refs from remote repository")
+		return nil, fmt.Errorf("received invalid response when fetching refs from remote repository: expected a pkt-line stream starting with '# service=%s'", service)
 	}
 
 	refsPktLines, err := readPktLines(bytes.NewReader(refDiscoveryRespBody))
@@ -67,74 +223,153 @@ func refDiscovery(repoURL string) (map[string]string, error) {
 		return nil, fmt.Errorf("failed to parse response when fetching refs from remote repository: %s", err)
 	}
 
-	if len(refsPktLines) == 0 || refsPktLines[0] != "# service=git-upload-pack" {
-		return nil, fmt.Errorf("received invalid response when fetching refs from remote repository")
+	if len(refsPktLines) == 0 || refsPktLines[0] != "# service="+service {
+		return nil, fmt.Errorf("received invalid response when fetching refs from remote repository: expected the advertisement of %s", service)
 	}
 
-	refsMap := make(map[string]string)
-	for _, refPktLine := range refsPktLines {
-		if len(refPktLine) > 45 && refPktLine[41:45] == "HEAD" {
-			refsMap["HEAD"] = refPktLine[0:40]
-		} else if len(refPktLine) > 52 && refPktLine[41:52] == "refs/heads/" {
-			branchName := refPktLine[52:]
-			refsMap[branchName] = refPktLine[0:40]
-		}
+	remoteRefs, err := parseRefAdvertisement(refsPktLines[1:])
+	if err != nil {
+		return nil, err
 	}
 
-	for refName, refHash := range refsMap {
-		if !isValidObjectHash(refHash) {
-			return nil, fmt.Errorf("ref %s in remote repository contained invalid SHA hash: %s", refName, refHash)
-		}
+	// The repository's URL is what precedes /info/refs in the URL the advertisement was received from
+	var isRepoURL bool
+	remoteRefs.url, isRepoURL = strings.CutSuffix(respURL, "/info/refs?service="+service)
+	if !isRepoURL {
+		return nil, fmt.Errorf("unable to update URL base from redirection to %s", redactURL(respURL))
 	}
-
-	return refsMap, nil
+	if remoteRefs.url != strings.TrimSuffix(repoURL, "/") {
+		fmt.Fprintf(os.Stderr, "warning: redirecting to %s\n", redactURL(remoteRefs.url))
+	}
+	return remoteRefs, nil
 }
 
-func uploadPackRequest(repoURL string, refsMap map[string]string) ([]byte, error) {
+// Returns the hashes of the remote HEAD and branches, which are fetched by default. Tags are only fetched by clone.
+func getDefaultWants(remoteRefs *RemoteRefs) []string {
 	wantObjHashes := []string{}
-	for _, objHash := range refsMap {
+	if headHash, exists := remoteRefs.get("HEAD"); exists {
+		wantObjHashes = append(wantObjHashes, headHash)
+	}
+	for _, objHash := range remoteRefs.branches() {
 		wantObjHashes = append(wantObjHashes, objHash)
 	}
+	return wantObjHashes
+}
+
+// Fetches the wanted objects into the repository, unpacking the packfile containing them as it's received from the
+// remote repository by uploadPackRequest, or, if the remote is a bundle file, unpacking the bundle's packfile (which
+// contains everything in the bundle, whatever is wanted) after checking that the repository has the bundle's
+// prerequisites. The objects unpacked are added to the command's transfer stats, and unless reportProgress is false,
+// reported as they're received.
+func fetchObjects(repoURL string, remoteRefs *RemoteRefs, wantObjHashes []string, filterSpec string, reportProgress bool, repoDir string) error {
+	var stats *PackfileUnpackStats
+	if !isBundleFile(repoURL) {
+		var err error
+		stats, err = uploadPackRequest(remoteRefs, wantObjHashes, filterSpec, reportProgress, repoDir)
+		if err != nil {
+			return err
+		}
+	} else {
+		bundle, err := readBundle(repoURL)
+		if err != nil {
+			return err
+		}
+		if err := bundle.checkPrerequisites(repoDir); err != nil {
+			return err
+		}
+		stats, err = unpackPackfile(bytes.NewReader(bundle.packfile), reportProgress, repoDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	transferStats.addUnpacked(stats)
+	return nil
+}
+
+// Fetches a packfile containing the wanted objects, along with everything reachable from them, and unpacks it as it's
+// received. Unless filterSpec is empty, the server leaves out the objects excluded by that filter (e.g. blob:none for
+// every blob), which requires the server to support the filter capability. The request is made to the repository
+// which advertised remoteRefs.
+func uploadPackRequest(remoteRefs *RemoteRefs, wantObjHashes []string, filterSpec string, reportProgress bool, repoDir string) (*PackfileUnpackStats, error) {
+	// Each object is wanted once (multiple refs may point to the same commit), in sorted order so that the request
+	// is the same every time for the same refs
+	wantObjHashes = slices.Clone(wantObjHashes)
+	sort.Strings(wantObjHashes)
+	wantObjHashes = slices.Compact(wantObjHashes)
+
+	// Only the capabilities which the server supports may be requested
+	capabilities := []string{}
+	for _, capability := range []string{"multi_ack", "ofs-delta", "thin-pack"} {
+		if remoteRefs.hasCapability(capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	if filterSpec != "" {
+		capabilities = append(capabilities, "filter")
+	}
 
-	capabilities := "multi_ack ofs-delta thin-pack include-tag"
 	uploadPackPktLines := []string{}
-	for _, wantObjHash := range wantObjHashes {
-		uploadPackPktLines = append(uploadPackPktLines, createPktLine(fmt.Sprintf("want %s %s", wantObjHash, capabilities)))
+	for i, wantObjHash := range wantObjHashes {
+		// Capabilities are only sent on the first want line
+		if i == 0 && len(capabilities) > 0 {
+			uploadPackPktLines = append(uploadPackPktLines, createPktLine(fmt.Sprintf("want %s %s", wantObjHash, strings.Join(capabilities, " "))))
+		} else {
+			uploadPackPktLines = append(uploadPackPktLines, createPktLine("want "+wantObjHash))
+		}
+	}
+	if filterSpec != "" {
+		uploadPackPktLines = append(uploadPackPktLines, createPktLine("filter "+filterSpec))
 	}
 	donePktLine := createPktLine("done")
 	uploadPackRequestBody := createPktLineStream(uploadPackPktLines) + donePktLine
 
-	var uploadPackReqBody bytes.Buffer
-	uploadPackReqBody.WriteString(uploadPackRequestBody)
-	uploadPackRespBody, err := makeHTTPRequest("POST", repoURL+"/git-upload-pack", uploadPackReqBody, []int{200})
+	uploadPackReqBody := newBufferedRequestBody([]byte(uploadPackRequestBody))
+	var stats *PackfileUnpackStats
+	_, err := makeHTTPRequest("POST", remoteRefs.url+"/git-upload-pack", uploadPackReqBody, []int{200}, getResultContentType("git-upload-pack"), func(respBody io.Reader) error {
+		// The packfile follows the NAK, and is unpacked straight from the response
+		reader := bufio.NewReader(respBody)
+		nakLine, err := readPktLine(reader)
+		// The server reports a request it refuses (e.g. one wanting an object it won't send) in an ERR pkt-line
+		if remoteErr, isErr := strings.CutPrefix(nakLine, "ERR "); err == nil && isErr {
+			return fmt.Errorf("remote error: %s", remoteErr)
+		}
+		if err != nil || nakLine != "NAK" {
+			return fmt.Errorf("expected NAK in git-upload-pack response")
+		}
+
+		stats, err = unpackPackfile(reader, reportProgress, repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to read packfile: %s", err)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("git-upload-pack request failed: %s", err)
 	}
 
-	nakLine, err := readPktLine(bytes.NewReader(uploadPackRespBody))
-	if err != nil || nakLine != "NAK" {
-		return nil, fmt.Errorf("expected NAK in git-upload-pack response")
-	}
-
-	return uploadPackRespBody[8:], nil
+	return stats, nil
 }
 
-func updateRefsAfterPull(refsMap map[string]string, repoDir string) error {
-	for branchName, refHash := range refsMap {
-		if branchName == "HEAD" {
-			continue
+// Updates the given remote's remote-tracking branches to the fetched remote branches, all in one ref transaction.
+// remoteBranches maps the name of each fetched remote branch to its hash. With updateLocalBranches (only used for a
+// newly cloned repository, which has no local work to lose), each local branch is updated to the remote branch of the
+// same name as well.
+func updateRefsAfterPull(remoteBranches map[string]string, remoteName string, updateLocalBranches bool, repoDir string) error {
+	transaction := newRefTransaction(repoDir)
+	for branchName, refHash := range remoteBranches {
+		if updateLocalBranches {
+			if err := transaction.update(getBranchRefName(branchName, ""), refHash, ""); err != nil {
+				return fmt.Errorf("failed to update local branch reference for %s: %s", branchName, err)
+			}
 		}
-
-		err := UpdateBranchRef(branchName, refHash, false, repoDir)
-		if err != nil {
-			return fmt.Errorf("failed to update local branch reference for %s: %s", branchName, err)
-		}
-
-		err = UpdateBranchRef(branchName, refHash, true, repoDir)
-		if err != nil {
+		if err := transaction.update(getBranchRefName(branchName, remoteName), refHash, ""); err != nil {
 			return fmt.Errorf("failed to update remote branch reference for %s: %s", branchName, err)
 		}
 	}
 
+	if err := transaction.commit(); err != nil {
+		return fmt.Errorf("failed to update branch references: %s", err)
+	}
 	return nil
 }
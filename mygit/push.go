@@ -1,113 +1,266 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
+	"io"
 	"strings"
 )
 
-func Push(localHead string, remoteHead string, repoURL string, repoDir string) error {
-	missingObjHashes, err := calculateMissingObjects(localHead, remoteHead, repoDir)
-	if err != nil {
-		return fmt.Errorf("failed to calculate objects in local HEAD missing from remote HEAD: %s", err)
+// Represents the conditions under which a push may overwrite the remote branch with a commit that isn't a
+// descendant of the remote branch's current tip
+type ForcePushOptions struct {
+	force         bool   // Overwrite the remote branch unconditionally
+	withLease     bool   // Overwrite the remote branch only if its tip is the expected value
+	leaseRef      string // The branch the lease applies to (any branch if empty)
+	leaseExpected string // The expected tip of the remote branch (the remote-tracking ref's value if empty)
+}
+
+// Parses the optional value of the --force-with-lease flag, which may be given with no value, as
+// --force-with-lease=<branch>, or as --force-with-lease=<branch>:<expected>
+type forceWithLeaseFlag struct {
+	enabled  bool
+	ref      string
+	expected string
+}
+
+func (f *forceWithLeaseFlag) String() string {
+	if f == nil || !f.enabled {
+		return ""
 	}
+	return f.ref + ":" + f.expected
+}
 
-	if len(missingObjHashes) == 0 {
-		fmt.Println("Everything up-to-date")
+func (f *forceWithLeaseFlag) Set(value string) error {
+	f.enabled = true
+	if value == "true" {
 		return nil
 	}
 
+	ref, expected, _ := strings.Cut(value, ":")
+	f.ref = strings.TrimPrefix(ref, "refs/heads/")
+	f.expected = expected
+	return nil
+}
+
+// Allows the flag to be given without a value
+func (f *forceWithLeaseFlag) IsBoolFlag() bool {
+	return true
+}
+
+// Pushes the current branch to its upstream branch in the remote repository (or, if it has no upstream configured,
+// to the remote branch of the same name). Depending on signMode, the push is signed with a push certificate (see
+// createPushCertificate) if the server accepts them.
+func Push(localHead string, repoURL string, forceOptions ForcePushOptions, signMode PushSignMode, noVerify bool, repoDir string) error {
 	branchName, err := getCurrentBranch(repoDir)
 	if err != nil {
 		return fmt.Errorf("failed to get current branch: %s", err)
 	}
 
-	fmt.Printf("Updating remote HEAD %s to local HEAD %s on branch %s\n", remoteHead, localHead, branchName)
-	fmt.Printf("Found %d objects in local HEAD missing from remote HEAD\n", len(missingObjHashes))
+	remoteName, err := getRemoteNameForURL(repoURL, repoDir)
+	if err != nil {
+		return err
+	}
 
-	packfile, err := CreatePackfile(missingObjHashes, repoDir)
+	remoteBranchName, err := getUpstreamBranchName(branchName, remoteName, repoDir)
 	if err != nil {
-		return fmt.Errorf("failed to create packfile of objects to push: %s", err)
+		return fmt.Errorf("failed to determine upstream branch: %s", err)
 	}
 
-	err = receivePackRequest(branchName, localHead, remoteHead, packfile, repoURL)
+	// The remote-tracking ref records the remote branch's tip as of the last pull or push
+	remoteHead, _, err := ResolveBranchRef(remoteBranchName, remoteName, repoDir)
 	if err != nil {
-		return fmt.Errorf("failed to perform receive-pack request sending packfile to remote repository: %s", err)
+		return fmt.Errorf("failed to resolve remote-tracking reference: %s", err)
 	}
 
-	err = UpdateBranchRef(branchName, localHead, false, repoDir)
+	remoteRefs, err := discoverRefs(repoURL, "git-receive-pack")
 	if err != nil {
-		return fmt.Errorf("failed to update local branch reference for %s: %s", branchName, err)
+		return fmt.Errorf("failed to perform reference discovery on the remote repository: %s", err)
 	}
+	actualRemoteHead, _ := remoteRefs.get("refs/heads/" + remoteBranchName)
 
-	err = UpdateBranchRef(branchName, localHead, true, repoDir)
+	if actualRemoteHead == localHead {
+		fmt.Println("Everything up-to-date")
+		return nil
+	}
+
+	err = checkPushAllowed(remoteBranchName, localHead, remoteHead, actualRemoteHead, forceOptions, repoDir)
 	if err != nil {
-		return fmt.Errorf("failed to update remote branch reference for %s: %s", branchName, err)
+		return err
 	}
 
-	return nil
-}
+	pushCertNonce, acceptsPushCerts := remoteRefs.getPushCertNonce()
+	if signMode == PushSignAlways && !acceptsPushCerts {
+		return fmt.Errorf("the receiving end does not support --signed push")
+	}
+	signPush := signMode != PushSignNever && acceptsPushCerts
 
-func calculateMissingObjects(localHead string, remoteHead string, repoDir string) ([]string, error) {
-	localObjHashes, err := GetAllObjectsInCommit(localHead, repoDir)
+	// The pre-push hook is told which ref is being pushed to which remote ref, one line per ref, and can abort the
+	// push before anything is sent
+	if !noVerify {
+		prevRemoteHead := actualRemoteHead
+		if prevRemoteHead == "" {
+			prevRemoteHead = NULL_OBJECT_HASH
+		}
+		refLine := fmt.Sprintf("%s %s %s %s\n", getBranchRefName(branchName, ""), localHead, getBranchRefName(remoteBranchName, ""), prevRemoteHead)
+		if err := runHook("pre-push", []string{remoteName, repoURL}, refLine, repoDir); err != nil {
+			return err
+		}
+	}
+
+	// Objects reachable from the remote branch's actual tip don't need to be sent, but if that commit isn't
+	// known locally, the remote-tracking ref is the best available approximation
+	knownRemoteHead := remoteHead
+	if actualRemoteHead != "" && objectExists(actualRemoteHead, repoDir) {
+		knownRemoteHead = actualRemoteHead
+	}
+
+	missingObjHashes, err := calculateMissingObjects(localHead, knownRemoteHead, repoDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get all objects in local HEAD: %s", err)
+		return fmt.Errorf("failed to calculate objects in local HEAD missing from remote HEAD: %s", err)
 	}
 
-	var remoteObjHashes []string
-	if remoteHead == "" {
-		remoteObjHashes = []string{}
-	} else {
-		remoteObjHashes, err = GetAllObjectsInCommit(remoteHead, repoDir)
+	fmt.Printf("Updating remote HEAD %s to local HEAD %s on branch %s\n", actualRemoteHead, localHead, remoteBranchName)
+	fmt.Printf("Found %d objects in local HEAD missing from remote HEAD\n", len(missingObjHashes))
+
+	// The push certificate is made before the request, so that a failure to sign it aborts the push
+	refUpdate := formatRefUpdate(remoteBranchName, localHead, actualRemoteHead)
+	pushCert := ""
+	if signPush {
+		pushCert, err = createPushCertificate([]string{refUpdate}, pushCertNonce, repoURL, repoDir)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get all objects in remote HEAD: %s", err)
+			return fmt.Errorf("failed to sign push certificate: %s", err)
 		}
 	}
 
-	remoteObjHashesSet := make(map[string]struct{}, len(remoteObjHashes))
-	for _, obj := range remoteObjHashes {
-		remoteObjHashesSet[obj] = struct{}{}
+	err = receivePackRequest(remoteBranchName, refUpdate, pushCert, missingObjHashes, remoteRefs.url, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to perform receive-pack request sending packfile to remote repository: %s", err)
+	}
+
+	// The local branch and its remote-tracking branch are updated together, so that they can't be left disagreeing
+	transaction := newRefTransaction(repoDir)
+	if err := transaction.update(getBranchRefName(branchName, ""), localHead, ""); err != nil {
+		return err
+	}
+	if err := transaction.update(getBranchRefName(remoteBranchName, remoteName), localHead, ""); err != nil {
+		return err
+	}
+	if err := transaction.commit(); err != nil {
+		return fmt.Errorf("failed to update branch references for %s: %s", branchName, err)
+	}
+
+	return nil
+}
+
+// Determines whether the remote branch may be updated from its actual tip to the local HEAD. Without any
+// force option, only fast-forward updates are allowed. With --force-with-lease, the remote branch's actual
+// tip must match the expected value (by default, the value last recorded in the remote-tracking ref), so
+// that commits pushed by others since the last fetch are never clobbered.
+func checkPushAllowed(branchName string, localHead string, remoteHead string, actualRemoteHead string, forceOptions ForcePushOptions, repoDir string) error {
+	if forceOptions.force {
+		return nil
 	}
 
-	missingObjHashesSet := make(map[string]struct{})
-	for _, obj := range localObjHashes {
-		if _, exists := remoteObjHashesSet[obj]; !exists {
-			missingObjHashesSet[obj] = struct{}{}
+	leaseApplies := forceOptions.withLease && (forceOptions.leaseRef == "" || forceOptions.leaseRef == branchName)
+	if leaseApplies {
+		expectedRemoteHead := forceOptions.leaseExpected
+		if expectedRemoteHead == "" {
+			expectedRemoteHead = remoteHead
 		}
+
+		if actualRemoteHead != expectedRemoteHead {
+			return fmt.Errorf("rejected %s (stale info): remote branch tip is %s, but expected %s. Pull to incorporate the remote changes before pushing", branchName, formatPushHash(actualRemoteHead), formatPushHash(expectedRemoteHead))
+		}
+
+		return nil
 	}
 
-	missingObjHashes := []string{}
-	for obj := range missingObjHashesSet {
-		missingObjHashes = append(missingObjHashes, obj)
+	if actualRemoteHead == "" {
+		return nil
 	}
 
+	isFastForward, err := isAncestorCommit(actualRemoteHead, localHead, repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to determine whether push is a fast-forward: %s", err)
+	}
+
+	if !isFastForward {
+		return fmt.Errorf("rejected %s (non-fast-forward): the tip of your current branch is behind its remote counterpart. Pull to incorporate the remote changes, or use --force-with-lease to overwrite them", branchName)
+	}
+
+	return nil
+}
+
+func formatPushHash(hash string) string {
+	if hash == "" {
+		return "(none)"
+	}
+	return hash
+}
+
+// Returns the objects which must be sent for the remote to have the local HEAD: the commits made since the remote
+// HEAD, along with the trees and blobs they introduce (see listObjects). The objects are listed in the order they're
+// walked, so that the same commits always produce a byte-identical packfile.
+func calculateMissingObjects(localHead string, remoteHead string, repoDir string) ([]string, error) {
+	excludedHashes := []string{}
+	if remoteHead != "" {
+		excludedHashes = append(excludedHashes, remoteHead)
+	}
+	revListObjects, err := listObjects([]string{localHead}, excludedHashes, true, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	missingObjHashes := []string{}
+	for _, obj := range revListObjects {
+		missingObjHashes = append(missingObjHashes, obj.hash)
+	}
 	return missingObjHashes, nil
 }
 
-func receivePackRequest(branchName string, localHead string, remoteHead string, packfile []byte, repoURL string) error {
+// Formats the update of the remote branch according to the Git protocol: <old-value> SP <new-value> SP <ref-name>
+func formatRefUpdate(branchName string, localHead string, remoteHead string) string {
 	// When creating a new branch, old-value should be all zeros
 	if remoteHead == "" {
 		remoteHead = strings.Repeat("0", OBJECT_HASH_LENGTH_STRING)
 	}
+	return fmt.Sprintf("%s %s refs/heads/%s", remoteHead, localHead, branchName)
+}
 
-	// Format the ref update line according to the Git protocol
-	// Format: <old-value> SP <new-value> SP <ref-name> NUL report-status
-	refUpdateLine := fmt.Sprintf("%s %s refs/heads/%s\x00 report-status", remoteHead, localHead, branchName)
-	refUpdate := createPktLineStream([]string{createPktLine(refUpdateLine)})
-
-	var receivePackReqBody bytes.Buffer
-	receivePackReqBody.WriteString(refUpdate)
-	receivePackReqBody.Write(packfile)
-
-	receivePackRespBody, err := makeHTTPRequest("POST", repoURL+"/git-receive-pack", receivePackReqBody, []int{200})
-	if err != nil {
-		return fmt.Errorf("git-receive-pack request failed: %s", err)
+// Sends the ref update and a packfile of the given objects to the remote repository, writing the packfile as it's sent.
+// The ref update is followed by the capabilities requested (separated by a NUL), unless the push is signed, in which
+// case the push certificate (which includes the ref update) is sent in its place.
+func receivePackRequest(branchName string, refUpdate string, pushCert string, objHashes []string, repoURL string, repoDir string) error {
+	capabilities := " report-status"
+	var commandPktLines []string
+	if pushCert != "" {
+		commandPktLines = formatPushCertificatePktLines(pushCert, capabilities)
+	} else {
+		commandPktLines = []string{createPktLine(refUpdate + "\x00" + capabilities)}
 	}
 
+	receivePackReqBody := newStreamedRequestBody(func(w io.Writer) error {
+		if _, err := io.WriteString(w, createPktLineStream(commandPktLines)); err != nil {
+			return err
+		}
+		if err := writePackfile(w, objHashes, true, repoDir); err != nil {
+			return fmt.Errorf("failed to create packfile of objects to push: %s", err)
+		}
+		return nil
+	})
+
 	// Parse the pkt-line formatted response
-	lines, err := readPktLines(bytes.NewReader(receivePackRespBody))
+	var lines []string
+	_, err := makeHTTPRequest("POST", repoURL+"/git-receive-pack", receivePackReqBody, []int{200}, getResultContentType("git-receive-pack"), func(respBody io.Reader) error {
+		var err error
+		lines, err = readPktLines(respBody)
+		if err != nil {
+			return fmt.Errorf("failed to parse pkt-lines from response: %s", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to parse pkt-lines from response: %s", err)
+		return fmt.Errorf("git-receive-pack request failed: %s", err)
 	}
 
 	if len(lines) < 2 {
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The capability advertised by a receive-pack server which accepts push certificates, with the nonce which the
+// certificate must include as its value (e.g. push-cert=1700000000-a1b2c3...)
+const PUSH_CERT_CAPABILITY = "push-cert"
+
+const PUSH_CERT_VERSION = "0.1"
+
+// Represents when a push is signed with a push certificate, as set by push --signed or the push.gpgSign config
+// variable
+type PushSignMode int
+
+const (
+	PushSignNever   PushSignMode = iota
+	PushSignAlways               // Fails if the server doesn't accept push certificates
+	PushSignIfAsked              // Only signs if the server accepts push certificates
+)
+
+// Parses the value of push --signed or the push.gpgSign config variable, which is a boolean or if-asked
+func parsePushSignMode(value string) (PushSignMode, error) {
+	if strings.ToLower(value) == "if-asked" {
+		return PushSignIfAsked, nil
+	}
+
+	sign, err := parseConfigBool(value)
+	if err != nil {
+		return PushSignNever, fmt.Errorf("invalid value for push signing: %s", value)
+	}
+	if sign {
+		return PushSignAlways, nil
+	}
+	return PushSignNever, nil
+}
+
+// Parses the optional value of the --signed flag, which may be given with no value (meaning true), or as
+// --signed=<true|false|if-asked>
+type pushSignedFlag struct {
+	given bool
+	mode  PushSignMode
+}
+
+func (f *pushSignedFlag) String() string {
+	return ""
+}
+
+func (f *pushSignedFlag) Set(value string) error {
+	mode, err := parsePushSignMode(value)
+	if err != nil {
+		return err
+	}
+	f.given, f.mode = true, mode
+	return nil
+}
+
+// Allows the flag to be given without a value
+func (f *pushSignedFlag) IsBoolFlag() bool {
+	return true
+}
+
+// Returns the nonce that the server requires push certificates to include, and whether it accepts push certificates
+// at all, from its push-cert capability
+func (r *RemoteRefs) getPushCertNonce() (string, bool) {
+	for _, capability := range r.capabilities {
+		if nonce, found := strings.CutPrefix(capability, PUSH_CERT_CAPABILITY+"="); found {
+			return nonce, true
+		}
+	}
+	return "", false
+}
+
+// Creates a push certificate for the given ref updates (each `<old-hash> <new-hash> <ref-name>`), signed with the
+// user's key (see signPayload), which lets the server record who pushed what and verify that it was the user. As in
+// Git, the certificate names the pusher (the committer identity, with the current time), the repository being pushed
+// to (without any credentials in its URL), and the nonce given by the server, which prevents the certificate from
+// being replayed.
+func createPushCertificate(refUpdates []string, nonce string, repoURL string, repoDir string) (string, error) {
+	pusher, err := getCommitUser(CommitCommitter, repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine pusher: %s", err)
+	}
+
+	var certBuilder strings.Builder
+	fmt.Fprintf(&certBuilder, "certificate version %s\n", PUSH_CERT_VERSION)
+	fmt.Fprintf(&certBuilder, "pusher %s\n", pusher.format())
+	fmt.Fprintf(&certBuilder, "pushee %s\n", anonymizeURL(repoURL))
+	fmt.Fprintf(&certBuilder, "nonce %s\n", nonce)
+	certBuilder.WriteString("\n")
+	for _, refUpdate := range refUpdates {
+		certBuilder.WriteString(refUpdate + "\n")
+	}
+
+	cert := certBuilder.String()
+	signature, err := signPayload(cert, "", *pusher, repoDir)
+	if err != nil {
+		return "", err
+	}
+	return cert + signature, nil
+}
+
+// Formats the push certificate as it's sent in place of the ref update commands: a push-cert line carrying the
+// capabilities, each line of the certificate as a pkt-line, and a push-cert-end line
+func formatPushCertificatePktLines(cert string, capabilities string) []string {
+	pktLines := []string{createPktLine(PUSH_CERT_CAPABILITY + "\x00" + capabilities)}
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(cert, "\n"), "\n") {
+		pktLines = append(pktLines, createPktLine(line))
+	}
+	return append(pktLines, createPktLine("push-cert-end"))
+}
+
+// Removes any username and password from the URL, so that they aren't recorded in push certificates
+func anonymizeURL(repoURL string) string {
+	parsedURL, err := url.Parse(repoURL)
+	if err != nil || parsedURL.User == nil {
+		return repoURL
+	}
+	parsedURL.User = nil
+	return parsedURL.String()
+}
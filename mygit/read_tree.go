@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// Replaces the contents of the index with the entries of the given trees, as git read-tree does. Without merge, the
+// index is replaced with the single tree's entries, which have no stat data, so every file is rehashed the next time
+// it's compared with the working tree. With merge, the trees are merged into the index (see mergeTreesIntoIndex),
+// keeping the stat data of every entry which is left unchanged.
+func ReadTree(treeHashes []string, merge bool, repoDir string) error {
+	if len(treeHashes) == 0 || len(treeHashes) > 3 || (!merge && len(treeHashes) != 1) {
+		return fmt.Errorf("expected one tree, or with -m, one to three trees")
+	}
+
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return err
+	}
+
+	trees := make([]map[string]*DiffFileVersion, len(treeHashes))
+	for i, treeHash := range treeHashes {
+		trees[i] = make(map[string]*DiffFileVersion)
+		if err := populateTreeDiffFiles(trees[i], treeHash, "", repoDir); err != nil {
+			return fmt.Errorf("failed to read files in tree %s: %s", treeHash, err)
+		}
+	}
+
+	var newEntries []*IndexEntry
+	if merge {
+		newEntries, err = mergeTreesIntoIndex(index.entries, trees)
+		if err != nil {
+			return err
+		}
+	} else {
+		newEntries = []*IndexEntry{}
+		for path, file := range trees[0] {
+			newEntries = append(newEntries, newTreeIndexEntry(path, file, 0))
+		}
+	}
+
+	if err := writeUpdatedIndex(indexLock, index, newEntries); err != nil {
+		return fmt.Errorf("failed to write updated Git index file: %s", err)
+	}
+	return nil
+}
+
+// Merges the trees into the index entries, returning the new entries:
+//
+//   - With one tree, the index is replaced with the tree, but the entries of files which are unchanged from the index
+//     keep their stat data.
+//   - With two trees, the index is moved from the first tree (e.g. HEAD) to the second, keeping any changes staged in
+//     the index: each file which differs between the trees is updated to its version in the second tree, unless the
+//     file is staged with a version which matches neither tree.
+//   - With three trees (the merge base, ours, and theirs), each file which changed on only one side since the merge
+//     base (or the same way on both) is updated to its merged version, and each file which changed differently on
+//     both sides is left with merge conflicts: entries at stage 1 for the merge base, stage 2 for ours, and stage 3
+//     for theirs, for whichever of them contain the file. Files whose entries would change must be staged as they are
+//     in ours.
+//
+// As in Git, the merge is refused if the index already has merge conflicts, or if it would overwrite a staged change.
+func mergeTreesIntoIndex(indexEntries []*IndexEntry, trees []map[string]*DiffFileVersion) ([]*IndexEntry, error) {
+	currEntries := make(map[string]*IndexEntry, len(indexEntries))
+	for _, entry := range indexEntries {
+		if entry.stage() != 0 {
+			return nil, fmt.Errorf("you need to resolve your current index first")
+		}
+		currEntries[entry.path] = entry
+	}
+
+	paths := make(map[string]bool, len(currEntries))
+	for path := range currEntries {
+		paths[path] = true
+	}
+	for _, tree := range trees {
+		for path := range tree {
+			paths[path] = true
+		}
+	}
+
+	newEntries := []*IndexEntry{}
+	for path := range paths {
+		currEntry := currEntries[path]
+		var curr *DiffFileVersion
+		if currEntry != nil {
+			curr = &DiffFileVersion{hash: hex.EncodeToString(currEntry.sha1[:]), mode: currEntry.mode}
+		}
+
+		var merged *DiffFileVersion
+		var conflicted bool
+		switch len(trees) {
+		case 1:
+			merged = trees[0][path]
+		case 2:
+			oldFile, newFile := trees[0][path], trees[1][path]
+			switch {
+			case isSameFileVersion(oldFile, newFile) || isSameFileVersion(curr, newFile):
+				merged = curr
+			case isSameFileVersion(curr, oldFile):
+				merged = newFile
+			default:
+				return nil, fmt.Errorf("entry '%s' would be overwritten by merge. Cannot merge.", path)
+			}
+		case 3:
+			baseFile, oursFile, theirsFile := trees[0][path], trees[1][path], trees[2][path]
+			switch {
+			case isSameFileVersion(oursFile, theirsFile) || isSameFileVersion(baseFile, theirsFile):
+				merged = oursFile
+			case isSameFileVersion(baseFile, oursFile):
+				merged = theirsFile
+			default:
+				conflicted = true
+			}
+			// The index may only differ from ours for files which the merge leaves as they are
+			if (conflicted || !isSameFileVersion(merged, curr)) && !isSameFileVersion(curr, oursFile) {
+				return nil, fmt.Errorf("entry '%s' would be overwritten by merge. Cannot merge.", path)
+			}
+		}
+
+		if conflicted {
+			for i, tree := range trees {
+				if file := tree[path]; file != nil {
+					newEntries = append(newEntries, newTreeIndexEntry(path, file, i+1))
+				}
+			}
+			continue
+		}
+
+		switch {
+		case merged == nil:
+			continue
+		case isSameFileVersion(merged, curr):
+			newEntries = append(newEntries, currEntry)
+		default:
+			newEntries = append(newEntries, newTreeIndexEntry(path, merged, 0))
+		}
+	}
+
+	return newEntries, nil
+}
+
+// Creates an index entry at the given stage for a file in a tree, with no stat data
+func newTreeIndexEntry(path string, file *DiffFileVersion, stage int) *IndexEntry {
+	entry := &IndexEntry{mode: file.mode, path: path, flags: uint16(stage << INDEX_ENTRY_STAGE_SHIFT)}
+	hashBytes, _ := hex.DecodeString(file.hash)
+	copy(entry.sha1[:], hashBytes)
+	return entry
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Replays the local commits which aren't reachable from the upstream commit on top of it, one at a time, returning
+// the hash of the new tip along with the number of commits replayed. Each commit's changes are applied file by file:
+// a file changed by the commit takes its new version as long as the file hasn't also been changed differently on
+// top of which the commit is being replayed, in which case the rebase is aborted. Commits whose changes are already
+// present upstream are dropped.
+func rebaseOntoUpstream(localHead string, upstreamHead string, repoDir string) (string, int, error) {
+	commitsToReplay, err := getCommitsToReplay(localHead, upstreamHead, repoDir)
+	if err != nil {
+		return "", -1, err
+	}
+
+	currHead := upstreamHead
+	currFiles, err := getCommitDiffFiles(upstreamHead, repoDir)
+	if err != nil {
+		return "", -1, err
+	}
+
+	numReplayed := 0
+	for _, commitObj := range commitsToReplay {
+		parentFiles := make(map[string]*DiffFileVersion)
+		if len(commitObj.parentCommitHashes) == 1 {
+			parentFiles, err = getCommitDiffFiles(commitObj.parentCommitHashes[0], repoDir)
+			if err != nil {
+				return "", -1, err
+			}
+		}
+
+		commitFiles, err := getCommitDiffFiles(commitObj.hash, repoDir)
+		if err != nil {
+			return "", -1, err
+		}
+
+		newFiles, conflicts := applyFileChanges(currFiles, parentFiles, commitFiles)
+		if len(conflicts) > 0 {
+			return "", -1, fmt.Errorf("could not apply %s (%s): conflicting changes to %s", commitObj.hash[:DIFF_ABBREV_HASH_LENGTH], getCommitSubject(commitObj), strings.Join(conflicts, ", "))
+		}
+
+		if len(diffFileSets(currFiles, newFiles)) == 0 {
+			continue
+		}
+
+		treeHash, err := createTreeObjectFromFiles(newFiles, repoDir)
+		if err != nil {
+			return "", -1, fmt.Errorf("failed to create tree for rebased commit: %s", err)
+		}
+
+		committer, err := getCommitUser(CommitCommitter, repoDir)
+		if err != nil {
+			return "", -1, err
+		}
+
+		newCommitObj, err := createCommitObject(treeHash, []string{currHead}, commitObj.author, *committer, commitObj.commitMessage, repoDir)
+		if err != nil {
+			return "", -1, fmt.Errorf("failed to create rebased commit: %s", err)
+		}
+
+		currHead = newCommitObj.hash
+		currFiles = newFiles
+		numReplayed += 1
+	}
+
+	return currHead, numReplayed, nil
+}
+
+// Returns the commits reachable from localHead but not upstreamHead, oldest first. Only linear history can be
+// replayed, so merge commits are rejected.
+func getCommitsToReplay(localHead string, upstreamHead string, repoDir string) ([]*CommitObject, error) {
+	upstreamCommits, err := getReachableCommits(upstreamHead, false, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	reversedCommits := []*CommitObject{}
+	commitHash := localHead
+	for !upstreamCommits[commitHash] {
+		commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %s: %s", commitHash, err)
+		}
+
+		if len(commitObj.parentCommitHashes) > 1 {
+			return nil, fmt.Errorf("cannot rebase merge commit %s", commitHash)
+		}
+		reversedCommits = append(reversedCommits, commitObj)
+
+		if len(commitObj.parentCommitHashes) == 0 {
+			break
+		}
+		commitHash = commitObj.parentCommitHashes[0]
+	}
+
+	commits := make([]*CommitObject, len(reversedCommits))
+	for i, commitObj := range reversedCommits {
+		commits[len(reversedCommits)-1-i] = commitObj
+	}
+	return commits, nil
+}
+
+// Applies the changes between the old and new sets of files on top of the base set of files, returning the
+// resulting files along with the paths which were changed differently in the base
+func applyFileChanges(baseFiles map[string]*DiffFileVersion, oldFiles map[string]*DiffFileVersion, newFiles map[string]*DiffFileVersion) (map[string]*DiffFileVersion, []string) {
+	resultFiles := make(map[string]*DiffFileVersion, len(baseFiles))
+	for path, file := range baseFiles {
+		resultFiles[path] = file
+	}
+
+	conflicts := []string{}
+	for _, change := range diffFileSets(oldFiles, newFiles) {
+		baseFile := baseFiles[change.path]
+		if isSameFileVersion(baseFile, change.oldFile) || isSameFileVersion(baseFile, change.newFile) {
+			if change.newFile == nil {
+				delete(resultFiles, change.path)
+			} else {
+				resultFiles[change.path] = change.newFile
+			}
+		} else {
+			conflicts = append(conflicts, change.path)
+		}
+	}
+
+	return resultFiles, conflicts
+}
+
+func isSameFileVersion(a *DiffFileVersion, b *DiffFileVersion) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.hash == b.hash && a.mode == b.mode
+}
+
+func getCommitDiffFiles(commitHash string, repoDir string) (map[string]*DiffFileVersion, error) {
+	commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit %s: %s", commitHash, err)
+	}
+
+	files := make(map[string]*DiffFileVersion)
+	if err := populateTreeDiffFiles(files, commitObj.treeHash, "", repoDir); err != nil {
+		return nil, fmt.Errorf("failed to read files in tree of commit %s: %s", commitHash, err)
+	}
+
+	return files, nil
+}
+
+func getCommitSubject(commitObj *CommitObject) string {
+	subject, _, _ := strings.Cut(strings.TrimSpace(commitObj.commitMessage), "\n")
+	return subject
+}
+
+// Creates the tree objects for the given set of files (keyed by their paths from the repository root), returning
+// the hash of the root tree object
+func createTreeObjectFromFiles(files map[string]*DiffFileVersion, repoDir string) (string, error) {
+	entries := []TreeObjectEntry{}
+	subDirFiles := make(map[string]map[string]*DiffFileVersion)
+
+	for path, file := range files {
+		dir, rest, inSubDir := strings.Cut(path, "/")
+		if inSubDir {
+			if _, exists := subDirFiles[dir]; !exists {
+				subDirFiles[dir] = make(map[string]*DiffFileVersion)
+			}
+			subDirFiles[dir][rest] = file
+			continue
+		}
+
+		entries = append(entries, TreeObjectEntry{
+			hash:    file.hash,
+			mode:    file.mode,
+			name:    path,
+			objType: getObjectTypeFromMode(file.mode),
+		})
+	}
+
+	for dir, files := range subDirFiles {
+		subDirTreeHash, err := createTreeObjectFromFiles(files, repoDir)
+		if err != nil {
+			return "", err
+		}
+
+		entries = append(entries, TreeObjectEntry{
+			hash:    subDirTreeHash,
+			mode:    DIRECTORY_MODE,
+			name:    dir,
+			objType: Tree,
+		})
+	}
+
+	treeObj, err := createTreeObject(entries, repoDir)
+	if err != nil {
+		return "", err
+	}
+
+	return treeObj.hash, nil
+}
+
+// Represents the uncommitted changes to tracked files saved before a pull, so that they can be reapplied to the
+// working tree afterwards. The working tree version of each changed file is stored as a blob, and a deleted file
+// has a nil version.
+type AutoStash struct {
+	baseFiles map[string]*DiffFileVersion // The files in HEAD when the changes were stashed
+	changes   map[string]*DiffFileVersion
+}
+
+// Saves the staged and unstaged changes reported by status, returning nil if there are none
+func createAutoStash(repoDir string) (*AutoStash, error) {
+	// Changes within submodules belong to their own repositories, so aren't stashed
+	status, err := GetRepoStatus(IgnoreSubmodulesAll, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	changedFiles := append(status.stagedFiles, status.notStagedFiles...)
+	if len(changedFiles) == 0 {
+		return nil, nil
+	}
+
+	baseFiles, err := getHeadDiffFiles(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]*DiffFileVersion, len(changedFiles))
+	for _, fileStatus := range changedFiles {
+		fullPath := filepath.Join(repoDir, fileStatus.path)
+		info, err := os.Lstat(fullPath)
+		if err != nil && os.IsNotExist(err) {
+			changes[fileStatus.path] = nil
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to stat file %s: %s", fileStatus.path, err)
+		}
+
+		blobObj, err := CreateBlobObjectFromFile(fullPath, converter, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stash file %s: %s", fileStatus.path, err)
+		}
+		changes[fileStatus.path] = &DiffFileVersion{hash: blobObj.hash, mode: getGitModeFromFileMode(info.Mode())}
+	}
+
+	return &AutoStash{baseFiles: baseFiles, changes: changes}, nil
+}
+
+// Reapplies the stashed changes to the working tree, which has just been updated to the given commit. Changes to
+// files which the update also changed are not applied, and their paths are returned as conflicts.
+func (s *AutoStash) apply(newHead string, repoDir string) ([]string, error) {
+	newFiles, err := getCommitDiffFiles(newHead, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := []string{}
+	for path, stashedFile := range s.changes {
+		if isSameFileVersion(newFiles[path], stashedFile) {
+			continue
+		}
+		if !isSameFileVersion(newFiles[path], s.baseFiles[path]) {
+			conflicts = append(conflicts, path)
+			continue
+		}
+
+		fullPath := filepath.Join(repoDir, path)
+		if stashedFile == nil {
+			if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to remove file %s: %s", path, err)
+			}
+			continue
+		}
+
+		if err := checkoutBlob(stashedFile.hash, fullPath, stashedFile.mode, converter, repoDir); err != nil {
+			return nil, fmt.Errorf("failed to restore file %s: %s", path, err)
+		}
+	}
+
+	sort.Strings(conflicts)
+	return conflicts, nil
+}
+
+// Lists the given stashed paths along with the blob holding each one's uncommitted contents, which can be
+// recovered with `cat-file -p`
+func (s *AutoStash) describe(paths []string) string {
+	descriptions := []string{}
+	for _, path := range paths {
+		if s.changes[path] == nil {
+			descriptions = append(descriptions, fmt.Sprintf("%s (deleted)", path))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%s (blob %s)", path, s.changes[path].hash))
+		}
+	}
+	return strings.Join(descriptions, ", ")
+}
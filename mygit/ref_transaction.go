@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Represents the kind of change made to a ref by a ref transaction
+type RefUpdateKind int
+
+const (
+	RefUpdateWrite  RefUpdateKind = iota // Points the ref at a new object, creating it if needed
+	RefUpdateDelete                      // Removes the ref, both its loose file and any packed entry
+	RefUpdateVerify                      // Only checks the ref's current value, failing the transaction if it differs
+)
+
+// Represents a single change in a ref transaction. If oldHash is set, the ref must currently point to that object
+// (or, if it's NULL_OBJECT_HASH, must not exist yet) for the transaction to go ahead.
+type RefUpdate struct {
+	kind        RefUpdateKind
+	refName     string
+	newHash     string
+	oldHash     string
+	derefName   string    // The ref which is actually changed, after following any symbolic refs (set once prepared)
+	currentHash string    // The value of the ref when it was locked, or "" if it didn't exist (set once prepared)
+	lock        *LockFile // Held from when the transaction is prepared until it's committed or aborted
+}
+
+type RefTransactionState int
+
+const (
+	RefTransactionOpen RefTransactionState = iota
+	RefTransactionPrepared
+	RefTransactionClosed
+)
+
+// Represents a set of ref updates which are applied together, following Git's ref transactions. Updates are queued
+// while the transaction is open. Preparing the transaction locks every ref being changed (in sorted order, so that
+// concurrent transactions can't deadlock) and checks their old values, so that if any ref can't be locked or has
+// moved on, the transaction fails without having changed anything. Committing then applies every update, and
+// aborting releases the locks without changing anything.
+type RefTransaction struct {
+	updates []*RefUpdate
+	state   RefTransactionState
+	repoDir string
+}
+
+func newRefTransaction(repoDir string) *RefTransaction {
+	return &RefTransaction{updates: []*RefUpdate{}, state: RefTransactionOpen, repoDir: repoDir}
+}
+
+// Queues an update of the ref to the new object hash, optionally only if it currently points to oldHash
+func (t *RefTransaction) update(refName string, newHash string, oldHash string) error {
+	if !isValidObjectHash(newHash) || newHash == NULL_OBJECT_HASH {
+		return fmt.Errorf("invalid object hash for %s: %s", refName, newHash)
+	}
+	return t.queue(&RefUpdate{kind: RefUpdateWrite, refName: refName, newHash: newHash, oldHash: oldHash})
+}
+
+// Queues the creation of the ref, which must not exist yet
+func (t *RefTransaction) create(refName string, newHash string) error {
+	return t.update(refName, newHash, NULL_OBJECT_HASH)
+}
+
+// Queues the deletion of the ref, optionally only if it currently points to oldHash
+func (t *RefTransaction) delete(refName string, oldHash string) error {
+	if oldHash == NULL_OBJECT_HASH {
+		return fmt.Errorf("cannot delete %s: the expected old object hash is the all-zero hash", refName)
+	}
+	return t.queue(&RefUpdate{kind: RefUpdateDelete, refName: refName, oldHash: oldHash})
+}
+
+// Queues a check that the ref currently points to oldHash, or, if oldHash is empty, that it doesn't exist
+func (t *RefTransaction) verify(refName string, oldHash string) error {
+	if oldHash == "" {
+		oldHash = NULL_OBJECT_HASH
+	}
+	return t.queue(&RefUpdate{kind: RefUpdateVerify, refName: refName, oldHash: oldHash})
+}
+
+func (t *RefTransaction) queue(update *RefUpdate) error {
+	if t.state != RefTransactionOpen {
+		return fmt.Errorf("cannot queue an update of %s: the transaction is no longer open", update.refName)
+	}
+	if err := validateRefName(update.refName); err != nil {
+		return err
+	}
+	if update.oldHash != "" && !isValidObjectHash(update.oldHash) {
+		return fmt.Errorf("invalid expected old object hash for %s: %s", update.refName, update.oldHash)
+	}
+
+	for _, queued := range t.updates {
+		if queued.refName == update.refName {
+			return fmt.Errorf("multiple updates for ref '%s' not allowed", update.refName)
+		}
+	}
+
+	t.updates = append(t.updates, update)
+	return nil
+}
+
+// Locks every ref being changed, checking that each has its expected old value, and writes the new values into the
+// lock files. If any of this fails, the transaction is aborted.
+func (t *RefTransaction) prepare() error {
+	if t.state != RefTransactionOpen {
+		return fmt.Errorf("cannot prepare a transaction which is no longer open")
+	}
+
+	sort.SliceStable(t.updates, func(i, j int) bool {
+		return t.updates[i].refName < t.updates[j].refName
+	})
+
+	// Two updates which reach the same ref through symbolic refs (e.g. HEAD and the current branch) would otherwise
+	// fail confusingly on the second one's lock
+	updatesByDerefName := make(map[string]*RefUpdate)
+	for _, update := range t.updates {
+		derefName, _, _, err := dereferenceRef(update.refName, t.repoDir)
+		if err != nil {
+			t.abort()
+			return err
+		}
+		if other, exists := updatesByDerefName[derefName]; exists {
+			t.abort()
+			return fmt.Errorf("multiple updates for '%s' (including one via its referent '%s') are not allowed", other.refName, derefName)
+		}
+		updatesByDerefName[derefName] = update
+	}
+
+	for _, update := range t.updates {
+		lock, derefName, currentHash, err := lockRefForUpdate(update.refName, update.oldHash, t.repoDir)
+		if err != nil {
+			t.abort()
+			return err
+		}
+		update.lock, update.derefName, update.currentHash = lock, derefName, currentHash
+
+		if update.kind == RefUpdateWrite {
+			if err := lock.write([]byte(update.newHash + "\n")); err != nil {
+				t.abort()
+				return err
+			}
+		}
+	}
+
+	t.state = RefTransactionPrepared
+	return nil
+}
+
+// Applies every update in the transaction, preparing it first if needed. Deleted refs are removed from the
+// packed-refs file in a single rewrite. As in Git, each loose ref is replaced atomically, but a failure partway
+// through committing (e.g. the disk filling up) can leave some of the updates applied.
+func (t *RefTransaction) commit() error {
+	if t.state == RefTransactionOpen {
+		if err := t.prepare(); err != nil {
+			return err
+		}
+	}
+	if t.state != RefTransactionPrepared {
+		return fmt.Errorf("cannot commit a transaction which is no longer open")
+	}
+	defer t.abort()
+
+	if err := t.deletePackedRefs(); err != nil {
+		return err
+	}
+
+	for _, update := range t.updates {
+		switch update.kind {
+		case RefUpdateWrite:
+			if err := update.lock.commit(); err != nil {
+				return fmt.Errorf("failed to update reference %s: %s", update.refName, err)
+			}
+			trace.refUpdate(update.derefName, update.currentHash, update.newHash)
+		case RefUpdateDelete:
+			if err := os.Remove(update.lock.path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove reference file %s: %s", update.refName, err)
+			}
+			trace.refUpdate(update.derefName, update.currentHash, "")
+		}
+	}
+
+	return nil
+}
+
+// Removes the packed entries of the refs being deleted, if any are packed
+func (t *RefTransaction) deletePackedRefs() error {
+	packedRefs, err := readPackedRefs(t.repoDir)
+	if err != nil {
+		return err
+	}
+
+	deletedRefNames := []string{}
+	for _, update := range t.updates {
+		if _, packed := packedRefs[update.derefName]; packed && update.kind == RefUpdateDelete {
+			delete(packedRefs, update.derefName)
+			deletedRefNames = append(deletedRefNames, update.refName)
+		}
+	}
+	if len(deletedRefNames) == 0 {
+		return nil
+	}
+
+	if err := writePackedRefs(packedRefs, t.repoDir); err != nil {
+		return fmt.Errorf("failed to remove %s from packed-refs file: %s", strings.Join(deletedRefNames, ", "), err)
+	}
+	return nil
+}
+
+// Releases the locks held by the transaction without changing any refs. Does nothing to updates which have already
+// been committed, so it's safe to defer.
+func (t *RefTransaction) abort() {
+	for _, update := range t.updates {
+		if update.lock != nil {
+			update.lock.rollback()
+		}
+	}
+	t.state = RefTransactionClosed
+}
+
+// Applies ref updates read from the input in the format of `git update-ref --stdin`, one command per line:
+//
+//	update <ref> <new-hash> [<old-hash>]
+//	create <ref> <new-hash>
+//	delete <ref> [<old-hash>]
+//	verify <ref> [<old-hash>]
+//	start | prepare | commit | abort
+//
+// Without start, every update is applied together once the input ends. start begins an explicit transaction, which
+// is committed by commit (after which another may be started) and aborted if the input ends first. As in Git, start,
+// prepare, commit, and abort each report `<command>: ok` to the output once they succeed.
+func ApplyRefUpdateCommands(input io.Reader, output io.Writer, repoDir string) error {
+	transaction := newRefTransaction(repoDir)
+	isExplicit := false
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		command, args, _ := strings.Cut(scanner.Text(), " ")
+
+		switch command {
+		case "start":
+			if transaction.state != RefTransactionOpen || len(transaction.updates) > 0 {
+				return fmt.Errorf("start: a transaction is already in progress")
+			}
+			isExplicit = true
+		case "prepare":
+			if err := transaction.prepare(); err != nil {
+				return fmt.Errorf("prepare: %s", err)
+			}
+		case "commit":
+			if err := transaction.commit(); err != nil {
+				return fmt.Errorf("commit: %s", err)
+			}
+			transaction, isExplicit = newRefTransaction(repoDir), false
+		case "abort":
+			transaction.abort()
+			transaction, isExplicit = newRefTransaction(repoDir), false
+		case "update", "create", "delete", "verify":
+			if err := queueRefUpdateCommand(transaction, command, args, repoDir); err != nil {
+				transaction.abort()
+				return err
+			}
+			continue
+		default:
+			transaction.abort()
+			return fmt.Errorf("unknown command: %s", scanner.Text())
+		}
+
+		if args != "" {
+			transaction.abort()
+			return fmt.Errorf("%s: extra input: %s", command, args)
+		}
+		fmt.Fprintf(output, "%s: ok\n", command)
+	}
+	if err := scanner.Err(); err != nil {
+		transaction.abort()
+		return fmt.Errorf("failed to read commands: %s", err)
+	}
+
+	if isExplicit {
+		transaction.abort()
+		return nil
+	}
+	return transaction.commit()
+}
+
+func queueRefUpdateCommand(transaction *RefTransaction, command string, args string, repoDir string) error {
+	fields := strings.Split(args, " ")
+	refName := fields[0]
+	if refName == "" {
+		return fmt.Errorf("%s: missing <ref>", command)
+	}
+
+	// The number of values (after the ref) that each command takes, and how many of them are required
+	maxValues, minValues := map[string]int{"update": 2, "create": 1, "delete": 1, "verify": 1}[command], 0
+	if command == "update" || command == "create" {
+		minValues = 1
+	}
+	values := fields[1:]
+	if len(values) < minValues {
+		return fmt.Errorf("%s %s: missing <new-hash>", command, refName)
+	} else if len(values) > maxValues {
+		return fmt.Errorf("%s %s: extra input: %s", command, refName, strings.Join(values[maxValues:], " "))
+	}
+	values = append(values, "", "")
+
+	// As in Git, updating a ref to the all-zero hash deletes it
+	if command == "update" && values[0] == NULL_OBJECT_HASH {
+		return transaction.delete(refName, values[1])
+	}
+	if command == "update" || command == "create" {
+		if !isValidObjectHash(values[0]) || !objectExists(values[0], repoDir) {
+			return fmt.Errorf("%s %s: invalid <new-hash>: %s", command, refName, values[0])
+		}
+	}
+
+	switch command {
+	case "update":
+		return transaction.update(refName, values[0], values[1])
+	case "create":
+		return transaction.create(refName, values[0])
+	case "delete":
+		return transaction.delete(refName, values[0])
+	default:
+		return transaction.verify(refName, values[0])
+	}
+}
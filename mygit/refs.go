@@ -2,111 +2,338 @@ package main
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
-func ResolveHead(remote bool, repoDir string) (string, bool, error) {
-	var headPath string
-	if remote {
-		headPath = filepath.Join(repoDir, ".git", "refs", "remotes", "origin", "HEAD")
-	} else {
-		headPath = filepath.Join(repoDir, ".git", "HEAD")
-	}
+// The maximum number of symbolic refs followed when resolving a ref, guarding against cycles
+const MAX_SYMBOLIC_REF_DEPTH = 5
+
+const SYMBOLIC_REF_PREFIX = "ref: "
+
+// The old value given when updating a ref to require that the ref doesn't exist yet
+var NULL_OBJECT_HASH = strings.Repeat("0", OBJECT_HASH_LENGTH_STRING)
+
+// The functions below operate on the local HEAD and branches if remoteName is empty, or otherwise on the given
+// remote's HEAD and remote-tracking branches (stored under refs/remotes/<remote>/)
+
+func ResolveHead(remoteName string, repoDir string) (string, bool, error) {
+	return resolveRef(getHeadRefName(remoteName), repoDir)
+}
+
+func UpdateHeadWithBranchRef(branchName string, remoteName string, repoDir string) error {
+	return UpdateSymbolicRef(getHeadRefName(remoteName), getBranchRefName(branchName, remoteName), repoDir)
+}
+
+func ResolveBranchRef(branchName string, remoteName string, repoDir string) (string, bool, error) {
+	return resolveRef(getBranchRefName(branchName, remoteName), repoDir)
+}
 
-	headContentBytes, err := os.ReadFile(headPath)
+func UpdateCurrentBranchRef(commitHash string, remoteName string, repoDir string) error {
+	branchName, err := getCurrentBranch(repoDir)
 	if err != nil {
-		return "", false, fmt.Errorf("failed to read HEAD file %s: %s", headPath, err)
+		return fmt.Errorf("failed to get current branch: %s", err)
 	}
-	headContent := strings.TrimSpace(string(headContentBytes))
 
-	// Check if HEAD is a symbolic reference
-	if strings.HasPrefix(headContent, "ref: ") {
-		refPath := strings.TrimPrefix(headContent, "ref: ")
-		refFilePath := filepath.Join(repoDir, ".git", refPath)
-		refContentBytes, err := os.ReadFile(refFilePath)
-		if err != nil {
-			// If the reference doesn't exist yet (e.g., in a new repo)
-			if os.IsNotExist(err) {
-				return "", false, nil
-			}
-			return "", false, fmt.Errorf("failed to read reference file %s: %s", refPath, err)
-		}
+	return UpdateBranchRef(branchName, commitHash, remoteName, repoDir)
+}
 
-		return strings.TrimSpace(string(refContentBytes)), true, nil
-	} else { // HEAD points directly to a commit (detached HEAD state)
-		return headContent, true, nil
+func UpdateBranchRef(branchName string, commitHash string, remoteName string, repoDir string) error {
+	return UpdateRef(getBranchRefName(branchName, remoteName), commitHash, "", repoDir)
+}
+
+func getHeadRefName(remoteName string) string {
+	if remoteName != "" {
+		return getBranchRefPrefix(remoteName) + "HEAD"
+	}
+	return "HEAD"
+}
+
+func getBranchRefName(branchName string, remoteName string) string {
+	return getBranchRefPrefix(remoteName) + branchName
+}
+
+func getBranchRefPrefix(remoteName string) string {
+	if remoteName != "" {
+		return "refs/remotes/" + remoteName + "/"
+	}
+	return "refs/heads/"
+}
+
+// Returns the path of the ref's loose file. In a linked worktree, a per-worktree ref is in the worktree's own Git
+// directory, while every other ref is in the common directory shared with the main working tree.
+func getRefPath(refName string, repoDir string) string {
+	if isPerWorktreeRef(refName) {
+		return filepath.Join(getGitDir(repoDir), filepath.FromSlash(refName))
 	}
+	return filepath.Join(getCommonDir(repoDir), filepath.FromSlash(refName))
 }
 
-func UpdateHeadWithBranchRef(branchName string, remote bool, repoDir string) error {
-	var headPath string
-	if remote {
-		headPath = filepath.Join(repoDir, ".git", "refs", "remotes", "origin", "HEAD")
-	} else {
-		headPath = filepath.Join(repoDir, ".git", "HEAD")
+// Returns whether each working tree of a repository has its own copy of the ref, as in Git: HEAD and the other
+// pseudorefs (e.g. ORIG_HEAD and MERGE_HEAD), and the refs under refs/bisect/, refs/worktree/, and refs/rewritten/
+func isPerWorktreeRef(refName string) bool {
+	if !strings.HasPrefix(refName, "refs/") {
+		return true
+	}
+	for _, prefix := range []string{"refs/bisect/", "refs/worktree/", "refs/rewritten/"} {
+		if strings.HasPrefix(refName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validates a full ref name, following the rules of `git check-ref-format`: HEAD, or a name under refs/ whose
+// slash-separated components are non-empty, don't start with a dot or end with .lock, and which contains no
+// control characters, spaces, any of ~^:?*[\, "..", or "@{", and doesn't end with a slash or a dot.
+func validateRefName(refName string) error {
+	if refName == "HEAD" {
+		return nil
+	}
+
+	if !strings.HasPrefix(refName, "refs/") {
+		return fmt.Errorf("invalid ref name %s: must be HEAD or start with refs/", refName)
 	}
 
-	var branchRefContent string
-	if remote {
-		branchRefContent = fmt.Sprintf("ref: refs/remotes/origin/%s", branchName)
-	} else {
-		branchRefContent = fmt.Sprintf("ref: refs/heads/%s", branchName)
+	if strings.HasSuffix(refName, "/") || strings.HasSuffix(refName, ".") {
+		return fmt.Errorf("invalid ref name %s: must not end with a slash or a dot", refName)
 	}
 
-	if err := os.WriteFile(headPath, []byte(branchRefContent), 0644); err != nil {
-		return fmt.Errorf("failed to write to HEAD file %s: %s", headPath, err)
+	if strings.Contains(refName, "..") || strings.Contains(refName, "@{") {
+		return fmt.Errorf("invalid ref name %s: must not contain \"..\" or \"@{\"", refName)
+	}
+
+	for _, char := range refName {
+		if char < 0x20 || char == 0x7f || strings.ContainsRune(" ~^:?*[\\", char) {
+			return fmt.Errorf("invalid ref name %s: must not contain %q", refName, char)
+		}
+	}
+
+	for _, component := range strings.Split(refName, "/") {
+		if component == "" || strings.HasPrefix(component, ".") || strings.HasSuffix(component, LOCK_FILE_SUFFIX) {
+			return fmt.Errorf("invalid ref name %s: invalid component \"%s\"", refName, component)
+		}
 	}
 
 	return nil
 }
 
-func ResolveBranchRef(branchName string, remote bool, repoDir string) (string, bool, error) {
-	var branchRefPath string
-	if remote {
-		branchRefPath = filepath.Join(repoDir, ".git", "refs", "remotes", "origin", branchName)
-	} else {
-		branchRefPath = filepath.Join(repoDir, ".git", "refs", "heads", branchName)
+// Reads the raw value of the given ref, which is either an object hash or, for a symbolic ref, the name of the ref
+// it points to prefixed with "ref: ". The loose ref file takes precedence, since refs that are updated after being
+// packed are written as loose files again, and the packed-refs file is consulted otherwise.
+func readRefValue(refName string, repoDir string) (string, bool, error) {
+	refContentBytes, err := os.ReadFile(getRefPath(refName, repoDir))
+	if err == nil {
+		return strings.TrimSpace(string(refContentBytes)), true, nil
+	} else if !os.IsNotExist(err) {
+		return "", false, fmt.Errorf("failed to read reference file %s: %s", refName, err)
 	}
 
-	branchRefContentBytes, err := os.ReadFile(branchRefPath)
+	packedRefs, err := readPackedRefs(repoDir)
 	if err != nil {
-		// If the reference doesn't exist yet (e.g., in a new repo)
-		if os.IsNotExist(err) {
-			return "", false, nil
+		return "", false, err
+	}
+
+	// If the reference doesn't exist yet (e.g., in a new repo)
+	packedRef, exists := packedRefs[refName]
+	if !exists {
+		return "", false, nil
+	}
+
+	return packedRef.hash, true, nil
+}
+
+// Follows the chain of symbolic refs starting at the given ref (e.g. from HEAD to refs/heads/main), returning the
+// name of the final, non-symbolic ref along with its value. The final ref need not exist yet, e.g. the current
+// branch of a new repository.
+func dereferenceRef(refName string, repoDir string) (string, string, bool, error) {
+	for range MAX_SYMBOLIC_REF_DEPTH {
+		refValue, exists, err := readRefValue(refName, repoDir)
+		if err != nil || !exists {
+			return refName, "", false, err
+		}
+
+		if !strings.HasPrefix(refValue, SYMBOLIC_REF_PREFIX) {
+			return refName, refValue, true, nil
 		}
-		return "", false, fmt.Errorf("failed to read branch reference file %s: %s", branchRefPath, err)
+		refName = strings.TrimPrefix(refValue, SYMBOLIC_REF_PREFIX)
 	}
 
-	return strings.TrimSpace(string(branchRefContentBytes)), true, nil
+	return "", "", false, fmt.Errorf("too many levels of symbolic refs starting at %s", refName)
 }
 
-func UpdateCurrentBranchRef(commitHash string, remote bool, repoDir string) error {
-	branchName, err := getCurrentBranch(repoDir)
+// Resolves the given full ref name (e.g. refs/heads/main), following any symbolic refs, to the object hash it
+// points to
+func resolveRef(refName string, repoDir string) (string, bool, error) {
+	_, refHash, exists, err := dereferenceRef(refName, repoDir)
+	return refHash, exists, err
+}
+
+// Returns the name of the ref that the given symbolic ref points to, or false if it isn't a symbolic ref
+func ReadSymbolicRef(refName string, repoDir string) (string, bool, error) {
+	refValue, exists, err := readRefValue(refName, repoDir)
+	if err != nil || !exists || !strings.HasPrefix(refValue, SYMBOLIC_REF_PREFIX) {
+		return "", false, err
+	}
+	return strings.TrimPrefix(refValue, SYMBOLIC_REF_PREFIX), true, nil
+}
+
+// Points the given symbolic ref (e.g. HEAD) at the target ref
+func UpdateSymbolicRef(refName string, targetRefName string, repoDir string) error {
+	if err := validateRefName(refName); err != nil {
+		return err
+	}
+	if err := validateRefName(targetRefName); err != nil || !strings.HasPrefix(targetRefName, "refs/") {
+		return fmt.Errorf("refusing to point %s outside of refs/: %s", refName, targetRefName)
+	}
+
+	refPath := getRefPath(refName, repoDir)
+	if err := os.MkdirAll(filepath.Dir(refPath), 0755); err != nil {
+		return fmt.Errorf("failed to create ref directory structure for %s: %s", refName, err)
+	}
+
+	if err := writeFileWithLock(refPath, []byte(SYMBOLIC_REF_PREFIX+targetRefName+"\n")); err != nil {
+		return fmt.Errorf("failed to write to symbolic reference file %s: %s", refName, err)
+	}
+
+	return nil
+}
+
+// Points HEAD directly at the given commit, rather than at a branch
+func DetachHead(commitHash string, repoDir string) error {
+	if !isValidObjectHash(commitHash) {
+		return fmt.Errorf("invalid object hash for HEAD: %s", commitHash)
+	}
+
+	if err := writeFileWithLock(getRefPath("HEAD", repoDir), []byte(commitHash+"\n")); err != nil {
+		return fmt.Errorf("failed to write to HEAD: %s", err)
+	}
+
+	return nil
+}
+
+// Updates the given ref (or, if it's a symbolic ref, the ref it ultimately points to) to point to the new object
+// hash. If expectedOldHash is set, the update is made only if the ref currently points to that hash (or, if it's
+// NULL_OBJECT_HASH, only if the ref doesn't exist yet). The check and the update are made while holding the ref's
+// lock, so concurrent updates can't be lost.
+func UpdateRef(refName string, newHash string, expectedOldHash string, repoDir string) error {
+	transaction := newRefTransaction(repoDir)
+	if err := transaction.update(refName, newHash, expectedOldHash); err != nil {
+		return err
+	}
+	return transaction.commit()
+}
+
+// Deletes the given ref (or, if it's a symbolic ref, the ref it ultimately points to), both its loose file and
+// any packed entry. If expectedOldHash is set, the ref is deleted only if it currently points to that hash.
+func DeleteRef(refName string, expectedOldHash string, repoDir string) error {
+	transaction := newRefTransaction(repoDir)
+	if err := transaction.delete(refName, expectedOldHash); err != nil {
+		return err
+	}
+	return transaction.commit()
+}
+
+// Acquires the lock for the ref that the given ref ultimately points to, and then checks that it points to the
+// expected object hash (if set). Returns the lock along with the name of the locked ref and its current value ("" if
+// it doesn't exist yet).
+func lockRefForUpdate(refName string, expectedOldHash string, repoDir string) (*LockFile, string, string, error) {
+	if err := validateRefName(refName); err != nil {
+		return nil, "", "", err
+	}
+	if expectedOldHash != "" && !isValidObjectHash(expectedOldHash) {
+		return nil, "", "", fmt.Errorf("invalid expected old object hash for %s: %s", refName, expectedOldHash)
+	}
+
+	derefName, _, _, err := dereferenceRef(refName, repoDir)
 	if err != nil {
-		return fmt.Errorf("failed to get current branch: %s", err)
+		return nil, "", "", err
+	}
+
+	refPath := getRefPath(derefName, repoDir)
+	if err := os.MkdirAll(filepath.Dir(refPath), 0755); err != nil {
+		return nil, "", "", fmt.Errorf("failed to create ref directory structure for %s: %s", derefName, err)
+	}
+
+	refLock, err := acquireLockFile(refPath)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	// The ref is read again now that its lock is held, since it may have been updated in the meantime
+	currentHash, exists, err := readRefValue(derefName, repoDir)
+	if err != nil {
+		refLock.rollback()
+		return nil, "", "", err
 	}
 
-	return UpdateBranchRef(branchName, commitHash, remote, repoDir)
+	if expectedOldHash == NULL_OBJECT_HASH && exists {
+		refLock.rollback()
+		return nil, "", "", fmt.Errorf("cannot lock ref '%s': reference already exists", derefName)
+	} else if expectedOldHash != "" && expectedOldHash != NULL_OBJECT_HASH && currentHash != expectedOldHash {
+		refLock.rollback()
+		if !exists {
+			return nil, "", "", fmt.Errorf("cannot lock ref '%s': unable to resolve reference", derefName)
+		}
+		return nil, "", "", fmt.Errorf("cannot lock ref '%s': is at %s but expected %s", derefName, currentHash, expectedOldHash)
+	}
+
+	return refLock, derefName, currentHash, nil
 }
 
-func UpdateBranchRef(branchName string, commitHash string, remote bool, repoDir string) error {
-	var branchRefPath string
-	if remote {
-		branchRefPath = filepath.Join(repoDir, ".git", "refs", "remotes", "origin", branchName)
-	} else {
-		branchRefPath = filepath.Join(repoDir, ".git", "refs", "heads", branchName)
+// Returns the names of all local branches (or the given remote's remote-tracking branches), in sorted order
+func ListBranches(remoteName string, repoDir string) ([]string, error) {
+	refPrefix := getBranchRefPrefix(remoteName)
+	refsDir := filepath.Join(getCommonDir(repoDir), filepath.FromSlash(refPrefix))
+
+	packedRefs, err := readPackedRefs(repoDir)
+	if err != nil {
+		return nil, err
 	}
 
-	branchRefDir := filepath.Dir(branchRefPath)
-	if err := os.MkdirAll(branchRefDir, 0755); err != nil {
-		return fmt.Errorf("failed to create ref directory structure for branch %s: %s", branchName, err)
+	branchNamesSet := make(map[string]bool)
+	for refName := range packedRefs {
+		if strings.HasPrefix(refName, refPrefix) {
+			branchNamesSet[strings.TrimPrefix(refName, refPrefix)] = true
+		}
 	}
 
-	if err := os.WriteFile(branchRefPath, []byte(commitHash), 0644); err != nil {
-		return fmt.Errorf("failed to write to branch reference file %s: %s", branchRefPath, err)
+	err = filepath.WalkDir(refsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() || strings.HasSuffix(path, LOCK_FILE_SUFFIX) {
+			return nil
+		}
+
+		branchName, err := filepath.Rel(refsDir, path)
+		if err != nil {
+			return err
+		}
+
+		// The remote HEAD is a symbolic ref rather than a branch
+		if remoteName != "" && branchName == "HEAD" {
+			return nil
+		}
+
+		branchNamesSet[filepath.ToSlash(branchName)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list branches in %s: %s", refsDir, err)
 	}
 
-	return nil
+	branchNames := make([]string, 0, len(branchNamesSet))
+	for branchName := range branchNamesSet {
+		branchNames = append(branchNames, branchName)
+	}
+	sort.Strings(branchNames)
+	return branchNames, nil
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// The name given to the remote repository that a repository was cloned from, which is also assumed for any remote
+// repository URL that isn't configured as a remote
+const DEFAULT_REMOTE_NAME = "origin"
+
+// Returns the name of the remote configured with the given URL (via its remote.<name>.url config variable), or
+// DEFAULT_REMOTE_NAME if there's no such remote
+func getRemoteNameForURL(repoURL string, repoDir string) (string, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read repository config: %s", err)
+	}
+
+	for _, entry := range config.entries {
+		if entry.section == "remote" && entry.key == "url" && normalizeRemoteURL(entry.value) == normalizeRemoteURL(repoURL) {
+			return entry.subsection, nil
+		}
+	}
+
+	return DEFAULT_REMOTE_NAME, nil
+}
+
+// Resolves the repository given to pull or push, which may be a remote repository URL, the name of a configured
+// remote, or empty to use the remote of the current branch's upstream (falling back to DEFAULT_REMOTE_NAME). Returns
+// the URL of the remote repository.
+func resolveRemoteURL(remoteOrURL string, repoDir string) (string, error) {
+	remoteName := remoteOrURL
+	if remoteName == "" {
+		remoteName = DEFAULT_REMOTE_NAME
+		if branchName, err := getCurrentBranch(repoDir); err == nil {
+			upstream, err := getBranchUpstream(branchName, repoDir)
+			if err != nil {
+				return "", err
+			}
+			if upstream != nil {
+				remoteName = upstream.remote
+			}
+		}
+	}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read repository config: %s", err)
+	}
+
+	if repoURL, isRemote := config.get(fmt.Sprintf("remote.%s.url", remoteName)); isRemote {
+		return repoURL, nil
+	}
+	if remoteOrURL == "" {
+		return "", fmt.Errorf("no remote repository specified, and the %s remote isn't configured", remoteName)
+	}
+
+	if err := validateRepoURL(remoteOrURL); err != nil {
+		return "", fmt.Errorf("%s is neither a configured remote nor a valid repository URL: %s", remoteOrURL, err)
+	}
+	return remoteOrURL, nil
+}
+
+func normalizeRemoteURL(repoURL string) string {
+	return strings.TrimSuffix(repoURL, "/")
+}
+
+// Configures a remote with the given name and URL, whose branches are fetched into remote-tracking branches under
+// refs/remotes/<name>/ (recorded in Git's refspec format, so that real Git fetches them the same way). If trackedRef
+// (a full ref name) is set, only that ref is fetched: a branch into its remote-tracking branch, or a tag into the tag
+// of the same name.
+func addRemote(remoteName string, repoURL string, trackedRef string, repoDir string) error {
+	if err := validateRefName(getHeadRefName(remoteName)); err != nil || strings.Contains(remoteName, "/") {
+		return fmt.Errorf("invalid remote name: %s", remoteName)
+	}
+
+	configPath := getRepoConfigPath(repoDir)
+	if err := setConfigValue(configPath, fmt.Sprintf("remote.%s.url", remoteName), repoURL); err != nil {
+		return fmt.Errorf("failed to write remote URL to config: %s", err)
+	}
+
+	fetchRefspec := fmt.Sprintf("+refs/heads/*:%s*", getBranchRefPrefix(remoteName))
+	if branchName, isBranch := strings.CutPrefix(trackedRef, "refs/heads/"); isBranch {
+		fetchRefspec = fmt.Sprintf("+%s:%s", trackedRef, getBranchRefName(branchName, remoteName))
+	} else if trackedRef != "" {
+		fetchRefspec = fmt.Sprintf("+%s:%s", trackedRef, trackedRef)
+	}
+	if err := setConfigValue(configPath, fmt.Sprintf("remote.%s.fetch", remoteName), fetchRefspec); err != nil {
+		return fmt.Errorf("failed to write remote refspec to config: %s", err)
+	}
+
+	return nil
+}
+
+// Represents how a branch of a remote repository relates to the remote-tracking branches fetched from it
+type RemoteBranchState int
+
+const (
+	RemoteBranchTracked    RemoteBranchState = iota // on the remote, and fetched into a remote-tracking branch
+	RemoteBranchNew                                 // on the remote, but not fetched yet
+	RemoteBranchStale                               // fetched into a remote-tracking branch, but no longer on the remote
+	RemoteBranchNotQueried                          // fetched into a remote-tracking branch, but the remote wasn't contacted
+)
+
+// Describes the state as listed by `remote show`, or returns "" if the remote wasn't contacted
+func (s RemoteBranchState) describe(remoteName string) string {
+	switch s {
+	case RemoteBranchTracked:
+		return "tracked"
+	case RemoteBranchNew:
+		return fmt.Sprintf("new (next fetch will store in remotes/%s)", remoteName)
+	case RemoteBranchStale:
+		return "stale (use 'git remote prune' to remove)"
+	default:
+		return ""
+	}
+}
+
+// Represents a branch of a remote repository, or a remote-tracking branch fetched from one
+type RemoteBranch struct {
+	name  string
+	state RemoteBranchState
+}
+
+// Represents a local branch which is pulled from and pushed to a branch of a remote repository
+type RemoteLocalBranch struct {
+	name         string
+	remoteBranch string
+	pullsFrom    bool   // Whether the remote branch is the local branch's upstream, which pull merges from
+	pushStatus   string // How pushing would update the remote branch (e.g. "up to date"), empty if not queried
+}
+
+// Represents everything known about a remote: its configuration, the state of its branches, and how local branches
+// are pulled from and pushed to them, as reported by `remote show`
+type RemoteDetails struct {
+	name          string
+	url           string
+	headBranch    string // Empty if the remote HEAD is unknown, i.e. detached or not queried
+	queried       bool   // Whether the remote repository was contacted, rather than only the local refs being read
+	pullRebase    bool   // Whether pull rebases local branches onto their upstream, rather than merging it
+	branches      []*RemoteBranch
+	localBranches []*RemoteLocalBranch
+}
+
+// Returns the names of the configured remotes, in the order in which they're configured
+func getRemoteNames(repoDir string) ([]string, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository config: %s", err)
+	}
+
+	remoteNames := []string{}
+	seen := make(map[string]bool)
+	for _, entry := range config.entries {
+		if entry.section == "remote" && entry.key == "url" && !seen[entry.subsection] {
+			seen[entry.subsection] = true
+			remoteNames = append(remoteNames, entry.subsection)
+		}
+	}
+	return remoteNames, nil
+}
+
+// Gathers the details of the given remote. Unless query is false, the remote repository is contacted to find its
+// HEAD and branches, which are compared against the local remote-tracking branches and local branches; otherwise,
+// only the local remote-tracking branches are read.
+func getRemoteDetails(remoteName string, query bool, repoDir string) (*RemoteDetails, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository config: %s", err)
+	}
+	repoURL, isRemote := config.get(fmt.Sprintf("remote.%s.url", remoteName))
+	if !isRemote {
+		return nil, fmt.Errorf("No such remote: '%s'", remoteName)
+	}
+	pullRebase, err := config.getBool("pull.rebase", false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pull.rebase config: %s", err)
+	}
+
+	details := &RemoteDetails{name: remoteName, url: repoURL, queried: query, pullRebase: pullRebase}
+
+	trackingBranches, err := ListBranches(remoteName, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote-tracking branches: %s", err)
+	}
+	trackingBranches = slices.DeleteFunc(trackingBranches, func(branchName string) bool {
+		return branchName == "HEAD"
+	})
+
+	// The remote's branches, mapped to their hashes. If the remote isn't queried, the remote-tracking branches
+	// stand in for them.
+	remoteBranches := make(map[string]string)
+	if query {
+		remoteRefs, err := discoverRefs(repoURL, "git-upload-pack")
+		if err != nil {
+			return nil, err
+		}
+		remoteBranches = remoteRefs.branches()
+		details.headBranch, _ = remoteRefs.headBranch()
+	} else {
+		for _, branchName := range trackingBranches {
+			remoteBranches[branchName] = ""
+		}
+	}
+
+	details.branches = getRemoteBranchStates(remoteBranches, trackingBranches, query)
+
+	localBranches, err := ListBranches("", repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local branches: %s", err)
+	}
+	for _, branchName := range localBranches {
+		upstream, err := getBranchUpstream(branchName, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		pullsFrom := upstream != nil && upstream.remote == remoteName
+
+		// Branches without an upstream on this remote are pushed to the remote branch of the same name, so they're
+		// only listed if that branch exists
+		remoteBranchName, err := getUpstreamBranchName(branchName, remoteName, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		remoteHash, onRemote := remoteBranches[remoteBranchName]
+		if !pullsFrom && !onRemote {
+			continue
+		}
+
+		localBranch := &RemoteLocalBranch{name: branchName, remoteBranch: remoteBranchName, pullsFrom: pullsFrom}
+		if query {
+			localBranch.pushStatus, err = getRemotePushStatus(branchName, remoteHash, onRemote, repoDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		details.localBranches = append(details.localBranches, localBranch)
+	}
+
+	return details, nil
+}
+
+// Compares the remote's branches against the remote-tracking branches fetched from it, returning every branch in
+// either, sorted by name
+func getRemoteBranchStates(remoteBranches map[string]string, trackingBranches []string, queried bool) []*RemoteBranch {
+	states := make(map[string]RemoteBranchState)
+	for branchName := range remoteBranches {
+		states[branchName] = RemoteBranchNew
+	}
+	for _, branchName := range trackingBranches {
+		switch _, onRemote := remoteBranches[branchName]; {
+		case !queried:
+			states[branchName] = RemoteBranchNotQueried
+		case onRemote:
+			states[branchName] = RemoteBranchTracked
+		default:
+			states[branchName] = RemoteBranchStale
+		}
+	}
+
+	branches := make([]*RemoteBranch, 0, len(states))
+	for branchName, state := range states {
+		branches = append(branches, &RemoteBranch{name: branchName, state: state})
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].name < branches[j].name
+	})
+	return branches
+}
+
+// Describes how pushing the local branch would update the remote branch, which is at remoteHash if it exists. As in
+// Git, a remote branch whose tip isn't in the local repository is assumed to have commits that the local branch
+// lacks, since they would have been fetched otherwise.
+func getRemotePushStatus(branchName string, remoteHash string, onRemote bool, repoDir string) (string, error) {
+	localHash, _, err := ResolveBranchRef(branchName, "", repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve branch %s: %s", branchName, err)
+	}
+
+	if !onRemote {
+		return "create", nil
+	}
+	if remoteHash == localHash {
+		return "up to date", nil
+	}
+	if !objectExists(remoteHash, repoDir) {
+		return "local out of date", nil
+	}
+
+	isFastForward, err := isAncestorCommit(remoteHash, localHash, repoDir)
+	if err != nil {
+		return "", err
+	}
+	if isFastForward {
+		return "fast-forwardable", nil
+	}
+	return "local out of date", nil
+}
@@ -9,10 +9,14 @@ import (
 	"strings"
 )
 
-// Supports two Git URL formats:
+// Supports two Git URL formats, along with the path of a bundle file (see Bundle), which stands in for a repository:
 // (1) git://<host>[:<port>]/<path-to-git-repo>
-// (2) http[s]://<host>[:<port>]/<path-to-git-repo>
+// (2) http[s]://[<user>[:<password>]@]<host>[:<port>]/<path-to-git-repo>
 func validateRepoURL(repoURL string) error {
+	if isBundleFile(repoURL) {
+		return nil
+	}
+
 	parts := strings.Split(repoURL, "//")
 	if len(parts) != 2 || (parts[0] != "git:" && parts[0] != "http:" && parts[0] != "https:") {
 		return fmt.Errorf("git URL must use git or http/https format")
@@ -23,7 +27,12 @@ func validateRepoURL(repoURL string) error {
 		return fmt.Errorf("repo URL not well-formatted")
 	}
 
-	hostParts := strings.Split(parts[0], ":")
+	// Any username (and password) given in the URL are used to authenticate to the host (see getCredential)
+	hostPort := parts[0]
+	if at := strings.LastIndex(hostPort, "@"); at >= 0 {
+		hostPort = hostPort[at+1:]
+	}
+	hostParts := strings.Split(hostPort, ":")
 	if len(hostParts) != 1 && len(hostParts) != 2 {
 		return fmt.Errorf("repo host/port not well-formatted")
 	}
@@ -37,24 +46,63 @@ func validateRepoURL(repoURL string) error {
 	return nil
 }
 
-func initRepo(repoDir string) (string, error) {
-	for _, dir := range []string{".git", ".git/objects", ".git/refs", ".git/refs/heads", ".git/refs/remotes", ".git/refs/remotes/origin"} {
-		if err := os.MkdirAll(filepath.Join(repoDir, dir), 0755); err != nil {
+// Represents the options controlling how a new repository is laid out
+type InitOptions struct {
+	initialBranch string // The branch HEAD starts on, instead of init.defaultBranch or master
+	bare          bool   // Whether to lay out a bare repository, with no working tree and no .git subdirectory
+}
+
+// Returns the directory which holds the Git metadata of a repository being initialized in repoDir. A bare
+// repository has its objects, refs, and so on directly in repoDir.
+func getInitGitDir(repoDir string, bare bool) string {
+	if bare {
+		return repoDir
+	}
+	return filepath.Join(repoDir, ".git")
+}
+
+// Initializes a repository in repoDir, returning the absolute path of its Git directory. Running it on an existing
+// repository is safe: anything missing is created, but HEAD and the config file are left as they are.
+func initRepo(repoDir string, options InitOptions) (string, error) {
+	gitDir := getInitGitDir(repoDir, options.bare)
+	for _, dir := range []string{"", "objects", "refs", "refs/heads", "refs/remotes"} {
+		if err := os.MkdirAll(filepath.Join(gitDir, dir), 0755); err != nil {
 			return "", fmt.Errorf("error creating directory: %s", err)
 		}
 	}
 
-	headFileContentsLocal := []byte("ref: refs/heads/master\n")
-	if err := os.WriteFile(filepath.Join(repoDir, ".git", "HEAD"), headFileContentsLocal, 0644); err != nil {
-		return "", fmt.Errorf("error writing local HEAD file: %s", err)
+	configPath := filepath.Join(gitDir, "config")
+	if !fileExists(configPath) {
+		coreConfig := [][]string{{"core.repositoryformatversion", "0"}, {"core.filemode", "true"}, {"core.bare", strconv.FormatBool(options.bare)}}
+		if !options.bare {
+			coreConfig = append(coreConfig, []string{"core.logallrefupdates", "true"})
+		}
+		for _, variable := range coreConfig {
+			if err := setConfigValue(configPath, variable[0], variable[1]); err != nil {
+				return "", fmt.Errorf("error writing config file: %s", err)
+			}
+		}
 	}
 
-	headFileContentsRemote := []byte("ref: refs/remotes/origin/master\n")
-	if err := os.WriteFile(filepath.Join(repoDir, ".git", "refs", "remotes", "origin", "HEAD"), headFileContentsRemote, 0644); err != nil {
-		return "", fmt.Errorf("error writing remote HEAD file: %s", err)
+	// The remote HEAD isn't created until a remote's default branch is known, e.g. when cloning
+	headPath := filepath.Join(gitDir, "HEAD")
+	if !fileExists(headPath) {
+		initialBranch := options.initialBranch
+		if initialBranch == "" {
+			var err error
+			initialBranch, err = getInitialBranchName(repoDir)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		headFileContentsLocal := []byte("ref: refs/heads/" + initialBranch + "\n")
+		if err := os.WriteFile(headPath, headFileContentsLocal, 0644); err != nil {
+			return "", fmt.Errorf("error writing local HEAD file: %s", err)
+		}
 	}
 
-	absPath, err := filepath.Abs(filepath.Join(repoDir, ".git"))
+	absPath, err := filepath.Abs(gitDir)
 	if err != nil {
 		return "", fmt.Errorf("error getting absolute path of Git repository: %s", err)
 	}
@@ -62,8 +110,26 @@ func initRepo(repoDir string) (string, error) {
 	return absPath, nil
 }
 
+// Returns the name of the branch that a new repository starts on: the init.defaultBranch config variable, or master
+func getInitialBranchName(repoDir string) (string, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config: %s", err)
+	}
+
+	if defaultBranch, isSet := config.get("init.defaultBranch"); isSet {
+		if err := validateRefName(getBranchRefName(defaultBranch, "")); err != nil {
+			return "", fmt.Errorf("invalid init.defaultBranch: %s", err)
+		}
+		return defaultBranch, nil
+	}
+	return "master", nil
+}
+
+// Returns the branch which HEAD points to, or an error if HEAD is detached. Commands which also work on a detached HEAD
+// (e.g. commit and status) use getStatusBranch instead.
 func getCurrentBranch(repoDir string) (string, error) {
-	headPath := filepath.Join(repoDir, ".git", "HEAD")
+	headPath := filepath.Join(getGitDir(repoDir), "HEAD")
 	headData, err := os.ReadFile(headPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to read HEAD file: %s", err)
@@ -74,7 +140,7 @@ func getCurrentBranch(repoDir string) (string, error) {
 		return strings.TrimSpace(strings.TrimPrefix(headContent, "ref: refs/heads/")), nil
 	}
 
-	return "", fmt.Errorf("failed to get current branch: HEAD detached at %s", headContent[:7])
+	return "", fmt.Errorf("you are not currently on a branch (HEAD detached at %s)", abbreviateHash(strings.TrimSpace(headContent)))
 }
 
 func getWorkingTreeFilePaths(repoDir string) ([]string, error) {
@@ -90,7 +156,21 @@ func getWorkingTreeFilePaths(repoDir string) ([]string, error) {
 			return err
 		}
 
-		if relPath == "." || d.IsDir() || strings.HasPrefix(relPath, ".git") {
+		// Only .git itself is excluded, since files such as .gitmodules are part of the working tree
+		if relPath == ".git" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// A nested repository (e.g. a submodule) is listed as a single path rather than by its files
+		if relPath != "." && d.IsDir() && fileExists(filepath.Join(path, ".git")) {
+			workingTreeFiles = append(workingTreeFiles, relPath)
+			return filepath.SkipDir
+		}
+
+		if relPath == "." || d.IsDir() {
 			return nil
 		}
 
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The Git directories of repositories whose metadata isn't simply in the .git subdirectory of the repository
+// directory: bare repositories, repositories whose Git directory was given by GIT_DIR, and working trees whose .git
+// is a file pointing to the Git directory. Keyed by the cleaned repository directory.
+var separateGitDirs = make(map[string]string)
+
+// The common directories of linked worktrees' Git directories (see getCommonDir), keyed by the cleaned Git directory
+var commonDirs = make(map[string]string)
+
+// Returns the directory holding the repository's Git metadata (objects, refs, the index, and so on)
+func getGitDir(repoDir string) string {
+	if gitDir, isSeparate := separateGitDirs[filepath.Clean(repoDir)]; isSeparate {
+		return gitDir
+	}
+	return filepath.Join(repoDir, ".git")
+}
+
+// Returns the directory holding the parts of the repository's Git metadata which are shared by all of its working
+// trees: the objects, the refs (other than per-worktree refs, see isPerWorktreeRef), packed-refs, the config, and
+// hooks. This is the Git directory itself, except in a linked worktree (created by `git worktree add`), whose Git
+// directory keeps only its own HEAD, index, and in-progress operations, and names the main Git directory in its
+// commondir file.
+func getCommonDir(repoDir string) string {
+	gitDir := getGitDir(repoDir)
+	if commonDir, isLinked := commonDirs[filepath.Clean(gitDir)]; isLinked {
+		return commonDir
+	}
+	return gitDir
+}
+
+func isSeparateGitDir(dir string) bool {
+	for _, gitDir := range separateGitDirs {
+		if gitDir == filepath.Clean(dir) {
+			return true
+		}
+	}
+	for _, commonDir := range commonDirs {
+		if commonDir == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the commondir file of a linked worktree's Git directory, which gives the path of the main Git directory
+// (relative to the worktree's Git directory, unless it's absolute). Returns false if the Git directory isn't a linked
+// worktree's.
+func readCommonDir(gitDir string) (string, bool, error) {
+	data, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to read commondir file: %s", err)
+	}
+
+	commonDir := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(gitDir, commonDir)
+	}
+	return filepath.Clean(commonDir), true, nil
+}
+
+// Represents the repository that a command operates on, as found by discoverRepo
+type DiscoveredRepo struct {
+	repoDir     string // The top level of the working tree, or the Git directory itself if there's no working tree
+	gitDir      string
+	hasWorkTree bool
+}
+
+// Finds the repository containing startDir, as Git does. If the GIT_DIR environment variable is set, it's used as
+// the Git directory, with the working tree given by GIT_WORK_TREE (or else startDir, unless the repository is
+// bare). Otherwise, startDir and then each of its parent directories is checked for a .git directory (or a .git file
+// pointing to the Git directory), or for being a Git directory itself, such as a bare repository. Returns nil if no
+// repository is found. The repository's Git directory is registered so that getGitDir finds it.
+func discoverRepo(startDir string) (*DiscoveredRepo, error) {
+	startDir, err := filepath.Abs(startDir)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := findRepo(startDir)
+	if err != nil || repo == nil {
+		return nil, err
+	}
+
+	// As in Git, a repository given explicitly by GIT_DIR is trusted, while a discovered one must be owned by the user
+	if os.Getenv("GIT_DIR") == "" {
+		if err := checkSafeDirectory(repo); err != nil {
+			return nil, err
+		}
+	}
+
+	if repo.gitDir != filepath.Join(repo.repoDir, ".git") {
+		separateGitDirs[filepath.Clean(repo.repoDir)] = repo.gitDir
+	}
+	commonDir, isLinked, err := readCommonDir(repo.gitDir)
+	if err != nil {
+		return nil, err
+	}
+	if isLinked {
+		commonDirs[filepath.Clean(repo.gitDir)] = commonDir
+	}
+	return repo, nil
+}
+
+func findRepo(startDir string) (*DiscoveredRepo, error) {
+	if envGitDir := os.Getenv("GIT_DIR"); envGitDir != "" {
+		gitDir, err := filepath.Abs(envGitDir)
+		if err != nil {
+			return nil, err
+		}
+		if !isGitDir(gitDir) {
+			return nil, fmt.Errorf("not a Git repository: %s", envGitDir)
+		}
+
+		workTree := os.Getenv("GIT_WORK_TREE")
+		if workTree == "" {
+			if isBareGitDir(gitDir) {
+				return &DiscoveredRepo{repoDir: gitDir, gitDir: gitDir, hasWorkTree: false}, nil
+			}
+			workTree = startDir
+		}
+
+		workTree, err = filepath.Abs(workTree)
+		if err != nil {
+			return nil, err
+		}
+		return &DiscoveredRepo{repoDir: workTree, gitDir: gitDir, hasWorkTree: true}, nil
+	}
+
+	ceilingDirs := getCeilingDirectories()
+	for dir := startDir; ; dir = filepath.Dir(dir) {
+		dotGitPath := filepath.Join(dir, ".git")
+		info, err := os.Stat(dotGitPath)
+		if err == nil && info.IsDir() && isGitDir(dotGitPath) {
+			return &DiscoveredRepo{repoDir: dir, gitDir: dotGitPath, hasWorkTree: true}, nil
+		}
+		if err == nil && !info.IsDir() {
+			gitDir, err := readGitFile(dotGitPath)
+			if err != nil {
+				return nil, err
+			}
+			return &DiscoveredRepo{repoDir: dir, gitDir: gitDir, hasWorkTree: true}, nil
+		}
+
+		// A bare repository, or a directory within a working tree's .git directory, has no working tree
+		if isGitDir(dir) {
+			return &DiscoveredRepo{repoDir: dir, gitDir: dir, hasWorkTree: false}, nil
+		}
+
+		if filepath.Dir(dir) == dir || slices.Contains(ceilingDirs, filepath.Dir(dir)) {
+			return nil, nil
+		}
+	}
+}
+
+// Returns the directories listed in the GIT_CEILING_DIRECTORIES environment variable, which the search for a
+// repository doesn't ascend into (though a repository in the directory the search starts from is still found). As
+// in Git, the list is colon-separated, relative paths are ignored, and symbolic links in each path are resolved,
+// except in the paths after an empty entry.
+func getCeilingDirectories() []string {
+	ceilingDirs := []string{}
+	resolveSymlinks := true
+	for _, dir := range filepath.SplitList(os.Getenv("GIT_CEILING_DIRECTORIES")) {
+		if dir == "" {
+			resolveSymlinks = false
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+
+		if resolveSymlinks {
+			if resolvedDir, err := filepath.EvalSymlinks(dir); err == nil {
+				dir = resolvedDir
+			}
+		}
+		ceilingDirs = append(ceilingDirs, filepath.Clean(dir))
+	}
+	return ceilingDirs
+}
+
+// Refuses to operate on a repository owned by another user, which could otherwise run commands as the current user
+// through its config (e.g. core.fsmonitor or a textconv driver) or hooks, as Git does on shared machines. Both the
+// working tree and the Git directory must be owned by the current user (or, when running as root through sudo, the
+// user who ran sudo), unless the working tree (or the Git directory of a bare repository) is allow-listed by the
+// safe.directory config variable.
+func checkSafeDirectory(repo *DiscoveredRepo) error {
+	paths := []string{repo.gitDir}
+	if repo.hasWorkTree {
+		paths = []string{repo.repoDir, repo.gitDir}
+	}
+
+	isOwned := true
+	for _, path := range paths {
+		owned, err := isOwnedByCurrentUser(path)
+		if err != nil {
+			return err
+		}
+		isOwned = isOwned && owned
+	}
+	if isOwned {
+		return nil
+	}
+
+	isSafe, err := isSafeDirectory(filepath.Clean(repo.repoDir))
+	if err != nil || isSafe {
+		return err
+	}
+
+	return fmt.Errorf("detected dubious ownership in repository at '%s'\nTo add an exception for this directory, call:\n\n\tgit config --global --add safe.directory %s", filepath.Clean(repo.repoDir), filepath.Clean(repo.repoDir))
+}
+
+// Returns whether the file is owned by the current user. When running as root, a file owned by the user who ran sudo
+// (given by SUDO_UID) also counts, so that `sudo` can be used in the user's own repositories.
+func isOwnedByCurrentUser(path string) (bool, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %s", path, err)
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true, nil
+	}
+
+	uid := os.Geteuid()
+	if uid == 0 {
+		if sudoUID, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+			uid = sudoUID
+		}
+	}
+	return int(stat.Uid) == uid, nil
+}
+
+// Returns whether the directory is allow-listed by the safe.directory config variable, which may be set multiple
+// times and is only read from the system and global config files, so that a repository can't vouch for itself. Each
+// value is a path (with a leading ~/ expanded), a path ending in /* to allow every directory under it, or * to allow
+// every directory. An empty value clears the values set before it.
+func isSafeDirectory(dir string) (bool, error) {
+	config, err := readProtectedConfig()
+	if err != nil {
+		return false, fmt.Errorf("failed to read config: %s", err)
+	}
+
+	isSafe := false
+	for _, value := range config.getAll("safe.directory") {
+		if value == "" {
+			isSafe = false
+			continue
+		}
+		if value == "*" {
+			isSafe = true
+			continue
+		}
+
+		safeDir, err := expandConfigPath(value)
+		if err != nil {
+			return false, err
+		}
+		if prefix, isPrefix := strings.CutSuffix(safeDir, "/*"); isPrefix {
+			isSafe = isSafe || strings.HasPrefix(dir+"/", filepath.Clean(prefix)+"/")
+		} else {
+			isSafe = isSafe || filepath.Clean(safeDir) == dir
+		}
+	}
+	return isSafe, nil
+}
+
+// Returns whether the directory looks like a Git directory, i.e. has a HEAD file and objects and refs directories. A
+// linked worktree's Git directory has its own HEAD, but the objects and refs directories of its common directory.
+func isGitDir(dir string) bool {
+	commonDir, isLinked, err := readCommonDir(dir)
+	if err != nil {
+		return false
+	} else if !isLinked {
+		commonDir = dir
+	}
+
+	for _, name := range []string{"objects", "refs"} {
+		info, err := os.Stat(filepath.Join(commonDir, name))
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return fileExists(filepath.Join(dir, "HEAD"))
+}
+
+// Returns whether the Git directory belongs to a bare repository, i.e. has core.bare set in its config
+func isBareGitDir(gitDir string) bool {
+	config, err := readConfigFile(filepath.Join(gitDir, "config"), ConfigScopeLocal, gitDir, 0)
+	if err != nil {
+		return false
+	}
+	isBare, err := config.getBool("core.bare", false)
+	return err == nil && isBare
+}
+
+// Reads a .git file, which contains `gitdir: <path>` giving the location of the working tree's Git directory (as
+// used for submodules and linked worktrees). The path may be relative to the directory containing the file.
+func readGitFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %s", path, err)
+	}
+
+	gitDir, found := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+	if !found {
+		return "", fmt.Errorf("invalid gitfile format: %s", path)
+	}
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(path), gitDir)
+	}
+
+	if !isGitDir(gitDir) {
+		return "", fmt.Errorf("not a Git repository: %s", gitDir)
+	}
+
+	return filepath.Clean(gitDir), nil
+}
+
+// Converts a path given on the command line, which is relative to the current directory, into a path relative to
+// the top level of the working tree (as paths are stored in the index), like Git does for commands run from a
+// subdirectory
+func getRepoRelativePath(path string, repoDir string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	relPath, err := filepath.Rel(repoDir, absPath)
+	if err != nil {
+		return "", err
+	}
+	if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is outside repository at '%s'", path, filepath.Clean(repoDir))
+	}
+
+	return filepath.ToSlash(relPath), nil
+}
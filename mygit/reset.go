@@ -0,0 +1,29 @@
+package main
+
+import "fmt"
+
+// Resets the index and working tree to the given commit, and moves the current branch (or HEAD, if it's detached) to
+// it, as git reset --hard does. Any changes to tracked files, staged or not, are discarded, and files which are
+// tracked in the index but not in the commit are removed. Untracked files are left as they are. Files which are
+// unchanged keep their index entries, so they're neither rewritten nor rehashed. As in Git, the commit HEAD was at is
+// recorded as ORIG_HEAD, and any merge in progress is abandoned.
+func ResetHard(commitHash string, repoDir string) error {
+	headCommitHash, commitsExist, err := ResolveHead("", repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve HEAD: %s", err)
+	}
+
+	if err := CheckoutCommit(commitHash, true, repoDir); err != nil {
+		return err
+	}
+
+	if commitsExist {
+		if err := writeOrigHead(headCommitHash, repoDir); err != nil {
+			return err
+		}
+	}
+	if err := UpdateRef("HEAD", commitHash, "", repoDir); err != nil {
+		return err
+	}
+	return removeMergeState(repoDir)
+}
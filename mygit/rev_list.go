@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"slices"
+)
+
+// Represents an object reachable from the commits walked by rev-list, along with the path at which it was first
+// found: empty for commits and root trees, and the path of the file or directory within the tree for blobs and
+// subtrees
+type RevListObject struct {
+	hash    string
+	objType ObjectType
+	path    string
+}
+
+// Lists the commits reachable from the given commits but not from the excluded ones (given with --not or ^), as git
+// rev-list does: the most recently committed first. With objects set, the trees and blobs reachable from those commits
+// are listed too, after the commits and with their paths, leaving out those which the excluded commits already have.
+// This is the set of objects one repository must send to another which has the excluded commits, e.g. in a push.
+func RevList(startHashes []string, excludedHashes []string, objects bool, output io.Writer, repoDir string) error {
+	revListObjects, err := listObjects(startHashes, excludedHashes, objects, repoDir)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range revListObjects {
+		var err error
+		if obj.objType == Commit {
+			_, err = fmt.Fprintln(output, obj.hash)
+		} else {
+			_, err = fmt.Fprintf(output, "%s %s\n", obj.hash, obj.path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the commits reachable from the given commits but not from the excluded commits, in the order they're walked,
+// followed by (if objects is set) the trees and blobs reachable from them. Each tree is listed before the objects
+// within it, in the order of its entries. As in Git, an object is left out if it's reachable from the tree of an
+// excluded commit at the boundary of the walk, i.e. one of the excluded commits given or a parent of a walked commit,
+// rather than from any excluded commit, so that the whole excluded history doesn't need to be read. Submodule commits
+// (gitlinks) are never listed, since they're in another repository. Excluded commits which aren't present locally
+// (e.g. a remote's branch which hasn't been fetched) are ignored.
+func listObjects(startHashes []string, excludedHashes []string, objects bool, repoDir string) ([]*RevListObject, error) {
+	excluded := make(map[string]bool)
+	for _, commitHash := range excludedHashes {
+		reachable, err := getReachableCommits(commitHash, false, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		for reachableHash := range reachable {
+			excluded[reachableHash] = true
+		}
+	}
+
+	walker, err := newCommitWalker(startHashes, excluded, false, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	revListObjects := []*RevListObject{}
+	commits := []*CommitObject{}
+	boundaryHashes := slices.Clone(excludedHashes)
+	for {
+		commitObj, err := walker.next()
+		if err != nil {
+			return nil, err
+		}
+		if commitObj == nil {
+			break
+		}
+		commits = append(commits, commitObj)
+		revListObjects = append(revListObjects, &RevListObject{hash: commitObj.hash, objType: Commit})
+
+		for _, parentHash := range commitObj.parentCommitHashes {
+			if excluded[parentHash] {
+				boundaryHashes = append(boundaryHashes, parentHash)
+			}
+		}
+	}
+	if !objects {
+		return revListObjects, nil
+	}
+
+	// The objects of the excluded commits at the boundary are marked as seen, so that they're left out
+	seen := make(map[string]bool)
+	for _, commitHash := range boundaryHashes {
+		if !objectExists(commitHash, repoDir) {
+			continue
+		}
+		commitObj, err := ReadCommitObjectFile(commitHash, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := collectTreeObjects(commitObj.treeHash, seen, repoDir); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, commitObj := range commits {
+		treeObjects, err := listTreeObjects(commitObj.treeHash, "", seen, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		revListObjects = append(revListObjects, treeObjects...)
+	}
+	return revListObjects, nil
+}
+
+// Returns the objects in the tree (including the tree itself, at the given path) which haven't been seen yet, marking
+// them as seen, as collectTreeObjects does, but along with their paths
+func listTreeObjects(treeHash string, treePath string, seen map[string]bool, repoDir string) ([]*RevListObject, error) {
+	if seen[treeHash] {
+		return []*RevListObject{}, nil
+	}
+	seen[treeHash] = true
+
+	treeObj, err := ReadTreeObjectFile(treeHash, repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree object file: %s", err)
+	}
+
+	treeObjects := []*RevListObject{{hash: treeHash, objType: Tree, path: treePath}}
+	for _, entry := range treeObj.entries {
+		entryPath := path.Join(treePath, entry.name)
+		switch entry.objType {
+		case Blob:
+			if !seen[entry.hash] {
+				seen[entry.hash] = true
+				treeObjects = append(treeObjects, &RevListObject{hash: entry.hash, objType: Blob, path: entryPath})
+			}
+		case Tree:
+			subTreeObjects, err := listTreeObjects(entry.hash, entryPath, seen, repoDir)
+			if err != nil {
+				return nil, err
+			}
+			treeObjects = append(treeObjects, subTreeObjects...)
+		}
+	}
+	return treeObjects, nil
+}
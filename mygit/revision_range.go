@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// Represents a revision given to log or shortlog as the commits it names, whose history is either included in the walk
+// or excluded from it:
+//
+//   - A includes the history of A.
+//   - ^A excludes the history of A.
+//   - A..B includes the history of B, excluding that of A, i.e. the commits made on B since it diverged from A.
+//   - A...B includes the histories of both A and B, excluding the history they have in common (symmetric).
+type RevisionRange struct {
+	included  []string
+	excluded  []string
+	symmetric bool
+}
+
+// Resolves a revision or range (see RevisionRange) to the commits it names. As in Git, either side of A..B or A...B may
+// be omitted, defaulting to HEAD.
+func resolveRevisionRange(revision string, repoDir string) (*RevisionRange, error) {
+	if strings.HasPrefix(revision, "^") {
+		commitHash, err := resolveCommitish(revision[1:], repoDir)
+		if err != nil {
+			return nil, err
+		}
+		return &RevisionRange{included: []string{}, excluded: []string{commitHash}}, nil
+	}
+
+	left, right, symmetric := strings.Cut(revision, "...")
+	if !symmetric {
+		var isRange bool
+		left, right, isRange = strings.Cut(revision, "..")
+		if !isRange {
+			commitHash, err := resolveCommitish(revision, repoDir)
+			if err != nil {
+				return nil, err
+			}
+			return &RevisionRange{included: []string{commitHash}, excluded: []string{}}, nil
+		}
+	}
+
+	sideHashes := make([]string, 2)
+	for i, side := range []string{left, right} {
+		if side == "" {
+			side = "HEAD"
+		}
+		commitHash, err := resolveCommitish(side, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		sideHashes[i] = commitHash
+	}
+
+	if symmetric {
+		return &RevisionRange{included: sideHashes, excluded: []string{}, symmetric: true}, nil
+	}
+	return &RevisionRange{included: sideHashes[1:], excluded: sideHashes[:1]}, nil
+}
+
+// Resolves the revisions and ranges given to log or shortlog (see RevisionRange) to the commits from which to walk the
+// history and the set of commits to exclude from the walk. The excluded history is read in full up front, so that the
+// walk can pass over it without reading it again.
+func resolveRevisionRanges(revisions []string, repoDir string) ([]string, map[string]bool, error) {
+	startHashes := []string{}
+	excluded := make(map[string]bool)
+	for _, revision := range revisions {
+		revisionRange, err := resolveRevisionRange(revision, repoDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		startHashes = append(startHashes, revisionRange.included...)
+
+		for _, commitHash := range revisionRange.excluded {
+			reachable, err := getReachableCommits(commitHash, false, repoDir)
+			if err != nil {
+				return nil, nil, err
+			}
+			for reachableHash := range reachable {
+				excluded[reachableHash] = true
+			}
+		}
+
+		if revisionRange.symmetric {
+			leftReachable, err := getReachableCommits(revisionRange.included[0], false, repoDir)
+			if err != nil {
+				return nil, nil, err
+			}
+			rightReachable, err := getReachableCommits(revisionRange.included[1], false, repoDir)
+			if err != nil {
+				return nil, nil, err
+			}
+			for commitHash := range leftReachable {
+				if rightReachable[commitHash] {
+					excluded[commitHash] = true
+				}
+			}
+		}
+	}
+
+	return startHashes, excluded, nil
+}
+
+// Splits the arguments given to log into revisions (or ranges) and paths, as Git does: the arguments after -- are
+// paths, and before it, the first argument which isn't a revision is taken as the first of the paths, as long as it
+// names a file or directory in the working tree. As in Git, paths are relative to the current directory, and are
+// returned relative to the top level of the working tree.
+func splitRevisionsAndPaths(args []string, repoDir string) ([]string, []string, error) {
+	revisions := args
+	var paths []string
+	for i, arg := range args {
+		if arg == "--" {
+			revisions, paths = args[:i], args[i+1:]
+			break
+		}
+		if _, err := resolveRevisionRange(arg, repoDir); err != nil {
+			if _, statErr := os.Lstat(arg); statErr != nil {
+				return nil, nil, err
+			}
+			revisions, paths = args[:i], args[i:]
+			break
+		}
+	}
+
+	repoPaths := []string{}
+	for _, path := range paths {
+		if path == "--" {
+			continue
+		}
+		repoPath, err := getRepoRelativePath(path, repoDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		repoPaths = append(repoPaths, repoPath)
+	}
+	return revisions, repoPaths, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+)
+
+type ShortlogOptions struct {
+	summary  bool // Whether to show only the number of commits by each author, rather than their subjects (-s)
+	numbered bool // Whether to sort the authors by their numbers of commits, rather than by name (-n)
+	email    bool // Whether to show each author's email address along with their name (-e)
+}
+
+// Represents an author's commits as summarized by shortlog
+type ShortlogAuthor struct {
+	name     string   // The author's name, along with their email address with -e
+	subjects []string // The subjects of the author's commits, oldest first
+}
+
+// Writes a summary of the history reachable from the given commits, other than the excluded commits, to the output, grouped by author, as git shortlog
+// does: each author's name and number of commits, followed by the subjects of their commits, oldest first, indented
+// by six spaces. Authors are sorted by name, or with numbered, by their numbers of commits (most first). With summary,
+// only the number of commits by each author is shown, e.g. to rank contributors.
+func Shortlog(startHashes []string, excluded map[string]bool, options ShortlogOptions, output io.Writer, repoDir string) error {
+	walker, err := newCommitWalker(startHashes, excluded, false, repoDir)
+	if err != nil {
+		return err
+	}
+
+	authors := make(map[string]*ShortlogAuthor)
+	for {
+		commitObj, err := walker.next()
+		if err != nil {
+			return err
+		}
+		if commitObj == nil {
+			break
+		}
+
+		name := commitObj.author.name
+		if options.email {
+			name = fmt.Sprintf("%s <%s>", commitObj.author.name, commitObj.author.email)
+		}
+		if authors[name] == nil {
+			authors[name] = &ShortlogAuthor{name: name, subjects: []string{}}
+		}
+		authors[name].subjects = append(authors[name].subjects, getCommitOnelineSubject(commitObj))
+	}
+
+	sortedAuthors := []*ShortlogAuthor{}
+	for _, author := range authors {
+		// The walk yields the most recent commits first
+		slices.Reverse(author.subjects)
+		sortedAuthors = append(sortedAuthors, author)
+	}
+	sort.Slice(sortedAuthors, func(i int, j int) bool {
+		a, b := sortedAuthors[i], sortedAuthors[j]
+		if options.numbered && len(a.subjects) != len(b.subjects) {
+			return len(a.subjects) > len(b.subjects)
+		}
+		return a.name < b.name
+	})
+
+	for _, author := range sortedAuthors {
+		if options.summary {
+			if _, err := fmt.Fprintf(output, "%6d\t%s\n", len(author.subjects), author.name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fmt.Fprintf(output, "%s (%d):\n", author.name, len(author.subjects))
+		for _, subject := range author.subjects {
+			fmt.Fprintf(output, "      %s\n", subject)
+		}
+		if _, err := fmt.Fprintln(output); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// The formats of signatures which commits can be signed with, as given by the gpg.format config variable
+const (
+	SIGNATURE_FORMAT_OPENPGP = "openpgp"
+	SIGNATURE_FORMAT_SSH     = "ssh"
+)
+
+const DEFAULT_GPG_PROGRAM = "gpg"
+const DEFAULT_SSH_SIGNING_PROGRAM = "ssh-keygen"
+
+// The namespace that SSH signatures of commits are made in, as in Git, so that a signature made for another purpose
+// can't be passed off as a commit signature
+const SSH_SIGNATURE_NAMESPACE = "git"
+
+// The first line of an ASCII-armored SSH signature, which tells it apart from an OpenPGP signature
+const SSH_SIGNATURE_ARMOR = "-----BEGIN SSH SIGNATURE-----"
+
+const TEMP_FILE_KIND_SIGNING = "sign"
+
+// Signs the payload (the content of a commit object without its signature) with the user's key, returning the
+// ASCII-armored signature. The key is keyID if it's set, or else the user.signingKey config variable. For OpenPGP
+// signatures (made with gpg.program, or gpg), the key defaults to the committer's identity if neither is set. For
+// SSH signatures (made with gpg.ssh.program, or ssh-keygen), the key is the path of a private key, or of a public key
+// whose private key is held by ssh-agent, or a public key given literally (prefixed with key::).
+func signPayload(payload string, keyID string, committer CommitUser, repoDir string) (string, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config: %s", err)
+	}
+
+	if keyID == "" {
+		keyID, _ = config.get("user.signingKey")
+	}
+
+	format, isSet := config.get("gpg.format")
+	if !isSet {
+		format = SIGNATURE_FORMAT_OPENPGP
+	}
+
+	switch strings.ToLower(format) {
+	case SIGNATURE_FORMAT_OPENPGP:
+		program, isSet := config.get("gpg.program")
+		if !isSet {
+			program = DEFAULT_GPG_PROGRAM
+		}
+		if keyID == "" {
+			keyID = fmt.Sprintf("%s <%s>", committer.name, committer.email)
+		}
+		return signPayloadWithGPG(payload, program, keyID)
+	case SIGNATURE_FORMAT_SSH:
+		program, isSet := config.get("gpg.ssh.program")
+		if !isSet {
+			program = DEFAULT_SSH_SIGNING_PROGRAM
+		}
+		if keyID == "" {
+			return "", fmt.Errorf("user.signingKey needs to be set for SSH signing")
+		}
+		return signPayloadWithSSH(payload, program, keyID, repoDir)
+	default:
+		return "", fmt.Errorf("unsupported value for gpg.format: %s", format)
+	}
+}
+
+// Makes a detached, ASCII-armored OpenPGP signature of the payload with gpg, as Git does
+func signPayloadWithGPG(payload string, program string, keyID string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(program, "--status-fd=2", "-bsau", keyID)
+	cmd.Stdin = strings.NewReader(payload)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// gpg's status lines are written to standard error along with its messages, and are left out of any error
+	err := cmd.Run()
+	messages := []string{}
+	signatureCreated := false
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if status, isStatus := strings.CutPrefix(line, "[GNUPG:] "); isStatus {
+			signatureCreated = signatureCreated || strings.HasPrefix(status, "SIG_CREATED ")
+		} else {
+			messages = append(messages, line)
+		}
+	}
+	if err != nil || !signatureCreated {
+		return "", fmt.Errorf("gpg failed to sign the data: %s", getSigningFailure(err, strings.Join(messages, "\n")))
+	}
+	return stdout.String(), nil
+}
+
+// Makes an SSH signature of the payload with ssh-keygen -Y sign, which writes the signature to a file next to the
+// payload's file
+func signPayloadWithSSH(payload string, program string, key string, repoDir string) (string, error) {
+	gitDir := getGitDir(repoDir)
+
+	// A literal public key is written to a file, since ssh-keygen only accepts keys as files
+	if literalKey, isLiteral := strings.CutPrefix(key, "key::"); isLiteral || strings.HasPrefix(key, "ssh-") {
+		if !isLiteral {
+			literalKey = key
+		}
+
+		keyPath, err := writeSigningTempFile(literalKey+"\n", gitDir)
+		if err != nil {
+			return "", err
+		}
+		defer releaseTempFile(keyPath)
+		key = keyPath
+	} else {
+		var err error
+		if key, err = expandConfigPath(key); err != nil {
+			return "", err
+		}
+	}
+
+	payloadPath, err := writeSigningTempFile(payload, gitDir)
+	if err != nil {
+		return "", err
+	}
+	defer releaseTempFile(payloadPath)
+	signaturePath := payloadPath + ".sig"
+	defer os.Remove(signaturePath)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(program, "-Y", "sign", "-n", SSH_SIGNATURE_NAMESPACE, "-f", key, payloadPath)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("ssh-keygen failed to sign the data: %s", getSigningFailure(err, stderr.String()))
+	}
+
+	signature, err := os.ReadFile(signaturePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read SSH signature: %s", err)
+	}
+	return string(signature), nil
+}
+
+func writeSigningTempFile(content string, gitDir string) (string, error) {
+	tempFile, err := createTempFile(TEMP_FILE_KIND_SIGNING, gitDir)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tempFile.WriteString(content)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		releaseTempFile(tempFile.Name())
+		return "", fmt.Errorf("failed to write temporary file: %s", err)
+	}
+	return tempFile.Name(), nil
+}
+
+// Describes why a signing program failed, using its error output if it wrote any
+func getSigningFailure(err error, stderr string) string {
+	if stderr = strings.TrimSpace(stderr); stderr != "" {
+		return stderr
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Sprintf("exited with status %d", exitErr.ExitCode())
+	} else if err != nil {
+		return err.Error()
+	}
+	return "no signature was created"
+}
+
+// Verifies the commit's gpgsig signature, which was made over the commit object's content without it, returning the
+// verifying program's report on it (e.g. `gpg: Good signature from ...`), as shown by log --show-signature. A bad
+// signature is described by the report rather than an error. As in Git, an SSH signature is recognized by its armor,
+// whatever gpg.format is, and OpenPGP signatures are verified with gpg.program (or gpg) and SSH signatures with
+// gpg.ssh.program (or ssh-keygen), against the signers listed in gpg.ssh.allowedSignersFile. Returns an empty report
+// if the commit isn't signed.
+func verifyCommitSignature(commitObj *CommitObject, repoDir string) (string, error) {
+	if commitObj.signature == "" {
+		return "", nil
+	}
+
+	headers := slices.DeleteFunc(slices.Clone(commitObj.headers), func(header *ObjectHeader) bool {
+		return header.name == "gpgsig"
+	})
+	payload := formatObjectContent(headers, commitObj.commitMessage)
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config: %s", err)
+	}
+
+	if strings.HasPrefix(commitObj.signature, SSH_SIGNATURE_ARMOR) {
+		program, isSet := config.get("gpg.ssh.program")
+		if !isSet {
+			program = DEFAULT_SSH_SIGNING_PROGRAM
+		}
+		allowedSignersFile, isSet := config.get("gpg.ssh.allowedSignersFile")
+		if !isSet {
+			return "", fmt.Errorf("gpg.ssh.allowedSignersFile needs to be configured and exist for ssh signature verification")
+		}
+		if allowedSignersFile, err = expandConfigPath(allowedSignersFile); err != nil {
+			return "", err
+		}
+		return verifySignatureWithSSH(payload, commitObj.signature, program, allowedSignersFile, repoDir)
+	}
+
+	program, isSet := config.get("gpg.program")
+	if !isSet {
+		program = DEFAULT_GPG_PROGRAM
+	}
+	return verifySignatureWithGPG(payload, commitObj.signature, program, repoDir)
+}
+
+// Verifies a detached OpenPGP signature of the payload with gpg, returning the messages gpg writes about it to
+// standard error, as Git shows them
+func verifySignatureWithGPG(payload string, signature string, program string, repoDir string) (string, error) {
+	signaturePath, err := writeSigningTempFile(signature, getGitDir(repoDir))
+	if err != nil {
+		return "", err
+	}
+	defer releaseTempFile(signaturePath)
+
+	// gpg exits with a non-zero status for a bad signature, or one whose key is missing, which its messages explain
+	var stderr bytes.Buffer
+	cmd := exec.Command(program, "--keyid-format=long", "--status-fd=1", "--verify", signaturePath, "-")
+	cmd.Stdin = strings.NewReader(payload)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", fmt.Errorf("failed to run gpg: %s", err)
+	}
+	return stderr.String(), nil
+}
+
+// Verifies an SSH signature of the payload with ssh-keygen, as Git does: the signer is looked up among the allowed
+// signers by the signature's key with -Y find-principals, and the signature verified as theirs with -Y verify. A
+// signature by a key which isn't allowed is still checked with -Y check-novalidate, but reported as matching no
+// principal.
+func verifySignatureWithSSH(payload string, signature string, program string, allowedSignersFile string, repoDir string) (string, error) {
+	signaturePath, err := writeSigningTempFile(signature, getGitDir(repoDir))
+	if err != nil {
+		return "", err
+	}
+	defer releaseTempFile(signaturePath)
+
+	// Runs ssh-keygen on the payload, returning its output and whether it succeeded
+	runProgram := func(args ...string) (string, bool, error) {
+		var output bytes.Buffer
+		cmd := exec.Command(program, args...)
+		cmd.Stdin = strings.NewReader(payload)
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			return "", false, fmt.Errorf("failed to run ssh-keygen: %s", err)
+		}
+		return output.String(), err == nil, nil
+	}
+
+	principals, found, err := runProgram("-Y", "find-principals", "-f", allowedSignersFile, "-s", signaturePath)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		output, _, err := runProgram("-Y", "check-novalidate", "-n", SSH_SIGNATURE_NAMESPACE, "-s", signaturePath)
+		if err != nil {
+			return "", err
+		}
+		return output + "No principal matched.\n", nil
+	}
+
+	// The signature is good if it's verified as coming from any of the principals its key is allowed for
+	var output string
+	for _, principal := range strings.Split(strings.TrimSpace(principals), "\n") {
+		var verified bool
+		output, verified, err = runProgram("-Y", "verify", "-n", SSH_SIGNATURE_NAMESPACE, "-f", allowedSignersFile, "-I", principal, "-s", signaturePath)
+		if err != nil || verified {
+			return output, err
+		}
+	}
+	return output, nil
+}
+
+// Inserts the signature into the commit object's content as the gpgsig header, at the end of the header lines, with
+// each line after the first indented by a space as a continuation of the header
+func addCommitSignatureHeader(content string, signature string) string {
+	headerEnd := strings.Index(content, "\n\n")
+	if headerEnd == -1 {
+		headerEnd = len(content) - 1
+	}
+
+	signatureLines := strings.Split(strings.TrimSuffix(signature, "\n"), "\n")
+	header := "gpgsig " + strings.Join(signatureLines, "\n ") + "\n"
+	return content[:headerEnd+1] + header + content[headerEnd+1:]
+}
+
+// Appends a Signed-off-by trailer for the given user to the commit message, as `commit -s` does. The trailer is added
+// to the message's existing block of trailers, if its last paragraph is one, and is skipped if the last trailer is
+// already the same sign-off.
+func addSignoff(commitMessage string, user CommitUser) string {
+	signoff := fmt.Sprintf("Signed-off-by: %s <%s>", user.name, user.email)
+
+	message := strings.TrimRight(commitMessage, "\n")
+	paragraphs := strings.Split(message, "\n\n")
+	lastParagraph := paragraphs[len(paragraphs)-1]
+	lastParagraphLines := strings.Split(lastParagraph, "\n")
+
+	if lastParagraphLines[len(lastParagraphLines)-1] == signoff {
+		return message + "\n"
+	}
+	if len(paragraphs) > 1 && isTrailerBlock(lastParagraphLines) {
+		return message + "\n" + signoff + "\n"
+	}
+	return message + "\n\n" + signoff + "\n"
+}
+
+// Returns whether every line of the paragraph is a trailer such as `Co-authored-by: Jane Doe <jane@example.com>`
+func isTrailerBlock(lines []string) bool {
+	for _, line := range lines {
+		token, _, found := strings.Cut(line, ": ")
+		if !found || token == "" || strings.ContainsAny(token, " \t") {
+			return false
+		}
+	}
+	return true
+}
+
+// Removes the -S[<keyid>] and --gpg-sign[=<keyid>] flags from the arguments, returning the remaining arguments along
+// with whether either flag was given and the key given with it (empty if none was)
+func extractGPGSignArgs(args []string) ([]string, bool, string) {
+	remainingArgs := []string{}
+	sign, keyID := false, ""
+	for i, arg := range args {
+		if arg == "--" {
+			remainingArgs = append(remainingArgs, args[i:]...)
+			break
+		}
+
+		if key, isFlag := strings.CutPrefix(arg, "-S"); isFlag {
+			sign, keyID = true, key
+		} else if arg == "--gpg-sign" {
+			sign, keyID = true, ""
+		} else if key, isFlag := strings.CutPrefix(arg, "--gpg-sign="); isFlag {
+			sign, keyID = true, key
+		} else {
+			remainingArgs = append(remainingArgs, arg)
+		}
+	}
+	return remainingArgs, sign, keyID
+}
@@ -4,14 +4,17 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+// Reads a single pkt-line, without reading any further, so that what follows it (e.g. a packfile) can be read from the
+// same reader
 func readPktLine(reader io.Reader) (string, error) {
-	bufReader := bufio.NewReader(reader)
 	lengthHex := make([]byte, 4)
-	_, err := io.ReadFull(bufReader, lengthHex)
+	_, err := io.ReadFull(reader, lengthHex)
 	if err != nil {
 		return "", fmt.Errorf("failed to read pkt-line length: %s", err)
 	}
@@ -23,7 +26,7 @@ func readPktLine(reader io.Reader) (string, error) {
 
 	payloadLength := length - 4
 	pktLine := make([]byte, payloadLength)
-	n, err := io.ReadFull(bufReader, pktLine)
+	n, err := io.ReadFull(reader, pktLine)
 	if err != nil || int64(n) != payloadLength {
 		return "", fmt.Errorf("failed to read pkt-line payload: %s", err)
 	}
@@ -40,7 +43,10 @@ func readPktLines(reader io.Reader) ([]string, error) {
 	for {
 		lengthHex := make([]byte, 4)
 		_, err := io.ReadFull(bufReader, lengthHex)
-		if err != nil {
+		// A response such as receive-pack's status report ends with its only flush-pkt
+		if err == io.EOF && passedStart {
+			break
+		} else if err != nil {
 			return nil, fmt.Errorf("failed to read pkt-line length: %s", err)
 		}
 
@@ -88,3 +94,118 @@ func createPktLineStream(pktLines []string) string {
 	}
 	return sb.String()
 }
+
+// Represents the refs advertised by a remote repository during ref discovery, along with the capabilities of the
+// server
+type RemoteRefs struct {
+	refs         map[string]string // Full ref name (e.g. HEAD, refs/heads/main, or refs/tags/v1.0^{}) to object hash
+	capabilities []string
+	url          string // The URL of the repository which advertised the refs, after following any redirects
+}
+
+// Parses the ref advertisement lines sent by the server (after the `# service=...` line), each of which is an object
+// hash and a ref name separated by a space. The first line also carries the server's capabilities, separated from
+// the ref name by a NUL byte.
+func parseRefAdvertisement(refPktLines []string) (*RemoteRefs, error) {
+	remoteRefs := &RemoteRefs{refs: make(map[string]string), capabilities: []string{}}
+
+	for i, refPktLine := range refPktLines {
+		refLine, capabilitiesStr, hasCapabilities := strings.Cut(refPktLine, "\x00")
+		if hasCapabilities {
+			if i != 0 {
+				return nil, fmt.Errorf("unexpected capabilities on ref advertisement line %d", i+1)
+			}
+			remoteRefs.capabilities = strings.Fields(capabilitiesStr)
+		}
+
+		refHash, refName, found := strings.Cut(refLine, " ")
+		if !found || refName == "" {
+			return nil, fmt.Errorf("malformed ref advertisement line: %s", refLine)
+		}
+		if !isValidObjectHash(refHash) {
+			return nil, fmt.Errorf("ref %s in remote repository contained invalid SHA hash: %s", refName, refHash)
+		}
+
+		// A repository without any refs advertises its capabilities on a placeholder line
+		if refName == "capabilities^{}" && refHash == NULL_OBJECT_HASH {
+			continue
+		}
+
+		remoteRefs.refs[refName] = refHash
+	}
+
+	return remoteRefs, nil
+}
+
+func (r *RemoteRefs) get(refName string) (string, bool) {
+	refHash, exists := r.refs[refName]
+	return refHash, exists
+}
+
+// Returns a mapping from the name of each remote branch (without the refs/heads/ prefix) to its object hash
+func (r *RemoteRefs) branches() map[string]string {
+	branches := make(map[string]string)
+	for refName, refHash := range r.refs {
+		if branchName, isBranch := strings.CutPrefix(refName, "refs/heads/"); isBranch {
+			branches[branchName] = refHash
+		}
+	}
+	return branches
+}
+
+// Returns a mapping from the name of each remote tag (without the refs/tags/ prefix) to the object hash it points to,
+// which is the tag object for an annotated tag. The peeled values advertised for annotated tags (e.g. refs/tags/v1.0^{})
+// are left out.
+func (r *RemoteRefs) tags() map[string]string {
+	tags := make(map[string]string)
+	for refName, refHash := range r.refs {
+		if tagName, isTag := strings.CutPrefix(refName, "refs/tags/"); isTag && !strings.HasSuffix(tagName, "^{}") {
+			tags[tagName] = refHash
+		}
+	}
+	return tags
+}
+
+// Returns whether the server supports the given capability, which may be advertised with a value (e.g.
+// agent=git/2.43.0)
+func (r *RemoteRefs) hasCapability(name string) bool {
+	for _, capability := range r.capabilities {
+		if capability == name || strings.HasPrefix(capability, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the name of the branch which the remote HEAD points to. This is advertised by servers via the symref
+// capability (e.g. symref=HEAD:refs/heads/main), and otherwise guessed from the branches pointing to the same commit
+// as HEAD, preferring master. Returns false if HEAD is detached, or the remote repository is empty.
+func (r *RemoteRefs) headBranch() (string, bool) {
+	for _, capability := range r.capabilities {
+		if target, isHeadSymref := strings.CutPrefix(capability, "symref=HEAD:"); isHeadSymref {
+			branchName, isBranch := strings.CutPrefix(target, "refs/heads/")
+			return branchName, isBranch
+		}
+	}
+
+	headHash, exists := r.get("HEAD")
+	if !exists {
+		return "", false
+	}
+
+	candidates := []string{}
+	for branchName, branchHash := range r.branches() {
+		if branchHash == headHash {
+			candidates = append(candidates, branchName)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	if slices.Contains(candidates, "master") {
+		return "master", true
+	}
+	sort.Strings(candidates)
+	return candidates[0], true
+}
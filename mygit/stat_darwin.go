@@ -0,0 +1,8 @@
+package main
+
+import "syscall"
+
+// Returns the change time and modification time stored in the given file stat data
+func statTimes(stat *syscall.Stat_t) (syscall.Timespec, syscall.Timespec) {
+	return stat.Ctimespec, stat.Mtimespec
+}
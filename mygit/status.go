@@ -3,7 +3,11 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 type RepositoryFileState int
@@ -18,30 +22,118 @@ const (
 	Unmodified                                   // same in working tree, index, and HEAD. working tree: f, index: f, HEAD: f
 )
 
+// Describes a change to a file, as listed by status (e.g. "modified:"). Unchanged and untracked files have no
+// description.
+func (s RepositoryFileState) describe() string {
+	switch s {
+	case ModifiedNotStaged, ModifiedStaged:
+		return "modified:"
+	case DeletedNotStaged, DeletedStaged:
+		return "deleted:"
+	case AddedStaged:
+		return "new file:"
+	default:
+		return ""
+	}
+}
+
 // Represents the status of an individual file in the repository
 type RepositoryFileStatus struct {
+	path             string
+	status           RepositoryFileState
+	submoduleChanges SubmoduleChanges // How a modified submodule differs from its index entry, if the file is one
+	oldMode, newMode FileMode         // A modified file's modes on either side, which differ if its mode changed (e.g. chmod +x)
+}
+
+// Describes a change to the file's mode, as Git's diff summary does (e.g. "mode change 100644 => 100755"), or
+// returns an empty string if its mode is unchanged
+func (fs *RepositoryFileStatus) describeModeChange() string {
+	if fs.oldMode == fs.newMode {
+		return ""
+	}
+	return fmt.Sprintf("mode change %s => %s", fs.oldMode.toPaddedString(), fs.newMode.toPaddedString())
+}
+
+// Represents a file with merge conflicts, which has an entry in the index for each side of the conflict
+type UnmergedFileStatus struct {
 	path   string
-	status RepositoryFileState
+	stages int // Bitmask of the index stages present: 1 (the common ancestor), 2 (ours), and 4 (theirs)
+}
+
+// Describes how the file conflicts, as shown by status
+func (u *UnmergedFileStatus) describe() string {
+	switch u.stages {
+	case 1:
+		return "both deleted:"
+	case 2:
+		return "added by us:"
+	case 3:
+		return "deleted by them:"
+	case 4:
+		return "added by them:"
+	case 5:
+		return "deleted by us:"
+	case 6:
+		return "both added:"
+	default:
+		return "both modified:"
+	}
+}
+
+// Returns the two-letter code for how the file conflicts, as shown by the short and porcelain formats
+func (u *UnmergedFileStatus) shortStatus() string {
+	switch u.stages {
+	case 1:
+		return "DD"
+	case 2:
+		return "AU"
+	case 3:
+		return "UD"
+	case 4:
+		return "UA"
+	case 5:
+		return "DU"
+	case 6:
+		return "AA"
+	default:
+		return "UU"
+	}
 }
 
 // Represents the status of the entire repository
 type RepositoryStatus struct {
-	branch          string
+	branch          string // Empty if HEAD is detached
 	localHead       string
-	remoteHead      string
+	upstream        *BranchUpstream // nil if the branch has no upstream (see getStatusUpstream)
+	upstreamHead    string          // Empty if the upstream's remote-tracking ref doesn't exist
+	ahead           int             // The number of commits in the local branch but not its upstream
+	behind          int             // The number of commits in the upstream but not the local branch
 	stagedFiles     []*RepositoryFileStatus
 	notStagedFiles  []*RepositoryFileStatus
 	untrackedFiles  []*RepositoryFileStatus
 	unmodifiedFiles []*RepositoryFileStatus
+	unmergedFiles   []*UnmergedFileStatus
+	operations      []*InProgressOperation // Operations such as merges and rebases which haven't been completed
+	stashCount      int
 }
 
-func GetRepoStatus(repoDir string) (*RepositoryStatus, error) {
+func GetRepoStatus(ignoreSubmodules IgnoreSubmodules, repoDir string) (*RepositoryStatus, error) {
 	stagedFiles := []*RepositoryFileStatus{}
 	notStagedFiles := []*RepositoryFileStatus{}
 	untrackedFiles := []*RepositoryFileStatus{}
 	unmodifiedFiles := []*RepositoryFileStatus{}
 
-	branch, err := getCurrentBranch(repoDir)
+	branch, err := getStatusBranch(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	operations, err := getInProgressOperations(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state of operations in progress: %s", err)
+	}
+
+	stashCount, err := getStashCount(repoDir)
 	if err != nil {
 		return nil, err
 	}
@@ -56,69 +148,103 @@ func GetRepoStatus(repoDir string) (*RepositoryStatus, error) {
 		workingTreePathsSet[path] = true
 	}
 
-	currIndexEntries, err := ReadIndex(repoDir)
+	// Refreshing the index's stat data is only an optimization, so it's skipped if another process holds the
+	// index lock
+	indexLock, err := lockIndex(repoDir)
+	if err == nil {
+		defer indexLock.rollback()
+	}
+
+	index, err := readIndexFile(repoDir)
 	if err != nil {
 		return nil, err
 	}
+	currIndexEntries := index.entries
 
+	// A file with merge conflicts has an entry for each conflicting stage instead of a single merged entry, so it's
+	// reported separately
 	currIndexEntriesMap := make(map[string]*IndexEntry, len(currIndexEntries))
+	unmergedStages := make(map[string]int)
 	for _, entry := range currIndexEntries {
+		if entry.stage() != 0 {
+			unmergedStages[entry.path] |= 1 << (entry.stage() - 1)
+			continue
+		}
 		currIndexEntriesMap[entry.path] = entry
+
+		// A submodule which hasn't been populated is an empty directory, which isn't listed as part of the
+		// working tree
+		if entry.mode == GITLINK_MODE && isDirectory(filepath.Join(repoDir, entry.path)) {
+			workingTreePathsSet[entry.path] = true
+		}
+	}
+
+	unmergedFiles := []*UnmergedFileStatus{}
+	for path, stages := range unmergedStages {
+		unmergedFiles = append(unmergedFiles, &UnmergedFileStatus{path: path, stages: stages})
 	}
+	sort.Slice(unmergedFiles, func(i int, j int) bool {
+		return unmergedFiles[i].path < unmergedFiles[j].path
+	})
+
+	indexModTime := getIndexModTime(repoDir)
+	indexNeedsRefresh := false
 
-	localHead, commitsExist, err := ResolveHead(false, repoDir)
+	localHead, commitsExist, err := ResolveHead("", repoDir)
 	if err != nil {
 		return nil, err
 	}
 
-	if !commitsExist {
-		// If this is a new repository with no commits yet, return a status with just untracked files
-		for path := range workingTreePathsSet {
-			untrackedFiles = append(untrackedFiles, &RepositoryFileStatus{
-				path:   path,
-				status: Untracked,
-			})
+	// A detached HEAD has no upstream, and neither does a branch with no commits yet
+	var upstream *BranchUpstream
+	if branch != "" && commitsExist {
+		upstream, err = getStatusUpstream(branch, repoDir)
+		if err != nil {
+			return nil, err
 		}
-
-		return &RepositoryStatus{
-			branch:          branch,
-			localHead:       localHead,
-			remoteHead:      "",
-			stagedFiles:     stagedFiles,
-			notStagedFiles:  notStagedFiles,
-			untrackedFiles:  untrackedFiles,
-			unmodifiedFiles: unmodifiedFiles,
-		}, nil
 	}
 
-	remoteHead, _, err := ResolveHead(true, repoDir)
-	if err != nil {
-		return nil, err
+	upstreamHead, ahead, behind := "", 0, 0
+	if upstream != nil {
+		upstreamHead, _, err = ResolveBranchRef(upstream.branch, upstream.remote, repoDir)
+		if err != nil {
+			return nil, err
+		}
+
+		if upstreamHead != "" {
+			ahead, behind, err = countAheadBehind(localHead, upstreamHead, repoDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compare branch with its upstream: %s", err)
+			}
+		}
 	}
 
-	headCommitObj, err := ReadCommitObjectFile(localHead, repoDir)
+	// Create headFiles with all files in the HEAD tree, of which there are none if there are no commits yet
+	headFiles, err := getHeadDiffFiles(repoDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read HEAD commit object file: %s", err)
+		return nil, err
 	}
 
-	headTreeObj, err := ReadTreeObjectFile(headCommitObj.treeHash, repoDir)
+	trustExecutableBit, err := getTrustExecutableBit(repoDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read tree object file for HEAD commit: %s", err)
+		return nil, err
 	}
-
-	// Create headTreeEntries with all files in the HEAD tree
-	headTreeEntries := make(map[string]string) // path -> hash
-	err = populateTreeEntriesMap(headTreeEntries, headTreeObj, "", repoDir)
+	converter, err := newContentConverter(repoDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to populate map with file entries in HEAD tree: %s", err)
+		return nil, err
 	}
 
 	for path := range workingTreePathsSet {
+		if _, isUnmerged := unmergedStages[path]; isUnmerged {
+			continue
+		}
+
 		indexEntry, inIndex := currIndexEntriesMap[path]
-		headHash, inHead := headTreeEntries[path]
+		headFile, inHead := headFiles[path]
 
-		// File exists in working tree but not index or HEAD, so Untracked
-		if !inIndex && !inHead {
+		// File exists in working tree but not index, so Untracked (and if it's in HEAD, its removal from the index
+		// is also staged, e.g. by rm --cached)
+		if !inIndex {
 			untrackedFiles = append(untrackedFiles, &RepositoryFileStatus{
 				path:   path,
 				status: Untracked,
@@ -129,27 +255,57 @@ func GetRepoStatus(repoDir string) (*RepositoryStatus, error) {
 		if inIndex {
 			indexHash := hex.EncodeToString(indexEntry.sha1[:])
 
-			blobObj, err := CreateBlobObjectFromFile(path, repoDir)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create blob object for %s", path)
-			}
-			workingTreeHash := blobObj.hash
+			workingTreeHash := indexHash
+			if indexEntry.mode == GITLINK_MODE {
+				if ignoreSubmodules == IgnoreSubmodulesAll {
+					unmodifiedFiles = append(unmodifiedFiles, &RepositoryFileStatus{
+						path:   path,
+						status: Unmodified,
+					})
+					continue
+				}
 
-			// File exists differently in working tree and index, so ModifiedNotStaged
-			if workingTreeHash != indexHash {
-				notStagedFiles = append(notStagedFiles, &RepositoryFileStatus{
-					path:   path,
-					status: ModifiedNotStaged,
-				})
-				continue
+				// Submodule has moved to another commit or has changes of its own, so ModifiedNotStaged
+				submoduleChanges, err := getSubmoduleChanges(path, indexHash, ignoreSubmodules, repoDir)
+				if err != nil {
+					return nil, err
+				}
+				if submoduleChanges != 0 {
+					notStagedFiles = append(notStagedFiles, &RepositoryFileStatus{
+						path:             path,
+						status:           ModifiedNotStaged,
+						submoduleChanges: submoduleChanges,
+					})
+					continue
+				}
+			} else {
+				workingTreeFile, refreshed, err := getWorkingTreeFileVersion(path, indexEntry, indexModTime, trustExecutableBit, converter, repoDir)
+				if err != nil {
+					return nil, err
+				}
+				indexNeedsRefresh = indexNeedsRefresh || refreshed
+				workingTreeHash = workingTreeFile.hash
+
+				// File exists differently (in content or mode) in working tree and index, so ModifiedNotStaged
+				if workingTreeHash != indexHash || workingTreeFile.mode != indexEntry.mode {
+					notStagedFiles = append(notStagedFiles, &RepositoryFileStatus{
+						path:    path,
+						status:  ModifiedNotStaged,
+						oldMode: indexEntry.mode,
+						newMode: workingTreeFile.mode,
+					})
+					continue
+				}
 			}
 
 			if inHead {
-				// File exists differently in working tree/index and HEAD, so ModifiedStaged
-				if workingTreeHash != headHash {
+				// File exists differently (in content or mode) in working tree/index and HEAD, so ModifiedStaged
+				if workingTreeHash != headFile.hash || indexEntry.mode != headFile.mode {
 					stagedFiles = append(stagedFiles, &RepositoryFileStatus{
-						path:   path,
-						status: ModifiedStaged,
+						path:    path,
+						status:  ModifiedStaged,
+						oldMode: headFile.mode,
+						newMode: indexEntry.mode,
 					})
 					continue
 				} else { // File is the same in working tree, index, and HEAD, so Unmodified
@@ -169,9 +325,10 @@ func GetRepoStatus(repoDir string) (*RepositoryStatus, error) {
 		}
 	}
 
-	for path := range currIndexEntriesMap {
-		// File exists in index but not working tree, so DeletedNotStaged
-		if !workingTreePathsSet[path] {
+	for path, entry := range currIndexEntriesMap {
+		// File exists in index but not working tree, so DeletedNotStaged (unless it's deliberately excluded
+		// from the working tree by a sparse checkout)
+		if !workingTreePathsSet[path] && !entry.isSkipWorktree() {
 			notStagedFiles = append(notStagedFiles, &RepositoryFileStatus{
 				path:   path,
 				status: DeletedNotStaged,
@@ -179,12 +336,12 @@ func GetRepoStatus(repoDir string) (*RepositoryStatus, error) {
 		}
 	}
 
-	for path := range headTreeEntries {
+	for path := range headFiles {
 		_, inIndex := currIndexEntriesMap[path]
-		_, inWorkingTree := workingTreePathsSet[path]
+		_, isUnmerged := unmergedStages[path]
 
-		// File exists in HEAD but not index or working tree, so DeletedStaged
-		if !inIndex && !inWorkingTree {
+		// File exists in HEAD but not index, so DeletedStaged
+		if !inIndex && !isUnmerged {
 			stagedFiles = append(stagedFiles, &RepositoryFileStatus{
 				path:   path,
 				status: DeletedStaged,
@@ -192,35 +349,110 @@ func GetRepoStatus(repoDir string) (*RepositoryStatus, error) {
 		}
 	}
 
+	// Persist any refreshed stat data so that unchanged files don't have to be rehashed by the next status
+	if indexNeedsRefresh && indexLock != nil {
+		if err := writeIndex(indexLock, currIndexEntries, index.cacheTree); err != nil {
+			return nil, fmt.Errorf("failed to refresh Git index file: %s", err)
+		}
+	}
+
+	// The statuses were gathered by iterating over maps, so they're sorted by path to be listed in a stable order
+	for _, files := range [][]*RepositoryFileStatus{stagedFiles, notStagedFiles, untrackedFiles, unmodifiedFiles} {
+		sortFileStatuses(files)
+	}
+
 	return &RepositoryStatus{
 		branch:          branch,
 		localHead:       localHead,
-		remoteHead:      remoteHead,
+		upstream:        upstream,
+		upstreamHead:    upstreamHead,
+		ahead:           ahead,
+		behind:          behind,
 		stagedFiles:     stagedFiles,
 		notStagedFiles:  notStagedFiles,
 		untrackedFiles:  untrackedFiles,
 		unmodifiedFiles: unmodifiedFiles,
+		unmergedFiles:   unmergedFiles,
+		operations:      operations,
+		stashCount:      stashCount,
 	}, nil
 }
 
-func populateTreeEntriesMap(treeEntries map[string]string, treeObj *TreeObject, pathPrefix string, repoDir string) error {
-	for _, entry := range treeObj.entries {
-		path := filepath.Join(pathPrefix, entry.name)
+// Returns the current branch, or an empty string if HEAD is detached (e.g. while a rebase is in progress)
+func getStatusBranch(repoDir string) (string, error) {
+	headRefName, isSymbolic, err := ReadSymbolicRef("HEAD", repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read HEAD: %s", err)
+	}
+
+	branchName, isBranch := strings.CutPrefix(headRefName, "refs/heads/")
+	if !isSymbolic || !isBranch {
+		return "", nil
+	}
+	return branchName, nil
+}
+
+// Returns the upstream that status compares the given branch against: its configured upstream, or otherwise the
+// remote-tracking branch of the same name on the default remote, if it exists (as pull and push fall back to it)
+func getStatusUpstream(branchName string, repoDir string) (*BranchUpstream, error) {
+	upstream, err := getBranchUpstream(branchName, repoDir)
+	if err != nil || upstream != nil {
+		return upstream, err
+	}
 
-		if entry.objType == Tree {
-			subTree, err := ReadTreeObjectFile(entry.hash, repoDir)
-			if err != nil {
-				return err
-			}
+	_, exists, err := ResolveBranchRef(branchName, DEFAULT_REMOTE_NAME, repoDir)
+	if err != nil || !exists {
+		return nil, err
+	}
 
-			err = populateTreeEntriesMap(treeEntries, subTree, path, repoDir)
-			if err != nil {
-				return err
-			}
-		} else {
-			treeEntries[path] = entry.hash
+	return &BranchUpstream{remote: DEFAULT_REMOTE_NAME, branch: branchName}, nil
+}
+
+func sortFileStatuses(files []*RepositoryFileStatus) {
+	sort.Slice(files, func(i int, j int) bool {
+		return files[i].path < files[j].path
+	})
+}
+
+// Determines the blob hash and mode of a file in the working tree (see getWorkingTreeFileMode). If the stat data
+// cached in the file's index entry matches the file, the hash stored in the index is trusted. Otherwise, the file is
+// rehashed (with its content converted as it would be if it were staged), and if its contents turn out to be
+// unchanged, the index entry's stat data is refreshed (indicated by the returned boolean).
+func getWorkingTreeFileVersion(path string, indexEntry *IndexEntry, indexModTime time.Time, trustExecutableBit bool, converter *ContentConverter, repoDir string) (*DiffFileVersion, bool, error) {
+	indexHash := hex.EncodeToString(indexEntry.sha1[:])
+	fullPath := filepath.Join(repoDir, path)
+
+	// A submodule's version in the working tree is the commit checked out in it
+	if indexEntry.mode == GITLINK_MODE {
+		head, err := getSubmoduleHead(path, repoDir)
+		if err != nil {
+			return nil, false, err
+		}
+		if head == "" {
+			head = indexHash
 		}
+		return &DiffFileVersion{hash: head, mode: GITLINK_MODE, inWorkingTree: true}, false, nil
+	}
+
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to stat file %s: %s", path, err)
 	}
+	mode := getWorkingTreeFileMode(info.Mode(), indexEntry.mode, trustExecutableBit)
 
-	return nil
+	if indexEntry.isAssumeValid() || isIndexEntryStatClean(indexEntry, info, indexModTime) {
+		return &DiffFileVersion{hash: indexHash, mode: indexEntry.mode, inWorkingTree: true}, false, nil
+	}
+
+	workingTreeHash, err := HashBlobObjectFromFile(fullPath, converter)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to hash file %s: %s", path, err)
+	}
+
+	refreshed := false
+	if workingTreeHash == indexHash {
+		setIndexEntryStatData(indexEntry, info)
+		refreshed = true
+	}
+	return &DiffFileVersion{hash: workingTreeHash, mode: mode, inWorkingTree: true}, refreshed, nil
 }
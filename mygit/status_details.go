@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Represents which part of the repository a change reported by Status is in
+type StatusArea int
+
+const (
+	StatusAreaStaged    StatusArea = iota // Between HEAD and the index
+	StatusAreaNotStaged                   // Between the index and the working tree
+	StatusAreaUntracked                   // In the working tree, but not the index
+	StatusAreaUnmerged                    // In the index with merge conflicts
+)
+
+func (a StatusArea) toString() string {
+	switch a {
+	case StatusAreaStaged:
+		return "staged"
+	case StatusAreaNotStaged:
+		return "not-staged"
+	case StatusAreaUntracked:
+		return "untracked"
+	case StatusAreaUnmerged:
+		return "unmerged"
+	default:
+		return "unknown"
+	}
+}
+
+func (a StatusArea) MarshalText() ([]byte, error) {
+	return []byte(a.toString()), nil
+}
+
+// Represents how a file reported by Status has changed
+type StatusChange int
+
+const (
+	StatusChangeAdded StatusChange = iota
+	StatusChangeModified
+	StatusChangeDeleted
+	StatusChangeRenamed
+	StatusChangeUntracked
+	StatusChangeConflicted
+)
+
+func (c StatusChange) toString() string {
+	switch c {
+	case StatusChangeAdded:
+		return "added"
+	case StatusChangeModified:
+		return "modified"
+	case StatusChangeDeleted:
+		return "deleted"
+	case StatusChangeRenamed:
+		return "renamed"
+	case StatusChangeUntracked:
+		return "untracked"
+	case StatusChangeConflicted:
+		return "conflicted"
+	default:
+		return "unknown"
+	}
+}
+
+func (c StatusChange) MarshalText() ([]byte, error) {
+	return []byte(c.toString()), nil
+}
+
+// Represents the ways in which a submodule reported by Status differs from the commit recorded for it in the index
+type SubmoduleStatus struct {
+	NewCommits       bool `json:"newCommits"`
+	ModifiedContent  bool `json:"modifiedContent"`
+	UntrackedContent bool `json:"untrackedContent"`
+}
+
+// Represents a single change reported by Status, for tools embedding this package which need more detail than
+// RepositoryStatus gives. The old side of a staged change is HEAD and the new side is the index, while the old side
+// of a change which isn't staged is the index and the new side is the working tree. Modes are formatted as in tree
+// objects (e.g. "100644"), and modes and object IDs are empty for a side on which the file doesn't exist. A file
+// may have both a staged and a not-staged entry.
+type StatusEntry struct {
+	Path      string           `json:"path"`
+	Area      StatusArea       `json:"area"`
+	Change    StatusChange     `json:"change"`
+	OrigPath  string           `json:"origPath,omitempty"` // The path a renamed file was renamed from
+	OldMode   string           `json:"oldMode,omitempty"`
+	NewMode   string           `json:"newMode,omitempty"`
+	OldOID    string           `json:"oldOid,omitempty"`
+	NewOID    string           `json:"newOid,omitempty"`   // Not computed for untracked files
+	Conflict  string           `json:"conflict,omitempty"` // How an unmerged file conflicts, e.g. "both modified"
+	Submodule *SubmoduleStatus `json:"submodule,omitempty"`
+}
+
+// Represents the status of the entire repository as returned by Status, with a stable JSON encoding
+type StatusReport struct {
+	Branch       string         `json:"branch,omitempty"`       // Empty if HEAD is detached
+	Head         string         `json:"head,omitempty"`         // Empty if there are no commits yet
+	Upstream     string         `json:"upstream,omitempty"`     // e.g. "origin/main"
+	UpstreamHead string         `json:"upstreamHead,omitempty"` // Empty if the upstream's remote-tracking ref doesn't exist
+	Ahead        int            `json:"ahead"`
+	Behind       int            `json:"behind"`
+	StashCount   int            `json:"stashCount"`
+	Entries      []*StatusEntry `json:"entries"`
+}
+
+// Determines the status of the repository along with the details of each change: the modes and object IDs on both
+// sides, the original path of files renamed in the index (detected only for exact renames, whose contents are
+// unchanged), and the changes within submodules. Entries are sorted by path, and then by area.
+func Status(ignoreSubmodules IgnoreSubmodules, repoDir string) (*StatusReport, error) {
+	status, err := GetRepoStatus(ignoreSubmodules, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Git index file: %s", err)
+	}
+	indexFiles := getIndexDiffFiles(index)
+
+	headFiles, err := getHeadDiffFiles(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	workingTreeFiles, err := getWorkingTreeDiffFiles(index, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &StatusReport{
+		Branch:       status.branch,
+		Head:         status.localHead,
+		UpstreamHead: status.upstreamHead,
+		Ahead:        status.ahead,
+		Behind:       status.behind,
+		StashCount:   status.stashCount,
+		Entries:      []*StatusEntry{},
+	}
+	if status.upstream != nil {
+		report.Upstream = status.upstream.toString()
+	}
+
+	unmergedPaths := make(map[string]bool, len(status.unmergedFiles))
+	for _, fs := range status.unmergedFiles {
+		unmergedPaths[fs.path] = true
+		report.Entries = append(report.Entries, &StatusEntry{
+			Path:     fs.path,
+			Area:     StatusAreaUnmerged,
+			Change:   StatusChangeConflicted,
+			Conflict: strings.TrimSuffix(fs.describe(), ":"),
+		})
+	}
+
+	// Staged changes are found by diffing HEAD against the index rather than taken from the status, which only
+	// reports one change for a file that has also changed in the working tree since it was staged
+	stagedChanges := []*DiffFileChange{}
+	for _, change := range diffFileSets(headFiles, indexFiles) {
+		if !unmergedPaths[change.path] {
+			stagedChanges = append(stagedChanges, change)
+		}
+	}
+	report.Entries = append(report.Entries, getStagedStatusEntries(stagedChanges)...)
+
+	for _, fs := range status.notStagedFiles {
+		entry := &StatusEntry{Path: fs.path, Area: StatusAreaNotStaged, Change: StatusChangeModified}
+		if fs.status == DeletedNotStaged {
+			entry.Change = StatusChangeDeleted
+		}
+		entry.setVersions(indexFiles[fs.path], workingTreeFiles[fs.path])
+
+		if fs.submoduleChanges != 0 {
+			entry.Submodule = &SubmoduleStatus{
+				NewCommits:       fs.submoduleChanges&SubmoduleNewCommits != 0,
+				ModifiedContent:  fs.submoduleChanges&SubmoduleModifiedContent != 0,
+				UntrackedContent: fs.submoduleChanges&SubmoduleUntrackedContent != 0,
+			}
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+
+	for _, fs := range status.untrackedFiles {
+		entry := &StatusEntry{Path: fs.path, Area: StatusAreaUntracked, Change: StatusChangeUntracked}
+		info, err := os.Lstat(filepath.Join(repoDir, fs.path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat file %s: %s", fs.path, err)
+		}
+		// The only directories listed as untracked are nested repositories, which would be added as submodules
+		mode := getGitModeFromFileMode(info.Mode())
+		if info.IsDir() {
+			mode = GITLINK_MODE
+		}
+		entry.NewMode = mode.toPaddedString()
+		report.Entries = append(report.Entries, entry)
+	}
+
+	sort.SliceStable(report.Entries, func(i int, j int) bool {
+		if report.Entries[i].Path != report.Entries[j].Path {
+			return report.Entries[i].Path < report.Entries[j].Path
+		}
+		return report.Entries[i].Area < report.Entries[j].Area
+	})
+
+	return report, nil
+}
+
+// Converts the changes between HEAD and the index into status entries, pairing up each deleted file with an added
+// file of the same content (if there is one) as a rename
+func getStagedStatusEntries(changes []*DiffFileChange) []*StatusEntry {
+	deletedByHash := make(map[string][]*DiffFileChange)
+	for _, change := range changes {
+		if change.newFile == nil {
+			deletedByHash[change.oldFile.hash] = append(deletedByHash[change.oldFile.hash], change)
+		}
+	}
+
+	renamedPaths := make(map[string]bool)
+	entries := []*StatusEntry{}
+	for _, change := range changes {
+		entry := &StatusEntry{Path: change.path, Area: StatusAreaStaged, Change: StatusChangeModified}
+
+		switch {
+		case change.oldFile == nil:
+			entry.Change = StatusChangeAdded
+			if deleted := deletedByHash[change.newFile.hash]; len(deleted) > 0 {
+				deletedByHash[change.newFile.hash] = deleted[1:]
+				renamedPaths[deleted[0].path] = true
+				entry.Change = StatusChangeRenamed
+				entry.OrigPath = deleted[0].path
+				entry.setVersions(deleted[0].oldFile, change.newFile)
+				break
+			}
+			entry.setVersions(nil, change.newFile)
+		case change.newFile == nil:
+			entry.Change = StatusChangeDeleted
+			entry.setVersions(change.oldFile, nil)
+		default:
+			entry.setVersions(change.oldFile, change.newFile)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	// A file which was renamed is reported once, at its new path
+	filteredEntries := []*StatusEntry{}
+	for _, entry := range entries {
+		if entry.Change == StatusChangeDeleted && renamedPaths[entry.Path] {
+			continue
+		}
+		filteredEntries = append(filteredEntries, entry)
+	}
+	return filteredEntries
+}
+
+func (e *StatusEntry) setVersions(oldFile *DiffFileVersion, newFile *DiffFileVersion) {
+	if oldFile != nil {
+		e.OldMode, e.OldOID = oldFile.mode.toPaddedString(), oldFile.hash
+	}
+	if newFile != nil {
+		e.NewMode, e.NewOID = newFile.mode.toPaddedString(), newFile.hash
+	}
+}
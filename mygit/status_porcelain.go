@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Represents the format in which status prints the repository's status
+type StatusFormat int
+
+const (
+	StatusFormatLong        StatusFormat = iota // The default, meant for people to read
+	StatusFormatShort                           // -s: a line for each changed file, with a two-letter status code
+	StatusFormatPorcelainV1                     // --porcelain: the short format, without colors, for scripts
+	StatusFormatPorcelainV2                     // --porcelain=v2: the modes and object IDs of each changed file
+)
+
+// The value of the --porcelain flag, which may be given without a version (meaning v1) or as --porcelain=v1 or
+// --porcelain=v2
+type porcelainFlag struct {
+	format StatusFormat
+}
+
+func (f *porcelainFlag) String() string {
+	if f == nil || f.format == StatusFormatLong {
+		return ""
+	}
+	if f.format == StatusFormatPorcelainV2 {
+		return "v2"
+	}
+	return "v1"
+}
+
+func (f *porcelainFlag) Set(value string) error {
+	switch value {
+	case "true", "v1":
+		f.format = StatusFormatPorcelainV1
+	case "v2":
+		f.format = StatusFormatPorcelainV2
+	default:
+		return fmt.Errorf("unsupported porcelain version '%s'", value)
+	}
+	return nil
+}
+
+// Allows the flag to be given without a value
+func (f *porcelainFlag) IsBoolFlag() bool {
+	return true
+}
+
+// Represents the options for printing the status in the short or porcelain formats
+type ShortStatusOptions struct {
+	format        StatusFormat
+	showBranch    bool // Print a header describing the current branch and its upstream first (-b)
+	nulTerminated bool // Terminate each entry with a NUL byte rather than a newline, leaving paths unquoted (-z)
+	colorizer     Colorizer
+}
+
+// Represents the changes to a single tracked file, as a single line of the short and porcelain formats
+type ShortStatusFile struct {
+	path      string
+	staged    *StatusEntry // Between HEAD and the index, if the file changed there
+	notStaged *StatusEntry // Between the index and the working tree, if the file changed there
+	unmerged  *UnmergedFileStatus
+}
+
+// Prints the status in the short format or one of the porcelain formats, which are what scripts and editors should
+// parse: unlike the long format, the porcelain formats never change between versions or with the user's config. As
+// in Git, each changed file gets a line with a two-letter XY code, where X is the change staged in the index (or
+// ' ' if there is none) and Y is the change in the working tree that isn't staged: M (modified), T (type changed,
+// e.g. a file replaced by a symbolic link), A (added), D (deleted), or R (renamed). Files with merge conflicts get
+// the codes DD, AU, UD, UA, DU, AA, or UU. The changed files are listed first, sorted by path, followed by the
+// untracked files (marked ??).
+func printShortStatus(w io.Writer, report *StatusReport, options ShortStatusOptions, repoDir string) error {
+	unmergedStages, err := getUnmergedIndexEntries(repoDir)
+	if err != nil {
+		return err
+	}
+
+	files := []*ShortStatusFile{}
+	filesByPath := make(map[string]*ShortStatusFile)
+	untrackedPaths := []string{}
+	for _, entry := range report.Entries {
+		if entry.Area == StatusAreaUntracked {
+			untrackedPaths = append(untrackedPaths, entry.Path)
+			continue
+		}
+
+		file, exists := filesByPath[entry.Path]
+		if !exists {
+			file = &ShortStatusFile{path: entry.Path}
+			filesByPath[entry.Path] = file
+			files = append(files, file)
+		}
+		switch entry.Area {
+		case StatusAreaStaged:
+			file.staged = entry
+		case StatusAreaNotStaged:
+			file.notStaged = entry
+		case StatusAreaUnmerged:
+			file.unmerged = &UnmergedFileStatus{path: entry.Path}
+			for stage, indexEntry := range unmergedStages[entry.Path] {
+				if indexEntry != nil {
+					file.unmerged.stages |= 1 << stage
+				}
+			}
+		}
+	}
+
+	terminator := "\n"
+	if options.nulTerminated {
+		terminator = "\x00"
+	}
+
+	if options.showBranch {
+		if options.format == StatusFormatPorcelainV2 {
+			fmt.Fprint(w, formatPorcelainV2BranchHeaders(report, terminator))
+		} else {
+			fmt.Fprintf(w, "## %s%s", formatShortStatusBranch(report, options.colorizer), terminator)
+		}
+	}
+
+	for _, file := range files {
+		var line string
+		if options.format == StatusFormatPorcelainV2 {
+			line, err = formatPorcelainV2Line(file, unmergedStages[file.path], options.nulTerminated, repoDir)
+			if err != nil {
+				return err
+			}
+		} else {
+			line = formatShortStatusLine(file, options)
+		}
+		fmt.Fprint(w, line+terminator)
+	}
+
+	for _, path := range untrackedPaths {
+		if options.format == StatusFormatPorcelainV2 {
+			fmt.Fprintf(w, "? %s%s", formatStatusPath(path, false, options.nulTerminated), terminator)
+		} else {
+			fmt.Fprintf(w, "%s %s%s", options.colorizer.wrap("??", COLOR_RED), formatStatusPath(path, true, options.nulTerminated), terminator)
+		}
+	}
+	return nil
+}
+
+// Returns the index entries of each file with merge conflicts, indexed by stage - 1 (so the common ancestor, ours, and
+// theirs), with nil for a stage that the file doesn't have
+func getUnmergedIndexEntries(repoDir string) (map[string][3]*IndexEntry, error) {
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Git index file: %s", err)
+	}
+
+	unmergedEntries := make(map[string][3]*IndexEntry)
+	for _, entry := range index.entries {
+		if entry.stage() != 0 {
+			stages := unmergedEntries[entry.path]
+			stages[entry.stage()-1] = entry
+			unmergedEntries[entry.path] = stages
+		}
+	}
+	return unmergedEntries, nil
+}
+
+// Describes the current branch and how it compares to its upstream, as in the header printed by -b, e.g.
+// `main...origin/main [ahead 1, behind 2]`
+func formatShortStatusBranch(report *StatusReport, colorizer Colorizer) string {
+	colorize := colorizer.wrap
+	if report.Branch == "" {
+		return colorize("HEAD (no branch)", COLOR_RED)
+	}
+	if report.Head == "" {
+		return "No commits yet on " + colorize(report.Branch, COLOR_GREEN)
+	}
+	if report.Upstream == "" {
+		return colorize(report.Branch, COLOR_GREEN)
+	}
+
+	header := colorize(report.Branch, COLOR_GREEN) + "..." + colorize(report.Upstream, COLOR_RED)
+	switch {
+	case report.UpstreamHead == "":
+		header += " [gone]"
+	case report.Ahead > 0 && report.Behind > 0:
+		header += fmt.Sprintf(" [ahead %s, behind %s]", colorize(fmt.Sprint(report.Ahead), COLOR_GREEN), colorize(fmt.Sprint(report.Behind), COLOR_RED))
+	case report.Ahead > 0:
+		header += fmt.Sprintf(" [ahead %s]", colorize(fmt.Sprint(report.Ahead), COLOR_GREEN))
+	case report.Behind > 0:
+		header += fmt.Sprintf(" [behind %s]", colorize(fmt.Sprint(report.Behind), COLOR_RED))
+	}
+	return header
+}
+
+// Returns the header lines printed by --porcelain=v2 --branch: the current commit, the current branch, and the
+// upstream along with how many commits the branch is ahead of and behind it
+func formatPorcelainV2BranchHeaders(report *StatusReport, terminator string) string {
+	oid, head := report.Head, report.Branch
+	if oid == "" {
+		oid = "(initial)"
+	}
+	if head == "" {
+		head = "(detached)"
+	}
+
+	headers := fmt.Sprintf("# branch.oid %s%s# branch.head %s%s", oid, terminator, head, terminator)
+	if report.Upstream != "" {
+		headers += fmt.Sprintf("# branch.upstream %s%s", report.Upstream, terminator)
+		if report.UpstreamHead != "" {
+			headers += fmt.Sprintf("# branch.ab +%d -%d%s", report.Ahead, report.Behind, terminator)
+		}
+	}
+	return headers
+}
+
+// Returns the line of the short or porcelain v1 format for a changed file, e.g. `MM file.txt` or
+// `R  old.txt -> new.txt`
+func formatShortStatusLine(file *ShortStatusFile, options ShortStatusOptions) string {
+	x, y := " ", " "
+	if file.unmerged != nil {
+		code := file.unmerged.shortStatus()
+		x, y = code[:1], code[1:]
+	}
+	if file.staged != nil {
+		x = file.staged.statusCode()
+	}
+	if file.notStaged != nil {
+		y = file.notStaged.statusCode()
+		// A submodule whose checked out commit is unchanged reports the changes within it instead
+		if submodule := file.notStaged.Submodule; submodule != nil && !submodule.NewCommits {
+			if submodule.ModifiedContent {
+				y = "m"
+			} else if submodule.UntrackedContent {
+				y = "?"
+			}
+		}
+	}
+
+	if x != " " {
+		x = options.colorizer.wrap(x, COLOR_GREEN)
+	}
+	if y != " " {
+		y = options.colorizer.wrap(y, COLOR_RED)
+	}
+
+	path := formatStatusPath(file.path, true, options.nulTerminated)
+	if file.staged != nil && file.staged.OrigPath != "" {
+		origPath := formatStatusPath(file.staged.OrigPath, true, options.nulTerminated)
+		if options.nulTerminated {
+			return fmt.Sprintf("%s%s %s\x00%s", x, y, path, origPath)
+		}
+		return fmt.Sprintf("%s%s %s -> %s", x, y, origPath, path)
+	}
+	return fmt.Sprintf("%s%s %s", x, y, path)
+}
+
+// Returns the line of the porcelain v2 format for a changed file, which also gives its modes in HEAD, the index, and
+// the working tree, and its object IDs in HEAD and the index:
+//
+//	1 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <path>
+//	2 <XY> <sub> <mH> <mI> <mW> <hH> <hI> R100 <path><TAB or NUL><origPath>
+//	u <XY> <sub> <m1> <m2> <m3> <mW> <h1> <h2> <h3> <path>
+//
+// where an unchanged side of XY is '.', and a mode or object ID is all zeros on a side where the file doesn't exist.
+// Renamed files have the 2 format, and files with merge conflicts the u format, which gives the modes and object IDs
+// of the common ancestor, ours, and theirs.
+func formatPorcelainV2Line(file *ShortStatusFile, unmergedEntries [3]*IndexEntry, nulTerminated bool, repoDir string) (string, error) {
+	path := formatStatusPath(file.path, false, nulTerminated)
+
+	if file.unmerged != nil {
+		worktreeMode, err := getWorktreeStatusMode(file.path, repoDir)
+		if err != nil {
+			return "", err
+		}
+
+		modes, hashes := []string{}, []string{}
+		for _, entry := range unmergedEntries {
+			if entry == nil {
+				modes, hashes = append(modes, formatStatusMode("")), append(hashes, NULL_OBJECT_HASH)
+				continue
+			}
+			modes, hashes = append(modes, entry.mode.toPaddedString()), append(hashes, fmt.Sprintf("%x", entry.sha1))
+		}
+		sub := getPorcelainV2SubmoduleField([]string{modes[0], modes[1], modes[2], worktreeMode}, nil)
+		return fmt.Sprintf("u %s %s %s %s %s %s", file.unmerged.shortStatus(), sub, strings.Join(modes, " "), worktreeMode, strings.Join(hashes, " "), path), nil
+	}
+
+	x, y := ".", "."
+	var headMode, indexMode, worktreeMode, headHash, indexHash string
+	if file.staged != nil {
+		x = file.staged.statusCode()
+		headMode, headHash, indexMode, indexHash = file.staged.OldMode, file.staged.OldOID, file.staged.NewMode, file.staged.NewOID
+		worktreeMode = indexMode
+	}
+	if file.notStaged != nil {
+		y = file.notStaged.statusCode()
+		indexMode, indexHash, worktreeMode = file.notStaged.OldMode, file.notStaged.OldOID, file.notStaged.NewMode
+		if file.staged == nil {
+			headMode, headHash = indexMode, indexHash
+		}
+	}
+
+	modes := []string{formatStatusMode(headMode), formatStatusMode(indexMode), formatStatusMode(worktreeMode)}
+	hashes := []string{formatStatusHash(headHash), formatStatusHash(indexHash)}
+	sub := getPorcelainV2SubmoduleField(modes, file.notStaged)
+
+	if file.staged != nil && file.staged.OrigPath != "" {
+		separator := "\t"
+		if nulTerminated {
+			separator = "\x00"
+		}
+		origPath := formatStatusPath(file.staged.OrigPath, false, nulTerminated)
+		return fmt.Sprintf("2 %s%s %s %s %s R100 %s%s%s", x, y, sub, strings.Join(modes, " "), strings.Join(hashes, " "), path, separator, origPath), nil
+	}
+	return fmt.Sprintf("1 %s%s %s %s %s %s", x, y, sub, strings.Join(modes, " "), strings.Join(hashes, " "), path), nil
+}
+
+// Returns the <sub> field of a porcelain v2 line: N... for a file which isn't a submodule, or for a submodule, S
+// followed by C if its checked out commit changed, M if it has modified content, and U if it has untracked content
+// (each of which is '.' otherwise)
+func getPorcelainV2SubmoduleField(modes []string, notStaged *StatusEntry) string {
+	isSubmodule := false
+	for _, mode := range modes {
+		isSubmodule = isSubmodule || mode == GITLINK_MODE.toPaddedString()
+	}
+	if !isSubmodule {
+		return "N..."
+	}
+
+	field := []byte("S...")
+	if notStaged != nil && notStaged.Submodule != nil {
+		for i, flag := range []bool{notStaged.Submodule.NewCommits, notStaged.Submodule.ModifiedContent, notStaged.Submodule.UntrackedContent} {
+			if flag {
+				field[i+1] = "CMU"[i]
+			}
+		}
+	}
+	return string(field)
+}
+
+// Returns the mode of a file in the working tree as shown by --porcelain=v2, which is all zeros if it doesn't exist
+func getWorktreeStatusMode(path string, repoDir string) (string, error) {
+	info, err := os.Lstat(filepath.Join(repoDir, path))
+	if os.IsNotExist(err) {
+		return formatStatusMode(""), nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to stat file %s: %s", path, err)
+	}
+	return getGitModeFromFileMode(info.Mode()).toPaddedString(), nil
+}
+
+func formatStatusMode(mode string) string {
+	if mode == "" {
+		return "000000"
+	}
+	return mode
+}
+
+func formatStatusHash(hash string) string {
+	if hash == "" {
+		return NULL_OBJECT_HASH
+	}
+	return hash
+}
+
+// Returns the letter for a change in the short and porcelain formats (see printShortStatus)
+func (e *StatusEntry) statusCode() string {
+	switch e.Change {
+	case StatusChangeAdded:
+		return "A"
+	case StatusChangeDeleted:
+		return "D"
+	case StatusChangeRenamed:
+		return "R"
+	case StatusChangeModified:
+		if isTypeChange(e.OldMode, e.NewMode) {
+			return "T"
+		}
+		return "M"
+	default:
+		return "?"
+	}
+}
+
+// Returns whether a file changed type between the given modes, e.g. from a regular file to a symbolic link (as opposed
+// to only its executable bit changing)
+func isTypeChange(oldMode string, newMode string) bool {
+	oldFileMode, oldErr := parseFileMode(oldMode)
+	newFileMode, newErr := parseFileMode(newMode)
+	if oldErr != nil || newErr != nil {
+		return false
+	}
+	const fileTypeMask = 0o170000
+	return oldFileMode&fileTypeMask != newFileMode&fileTypeMask
+}
+
+// Formats a path as the short and porcelain formats do. Unless entries are NUL-terminated, a path containing special
+// characters (a double quote, a backslash, a control character, or any non-ASCII byte) is quoted with C-style escapes,
+// as is a path containing a space in the short and porcelain v1 formats, whose renames are written as `old -> new`.
+func formatStatusPath(path string, quoteSpaces bool, nulTerminated bool) string {
+	if nulTerminated {
+		return path
+	}
+
+	needsQuotes := false
+	var quoted strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '"' || c == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+			needsQuotes = true
+		case strings.IndexByte("\a\b\t\n\v\f\r", c) >= 0:
+			quoted.WriteByte('\\')
+			quoted.WriteByte("abtnvfr"[strings.IndexByte("\a\b\t\n\v\f\r", c)])
+			needsQuotes = true
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&quoted, "\\%03o", c)
+			needsQuotes = true
+		case c == ' ' && quoteSpaces:
+			quoted.WriteByte(c)
+			needsQuotes = true
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+
+	if !needsQuotes {
+		return path
+	}
+	return `"` + quoted.String() + `"`
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShortStatusIsDeterministic(t *testing.T) {
+	repoDir := newTestRepo(t)
+	_, headHash := createTestHistory(t, repoDir)
+	if err := UpdateBranchRef("main", headHash, "", repoDir); err != nil {
+		t.Fatalf("failed to update branch: %s", err)
+	}
+
+	// The index matches HEAD, and then files are staged, changed without being staged, deleted, and left untracked
+	if err := CreateIndexFromWorkingTree(repoDir); err != nil {
+		t.Fatalf("failed to add files to index: %s", err)
+	}
+	for i := range 8 {
+		writeTestFiles(t, map[string]string{fmt.Sprintf("dir%d/staged%d.txt", i%3, i): "staged\n"}, repoDir)
+		if err := AddFilesToIndex([]string{fmt.Sprintf("dir%d/staged%d.txt", i%3, i)}, repoDir); err != nil {
+			t.Fatalf("failed to add file to index: %s", err)
+		}
+		writeTestFiles(t, map[string]string{fmt.Sprintf("dir%d/untracked%d.txt", i%3, i): "untracked\n"}, repoDir)
+	}
+	writeTestFiles(t, map[string]string{"dir0/file4.txt": "changed\n", "dir1/file5.txt": "changed\n", "top.txt": "changed\n"}, repoDir)
+	for _, path := range []string{"dir2/file6.txt", "dir3/file7.txt"} {
+		if err := os.Remove(filepath.Join(repoDir, path)); err != nil {
+			t.Fatalf("failed to remove %s: %s", path, err)
+		}
+	}
+
+	for _, format := range []StatusFormat{StatusFormatShort, StatusFormatPorcelainV2} {
+		var firstOutput []byte
+		for range DETERMINISM_TEST_RUNS {
+			report, err := Status(IgnoreSubmodulesNone, repoDir)
+			if err != nil {
+				t.Fatalf("failed to get status: %s", err)
+			}
+			var output bytes.Buffer
+			if err := printShortStatus(&output, report, ShortStatusOptions{format: format, showBranch: true}, repoDir); err != nil {
+				t.Fatalf("failed to print status: %s", err)
+			}
+
+			if firstOutput == nil {
+				firstOutput = output.Bytes()
+				continue
+			}
+			if !bytes.Equal(output.Bytes(), firstOutput) {
+				t.Fatalf("status printed\n%s\nand before\n%s", output.Bytes(), firstOutput)
+			}
+		}
+
+		// 8 staged, 3 modified, 2 deleted, and 8 untracked files, after the branch header(s)
+		if numLines := bytes.Count(firstOutput, []byte("\n")); numLines < 21 {
+			t.Errorf("status printed %d lines, expected at least 21:\n%s", numLines, firstOutput)
+		}
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Represents which changes to submodules are ignored, as given to --ignore-submodules or the diff.ignoreSubmodules
+// config variable
+type IgnoreSubmodules int
+
+const (
+	IgnoreSubmodulesNone      IgnoreSubmodules = iota // Report new commits, modified content, and untracked content
+	IgnoreSubmodulesUntracked                         // Don't report untracked content
+	IgnoreSubmodulesDirty                             // Only report new commits
+	IgnoreSubmodulesAll                               // Don't report any changes to submodules
+)
+
+func (i IgnoreSubmodules) toString() string {
+	switch i {
+	case IgnoreSubmodulesNone:
+		return "none"
+	case IgnoreSubmodulesUntracked:
+		return "untracked"
+	case IgnoreSubmodulesDirty:
+		return "dirty"
+	case IgnoreSubmodulesAll:
+		return "all"
+	default:
+		return "unknown"
+	}
+}
+
+func parseIgnoreSubmodules(value string) (IgnoreSubmodules, error) {
+	switch strings.ToLower(value) {
+	case "none":
+		return IgnoreSubmodulesNone, nil
+	case "untracked":
+		return IgnoreSubmodulesUntracked, nil
+	case "dirty":
+		return IgnoreSubmodulesDirty, nil
+	case "all":
+		return IgnoreSubmodulesAll, nil
+	default:
+		return -1, fmt.Errorf("unknown value for ignoring submodules: %s", value)
+	}
+}
+
+// Returns which changes to submodules to ignore: those given on the command line if any, or else those given by the
+// diff.ignoreSubmodules config variable, or else none
+func getIgnoreSubmodules(value string, repoDir string) (IgnoreSubmodules, error) {
+	if value == "" {
+		config, err := readConfig(repoDir)
+		if err != nil {
+			return -1, fmt.Errorf("failed to read config: %s", err)
+		}
+
+		configValue, isSet := config.get("diff.ignoreSubmodules")
+		if !isSet {
+			return IgnoreSubmodulesNone, nil
+		}
+		value = configValue
+	}
+
+	return parseIgnoreSubmodules(value)
+}
+
+// Represents the ways in which a submodule differs from the commit recorded for it in the index, as a bitmask
+type SubmoduleChanges int
+
+const (
+	SubmoduleNewCommits       SubmoduleChanges = 1 << iota // A different commit is checked out in the submodule
+	SubmoduleModifiedContent                               // The submodule has staged or unstaged changes
+	SubmoduleUntrackedContent                              // The submodule has untracked files
+)
+
+// Describes the changes as shown by status, e.g. "new commits, modified content"
+func (c SubmoduleChanges) describe() string {
+	descriptions := []string{}
+	if c&SubmoduleNewCommits != 0 {
+		descriptions = append(descriptions, "new commits")
+	}
+	if c&SubmoduleModifiedContent != 0 {
+		descriptions = append(descriptions, "modified content")
+	}
+	if c&SubmoduleUntrackedContent != 0 {
+		descriptions = append(descriptions, "untracked content")
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// Returns the top-level directory of the submodule at the given path, or an empty string if the submodule hasn't
+// been populated (e.g. it was never cloned, leaving an empty directory)
+func getSubmoduleRepoDir(path string, repoDir string) (string, error) {
+	submoduleDir := filepath.Join(repoDir, path)
+	if !fileExists(filepath.Join(submoduleDir, ".git")) {
+		return "", nil
+	}
+
+	submodule, err := discoverRepo(submoduleDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to find repository of submodule %s: %s", path, err)
+	}
+	if submodule == nil || !submodule.hasWorkTree {
+		return "", fmt.Errorf("submodule %s is not a repository with a working tree", path)
+	}
+
+	return submodule.repoDir, nil
+}
+
+// Returns the commit checked out in the submodule at the given path, or an empty string if the submodule hasn't been
+// populated or has no commits yet
+func getSubmoduleHead(path string, repoDir string) (string, error) {
+	submoduleRepoDir, err := getSubmoduleRepoDir(path, repoDir)
+	if err != nil || submoduleRepoDir == "" {
+		return "", err
+	}
+
+	head, _, err := ResolveHead("", submoduleRepoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve HEAD of submodule %s: %s", path, err)
+	}
+	return head, nil
+}
+
+// Determines how the submodule at the given path differs from the commit recorded for it in the index, leaving out
+// the changes which are ignored. A submodule which hasn't been populated is considered unchanged.
+func getSubmoduleChanges(path string, indexHash string, ignoreSubmodules IgnoreSubmodules, repoDir string) (SubmoduleChanges, error) {
+	if ignoreSubmodules == IgnoreSubmodulesAll {
+		return 0, nil
+	}
+
+	submoduleRepoDir, err := getSubmoduleRepoDir(path, repoDir)
+	if err != nil || submoduleRepoDir == "" {
+		return 0, err
+	}
+
+	head, commitsExist, err := ResolveHead("", submoduleRepoDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve HEAD of submodule %s: %s", path, err)
+	}
+	if !commitsExist {
+		return 0, nil
+	}
+
+	var changes SubmoduleChanges
+	if head != indexHash {
+		changes |= SubmoduleNewCommits
+	}
+	if ignoreSubmodules == IgnoreSubmodulesDirty {
+		return changes, nil
+	}
+
+	status, err := GetRepoStatus(ignoreSubmodules, submoduleRepoDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to determine status of submodule %s: %s", path, err)
+	}
+
+	if len(status.stagedFiles) > 0 || len(status.notStagedFiles) > 0 || len(status.unmergedFiles) > 0 {
+		changes |= SubmoduleModifiedContent
+	}
+	if len(status.untrackedFiles) > 0 && ignoreSubmodules != IgnoreSubmodulesUntracked {
+		changes |= SubmoduleUntrackedContent
+	}
+
+	return changes, nil
+}
+
+// Represents the state of a submodule as listed by `submodule status`
+type SubmoduleState struct {
+	path       string
+	commitHash string // The commit checked out in the submodule if it's been populated, or else the recorded commit
+	populated  bool
+	modified   bool   // Whether the commit checked out in the submodule differs from the commit recorded in the index
+	unmerged   bool   // Whether the submodule has merge conflicts, in which case no commit is recorded for it
+	revName    string // A name for the checked out commit, e.g. a tag or branch describing it (empty if unpopulated)
+}
+
+// Formats the state as Git lists it: the commit, prefixed by - if the submodule hasn't been populated, + if its
+// checked out commit differs from the recorded commit, or U if it has merge conflicts, followed by its path and the
+// name of the commit
+func (s *SubmoduleState) format() string {
+	prefix := " "
+	switch {
+	case s.unmerged:
+		return fmt.Sprintf("U%s %s", NULL_OBJECT_HASH, s.path)
+	case !s.populated:
+		return fmt.Sprintf("-%s %s", s.commitHash, s.path)
+	case s.modified:
+		prefix = "+"
+	}
+	return fmt.Sprintf("%s%s %s (%s)", prefix, s.commitHash, s.path, s.revName)
+}
+
+// Returns the state of each submodule recorded in the index (i.e. each gitlink entry), in path order
+func GetSubmoduleStates(repoDir string) ([]*SubmoduleState, error) {
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Git index file: %s", err)
+	}
+
+	states := []*SubmoduleState{}
+	for _, entry := range index.entries {
+		if entry.mode != GITLINK_MODE {
+			continue
+		}
+		if entry.stage() != 0 {
+			// Each stage of a conflicted submodule is listed once
+			if len(states) == 0 || states[len(states)-1].path != entry.path {
+				states = append(states, &SubmoduleState{path: entry.path, unmerged: true})
+			}
+			continue
+		}
+
+		state := &SubmoduleState{path: entry.path, commitHash: hex.EncodeToString(entry.sha1[:])}
+		submoduleRepoDir, err := getSubmoduleRepoDir(entry.path, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		if submoduleRepoDir != "" {
+			head, commitsExist, err := ResolveHead("", submoduleRepoDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve HEAD of submodule %s: %s", entry.path, err)
+			}
+			if commitsExist {
+				state.populated = true
+				state.modified = head != state.commitHash
+				state.commitHash = head
+				state.revName = getSubmoduleRevName(head, submoduleRepoDir)
+			}
+		}
+		states = append(states, state)
+	}
+
+	return states, nil
+}
+
+// Names the commit checked out in a submodule as Git does, trying each of these in turn: the most recent annotated
+// tag reachable from it, the most recent tag of any kind, a branch whose tip is the commit (e.g. heads/main, which
+// also names a commit checked out with a detached HEAD, as after submodule update), and finally the abbreviated hash
+// of the commit
+func getSubmoduleRevName(commitHash string, submoduleRepoDir string) string {
+	for _, options := range []DescribeOptions{{}, {tags: true}} {
+		if description, err := Describe(commitHash, options, submoduleRepoDir); err == nil {
+			return description
+		}
+	}
+
+	branchNames, _ := ListBranches("", submoduleRepoDir)
+	for _, branchName := range branchNames {
+		if branchHash, exists, err := ResolveBranchRef(branchName, "", submoduleRepoDir); err == nil && exists && branchHash == commitHash {
+			return "heads/" + branchName
+		}
+	}
+	return abbreviateHash(commitHash)
+}
+
+// Represents a submodule as configured in the .gitmodules file at the top level of the working tree
+type SubmoduleConfig struct {
+	name string
+	path string
+	url  string // As given in .gitmodules, which may be relative to the superproject's remote (e.g. ../lib.git)
+}
+
+// Reads the submodules configured in .gitmodules, keyed by path. As in Git, submodules without a path are ignored.
+func readGitmodules(repoDir string) (map[string]*SubmoduleConfig, error) {
+	gitmodules, err := readConfigFile(filepath.Join(repoDir, ".gitmodules"), ConfigScopeLocal, getGitDir(repoDir), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .gitmodules: %s", err)
+	}
+
+	submodulesByName := make(map[string]*SubmoduleConfig)
+	for _, entry := range gitmodules.entries {
+		if entry.section != "submodule" || entry.subsection == "" {
+			continue
+		}
+		submodule, exists := submodulesByName[entry.subsection]
+		if !exists {
+			submodule = &SubmoduleConfig{name: entry.subsection}
+			submodulesByName[entry.subsection] = submodule
+		}
+
+		switch entry.key {
+		case "path":
+			submodule.path = strings.TrimSuffix(filepath.ToSlash(entry.value), "/")
+		case "url":
+			submodule.url = entry.value
+		}
+	}
+
+	submodules := make(map[string]*SubmoduleConfig)
+	for _, submodule := range submodulesByName {
+		if submodule.path != "" {
+			submodules[submodule.path] = submodule
+		}
+	}
+	return submodules, nil
+}
+
+// Returns the paths and recorded commits of the submodules in the index, in path order, along with their
+// configuration in .gitmodules. As in Git, it's an error for a submodule to be missing from .gitmodules.
+func getIndexSubmodules(repoDir string) ([]*SubmoduleConfig, []string, error) {
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read Git index file: %s", err)
+	}
+
+	gitmodules, err := readGitmodules(repoDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	submodules, commitHashes := []*SubmoduleConfig{}, []string{}
+	for _, entry := range index.entries {
+		if entry.mode != GITLINK_MODE || entry.stage() != 0 {
+			continue
+		}
+
+		submodule, configured := gitmodules[entry.path]
+		if !configured {
+			return nil, nil, fmt.Errorf("no submodule mapping found in .gitmodules for path '%s'", entry.path)
+		}
+		submodules = append(submodules, submodule)
+		commitHashes = append(commitHashes, hex.EncodeToString(entry.sha1[:]))
+	}
+
+	return submodules, commitHashes, nil
+}
+
+// Registers the URL of each submodule in the index in the repository's config, as submodule.<name>.url, which marks
+// it as active so that UpdateSubmodules populates it. Relative URLs are resolved against the URL of the superproject's
+// default remote. Submodules which are already registered are left as they are, so that their URLs can be changed
+// locally.
+func InitSubmodules(repoDir string) error {
+	submodules, _, err := getIndexSubmodules(repoDir)
+	if err != nil {
+		return err
+	}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read repository config: %s", err)
+	}
+
+	for _, submodule := range submodules {
+		urlName := fmt.Sprintf("submodule.%s.url", submodule.name)
+		if _, isRegistered := config.get(urlName); isRegistered {
+			continue
+		}
+		if submodule.url == "" {
+			return fmt.Errorf("no url found for submodule path '%s' in .gitmodules", submodule.path)
+		}
+
+		submoduleURL, err := resolveSubmoduleURL(submodule.url, repoDir)
+		if err != nil {
+			return err
+		}
+		if err := setConfigValue(getRepoConfigPath(repoDir), urlName, submoduleURL); err != nil {
+			return fmt.Errorf("failed to register submodule %s: %s", submodule.name, err)
+		}
+		fmt.Printf("Submodule '%s' (%s) registered for path '%s'\n", submodule.name, submoduleURL, submodule.path)
+	}
+
+	return nil
+}
+
+// Resolves a submodule URL from .gitmodules. As in Git, a URL starting with ./ or ../ is relative to the URL of the
+// superproject's default remote, e.g. ../lib.git next to https://github.com/user/app.git is
+// https://github.com/user/lib.git.
+func resolveSubmoduleURL(submoduleURL string, repoDir string) (string, error) {
+	if !strings.HasPrefix(submoduleURL, "./") && !strings.HasPrefix(submoduleURL, "../") {
+		return submoduleURL, nil
+	}
+
+	remoteURL, err := resolveRemoteURL("", repoDir)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve relative submodule URL %s: %s", submoduleURL, err)
+	}
+	parsedURL, err := url.Parse(normalizeRemoteURL(remoteURL))
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve relative submodule URL %s: invalid remote URL %s", submoduleURL, remoteURL)
+	}
+
+	parsedURL.Path = path.Join(parsedURL.Path, submoduleURL)
+	return parsedURL.String(), nil
+}
+
+// Populates each registered submodule in the index (see InitSubmodules) which isn't yet at its recorded commit. A
+// submodule which hasn't been populated is cloned from its registered URL, with its Git directory kept in the
+// superproject's .git/modules/<name>/ (so that it survives the submodule's directory being removed), and its .git being
+// a file pointing there, as in Git. The recorded commit is then checked out in the submodule, with HEAD detached at
+// it, fetching it from the submodule's remote if needed. Submodules with local changes, which checking out would
+// overwrite, are refused.
+func UpdateSubmodules(repoDir string) error {
+	submodules, commitHashes, err := getIndexSubmodules(repoDir)
+	if err != nil {
+		return err
+	}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read repository config: %s", err)
+	}
+
+	for i, submodule := range submodules {
+		submoduleURL, isRegistered := config.get(fmt.Sprintf("submodule.%s.url", submodule.name))
+		if !isRegistered {
+			continue
+		}
+		if err := updateSubmodule(submodule, submoduleURL, commitHashes[i], repoDir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func updateSubmodule(submodule *SubmoduleConfig, submoduleURL string, commitHash string, repoDir string) error {
+	submoduleRepoDir, err := getSubmoduleRepoDir(submodule.path, repoDir)
+	if err != nil {
+		return err
+	}
+
+	if submoduleRepoDir == "" {
+		submoduleRepoDir, err = createSubmoduleRepo(submodule, submoduleURL, repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to clone submodule path '%s': %s", submodule.path, err)
+		}
+	} else {
+		head, _, err := ResolveHead("", submoduleRepoDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve HEAD of submodule %s: %s", submodule.path, err)
+		}
+		if head == commitHash {
+			return nil
+		}
+
+		status, err := GetRepoStatus(IgnoreSubmodulesNone, submoduleRepoDir)
+		if err != nil {
+			return fmt.Errorf("failed to determine status of submodule %s: %s", submodule.path, err)
+		}
+		if len(status.stagedFiles) > 0 || len(status.notStagedFiles) > 0 || len(status.untrackedFiles) > 0 || len(status.unmergedFiles) > 0 {
+			return fmt.Errorf("unable to checkout '%s' in submodule path '%s': its local changes would be overwritten", commitHash, submodule.path)
+		}
+	}
+
+	if !objectExists(commitHash, submoduleRepoDir) {
+		if err := fetchSubmodule(submoduleURL, submoduleRepoDir); err != nil {
+			return fmt.Errorf("failed to fetch submodule path '%s': %s", submodule.path, err)
+		}
+		if !objectExists(commitHash, submoduleRepoDir) {
+			return fmt.Errorf("fetched in submodule path '%s', but it did not contain %s", submodule.path, commitHash)
+		}
+	}
+
+	if err := CheckoutCommit(commitHash, false, submoduleRepoDir); err != nil {
+		return fmt.Errorf("unable to checkout '%s' in submodule path '%s': %s", commitHash, submodule.path, err)
+	}
+	if err := DetachHead(commitHash, submoduleRepoDir); err != nil {
+		return err
+	}
+
+	fmt.Printf("Submodule path '%s': checked out '%s'\n", submodule.path, commitHash)
+	return nil
+}
+
+// Creates the repository of a submodule which hasn't been populated, with its Git directory in the superproject's
+// .git/modules/<name>/ (reusing it if it already exists) and the given URL as its origin remote. Returns the top-level
+// directory of the submodule.
+func createSubmoduleRepo(submodule *SubmoduleConfig, submoduleURL string, repoDir string) (string, error) {
+	submoduleDir, err := filepath.Abs(filepath.Join(repoDir, filepath.FromSlash(submodule.path)))
+	if err != nil {
+		return "", err
+	}
+	moduleGitDir, err := filepath.Abs(filepath.Join(getCommonDir(repoDir), "modules", filepath.FromSlash(submodule.name)))
+	if err != nil {
+		return "", err
+	}
+
+	isNewRepo := !isGitDir(moduleGitDir)
+	if isNewRepo {
+		fmt.Printf("Cloning into '%s'...\n", submoduleDir)
+		if _, err := initRepo(moduleGitDir, InitOptions{bare: true}); err != nil {
+			return "", err
+		}
+
+		// The Git directory is laid out like a bare repository's, but it has a working tree, which real Git finds via
+		// core.worktree
+		workTree, err := filepath.Rel(moduleGitDir, submoduleDir)
+		if err != nil {
+			return "", err
+		}
+		configPath := filepath.Join(moduleGitDir, "config")
+		if err := setConfigValue(configPath, "core.bare", "false"); err != nil {
+			return "", err
+		}
+		if err := setConfigValue(configPath, "core.worktree", filepath.ToSlash(workTree)); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(submoduleDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create submodule directory: %s", err)
+	}
+	relGitDir, err := filepath.Rel(submoduleDir, moduleGitDir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(submoduleDir, ".git"), []byte("gitdir: "+filepath.ToSlash(relGitDir)+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write .git file of submodule: %s", err)
+	}
+
+	// Finding the submodule's repository registers its Git directory, so that it's used for the working tree
+	submoduleRepo, err := discoverRepo(submoduleDir)
+	if err != nil {
+		return "", err
+	}
+	if submoduleRepo == nil || submoduleRepo.gitDir != moduleGitDir {
+		return "", fmt.Errorf("failed to set up Git directory %s for submodule", moduleGitDir)
+	}
+
+	if isNewRepo {
+		if err := addRemote(DEFAULT_REMOTE_NAME, submoduleURL, "", submoduleRepo.repoDir); err != nil {
+			return "", err
+		}
+	}
+	return submoduleRepo.repoDir, nil
+}
+
+// Fetches every branch of the submodule's remote into its repository, updating its remote-tracking branches. A newly
+// created repository has its local branches created in the same way as cloning, while those of one which has already
+// been checked out are left alone.
+func fetchSubmodule(submoduleURL string, submoduleRepoDir string) error {
+	remoteRefs, err := refDiscovery(submoduleURL)
+	if err != nil {
+		return fmt.Errorf("failed to perform reference discovery on the remote repository: %s", err)
+	}
+	if len(remoteRefs.refs) == 0 {
+		return nil
+	}
+
+	if err := fetchObjects(submoduleURL, remoteRefs, getDefaultWants(remoteRefs), "", true, submoduleRepoDir); err != nil {
+		return fmt.Errorf("failed to fetch objects: %s", err)
+	}
+
+	_, commitsExist, err := ResolveHead("", submoduleRepoDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve HEAD of submodule: %s", err)
+	}
+	remoteBranches := remoteRefs.branches()
+	if err := updateRefsAfterPull(remoteBranches, DEFAULT_REMOTE_NAME, !commitsExist, submoduleRepoDir); err != nil {
+		return err
+	}
+	if remoteHeadBranch, hasHeadBranch := remoteRefs.headBranch(); hasHeadBranch {
+		if _, fetched := remoteBranches[remoteHeadBranch]; fetched {
+			return UpdateHeadWithBranchRef(remoteHeadBranch, DEFAULT_REMOTE_NAME, submoduleRepoDir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+type SynthSizeDistribution int
+
+const (
+	SynthSizeUniform     SynthSizeDistribution = iota // File sizes are spread evenly between the minimum and maximum
+	SynthSizeExponential                              // Most files are small, with a long tail of larger ones, as in real repositories
+)
+
+func parseSynthSizeDistribution(name string) (SynthSizeDistribution, error) {
+	switch name {
+	case "uniform":
+		return SynthSizeUniform, nil
+	case "exponential":
+		return SynthSizeExponential, nil
+	default:
+		return -1, fmt.Errorf("unknown size distribution: %s", name)
+	}
+}
+
+// The time of the first synthetic commit (2023-11-14T22:13:20Z). Each subsequent commit is a minute later, so that
+// the same options always generate objects with the same hashes.
+const SYNTH_REPO_START_TIME = 1700000000
+
+// The number of files placed in each directory of a synthetic repository
+const SYNTH_REPO_FILES_PER_DIR = 16
+
+// Represents the shape of a synthetic repository generated by synth-repo
+type SynthRepoOptions struct {
+	files            int // The number of files in the repository
+	minFileSize      int // In bytes
+	maxFileSize      int // In bytes
+	sizeDistribution SynthSizeDistribution
+	commits          int  // The number of commits on the initial branch, not counting merges
+	branches         int  // The number of topic branches, each forked from a random commit on the initial branch
+	branchCommits    int  // The number of commits on each topic branch
+	merge            bool // Whether to merge each topic branch back into the initial branch
+	seed             int64
+}
+
+// Represents a file of a synthetic repository. Modifying a file replaces it rather than changing it in place, so the
+// sets of files on different branches can share files.
+type synthFile struct {
+	lines []string
+	hash  string
+}
+
+type synthRepoGenerator struct {
+	options SynthRepoOptions
+	rand    *rand.Rand
+	time    int64 // The time of the next commit
+	repoDir string
+}
+
+// Generates a synthetic repository in repoDir (which must not already contain one) directly through the object
+// store, e.g. as a reproducible fixture for benchmarks and stress tests. The files of the initial branch's last
+// commit (or merge) are then checked out. Returns the hash of the commit which HEAD points to.
+func GenerateSynthRepo(options SynthRepoOptions, repoDir string) (string, error) {
+	if options.files < 1 || options.commits < 1 || options.branches < 0 || options.branchCommits < 1 {
+		return "", fmt.Errorf("a repository needs at least one file and one commit, and each branch at least one commit")
+	}
+	if options.minFileSize < 0 || options.maxFileSize < options.minFileSize {
+		return "", fmt.Errorf("invalid file size range: %d to %d bytes", options.minFileSize, options.maxFileSize)
+	}
+
+	if fileExists(getGitDir(repoDir)) {
+		return "", fmt.Errorf("a repository already exists in %s", repoDir)
+	}
+	if _, err := initRepo(repoDir, InitOptions{}); err != nil {
+		return "", err
+	}
+
+	generator := &synthRepoGenerator{
+		options: options,
+		rand:    rand.New(rand.NewSource(options.seed)),
+		time:    SYNTH_REPO_START_TIME,
+		repoDir: repoDir,
+	}
+
+	// Each topic branch forks from a random commit on the initial branch, possibly the same one as another branch
+	forkPoints := make([]int, options.branches)
+	for i := range forkPoints {
+		forkPoints[i] = generator.rand.Intn(options.commits)
+	}
+
+	files := make(map[string]*synthFile, options.files)
+	for i := 0; i < options.files; i++ {
+		path := fmt.Sprintf("dir%03d/file%05d.txt", i/SYNTH_REPO_FILES_PER_DIR, i)
+		file, err := generator.createFile(generator.generateLines(generator.fileSize()))
+		if err != nil {
+			return "", err
+		}
+		files[path] = file
+	}
+
+	head := ""
+	branchStarts := make([]map[string]*synthFile, options.branches)
+	branchBases := make([]string, options.branches)
+	for i := 0; i < options.commits; i++ {
+		if i > 0 {
+			var err error
+			if files, err = generator.modifyFiles(files); err != nil {
+				return "", err
+			}
+		}
+
+		var parents []string
+		if head != "" {
+			parents = []string{head}
+		}
+		var err error
+		head, err = generator.commit(files, parents, fmt.Sprintf("Synthetic commit %d", i+1))
+		if err != nil {
+			return "", err
+		}
+
+		for branch, forkPoint := range forkPoints {
+			if forkPoint == i {
+				branchStarts[branch], branchBases[branch] = files, head
+			}
+		}
+	}
+
+	for branch := range forkPoints {
+		branchFiles, branchHead := branchStarts[branch], branchBases[branch]
+		for i := 0; i < options.branchCommits; i++ {
+			var err error
+			if branchFiles, err = generator.modifyFiles(branchFiles); err != nil {
+				return "", err
+			}
+			branchHead, err = generator.commit(branchFiles, []string{branchHead}, fmt.Sprintf("Synthetic commit %d on topic-%d", i+1, branch+1))
+			if err != nil {
+				return "", err
+			}
+		}
+
+		branchName := fmt.Sprintf("topic-%d", branch+1)
+		if err := UpdateBranchRef(branchName, branchHead, "", repoDir); err != nil {
+			return "", fmt.Errorf("failed to create branch %s: %s", branchName, err)
+		}
+
+		if options.merge {
+			// Where both branches changed a file, the topic branch's version wins
+			files = mergeSynthFiles(files, branchStarts[branch], branchFiles)
+			var err error
+			head, err = generator.commit(files, []string{head, branchHead}, fmt.Sprintf("Merge branch '%s'", branchName))
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if err := UpdateCurrentBranchRef(head, "", repoDir); err != nil {
+		return "", fmt.Errorf("failed to update current branch: %s", err)
+	}
+
+	commitObj, err := ReadCommitObjectFile(head, repoDir)
+	if err != nil {
+		return "", err
+	}
+	converter, err := newTreeContentConverter(commitObj.treeHash, repoDir)
+	if err != nil {
+		return "", err
+	}
+	if err := checkoutTree(commitObj.treeHash, repoDir, converter, repoDir, make(map[string]string)); err != nil {
+		return "", err
+	}
+	if err := createIndexFromWorkingTree(converter, repoDir); err != nil {
+		return "", err
+	}
+
+	return head, nil
+}
+
+// Picks the size of a new file, in bytes
+func (g *synthRepoGenerator) fileSize() int {
+	sizeRange := g.options.maxFileSize - g.options.minFileSize
+	switch g.options.sizeDistribution {
+	case SynthSizeExponential:
+		// The mean size is an eighth of the way through the range
+		return g.options.minFileSize + min(sizeRange, int(g.rand.ExpFloat64()*float64(sizeRange)/8))
+	default:
+		return g.options.minFileSize + g.rand.Intn(sizeRange+1)
+	}
+}
+
+// Generates lines of random lowercase words adding up to roughly the given number of bytes
+func (g *synthRepoGenerator) generateLines(size int) []string {
+	lines := []string{}
+	for size > 0 {
+		line := g.generateLine()
+		lines = append(lines, line)
+		size -= len(line) + 1
+	}
+	return lines
+}
+
+func (g *synthRepoGenerator) generateLine() string {
+	words := make([]string, 1+g.rand.Intn(10))
+	for i := range words {
+		word := make([]byte, 1+g.rand.Intn(8))
+		for j := range word {
+			word[j] = byte('a' + g.rand.Intn(26))
+		}
+		words[i] = string(word)
+	}
+	return strings.Join(words, " ")
+}
+
+func (g *synthRepoGenerator) createFile(lines []string) (*synthFile, error) {
+	content := ""
+	if len(lines) > 0 {
+		content = strings.Join(lines, "\n") + "\n"
+	}
+
+	hash, err := CreateObjectFile(Blob, []byte(content), g.repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create blob object: %s", err)
+	}
+	return &synthFile{lines: lines, hash: hash}, nil
+}
+
+// Returns a copy of the files in which about a tenth of them (but at least one) have had a line replaced, inserted,
+// or deleted
+func (g *synthRepoGenerator) modifyFiles(files map[string]*synthFile) (map[string]*synthFile, error) {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	// Map iteration order is random, so the paths are sorted for the same seed to modify the same files
+	sort.Strings(paths)
+
+	modifiedFiles := make(map[string]*synthFile, len(files))
+	for path, file := range files {
+		modifiedFiles[path] = file
+	}
+
+	for _, pathIndex := range g.rand.Perm(len(paths))[:max(1, len(paths)/10)] {
+		path := paths[pathIndex]
+		lines := append([]string{}, modifiedFiles[path].lines...)
+
+		lineNum := g.rand.Intn(len(lines) + 1)
+		switch g.rand.Intn(3) {
+		case 0:
+			if lineNum < len(lines) {
+				lines[lineNum] = g.generateLine()
+				break
+			}
+			fallthrough
+		case 1:
+			lines = append(lines[:lineNum], append([]string{g.generateLine()}, lines[lineNum:]...)...)
+		default:
+			if lineNum < len(lines) {
+				lines = append(lines[:lineNum], lines[lineNum+1:]...)
+			}
+		}
+
+		file, err := g.createFile(lines)
+		if err != nil {
+			return nil, err
+		}
+		modifiedFiles[path] = file
+	}
+
+	return modifiedFiles, nil
+}
+
+// Creates the commit of the given files, authored and committed by a synthetic user one minute after the
+// previous commit
+func (g *synthRepoGenerator) commit(files map[string]*synthFile, parents []string, message string) (string, error) {
+	treeFiles := make(map[string]*DiffFileVersion, len(files))
+	for path, file := range files {
+		treeFiles[path] = &DiffFileVersion{hash: file.hash, mode: REGULAR_FILE_MODE}
+	}
+
+	treeHash, err := createTreeObjectFromFiles(treeFiles, g.repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create tree objects: %s", err)
+	}
+
+	user := CommitUser{name: "Synthetic Author", email: "synth@mygit.com", dateSeconds: g.time, timezone: "+0000"}
+	g.time += 60
+
+	commitObj, err := createCommitObject(treeHash, parents, user, user, message+"\n", g.repoDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create commit object: %s", err)
+	}
+	return commitObj.hash, nil
+}
+
+// Returns the files of the branch being merged into, with the files changed on the topic branch since it forked
+// (from the files in base) taking the topic branch's version
+func mergeSynthFiles(files map[string]*synthFile, base map[string]*synthFile, topicFiles map[string]*synthFile) map[string]*synthFile {
+	mergedFiles := make(map[string]*synthFile, len(files))
+	for path, file := range files {
+		mergedFiles[path] = file
+	}
+	for path, file := range topicFiles {
+		if base[path] != file {
+			mergedFiles[path] = file
+		}
+	}
+	return mergedFiles
+}
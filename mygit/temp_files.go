@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Temporary files (e.g. object files being written) and lock file owner records are kept in .git/objects/tmp/,
+// named <kind>_<pid>_<random> so that files left behind by a crashed process can be attributed to it
+const TEMP_FILE_DIR = "tmp"
+
+const TEMP_FILE_KIND_OBJECT = "obj"
+const TEMP_FILE_KIND_LOCK_OWNER = "lock"
+
+// Temporary and lock files which can't be attributed to a process (such as those created by real Git) are only
+// considered stale, and removed, once they're older than this
+const STALE_TEMP_FILE_AGE = time.Hour
+
+// The temporary and lock files currently held by this process, which are removed if the process is interrupted
+var activeTempFiles = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+func getTempFileDir(gitDir string) string {
+	return filepath.Join(gitDir, "objects", TEMP_FILE_DIR)
+}
+
+// Creates a new temporary file of the given kind, which is removed if this process is interrupted before it's
+// renamed into place or released with releaseTempFile
+func createTempFile(kind string, gitDir string) (*os.File, error) {
+	tempFileDir := getTempFileDir(gitDir)
+	if err := os.MkdirAll(tempFileDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temporary file directory: %s", err)
+	}
+
+	file, err := os.CreateTemp(tempFileDir, fmt.Sprintf("%s_%d_*", kind, os.Getpid()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %s", err)
+	}
+
+	trackTempFile(file.Name())
+	return file, nil
+}
+
+func trackTempFile(path string) {
+	activeTempFiles.Lock()
+	defer activeTempFiles.Unlock()
+	activeTempFiles.paths[path] = true
+}
+
+// Stops tracking the given temporary file once it's been renamed into place
+func untrackTempFile(path string) {
+	activeTempFiles.Lock()
+	defer activeTempFiles.Unlock()
+	delete(activeTempFiles.paths, path)
+}
+
+// Stops tracking the given temporary file and removes it
+func releaseTempFile(path string) {
+	activeTempFiles.Lock()
+	defer activeTempFiles.Unlock()
+	delete(activeTempFiles.paths, path)
+	os.Remove(path)
+}
+
+// Removes the temporary and lock files held by this process if it's interrupted, so that they don't block later
+// commands. Files left behind if the process crashes are instead removed by cleanStaleTempFiles.
+func installInterruptCleanup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		activeTempFiles.Lock()
+		for path := range activeTempFiles.paths {
+			os.Remove(path)
+		}
+		// The lock is kept so that no new temporary files are created while exiting
+
+		fmt.Fprintf(os.Stderr, "Interrupted: %s\n", sig)
+		exit(130)
+	}()
+}
+
+// Records this process as the owner of the given lock file, returning the path of the record. Returns an empty
+// path if the lock file isn't within a Git directory.
+func recordLockFileOwner(lockPath string) (string, error) {
+	gitDir, found := findEnclosingGitDir(lockPath)
+	if !found {
+		return "", nil
+	}
+
+	absLockPath, err := filepath.Abs(lockPath)
+	if err != nil {
+		return "", err
+	}
+
+	ownerFile, err := createTempFile(TEMP_FILE_KIND_LOCK_OWNER, gitDir)
+	if err != nil {
+		return "", err
+	}
+	defer ownerFile.Close()
+
+	if _, err := ownerFile.WriteString(absLockPath); err != nil {
+		releaseTempFile(ownerFile.Name())
+		return "", fmt.Errorf("failed to record owner of lock file %s: %s", lockPath, err)
+	}
+
+	return ownerFile.Name(), nil
+}
+
+func findEnclosingGitDir(path string) (string, bool) {
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if filepath.Base(dir) == ".git" || isSeparateGitDir(dir) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// Parses the ID of the process which created a temporary file from its name, e.g. obj_1234_5678
+func parseTempFileOwner(name string) (int, bool) {
+	parts := strings.SplitN(name, "_", 3)
+	if len(parts) != 3 {
+		return -1, false
+	}
+
+	pid, err := strconv.Atoi(parts[1])
+	if err != nil || pid <= 0 {
+		return -1, false
+	}
+	return pid, true
+}
+
+func isProcessAlive(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+
+	// Signal 0 checks for the process's existence without sending a signal. EPERM means that the process exists
+	// but belongs to another user.
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Removes the temporary and lock files left behind by crashed processes, so that a crash (e.g. in the middle of a
+// clone) can't permanently wedge the repository. A file owned by a process which is no longer running is stale, as
+// is a file which can't be attributed to any process and is older than STALE_TEMP_FILE_AGE. Returns the number of
+// files removed.
+func cleanStaleTempFiles(gitDir string) (int, error) {
+	tempFileDir := getTempFileDir(gitDir)
+	tempFileEntries, err := os.ReadDir(tempFileDir)
+	if err != nil && !os.IsNotExist(err) {
+		return -1, fmt.Errorf("failed to read temporary file directory: %s", err)
+	}
+
+	numRemoved := 0
+	liveLockPaths := make(map[string]bool)
+	deadLockPaths := []string{}
+
+	for _, entry := range tempFileEntries {
+		path := filepath.Join(tempFileDir, entry.Name())
+		pid, hasOwner := parseTempFileOwner(entry.Name())
+
+		if strings.HasPrefix(entry.Name(), TEMP_FILE_KIND_LOCK_OWNER+"_") && hasOwner {
+			lockPath, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+
+			if isProcessAlive(pid) {
+				liveLockPaths[string(lockPath)] = true
+				continue
+			}
+			deadLockPaths = append(deadLockPaths, string(lockPath))
+		} else if hasOwner && isProcessAlive(pid) {
+			continue
+		} else if !hasOwner && !isOlderThan(path, STALE_TEMP_FILE_AGE) {
+			continue
+		}
+
+		if os.Remove(path) == nil {
+			numRemoved += 1
+		}
+	}
+
+	// A lock file whose owner has died is removed, unless it's since been acquired by a live process
+	for _, lockPath := range deadLockPaths {
+		if liveLockPaths[lockPath] {
+			continue
+		}
+		if os.Remove(lockPath) == nil {
+			numRemoved += 1
+		}
+	}
+
+	// Lock files without an owner record (e.g. left behind by real Git) are removed once they're old enough
+	lockPaths, err := findLockFiles(gitDir)
+	if err != nil {
+		return numRemoved, err
+	}
+	for _, lockPath := range lockPaths {
+		if liveLockPaths[lockPath] || !isOlderThan(lockPath, STALE_TEMP_FILE_AGE) {
+			continue
+		}
+		if os.Remove(lockPath) == nil {
+			numRemoved += 1
+		}
+	}
+
+	return numRemoved, nil
+}
+
+// Returns the absolute paths of the lock files for the files directly within the .git directory (e.g. the index
+// and config) and for refs
+func findLockFiles(gitDir string) ([]string, error) {
+	absGitDir, err := filepath.Abs(gitDir)
+	if err != nil {
+		return nil, err
+	}
+
+	lockPaths, err := filepath.Glob(filepath.Join(absGitDir, "*"+LOCK_FILE_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.WalkDir(filepath.Join(absGitDir, "refs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, LOCK_FILE_SUFFIX) {
+			lockPaths = append(lockPaths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for ref lock files: %s", err)
+	}
+
+	return lockPaths, nil
+}
+
+func isOlderThan(path string, age time.Duration) bool {
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) > age
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The prefix of the notes refs in which the output of textconv drivers with diff.<driver>.cachetextconv set is
+// cached, e.g. refs/notes/textconv/pdf. As in Git, each note is a blob of converted text, named by the hash of the
+// blob it was converted from, and the notes commit's message is the command that produced it.
+const TEXTCONV_NOTES_REF_PREFIX = "refs/notes/textconv/"
+
+const TEMP_FILE_KIND_TEXTCONV = "textconv"
+
+// Represents a textconv driver, configured by the diff.<driver>.textconv config variable and given to paths by the
+// `diff=<driver>` attribute, which converts files (e.g. PDFs or images) into text to be shown in their place
+type TextconvDriver struct {
+	name    string
+	command string
+	cache   bool // Whether the output is cached in the driver's notes ref (diff.<driver>.cachetextconv)
+}
+
+// Represents the textconv cache of a driver, loaded from its notes ref. New conversions are added to the cache in
+// memory and written out together by saveCaches.
+type TextconvCache struct {
+	refName    string
+	refHash    string            // The notes commit the ref pointed to when loaded, or NULL_OBJECT_HASH if none
+	commitHash string            // The notes commit the cache was loaded from, or empty if there wasn't a usable one
+	notes      map[string]string // Maps the hash of each converted blob to the hash of the blob of its text
+	modified   bool
+}
+
+// Converts the files of a repository with their textconv drivers, as determined by its attributes and config
+type Textconv struct {
+	attributes *Attributes
+	config     *Config
+	caches     map[string]*TextconvCache
+	repoDir    string
+}
+
+func newTextconv(repoDir string) (*Textconv, error) {
+	attributes, err := readAttributes(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attributes: %s", err)
+	}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %s", err)
+	}
+
+	return &Textconv{attributes: attributes, config: config, caches: map[string]*TextconvCache{}, repoDir: repoDir}, nil
+}
+
+// Returns the textconv driver for the given path, or nil if it doesn't have one
+func (t *Textconv) getDriver(path string) (*TextconvDriver, error) {
+	driverName, isSpecified := t.attributes.get(path, "diff")
+	if !isSpecified || driverName == ATTRIBUTE_SET || driverName == ATTRIBUTE_UNSET {
+		return nil, nil
+	}
+
+	command, isSet := t.config.get(fmt.Sprintf("diff.%s.textconv", driverName))
+	if !isSet || command == "" {
+		return nil, nil
+	}
+
+	cache, err := t.config.getBool(fmt.Sprintf("diff.%s.cachetextconv", driverName), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TextconvDriver{name: driverName, command: command, cache: cache}, nil
+}
+
+// Converts the content of the file at the given path with its textconv driver, returning the content unchanged if the
+// file doesn't have one. blobHash is the hash of the content if it's stored as a blob, or empty if it's read from the
+// working tree, in which case the output is never cached.
+func (t *Textconv) convert(path string, content []byte, blobHash string) ([]byte, error) {
+	driver, err := t.getDriver(path)
+	if err != nil || driver == nil {
+		return content, err
+	}
+
+	var cache *TextconvCache
+	if driver.cache && blobHash != "" {
+		cache, err = t.getCache(driver)
+		if err != nil {
+			return nil, err
+		}
+
+		if textHash, exists := cache.notes[blobHash]; exists {
+			blobObj, err := ReadBlobObjectFile(textHash, t.repoDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read cached textconv output for %s: %s", path, err)
+			}
+			return blobObj.content, nil
+		}
+	}
+
+	text, err := runTextconv(driver, content, t.repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s: %s", path, err)
+	}
+
+	if cache != nil {
+		textHash, err := CreateObjectFile(Blob, text, t.repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to cache textconv output for %s: %s", path, err)
+		}
+		cache.notes[blobHash] = textHash
+		cache.modified = true
+	}
+
+	return text, nil
+}
+
+// Runs the driver's command on the content, which is written to a temporary file whose path is given to the command
+// as its last argument, as in Git. Returns the command's output.
+func runTextconv(driver *TextconvDriver, content []byte, repoDir string) ([]byte, error) {
+	tempFile, err := createTempFile(TEMP_FILE_KIND_TEXTCONV, getGitDir(repoDir))
+	if err != nil {
+		return nil, err
+	}
+	defer releaseTempFile(tempFile.Name())
+
+	_, err = tempFile.Write(content)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write temporary file: %s", err)
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", driver.command+` "$@"`, driver.command, tempFile.Name())
+	cmd.Dir = repoDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("textconv driver '%s' exited with status %d", driver.name, exitErr.ExitCode())
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to run textconv driver '%s': %s", driver.name, err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// Returns the driver's textconv cache, loading it from its notes ref the first time. A cache written by a different
+// command than the driver's current one is discarded.
+func (t *Textconv) getCache(driver *TextconvDriver) (*TextconvCache, error) {
+	if cache, exists := t.caches[driver.name]; exists {
+		return cache, nil
+	}
+
+	refName := TEXTCONV_NOTES_REF_PREFIX + driver.name
+	commitHash, exists, err := resolveRef(refName, t.repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %s", refName, err)
+	}
+
+	cache := &TextconvCache{refName: refName, refHash: NULL_OBJECT_HASH, notes: map[string]string{}}
+	t.caches[driver.name] = cache
+	if !exists {
+		return cache, nil
+	}
+	cache.refHash = commitHash
+
+	commitObj, err := ReadCommitObjectFile(commitHash, t.repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read textconv cache: %s", err)
+	}
+	if strings.TrimSuffix(commitObj.commitMessage, "\n") != driver.command {
+		// The cache will be replaced by a new root commit
+		return cache, nil
+	}
+	cache.commitHash = commitHash
+
+	treeObj, err := ReadTreeObjectFile(commitObj.treeHash, t.repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read textconv cache: %s", err)
+	}
+	for _, entry := range treeObj.entries {
+		cache.notes[entry.name] = entry.hash
+	}
+
+	return cache, nil
+}
+
+// Writes out any textconv caches which have had conversions added to them, each as a new notes commit
+func (t *Textconv) saveCaches() error {
+	for driverName, cache := range t.caches {
+		if !cache.modified {
+			continue
+		}
+
+		entries := make([]TreeObjectEntry, 0, len(cache.notes))
+		for blobHash, textHash := range cache.notes {
+			entries = append(entries, TreeObjectEntry{hash: textHash, mode: REGULAR_FILE_MODE, name: blobHash, objType: Blob})
+		}
+		treeObj, err := createTreeObject(entries, t.repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to create textconv cache tree: %s", err)
+		}
+
+		user, err := getCommitUser(CommitCommitter, t.repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to determine textconv cache committer: %s", err)
+		}
+
+		parents := []string{}
+		if cache.commitHash != "" {
+			parents = append(parents, cache.commitHash)
+		}
+		command, _ := t.config.get(fmt.Sprintf("diff.%s.textconv", driverName))
+		commitObj, err := createCommitObject(treeObj.hash, parents, *user, *user, command+"\n", t.repoDir)
+		if err != nil {
+			return fmt.Errorf("failed to create textconv cache commit: %s", err)
+		}
+
+		// The ref must still point to the notes commit it was loaded from, so that a cache written concurrently
+		// isn't overwritten
+		if err := UpdateRef(cache.refName, commitObj.hash, cache.refHash, t.repoDir); err != nil {
+			return fmt.Errorf("failed to update %s: %s", cache.refName, err)
+		}
+
+		cache.refHash, cache.commitHash = commitObj.hash, commitObj.hash
+		cache.modified = false
+	}
+
+	return nil
+}
+
+// Resolves an object name of the form <tree-ish>:<path>, as given to cat-file --textconv, to the hash of the blob at
+// that path. The tree-ish is HEAD or the hash of a commit or tree, or if it's empty, the blob is looked up in the
+// index instead.
+func resolveBlobPath(objectName string, repoDir string) (string, string, error) {
+	treeish, path, found := strings.Cut(objectName, ":")
+	if !found || path == "" {
+		return "", "", fmt.Errorf("<object> must be of the form <tree-ish>:<path>: %s", objectName)
+	}
+
+	if treeish == "" {
+		index, err := readIndexFile(repoDir)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read Git index file: %s", err)
+		}
+		for _, entry := range index.entries {
+			if entry.path == path && entry.stage() == 0 {
+				return hex.EncodeToString(entry.sha1[:]), path, nil
+			}
+		}
+		return "", "", fmt.Errorf("path '%s' is not in the index", path)
+	}
+
+	treeHash, err := resolveTreeish(treeish, repoDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	blobHash, exists, err := findFileInTree(treeHash, path, repoDir)
+	if err != nil {
+		return "", "", err
+	} else if !exists {
+		return "", "", fmt.Errorf("path '%s' does not exist in '%s'", path, treeish)
+	}
+	return blobHash, path, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The version of the format of the events written by --trace-json, which is raised only if an existing field is
+// removed or changes meaning (new events and fields may be added without raising it)
+const TRACE_JSON_VERSION = 1
+
+// Represents the JSON event log of a command, enabled by --trace-json (or the GIT_TRACE_JSON environment variable),
+// through which wrappers, editors, and CI systems can follow what the command does without parsing its output. Each
+// event is a single line holding a JSON object, with the kind of event in its "event" field and the time it happened
+// in its "time" field:
+//
+//   - start: the command is starting, with its "argv", "command", "pid", and the "version" of the event format
+//   - ref_update: a ref was changed, with its "ref" name and its "old" and "new" object hashes (the all-zero hash if it
+//     didn't exist before, or was deleted)
+//   - error: the command failed, with the error "message" it printed
+//   - exit: the command is exiting, with its exit "code", its "elapsed_ms", the numbers of "objects_read" and
+//     "objects_written", and the "bytes_received" from and "bytes_sent" to remote repositories
+type Tracer struct {
+	mu             sync.Mutex
+	output         io.Writer // Where events are written, or nil if tracing isn't enabled
+	start          time.Time
+	exited         bool
+	objectsRead    atomic.Int64
+	objectsWritten atomic.Int64
+}
+
+// The event log of the command, which does nothing until it's started by startTrace
+var trace = &Tracer{}
+
+// Starts writing the command's events to the given target: either a file descriptor (e.g. 2 for standard error) or
+// the path of a file, which events are appended to. As in Git's tracing, failing to open the target isn't fatal.
+func startTrace(target string, argv []string) {
+	if target == "" {
+		return
+	}
+
+	var output io.Writer
+	if fd, err := strconv.Atoi(target); err == nil {
+		if fd < 1 {
+			fmt.Fprintf(os.Stderr, "warning: invalid --trace-json file descriptor: %s\n", target)
+			return
+		}
+		output = os.NewFile(uintptr(fd), "trace-json")
+	} else {
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: could not open '%s' for tracing: %s\n", target, err)
+			return
+		}
+		output = file
+	}
+
+	trace.mu.Lock()
+	trace.output, trace.start = output, time.Now()
+	trace.mu.Unlock()
+
+	command := ""
+	if len(argv) > 1 {
+		command = argv[1]
+	}
+	trace.emit("start", map[string]any{"version": TRACE_JSON_VERSION, "argv": argv, "command": command, "pid": os.Getpid()})
+}
+
+// Writes an event with the given fields, as a single write so that the events of concurrent commands tracing to the
+// same file don't interleave
+func (t *Tracer) emit(event string, fields map[string]any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.output == nil || t.exited {
+		return
+	}
+
+	fields["event"] = event
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	t.output.Write(append(line, '\n'))
+}
+
+func (t *Tracer) objectRead() {
+	t.objectsRead.Add(1)
+}
+
+func (t *Tracer) objectWritten() {
+	t.objectsWritten.Add(1)
+}
+
+// Records a change to a ref, where an empty hash means that the ref didn't exist before, or was deleted
+func (t *Tracer) refUpdate(refName string, oldHash string, newHash string) {
+	if oldHash == "" {
+		oldHash = NULL_OBJECT_HASH
+	}
+	if newHash == "" {
+		newHash = NULL_OBJECT_HASH
+	}
+	t.emit("ref_update", map[string]any{"ref": refName, "old": oldHash, "new": newHash})
+}
+
+// Records that the command is exiting with the given code, along with what it did. Only the first exit is recorded.
+func (t *Tracer) exit(code int) {
+	t.emit("exit", map[string]any{
+		"code":            code,
+		"elapsed_ms":      time.Since(t.start).Milliseconds(),
+		"objects_read":    t.objectsRead.Load(),
+		"objects_written": t.objectsWritten.Load(),
+		"bytes_received":  transferStats.bytesReceived,
+		"bytes_sent":      transferStats.bytesSent,
+	})
+
+	t.mu.Lock()
+	t.exited = true
+	t.mu.Unlock()
+}
+
+// Exits the command with the given code, recording it in the event log first
+func exit(code int) {
+	stopPager()
+	trace.exit(code)
+	os.Exit(code)
+}
+
+// Receives the messages of log.Fatal, which every command uses to report the error that it's failing with. Each is
+// printed to standard error and recorded as an error event, followed by the exit event, since log.Fatal then exits
+// with code 1 without returning.
+type TraceLogWriter struct{}
+
+func (w TraceLogWriter) Write(p []byte) (int, error) {
+	stopPager()
+	n, err := os.Stderr.Write(p)
+	trace.emit("error", map[string]any{"message": strings.TrimRight(string(p), "\n")})
+	trace.exit(1)
+	return n, err
+}
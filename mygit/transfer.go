@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Represents the limits on the speed of transfers to and from remote repositories, which keep them polite on
+// constrained links and abort them when they stall
+type TransferLimits struct {
+	rateLimit     int64         // The maximum speed in bytes per second (from --limit-rate), or 0 for no limit
+	lowSpeedLimit int64         // The speed in bytes per second below which a transfer is too slow, or 0 for no limit
+	lowSpeedTime  time.Duration // How long a transfer may be too slow before it's aborted
+}
+
+// The limits applied to every HTTP request made by the command, set up by loadTransferLimits
+var transferLimits TransferLimits
+
+// Sets up the limits applied to the command's transfers: the given rate limit (e.g. 100k, or "" for none), which may
+// have a k, m, or g suffix, and as in Git, the low speed limit given by http.lowSpeedLimit and http.lowSpeedTime (or
+// the GIT_HTTP_LOW_SPEED_LIMIT and GIT_HTTP_LOW_SPEED_TIME environment variables). A transfer is aborted if it's
+// slower than http.lowSpeedLimit bytes per second for http.lowSpeedTime seconds, and only if both are set.
+func loadTransferLimits(rateLimit string, repoDir string) error {
+	rate, err := parseRateLimit(rateLimit)
+	if err != nil {
+		return err
+	}
+	limits := TransferLimits{rateLimit: rate}
+
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+	lowSpeedLimit, err := config.getInt("http.lowSpeedLimit", 0)
+	if err != nil {
+		return err
+	}
+	lowSpeedSeconds, err := config.getInt("http.lowSpeedTime", 0)
+	if err != nil {
+		return err
+	}
+	for envVar, value := range map[string]*int64{"GIT_HTTP_LOW_SPEED_LIMIT": &lowSpeedLimit, "GIT_HTTP_LOW_SPEED_TIME": &lowSpeedSeconds} {
+		if envValue := os.Getenv(envVar); envValue != "" {
+			if *value, err = strconv.ParseInt(envValue, 10, 64); err != nil {
+				return fmt.Errorf("invalid %s: %s", envVar, envValue)
+			}
+		}
+	}
+	if lowSpeedLimit > 0 && lowSpeedSeconds > 0 {
+		limits.lowSpeedLimit, limits.lowSpeedTime = lowSpeedLimit, time.Duration(lowSpeedSeconds)*time.Second
+	}
+
+	transferLimits = limits
+	return nil
+}
+
+// Parses a rate limit in bytes per second, which may have a k, m, or g suffix (e.g. 100k), returning 0 for no limit if
+// it's empty
+func parseRateLimit(rateLimit string) (int64, error) {
+	if rateLimit == "" {
+		return 0, nil
+	}
+	rate, err := parseScaledInt(rateLimit)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid rate limit: %s", rateLimit)
+	}
+	return rate, nil
+}
+
+// Monitors the data sent and received by a single HTTP request, keeping it within the rate limit, and cancelling it if
+// it's slower than the low speed limit for too long
+type TransferMonitor struct {
+	limits   TransferLimits
+	start    time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+	tooSlow  atomic.Bool
+	done     chan struct{}
+}
+
+// Starts monitoring a request, which is cancelled through the given function if it's too slow
+func newTransferMonitor(limits TransferLimits, cancel context.CancelFunc) *TransferMonitor {
+	monitor := &TransferMonitor{limits: limits, start: time.Now(), done: make(chan struct{})}
+	if limits.lowSpeedLimit > 0 {
+		go monitor.watchLowSpeed(cancel)
+	}
+	return monitor
+}
+
+// Checks the speed of the transfer once a second, cancelling it if fewer than lowSpeedLimit bytes per second have been
+// transferred over the last lowSpeedTime. The time spent waiting for the server to respond counts, as in curl.
+func (m *TransferMonitor) watchLowSpeed(cancel context.CancelFunc) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	windowStart, windowStartBytes := m.start, int64(0)
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(windowStart)
+			if elapsed < m.limits.lowSpeedTime {
+				continue
+			}
+			transferred := m.total()
+			if float64(transferred-windowStartBytes)/elapsed.Seconds() < float64(m.limits.lowSpeedLimit) {
+				m.tooSlow.Store(true)
+				cancel()
+				return
+			}
+			windowStart, windowStartBytes = now, transferred
+		}
+	}
+}
+
+func (m *TransferMonitor) total() int64 {
+	return m.sent.Load() + m.received.Load()
+}
+
+// Stops monitoring the request, adding what it transferred to the command's transfer stats
+func (m *TransferMonitor) stop() {
+	close(m.done)
+	transferStats.bytesSent += m.sent.Load()
+	transferStats.bytesReceived += m.received.Load()
+	transferStats.elapsed += time.Since(m.start)
+}
+
+// Returns the error reported when the request was cancelled for being too slow, as worded by Git (and curl)
+func (m *TransferMonitor) lowSpeedError() error {
+	return fmt.Errorf("RPC failed; operation too slow. Less than %d bytes/sec transferred the last %d seconds", m.limits.lowSpeedLimit, int(m.limits.lowSpeedTime.Seconds()))
+}
+
+// Wraps the request or response body, so that the data read from it is counted (into counter) and kept within the
+// rate limit
+func (m *TransferMonitor) wrap(reader io.Reader, counter *atomic.Int64) io.Reader {
+	return &MonitoredReader{reader: reader, monitor: m, counter: counter}
+}
+
+type MonitoredReader struct {
+	reader  io.Reader
+	monitor *TransferMonitor
+	counter *atomic.Int64
+}
+
+func (r *MonitoredReader) Read(p []byte) (int, error) {
+	rateLimit := r.monitor.limits.rateLimit
+	// A rate-limited transfer is read in small chunks, so that it proceeds steadily rather than in bursts
+	if chunkSize := max(rateLimit/10, 1); rateLimit > 0 && int64(len(p)) > chunkSize {
+		p = p[:chunkSize]
+	}
+
+	n, err := r.reader.Read(p)
+	r.counter.Add(int64(n))
+
+	// Waits until the transfer as a whole is back within the rate limit
+	if rateLimit > 0 {
+		allowedElapsed := time.Duration(float64(r.monitor.total()) / float64(rateLimit) * float64(time.Second))
+		if wait := allowedElapsed - time.Since(r.monitor.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
+
+// Represents the totals of the transfers made by a command, which are summarized once it's done
+type TransferStats struct {
+	bytesSent     int64
+	bytesReceived int64
+	elapsed       time.Duration // The time spent making requests, not including processing their responses
+	numObjects    int
+	objectBytes   int64 // The total size of the objects received, once unpacked
+}
+
+// The transfer stats of the command
+var transferStats TransferStats
+
+func (s *TransferStats) addUnpacked(packStats *PackfileUnpackStats) {
+	s.numObjects += packStats.numObjects
+	s.objectBytes += packStats.objectBytes
+}
+
+// Summarizes the transfers, e.g. `Received 1.19 MiB in 2.31 s (527.31 KiB/s), sent 9.51 KiB; unpacked 130 objects,
+// 4.01 MiB (3.37x compression)`
+func (s *TransferStats) summarize() string {
+	rate := float64(0)
+	if s.elapsed > 0 {
+		rate = float64(s.bytesReceived+s.bytesSent) / s.elapsed.Seconds()
+	}
+	summary := fmt.Sprintf("Received %s in %.2f s (%s/s), sent %s", humanizeBytes(float64(s.bytesReceived)), s.elapsed.Seconds(), humanizeBytes(rate), humanizeBytes(float64(s.bytesSent)))
+
+	if s.numObjects > 0 {
+		summary += fmt.Sprintf("; unpacked %d %s, %s", s.numObjects, pluralize(s.numObjects, "object", "objects"), humanizeBytes(float64(s.objectBytes)))
+		if s.bytesReceived > 0 {
+			summary += fmt.Sprintf(" (%.2fx compression)", float64(s.objectBytes)/float64(s.bytesReceived))
+		}
+	}
+	return summary
+}
+
+// Formats a number of bytes as Git does in its progress output, e.g. 1.19 MiB
+func humanizeBytes(n float64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GiB", n/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", n/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2f KiB", n/(1<<10))
+	case n == 1:
+		return "1 byte"
+	default:
+		return fmt.Sprintf("%d bytes", int64(n))
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Represents an entry given to update-index --cacheinfo, which is added to the index as it is, without the file
+// being read from (or even existing in) the working tree
+type CacheInfo struct {
+	mode FileMode
+	hash string
+	path string
+}
+
+// The values of update-index's --cacheinfo flag, given as <mode>,<hash>,<path>, which may be repeated
+type cacheInfoFlag []*CacheInfo
+
+func (f *cacheInfoFlag) String() string {
+	return ""
+}
+
+func (f *cacheInfoFlag) Set(value string) error {
+	parts := strings.SplitN(value, ",", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return fmt.Errorf("--cacheinfo expects <mode>,<hash>,<path>")
+	}
+
+	mode, err := parseFileMode(parts[0])
+	if err != nil || !isValidMode(mode) {
+		return fmt.Errorf("invalid mode: %s", parts[0])
+	}
+	if !isValidObjectHash(parts[1]) {
+		return fmt.Errorf("invalid object hash: %s", parts[1])
+	}
+
+	*f = append(*f, &CacheInfo{mode: mode, hash: parts[1], path: parts[2]})
+	return nil
+}
+
+type UpdateIndexOptions struct {
+	add             bool         // Whether files which aren't in the index yet may be added to it
+	remove          bool         // Whether files which have been deleted from the working tree are removed from the index
+	forceRemove     bool         // Whether the files are removed from the index even if they still exist
+	refresh         bool         // Whether the stat data of every entry whose file is unchanged is refreshed
+	assumeUnchanged *bool        // If set, the files' assume-unchanged bits are set or cleared, rather than updated
+	cacheInfo       []*CacheInfo // Entries to add as they are
+}
+
+// Updates the index entries of the given paths (relative to the top level of the working tree), as git update-index
+// does, first adding any --cacheinfo entries. Each file's entry is updated with its current contents, unless its
+// assume-unchanged bit is being set or cleared instead, in which case the file must already be in the index. A file
+// which isn't in the index is only added with --add, and one which has been deleted from the working tree is only
+// removed with --remove. With --refresh, the entries of every file are then checked against the working tree, and
+// returned are messages for those which need updating (`<path>: needs update`) or have merge conflicts
+// (`<path>: needs merge`), which are otherwise left as they are.
+func UpdateIndex(paths []string, options UpdateIndexOptions, repoDir string) ([]string, error) {
+	indexLock, err := lockIndex(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	defer indexLock.rollback()
+
+	index, err := readIndexFile(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := append([]*IndexEntry{}, index.entries...)
+	findEntry := func(path string) *IndexEntry {
+		for _, entry := range entries {
+			if entry.path == path && entry.stage() == 0 {
+				return entry
+			}
+		}
+		return nil
+	}
+	isTracked := func(path string) bool {
+		for _, entry := range entries {
+			if entry.path == path {
+				return true
+			}
+		}
+		return false
+	}
+	// Replaces every entry of the path (at any stage) with the given entry, or removes them if it's nil
+	replaceEntries := func(path string, newEntry *IndexEntry) {
+		keptEntries := []*IndexEntry{}
+		for _, entry := range entries {
+			if entry.path != path {
+				keptEntries = append(keptEntries, entry)
+			}
+		}
+		if newEntry != nil {
+			keptEntries = append(keptEntries, newEntry)
+		}
+		entries = keptEntries
+	}
+
+	for _, cacheInfo := range options.cacheInfo {
+		if !isTracked(cacheInfo.path) && !options.add {
+			return nil, fmt.Errorf("%s: cannot add to the index - missing --add option?", cacheInfo.path)
+		}
+
+		entry := &IndexEntry{mode: cacheInfo.mode, path: cacheInfo.path}
+		hashBytes, _ := hex.DecodeString(cacheInfo.hash)
+		copy(entry.sha1[:], hashBytes)
+		replaceEntries(cacheInfo.path, entry)
+	}
+
+	converter, err := newContentConverter(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	trustExecutableBit, err := getTrustExecutableBit(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		if options.assumeUnchanged != nil {
+			entry := findEntry(path)
+			if entry == nil {
+				return nil, fmt.Errorf("unable to mark file %s: not in the index", path)
+			}
+			// The entry is copied, so that the cache tree sees the change
+			updatedEntry := *entry
+			if *options.assumeUnchanged {
+				updatedEntry.flags |= INDEX_ENTRY_ASSUME_VALID_FLAG
+			} else {
+				updatedEntry.flags &^= INDEX_ENTRY_ASSUME_VALID_FLAG
+			}
+			replaceEntries(path, &updatedEntry)
+			continue
+		}
+
+		if options.forceRemove {
+			replaceEntries(path, nil)
+			continue
+		}
+
+		if _, err := os.Lstat(filepath.Join(repoDir, path)); os.IsNotExist(err) {
+			if !options.remove {
+				return nil, fmt.Errorf("%s: does not exist and --remove not passed", path)
+			}
+			replaceEntries(path, nil)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to stat file %s: %s", path, err)
+		}
+
+		currEntry := findEntry(path)
+		if currEntry == nil && !options.add {
+			return nil, fmt.Errorf("%s: cannot add to the index - missing --add option?", path)
+		}
+		var currMode FileMode
+		if currEntry != nil {
+			currMode = currEntry.mode
+		}
+		entry, err := createIndexEntry(path, currMode, trustExecutableBit, converter, repoDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create index entry for '%s': %s", path, err)
+		}
+		replaceEntries(path, entry)
+	}
+
+	messages := []string{}
+	if options.refresh {
+		messages, err = refreshIndexEntries(entries, trustExecutableBit, converter, repoDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeUpdatedIndex(indexLock, index, entries); err != nil {
+		return nil, fmt.Errorf("failed to write updated Git index file: %s", err)
+	}
+	return messages, nil
+}
+
+// Refreshes the stat data of each index entry whose file is unchanged in the working tree, so that later commands
+// don't need to rehash it. Returns a message for each file which has changed (or been deleted) and so needs updating,
+// or has merge conflicts. Entries marked assume-unchanged or skip-worktree, and submodules, are skipped.
+func refreshIndexEntries(entries []*IndexEntry, trustExecutableBit bool, converter *ContentConverter, repoDir string) ([]string, error) {
+	indexModTime := getIndexModTime(repoDir)
+
+	messages := []string{}
+	reportedUnmerged := make(map[string]bool)
+	for i, entry := range entries {
+		if entry.stage() != 0 {
+			if !reportedUnmerged[entry.path] {
+				messages = append(messages, fmt.Sprintf("%s: needs merge", entry.path))
+				reportedUnmerged[entry.path] = true
+			}
+			continue
+		}
+		if entry.isAssumeValid() || entry.isSkipWorktree() || entry.mode == GITLINK_MODE {
+			continue
+		}
+
+		fullPath := filepath.Join(repoDir, entry.path)
+		info, err := os.Lstat(fullPath)
+		if os.IsNotExist(err) {
+			messages = append(messages, fmt.Sprintf("%s: needs update", entry.path))
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to stat file %s: %s", entry.path, err)
+		}
+		if isIndexEntryStatClean(entry, info, indexModTime) {
+			continue
+		}
+
+		workingTreeHash, err := HashBlobObjectFromFile(fullPath, converter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash file %s: %s", entry.path, err)
+		}
+		mode := getWorkingTreeFileMode(info.Mode(), entry.mode, trustExecutableBit)
+		if workingTreeHash != hex.EncodeToString(entry.sha1[:]) || mode != entry.mode {
+			messages = append(messages, fmt.Sprintf("%s: needs update", entry.path))
+			continue
+		}
+
+		refreshedEntry := *entry
+		setIndexEntryStatData(&refreshedEntry, info)
+		entries[i] = &refreshedEntry
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Represents the upstream configured for a local branch: the remote branch that it is compared against by
+// status, merged from by pull, and pushed to by push
+type BranchUpstream struct {
+	remote string
+	branch string // Without the refs/heads/ prefix
+}
+
+func (u *BranchUpstream) toString() string {
+	return u.remote + "/" + u.branch
+}
+
+// Returns the upstream configured for the given branch via its branch.<name>.remote and branch.<name>.merge
+// config variables, or nil if no upstream is configured
+func getBranchUpstream(branchName string, repoDir string) (*BranchUpstream, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository config: %s", err)
+	}
+
+	remote, hasRemote := config.get(fmt.Sprintf("branch.%s.remote", branchName))
+	merge, hasMerge := config.get(fmt.Sprintf("branch.%s.merge", branchName))
+	if !hasRemote || !hasMerge {
+		return nil, nil
+	}
+
+	return &BranchUpstream{
+		remote: remote,
+		branch: strings.TrimPrefix(merge, "refs/heads/"),
+	}, nil
+}
+
+// Returns the name of the branch on the given remote that the given local branch is pulled from and pushed to: its
+// configured upstream branch if that's on the same remote, or otherwise the remote branch of the same name
+func getUpstreamBranchName(branchName string, remoteName string, repoDir string) (string, error) {
+	upstream, err := getBranchUpstream(branchName, repoDir)
+	if err != nil {
+		return "", err
+	}
+
+	if upstream == nil || upstream.remote != remoteName {
+		return branchName, nil
+	}
+	return upstream.branch, nil
+}
+
+// Sets the upstream of the given branch to the given remote-tracking branch (e.g. origin/main), which must exist
+func setBranchUpstream(branchName string, upstreamName string, repoDir string) (*BranchUpstream, error) {
+	remote, upstreamBranch, found := strings.Cut(upstreamName, "/")
+	if !found || upstreamBranch == "" {
+		return nil, fmt.Errorf("invalid upstream %s: expected <remote>/<branch>", upstreamName)
+	}
+	_, exists, err := ResolveBranchRef(upstreamBranch, remote, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("the requested upstream branch '%s' does not exist", upstreamName)
+	}
+
+	upstream := &BranchUpstream{remote: remote, branch: upstreamBranch}
+	if err := writeBranchUpstream(branchName, upstream, repoDir); err != nil {
+		return nil, err
+	}
+	return upstream, nil
+}
+
+// Records the upstream of the given branch in the config, without checking that the upstream branch exists (e.g.
+// for a branch cloned from an empty repository, which has no remote-tracking branches yet)
+func writeBranchUpstream(branchName string, upstream *BranchUpstream, repoDir string) error {
+	configPath := getRepoConfigPath(repoDir)
+	if err := setConfigValue(configPath, fmt.Sprintf("branch.%s.remote", branchName), upstream.remote); err != nil {
+		return fmt.Errorf("failed to write upstream remote to config: %s", err)
+	}
+	if err := setConfigValue(configPath, fmt.Sprintf("branch.%s.merge", branchName), "refs/heads/"+upstream.branch); err != nil {
+		return fmt.Errorf("failed to write upstream branch to config: %s", err)
+	}
+	return nil
+}
+
+func unsetBranchUpstream(branchName string, repoDir string) error {
+	configPath := getRepoConfigPath(repoDir)
+
+	hadRemote, err := unsetConfigValue(configPath, fmt.Sprintf("branch.%s.remote", branchName))
+	if err != nil {
+		return fmt.Errorf("failed to remove upstream remote from config: %s", err)
+	}
+
+	hadMerge, err := unsetConfigValue(configPath, fmt.Sprintf("branch.%s.merge", branchName))
+	if err != nil {
+		return fmt.Errorf("failed to remove upstream branch from config: %s", err)
+	}
+
+	if !hadRemote && !hadMerge {
+		return fmt.Errorf("branch '%s' has no upstream information", branchName)
+	}
+
+	return nil
+}
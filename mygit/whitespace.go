@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Represents a kind of whitespace error which may be flagged in added lines, as named in the core.whitespace config
+// variable and the whitespace attribute. The rules in effect for a file are combined as a bit set.
+type WhitespaceRule int
+
+const (
+	WhitespaceBlankAtEOL       WhitespaceRule = 1 << iota // whitespace at the end of a line
+	WhitespaceSpaceBeforeTab                              // a space before a tab in the indentation of a line
+	WhitespaceIndentWithNonTab                            // a line indented with at least tabWidth spaces, rather than tabs
+	WhitespaceTabInIndent                                 // a tab in the indentation of a line
+	WhitespaceBlankAtEOF                                  // blank lines added at the end of a file
+	WhitespaceIncompleteLine                              // a last line without a newline at the end of a file
+	WhitespaceCRAtEOL                                     // not an error: allows a carriage return at the end of a line
+)
+
+// The names of the whitespace rules, in the order in which their errors are described
+var WHITESPACE_RULE_NAMES = []struct {
+	name        string
+	rule        WhitespaceRule
+	description string
+}{
+	{"blank-at-eol", WhitespaceBlankAtEOL, "trailing whitespace"},
+	{"space-before-tab", WhitespaceSpaceBeforeTab, "space before tab in indent"},
+	{"indent-with-non-tab", WhitespaceIndentWithNonTab, "indent with spaces"},
+	{"tab-in-indent", WhitespaceTabInIndent, "tab in indent"},
+	{"blank-at-eof", WhitespaceBlankAtEOF, "new blank line at EOF"},
+	{"incomplete-line", WhitespaceIncompleteLine, "no newline at the end of file"},
+	{"cr-at-eol", WhitespaceCRAtEOL, ""},
+}
+
+// The rules in effect unless core.whitespace or the whitespace attribute say otherwise. Git's defaults are extended
+// with incomplete-line, since a file missing its final newline is as much of a nuisance in a diff as trailing
+// whitespace.
+const DEFAULT_WHITESPACE_RULES = WhitespaceBlankAtEOL | WhitespaceSpaceBeforeTab | WhitespaceBlankAtEOF | WhitespaceIncompleteLine
+
+// The rules in effect for a file with the whitespace attribute set, which are all of the errors other than
+// tab-in-indent (which contradicts indent-with-non-tab), as in Git
+const ALL_WHITESPACE_RULES = WhitespaceBlankAtEOL | WhitespaceSpaceBeforeTab | WhitespaceIndentWithNonTab | WhitespaceBlankAtEOF | WhitespaceIncompleteLine
+
+const DEFAULT_WHITESPACE_TAB_WIDTH = 8
+
+// Represents the whitespace rules in effect for a file, along with the width of a tab used by indent-with-non-tab
+type WhitespaceRules struct {
+	rules    WhitespaceRule
+	tabWidth int
+}
+
+func (r WhitespaceRules) has(rule WhitespaceRule) bool {
+	return r.rules&rule != 0
+}
+
+// Represents the whitespace errors in a line added by a diff, at its 1-indexed line number in the new file. For
+// blank lines added at the end of the file, only the first is reported, without its content.
+type WhitespaceError struct {
+	path    string
+	lineNum int
+	errors  WhitespaceRule
+	line    string
+}
+
+// Formats the error as Git does, e.g. `file.txt:3: trailing whitespace.` followed by the added line
+func (e *WhitespaceError) format() string {
+	descriptions := []string{}
+	for _, ruleName := range WHITESPACE_RULE_NAMES {
+		if e.errors&ruleName.rule != 0 {
+			descriptions = append(descriptions, ruleName.description)
+		}
+	}
+
+	formatted := fmt.Sprintf("%s:%d: %s.\n", e.path, e.lineNum, strings.Join(descriptions, ", "))
+	if e.errors != WhitespaceBlankAtEOF {
+		formatted += "+" + strings.TrimSuffix(e.line, "\n") + "\n"
+	}
+	return formatted
+}
+
+// Parses a comma-separated list of whitespace rules, as given by core.whitespace or the whitespace attribute. Each
+// rule is enabled by naming it or disabled by prefixing its name with -, starting from the default rules.
+// trailing-space is shorthand for both blank-at-eol and blank-at-eof, and tabwidth=<n> sets the width of a tab.
+func parseWhitespaceRules(value string) (WhitespaceRules, error) {
+	rules := WhitespaceRules{rules: DEFAULT_WHITESPACE_RULES, tabWidth: DEFAULT_WHITESPACE_TAB_WIDTH}
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if tabWidth, isTabWidth := strings.CutPrefix(name, "tabwidth="); isTabWidth {
+			width, err := strconv.Atoi(tabWidth)
+			if err != nil || width < 1 || width > 63 {
+				return rules, fmt.Errorf("tabwidth %s out of range", tabWidth)
+			}
+			rules.tabWidth = width
+			continue
+		}
+
+		name, negated := strings.CutPrefix(name, "-")
+		var rule WhitespaceRule
+		if name == "trailing-space" {
+			rule = WhitespaceBlankAtEOL | WhitespaceBlankAtEOF
+		} else {
+			for _, ruleName := range WHITESPACE_RULE_NAMES {
+				if ruleName.name == name {
+					rule = ruleName.rule
+				}
+			}
+		}
+		if rule == 0 {
+			return rules, fmt.Errorf("unknown whitespace rule: %s", name)
+		}
+
+		if negated {
+			rules.rules &^= rule
+		} else {
+			rules.rules |= rule
+		}
+	}
+
+	if rules.has(WhitespaceTabInIndent) && rules.has(WhitespaceIndentWithNonTab) {
+		return rules, fmt.Errorf("cannot enforce both tab-in-indent and indent-with-non-tab")
+	}
+	return rules, nil
+}
+
+// Determines the whitespace rules for the files of a repository: those given by the core.whitespace config variable,
+// unless overridden for a file by its whitespace attribute
+type WhitespaceChecker struct {
+	attributes   *Attributes
+	defaultRules WhitespaceRules
+}
+
+func newWhitespaceChecker(repoDir string) (*WhitespaceChecker, error) {
+	config, err := readConfig(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %s", err)
+	}
+
+	coreWhitespace, _ := config.get("core.whitespace")
+	defaultRules, err := parseWhitespaceRules(coreWhitespace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid core.whitespace: %s", err)
+	}
+
+	attributes, err := readAttributes(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WhitespaceChecker{attributes: attributes, defaultRules: defaultRules}, nil
+}
+
+// Returns the whitespace rules for the given path. As in Git, setting the whitespace attribute enables all of the
+// errors, unsetting it disables them, and giving it a value applies that list of rules.
+func (c *WhitespaceChecker) getRules(path string) (WhitespaceRules, error) {
+	value, isSpecified := c.attributes.get(path, "whitespace")
+	switch {
+	case !isSpecified:
+		return c.defaultRules, nil
+	case value == ATTRIBUTE_SET:
+		return WhitespaceRules{rules: ALL_WHITESPACE_RULES, tabWidth: c.defaultRules.tabWidth}, nil
+	case value == ATTRIBUTE_UNSET:
+		return WhitespaceRules{tabWidth: c.defaultRules.tabWidth}, nil
+	}
+
+	rules, err := parseWhitespaceRules(value)
+	if err != nil {
+		return rules, fmt.Errorf("invalid whitespace attribute for %s: %s", path, err)
+	}
+	return rules, nil
+}
+
+// Returns the whitespace errors in the line (which keeps its trailing newline, if it has one). As in Git, only the
+// whitespace before the first other character is checked as indentation.
+func (r WhitespaceRules) checkLine(line string) WhitespaceRule {
+	var errors WhitespaceRule
+
+	content, hasNewline := strings.CutSuffix(line, "\n")
+	if !hasNewline && r.has(WhitespaceIncompleteLine) {
+		errors |= WhitespaceIncompleteLine
+	}
+	if r.has(WhitespaceCRAtEOL) {
+		content = strings.TrimSuffix(content, "\r")
+	}
+
+	indentEnd := len(content)
+	if r.has(WhitespaceBlankAtEOL) {
+		trimmed := strings.TrimRight(content, " \t\r\v\f")
+		if len(trimmed) < len(content) {
+			errors |= WhitespaceBlankAtEOL
+		}
+		indentEnd = len(trimmed)
+	}
+
+	// The position just after the last tab in the indentation
+	afterLastTab := 0
+	i := 0
+	for ; i < indentEnd; i++ {
+		if content[i] == ' ' {
+			continue
+		}
+		if content[i] != '\t' {
+			break
+		}
+		if r.has(WhitespaceSpaceBeforeTab) && afterLastTab < i {
+			errors |= WhitespaceSpaceBeforeTab
+		}
+		if r.has(WhitespaceTabInIndent) {
+			errors |= WhitespaceTabInIndent
+		}
+		afterLastTab = i + 1
+	}
+	if r.has(WhitespaceIndentWithNonTab) && i-afterLastTab >= r.tabWidth {
+		errors |= WhitespaceIndentWithNonTab
+	}
+
+	return errors
+}
+
+// Checks the lines added by the same set of changes shown by GetDiffChanges for whitespace errors, which pre-commit
+// workflows can use to reject changes introducing them. Only regular files are checked, and binary files are skipped.
+// As in Git, lines added to a file which are unchanged once the whitespace differences being ignored are removed
+// aren't checked.
+func CheckDiffWhitespace(cached bool, commitHash string, diffOptions DiffOptions, repoDir string) ([]*WhitespaceError, error) {
+	changes, err := GetDiffChanges(cached, commitHash, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	checker, err := newWhitespaceChecker(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	whitespaceErrors := []*WhitespaceError{}
+	for _, change := range changes {
+		if change.newFile == nil || (change.newFile.mode != REGULAR_FILE_MODE && change.newFile.mode != EXECUTABLE_FILE_MODE) {
+			continue
+		}
+
+		rules, err := checker.getRules(change.path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Whitespace is checked in the content as it's stored, rather than as converted by a textconv driver
+		oldContent, newContent, err := change.readContents(nil, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		if isBinaryContent(oldContent) || isBinaryContent(newContent) {
+			continue
+		}
+
+		whitespaceErrors = append(whitespaceErrors, checkAddedLines(change.path, splitLines(oldContent), splitLines(newContent), rules, diffOptions)...)
+	}
+
+	return whitespaceErrors, nil
+}
+
+func checkAddedLines(path string, oldLines []string, newLines []string, rules WhitespaceRules, diffOptions DiffOptions) []*WhitespaceError {
+	whitespaceErrors := []*WhitespaceError{}
+	for _, op := range diffLines(oldLines, newLines, diffOptions) {
+		if op.opType != DiffInsert {
+			continue
+		}
+		if errors := rules.checkLine(op.line); errors != 0 {
+			whitespaceErrors = append(whitespaceErrors, &WhitespaceError{path: path, lineNum: op.newLineNum + 1, errors: errors, line: op.line})
+		}
+	}
+
+	// Blank lines at the end of the file are only an error if the change adds more of them than there were before,
+	// in which case the first of them is reported
+	if rules.has(WhitespaceBlankAtEOF) {
+		oldBlankLines, newBlankLines := countTrailingBlankLines(oldLines), countTrailingBlankLines(newLines)
+		if newBlankLines > oldBlankLines {
+			lineNum := len(newLines) - newBlankLines + 1
+			whitespaceErrors = append(whitespaceErrors, &WhitespaceError{path: path, lineNum: lineNum, errors: WhitespaceBlankAtEOF})
+		}
+	}
+
+	return whitespaceErrors
+}
+
+// Returns the number of lines at the end of the file which contain only whitespace
+func countTrailingBlankLines(lines []string) int {
+	count := 0
+	for i := len(lines) - 1; i >= 0 && strings.TrimSpace(lines[i]) == ""; i-- {
+		count += 1
+	}
+	return count
+}
@@ -61,20 +61,3 @@ func zlibDecompress(r io.Reader) ([]byte, error) {
 
 	return decompressed, nil
 }
-
-func zlibDecompressWithReadCount(b []byte) ([]byte, int, error) {
-	r := bytes.NewReader(b)
-	zr, err := zlib.NewReader(r)
-	if err != nil {
-		return nil, 0, fmt.Errorf("failed to initialize zlib reader: %s", err)
-	}
-	defer zr.Close()
-
-	decompressed, err := io.ReadAll(zr)
-	if err != nil {
-		return nil, 0, fmt.Errorf("failed to decompress data with zlib: %s", err)
-	}
-
-	bytesRead := int(r.Size()) - r.Len()
-	return decompressed, bytesRead, nil
-}